@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// activityCheckInterval is how often the source is polled while waiting for it to become quiet
+const activityCheckInterval = 10 * time.Second
+
+// ActivityCheckOptions controls the pre-export source activity check
+type ActivityCheckOptions struct {
+	Skip         bool
+	Threshold    time.Duration // Transactions older than this count as long-running
+	WaitForQuiet time.Duration // How long to wait for the source to become quiet (0 = don't wait)
+	Strict       bool          // Abort instead of warning when activity is found
+}
+
+// sourceActivity is a single finding of the activity check
+type sourceActivity struct {
+	Kind   string // "transaction" or "lock"
+	Detail string
+}
+
+// checkSourceActivity looks for long-running transactions and exclusive locks
+// on the source that could conflict with pg_dump. Depending on the options it
+// warns, waits for the source to become quiet, or aborts.
+func checkSourceActivity(config *DatabaseConfig, opts *ActivityCheckOptions) error {
+	if opts.Skip {
+		logger.Info("Skipping source activity check")
+		return nil
+	}
+
+	logger.Info("Checking source for long-running transactions and exclusive locks...")
+
+	db, err := openDB(config, config.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	deadline := time.Now().Add(opts.WaitForQuiet)
+	for {
+		findings, err := querySourceActivity(db, opts.Threshold)
+		if err != nil {
+			warn(WarnSourceActivityCheckFailed, fmt.Sprintf("Source activity check failed (continuing): %v", err))
+			return nil
+		}
+
+		if len(findings) == 0 {
+			logger.Info("Source is quiet, no conflicting activity found")
+			return nil
+		}
+
+		warn(WarnSourceActivity, fmt.Sprintf("Found %d potentially conflicting activity item(s) on the source:", len(findings)))
+		for _, f := range findings {
+			logger.Warning(fmt.Sprintf("  [%s] %s", f.Kind, f.Detail))
+		}
+
+		if opts.WaitForQuiet > 0 {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("source did not become quiet within %s", opts.WaitForQuiet)
+			}
+			logger.Info(fmt.Sprintf("Waiting for the source to become quiet (up to %s remaining)...",
+				time.Until(deadline).Round(time.Second)))
+			time.Sleep(activityCheckInterval)
+			continue
+		}
+
+		if opts.Strict {
+			return fmt.Errorf("conflicting activity on source (use --wait-for-quiet or --skip-activity-check)")
+		}
+
+		logger.Warning("Continuing despite source activity; pg_dump may block or fail on lock conflicts")
+		return nil
+	}
+}
+
+func querySourceActivity(db *sql.DB, threshold time.Duration) ([]sourceActivity, error) {
+	var findings []sourceActivity
+
+	rows, err := db.Query(`
+		SELECT pid, coalesce(usename, ''), coalesce(state, ''),
+		       date_trunc('second', now() - xact_start)::text,
+		       left(coalesce(query, ''), 120)
+		FROM pg_stat_activity
+		WHERE datname = current_database()
+		  AND pid <> pg_backend_pid()
+		  AND xact_start IS NOT NULL
+		  AND now() - xact_start > make_interval(secs => $1)
+		ORDER BY xact_start`, threshold.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var pid int
+		var user, state, age, query string
+		if err := rows.Scan(&pid, &user, &state, &age, &query); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		findings = append(findings, sourceActivity{
+			Kind:   "transaction",
+			Detail: fmt.Sprintf("pid %d (%s, %s) open for %s: %s", pid, user, state, age, query),
+		})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`
+		SELECT l.pid, coalesce(l.relation::regclass::text, l.locktype)
+		FROM pg_locks l
+		JOIN pg_database d ON d.oid = l.database
+		WHERE d.datname = current_database()
+		  AND l.mode = 'AccessExclusiveLock'
+		  AND l.granted
+		  AND l.pid <> pg_backend_pid()
+		ORDER BY l.pid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pid int
+		var object string
+		if err := rows.Scan(&pid, &object); err != nil {
+			return nil, err
+		}
+		findings = append(findings, sourceActivity{
+			Kind:   "lock",
+			Detail: fmt.Sprintf("pid %d holds AccessExclusiveLock on %s", pid, object),
+		})
+	}
+	return findings, rows.Err()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// analyzeSlowestShown is how many of the slowest tables are logged
+const analyzeSlowestShown = 5
+
+// AnalyzeOptions controls the statistics refresh after data is loaded
+type AnalyzeOptions struct {
+	Skip   bool // --no-analyze
+	Vacuum bool // VACUUM ANALYZE instead of ANALYZE
+	Jobs   int  // Tables refreshed at once
+}
+
+// command is the statement run for each table
+func (o AnalyzeOptions) command() string {
+	if o.Vacuum {
+		return "VACUUM ANALYZE"
+	}
+	return "ANALYZE"
+}
+
+// AnalyzedTable is the statistics refresh of one table
+type AnalyzedTable struct {
+	Table   string  `json:"table"`
+	Seconds float64 `json:"seconds"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// AnalyzeReport records the statistics refresh after a data load
+type AnalyzeReport struct {
+	Command string          `json:"command"` // ANALYZE or VACUUM ANALYZE
+	Tables  []AnalyzedTable `json:"tables"`
+}
+
+// tablesNeedingAnalyze lists the tables changed since they were last
+// analyzed, or never analyzed at all, largest first so the big ones don't
+// end up last in a batch
+func tablesNeedingAnalyze(db *sql.DB) ([]string, error) {
+	rows, err := db.QueryContext(runContext(), `
+		SELECT quote_ident(schemaname) || '.' || quote_ident(relname)
+		FROM pg_stat_user_tables
+		WHERE n_mod_since_analyze > 0 OR (last_analyze IS NULL AND last_autoanalyze IS NULL)
+		ORDER BY pg_total_relation_size(relid) DESC, 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+// analyzeLoadedTables refreshes the statistics of the tables a data load
+// changed, options.Jobs at a time, so the first queries on the destination
+// are planned with them. Failures are warnings; a destination without
+// statistics still works, and autovacuum catches up eventually.
+func analyzeLoadedTables(dest *DatabaseConfig, options *AnalyzeOptions, state *RunState) error {
+	db, err := openDatabase(dest, dest.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(options.Jobs)
+
+	tables, err := tablesNeedingAnalyze(db)
+	if err != nil {
+		warn(WarnAnalyzeFailed, fmt.Sprintf("Could not list the tables to analyze: %v", err))
+		return runContext().Err()
+	}
+	if len(tables) == 0 {
+		logger.Info("No tables need new statistics")
+		return nil
+	}
+
+	command := options.command()
+	report := &AnalyzeReport{Command: command, Tables: make([]AnalyzedTable, len(tables))}
+	state.Analyze = report
+	jobs := min(options.Jobs, len(tables))
+	logger.Info(fmt.Sprintf("Running %s on %d table(s), %d at a time", command, len(tables), jobs))
+
+	started := time.Now()
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// SET ROLE holds for one connection, so each worker keeps its own
+			conn, err := db.Conn(runContext())
+			if err == nil && dest.Role != "" {
+				_, err = conn.ExecContext(runContext(), setRoleStatement(dest.Role))
+			}
+			if conn != nil {
+				defer conn.Close()
+			}
+			for i := range work {
+				result := AnalyzedTable{Table: tables[i]}
+				if err != nil {
+					result.Error = err.Error()
+					report.Tables[i] = result
+					continue
+				}
+				start := time.Now()
+				_, execErr := conn.ExecContext(runContext(), command+" "+tables[i])
+				result.Seconds = time.Since(start).Seconds()
+				if execErr != nil {
+					result.Error = execErr.Error()
+				}
+				report.Tables[i] = result
+				logger.Debug(fmt.Sprintf("%s %s took %s", command, tables[i], time.Since(start).Round(time.Millisecond)))
+			}
+		}()
+	}
+	for i := range tables {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	failed := 0
+	for _, t := range report.Tables {
+		if t.Error != "" {
+			failed++
+			warn(WarnAnalyzeFailed, fmt.Sprintf("%s %s failed: %s", command, t.Table, t.Error))
+		}
+	}
+
+	slowest := append([]AnalyzedTable{}, report.Tables...)
+	sort.SliceStable(slowest, func(i, j int) bool { return slowest[i].Seconds > slowest[j].Seconds })
+	if len(slowest) > analyzeSlowestShown {
+		slowest = slowest[:analyzeSlowestShown]
+	}
+	logger.Info(fmt.Sprintf("%s of %d table(s) took %s (%d failed); slowest:", command, len(tables), time.Since(started).Round(time.Second), failed))
+	for _, t := range slowest {
+		logger.Info(fmt.Sprintf("   %s: %s", t.Table, time.Duration(t.Seconds*float64(time.Second)).Round(time.Millisecond)))
+	}
+	return runContext().Err()
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newApplyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "apply [schema-file]",
+		Short: "Apply a schema file to the destination database",
+		Long: "Replace the destination database with an existing schema file, e.g. one written by --mode export. " +
+			"A directory dump, or a .tar or .tar.gz archive of one with its .sha256 checksum, is converted with pg_restore first. " +
+			"The destination is backed up, dropped, recreated and the schema applied as in direct mode. " +
+			"Use '-' to read the schema from stdin, or an s3://, gs:// or az:// URI to download it first.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: runApply,
+
+		PreRunE: promptRemembered,
+	}
+
+	cmd.Flags().StringP("schema-file", "f", "", "Schema file to apply, '-' to read it from stdin, or an s3://, gs:// or az:// URI")
+	cmd.Flags().IntP("preview-statements", "", 10, "Number of statements to print in a dry run")
+	return cmd
+}
+
+func runApply(cmd *cobra.Command, args []string) error {
+	// Keep stdout clean for the JSON plan
+	if format, _ := cmd.Flags().GetString("plan-format"); format == PlanFormatJSON {
+		logger.SetOutput(os.Stderr)
+	}
+
+	if err := configureCIOutput(cmd); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	logger.Info("Starting PostgreSQL schema apply...")
+	handleSignals()
+
+	schemaFile, err := applySchemaSource(cmd, args)
+	if err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	options, err := parseMigrationOptions(cmd)
+	if err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Failed to parse options: %v", err))
+	}
+
+	if destDB, _ := cmd.Flags().GetString("dest-db"); destDB == "" {
+		return exitWith(exitOptionError, errors.New("--dest-db is required for apply"))
+	}
+	if err := validateConnectionFlags(cmd, false, true); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	// Buffer stdin before anything connects, so an empty or broken stream
+	// is rejected before the destination is touched
+	if schemaFile == "-" {
+		schemaFile, err = bufferStdinToTempFile()
+		if err != nil {
+			return exitWith(exitFailure, fmt.Errorf("Failed to read schema from stdin: %v", err))
+		}
+	}
+
+	state, err := beginRun(cmd, options)
+	if err != nil {
+		return err
+	}
+
+	state.SchemaFile = schemaFile
+	if isSplitSchema(schemaFile) {
+		logger.Info(fmt.Sprintf("Split schema: %s", schemaFile))
+	} else if info, err := os.Stat(schemaFile); err == nil && info.IsDir() {
+		logger.Info(fmt.Sprintf("Schema directory dump: %s", schemaFile))
+	} else if !isDumpArchive(schemaFile) {
+		checksum, err := fileChecksum(schemaFile)
+		if err != nil {
+			return exitWith(exitFailure, fmt.Errorf("Failed to read schema file: %v", err))
+		}
+		logger.Info(fmt.Sprintf("Schema file sha256: %s", checksum))
+		if header, err := readFileHeader(schemaFile); err != nil {
+			warn(WarnFileHeaderInvalid, fmt.Sprintf("Could not read the schema file header: %v", err))
+		} else if header != nil {
+			state.SchemaHeader = header
+			logger.Info(fmt.Sprintf("Schema file generated by pg-schema-migrate %s from %s at %s", header.ToolVersion, header.Source, header.GeneratedAt.Format(time.RFC3339)))
+		}
+	}
+
+	if options.PlanOnly {
+		return runPlanOnly(cmd, schemaFile, options, state)
+	}
+
+	destConfig, err := getDestConfig(cmd, "")
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Failed to get destination config: %v", err))
+	}
+
+	// Directory dumps and their archives are applied as the script pg_restore makes of them
+	schemaFile, err = dumpScriptFor(destConfig, schemaFile)
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Failed to read the schema dump: %v", err))
+	}
+	if err := protectProduction(nil, destConfig, options); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+	if err := checkBlackout(options, state, time.Now()); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+	state.Dest = destConfig
+
+	if err := startTunnels(&options.SSH, destConfig); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("SSH tunnel setup failed: %v", err))
+	}
+
+	if err := validateDestinationConnection(destConfig); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Connection validation failed: %v", err))
+	}
+	if err := resolveDatabaseCase(destConfig, options, state); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+
+	if useKeyring, _ := cmd.Flags().GetBool("use-keyring"); useKeyring {
+		rememberPasswords(destConfig)
+	}
+
+	if err := prepareArtifactNames(options, state); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+
+	result, err := performSchemaApply(destConfig, schemaFile, options, state)
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Schema apply failed after %s: %v", result.Duration().Round(time.Second), err))
+	}
+
+	saveRemembered(cmd, destConfig)
+	if err := finishRun(state, options); err != nil {
+		return err
+	}
+	logger.Success(fmt.Sprintf("Schema apply completed successfully in %s!", result.Duration().Round(time.Second)))
+	return nil
+}
+
+// applySchemaSource returns the schema file given as argument or with
+// --schema-file.
+func applySchemaSource(cmd *cobra.Command, args []string) (string, error) {
+	schemaFile, _ := cmd.Flags().GetString("schema-file")
+	if len(args) == 1 {
+		if schemaFile != "" {
+			return "", fmt.Errorf("give the schema file either as argument or with --schema-file, not both")
+		}
+		schemaFile = args[0]
+	}
+	if schemaFile == "" {
+		return "", fmt.Errorf("a schema file is required (use '-' to read it from stdin)")
+	}
+
+	if schemaFile == "-" {
+		if passwordStdin, _ := cmd.Flags().GetBool("password-stdin"); passwordStdin {
+			return "", fmt.Errorf("--password-stdin cannot be used when the schema is read from stdin")
+		}
+		return schemaFile, nil
+	}
+	if isStorageURI(schemaFile) {
+		local, err := fetchArtifact(schemaFile)
+		if err != nil {
+			return "", fmt.Errorf("schema file not accessible: %v", err)
+		}
+		return local, nil
+	}
+
+	if _, err := os.Stat(schemaFile); err != nil {
+		return "", fmt.Errorf("schema file not accessible: %v", err)
+	}
+	return schemaFile, nil
+}
+
+// bufferStdinToTempFile copies stdin to a file in the scratch directory,
+// since psql needs a file to report errors against
+func bufferStdinToTempFile() (string, error) {
+	file, err := scratchFile("schema-*.sql")
+	if err != nil {
+		return "", err
+	}
+
+	n, err := io.Copy(file, os.Stdin)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return "", fmt.Errorf("stdin is empty")
+	}
+
+	logger.Info(fmt.Sprintf("Read %d bytes of schema from stdin", n))
+	return file.Name(), nil
+}
+
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// performSchemaApply applies schemaFile and returns the result of the run,
+// also when it fails
+func performSchemaApply(dest *DatabaseConfig, schemaFile string, options *MigrationOptions, state *RunState) (*RunResult, error) {
+	err := applySchemaFile(dest, schemaFile, options, state)
+	return state.finish(err), err
+}
+
+func applySchemaFile(dest *DatabaseConfig, schemaFile string, options *MigrationOptions, state *RunState) error {
+	timestamp := state.Timestamp()
+
+	if err := createDirectories(options); err != nil {
+		return fmt.Errorf("failed to create directories: %v", err)
+	}
+	err := state.phase("output-check", func() error {
+		return checkOutputLocations(dest, options, state)
+	})
+	if err != nil {
+		return fmt.Errorf("output directory check failed: %v", err)
+	}
+
+	if err := resolveCreateDatabaseOptions(nil, dest, &options.CreateDB); err != nil {
+		return fmt.Errorf("invalid destination database options: %v", err)
+	}
+
+	// Exported schemas are filtered by pg_dump; a given file is filtered here
+	if options.Comments != CommentsKeep {
+		filtered, err := filterCommentsToTempFile(schemaFile, options.Comments)
+		if err != nil {
+			return fmt.Errorf("failed to filter comments: %v", err)
+		}
+		schemaFile = filtered
+	}
+
+	if options.DryRun {
+		if err := previewStatements(schemaFile, options.PreviewStatements); err != nil {
+			warn(WarnSchemaPreviewFailed, fmt.Sprintf("Could not preview schema statements: %v", err))
+		}
+	}
+
+	return migrateDestination(dest, schemaFile, timestamp, options, state)
+}
+
+// previewStatements logs the first n statements of a SQL file. Statements are
+// split at lines ending in a semicolon outside dollar quotes, which is enough
+// for pg_dump output.
+func previewStatements(path string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	logger.Info(fmt.Sprintf("First %d statements of %s:", n, path))
+
+	var current []string
+	inDollarQuote := false
+	shown := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() && shown < n {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if len(current) == 0 && (trimmed == "" || strings.HasPrefix(trimmed, "--")) {
+			continue
+		}
+		current = append(current, line)
+		if strings.Count(line, "$$")%2 == 1 {
+			inDollarQuote = !inDollarQuote
+		}
+		if !inDollarQuote && strings.HasSuffix(trimmed, ";") {
+			shown++
+			logger.Info(fmt.Sprintf("   [%d] %s", shown, strings.Join(current, "\n       ")))
+			current = nil
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Export formats for --format
+const (
+	DumpFormatPlain     = "plain"     // One SQL file, post-processed and applied with psql
+	DumpFormatDirectory = "directory" // pg_dump -Fd, one file per table of contents entry
+)
+
+// checksumSuffix is appended to an archive's name for its sha256sum-style sidecar
+const checksumSuffix = ".sha256"
+
+// isDumpArchive reports whether path names a directory dump archived by --archive
+func isDumpArchive(path string) bool {
+	return strings.HasSuffix(path, ".tar") || strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz")
+}
+
+// archiveDumpDirectory packs the directory dump dir into a single tar file,
+// gzipped when compress is set, writes its checksum sidecar and removes dir.
+// The archive is written to a temporary file first, so a failure never leaves
+// a truncated archive under the final name.
+func archiveDumpDirectory(dir, archivePath string, compress bool) error {
+	tmp, err := os.CreateTemp(filepath.Dir(archivePath), ".pgsm-archive-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	var w io.Writer = tmp
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(tmp)
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), archivePath); err != nil {
+		return err
+	}
+	if err := writeChecksumSidecar(archivePath); err != nil {
+		return fmt.Errorf("failed to write checksum: %v", err)
+	}
+	return os.RemoveAll(dir)
+}
+
+// writeChecksumSidecar writes path's sha256 next to it, in the format of
+// sha256sum so `sha256sum -c` can check it too
+func writeChecksumSidecar(path string) error {
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%s  %s\n", checksum, filepath.Base(path))
+	return os.WriteFile(path+checksumSuffix, []byte(line), 0644)
+}
+
+// verifyChecksumSidecar checks path against its checksum sidecar. An archive
+// without one is refused, since nothing else says it arrived intact.
+func verifyChecksumSidecar(path string) (string, error) {
+	data, err := os.ReadFile(path + checksumSuffix)
+	if err != nil {
+		return "", fmt.Errorf("cannot read the checksum of %s: %v", path, err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || len(fields[0]) != 64 {
+		return "", fmt.Errorf("%s%s is not a sha256 checksum", path, checksumSuffix)
+	}
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(checksum, fields[0]) {
+		return "", fmt.Errorf("%s does not match its checksum (sha256 %s, expected %s); the archive is damaged or incomplete", path, checksum, fields[0])
+	}
+	return checksum, nil
+}
+
+// archiveEntryPath returns where the archive entry name goes inside dir, or
+// an error for names that would end up outside it
+func archiveEntryPath(dir, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("archive entry %q has an absolute path", name)
+	}
+	target := filepath.Join(dir, clean)
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) || !pathWithin(target, dir) {
+		return "", fmt.Errorf("archive entry %q points outside the archive", name)
+	}
+	return target, nil
+}
+
+// extractDumpArchive verifies a dump archive against its checksum and
+// extracts it into the scratch directory. Only regular files and directories
+// are extracted; links and devices, and any entry leaving the directory, fail
+// the extraction.
+func extractDumpArchive(path string) (string, error) {
+	checksum, err := verifyChecksumSidecar(path)
+	if err != nil {
+		return "", err
+	}
+	logger.Info(fmt.Sprintf("Archive %s matches its checksum (sha256 %s)", path, checksum))
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// Compression is told by the gzip magic, not the file name
+	br := bufio.NewReader(file)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return "", err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	dir, err := scratchDirectory("dump-*")
+	if err != nil {
+		return "", err
+	}
+
+	started := time.Now()
+	files := 0
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read archive: %v", err)
+		}
+		target, err := archiveEntryPath(dir, header.Name)
+		if err != nil {
+			return "", err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return "", err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return "", err
+			}
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return "", err
+			}
+			_, err = io.Copy(out, tr)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return "", err
+			}
+			files++
+		default:
+			return "", fmt.Errorf("archive entry %q is not a regular file or directory", header.Name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "toc.dat")); err != nil {
+		return "", fmt.Errorf("%s holds no pg_dump directory dump (toc.dat missing)", path)
+	}
+
+	logger.Info(fmt.Sprintf("Extracted %d file(s) to %s in %s", files, dir, time.Since(started).Round(time.Millisecond)))
+	return dir, nil
+}
+
+// restoreDumpToScript turns a directory dump into the plain SQL script psql
+// applies, with pg_restore writing to the scratch directory
+func restoreDumpToScript(config *DatabaseConfig, dir string) (string, error) {
+	tmp, err := scratchFile("restore-*.sql")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+
+	args := []string{"--no-owner", "-f", tmp.Name(), dir}
+	cmd := clientCommand(config, "pg_restore", args, tmp.Name(), dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("pg_restore failed: %v", err)
+	}
+	return tmp.Name(), nil
+}
+
+// dumpScriptFor returns the SQL script to apply for a schema source: a plain
+// file as it is, a split schema joined by its objects.map.json, a directory
+// dump or a dump archive through pg_restore
+func dumpScriptFor(config *DatabaseConfig, path string) (string, error) {
+	if isSplitSchema(path) {
+		return joinSplitSchema(path)
+	}
+	dir := path
+	if isDumpArchive(path) {
+		extracted, err := extractDumpArchive(path)
+		if err != nil {
+			return "", err
+		}
+		dir = extracted
+	} else if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return path, err
+	}
+	if err := checkDumpTOC(config, dir); err != nil {
+		return "", err
+	}
+	logger.Info(fmt.Sprintf("Converting the directory dump %s to a SQL script with pg_restore", path))
+	return restoreDumpToScript(config, dir)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Artifacts --artifact-name-template can name
+const (
+	ArtifactSchema   = "schema"
+	ArtifactBackup   = "backup"
+	ArtifactRollback = "rollback"
+	ArtifactRunDir   = "run-dir"
+)
+
+// defaultArtifactTemplates are the names used without
+// --artifact-name-template. Without a run directory, everything is written
+// to --output-dir itself.
+var defaultArtifactTemplates = map[string]string{
+	ArtifactSchema:   "schema_{{.SourceDB}}_{{.Timestamp}}.sql",
+	ArtifactBackup:   "backup_{{.DestDB}}_{{.Timestamp}}.sql",
+	ArtifactRollback: "rollback.sh",
+	ArtifactRunDir:   "",
+}
+
+// gitSchemaTemplate is the default schema name with --git: each export is a
+// new version of the same file, compared with the one HEAD has
+const gitSchemaTemplate = "schema_{{.SourceDB}}.sql"
+
+// ArtifactNameData are the fields available to --artifact-name-template
+type ArtifactNameData struct {
+	SourceDB  string
+	DestDB    string
+	Host      string // Of the destination, or of the source without one
+	Env       string // --dest-environment, or --source-environment without a destination
+	Timestamp string // Start of the run, YYYYMMDD_HHMMSS
+	Date      string // Start of the run, YYYYMMDD
+	RunLabel  string
+	Mode      string
+}
+
+// newArtifactNameData fills the template fields for a run; source or dest
+// may be nil
+func newArtifactNameData(source, dest *DatabaseConfig, timestamp string, state *RunState) ArtifactNameData {
+	data := ArtifactNameData{
+		Timestamp: timestamp,
+		Date:      strings.SplitN(timestamp, "_", 2)[0],
+		RunLabel:  state.Label,
+		Mode:      state.Mode,
+	}
+	if source != nil {
+		data.SourceDB, data.Host, data.Env = source.Database, source.Host, source.Environment
+	}
+	if dest != nil {
+		data.DestDB, data.Host, data.Env = dest.Database, dest.Host, dest.Environment
+	}
+	return data
+}
+
+// parseArtifactNameTemplates reads the kind=template values of
+// --artifact-name-template, trying each template before anything connects
+func parseArtifactNameTemplates(values []string) (map[string]string, error) {
+	templates := make(map[string]string)
+	for _, value := range values {
+		kind, text, ok := strings.Cut(value, "=")
+		if _, known := defaultArtifactTemplates[kind]; !ok || !known {
+			return nil, fmt.Errorf("--artifact-name-template %q must be <kind>=<template> with kind one of: %s", value, strings.Join(artifactKinds(), ", "))
+		}
+		if _, seen := templates[kind]; seen {
+			return nil, fmt.Errorf("--artifact-name-template %s is given more than once", kind)
+		}
+		if _, err := renderArtifactName(kind, text, ArtifactNameData{}); err != nil {
+			return nil, err
+		}
+		templates[kind] = text
+	}
+	return templates, nil
+}
+
+// artifactKinds lists the kinds of artifacts, sorted
+func artifactKinds() []string {
+	kinds := make([]string, 0, len(defaultArtifactTemplates))
+	for kind := range defaultArtifactTemplates {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// renderArtifactName evaluates the template of one artifact
+func renderArtifactName(kind, text string, data ArtifactNameData) (string, error) {
+	tmpl, err := template.New(kind).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid --artifact-name-template %s: %v", kind, err)
+	}
+	var name strings.Builder
+	if err := tmpl.Execute(&name, data); err != nil {
+		return "", fmt.Errorf("failed to render --artifact-name-template %s: %v", kind, err)
+	}
+	return strings.TrimSpace(name.String()), nil
+}
+
+// validateArtifactName keeps a rendered name inside the directory it is
+// relative to: no absolute paths, volumes or .. components
+func validateArtifactName(kind, name string) error {
+	if name == "" || filepath.Clean(name) == "." {
+		return fmt.Errorf("--artifact-name-template %s renders an empty name", kind)
+	}
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") || filepath.VolumeName(name) != "" {
+		return fmt.Errorf("--artifact-name-template %s renders %q, which must be relative to the output directory", kind, name)
+	}
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == filepath.Separator }) {
+		if part == ".." {
+			return fmt.Errorf("--artifact-name-template %s renders %q, which must not leave the output directory", kind, name)
+		}
+	}
+	return nil
+}
+
+// artifactPath is where an artifact of the run is written: its rendered name
+// in the run's output directory, or its backup directory for backups. It
+// doesn't create anything.
+func (o *MigrationOptions) artifactPath(kind string, data ArtifactNameData) (string, error) {
+	text, ok := o.ArtifactNames[kind]
+	switch {
+	case ok:
+	case kind == ArtifactSchema && o.Git.Enabled:
+		text = gitSchemaTemplate
+	default:
+		text = defaultArtifactTemplates[kind]
+	}
+	name, err := renderArtifactName(kind, text, data)
+	if err != nil {
+		return "", err
+	}
+	if err := validateArtifactName(kind, name); err != nil {
+		return "", err
+	}
+	base := o.OutputDir
+	if kind == ArtifactBackup {
+		base = o.BackupDir
+	}
+	return filepath.Join(base, filepath.FromSlash(name)), nil
+}
+
+// prepareArtifactNames moves the run into the directory --artifact-name-template
+// run-dir names, and checks before anything is written that the templated
+// names of the run neither collide with each other nor with files already
+// there. The manifest stays in --output-dir, next to those of earlier runs.
+func prepareArtifactNames(options *MigrationOptions, state *RunState) error {
+	if len(options.ArtifactNames) == 0 {
+		return nil
+	}
+	data := newArtifactNameData(state.Source, state.Dest, state.Timestamp(), state)
+
+	if text, ok := options.ArtifactNames[ArtifactRunDir]; ok {
+		name, err := renderArtifactName(ArtifactRunDir, text, data)
+		if err != nil {
+			return err
+		}
+		if err := validateArtifactName(ArtifactRunDir, name); err != nil {
+			return err
+		}
+		dir := filepath.Join(options.OutputDir, filepath.FromSlash(name))
+		if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+			return fmt.Errorf("run directory %s already exists and is not empty; make --artifact-name-template run-dir unique, e.g. with {{.Timestamp}}", dir)
+		}
+		options.OutputDir = dir
+		options.BackupDir = filepath.Join(dir, "backup")
+		state.RunDir = dir
+		logger.Info(fmt.Sprintf("Run directory: %s", dir))
+	}
+
+	kinds := []string{ArtifactRollback}
+	if options.CreateBackup && state.Dest != nil {
+		kinds = append(kinds, ArtifactBackup)
+	}
+	if state.Source != nil && options.Output == "" {
+		kinds = append(kinds, ArtifactSchema)
+	}
+	seen := make(map[string]string)
+	for _, kind := range kinds {
+		path, err := options.artifactPath(kind, data)
+		if err != nil {
+			return err
+		}
+		if other, ok := seen[path]; ok {
+			return fmt.Errorf("the %s and %s names both render to %s", other, kind, path)
+		}
+		seen[path] = kind
+		// With --git the schema file is meant to be replaced, as long as
+		// checkGitOutput finds it committed
+		if _, templated := options.ArtifactNames[kind]; !templated || (kind == ArtifactSchema && options.Git.Enabled) {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists; make --artifact-name-template %s unique, e.g. with {{.Timestamp}}", path, kind)
+		}
+	}
+	return nil
+}
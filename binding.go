@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// channelBindingModes are the values libpq accepts for channel_binding
+var channelBindingModes = []string{"disable", "prefer", "require"}
+
+// gssEncModes are the values libpq accepts for gssencmode
+var gssEncModes = []string{"disable", "prefer", "require"}
+
+// driverLimitation is appended to the errors for settings the driver of the
+// tool's own connections can't honor
+const driverLimitation = "pg_dump and psql would honor it, but %s, the driver of the tool's own connections, " +
+	"has no support for it and would connect without it"
+
+// clientSSLQuery and clientGSSQuery report how the connection of the client
+// tools was secured. pg_stat_gssapi only exists from PostgreSQL 12 on, which
+// GSSAPI encryption needs anyway, so it is only read when gssencmode is set.
+const (
+	clientSSLQuery = `SELECT coalesce((SELECT ssl FROM pg_stat_ssl WHERE pid = pg_backend_pid()), false)`
+	clientGSSQuery = `SELECT coalesce((SELECT encrypted FROM pg_stat_gssapi WHERE pid = pg_backend_pid()), false)`
+)
+
+// validateClientSecurity checks the channel binding of one side and
+// --gssencmode; either may be left empty.
+// Settings requiring what the driver backend can't do are refused: the tool's
+// own connections would silently go without them. Only pgx binds channels,
+// and neither backend encrypts with GSSAPI.
+func validateClientSecurity(channelBinding, gssEncMode, sslMode, driver string) error {
+	if channelBinding != "" && !slices.Contains(channelBindingModes, channelBinding) {
+		return fmt.Errorf("channel binding must be one of: %s", strings.Join(channelBindingModes, ", "))
+	}
+	if gssEncMode != "" && !slices.Contains(gssEncModes, gssEncMode) {
+		return fmt.Errorf("gssencmode must be one of: %s", strings.Join(gssEncModes, ", "))
+	}
+	if channelBinding == "require" && sslMode == "disable" {
+		return fmt.Errorf("channel binding needs SSL, but sslmode is disable")
+	}
+	if channelBinding == "require" && driver != DriverPGX {
+		return fmt.Errorf("channel binding require can't be honored: "+driverLimitation+"; use --driver pgx", "lib/pq")
+	}
+	if gssEncMode == "require" {
+		return fmt.Errorf("gssencmode require can't be honored: "+driverLimitation, "lib/pq or pgx")
+	}
+	return nil
+}
+
+// checkClientNegotiation connects with psql as pg_dump and psql will, with
+// the channel binding and GSSAPI encryption settings in the environment, and
+// logs how the connection was secured. It only runs when one of them is set.
+func checkClientNegotiation(config *DatabaseConfig, database, side string) error {
+	if config.ChannelBinding == "" && config.GSSEncMode == "" {
+		return nil
+	}
+
+	query := func(sql string) (bool, error) {
+		args := []string{"-h", config.Host, "-p", config.Port, "-U", config.Username, "-d", dbnameArg(database),
+			"-X", "-A", "-t", "-c", sql, "--no-password"}
+		out, err := clientCommand(config, "psql", args).CombinedOutput()
+		if err != nil {
+			return false, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return strings.TrimSpace(string(out)) == "t", nil
+	}
+
+	ssl, err := query(clientSSLQuery)
+	if err != nil {
+		return err
+	}
+	gss := false
+	if config.GSSEncMode != "" && config.GSSEncMode != "disable" {
+		if gss, err = query(clientGSSQuery); err != nil {
+			logger.Debug(fmt.Sprintf("Could not read the %s GSSAPI state from pg_stat_gssapi: %v", side, err))
+		}
+	}
+
+	var mechanism string
+	switch {
+	case gss:
+		mechanism = "GSSAPI encryption"
+	case ssl && config.ChannelBinding == "prefer":
+		mechanism = "SSL, with channel binding if the server authenticates with SCRAM"
+	case ssl && config.ChannelBinding == "disable":
+		mechanism = "SSL, without channel binding"
+	case ssl:
+		mechanism = "SSL"
+	default:
+		mechanism = "unencrypted"
+	}
+	if config.GSSEncMode == "prefer" && !gss {
+		mechanism += " (GSSAPI encryption was not negotiated)"
+	}
+	logger.Info(fmt.Sprintf("%s client tools connection: %s (channel_binding %s, gssencmode %s)", side, mechanism,
+		valueOr(config.ChannelBinding, "default"), valueOr(config.GSSEncMode, "default")))
+	return nil
+}
+
+// valueOr returns value, or fallback when it is empty
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configEnv names the config file when --config is not given
+const configEnv = "PGSM_CONFIG"
+
+// weekdays are the accepted weekday abbreviations of a blackout window
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// BlackoutWindow is a recurring change freeze during which direct-mode runs
+// are refused. Start and End are "Fri 16:00" for a weekly window or "22:00"
+// for a daily one; a window ending before it starts wraps around.
+type BlackoutWindow struct {
+	Name     string `json:"name,omitempty"`
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone,omitempty"` // IANA name, the local timezone when empty
+}
+
+func (w BlackoutWindow) String() string {
+	name := w.Name
+	if name == "" {
+		name = "blackout window"
+	}
+	timezone := w.Timezone
+	if timezone == "" {
+		timezone = "local time"
+	}
+	return fmt.Sprintf("%s (%s to %s %s)", name, w.Start, w.End, timezone)
+}
+
+// parseWindowTime returns the minute of the week ("Fri 16:00") or of the day
+// ("16:00") a window boundary falls on, and whether it names a weekday
+func parseWindowTime(s string) (int, bool, error) {
+	fields := strings.Fields(s)
+	var day time.Weekday
+	weekly := len(fields) == 2
+	if weekly {
+		d, ok := weekdays[strings.ToLower(fields[0])]
+		if !ok {
+			return 0, false, fmt.Errorf("unknown weekday %q in %q", fields[0], s)
+		}
+		day, fields = d, fields[1:]
+	}
+	if len(fields) != 1 {
+		return 0, false, fmt.Errorf("invalid time %q, expected e.g. \"Fri 16:00\" or \"16:00\"", s)
+	}
+	hours, minutes, ok := strings.Cut(fields[0], ":")
+	h, err := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	if !ok || err != nil || err2 != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+		return 0, false, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return int(day)*24*60 + h*60 + m, weekly, nil
+}
+
+// contains reports whether t falls inside the window
+func (w BlackoutWindow) contains(t time.Time) (bool, error) {
+	start, weekly, err := parseWindowTime(w.Start)
+	if err != nil {
+		return false, err
+	}
+	end, endWeekly, err := parseWindowTime(w.End)
+	if err != nil {
+		return false, err
+	}
+	if weekly != endWeekly {
+		return false, fmt.Errorf("start %q and end %q must both name a weekday or neither", w.Start, w.End)
+	}
+	location := time.Local
+	if w.Timezone != "" {
+		if location, err = time.LoadLocation(w.Timezone); err != nil {
+			return false, fmt.Errorf("unknown timezone %q: %v", w.Timezone, err)
+		}
+	}
+
+	t = t.In(location)
+	now := t.Hour()*60 + t.Minute()
+	if weekly {
+		now += int(t.Weekday()) * 24 * 60
+	}
+	if start <= end {
+		return start <= now && now < end, nil
+	}
+	return now >= start || now < end, nil
+}
+
+// loadBlackoutWindows reads the blackout_windows of a config file, which may
+// be the serve config file
+func loadBlackoutWindows(path string) ([]BlackoutWindow, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		BlackoutWindows []BlackoutWindow `json:"blackout_windows"`
+	}
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	if err := validateBlackoutWindows(config.BlackoutWindows); err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	return config.BlackoutWindows, nil
+}
+
+// validateBlackoutWindows checks the times and timezones of windows
+func validateBlackoutWindows(windows []BlackoutWindow) error {
+	for i, w := range windows {
+		if _, err := w.contains(time.Now()); err != nil {
+			return fmt.Errorf("blackout window %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// checkBlackout refuses runs that change a destination during a blackout
+// window unless --override-blackout is given, in which case the override is
+// recorded in the warnings and the run manifest. Dry runs are always allowed.
+func checkBlackout(options *MigrationOptions, state *RunState, now time.Time) error {
+	if options.DryRun {
+		return nil
+	}
+	for _, w := range options.BlackoutWindows {
+		inside, err := w.contains(now)
+		if err != nil {
+			return err
+		}
+		if !inside {
+			continue
+		}
+		if !options.OverrideBlackout {
+			return fmt.Errorf("inside blackout window %s; pass --override-blackout to run anyway", w)
+		}
+		warn(WarnBlackoutOverridden, fmt.Sprintf("Running inside blackout window %s (--override-blackout)", w))
+		state.BlackoutOverride = w.String()
+		return nil
+	}
+	return nil
+}
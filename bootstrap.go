@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// createExtensionPattern matches the CREATE EXTENSION statements of a plain-format dump
+var createExtensionPattern = regexp.MustCompile(`^CREATE EXTENSION (?:IF NOT EXISTS )?("(?:[^"]|"")*"|[^\s"]+) WITH SCHEMA ("(?:[^"]|"")*"|[^\s"]+);`)
+
+// BootstrapReport records how a --bootstrap run found and prepared the destination
+type BootstrapReport struct {
+	DatabaseExisted   bool     `json:"database_existed"`
+	ExistingObjects   int      `json:"existing_objects,omitempty"` // User objects found, only with --force
+	Forced            bool     `json:"forced,omitempty"`
+	Extensions        []string `json:"extensions,omitempty"`         // Required by the schema
+	CreatedExtensions []string `json:"created_extensions,omitempty"` // Created ahead of the apply
+}
+
+// schemaExtension is an extension a schema file creates, and the schema it goes in
+type schemaExtension struct {
+	Name   string
+	Schema string
+}
+
+// schemaFileExtensions lists the extensions a schema file creates
+func schemaFileExtensions(path string) ([]schemaExtension, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var extensions []schemaExtension
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if m := createExtensionPattern.FindStringSubmatch(scanner.Text()); m != nil {
+			extensions = append(extensions, schemaExtension{Name: unquoteRoleName(m[1]), Schema: unquoteRoleName(m[2])})
+		}
+	}
+	return extensions, scanner.Err()
+}
+
+// checkBootstrapTarget makes sure a --bootstrap run targets a new server: the
+// destination database must be missing or hold no user objects, unless
+// --force is given, and the extensions the schema needs must be available.
+func checkBootstrapTarget(dest *DatabaseConfig, schemaFile string, options *MigrationOptions, state *RunState) error {
+	report := &BootstrapReport{}
+	state.Bootstrap = report
+
+	exists, err := databaseExists(dest)
+	if err != nil {
+		return err
+	}
+	report.DatabaseExisted = exists
+	if exists {
+		db, err := openDatabase(dest, dest.Database)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		objects, err := listDatabaseObjects(db)
+		if err != nil {
+			return fmt.Errorf("failed to list destination objects: %v", err)
+		}
+		if len(objects) > 0 {
+			if !options.Force {
+				return fmt.Errorf("destination database '%s' is not empty (%d object(s), such as %s); --bootstrap only targets a new server or an empty database, pass --force to apply into it anyway",
+					dest.Database, len(objects), objects[0])
+			}
+			report.ExistingObjects = len(objects)
+			report.Forced = true
+			warn(WarnBootstrapNotEmpty, fmt.Sprintf("Destination database '%s' already holds %d object(s); applying into it because of --force", dest.Database, len(objects)))
+		} else {
+			logger.Info(fmt.Sprintf("Destination database '%s' exists and is empty; it is used as it is", dest.Database))
+		}
+	}
+
+	extensions, err := schemaFileExtensions(schemaFile)
+	if err != nil {
+		return fmt.Errorf("failed to read schema file: %v", err)
+	}
+	if len(extensions) == 0 {
+		return nil
+	}
+	server, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	var unavailable []string
+	for _, ext := range extensions {
+		report.Extensions = append(report.Extensions, ext.Name)
+		available, err := rowExists(server, `SELECT EXISTS(SELECT 1 FROM pg_available_extensions WHERE name = $1)`, ext.Name)
+		if err != nil {
+			return err
+		}
+		if !available {
+			unavailable = append(unavailable, ext.Name)
+		}
+	}
+	if len(unavailable) > 0 {
+		msg := fmt.Sprintf("%d extension(s) the schema needs are not available on %s: %s", len(unavailable), dest.Host, strings.Join(unavailable, ", "))
+		if options.DryRun {
+			warn(WarnExtensionsUnavailable, msg)
+			return nil
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// createBootstrapExtensions creates the extensions of the schema ahead of the
+// apply, so one that can't be created fails the run before anything else is
+// applied. Extensions going into schemas the dump creates itself are left to
+// the dump, whose CREATE SCHEMA would fail on a schema created ahead of it.
+func createBootstrapExtensions(dest *DatabaseConfig, schemaFile string, state *RunState) error {
+	extensions, err := schemaFileExtensions(schemaFile)
+	if err != nil || len(extensions) == 0 {
+		return err
+	}
+	db, err := openDatabase(dest, dest.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if state.Bootstrap == nil { // Resumed after the check
+		state.Bootstrap = &BootstrapReport{DatabaseExisted: true}
+	}
+	for _, ext := range extensions {
+		exists, err := rowExists(db, `SELECT EXISTS(SELECT 1 FROM pg_namespace WHERE nspname = $1)`, ext.Schema)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		statement := fmt.Sprintf("CREATE EXTENSION IF NOT EXISTS %s WITH SCHEMA %s", quoteIdentifier(ext.Name), quoteIdentifier(ext.Schema))
+		if _, err := db.ExecContext(runContext(), statement); err != nil {
+			return fmt.Errorf("failed to create extension %s: %v", ext.Name, err)
+		}
+		logger.Info(fmt.Sprintf("Created extension %s in schema %s", ext.Name, ext.Schema))
+		state.Bootstrap.CreatedExtensions = append(state.Bootstrap.CreatedExtensions, ext.Name)
+	}
+	return nil
+}
+
+// copySourceLocale makes a bootstrapped database use the encoding and locale
+// of the source, created from template0 since template1 may differ. An
+// explicit --dest-template decides them instead.
+func copySourceLocale(source *DatabaseConfig, opts *CreateDatabaseOptions) error {
+	if opts.Template != "" {
+		return nil
+	}
+	db, err := openDB(source, source.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = db.QueryRowContext(runContext(), `
+		SELECT pg_encoding_to_char(encoding), datcollate, datctype
+		FROM pg_database
+		WHERE datname = $1`, source.Database).Scan(&opts.Encoding, &opts.Collate, &opts.Ctype)
+	if err != nil {
+		return err
+	}
+	opts.Template = "template0"
+	logger.Info(fmt.Sprintf("Destination database will use the source encoding %s and locale %s", opts.Encoding, opts.Collate))
+	return nil
+}
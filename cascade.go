@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// dependentsMax bounds how many dependents are listed for one dropped object
+const dependentsMax = 100
+
+// dependentsQuery lists the objects depending directly on one object, or on
+// any of its columns. A view is reached through its rewrite rule and named as
+// the view. Internal dependencies, such as the row type of a table, are part
+// of the object; extension members and column defaults are left out.
+const dependentsQuery = `
+SELECT classid, objid, objsubid, deptype, pg_describe_object(classid, objid, objsubid)
+FROM (
+	SELECT DISTINCT
+		CASE WHEN d.classid = 'pg_rewrite'::regclass THEN 'pg_class'::regclass::oid ELSE d.classid END AS classid,
+		COALESCE(r.ev_class, d.objid) AS objid,
+		CASE WHEN d.classid = 'pg_rewrite'::regclass THEN 0 ELSE d.objsubid END AS objsubid,
+		d.deptype
+	FROM pg_depend d
+	LEFT JOIN pg_rewrite r ON d.classid = 'pg_rewrite'::regclass AND r.oid = d.objid
+	WHERE d.refclassid = $1 AND d.refobjid = $2 AND ($3 = 0 OR d.refobjsubid = $3)
+	  AND d.deptype IN ('n', 'a', 'i')
+	  AND d.classid <> 'pg_attrdef'::regclass
+) dependents
+ORDER BY 5`
+
+// dropTarget is an object a converge change drops, as the catalogs find it
+type dropTarget struct {
+	kind  string // relation, type, function, schema, extension, column or constraint
+	name  string // Quoted as in SQL; the table of a column or constraint
+	child string // The column or constraint, unquoted
+}
+
+// DropDependent is an object going with one a converge change drops
+type DropDependent struct {
+	Object  string `json:"object"`  // As pg_describe_object names it
+	Depth   int    `json:"depth"`   // 1 for a direct dependent
+	Cascade bool   `json:"cascade"` // Only dropped with CASCADE: a plain DROP fails on it
+}
+
+// catalogObject is an object as pg_depend refers to it
+type catalogObject struct {
+	classID uint32
+	objID   uint32
+	subID   int32
+}
+
+// entryDropTarget is what dropEntryStatement drops for a TOC entry
+func entryDropTarget(e dumpEntry) (dropTarget, bool) {
+	owner, name, pair := strings.Cut(e.Name, " ")
+	switch e.Type {
+	case "TABLE", "FOREIGN TABLE", "VIEW", "MATERIALIZED VIEW", "SEQUENCE", "INDEX":
+		return dropTarget{kind: "relation", name: e.qualified(e.Name)}, true
+	case "TYPE", "DOMAIN":
+		return dropTarget{kind: "type", name: e.qualified(e.Name)}, true
+	case "SCHEMA", "EXTENSION":
+		return dropTarget{kind: strings.ToLower(e.Type), name: e.Name}, true
+	case "FUNCTION", "PROCEDURE", "AGGREGATE":
+		if name, args, ok := strings.Cut(e.Name, "("); ok {
+			return dropTarget{kind: "function", name: e.qualified(name) + "(" + args}, true
+		}
+	case "CONSTRAINT", "FK CONSTRAINT", "CHECK CONSTRAINT":
+		if pair {
+			return dropTarget{kind: "constraint", name: e.qualified(owner), child: name}, true
+		}
+	}
+	return dropTarget{}, false
+}
+
+// withCascade adds CASCADE to a DROP statement. Dropping a column default
+// takes no CASCADE and is left as it is.
+func withCascade(statement string) string {
+	if statement == "" || strings.HasSuffix(statement, " DROP DEFAULT;") {
+		return statement
+	}
+	return strings.TrimSuffix(statement, ";") + " CASCADE;"
+}
+
+// resolveDropTarget finds a dropped object in the catalogs of db; ok is false
+// when it is not there
+func resolveDropTarget(db *sql.DB, target dropTarget) (catalogObject, bool, error) {
+	var query string
+	args := []any{target.name}
+	switch target.kind {
+	case "relation":
+		query = `SELECT 'pg_class'::regclass::oid, to_regclass($1)::oid, 0`
+	case "type":
+		query = `SELECT 'pg_type'::regclass::oid, to_regtype($1)::oid, 0`
+	case "function":
+		query = `SELECT 'pg_proc'::regclass::oid, to_regprocedure($1)::oid, 0`
+	case "schema":
+		query = `SELECT 'pg_namespace'::regclass::oid, oid, 0 FROM pg_namespace WHERE nspname = $1`
+	case "extension":
+		query = `SELECT 'pg_extension'::regclass::oid, oid, 0 FROM pg_extension WHERE extname = $1`
+	case "column":
+		query = `SELECT 'pg_class'::regclass::oid, attrelid, attnum FROM pg_attribute
+			WHERE attrelid = to_regclass($1) AND attname = $2 AND NOT attisdropped`
+		args = append(args, target.child)
+	case "constraint":
+		query = `SELECT 'pg_constraint'::regclass::oid, oid, 0 FROM pg_constraint
+			WHERE conrelid = to_regclass($1) AND conname = $2`
+		args = append(args, target.child)
+	default:
+		return catalogObject{}, false, nil
+	}
+
+	var object catalogObject
+	var objID sql.NullInt64
+	err := db.QueryRowContext(runContext(), query, args...).Scan(&object.classID, &objID, &object.subID)
+	if err == sql.ErrNoRows || (err == nil && !objID.Valid) {
+		return catalogObject{}, false, nil
+	}
+	object.objID = uint32(objID.Int64)
+	return object, err == nil, err
+}
+
+// dropDependents walks pg_depend from one dropped object and returns what
+// goes with it as a tree, depth first. Dependents reached through an
+// internal dependency are listed at the depth of the object they belong to.
+func dropDependents(db *sql.DB, root catalogObject) ([]DropDependent, bool, error) {
+	seen := map[catalogObject]bool{root: true}
+	var dependents []DropDependent
+	truncated := false
+
+	var walk func(object catalogObject, depth int) error
+	walk = func(object catalogObject, depth int) error {
+		rows, err := db.QueryContext(runContext(), dependentsQuery, object.classID, object.objID, object.subID)
+		if err != nil {
+			return err
+		}
+		type found struct {
+			object      catalogObject
+			deptype     string
+			description string
+		}
+		var direct []found
+		for rows.Next() {
+			var f found
+			if err := rows.Scan(&f.object.classID, &f.object.objID, &f.object.subID, &f.deptype, &f.description); err != nil {
+				rows.Close()
+				return err
+			}
+			direct = append(direct, f)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, f := range direct {
+			if seen[f.object] {
+				continue
+			}
+			seen[f.object] = true
+			if f.deptype == "i" {
+				if err := walk(f.object, depth); err != nil {
+					return err
+				}
+				continue
+			}
+			if len(dependents) == dependentsMax {
+				truncated = true
+				return nil
+			}
+			dependents = append(dependents, DropDependent{Object: f.description, Depth: depth, Cascade: f.deptype == "n"})
+			if err := walk(f.object, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := walk(root, 1)
+	return dependents, truncated, err
+}
+
+// previewDependents fills in the dependents of the destructive changes from
+// the catalogs of dest, before any of them is applied
+func previewDependents(dest *DatabaseConfig, changes []ConvergeChange) error {
+	db, err := openDatabase(dest, dest.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for i := range changes {
+		c := &changes[i]
+		for _, target := range c.targets {
+			root, ok, err := resolveDropTarget(db, target)
+			if err != nil {
+				return fmt.Errorf("failed to look up %s %s: %v", target.kind, target.name, err)
+			}
+			if !ok {
+				continue
+			}
+			dependents, truncated, err := dropDependents(db, root)
+			if err != nil {
+				return fmt.Errorf("failed to list what depends on %s %s: %v", target.kind, target.name, err)
+			}
+			c.Dependents = append(c.Dependents, dependents...)
+			if truncated {
+				logger.Warning(fmt.Sprintf("%s %s has more than %d dependents; only the first are listed", c.Action, c.Object, dependentsMax))
+			}
+		}
+	}
+	return nil
+}
+
+// dependentLines renders the dependents of a change as an indented tree
+func dependentLines(dependents []DropDependent, indent string) []string {
+	var lines []string
+	for _, d := range dependents {
+		note := "dropped with it"
+		if d.Cascade {
+			note = "needs CASCADE"
+		}
+		lines = append(lines, fmt.Sprintf("%s%s%s (%s)", indent, strings.Repeat("  ", d.Depth-1), d.Object, note))
+	}
+	return lines
+}
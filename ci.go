@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// OutputAdapter adapts log output to a CI system. Adapters get the first look
+// at every log line and can take it over, e.g. to turn it into an annotation.
+type OutputAdapter interface {
+	// Handle is called for each log line and returns true if it wrote the
+	// line itself, in which case the plain log line is skipped.
+	Handle(level, msg string) bool
+	// FileMessage reports a message tied to a line of a file
+	FileMessage(level, file string, line int, msg string)
+	StartGroup(name string)
+	EndGroup()
+	// WriteSummary publishes the run summary once the run has finished
+	WriteSummary(result *RunResult) error
+}
+
+// ciFormat is the output format selected by --ci, or detected from the CI
+// environment when the flag isn't given
+func ciFormat(cmd *cobra.Command) string {
+	ci, _ := cmd.Flags().GetString("ci")
+	if !cmd.Flags().Changed("ci") && os.Getenv("GITHUB_ACTIONS") == "true" {
+		ci = "github"
+	}
+	return ci
+}
+
+// ciMode reports whether the run is unattended in CI, where nobody reads a
+// warning: --ci selects a format, or CI=true is set as CI systems do. --ci
+// none turns it off.
+func ciMode(cmd *cobra.Command) bool {
+	switch ciFormat(cmd) {
+	case "none":
+		return false
+	case "":
+		return os.Getenv("CI") == "true"
+	}
+	return true
+}
+
+// configureCIOutput installs the output adapter selected by --ci, falling back
+// to auto-detection from the CI environment.
+func configureCIOutput(cmd *cobra.Command) error {
+	switch ci := ciFormat(cmd); ci {
+	case "", "none":
+		return nil
+	case "github":
+		logger.SetAdapter(&githubAdapter{summaryPath: os.Getenv("GITHUB_STEP_SUMMARY")})
+		return nil
+	default:
+		return fmt.Errorf("--ci must be 'github' or 'none', got %q", ci)
+	}
+}
+
+// githubAdapter emits GitHub Actions workflow commands to the logger's output
+type githubAdapter struct {
+	mu          sync.Mutex
+	summaryPath string
+}
+
+func (g *githubAdapter) Handle(level, msg string) bool {
+	command := githubCommand(level)
+	if command == "" {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(logger.Writer(), "::%s::%s\n", command, escapeGitHubData(msg))
+	return true
+}
+
+func (g *githubAdapter) FileMessage(level, file string, line int, msg string) {
+	command := githubCommand(level)
+	if command == "" {
+		command = "notice"
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(logger.Writer(), "::%s file=%s,line=%d::%s\n", command, escapeGitHubProperty(file), line, escapeGitHubData(msg))
+}
+
+func (g *githubAdapter) StartGroup(name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(logger.Writer(), "::group::%s\n", escapeGitHubData(name))
+}
+
+func (g *githubAdapter) EndGroup() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintln(logger.Writer(), "::endgroup::")
+}
+
+func (g *githubAdapter) WriteSummary(result *RunResult) error {
+	if g.summaryPath == "" {
+		return nil
+	}
+
+	var b strings.Builder
+	b.WriteString("## pg-schema-migrate\n\n")
+	if result.Success {
+		b.WriteString("**Result:** :white_check_mark: succeeded\n\n")
+	} else {
+		fmt.Fprintf(&b, "**Result:** :x: failed in phase `%s`\n\n", result.FailedPhase)
+		if result.Error != "" {
+			fmt.Fprintf(&b, "**Error:** %s\n\n", result.Error)
+		}
+	}
+	if result.TimedOut != "" {
+		fmt.Fprintf(&b, "**Time budget:** used up in phase `%s`\n\n", result.TimedOut)
+	}
+	if result.Source != nil {
+		if result.SourceReplica != nil {
+			fmt.Fprintf(&b, "**Source:** `%s` (replica %s, %s)\n\n", result.Source.Database, result.SourceReplica.Host, result.SourceReplica)
+		} else {
+			fmt.Fprintf(&b, "**Source:** `%s`\n\n", result.Source.Database)
+		}
+	}
+	if result.Destination != nil {
+		if result.Destination.Environment != "" {
+			fmt.Fprintf(&b, "**Destination:** `%s` (%s)\n\n", result.Destination.Database, result.Destination.Environment)
+		} else {
+			fmt.Fprintf(&b, "**Destination:** `%s`\n\n", result.Destination.Database)
+		}
+	}
+	if result.DestinationPath != "" {
+		fmt.Fprintf(&b, "**Strategy:** %s\n\n", destinationPathText(result.DestinationPath))
+	}
+	if result.RunLabel != "" {
+		fmt.Fprintf(&b, "**Run label:** `%s`\n\n", result.RunLabel)
+	}
+	if result.ObjectCounts != nil {
+		fmt.Fprintf(&b, "**Objects:** %d\n\n", totalObjects(result.ObjectCounts))
+	}
+
+	// Phases that ran concurrently show overlapping start offsets
+	b.WriteString("| Phase | Started | Duration | Status |\n")
+	b.WriteString("|-------|---------|----------|--------|\n")
+	for _, p := range result.Phases {
+		fmt.Fprintf(&b, "| %s | +%s | %s | %s |\n", p.Name, p.Started().Round(10*time.Millisecond), p.Duration().Round(10*time.Millisecond), p.Status)
+	}
+	b.WriteString("\n")
+
+	if result.ApplyErrorCount > 0 {
+		fmt.Fprintf(&b, "**Apply errors:** %d\n\n", result.ApplyErrorCount)
+		for _, e := range result.ApplyErrors {
+			fmt.Fprintf(&b, "- `%s:%d` %s\n", e.File, e.Line, e.Message)
+		}
+		b.WriteString("\n")
+	}
+
+	if slowest := slowestObjects(result.ObjectTimings, slowestObjectsShown); len(slowest) > 0 {
+		b.WriteString("**Slowest objects to apply:**\n\n")
+		b.WriteString("| Object | Line | Duration |\n")
+		b.WriteString("|--------|------|----------|\n")
+		for _, t := range slowest {
+			fmt.Fprintf(&b, "| `%s` | %d | %s |\n", t.Object, t.Line, objectSeconds(t.Seconds))
+		}
+		b.WriteString("\n")
+	}
+
+	if len(result.NonTransactional) > 0 {
+		fmt.Fprintf(&b, "**Run after the transaction:** %d statement(s)\n\n", len(result.NonTransactional))
+		for _, s := range result.NonTransactional {
+			fmt.Fprintf(&b, "- %s: line %d `%s` (%s)\n", s.Status, s.Line, firstLine(s.SQL), s.Reason)
+		}
+		b.WriteString("\n")
+	}
+
+	if result.Unlogged != nil {
+		if len(result.Unlogged.Converted) > 0 {
+			fmt.Fprintf(&b, "**Persistence changed (--unlogged %s):** %d\n\n", result.Unlogged.Mode, len(result.Unlogged.Converted))
+			for _, name := range result.Unlogged.Converted {
+				fmt.Fprintf(&b, "- `%s`\n", name)
+			}
+			b.WriteString("\n")
+		}
+		if len(result.Unlogged.Unlogged) > 0 {
+			fmt.Fprintf(&b, "**Unlogged:** %d\n\n", len(result.Unlogged.Unlogged))
+			for _, name := range result.Unlogged.Unlogged {
+				fmt.Fprintf(&b, "- `%s`\n", name)
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	if len(result.PinnedFunctions) > 0 {
+		fmt.Fprintf(&b, "**Pinned search_path:** %d function(s)\n\n", len(result.PinnedFunctions))
+		for _, name := range result.PinnedFunctions {
+			fmt.Fprintf(&b, "- `%s`\n", name)
+		}
+		b.WriteString("\n")
+	}
+
+	if len(result.Warnings) > 0 {
+		fmt.Fprintf(&b, "**Warnings:** %d\n\n", len(result.Warnings))
+		for _, w := range result.Warnings {
+			fmt.Fprintf(&b, "- `%s` %s\n", w.Code, w.Message)
+		}
+		b.WriteString("\n")
+	}
+
+	file, err := os.OpenFile(g.summaryPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(b.String()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func githubCommand(level string) string {
+	switch level {
+	case "ERROR":
+		return "error"
+	case "WARNING":
+		return "warning"
+	}
+	return ""
+}
+
+func escapeGitHubData(s string) string {
+	s = strings.ReplaceAll(s, "%", "%25")
+	s = strings.ReplaceAll(s, "\r", "%0D")
+	return strings.ReplaceAll(s, "\n", "%0A")
+}
+
+func escapeGitHubProperty(s string) string {
+	s = escapeGitHubData(s)
+	s = strings.ReplaceAll(s, ":", "%3A")
+	return strings.ReplaceAll(s, ",", "%2C")
+}
+
+// psqlMessagePattern matches psql's "psql:<file>:<line>: ERROR:  <msg>" lines
+var psqlMessagePattern = regexp.MustCompile(`^psql:(.+):(\d+): (ERROR|WARNING|NOTICE):\s+(.*)$`)
+
+// psqlStderr returns the writer psql's stderr should go to. With an output
+// adapter installed, error and warning lines are additionally reported
+// against the file and line psql names; with a collector, notices, warnings
+// and errors are recorded.
+func psqlStderr(notices *noticeCollector) io.Writer {
+	if logger.adapter == nil && notices == nil {
+		return os.Stderr
+	}
+	return &psqlMessageWriter{out: os.Stderr, adapter: logger.adapter, notices: notices}
+}
+
+// psqlMessageWriter passes output through and handles complete psql message lines
+type psqlMessageWriter struct {
+	out     io.Writer
+	adapter OutputAdapter
+	notices *noticeCollector
+	pending []byte
+
+	ran, file string // psql ran a copy of file at ran, and messages name file instead
+}
+
+func (w *psqlMessageWriter) Write(p []byte) (int, error) {
+	n, err := len(p), error(nil)
+	if w.ran == "" {
+		n, err = w.out.Write(p)
+	}
+	w.pending = append(w.pending, p[:n]...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(w.pending[:i]), "\r")
+		w.pending = w.pending[i+1:]
+		if w.ran != "" {
+			line = strings.ReplaceAll(line, "psql:"+w.ran+":", "psql:"+w.file+":")
+			if _, werr := fmt.Fprintln(w.out, line); werr != nil && err == nil {
+				err = werr
+			}
+		}
+
+		m := psqlMessagePattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		file, severity, msg := m[1], m[3], m[4]
+		lineNo, _ := strconv.Atoi(m[2])
+		if w.adapter != nil && severity != "NOTICE" {
+			w.adapter.FileMessage(severity, file, lineNo, msg)
+		}
+		if w.notices != nil {
+			if severity == "ERROR" {
+				w.notices.addError(file, lineNo, msg)
+			} else {
+				w.notices.add(severity, file, lineNo, msg)
+			}
+		}
+	}
+	return n, err
+}
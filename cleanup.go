@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	cleanupMu sync.Mutex
+	cleanups  []func()
+)
+
+// registerCleanup adds a function to run before the process exits, whether it
+// finishes normally, fails, or is interrupted by a signal.
+func registerCleanup(fn func()) {
+	cleanupMu.Lock()
+	defer cleanupMu.Unlock()
+	cleanups = append(cleanups, fn)
+}
+
+// runCleanups runs registered cleanups in reverse order of registration. Each
+// cleanup runs at most once.
+func runCleanups() {
+	cleanupMu.Lock()
+	fns := cleanups
+	cleanups = nil
+	cleanupMu.Unlock()
+
+	for i := len(fns) - 1; i >= 0; i-- {
+		fns[i]()
+	}
+}
+
+// exitError ends the run with an exit code other than exitFailure. A nil err
+// has been reported already.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error { return e.err }
+
+// exitWith has err end the run with code
+func exitWith(code int, err error) error {
+	return &exitError{code: code, err: err}
+}
+
+// exitCode is the exit code err ends the run with
+func exitCode(err error) int {
+	var e *exitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &e):
+		return e.code
+	}
+	return exitFailure
+}
+
+// execute runs the command line and returns its exit code. Commands return
+// their errors up to here instead of exiting, so their deferred functions
+// run; the error is logged once, and the registered cleanups run last.
+func execute(rootCmd *cobra.Command) int {
+	rootCmd.SilenceErrors = true
+	showUsageOnlyForFlags(rootCmd)
+	err := rootCmd.Execute()
+	if err != nil {
+		var e *exitError
+		switch {
+		case !errors.As(err, &e):
+			logger.Error(fmt.Sprintf("Command execution failed: %v", err))
+		case e.err != nil:
+			logger.Error(e.err.Error())
+		}
+	}
+	runCleanups()
+	return exitCode(err)
+}
+
+// showUsageOnlyForFlags keeps cobra from printing the usage of cmd and its
+// subcommands for an error of the run itself, once the command line has
+// been accepted
+func showUsageOnlyForFlags(cmd *cobra.Command) {
+	if run := cmd.RunE; run != nil {
+		cmd.RunE = func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return run(cmd, args)
+		}
+	}
+	for _, sub := range cmd.Commands() {
+		showUsageOnlyForFlags(sub)
+	}
+}
+
+// exitWithCleanup runs registered cleanups and exits with the given code. It
+// is only for an interrupted run; everything else returns its error to
+// execute.
+func exitWithCleanup(code int) {
+	runCleanups()
+	os.Exit(code)
+}
+
+// handleSignals runs registered cleanups when the process is interrupted
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Warning(fmt.Sprintf("Received %s, cleaning up...", sig))
+		exitWithCleanup(130)
+	}()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// fakeCleanups registers cleanups through registerCleanup and records the
+// order they ran in
+type fakeCleanups struct {
+	ran []string
+}
+
+func (f *fakeCleanups) register(name string) {
+	registerCleanup(func() { f.ran = append(f.ran, name) })
+}
+
+// captureLog sends the logger's output to a buffer for the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var b bytes.Buffer
+	previous := logger.Writer()
+	logger.SetOutput(&b)
+	t.Cleanup(func() { logger.SetOutput(previous) })
+	return &b
+}
+
+// Stages of a run, each registering a cleanup before the next starts
+var cleanupStages = []string{"password", "tunnel", "scratch", "lock", "upload"}
+
+func TestExecuteRunsCleanupsWhenAStageFails(t *testing.T) {
+	failures := []struct {
+		name string
+		err  error
+		code int
+		log  string // Expected in the log, "" for nothing logged
+	}{
+		{"error", errors.New("connection refused"), exitFailure, "Command execution failed: connection refused"},
+		{"wrapped", fmt.Errorf("apply: %w", errors.New("syntax error")), exitFailure, "Command execution failed: apply: syntax error"},
+		{"exitWith", exitWith(exitOptionError, errors.New("--dest-db is required")), exitOptionError, "--dest-db is required"},
+		{"exitWith reported", exitWith(exitWarnings, nil), exitWarnings, ""},
+		{"exitWith wrapped", fmt.Errorf("drift: %w", exitWith(exitDrift, nil)), exitDrift, ""},
+	}
+
+	for failAt := range cleanupStages {
+		for _, failure := range failures {
+			t.Run(fmt.Sprintf("%s/%s", cleanupStages[failAt], failure.name), func(t *testing.T) {
+				log := captureLog(t)
+				fake := &fakeCleanups{}
+				cmd := &cobra.Command{
+					Use: "run",
+					RunE: func(cmd *cobra.Command, args []string) error {
+						for i, stage := range cleanupStages {
+							fake.register(stage)
+							if i == failAt {
+								return failure.err
+							}
+						}
+						return nil
+					},
+				}
+				cmd.SetArgs(nil)
+				cmd.SetOut(&bytes.Buffer{})
+				cmd.SetErr(&bytes.Buffer{})
+
+				if code := execute(cmd); code != failure.code {
+					t.Errorf("exit code %d, want %d", code, failure.code)
+				}
+				want := slices.Clone(cleanupStages[:failAt+1])
+				slices.Reverse(want)
+				if !slices.Equal(fake.ran, want) {
+					t.Errorf("cleanups ran %q, want %q", fake.ran, want)
+				}
+				if failure.log == "" {
+					if strings.Contains(log.String(), "[ERROR]") {
+						t.Errorf("an error reported already was logged again:\n%s", log)
+					}
+				} else if n := strings.Count(log.String(), failure.log); n != 1 {
+					t.Errorf("error logged %d times, want once:\n%s", n, log)
+				}
+			})
+		}
+	}
+}
+
+func TestExecuteRunsCleanupsOnSuccess(t *testing.T) {
+	captureLog(t)
+	fake := &fakeCleanups{}
+	cmd := &cobra.Command{
+		Use: "run",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, stage := range cleanupStages {
+				fake.register(stage)
+			}
+			return nil
+		},
+	}
+	cmd.SetArgs(nil)
+	if code := execute(cmd); code != 0 {
+		t.Errorf("exit code %d, want 0", code)
+	}
+	if len(fake.ran) != len(cleanupStages) {
+		t.Errorf("cleanups ran %q", fake.ran)
+	}
+}
+
+func TestExecuteUsageOnlyForFlagErrors(t *testing.T) {
+	captureLog(t)
+	for _, test := range []struct {
+		args  []string
+		usage bool
+	}{
+		{[]string{"--no-such-flag"}, true},
+		{nil, false},
+	} {
+		var out bytes.Buffer
+		cmd := &cobra.Command{
+			Use:  "run",
+			RunE: func(cmd *cobra.Command, args []string) error { return errors.New("failed") },
+		}
+		cmd.SetArgs(test.args)
+		cmd.SetOut(&out)
+		cmd.SetErr(&out)
+		if code := execute(cmd); code != exitFailure {
+			t.Errorf("%q: exit code %d, want %d", test.args, code, exitFailure)
+		}
+		if got := strings.Contains(out.String(), "Usage:"); got != test.usage {
+			t.Errorf("%q: usage printed %v, want %v:\n%s", test.args, got, test.usage, out.String())
+		}
+	}
+}
+
+func TestRunCleanupsRunsEachOnce(t *testing.T) {
+	fake := &fakeCleanups{}
+	fake.register("first")
+	fake.register("second")
+	runCleanups()
+	runCleanups()
+	if want := []string{"second", "first"}; !slices.Equal(fake.ran, want) {
+		t.Errorf("cleanups ran %q, want %q", fake.ran, want)
+	}
+}
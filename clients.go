@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ClientToolOptions selects how pg_dump and psql are run
+type ClientToolOptions struct {
+	DockerImage     string // Run the tools with docker run in this image
+	DockerContainer string // Run the tools with docker exec in this container
+}
+
+// clientTools is set once from the command line flags
+var clientTools ClientToolOptions
+
+// warnedLocalhost makes sure the localhost translation is only reported once
+var warnedLocalhost bool
+
+// configureClientTools reads the --client-docker-* flags and checks that
+// docker is available when they are used.
+func configureClientTools(cmd *cobra.Command) error {
+	image, _ := cmd.Flags().GetString("client-docker-image")
+	container, _ := cmd.Flags().GetString("client-docker-container")
+
+	if image != "" && container != "" {
+		return fmt.Errorf("--client-docker-image and --client-docker-container are mutually exclusive")
+	}
+	if image == "" && container == "" {
+		return nil
+	}
+
+	if _, err := exec.LookPath("docker"); err != nil {
+		flag := "--client-docker-image"
+		if container != "" {
+			flag = "--client-docker-container"
+		}
+		return fmt.Errorf("%s needs the docker CLI, which was not found in PATH: install Docker or run without %s", flag, flag)
+	}
+
+	clientTools = ClientToolOptions{DockerImage: image, DockerContainer: container}
+	if container != "" {
+		logger.Info(fmt.Sprintf("Running pg_dump and psql in container %s; output paths must exist at the same location inside it", container))
+	} else {
+		logger.Info(fmt.Sprintf("Running pg_dump and psql in image %s", image))
+	}
+	return nil
+}
+
+// usesDocker reports whether client tools run inside docker
+func (c *ClientToolOptions) usesDocker() bool {
+	return c.DockerImage != "" || c.DockerContainer != ""
+}
+
+// clientCommand builds the command that runs tool (pg_dump or psql) with args
+// against config. files lists the local files the tool reads or writes; they
+// are mounted into the container when running through docker run.
+func clientCommand(config *DatabaseConfig, tool string, args []string, files ...string) *exec.Cmd {
+	return clientCommandEnv(config, nil, tool, args, files...)
+}
+
+// clientCommandEnv is clientCommand with extra environment variables. Each
+// command gets its own copy of the libpq environment for config, so commands
+// against different servers can run at the same time.
+func clientCommandEnv(config *DatabaseConfig, extra map[string]string, tool string, args []string, files ...string) *exec.Cmd {
+	env := pgEnv(config)
+	for name, value := range extra {
+		env[name] = value
+	}
+
+	var cmd *exec.Cmd
+	if !clientTools.usesDocker() {
+		cmd = exec.CommandContext(runContext(), tool, args...)
+	} else {
+		cmd = exec.CommandContext(runContext(), "docker", clientTools.dockerArgs(config, env, tool, args, files)...)
+	}
+	cmd.Env = os.Environ()
+	for name, value := range env {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	return cmd
+}
+
+func (c *ClientToolOptions) dockerArgs(config *DatabaseConfig, env map[string]string, tool string, args []string, files []string) []string {
+	var docker []string
+	if c.DockerContainer != "" {
+		docker = []string{"exec", "-i"}
+	} else {
+		docker = []string{"run", "--rm", "-i"}
+		if runtime.GOOS != "windows" {
+			docker = append(docker, "--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()))
+		}
+	}
+
+	// Pass the libpq environment by name so the password never appears in
+	// the docker command line
+	names := make([]string, 0)
+	for name := range env {
+		names = append(names, name)
+	}
+	if _, ok := os.LookupEnv("PGOPTIONS"); ok && env["PGOPTIONS"] == "" {
+		names = append(names, "PGOPTIONS")
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		docker = append(docker, "-e", name)
+	}
+
+	args = append([]string(nil), args...)
+	if c.DockerImage != "" {
+		mounts := make(map[string]bool)
+		for _, file := range append([]string{config.SSLRootCert, config.SSLCert, config.SSLKey}, files...) {
+			if file == "" {
+				continue
+			}
+			abs, err := filepath.Abs(file)
+			if err != nil {
+				continue
+			}
+			for i := range args {
+				if args[i] == file {
+					args[i] = abs
+				}
+			}
+			mounts[filepath.Dir(abs)] = true
+		}
+		if isUnixSocket(config.Host) {
+			mounts[config.Host] = true
+		}
+
+		dirs := make([]string, 0, len(mounts))
+		for dir := range mounts {
+			dirs = append(dirs, dir)
+		}
+		sort.Strings(dirs)
+		for _, dir := range dirs {
+			docker = append(docker, "-v", dir+":"+dir)
+		}
+
+		if isLocalHost(config.Host) {
+			if runtime.GOOS == "linux" {
+				docker = append(docker, "--network", "host")
+			} else {
+				for i := 0; i+1 < len(args); i++ {
+					if args[i] == "-h" {
+						args[i+1] = "host.docker.internal"
+					}
+				}
+				if !warnedLocalhost {
+					warn(WarnDockerLocalhost, fmt.Sprintf("Database host %s is local to this machine; the container connects through host.docker.internal instead", config.Host))
+					warnedLocalhost = true
+				}
+			}
+		}
+		docker = append(docker, c.DockerImage)
+	} else {
+		docker = append(docker, c.DockerContainer)
+	}
+
+	docker = append(docker, tool)
+	return append(docker, args...)
+}
+
+// isLocalHost reports whether host refers to the loopback interface
+func isLocalHost(host string) bool {
+	switch strings.ToLower(host) {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
+
+// plainArgPattern matches arguments that need no shell quoting
+var plainArgPattern = regexp.MustCompile(`^[A-Za-z0-9_./:=@%+,-]+$`)
+
+// secretSettingPattern matches setting names whose values are not shown
+var secretSettingPattern = regexp.MustCompile(`(?i)password|secret|token|key`)
+
+// redactOptions returns connection options for display, with the values of
+// settings that look secret masked
+func redactOptions(options string) string {
+	fields := strings.Fields(options)
+	for i, field := range fields {
+		name, _, ok := strings.Cut(strings.TrimLeft(strings.TrimPrefix(field, "-c"), "-"), "=")
+		if ok && secretSettingPattern.MatchString(name) {
+			fields[i] = field[:strings.Index(field, "=")+1] + "*****"
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// commandLine renders cmd as a shell command line for display, with the
+// PGOPTIONS it gets in front, since they change what it does
+func commandLine(cmd *exec.Cmd) string {
+	parts := make([]string, 0, len(cmd.Args)+1)
+	for i := len(cmd.Env) - 1; i >= 0; i-- {
+		if options, ok := strings.CutPrefix(cmd.Env[i], "PGOPTIONS="); ok {
+			if options != "" {
+				parts = append(parts, "PGOPTIONS="+shellQuote(redactOptions(options)))
+			}
+			break
+		}
+	}
+	for _, arg := range cmd.Args {
+		if plainArgPattern.MatchString(arg) {
+			parts = append(parts, arg)
+		} else {
+			parts = append(parts, shellQuote(arg))
+		}
+	}
+	return strings.Join(parts, " ")
+}
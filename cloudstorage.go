@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/oauth2/google"
+)
+
+// s3Storage is a prefix of an S3 bucket. Uploads are multipart, so a stream
+// of any length goes up without being buffered whole; the SDK retries failed
+// requests.
+type s3Storage struct {
+	client *s3.Client
+	upload *transfermanager.Client
+	bucket string
+	prefix string
+}
+
+// openS3Storage loads the AWS configuration the way setupIAMAuth does, with
+// --aws-region and --aws-profile. An S3-compatible service is reached with
+// AWS_ENDPOINT_URL_S3.
+func openS3Storage(ctx context.Context, bucket, prefix string, awsOpts *AWSOptions) (*s3Storage, error) {
+	loadOpts := []func(*awsconfig.LoadOptions) error{awsconfig.WithRetryMaxAttempts(storageAttempts)}
+	if awsOpts != nil && awsOpts.Region != "" {
+		loadOpts = append(loadOpts, awsconfig.WithRegion(awsOpts.Region))
+	}
+	if awsOpts != nil && awsOpts.Profile != "" {
+		loadOpts = append(loadOpts, awsconfig.WithSharedConfigProfile(awsOpts.Profile))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %v", err)
+	}
+	if cfg.Region == "" {
+		return nil, fmt.Errorf("no AWS region configured for s3://%s (set AWS_REGION or pass --aws-region)", bucket)
+	}
+	client := s3.NewFromConfig(cfg)
+	return &s3Storage{client: client, upload: transfermanager.New(client), bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *s3Storage) String() string { return "s3://" + strings.TrimSuffix(s.bucket+"/"+s.prefix, "/") }
+
+func (s *s3Storage) Put(ctx context.Context, name string, r io.Reader) error {
+	_, err := s.upload.UploadObject(ctx, &transfermanager.UploadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(storageName(s.prefix, name)),
+		Body:   r,
+	})
+	return err
+}
+
+func (s *s3Storage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(storageName(s.prefix, name))})
+	var noSuchKey *s3types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, fmt.Errorf("s3://%s/%s: %w", s.bucket, storageName(s.prefix, name), fs.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *s3Storage) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{Bucket: aws.String(s.bucket), Prefix: aws.String(storageListPrefix(s.prefix, prefix))})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			names = append(names, strings.TrimPrefix(aws.ToString(object.Key), s.prefix+"/"))
+		}
+	}
+	return names, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(storageName(s.prefix, name))})
+	return err
+}
+
+// gcsStorage is a prefix of a Google Cloud Storage bucket, reached through
+// its JSON API. STORAGE_EMULATOR_HOST points it at an emulator, as it does
+// Google's client libraries.
+type gcsStorage struct {
+	client   *http.Client
+	endpoint string
+	bucket   string
+	prefix   string
+}
+
+const gcsEndpoint = "https://storage.googleapis.com"
+
+// openGCSStorage authenticates with the application default credentials:
+// GOOGLE_APPLICATION_CREDENTIALS, gcloud's login, or the metadata server of
+// the machine
+func openGCSStorage(ctx context.Context, bucket, prefix string) (*gcsStorage, error) {
+	s := &gcsStorage{client: http.DefaultClient, endpoint: gcsEndpoint, bucket: bucket, prefix: prefix}
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		s.endpoint = strings.TrimSuffix(host, "/")
+		if !strings.Contains(host, "://") {
+			s.endpoint = "http://" + s.endpoint
+		}
+		return s, nil
+	}
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/devstorage.read_write")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find Google credentials for gs://%s: %v", bucket, err)
+	}
+	s.client = client
+	return s, nil
+}
+
+func (s *gcsStorage) String() string { return "gs://" + strings.TrimSuffix(s.bucket+"/"+s.prefix, "/") }
+
+func (s *gcsStorage) objectURL(name string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", s.endpoint, url.PathEscape(s.bucket), url.PathEscape(storageName(s.prefix, name)))
+}
+
+// gcsError is a response of the JSON API other than success
+type gcsError struct {
+	status int
+	body   string
+}
+
+func (e *gcsError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.status, strings.TrimSpace(e.body))
+}
+
+// gcsRetryable reports whether a request may succeed when repeated: on
+// network errors, rate limiting and server errors, as Google advises
+func gcsRetryable(err error) bool {
+	var e *gcsError
+	if errors.As(err, &e) {
+		return e.status == http.StatusTooManyRequests || e.status == http.StatusRequestTimeout || e.status >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// do sends a request and returns the response of a success. A body that can
+// be rewound, like a file, is sent with its length and rewound before each
+// retry; any other is streamed once.
+func (s *gcsStorage) do(ctx context.Context, method, target string, body io.Reader) (*http.Response, error) {
+	seeker, rewindable := body.(io.Seeker)
+	retryable := gcsRetryable
+	if body != nil && !rewindable {
+		retryable = func(error) bool { return false }
+	}
+	var start, length int64
+	if rewindable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		if length, err = seeker.Seek(0, io.SeekEnd); err != nil {
+			return nil, err
+		}
+		length -= start
+	}
+
+	var resp *http.Response
+	err := retryStorage(ctx, method+" "+target, retryable, func() error {
+		if rewindable {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = io.NopCloser(body) // The transport would close it after the first attempt
+		}
+		req, err := http.NewRequestWithContext(ctx, method, target, reqBody)
+		if err != nil {
+			return err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		if rewindable {
+			req.ContentLength = length
+		}
+		if resp, err = s.client.Do(req); err != nil {
+			return err
+		}
+		if resp.StatusCode/100 != 2 {
+			text, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			return &gcsError{status: resp.StatusCode, body: string(text)}
+		}
+		return nil
+	})
+	var e *gcsError
+	if errors.As(err, &e) && e.status == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", target, fs.ErrNotExist)
+	}
+	return resp, err
+}
+
+func (s *gcsStorage) Put(ctx context.Context, name string, r io.Reader) error {
+	target := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s", s.endpoint, url.PathEscape(s.bucket), url.QueryEscape(storageName(s.prefix, name)))
+	resp, err := s.do(ctx, http.MethodPost, target, r)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *gcsStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(name)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *gcsStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	full := storageListPrefix(s.prefix, prefix)
+	token := ""
+	for {
+		query := url.Values{"prefix": {full}, "fields": {"items(name),nextPageToken"}}
+		if token != "" {
+			query.Set("pageToken", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, fmt.Sprintf("%s/storage/v1/b/%s/o?%s", s.endpoint, url.PathEscape(s.bucket), query.Encode()), nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid object list from gs://%s: %v", s.bucket, err)
+		}
+		for _, item := range page.Items {
+			names = append(names, strings.TrimPrefix(item.Name, s.prefix+"/"))
+		}
+		if token = page.NextPageToken; token == "" {
+			return names, nil
+		}
+	}
+}
+
+func (s *gcsStorage) Delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.objectURL(name), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// azureStorage is a prefix of an Azure Blob Storage container. Uploads are
+// sent in blocks, so a stream of any length goes up without being buffered
+// whole; the SDK retries failed requests.
+type azureStorage struct {
+	client    *azblob.Client
+	account   string
+	container string
+	prefix    string
+}
+
+// openAzureStorage uses AZURE_STORAGE_CONNECTION_STRING when it is set, and
+// otherwise the default Azure credential: environment, workload or managed
+// identity, or the az CLI's login
+func openAzureStorage(account, container, prefix string) (*azureStorage, error) {
+	s := &azureStorage{account: account, container: container, prefix: prefix}
+	var err error
+	if conn := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); conn != "" {
+		s.client, err = azblob.NewClientFromConnectionString(conn, nil)
+	} else {
+		var cred *azidentity.DefaultAzureCredential
+		if cred, err = azidentity.NewDefaultAzureCredential(nil); err != nil {
+			return nil, fmt.Errorf("failed to find Azure credentials for az://%s/%s: %v", account, container, err)
+		}
+		s.client, err = azblob.NewClient(fmt.Sprintf("https://%s.blob.core.windows.net/", account), cred, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open az://%s/%s: %v", account, container, err)
+	}
+	return s, nil
+}
+
+func (s *azureStorage) String() string {
+	return "az://" + strings.TrimSuffix(s.account+"/"+s.container+"/"+s.prefix, "/")
+}
+
+func (s *azureStorage) Put(ctx context.Context, name string, r io.Reader) error {
+	_, err := s.client.UploadStream(ctx, s.container, storageName(s.prefix, name), r, nil)
+	return err
+}
+
+func (s *azureStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.client.DownloadStream(ctx, s.container, storageName(s.prefix, name), nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil, fmt.Errorf("%s/%s: %w", s, name, fs.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *azureStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	full := storageListPrefix(s.prefix, prefix)
+	pages := s.client.NewListBlobsFlatPager(s.container, &azblob.ListBlobsFlatOptions{Prefix: &full})
+	for pages.More() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range page.Segment.BlobItems {
+			names = append(names, strings.TrimPrefix(*blob.Name, s.prefix+"/"))
+		}
+	}
+	return names, nil
+}
+
+func (s *azureStorage) Delete(ctx context.Context, name string) error {
+	_, err := s.client.DeleteBlob(ctx, s.container, storageName(s.prefix, name), nil)
+	return err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"pg-schema-migrator/internal/dumpparse"
+)
+
+// clusterStatementPatterns match the statements of a schema file that change
+// the destination server as a whole rather than the destination database:
+// its configuration, its superusers and its tablespaces
+var clusterStatementPatterns = []struct {
+	pattern *regexp.Regexp
+	what    string
+}{
+	{regexp.MustCompile(`(?is)^ALTER\s+SYSTEM\b`), "ALTER SYSTEM"},
+	{regexp.MustCompile(`(?is)^(?:CREATE|ALTER)\s+(?:ROLE|USER|GROUP)\b.*\bSUPERUSER\b`), "role with SUPERUSER"},
+	{regexp.MustCompile(`(?is)^CREATE\s+TABLESPACE\b`), "CREATE TABLESPACE"},
+}
+
+// quotedPattern matches string literals, quoted identifiers and comments,
+// which are blanked out before matching: a role named "superuser" isn't one,
+// and a comment doesn't hide the statement after it
+var quotedPattern = regexp.MustCompile(`(?s)'(?:[^']|'')*'|"(?:[^"]|"")*"|/\*.*?\*/|--[^\n]*`)
+
+// blankQuoted blanks out what quotedPattern matches
+func blankQuoted(text string) string {
+	return strings.TrimSpace(quotedPattern.ReplaceAllStringFunc(text, func(s string) string {
+		if strings.HasPrefix(s, "/*") || strings.HasPrefix(s, "--") {
+			return " "
+		}
+		return "''"
+	}))
+}
+
+// findClusterStatements lists the statements of a plain schema file matching
+// clusterStatementPatterns, as "line N: <what>: <first line>". The file is
+// split with the dump parser, so text in function bodies, string literals
+// and comments is never taken for a statement.
+func findClusterStatements(schemaFile string) ([]string, error) {
+	data, err := os.ReadFile(schemaFile)
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	for _, s := range dumpparse.Statements(string(data)) {
+		text := blankQuoted(s.Text)
+		for _, p := range clusterStatementPatterns {
+			if p.pattern.MatchString(text) {
+				found = append(found, fmt.Sprintf("line %d: %s: %s", s.Line, p.what, firstLine(s.Text)))
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+// checkClusterStatements refuses a schema file that would reconfigure the
+// destination server, as files concatenated with a roles dump or a server
+// setup script do, unless --allow-cluster-statements is given. Directory
+// dumps and archives hold the objects of one database only.
+func checkClusterStatements(schemaFile string, options *MigrationOptions) error {
+	if info, err := os.Stat(schemaFile); err != nil || info.IsDir() || isDumpArchive(schemaFile) {
+		return err
+	}
+	found, err := findClusterStatements(schemaFile)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	if options.AllowClusterStatements {
+		warn(WarnClusterStatements, fmt.Sprintf("%s has %d statement(s) changing the whole server, applied because of --allow-cluster-statements:\n   %s",
+			schemaFile, len(found), strings.Join(found, "\n   ")))
+		return nil
+	}
+	return fmt.Errorf("%s has %d statement(s) changing the whole server rather than the destination database. Remove them, or pass --allow-cluster-statements:\n   %s",
+		schemaFile, len(found), strings.Join(found, "\n   "))
+}
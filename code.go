@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Kinds of stored code, in the order they are applied
+const (
+	CodeFunction         = "FUNCTION"
+	CodeProcedure        = "PROCEDURE"
+	CodeView             = "VIEW"
+	CodeMaterializedView = "MATERIALIZED VIEW"
+	CodeTrigger          = "TRIGGER"
+)
+
+// userSchemas restricts a catalog query aliasing pg_namespace as n to user schemas
+const userSchemas = `n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname !~ '^pg_(toast|temp)'`
+
+// notExtensionMember excludes objects that belong to an extension
+const notExtensionMember = `NOT EXISTS (SELECT 1 FROM pg_depend e WHERE e.classid = '%s'::regclass AND e.objid = %s AND e.deptype = 'e')`
+
+// replaceFailedCodes are the errors CREATE OR REPLACE raises when an object
+// can't be changed in place, e.g. a new return type or dropped view columns
+var replaceFailedCodes = map[string]bool{
+	"42P13": true, // invalid_function_definition
+	"42P16": true, // invalid_table_definition
+	"42804": true, // datatype_mismatch
+	"42809": true, // wrong_object_type
+}
+
+// CodeObject is a function, procedure, view, materialized view or trigger as
+// stored in the catalog
+type CodeObject struct {
+	Kind       string
+	Name       string // Qualified; routines with their argument types, triggers with their table
+	Definition string // Statements creating the object
+
+	catalog string   // pg_proc, pg_class or pg_trigger
+	oid     uint32   // Within catalog
+	reads   []uint32 // Views and materialized views a view reads from
+}
+
+func (o *CodeObject) key() string {
+	return o.Kind + " " + o.Name
+}
+
+// catalogKey identifies the object among the rows of pg_depend
+func (o *CodeObject) catalogKey() string {
+	return fmt.Sprintf("%s/%d", o.catalog, o.oid)
+}
+
+// replaceStatement changes an existing object in place, or is empty when
+// the object can only be dropped and created again
+func (o *CodeObject) replaceStatement() string {
+	switch o.Kind {
+	case CodeMaterializedView:
+		return ""
+	case CodeTrigger:
+		return fmt.Sprintf("DROP TRIGGER IF EXISTS %s;\n%s", o.Name, o.Definition)
+	}
+	return o.Definition
+}
+
+// dropStatement drops the object along with everything that depends on it
+func (o *CodeObject) dropStatement() string {
+	if o.Kind == CodeTrigger {
+		return fmt.Sprintf("DROP TRIGGER %s;", o.Name)
+	}
+	return fmt.Sprintf("DROP %s %s CASCADE;", o.Kind, o.Name)
+}
+
+// CodeChange is a source object that is new or differs on the destination
+type CodeChange struct {
+	Source *CodeObject
+	Dest   *CodeObject // nil for a new object
+}
+
+// diff returns how the destination's definition differs from the source's
+// as a unified diff, or "" for a new object
+func (c CodeChange) diff() string {
+	if c.Dest == nil {
+		return ""
+	}
+	return unifiedDiff("destination "+c.Dest.key(), "source "+c.Source.key(), c.Dest.Definition, c.Source.Definition)
+}
+
+// CodeDiff is a code change as the run manifest records it
+type CodeDiff struct {
+	Object string `json:"object"`
+	New    bool   `json:"new,omitempty"`
+	Diff   string `json:"diff,omitempty"` // Unified diff from the destination's definition to the source's
+}
+
+// codeDiffs lists the changes for the run manifest
+func codeDiffs(changes []CodeChange) []CodeDiff {
+	diffs := make([]CodeDiff, 0, len(changes))
+	for _, c := range changes {
+		diffs = append(diffs, CodeDiff{Object: c.Source.key(), New: c.Dest == nil, Diff: c.diff()})
+	}
+	return diffs
+}
+
+// loadCodeObjects reads the stored code of a database in the order it can be
+// created: routines, then views by their dependencies, then triggers
+func loadCodeObjects(db *sql.DB) ([]*CodeObject, error) {
+	ctx := runContext()
+	var routines, views, triggers []*CodeObject
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.oid, p.prokind = 'p', format('%I.%I(%s)', n.nspname, p.proname, pg_get_function_identity_arguments(p.oid)),
+		       pg_get_functiondef(p.oid)
+		FROM pg_proc p
+		JOIN pg_namespace n ON n.oid = p.pronamespace
+		WHERE p.prokind IN ('f', 'p') AND `+userSchemas+` AND `+fmt.Sprintf(notExtensionMember, "pg_proc", "p.oid")+`
+		ORDER BY 3`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read functions: %v", err)
+	}
+	for rows.Next() {
+		o := &CodeObject{Kind: CodeFunction, catalog: "pg_proc"}
+		var procedure bool
+		if err := rows.Scan(&o.oid, &procedure, &o.Name, &o.Definition); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if procedure {
+			o.Kind = CodeProcedure
+		}
+		o.Definition = strings.TrimSpace(o.Definition) + ";"
+		routines = append(routines, o)
+	}
+	rows.Close()
+
+	matviewIndexes := make(map[uint32][]string)
+	rows, err = db.QueryContext(ctx, `
+		SELECT i.indrelid, pg_get_indexdef(i.indexrelid)
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indrelid
+		WHERE c.relkind = 'm'
+		ORDER BY 1, 2`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read materialized view indexes: %v", err)
+	}
+	for rows.Next() {
+		var oid uint32
+		var def string
+		if err := rows.Scan(&oid, &def); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		matviewIndexes[oid] = append(matviewIndexes[oid], def+";")
+	}
+	rows.Close()
+
+	reads := make(map[uint32][]uint32)
+	rows, err = db.QueryContext(ctx, `
+		SELECT DISTINCT r.ev_class, d.refobjid
+		FROM pg_rewrite r
+		JOIN pg_depend d ON d.classid = 'pg_rewrite'::regclass AND d.objid = r.oid
+		WHERE d.refclassid = 'pg_class'::regclass AND d.refobjid <> r.ev_class`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read view dependencies: %v", err)
+	}
+	for rows.Next() {
+		var view, ref uint32
+		if err := rows.Scan(&view, &ref); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		reads[view] = append(reads[view], ref)
+	}
+	rows.Close()
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT c.oid, c.relkind = 'm', format('%I.%I', n.nspname, c.relname), pg_get_viewdef(c.oid, true),
+		       coalesce(array_to_string(c.reloptions, ', '), '')
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('v', 'm') AND `+userSchemas+` AND `+fmt.Sprintf(notExtensionMember, "pg_class", "c.oid")+`
+		ORDER BY 3`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read views: %v", err)
+	}
+	for rows.Next() {
+		o := &CodeObject{Kind: CodeView, catalog: "pg_class"}
+		var materialized bool
+		var query, reloptions string
+		if err := rows.Scan(&o.oid, &materialized, &o.Name, &query, &reloptions); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		with := ""
+		if reloptions != "" {
+			with = fmt.Sprintf(" WITH (%s)", reloptions)
+		}
+		query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+		if materialized {
+			o.Kind = CodeMaterializedView
+			o.Definition = strings.Join(append([]string{
+				fmt.Sprintf("CREATE MATERIALIZED VIEW %s%s AS\n%s\nWITH DATA;", o.Name, with, query),
+			}, matviewIndexes[o.oid]...), "\n")
+		} else {
+			o.Definition = fmt.Sprintf("CREATE OR REPLACE VIEW %s%s AS\n%s;", o.Name, with, query)
+		}
+		o.reads = reads[o.oid]
+		views = append(views, o)
+	}
+	rows.Close()
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT t.oid, format('%I ON %I.%I', t.tgname, n.nspname, c.relname), pg_get_triggerdef(t.oid, true)
+		FROM pg_trigger t
+		JOIN pg_class c ON c.oid = t.tgrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE NOT t.tgisinternal AND `+userSchemas+` AND `+fmt.Sprintf(notExtensionMember, "pg_class", "c.oid")+`
+		ORDER BY 2`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read triggers: %v", err)
+	}
+	for rows.Next() {
+		o := &CodeObject{Kind: CodeTrigger, catalog: "pg_trigger"}
+		if err := rows.Scan(&o.oid, &o.Name, &o.Definition); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		o.Definition += ";"
+		triggers = append(triggers, o)
+	}
+	rows.Close()
+
+	objects := append(routines, sortViews(views)...)
+	return append(objects, triggers...), rows.Err()
+}
+
+// sortViews orders views so each comes after the views it reads from
+func sortViews(views []*CodeObject) []*CodeObject {
+	byOID := make(map[uint32]*CodeObject, len(views))
+	for _, v := range views {
+		byOID[v.oid] = v
+	}
+	sorted := make([]*CodeObject, 0, len(views))
+	visited := make(map[uint32]bool, len(views))
+	var visit func(v *CodeObject)
+	visit = func(v *CodeObject) {
+		if visited[v.oid] {
+			return
+		}
+		visited[v.oid] = true
+		for _, ref := range v.reads {
+			if dep, ok := byOID[ref]; ok {
+				visit(dep)
+			}
+		}
+		sorted = append(sorted, v)
+	}
+	for _, v := range views {
+		visit(v)
+	}
+	return sorted
+}
+
+// codeCounts counts the objects by kind, for the run's object counts
+func codeCounts(objects []*CodeObject) map[string]int {
+	counts := make(map[string]int)
+	for _, o := range objects {
+		counts[o.Kind]++
+	}
+	return counts
+}
+
+// diffCode lists the source objects that are missing or different on the
+// destination, in source order, and the destination objects the source lacks.
+// Definitions differing only in what normalizeCode evens out are the same,
+// unless strict is set.
+func diffCode(source, dest []*CodeObject, strict bool) ([]CodeChange, []*CodeObject) {
+	destByKey := make(map[string]*CodeObject, len(dest))
+	for _, o := range dest {
+		destByKey[o.key()] = o
+	}
+
+	var changes []CodeChange
+	for _, o := range source {
+		d := destByKey[o.key()]
+		delete(destByKey, o.key())
+		if d == nil || !sameCode(o.Kind, d.Definition, o.Definition, strict) {
+			changes = append(changes, CodeChange{Source: o, Dest: d})
+		}
+	}
+
+	var destOnly []*CodeObject
+	for _, o := range dest {
+		if _, ok := destByKey[o.key()]; ok {
+			destOnly = append(destOnly, o)
+		}
+	}
+	return changes, destOnly
+}
+
+// writeCodeFile writes the creating statements of objects to w
+func writeCodeFile(w io.Writer, objects []*CodeObject) error {
+	for _, o := range objects {
+		if _, err := fmt.Fprintf(w, "-- %s %s\n%s\n\n", o.Kind, o.Name, o.Definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printCodeDiff shows the new definitions, and the changed ones as unified diffs
+func printCodeDiff(w io.Writer, changes []CodeChange) {
+	for _, c := range changes {
+		if c.Dest == nil {
+			fmt.Fprintf(w, "+++ new %s\n", c.Source.key())
+			for _, line := range strings.Split(c.Source.Definition, "\n") {
+				fmt.Fprintf(w, "+ %s\n", line)
+			}
+			continue
+		}
+		fmt.Fprint(w, c.diff())
+	}
+}
+
+// diffLines returns the lines of a and b prefixed with "- ", "+ " or "  "
+// along their longest common subsequence
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, "  "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "- "+a[i])
+			i++
+		default:
+			out = append(out, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+ "+b[j])
+	}
+	return out
+}
+
+// applyCodeChanges replaces the changed objects in one transaction. Objects
+// CREATE OR REPLACE can't change are dropped and created again, along with
+// the views, routines and triggers depending on them.
+func applyCodeChanges(dest *DatabaseConfig, changes []CodeChange, sourceObjects, destObjects []*CodeObject) error {
+	db, err := openDatabase(dest, dest.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := setSessionRole(db, dest.Role); err != nil {
+		return err
+	}
+
+	ctx := runContext()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	a := &codeApplier{
+		ctx:       ctx,
+		tx:        tx,
+		source:    make(map[string]*CodeObject, len(sourceObjects)),
+		dest:      make(map[string]*CodeObject, len(destObjects)),
+		recreated: make(map[string]bool),
+	}
+	for _, o := range sourceObjects {
+		a.source[o.key()] = o
+	}
+	for _, o := range destObjects {
+		a.dest[o.catalogKey()] = o
+	}
+
+	for _, c := range changes {
+		if a.recreated[c.Source.key()] {
+			continue // Already created again as a dependent
+		}
+		if c.Dest == nil {
+			if err := a.exec(c.Source.Definition); err != nil {
+				return fmt.Errorf("failed to create %s: %v", c.Source.key(), err)
+			}
+			logger.Info(fmt.Sprintf("Created %s", c.Source.key()))
+			continue
+		}
+
+		if stmt := c.Source.replaceStatement(); stmt != "" {
+			replaced, err := a.tryReplace(stmt)
+			if err != nil {
+				return fmt.Errorf("failed to replace %s: %v", c.Source.key(), err)
+			}
+			if replaced {
+				logger.Info(fmt.Sprintf("Replaced %s", c.Source.key()))
+				continue
+			}
+		}
+		if err := a.recreate(c); err != nil {
+			return fmt.Errorf("failed to recreate %s: %v", c.Source.key(), err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(a.dependents) > 0 {
+		warn(WarnCodeObjectsRecreated, fmt.Sprintf("Dropped and recreated %d dependent object(s); their grants and comments are not restored: %s",
+			len(a.dependents), strings.Join(a.dependents, ", ")))
+	}
+	logger.Success(fmt.Sprintf("Updated %d code object(s) in '%s'", len(changes), dest.Database))
+	return nil
+}
+
+// codeApplier tracks one code apply transaction
+type codeApplier struct {
+	ctx        context.Context
+	tx         *sql.Tx
+	source     map[string]*CodeObject // By key
+	dest       map[string]*CodeObject // By catalog key
+	recreated  map[string]bool        // Keys created again as dependents
+	dependents []string
+}
+
+func (a *codeApplier) exec(stmt string) error {
+	_, err := a.tx.ExecContext(a.ctx, stmt)
+	return err
+}
+
+// tryReplace runs stmt under a savepoint and reports whether it worked.
+// Failures that call for a drop and create are not errors.
+func (a *codeApplier) tryReplace(stmt string) (bool, error) {
+	if err := a.exec("SAVEPOINT pgsm_code"); err != nil {
+		return false, err
+	}
+	err := a.exec(stmt)
+	if err == nil {
+		return true, a.exec("RELEASE SAVEPOINT pgsm_code")
+	}
+	if rollbackErr := a.exec("ROLLBACK TO SAVEPOINT pgsm_code"); rollbackErr != nil {
+		return false, rollbackErr
+	}
+	if serverErr, ok := asServerError(err); ok && replaceFailedCodes[serverErr.Code] {
+		logger.Info(fmt.Sprintf("Can't replace in place (%s), dropping and recreating", serverErr.Message))
+		return false, nil
+	}
+	return false, err
+}
+
+// recreate drops the destination's object and creates the source's, then
+// creates everything the drop cascaded to, from the source's definition
+// where it has one
+func (a *codeApplier) recreate(c CodeChange) error {
+	dependents, err := a.dependentsOf(c.Dest)
+	if err != nil {
+		return err
+	}
+
+	if err := a.exec(c.Dest.dropStatement()); err != nil {
+		return err
+	}
+	if err := a.exec(c.Source.Definition); err != nil {
+		return err
+	}
+	a.recreated[c.Source.key()] = true
+	logger.Info(fmt.Sprintf("Recreated %s", c.Source.key()))
+
+	for _, d := range dependents {
+		def := d.Definition
+		if s, ok := a.source[d.key()]; ok {
+			def = s.Definition
+		} else {
+			a.dependents = append(a.dependents, d.key())
+		}
+		if err := a.exec(def); err != nil {
+			return fmt.Errorf("failed to recreate dependent %s: %v", d.key(), err)
+		}
+		a.recreated[d.key()] = true
+		logger.Info(fmt.Sprintf("Recreated dependent %s", d.key()))
+	}
+	return nil
+}
+
+// dependentsOf lists what dropping o with CASCADE also drops, deepest
+// dependents last so they can be created again in order. Dependents other than stored code, such as column defaults or
+// policies, would be lost, so they are an error.
+func (a *codeApplier) dependentsOf(o *CodeObject) ([]*CodeObject, error) {
+	rows, err := a.tx.QueryContext(a.ctx, `
+		WITH RECURSIVE deps(classid, objid, level) AS (
+			SELECT $1::regclass::oid, $2::oid, 0
+			UNION
+			SELECT CASE WHEN d.classid = 'pg_rewrite'::regclass THEN 'pg_class'::regclass::oid ELSE d.classid END,
+			       CASE WHEN d.classid = 'pg_rewrite'::regclass THEN r.ev_class ELSE d.objid END,
+			       deps.level + 1
+			FROM deps
+			LEFT JOIN pg_class rel ON deps.classid = 'pg_class'::regclass AND rel.oid = deps.objid
+			JOIN pg_depend d
+			  ON (d.refclassid = deps.classid AND d.refobjid = deps.objid)
+			  OR (d.refclassid = 'pg_type'::regclass AND d.refobjid = rel.reltype)
+			LEFT JOIN pg_rewrite r ON d.classid = 'pg_rewrite'::regclass AND r.oid = d.objid
+			WHERE (d.deptype = 'n' OR (d.deptype = 'a' AND d.classid = 'pg_trigger'::regclass))
+			  AND NOT (d.classid = 'pg_rewrite'::regclass AND r.ev_class = deps.objid)
+		)
+		SELECT classid::regclass::text, objid, max(level), pg_describe_object(classid, objid, 0)
+		FROM deps
+		WHERE level > 0
+		GROUP BY classid, objid
+		ORDER BY 3, 2`, o.catalog, o.oid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dependents: %v", err)
+	}
+	defer rows.Close()
+
+	var dependents []*CodeObject
+	var unsupported []string
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var catalog, description string
+		var oid uint32
+		var level int
+		if err := rows.Scan(&catalog, &oid, &level, &description); err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("%s/%d", catalog, oid)
+		d, ok := a.dest[key]
+		if !ok {
+			unsupported = append(unsupported, description)
+			continue
+		}
+		if !seen[key] {
+			seen[key] = true
+			dependents = append(dependents, d)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(unsupported) > 0 {
+		return nil, fmt.Errorf("it can't be dropped and recreated because %s depend on it; use a full migration", strings.Join(unsupported, ", "))
+	}
+	return dependents, nil
+}
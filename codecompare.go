@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines around a change in a unified diff
+const diffContext = 3
+
+// Clauses of a routine header spelled differently by pg_get_functiondef and
+// pg_dump across server versions
+var (
+	createOrReplacePattern = regexp.MustCompile(`^CREATE OR REPLACE `)
+	languagePattern        = regexp.MustCompile(`(?i)\bLANGUAGE '?"?([A-Za-z_][A-Za-z_0-9]*)"?'?`)
+	volatilityPattern      = regexp.MustCompile(`(?i)\b(IMMUTABLE|STABLE)\b`)
+	// The defaults, which some versions print and others leave out
+	defaultClausePattern = regexp.MustCompile(`(?i) (VOLATILE|CALLED ON NULL INPUT|SECURITY INVOKER|PARALLEL UNSAFE|NOT LEAKPROOF)\b`)
+)
+
+// collapseSpace makes two spellings of SQL that differ only in whitespace the
+// same: runs of whitespace become one space, and spaces next to parentheses,
+// commas and casts are dropped. Quoted literals and names and dollar-quoted
+// strings are kept as they are.
+func collapseSpace(sql string) string {
+	var b strings.Builder
+	space := false
+	s := strings.TrimSpace(sql)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			space = true
+			continue
+		}
+		if space && b.Len() > 0 && !strings.ContainsRune("(,:", lastRune(b.String())) && !strings.ContainsRune("),:", rune(c)) {
+			b.WriteByte(' ')
+		}
+		space = false
+
+		end := i + 1
+		switch {
+		case c == '\'' || c == '"':
+			for end < len(s) && s[end] != c {
+				end++
+			}
+			end = min(end+1, len(s))
+		case c == '$':
+			if tag := dollarTag(s[i:]); tag != "" {
+				if close := strings.Index(s[i+len(tag):], tag); close >= 0 {
+					end = i + len(tag) + close + len(tag)
+				} else {
+					end = len(s)
+				}
+			}
+		}
+		b.WriteString(s[i:end])
+		i = end - 1
+	}
+	return b.String()
+}
+
+// dollarTag returns the dollar quote s starts with, or ""
+func dollarTag(s string) string {
+	if loc := dollarQuotePattern.FindStringIndex(s); loc != nil && loc[0] == 0 {
+		return s[:loc[1]]
+	}
+	return ""
+}
+
+// routineBody splits a CREATE FUNCTION or CREATE PROCEDURE into its header,
+// its dollar-quoted body without the quotes and what follows the body, such
+// as the link symbol of a C function. body is "" for a header alone or a
+// SQL-standard body, which is left in the header.
+func routineBody(definition string) (header, body, rest string) {
+	var quote byte
+	for i := 0; i < len(definition); i++ {
+		c := definition[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '$':
+			tag := dollarTag(definition[i:])
+			if tag == "" {
+				continue
+			}
+			start := i + len(tag)
+			end := strings.Index(definition[start:], tag)
+			if end < 0 {
+				return definition, "", ""
+			}
+			return definition[:i], definition[start : start+end], definition[start+end+len(tag):]
+		}
+	}
+	return definition, "", ""
+}
+
+// normalizeCode spells the definition of a code object the way every server
+// version would: whitespace is collapsed outside string literals and, for
+// routines, the dollar quotes of the body, the quoting of the language and
+// the volatility clause are made the same and clauses stating defaults are
+// dropped. Views are expected as pg_get_viewdef prints them with pretty set.
+func normalizeCode(kind, definition string) string {
+	definition = strings.TrimSuffix(strings.TrimSpace(definition), ";")
+	definition = createOrReplacePattern.ReplaceAllString(definition, "CREATE ")
+	if kind != CodeFunction && kind != CodeProcedure {
+		return collapseSpace(definition)
+	}
+
+	header, body, rest := routineBody(definition)
+	header = collapseSpace(header)
+	header = languagePattern.ReplaceAllStringFunc(header, func(clause string) string {
+		return "LANGUAGE " + strings.ToLower(languagePattern.FindStringSubmatch(clause)[1])
+	})
+	header = volatilityPattern.ReplaceAllStringFunc(header, strings.ToUpper)
+	header = defaultClausePattern.ReplaceAllString(header, "")
+	if body == "" {
+		return header
+	}
+	return fmt.Sprintf("%s $$%s$$%s", header, collapseSpace(body), collapseSpace(rest))
+}
+
+// sameCode reports whether two definitions of a code object of the given kind
+// are the same, exactly with strict and after normalizeCode otherwise
+func sameCode(kind, a, b string, strict bool) bool {
+	if strings.TrimSpace(a) == strings.TrimSpace(b) {
+		return true
+	}
+	return !strict && normalizeCode(kind, a) == normalizeCode(kind, b)
+}
+
+// unifiedDiff returns the changes from a to b as a unified diff, with
+// diffContext unchanged lines around each change, or "" when they are equal
+func unifiedDiff(fromName, toName, a, b string) string {
+	lines := diffLines(strings.Split(a, "\n"), strings.Split(b, "\n"))
+	changed := make([]bool, len(lines))
+	differs := false
+	for i, line := range lines {
+		changed[i] = line[0] != ' '
+		differs = differs || changed[i]
+	}
+	if !differs {
+		return ""
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	aLine, bLine := 1, 1 // Line numbers at lines[i]
+	for i := 0; i < len(lines); {
+		if !changed[i] {
+			aLine++
+			bLine++
+			i++
+			continue
+		}
+		// The hunk starts diffContext lines before the change and ends once
+		// more than twice that many unchanged lines follow one
+		start := i
+		for start > 0 && i-start < diffContext && !changed[start-1] {
+			start--
+		}
+		aStart, bStart := aLine-(i-start), bLine-(i-start)
+		end, unchanged := i, 0
+		for end < len(lines) && (changed[end] || unchanged < 2*diffContext) {
+			if changed[end] {
+				unchanged = 0
+			} else {
+				unchanged++
+			}
+			end++
+		}
+		if unchanged > diffContext {
+			end -= unchanged - diffContext
+		}
+
+		aCount, bCount := 0, 0
+		for _, line := range lines[start:end] {
+			if line[0] != '+' {
+				aCount++
+			}
+			if line[0] != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+		for _, line := range lines[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", line[0], line[2:])
+		}
+		aLine, bLine = aStart+aCount, bStart+bCount
+		i = end
+	}
+	return out.String()
+}
+
+// hunkRange formats the start and length of a hunk the way diff -u does
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start-1)
+	case 1:
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// collationVersionsVersion is the first server version (server_version_num)
+// with pg_collation_actual_version
+const collationVersionsVersion = 100000
+
+// CollationCheckOptions controls the pre-flight comparison of collation versions
+type CollationCheckOptions struct {
+	FailOnMismatch bool // Abort instead of warning when collations differ
+	ReindexScript  bool // Write the REINDEX statements for affected indexes to the output directory
+}
+
+// collationVersion is what decides the sort order of a collation on one server
+type collationVersion struct {
+	Provider string // pg_collation.collprovider: c (libc), i (icu), b (builtin)
+	Locale   string
+	Version  string // Version of the collation library, empty when unknown
+}
+
+func (v collationVersion) String() string {
+	providers := map[string]string{"c": "libc", "i": "icu", "b": "builtin"}
+	provider := providers[v.Provider]
+	if provider == "" {
+		provider = v.Provider
+	}
+	version := v.Version
+	if version == "" {
+		version = "version unknown"
+	}
+	return fmt.Sprintf("%s %s %s", provider, v.Locale, version)
+}
+
+// stable reports whether the collation sorts bytewise, which no library upgrade changes
+func (v collationVersion) stable() bool {
+	return v.Locale == "C" || v.Locale == "POSIX"
+}
+
+// collationIndex is an index of the source whose ordering depends on a collation
+type collationIndex struct {
+	Index      string
+	Table      string
+	Collations []string
+}
+
+// collationLocaleColumn returns the locale of pg_collation c for a server
+// version; ICU and builtin locales moved out of collcollate in 15 and 17
+func collationLocaleColumn(version int) string {
+	switch {
+	case version >= 170000:
+		return "coalesce(c.colllocale, c.collcollate)"
+	case version >= 150000:
+		return "coalesce(c.colliculocale, c.collcollate)"
+	default:
+		return "c.collcollate"
+	}
+}
+
+// databaseCollation reads the default collation of the database called name
+func databaseCollation(db *sql.DB, version int, name string) (*collationVersion, error) {
+	query := `
+		SELECT 'c', d.datcollate,
+		       coalesce((SELECT pg_collation_actual_version(c.oid) FROM pg_collation c
+		                 WHERE c.collprovider = 'c' AND c.collcollate = d.datcollate LIMIT 1), '')
+		FROM pg_database d WHERE d.datname = $1`
+	switch {
+	case version >= 170000:
+		query = `
+			SELECT d.datlocprovider::text, coalesce(d.datlocale, d.datcollate), coalesce(pg_database_collation_actual_version(d.oid), '')
+			FROM pg_database d WHERE d.datname = $1`
+	case version >= 150000:
+		query = `
+			SELECT d.datlocprovider::text, coalesce(d.daticulocale, d.datcollate), coalesce(pg_database_collation_actual_version(d.oid), '')
+			FROM pg_database d WHERE d.datname = $1`
+	}
+
+	v := &collationVersion{}
+	err := db.QueryRowContext(runContext(), query, name).Scan(&v.Provider, &v.Locale, &v.Version)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("database %q not found", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// sourceCollationIndexes lists the source indexes on collatable columns or
+// expressions, with the collations they use. Collations are keyed by name,
+// "default" being the database default.
+func sourceCollationIndexes(db *sql.DB, version int) ([]collationIndex, map[string]collationVersion, error) {
+	rows, err := db.QueryContext(runContext(), `
+		SELECT format('%I.%I', n.nspname, ic.relname), format('%I.%I', n.nspname, t.relname),
+		       CASE WHEN c.collprovider = 'd' THEN 'default' ELSE format('%I.%I', cn.nspname, c.collname) END,
+		       c.collprovider::text, coalesce(`+collationLocaleColumn(version)+`, ''),
+		       CASE WHEN c.collprovider = 'd' THEN '' ELSE coalesce(pg_collation_actual_version(c.oid), '') END
+		FROM pg_index i
+		JOIN pg_class ic ON ic.oid = i.indexrelid
+		JOIN pg_class t ON t.oid = i.indrelid
+		JOIN pg_namespace n ON n.oid = ic.relnamespace
+		JOIN pg_collation c ON c.oid = ANY (i.indcollation::oid[])
+		JOIN pg_namespace cn ON cn.oid = c.collnamespace
+		WHERE `+userSchemas+`
+		ORDER BY 1, 3`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var indexes []collationIndex
+	collations := make(map[string]collationVersion)
+	for rows.Next() {
+		var index, table, name string
+		var v collationVersion
+		if err := rows.Scan(&index, &table, &name, &v.Provider, &v.Locale, &v.Version); err != nil {
+			return nil, nil, err
+		}
+		if name != "default" {
+			collations[name] = v
+		}
+		if n := len(indexes); n > 0 && indexes[n-1].Index == index {
+			indexes[n-1].Collations = append(indexes[n-1].Collations, name)
+			continue
+		}
+		indexes = append(indexes, collationIndex{Index: index, Table: table, Collations: []string{name}})
+	}
+	return indexes, collations, rows.Err()
+}
+
+// destinationCollation finds the version of a collation with the same
+// provider and locale on the destination, or nil when it has none
+func destinationCollation(db *sql.DB, version int, source collationVersion) (*collationVersion, error) {
+	v := collationVersion{Provider: source.Provider, Locale: source.Locale}
+	err := db.QueryRowContext(runContext(), `
+		SELECT coalesce(pg_collation_actual_version(c.oid), '')
+		FROM pg_collation c
+		WHERE c.collprovider = $1 AND `+collationLocaleColumn(version)+` = $2
+		LIMIT 1`, source.Provider, source.Locale).Scan(&v.Version)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// collationsDiffer reports whether data sorted under source may be out of
+// order under dest. Unknown versions can't be compared and don't count.
+func collationsDiffer(source collationVersion, dest *collationVersion) bool {
+	if source.stable() {
+		return false
+	}
+	if dest == nil {
+		return true
+	}
+	if source.Provider != dest.Provider || source.Locale != dest.Locale {
+		return true
+	}
+	return source.Version != "" && dest.Version != "" && source.Version != dest.Version
+}
+
+// serverVersion reads server_version_num
+func serverVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRowContext(runContext(), `SELECT current_setting('server_version_num')::int`).Scan(&version)
+	return version, err
+}
+
+// checkCollations compares the collations used by the source's indexes, and
+// the default collation, with the destination's. A glibc or ICU upgrade
+// changes sort order, so indexes built under one version can be corrupt under
+// another; the affected indexes are listed for a REINDEX after the migration.
+// A check that can't run only warns, unless mismatches are fatal.
+func checkCollations(source, dest *DatabaseConfig, options *MigrationOptions, state *RunState) error {
+	logger.Info("Comparing collation versions of source and destination...")
+
+	err := compareCollations(source, dest, options, state)
+	if err != nil && !options.Collation.FailOnMismatch {
+		warn(WarnCollationCheckFailed, fmt.Sprintf("Collation check failed (continuing): %v", err))
+		return nil
+	}
+	return err
+}
+
+// compareCollations does the work of checkCollations
+func compareCollations(source, dest *DatabaseConfig, options *MigrationOptions, state *RunState) error {
+	sourceDB, err := openDB(source, source.Database)
+	if err != nil {
+		return err
+	}
+	defer sourceDB.Close()
+	destDB, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+
+	sourceVersion, err := serverVersion(sourceDB)
+	if err != nil {
+		return err
+	}
+	destVersion, err := serverVersion(destDB)
+	if err != nil {
+		return err
+	}
+	if sourceVersion < collationVersionsVersion || destVersion < collationVersionsVersion {
+		logger.Info("Collation versions are not available before PostgreSQL 10, skipping the collation check")
+		return nil
+	}
+
+	// The destination database is recreated from its template, which decides its default collation
+	template := options.CreateDB.Template
+	if template == "" {
+		template = "template1"
+	}
+	sourceDefault, err := databaseCollation(sourceDB, sourceVersion, source.Database)
+	if err != nil {
+		return fmt.Errorf("failed to read the source default collation: %v", err)
+	}
+	destDefault, err := databaseCollation(destDB, destVersion, template)
+	if err != nil {
+		return fmt.Errorf("failed to read the destination default collation: %v", err)
+	}
+	indexes, collations, err := sourceCollationIndexes(sourceDB, sourceVersion)
+	if err != nil {
+		return fmt.Errorf("failed to read source indexes: %v", err)
+	}
+
+	differs := make(map[string]bool)
+	var mismatches []string
+	if collationsDiffer(*sourceDefault, destDefault) {
+		differs["default"] = true
+		mismatches = append(mismatches, fmt.Sprintf("default collation: source %s, destination %s", sourceDefault, destDefault))
+	}
+	names := make([]string, 0, len(collations))
+	for name := range collations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := collations[name]
+		d, err := destinationCollation(destDB, destVersion, v)
+		if err != nil {
+			return fmt.Errorf("failed to read destination collation %s: %v", name, err)
+		}
+		if !collationsDiffer(v, d) {
+			continue
+		}
+		differs[name] = true
+		destination := "not available"
+		if d != nil {
+			destination = d.String()
+		}
+		mismatches = append(mismatches, fmt.Sprintf("collation %s: source %s, destination %s", name, v, destination))
+	}
+	if len(mismatches) == 0 {
+		logger.Info("Collations match between source and destination")
+		return nil
+	}
+
+	var affected []collationIndex
+	for _, index := range indexes {
+		for _, name := range index.Collations {
+			if differs[name] {
+				affected = append(affected, index)
+				break
+			}
+		}
+	}
+
+	warn(WarnCollationMismatch, fmt.Sprintf("Collations differ between source and destination; %d index(es) depend on them and should be reindexed after the migration", len(affected)))
+	for _, m := range mismatches {
+		logger.Warning("   " + m)
+	}
+	for _, index := range affected {
+		logger.Warning(fmt.Sprintf("   REINDEX INDEX %s; -- on %s (%s)", index.Index, index.Table, strings.Join(index.Collations, ", ")))
+	}
+
+	if options.Collation.ReindexScript && len(affected) > 0 {
+		path := filepath.Join(options.OutputDir, fmt.Sprintf("reindex_%s_%s.sql", dest.Database, state.Timestamp()))
+		if err := writeReindexScript(path, mismatches, affected); err != nil {
+			return fmt.Errorf("failed to write reindex script: %v", err)
+		}
+		state.ReindexFile = path
+		logger.Info(fmt.Sprintf("Reindex script written to: %s", path))
+	}
+
+	if options.Collation.FailOnMismatch {
+		return fmt.Errorf("collations differ between source and destination (--fail-on-collation-mismatch)")
+	}
+	return nil
+}
+
+// writeReindexScript writes the REINDEX statements for the affected indexes
+func writeReindexScript(path string, mismatches []string, indexes []collationIndex) error {
+	var b strings.Builder
+	b.WriteString("-- Indexes that depend on collations that differ between source and destination\n")
+	for _, m := range mismatches {
+		b.WriteString("--   " + m + "\n")
+	}
+	b.WriteString("\n")
+	for _, index := range indexes {
+		fmt.Fprintf(&b, "REINDEX INDEX %s;\n", index.Index)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
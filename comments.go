@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Comment modes for --comments
+const (
+	CommentsKeep  = "keep"
+	CommentsStrip = "strip"
+	CommentsOnly  = "only"
+)
+
+// dumpTrailer is the comment pg_dump ends a plain-format dump with
+const dumpTrailer = "-- PostgreSQL database dump complete"
+
+// filterComments copies a plain-format pg_dump from r to w, keeping only the
+// COMMENT entries (CommentsOnly) or everything but them (CommentsStrip). The
+// preamble of SET statements is always kept. It returns the number of
+// COMMENT entries found.
+func filterComments(r io.Reader, w io.Writer, mode string) (int, error) {
+	out := bufio.NewWriter(w)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	comments := 0
+	keep := true
+	held := false // A "--" line that may open the next TOC entry
+	write := func(line string) {
+		if keep {
+			out.WriteString(line)
+			out.WriteByte('\n')
+		}
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if held {
+			if m := tocEntryPattern.FindStringSubmatch(line); m != nil {
+				isComment := m[2] == "COMMENT"
+				if isComment {
+					comments++
+				}
+				keep = isComment == (mode == CommentsOnly)
+			} else if line == dumpTrailer {
+				keep = true
+			}
+			write("--")
+			held = false
+		}
+		if line == "--" {
+			held = true
+			continue
+		}
+		write(line)
+	}
+	if held {
+		write("--")
+	}
+	if err := scanner.Err(); err != nil {
+		return comments, err
+	}
+	return comments, out.Flush()
+}
+
+// filterCommentsFile rewrites the dump at path according to mode
+func filterCommentsFile(path, mode string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(path), ".comments-*.sql")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	comments, err := filterComments(in, out, mode)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if info, err := in.Stat(); err == nil {
+		os.Chmod(out.Name(), info.Mode().Perm())
+	}
+	if err := os.Rename(out.Name(), path); err != nil {
+		return err
+	}
+
+	logCommentFilter(comments, mode)
+	return nil
+}
+
+// keepOnlyComments reduces the dump at path to its COMMENT entries, in place
+// or, when w is not nil, by writing them to w
+func keepOnlyComments(path string, w io.Writer) error {
+	if w == nil {
+		return filterCommentsFile(path, CommentsOnly)
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	comments, err := filterComments(in, w, CommentsOnly)
+	if err != nil {
+		return err
+	}
+	logCommentFilter(comments, CommentsOnly)
+	return nil
+}
+
+// filterCommentsToTempFile writes a filtered copy of the dump at path to the
+// scratch directory, leaving path untouched
+func filterCommentsToTempFile(path, mode string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := scratchFile("comments-*.sql")
+	if err != nil {
+		return "", err
+	}
+
+	comments, err := filterComments(in, out, mode)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	logCommentFilter(comments, mode)
+	return out.Name(), nil
+}
+
+func logCommentFilter(comments int, mode string) {
+	if mode == CommentsOnly {
+		logger.Info(fmt.Sprintf("Kept %d COMMENT statement(s) and nothing else (--comments only)", comments))
+	} else {
+		logger.Info(fmt.Sprintf("Stripped %d COMMENT statement(s) (--comments strip)", comments))
+	}
+}
+
+// syncComments applies a comments-only file to the existing destination
+// database. Nothing is dropped, so there is no backup or rollback script.
+func syncComments(dest *DatabaseConfig, commentsFile string, options *MigrationOptions, state *RunState) error {
+	if err := refreshCredentials(dest); err != nil {
+		return err
+	}
+	exists, err := databaseExists(dest)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("destination database '%s' does not exist; --comments only updates an already migrated database", dest.Database)
+	}
+
+	if options.DryRun {
+		logger.Info("DRY RUN MODE - showing what would be done:")
+		logger.Info(fmt.Sprintf("Apply comments from %s to existing database: %s", commentsFile, dest.Database))
+		logger.Info(fmt.Sprintf("   %s", commandLine(clientCommand(dest, "psql", applySchemaArgs(dest, commentsFile), commentsFile))))
+		return nil
+	}
+
+	logger.Info(fmt.Sprintf("Syncing comments to existing database '%s' (no drop, no backup)", dest.Database))
+	return applyPhase(dest, commentsFile, options, state)
+}
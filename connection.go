@@ -0,0 +1,439 @@
+package main
+
+import (
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// sslModes are the libpq SSL modes, weakest first
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// sslProtocolVersions are the values libpq accepts for ssl_min_protocol_version, oldest first
+var sslProtocolVersions = []string{"TLSv1", "TLSv1.1", "TLSv1.2", "TLSv1.3"}
+
+// connString builds a lib/pq connection string for the given database on the
+// server described by config. channel_binding and gssencmode are left out:
+// lib/pq would send them to the server as settings, which it rejects.
+func connString(config *DatabaseConfig, dbname string) string {
+	params := []string{
+		"host=" + dsnQuote(config.Host),
+		"port=" + dsnQuote(config.Port),
+		"user=" + dsnQuote(config.Username),
+		"password=" + dsnQuote(config.Password),
+		"dbname=" + dsnQuote(dbname),
+		"sslmode=" + dsnQuote(config.driverSSLMode()),
+	}
+	if config.SSLRootCert != "" {
+		params = append(params, "sslrootcert="+dsnQuote(config.SSLRootCert))
+	}
+	if config.SSLCert != "" {
+		params = append(params, "sslcert="+dsnQuote(config.SSLCert))
+	}
+	if config.SSLKey != "" {
+		params = append(params, "sslkey="+dsnQuote(config.SSLKey))
+	}
+	if config.Options != "" {
+		params = append(params, "options="+dsnQuote(config.Options))
+	}
+	// Keep queries within the time left for the current phase
+	if ms := statementTimeout(); ms > 0 {
+		params = append(params, fmt.Sprintf("statement_timeout=%d", ms))
+	}
+	return strings.Join(params, " ")
+}
+
+// isUnixSocket reports whether host names a Unix domain socket directory
+// rather than a TCP host, following libpq's convention.
+func isUnixSocket(host string) bool {
+	return strings.HasPrefix(host, "/")
+}
+
+// sslModeForHost returns the SSL mode to use for host. SSL is never negotiated
+// over Unix domain sockets, so socket connections imply "disable"; explicit
+// requests that insist on SSL are overridden with a warning.
+func sslModeForHost(host, sslMode string, explicit bool) string {
+	if !isUnixSocket(host) || sslMode == "disable" {
+		return sslMode
+	}
+	if explicit && sslMode != "allow" && sslMode != "prefer" {
+		warn(WarnSSLModeOverridden, fmt.Sprintf("SSL mode %s ignored for Unix socket %s, using disable", sslMode, host))
+	}
+	return "disable"
+}
+
+// validateSSLMode checks sslMode against the modes libpq supports
+func validateSSLMode(sslMode string) error {
+	for _, mode := range sslModes {
+		if sslMode == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of: %s", strings.Join(sslModes, ", "))
+}
+
+// validateSSLMinProtocol checks a minimum TLS version against the ones libpq supports
+func validateSSLMinProtocol(version string) error {
+	if version == "" {
+		return nil
+	}
+	for _, v := range sslProtocolVersions {
+		if version == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of: %s", strings.Join(sslProtocolVersions, ", "))
+}
+
+// warnOptionalSSL warns when a remote server may be reached without SSL
+func warnOptionalSSL(config *DatabaseConfig, side string) {
+	if (config.SSLMode == "allow" || config.SSLMode == "prefer") && !isLocalHost(config.Host) && !isUnixSocket(config.Host) {
+		warn(WarnSSLOptional, fmt.Sprintf("%s SSL mode %s falls back to an unencrypted connection to %s; use require or stricter", side, config.SSLMode, config.Host))
+	}
+}
+
+// driverSSLMode is the sslmode given to the Go driver; lib/pq lacks allow
+// and prefer, and both backends settle them the same way. Until negotiateSSLMode has settled them, they map to the mode
+// libpq tries first.
+func (c *DatabaseConfig) driverSSLMode() string {
+	if c.negotiatedSSLMode != "" {
+		return c.negotiatedSSLMode
+	}
+	switch c.SSLMode {
+	case "allow":
+		return "disable"
+	case "prefer":
+		return "require"
+	}
+	return c.SSLMode
+}
+
+// negotiateSSLMode settles allow and prefer on disable or require for the
+// Go connections, trying the same order libpq does
+func negotiateSSLMode(config *DatabaseConfig, dbname string) error {
+	var fallback string
+	switch config.SSLMode {
+	case "allow":
+		fallback = "require"
+	case "prefer":
+		fallback = "disable"
+	default:
+		return nil
+	}
+
+	config.negotiatedSSLMode = config.driverSSLMode()
+	db, err := openDB(config, dbname)
+	if err != nil {
+		return err
+	}
+	err = db.Ping()
+	db.Close()
+	if err == nil || !sslRetryable(err, config.SSLMode) {
+		return nil // Any other error is reported by the caller's own ping
+	}
+
+	logger.Debug(fmt.Sprintf("sslmode=%s: %v, retrying with %s", config.SSLMode, err, fallback))
+	config.negotiatedSSLMode = fallback
+	return nil
+}
+
+// hbaSSLMode reports whether err is pg_hba.conf turning the connection down
+// for its SSL state, and the mode it would admit: its message ends in "SSL
+// off" or "no encryption" when only SSL connections are admitted, and "SSL
+// on" or "SSL encryption" when only unencrypted ones are
+func hbaSSLMode(err error) (string, bool) {
+	serverErr, ok := asServerError(err)
+	if !ok || serverErr.Code != "28000" || !strings.Contains(serverErr.Message, "no pg_hba.conf entry") {
+		return "", false
+	}
+	switch msg := serverErr.Message; {
+	case strings.HasSuffix(msg, "SSL off") || strings.HasSuffix(msg, "no encryption"):
+		return "require", true
+	case strings.HasSuffix(msg, "SSL on") || strings.HasSuffix(msg, "SSL encryption"):
+		return "disable", true
+	}
+	return "", false
+}
+
+// adjustSSLMode tries a connection with the SSL mode given and, when
+// pg_hba.conf turns it down for its SSL state, once more with the mode it
+// admits. When that connects the run goes on with it: SSLMode is switched,
+// so pg_dump, psql, the rollback script and the manifest use it too, and a
+// warning names both modes. --strict-ssl keeps the mode given, and any other
+// failure is left to the caller's own ping.
+func adjustSSLMode(config *DatabaseConfig, dbname, side string) error {
+	if config.SSLMode == "allow" || config.SSLMode == "prefer" {
+		return nil // libpq and negotiateSSLMode try both already
+	}
+	db, err := openDatabase(config, dbname)
+	if err != nil {
+		return err
+	}
+	err = db.Ping()
+	db.Close()
+	if err == nil {
+		return nil
+	}
+	mode, ok := hbaSSLMode(err)
+	if !ok || config.StrictSSL {
+		return nil
+	}
+
+	retry := *config
+	retry.SSLMode, retry.negotiatedSSLMode = mode, ""
+	db, err = openDatabase(&retry, dbname)
+	if err != nil {
+		return err
+	}
+	err = db.Ping()
+	db.Close()
+	if err != nil {
+		logger.Debug(fmt.Sprintf("sslmode=%s failed too: %v", mode, err))
+		return nil
+	}
+
+	warn(WarnSSLModeAdjusted, fmt.Sprintf("The pg_hba.conf of %s turns down sslmode=%s, so the run uses sslmode=%s, which it admits; give --%s-ssl %s, or --strict-ssl to fail instead",
+		config.Host, config.SSLMode, mode, side, mode))
+	config.SSLModeRequested = config.SSLMode
+	config.SSLMode, config.negotiatedSSLMode = mode, ""
+	return nil
+}
+
+// sslRetryable reports whether err is the failure libpq answers with its
+// second attempt: the server lacks SSL (prefer), or insists on it (allow)
+func sslRetryable(err error, sslMode string) bool {
+	if sslMode == "prefer" {
+		return sslNotSupported(err)
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "SSL off") || strings.Contains(msg, "no encryption")
+}
+
+// SSLState is how a Go connection to a server was secured, from pg_stat_ssl
+type SSLState struct {
+	Encrypted bool   `json:"encrypted"`
+	Version   string `json:"version,omitempty"`
+	Cipher    string `json:"cipher,omitempty"`
+	Bits      int    `json:"bits,omitempty"`
+}
+
+func (s *SSLState) String() string {
+	if !s.Encrypted {
+		return "not encrypted"
+	}
+	return fmt.Sprintf("SSL %s, %s, %d bits", s.Version, s.Cipher, s.Bits)
+}
+
+// readSSLState reads the SSL state of the connection db runs queries on
+func readSSLState(db *sql.DB) (*SSLState, error) {
+	var ssl bool
+	var version, cipher sql.NullString
+	var bits sql.NullInt64
+	err := db.QueryRow(`SELECT ssl, version, cipher, bits FROM pg_stat_ssl WHERE pid = pg_backend_pid()`).Scan(&ssl, &version, &cipher, &bits)
+	if err != nil {
+		return nil, err
+	}
+	return &SSLState{Encrypted: ssl, Version: version.String, Cipher: cipher.String, Bits: int(bits.Int64)}, nil
+}
+
+// recordSSLState logs how the connection to a side was secured and keeps it
+// for the run manifest. A server that can't tell is only noted at debug level.
+func recordSSLState(db *sql.DB, config *DatabaseConfig, side string) {
+	state, err := readSSLState(db)
+	if err != nil {
+		logger.Debug(fmt.Sprintf("Could not read the %s SSL state from pg_stat_ssl: %v", side, err))
+		return
+	}
+	config.SSLState = state
+	logger.Info(fmt.Sprintf("%s connection: %s (sslmode %s)", side, state, config.SSLMode))
+}
+
+// checkSSLProtocol verifies that a Go connection meets the minimum TLS
+// version. lib/pq can't be told the minimum, so it is checked after the fact.
+func checkSSLProtocol(db *sql.DB, config *DatabaseConfig) error {
+	if config.SSLMinProtocol == "" {
+		return nil
+	}
+
+	state := config.SSLState
+	if state == nil {
+		var err error
+		if state, err = readSSLState(db); err != nil {
+			return err
+		}
+	}
+	if !state.Encrypted {
+		return fmt.Errorf("connection is not encrypted but %s is required", config.SSLMinProtocol)
+	}
+	for _, v := range sslProtocolVersions {
+		if v == config.SSLMinProtocol {
+			break
+		}
+		if v == state.Version {
+			return fmt.Errorf("connection uses %s, below the required %s", state.Version, config.SSLMinProtocol)
+		}
+	}
+	return nil
+}
+
+// passwordSources describe where obtainCredentials found a password, for
+// pointing at what to fix when the server rejects it
+var passwordSources = map[string]string{
+	"command": "--%s-password-command",
+	"keyring": "the OS keyring (stored by an earlier --use-keyring run)",
+	"pgpass":  "the pgpass file",
+	"env":     "the environment ($PGSM_*_PASSWORD or $PGPASSWORD)",
+	"stdin":   "--password-stdin",
+	"prompt":  "the prompt",
+}
+
+// connectionErrorHint explains a failed connection to one side of the run
+// ("source" or "dest", the prefix of its flags) and says which flag to
+// change: SSL the server doesn't offer or insists on, a certificate that
+// doesn't verify, and a rejected password.
+func connectionErrorHint(err error, config *DatabaseConfig, side string) string {
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	serverErr, isServerErr := asServerError(err)
+	hbaMode, _ := hbaSSLMode(err)
+
+	switch {
+	case sslNotSupported(err):
+		return fmt.Sprintf(" (SSL is not enabled on the server %s; enable ssl in its postgresql.conf, or accept an unencrypted connection with --%s-ssl prefer or disable)", config.Host, side)
+	case sslRetryable(err, "allow"):
+		return fmt.Sprintf(" (the server only accepts SSL connections from here; use --%s-ssl require or stricter)", side)
+	case hbaMode == "disable":
+		return fmt.Sprintf(" (the server only accepts unencrypted connections from here; use --%s-ssl disable, or admit hostssl connections in its pg_hba.conf)", side)
+	case errors.As(err, &hostnameErr):
+		names := hostnameErr.Certificate.DNSNames
+		if len(names) == 0 && hostnameErr.Certificate.Subject.CommonName != "" {
+			names = []string{hostnameErr.Certificate.Subject.CommonName}
+		}
+		return fmt.Sprintf(" (the hostname does not match the server certificate, which is for %s: connect with --%s-host set to one of those names, or use --%s-ssl verify-ca to check only the CA)", strings.Join(names, ", "), side, side)
+	case errors.As(err, &authorityErr):
+		if config.SSLRootCert == "" {
+			return fmt.Sprintf(" (the server certificate is signed by an unknown CA: give its CA bundle with --%s-sslrootcert)", side)
+		}
+		return fmt.Sprintf(" (the server certificate is not signed by a CA in --%s-sslrootcert %s: point it at the CA bundle of the server)", side, config.SSLRootCert)
+	case errors.As(err, &invalidErr):
+		return fmt.Sprintf(" (the server certificate is invalid: %v; renew it on the server, or use --%s-ssl require to skip verification)", invalidErr, side)
+	case isServerErr && serverErr.Code == "28P01":
+		if config.Auth == "iam" {
+			return fmt.Sprintf(" (the IAM token for %s was rejected: check that the user has rds_iam and the IAM policy allows rds-db:connect)", config.Username)
+		}
+		source := "an unknown source"
+		if format, ok := passwordSources[config.passwordSource]; ok {
+			source = format
+			if strings.Contains(format, "%s") {
+				source = fmt.Sprintf(format, side)
+			}
+		}
+		return fmt.Sprintf(" (password authentication failed for %s; the password came from %s)", config.Username, source)
+	}
+	return ""
+}
+
+// dsnQuote quotes a connection string value when it is empty or contains
+// characters with special meaning.
+func dsnQuote(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// dbnameArg returns the value to pass to pg_dump/psql -d. Those tools treat a
+// -d value containing "=" or a URI prefix as a connection string, so such
+// names are wrapped in an explicit dbname= parameter.
+func dbnameArg(name string) string {
+	if strings.Contains(name, "=") || strings.HasPrefix(name, "postgres://") || strings.HasPrefix(name, "postgresql://") {
+		return "dbname=" + dsnQuote(name)
+	}
+	return name
+}
+
+// pgEnv returns the libpq environment variables pg_dump and psql need to reach
+// the server described by config.
+func pgEnv(config *DatabaseConfig) map[string]string {
+	env := map[string]string{
+		"PGPASSWORD": config.Password,
+		"PGSSLMODE":  config.SSLMode,
+	}
+	if config.SSLRootCert != "" {
+		env["PGSSLROOTCERT"] = config.SSLRootCert
+	}
+	if config.SSLCert != "" {
+		env["PGSSLCERT"] = config.SSLCert
+	}
+	if config.SSLKey != "" {
+		env["PGSSLKEY"] = config.SSLKey
+	}
+	if config.SSLMinProtocol != "" {
+		env["PGSSLMINPROTOCOLVERSION"] = config.SSLMinProtocol
+	}
+	if config.ChannelBinding != "" {
+		env["PGCHANNELBINDING"] = config.ChannelBinding
+	}
+	if config.GSSEncMode != "" {
+		env["PGGSSENCMODE"] = config.GSSEncMode
+	}
+	if config.Options != "" {
+		env["PGOPTIONS"] = config.Options
+	}
+	return env
+}
+
+// optionsHint points at the connection options when a connection with them
+// failed, since the server rejects the whole connection for a bad one
+func optionsHint(config *DatabaseConfig, side string) string {
+	if config.Options == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (check that the server accepts --%s-options %s)", side, redactOptions(config.Options))
+}
+
+// validateSSLFiles checks that configured certificate and key files exist and
+// are readable.
+func validateSSLFiles(config *DatabaseConfig) error {
+	files := []struct {
+		flag string
+		path string
+	}{
+		{"sslrootcert", config.SSLRootCert},
+		{"sslcert", config.SSLCert},
+		{"sslkey", config.SSLKey},
+	}
+
+	var problems []string
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		file, err := os.Open(f.path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s: %v", f.flag, f.path, err))
+			continue
+		}
+		file.Close()
+	}
+
+	if (config.SSLCert == "") != (config.SSLKey == "") {
+		problems = append(problems, "sslcert and sslkey must be given together")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// shellQuote quotes a value for safe use in a generated shell script
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// socketDirs are socket directories as given to --source-host
+var socketDirs = []string{
+	"/var/run/postgresql",
+	"/tmp/pg sockets",
+	"/srv/my  db/run",
+	"/tmp/it's here",
+	`/tmp/back\slash dir`,
+}
+
+func TestConnStringSocketPath(t *testing.T) {
+	for _, dir := range socketDirs {
+		config := &DatabaseConfig{Host: dir, Port: "5433", Username: "app user", Database: "app", SSLMode: sslModeForHost(dir, "require", false)}
+		dsn := connString(config, "my db")
+
+		// pgx reads connection strings as libpq does
+		parsed, err := pgconn.ParseConfig(dsn)
+		if err != nil {
+			t.Errorf("%q: %v", dsn, err)
+			continue
+		}
+		if parsed.Host != dir || parsed.Port != 5433 || parsed.User != "app user" || parsed.Database != "my db" {
+			t.Errorf("%q read back as host %q port %d user %q dbname %q", dsn, parsed.Host, parsed.Port, parsed.User, parsed.Database)
+		}
+		if parsed.TLSConfig != nil {
+			t.Errorf("%q: SSL is negotiated over a socket", dsn)
+		}
+	}
+}
+
+func TestSocketToolArguments(t *testing.T) {
+	captureLog(t)
+	for _, dir := range socketDirs {
+		config := &DatabaseConfig{Host: dir, Port: "5432", Username: "app", Database: "app", SSLMode: sslModeForHost(dir, "verify-full", true)}
+
+		// pg_dump and psql get the directory as one argument, not split
+		args := exportSchemaArgs(config, &MigrationOptions{})
+		if i := slices.Index(args, "-h"); i < 0 || args[i+1] != dir {
+			t.Errorf("%s: pg_dump arguments %q", dir, args)
+		}
+		// and libpq in them is told not to try SSL
+		env := pgEnv(config)
+		if env["PGSSLMODE"] != "disable" {
+			t.Errorf("%s: PGSSLMODE=%s", dir, env["PGSSLMODE"])
+		}
+		if _, ok := env["PGHOST"]; ok {
+			t.Errorf("%s: PGHOST set besides -h", dir)
+		}
+
+		// The command shown in plans reads back as the same arguments
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = shellQuote(arg)
+		}
+		words, err := shellWords("pg_dump " + strings.Join(quoted, " "))
+		if err != nil || !slices.Equal(words[1:], args) {
+			t.Errorf("%s: the quoted command reads back as %q, %v", dir, words, err)
+		}
+	}
+}
+
+func TestSSLModeForHost(t *testing.T) {
+	captureLog(t)
+	for _, test := range []struct {
+		host, mode string
+		want       string
+	}{
+		{"/var/run/postgresql", "require", "disable"},
+		{"/tmp/pg sockets", "verify-full", "disable"},
+		{"/tmp/pg sockets", "disable", "disable"},
+		{"db.example.com", "require", "require"},
+		{"localhost", "prefer", "prefer"},
+	} {
+		if got := sslModeForHost(test.host, test.mode, true); got != test.want {
+			t.Errorf("%s with %s: %s, want %s", test.host, test.mode, got, test.want)
+		}
+	}
+}
+
+// readStartupMessage reads the parameters of the startup message a client
+// sends first
+func readStartupMessage(conn net.Conn) (map[string]string, error) {
+	var length int32
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+	fields := bytes.Split(body[4:], []byte{0}) // After the protocol version
+	params := make(map[string]string)
+	for i := 0; i+1 < len(fields); i += 2 {
+		params[string(fields[i])] = string(fields[i+1])
+	}
+	return params, nil
+}
+
+// startupServer listens on port 5433 of a socket directory with a space in
+// its name, and hangs up on every client after sending on the channel the
+// startup parameters it got
+func startupServer(t *testing.T) (string, <-chan map[string]string) {
+	t.Helper()
+	// Socket paths are limited to about 100 bytes, so not in t.TempDir()
+	dir, err := os.MkdirTemp("", "pgsm socket ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	listener, err := net.Listen("unix", filepath.Join(dir, ".s.PGSQL.5433"))
+	if err != nil {
+		t.Skipf("no Unix sockets here: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	startups := make(chan map[string]string, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			params, err := readStartupMessage(conn)
+			if err == nil {
+				select {
+				case startups <- params:
+				default: // A retry of a Ping already seen
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return dir, startups
+}
+
+// nextStartup waits for the startup parameters a client sent startupServer
+func nextStartup(t *testing.T, startups <-chan map[string]string) map[string]string {
+	t.Helper()
+	select {
+	case params := <-startups:
+		return params
+	case <-time.After(5 * time.Second):
+		t.Error("no client connected to the socket")
+		return nil
+	}
+}
+
+func TestConnectToSocketWithSpaces(t *testing.T) {
+	dir, startups := startupServer(t)
+	for _, backend := range driverBackends {
+		config := &DatabaseConfig{Host: dir, Port: "5433", Username: "app", Database: "my db", Driver: backend, SSLMode: sslModeForHost(dir, "require", false)}
+		db, err := openDatabase(config, config.Database)
+		if err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		db.Ping() // Fails once the test server hangs up
+		db.Close()
+
+		if params := nextStartup(t, startups); params["user"] != "app" || params["database"] != "my db" {
+			t.Errorf("%s: startup message %v", backend, params)
+		}
+	}
+}
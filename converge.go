@@ -0,0 +1,666 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// errDestructiveChanges stops a converge that would drop or rebuild objects
+var errDestructiveChanges = errors.New("destructive changes required; rerun with --allow-destructive to apply them")
+
+// Converge actions
+const (
+	ConvergeCreate  = "create"  // New object
+	ConvergeReplace = "replace" // CREATE OR REPLACE, or a statement that can be repeated
+	ConvergeAlter   = "alter"   // Columns added to or dropped from a table
+	ConvergeDrop    = "drop"    // Object only on the destination
+	ConvergeRebuild = "rebuild" // Dropped and created again
+)
+
+// replaceableTypes are the TOC types whose changed entries are applied again
+// as they are, or with CREATE OR REPLACE
+var replaceableTypes = map[string]string{
+	"FUNCTION":          "CREATE FUNCTION ",
+	"PROCEDURE":         "CREATE PROCEDURE ",
+	"VIEW":              "CREATE VIEW ",
+	"COMMENT":           "",
+	"ACL":               "",
+	"DEFAULT":           "",
+	"SEQUENCE OWNED BY": "",
+}
+
+// codeEntryTypes are the TOC types of stored code, by the kind normalizeCode
+// compares them as
+var codeEntryTypes = map[string]string{
+	"FUNCTION":          CodeFunction,
+	"PROCEDURE":         CodeProcedure,
+	"VIEW":              CodeView,
+	"MATERIALIZED VIEW": CodeMaterializedView,
+	"TRIGGER":           CodeTrigger,
+}
+
+// createTablePattern matches the first line of a table in a plain-format dump
+var createTablePattern = regexp.MustCompile(`^CREATE (?:UNLOGGED )?TABLE (.+) \($`)
+
+// dumpEntry is one TOC entry of a plain-format pg_dump
+type dumpEntry struct {
+	Name   string
+	Type   string
+	Schema string
+	Body   string // The entry's statements, without OWNER TO lines
+}
+
+func (e dumpEntry) key() string {
+	return e.Type + "|" + e.Schema + "|" + e.Name
+}
+
+func (e dumpEntry) String() string {
+	if e.Schema == "-" {
+		return e.Type + " " + e.Name
+	}
+	return fmt.Sprintf("%s %s.%s", e.Type, e.Schema, e.Name)
+}
+
+// qualified returns name in the entry's schema, quoted
+func (e dumpEntry) qualified(name string) string {
+	if e.Schema == "-" {
+		return quoteIdentifier(name)
+	}
+	return quoteIdentifier(e.Schema) + "." + quoteIdentifier(name)
+}
+
+// parseDumpEntries splits a plain-format dump into the SET statements that
+// precede the first entry and its TOC entries
+func parseDumpEntries(path string) (string, []dumpEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var preamble []string
+	var entries []dumpEntry
+	var body []string
+	finish := func() {
+		if len(entries) > 0 {
+			entries[len(entries)-1].Body = strings.TrimSpace(strings.Join(body, "\n"))
+		}
+		body = nil
+	}
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r")
+		switch {
+		case tocEntryPattern.MatchString(line):
+			// The "--" opening the header was taken for the previous entry
+			if n := len(body); n > 0 && body[n-1] == "--" {
+				body = body[:n-1]
+			}
+			finish()
+			m := tocEntryPattern.FindStringSubmatch(line)
+			entries = append(entries, dumpEntry{Name: m[1], Type: m[2], Schema: m[3]})
+			if i+1 < len(lines) && strings.TrimRight(lines[i+1], "\r") == "--" {
+				i++
+			}
+		case strings.HasPrefix(line, `\restrict `) || strings.HasPrefix(line, `\unrestrict `):
+			// The key changes with every dump
+		case strings.HasPrefix(line, dumpTrailer):
+			if n := len(body); n > 0 && body[n-1] == "--" {
+				body = body[:n-1]
+			}
+			i++ // Its closing "--"
+		case len(entries) == 0:
+			if line != "" && !strings.HasPrefix(line, "--") {
+				preamble = append(preamble, line)
+			}
+		case ownershipStatement(line, true, false) != "":
+		default:
+			body = append(body, line)
+		}
+	}
+	finish()
+	return strings.Join(preamble, "\n"), entries, nil
+}
+
+// ConvergeChange is one statement group bringing the destination to the schema file
+type ConvergeChange struct {
+	Object      string `json:"object"`
+	Action      string `json:"action"`
+	Destructive bool   `json:"destructive"`
+	Manual      bool   `json:"manual,omitempty"` // No statement can make the change
+	SQL         string `json:"sql,omitempty"`
+	Diff        string `json:"diff,omitempty"` // Unified diff of a changed function or view, from the destination to the schema file
+
+	// Dependents are what goes with the objects and columns the change drops,
+	// from the catalogs of the destination
+	Dependents []DropDependent `json:"dependents,omitempty"`
+	targets    []dropTarget
+}
+
+// dropEntryStatement drops the object of a TOC entry, or returns "" for
+// types it doesn't know how to drop
+func dropEntryStatement(e dumpEntry) string {
+	owner, name, pair := strings.Cut(e.Name, " ")
+	// The sequence of an identity column goes with its identity
+	if id, ok := parseIdentity(e); ok {
+		return fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP IDENTITY IF EXISTS;", id.Table, id.Column)
+	}
+	switch e.Type {
+	case "TABLE", "FOREIGN TABLE", "VIEW", "MATERIALIZED VIEW", "SEQUENCE", "INDEX", "TYPE", "DOMAIN":
+		return fmt.Sprintf("DROP %s IF EXISTS %s;", e.Type, e.qualified(e.Name))
+	case "SCHEMA", "EXTENSION":
+		return fmt.Sprintf("DROP %s IF EXISTS %s;", e.Type, quoteIdentifier(e.Name))
+	case "FUNCTION", "PROCEDURE", "AGGREGATE":
+		if name, args, ok := strings.Cut(e.Name, "("); ok {
+			return fmt.Sprintf("DROP %s IF EXISTS %s(%s;", e.Type, e.qualified(name), args)
+		}
+	case "TRIGGER", "POLICY", "RULE":
+		if pair {
+			return fmt.Sprintf("DROP %s IF EXISTS %s ON %s;", e.Type, quoteIdentifier(name), e.qualified(owner))
+		}
+	case "CONSTRAINT", "FK CONSTRAINT", "CHECK CONSTRAINT":
+		if pair {
+			return fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s;", e.qualified(owner), quoteIdentifier(name))
+		}
+	case "DEFAULT":
+		if pair {
+			return fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP DEFAULT;", e.qualified(owner), quoteIdentifier(name))
+		}
+	}
+	return ""
+}
+
+// parseTableBody splits a CREATE TABLE statement into its table name, its
+// columns and table constraints keyed by name, and what follows the column
+// list. ok is false for bodies holding more than one CREATE TABLE statement.
+func parseTableBody(body string) (table string, items map[string]string, order []string, tail string, ok bool) {
+	lines := strings.Split(body, "\n")
+	m := createTablePattern.FindStringSubmatch(lines[0])
+	if m == nil {
+		return "", nil, nil, "", false
+	}
+	items = make(map[string]string)
+	for i, line := range lines[1:] {
+		if strings.HasPrefix(line, ")") {
+			return m[1], items, order, strings.Join(lines[i+1:], "\n"), true
+		}
+		item := strings.TrimSuffix(strings.TrimSpace(line), ",")
+		key := strings.Fields(item)[0]
+		if key == "CONSTRAINT" {
+			key += " " + strings.Fields(item)[1]
+		}
+		items[key] = item
+		order = append(order, key)
+	}
+	return "", nil, nil, "", false
+}
+
+// tableChanges turns the differences between two versions of a table into
+// ALTER TABLE statements: new columns are added, removed ones dropped and
+// changed ones dropped and added again, with CASCADE when cascade is set.
+// dropped lists the columns and constraints dropped. Storage parameters,
+// statistics targets and storage modes are set and reset. ok is false when
+// more than the columns and those settings changed. A generated column whose
+// expression only differs in spelling is left alone, and one the destination
+// of version can change in place is altered rather than rebuilt.
+func tableChanges(want, have dumpEntry, cascade bool, version int) (additive, destructive []string, dropped []dropTarget, ok bool) {
+	table, wantItems, wantOrder, wantTail, ok1 := parseTableBody(want.Body)
+	_, haveItems, haveOrder, haveTail, ok2 := parseTableBody(have.Body)
+	if !ok1 || !ok2 {
+		return nil, nil, nil, false
+	}
+	wantTail, wantSettings := splitTableSettings(wantTail)
+	haveTail, haveSettings := splitTableSettings(haveTail)
+	if wantTail != haveTail {
+		return nil, nil, nil, false
+	}
+	droppedColumns := make(map[string]bool)
+	drop := func(key string) string {
+		statement := fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s;", table, key)
+		target := dropTarget{kind: "column", name: table, child: unquoteName(key)}
+		if name, ok := strings.CutPrefix(key, "CONSTRAINT "); ok {
+			statement = fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s;", table, name)
+			target = dropTarget{kind: "constraint", name: table, child: unquoteName(name)}
+		}
+		dropped = append(dropped, target)
+		if cascade {
+			return withCascade(statement)
+		}
+		return statement
+	}
+	add := func(key string) string {
+		if strings.HasPrefix(key, "CONSTRAINT ") {
+			return fmt.Sprintf("ALTER TABLE %s ADD %s;", table, wantItems[key])
+		}
+		return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s;", table, wantItems[key])
+	}
+
+	for _, key := range haveOrder {
+		if _, ok := wantItems[key]; !ok {
+			destructive = append(destructive, drop(key))
+			droppedColumns[key] = true
+		}
+	}
+	for _, key := range wantOrder {
+		current, ok := haveItems[key]
+		switch {
+		case !ok:
+			additive = append(additive, add(key))
+		case current != wantItems[key]:
+			if !strings.HasPrefix(key, "CONSTRAINT ") {
+				if statements, ok := generatedColumnChange(table, key, wantItems[key], current, version); ok {
+					additive = append(additive, statements...)
+					continue
+				}
+			}
+			destructive = append(destructive, drop(key), add(key))
+			droppedColumns[key] = true
+		}
+	}
+	additive = append(additive, settingChanges(table, wantSettings, haveSettings, droppedColumns)...)
+	return additive, destructive, dropped, true
+}
+
+// unignoredEntries leaves out the entries of objects excluded by .pgsmignore
+// and --ignore-object, which converge neither creates nor drops
+func unignoredEntries(entries []dumpEntry, ignore *IgnoreList) []dumpEntry {
+	var kept []dumpEntry
+	for _, e := range entries {
+		if !ignore.Ignored(entryObject(e)) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// diffDumps lists the changes that bring a database dumped as have to the
+// dump want: objects only in have are dropped first, in reverse order, then
+// new and changed objects are created in the order of want. Comments and
+// privileges only on the destination are left alone. With cascade the DROP
+// statements take what depends on the objects along. version is the
+// server_version_num of the destination, or 0 when it isn't known. Functions
+// and views differing only in what normalizeCode evens out are the same,
+// unless strict is set; those that still differ carry a diff.
+func diffDumps(want, have []dumpEntry, cascade bool, version int, strict bool) []ConvergeChange {
+	wantKeys := make(map[string]bool)
+	for _, e := range want {
+		wantKeys[e.key()] = true
+	}
+	haveEntries := make(map[string]dumpEntry)
+	for _, e := range have {
+		haveEntries[e.key()] = e
+	}
+
+	var changes []ConvergeChange
+	for i := len(have) - 1; i >= 0; i-- {
+		e := have[i]
+		if wantKeys[e.key()] || e.Type == "COMMENT" || e.Type == "ACL" || e.Type == "DEFAULT ACL" {
+			continue
+		}
+		drop := dropEntryStatement(e)
+		if cascade {
+			drop = withCascade(drop)
+		}
+		change := ConvergeChange{Object: e.String(), Action: ConvergeDrop, Destructive: true, Manual: drop == "", SQL: drop}
+		if target, ok := entryDropTarget(e); ok {
+			change.targets = []dropTarget{target}
+		}
+		changes = append(changes, change)
+	}
+
+	for _, e := range want {
+		current, exists := haveEntries[e.key()]
+		found := len(changes)
+		switch {
+		case !exists:
+			changes = append(changes, ConvergeChange{Object: e.String(), Action: ConvergeCreate, SQL: e.Body})
+		case current.Body == e.Body:
+		case codeEntryTypes[e.Type] != "" && sameCode(codeEntryTypes[e.Type], current.Body, e.Body, strict):
+		case e.Type == "TABLE":
+			additive, destructive, dropped, ok := tableChanges(e, current, cascade, version)
+			if !ok {
+				changes = append(changes, rebuildChange(e, current, cascade))
+				continue
+			}
+			if len(destructive) > 0 {
+				changes = append(changes, ConvergeChange{Object: e.String(), Action: ConvergeAlter, Destructive: true, SQL: strings.Join(destructive, "\n"), targets: dropped})
+			}
+			if len(additive) > 0 {
+				changes = append(changes, ConvergeChange{Object: e.String(), Action: ConvergeAlter, SQL: strings.Join(additive, "\n")})
+			}
+		case e.Type == "SEQUENCE" && identityPattern.MatchString(strings.TrimSpace(e.Body)):
+			statement, ok := identityChange(e, current)
+			switch {
+			case !ok:
+				changes = append(changes, rebuildChange(e, current, cascade))
+			case statement != "":
+				changes = append(changes, ConvergeChange{Object: e.String(), Action: ConvergeAlter, SQL: statement})
+			}
+		default:
+			prefix, ok := replaceableTypes[e.Type]
+			if !ok {
+				changes = append(changes, rebuildChange(e, current, cascade))
+				continue
+			}
+			body := e.Body
+			if prefix != "" {
+				body = strings.Replace(body, prefix, "CREATE OR REPLACE "+strings.TrimPrefix(prefix, "CREATE "), 1)
+			}
+			changes = append(changes, ConvergeChange{Object: e.String(), Action: ConvergeReplace, SQL: body})
+		}
+		if exists && len(changes) > found && codeEntryTypes[e.Type] != "" {
+			changes[found].Diff = unifiedDiff("destination "+e.String(), "schema file "+e.String(), current.Body, e.Body)
+		}
+	}
+	return changes
+}
+
+// rebuildChange drops an object and creates it as the schema file has it
+func rebuildChange(want, have dumpEntry, cascade bool) ConvergeChange {
+	drop := dropEntryStatement(have)
+	if cascade {
+		drop = withCascade(drop)
+	}
+	change := ConvergeChange{Object: want.String(), Action: ConvergeRebuild, Destructive: true, Manual: drop == "", SQL: drop + "\n" + want.Body}
+	if target, ok := entryDropTarget(have); ok {
+		change.targets = []dropTarget{target}
+	}
+	return change
+}
+
+func newConvergeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "converge [schema-file]",
+		Short: "Bring the destination database to a schema file without dropping it",
+		Long: "Create the destination database if it is missing and apply, in one transaction, only the statements " +
+			"that bring it to the schema file. Running it again once converged changes nothing. Changes that drop or " +
+			"rebuild objects are printed, with what depends on the dropped objects on the destination, and make it exit " +
+			"with code 2 unless --allow-destructive is given. Drops are plain and fail while dependents exist, unless " +
+			"--cascade is given.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: runConverge,
+	}
+
+	cmd.Flags().StringP("schema-file", "f", "", "Schema file to converge the destination to")
+	cmd.Flags().BoolP("allow-destructive", "", false, "Also apply changes that drop or rebuild objects or columns")
+	cmd.Flags().BoolP("cascade", "", false, "Drop with CASCADE, taking the dependents listed along")
+	cmd.Flags().BoolP("no-cascade", "", false, "Drop without CASCADE, failing while dependents exist (the default)")
+	return cmd
+}
+
+func runConverge(cmd *cobra.Command, args []string) error {
+	if err := configureCIOutput(cmd); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	logger.Info("Starting PostgreSQL schema converge...")
+	handleSignals()
+
+	schemaFile, err := applySchemaSource(cmd, args)
+	if err == nil && schemaFile == "-" {
+		err = fmt.Errorf("converge needs a schema file, not stdin")
+	}
+	if err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	options, err := parseMigrationOptions(cmd)
+	if err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Failed to parse options: %v", err))
+	}
+	allowDestructive, _ := cmd.Flags().GetBool("allow-destructive")
+	cascade, _ := cmd.Flags().GetBool("cascade")
+	if noCascade, _ := cmd.Flags().GetBool("no-cascade"); cascade && noCascade {
+		return exitWith(exitOptionError, errors.New("--cascade and --no-cascade are mutually exclusive"))
+	}
+
+	if destDB, _ := cmd.Flags().GetString("dest-db"); destDB == "" {
+		return exitWith(exitOptionError, errors.New("--dest-db is required for converge"))
+	}
+	if err := validateConnectionFlags(cmd, false, true); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	state, err := beginRun(cmd, options)
+	if err != nil {
+		return err
+	}
+	state.SchemaFile = schemaFile
+
+	destConfig, err := getDestConfig(cmd, "")
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Failed to get destination config: %v", err))
+	}
+	if err := protectProduction(nil, destConfig, options); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+	if err := checkBlackout(options, state, time.Now()); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+	state.Dest = destConfig
+
+	if err := startTunnels(&options.SSH, destConfig); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("SSH tunnel setup failed: %v", err))
+	}
+	if err := validateDestinationConnection(destConfig); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Connection validation failed: %v", err))
+	}
+	if err := resolveDatabaseCase(destConfig, options, state); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+
+	if useKeyring, _ := cmd.Flags().GetBool("use-keyring"); useKeyring {
+		rememberPasswords(destConfig)
+	}
+
+	if err := convergeSchema(destConfig, schemaFile, allowDestructive, cascade, options, state); err != nil {
+		if errors.Is(err, errDestructiveChanges) {
+			return exitWith(exitDestructive, fmt.Errorf("Schema converge failed: %v", err))
+		}
+		return exitWith(exitFailure, fmt.Errorf("Schema converge failed: %v", err))
+	}
+
+	if err := finishRun(state, options); err != nil {
+		return err
+	}
+	logger.Success("Schema converge completed successfully!")
+	return nil
+}
+
+// convergeSchema brings dest to schemaFile: the database is created when
+// missing, the differences with a dump of it are applied in one transaction.
+// What depends on the objects dropped is looked up first and shown with them.
+func convergeSchema(dest *DatabaseConfig, schemaFile string, allowDestructive, cascade bool, options *MigrationOptions, state *RunState) error {
+	timestamp := state.Timestamp()
+	if err := createDirectories(options); err != nil {
+		return fmt.Errorf("failed to create directories: %v", err)
+	}
+	if err := resolveCreateDatabaseOptions(nil, dest, &options.CreateDB); err != nil {
+		return fmt.Errorf("invalid destination database options: %v", err)
+	}
+
+	preamble, want, err := parseDumpEntries(schemaFile)
+	if err != nil {
+		return fmt.Errorf("failed to read schema file: %v", err)
+	}
+
+	if err := refreshCredentials(dest); err != nil {
+		return err
+	}
+	exists, err := databaseExists(dest)
+	if err != nil {
+		return err
+	}
+	if !exists && !options.DryRun {
+		err := state.phase("create", func() error {
+			return createDatabase(dest, &options.CreateDB)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create destination database: %v", err)
+		}
+		exists = true
+	}
+
+	var changes []ConvergeChange
+	err = state.phase("diff", func() error {
+		var have []dumpEntry
+		var version int
+		if exists {
+			if have, err = dumpDestinationEntries(dest, options); err != nil {
+				return err
+			}
+			if version, err = destinationVersion(dest); err != nil {
+				logger.Debug(fmt.Sprintf("Server version of the destination unknown, generated columns are rebuilt: %v", err))
+			}
+		} else {
+			logger.Info(fmt.Sprintf("DRY RUN MODE - would create database %s", dest.Database))
+		}
+		changes = diffDumps(unignoredEntries(want, options.Ignore), unignoredEntries(have, options.Ignore), cascade, version, options.StrictCodeCompare)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to compare the destination with the schema file: %v", err)
+	}
+	if exists && slices.ContainsFunc(changes, func(c ConvergeChange) bool { return len(c.targets) > 0 }) {
+		err := state.phase("dependents", func() error {
+			return previewDependents(dest, changes)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to look up dependents of dropped objects: %v", err)
+		}
+	}
+	state.ConvergeChanges = changes
+	if len(changes) == 0 {
+		logger.Success(fmt.Sprintf("No changes: '%s' already matches %s", dest.Database, schemaFile))
+		return nil
+	}
+
+	destructive, manual, blocking := 0, 0, 0
+	logger.Info(fmt.Sprintf("%d change(s) to converge '%s':", len(changes), dest.Database))
+	for _, c := range changes {
+		marker := "  "
+		switch {
+		case c.Manual:
+			marker = "!!"
+			manual++
+		case c.Destructive:
+			marker = "!"
+			destructive++
+		}
+		logger.Info(fmt.Sprintf("%s %s %s", marker, c.Action, c.Object))
+		for _, line := range strings.Split(strings.TrimSuffix(c.Diff, "\n"), "\n") {
+			if line != "" {
+				logger.Info("     " + line)
+			}
+		}
+		for _, line := range dependentLines(c.Dependents, "     ") {
+			logger.Info(line)
+		}
+		for _, d := range c.Dependents {
+			if d.Cascade {
+				blocking++
+			}
+		}
+	}
+
+	script := filepath.Join(options.OutputDir, fmt.Sprintf("converge_%s_%s.sql", dest.Database, timestamp))
+	header := newFileHeader(FileKindConverge, "pg_dump", dest, state)
+	if err := writeConvergeScript(script, header, preamble, changes); err != nil {
+		return fmt.Errorf("failed to write converge script: %v", err)
+	}
+	state.ConvergeFile = script
+	logger.Info(fmt.Sprintf("Converge statements written to: %s", script))
+
+	if manual > 0 {
+		return fmt.Errorf("%d change(s) marked !! have no automatic statement and must be made by hand", manual)
+	}
+	if destructive > 0 && !allowDestructive {
+		for _, c := range changes {
+			if c.Destructive {
+				message := fmt.Sprintf("%s %s:\n%s", c.Action, c.Object, c.SQL)
+				if len(c.Dependents) > 0 {
+					message += "\nDepending on it:\n" + strings.Join(dependentLines(c.Dependents, "  "), "\n")
+				}
+				logger.Warning(message)
+			}
+		}
+		return fmt.Errorf("%d change(s) marked ! drop or rebuild objects: %w", destructive, errDestructiveChanges)
+	}
+	if blocking > 0 {
+		if cascade {
+			logger.Warning(fmt.Sprintf("CASCADE drops the %d dependent object(s) listed as needing it above; those the schema file has and this converge does not create again are created by the next converge", blocking))
+		} else {
+			logger.Warning(fmt.Sprintf("%d dependent object(s) listed above need CASCADE: the plain DROP fails on those not dropped first, unless --cascade is given", blocking))
+		}
+	}
+	if options.DryRun {
+		logger.Info("DRY RUN MODE - the statements above were not applied")
+		return nil
+	}
+
+	return state.phase("apply", func() error {
+		if err := refreshCredentials(dest); err != nil {
+			return err
+		}
+		logger.Info(fmt.Sprintf("Applying %d change(s) in one transaction...", len(changes)))
+		committed, err := runSingleTransaction(dest, script, state)
+		if err != nil && !committed {
+			return fmt.Errorf("psql failed, nothing was changed: %v", err)
+		}
+		return err
+	})
+}
+
+// dumpDestinationEntries dumps the schema of dest, with privileges so those
+// of the schema file can be compared, and parses it
+func dumpDestinationEntries(dest *DatabaseConfig, options *MigrationOptions) ([]dumpEntry, error) {
+	file, err := scratchFile("converge-*.sql")
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	defer releaseScratch(file.Name())
+
+	args := removeFromSlice(removeFromSlice(exportSchemaArgs(dest, options), "--no-privileges"), "--verbose")
+	args = append(args, "-f", file.Name())
+	cmd := clientCommand(dest, "pg_dump", args, file.Name())
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("pg_dump of the destination failed: %v", err)
+	}
+	_, entries, err := parseDumpEntries(file.Name())
+	return entries, err
+}
+
+// writeConvergeScript writes the statements of changes after the SET
+// statements of the schema file
+func writeConvergeScript(path string, header *FileHeader, preamble string, changes []ConvergeChange) error {
+	var b strings.Builder
+	header.write(&b)
+	b.WriteString("-- Statements converging the destination to the schema file, applied in one transaction\n\n")
+	b.WriteString(preamble + "\n")
+	for _, c := range changes {
+		fmt.Fprintf(&b, "\n-- %s %s\n", c.Action, c.Object)
+		if c.Manual {
+			b.WriteString("-- No automatic statement, make this change by hand\n")
+		}
+		if len(c.Dependents) > 0 {
+			b.WriteString("-- Depending on it on the destination:\n")
+			for _, line := range dependentLines(c.Dependents, "--   ") {
+				b.WriteString(line + "\n")
+			}
+		}
+		if c.SQL != "" {
+			b.WriteString(c.SQL + "\n")
+		}
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
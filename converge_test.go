@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeDump writes a plain dump of the entries, each a header and its body,
+// and parses it back
+func writeDump(t *testing.T, entries ...string) []dumpEntry {
+	t.Helper()
+	text := "SET client_encoding = 'UTF8';\n"
+	for _, e := range entries {
+		text += "\n--\n-- " + e + "\n"
+	}
+	path := filepath.Join(t.TempDir(), "schema.sql")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, parsed, err := parseDumpEntries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestConvergeLeavesIgnoredObjectsAlone(t *testing.T) {
+	want := writeDump(t,
+		"Name: orders; Type: TABLE; Schema: public; Owner: app\n--\n\nCREATE TABLE public.orders (\n    id integer\n);\n",
+		// Created by the tool that manages the schema, not by converge
+		"Name: audit; Type: SCHEMA; Schema: -; Owner: app\n--\n\nCREATE SCHEMA audit;\n",
+		"Name: events; Type: TABLE; Schema: audit; Owner: app\n--\n\nCREATE TABLE audit.events (\n    id integer\n);\n",
+	)
+	have := writeDump(t,
+		"Name: orders; Type: TABLE; Schema: public; Owner: app\n--\n\nCREATE TABLE public.orders (\n    id integer\n);\n",
+		"Name: partman; Type: SCHEMA; Schema: -; Owner: app\n--\n\nCREATE SCHEMA partman;\n",
+		"Name: part_config; Type: TABLE; Schema: partman; Owner: app\n--\n\nCREATE TABLE partman.part_config (\n    parent_table text\n);\n",
+		"Name: stale; Type: TABLE; Schema: public; Owner: app\n--\n\nCREATE TABLE public.stale (\n    id integer\n);\n",
+		"Name: pg_stat_cache; Type: VIEW; Schema: public; Owner: app\n--\n\nCREATE VIEW public.pg_stat_cache AS\n SELECT 1 AS one;\n",
+	)
+
+	ignore := &IgnoreList{}
+	for _, pattern := range []string{"partman", "audit", "public.pg_stat_*"} {
+		if err := ignore.add(pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for _, c := range diffDumps(unignoredEntries(want, ignore), unignoredEntries(have, ignore), false, 0, false) {
+		got = append(got, c.Action+" "+c.Object)
+	}
+	if wantChanges := []string{"drop TABLE public.stale"}; !slices.Equal(got, wantChanges) {
+		t.Errorf("changes %q, want %q", got, wantChanges)
+	}
+
+	// Without the list the same dumps drop and create them
+	var all []string
+	for _, c := range diffDumps(want, have, false, 0, false) {
+		all = append(all, c.Action+" "+c.Object)
+	}
+	if len(all) != 6 {
+		t.Errorf("without ignore list: %q", all)
+	}
+}
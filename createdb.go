@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// CreateDatabaseOptions holds the options used when recreating the destination database
+type CreateDatabaseOptions struct {
+	Owner              string
+	Template           string
+	Tablespace         string
+	ConnectionLimit    int // -1 means unlimited
+	ConnectionLimitSet bool
+	Encoding           string // Copied from the source by --bootstrap
+	Collate            string
+	Ctype              string
+}
+
+// databaseSettings are the CREATE DATABASE relevant properties of an existing database
+type databaseSettings struct {
+	Owner           string
+	Tablespace      string
+	ConnectionLimit int
+}
+
+// buildCreateDatabaseStatement renders the full CREATE DATABASE statement
+func buildCreateDatabaseStatement(name string, opts *CreateDatabaseOptions) string {
+	var b strings.Builder
+	b.WriteString("CREATE DATABASE ")
+	b.WriteString(quoteIdentifier(name))
+
+	if opts == nil {
+		return b.String()
+	}
+	if opts.Owner != "" {
+		b.WriteString(" OWNER " + quoteIdentifier(opts.Owner))
+	}
+	if opts.Template != "" {
+		b.WriteString(" TEMPLATE " + quoteIdentifier(opts.Template))
+	}
+	if opts.Encoding != "" {
+		b.WriteString(" ENCODING " + pq.QuoteLiteral(opts.Encoding))
+	}
+	if opts.Collate != "" {
+		b.WriteString(" LC_COLLATE " + pq.QuoteLiteral(opts.Collate))
+	}
+	if opts.Ctype != "" {
+		b.WriteString(" LC_CTYPE " + pq.QuoteLiteral(opts.Ctype))
+	}
+	if opts.Tablespace != "" {
+		b.WriteString(" TABLESPACE " + quoteIdentifier(opts.Tablespace))
+	}
+	if opts.ConnectionLimitSet {
+		b.WriteString(fmt.Sprintf(" CONNECTION LIMIT %d", opts.ConnectionLimit))
+	}
+	return b.String()
+}
+
+// resolveCreateDatabaseOptions fills unset options from the existing destination
+// database (or the source database, if any, when the destination doesn't exist yet) and
+// checks that everything referenced exists on the destination server. Explicit
+// flags that don't resolve are errors; captured defaults that don't resolve are
+// dropped with a warning.
+func resolveCreateDatabaseOptions(source, dest *DatabaseConfig, opts *CreateDatabaseOptions) error {
+	destDB, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+
+	captured, origin, err := captureDatabaseSettings(source, dest, destDB)
+	if err != nil {
+		warn(WarnDatabaseSettingsUnknown, fmt.Sprintf("Could not capture existing database settings: %v", err))
+	}
+
+	explicitOwner := opts.Owner != ""
+	explicitTablespace := opts.Tablespace != ""
+
+	if captured != nil {
+		if !explicitOwner {
+			opts.Owner = captured.Owner
+		}
+		if !explicitTablespace && captured.Tablespace != "pg_default" {
+			opts.Tablespace = captured.Tablespace
+		}
+		if !opts.ConnectionLimitSet && captured.ConnectionLimit != -1 {
+			opts.ConnectionLimit = captured.ConnectionLimit
+			opts.ConnectionLimitSet = true
+		}
+		logger.Info(fmt.Sprintf("Destination database defaults taken from the %s database", origin))
+	}
+
+	if opts.Template != "" {
+		exists, err := rowExists(destDB, `SELECT EXISTS(SELECT 1 FROM pg_database WHERE datname = $1)`, opts.Template)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("template database %q does not exist on %s", opts.Template, dest.Host)
+		}
+	}
+
+	if opts.Owner != "" {
+		exists, err := rowExists(destDB, `SELECT EXISTS(SELECT 1 FROM pg_roles WHERE rolname = $1)`, opts.Owner)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if explicitOwner {
+				return fmt.Errorf("owner role %q does not exist on %s", opts.Owner, dest.Host)
+			}
+			warn(WarnOwnerMissing, fmt.Sprintf("Owner %q of the %s database does not exist on %s, using the default owner", opts.Owner, origin, dest.Host))
+			opts.Owner = ""
+		}
+	}
+
+	if opts.Tablespace != "" {
+		exists, err := rowExists(destDB, `SELECT EXISTS(SELECT 1 FROM pg_tablespace WHERE spcname = $1)`, opts.Tablespace)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if explicitTablespace {
+				return fmt.Errorf("tablespace %q does not exist on %s", opts.Tablespace, dest.Host)
+			}
+			warn(WarnTablespaceMissing, fmt.Sprintf("Tablespace %q of the %s database does not exist on %s, using the default tablespace", opts.Tablespace, origin, dest.Host))
+			opts.Tablespace = ""
+		}
+	}
+
+	return nil
+}
+
+// captureDatabaseSettings reads the settings of the destination database if it
+// exists, falling back to the source database.
+func captureDatabaseSettings(source, dest *DatabaseConfig, destDB *sql.DB) (*databaseSettings, string, error) {
+	settings, err := queryDatabaseSettings(destDB, dest.Database)
+	if err != nil {
+		return nil, "", err
+	}
+	if settings != nil {
+		return settings, "existing destination", nil
+	}
+	if source == nil {
+		return nil, "", nil
+	}
+
+	sourceDB, err := openDB(source, source.Database)
+	if err != nil {
+		return nil, "", err
+	}
+	defer sourceDB.Close()
+
+	settings, err = queryDatabaseSettings(sourceDB, source.Database)
+	return settings, "source", err
+}
+
+func queryDatabaseSettings(db *sql.DB, name string) (*databaseSettings, error) {
+	var s databaseSettings
+	err := db.QueryRow(`
+		SELECT pg_get_userbyid(d.datdba), t.spcname, d.datconnlimit
+		FROM pg_database d
+		JOIN pg_tablespace t ON t.oid = d.dattablespace
+		WHERE d.datname = $1`, name).Scan(&s.Owner, &s.Tablespace, &s.ConnectionLimit)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func rowExists(db *sql.DB, query string, args ...interface{}) (bool, error) {
+	var exists bool
+	err := db.QueryRow(query, args...).Scan(&exists)
+	return exists, err
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/term"
+)
+
+// keyringService is the service name passwords are stored under in the OS keychain
+const keyringService = "pg-schema-migrate"
+
+// passwordCommandTimeout bounds how long a --*-password-command may run
+const passwordCommandTimeout = 30 * time.Second
+
+// obtainCredentials fills in config.Password. side is "source" or
+// "destination" and selects the side-specific flags and environment variables.
+// Passwords are looked up in this order: password command, OS keyring,
+// pgpass file, environment, interactive prompt.
+func obtainCredentials(cmd *cobra.Command, config *DatabaseConfig, side string) error {
+	if config.Auth == "iam" {
+		region, _ := cmd.Flags().GetString("aws-region")
+		profile, _ := cmd.Flags().GetString("aws-profile")
+		return setupIAMAuth(config, &AWSOptions{Region: region, Profile: profile})
+	}
+
+	prefix := "source"
+	envName := "PGSM_SOURCE_PASSWORD"
+	if side == "destination" {
+		prefix = "dest"
+		envName = "PGSM_DEST_PASSWORD"
+	}
+	passwordCommand, _ := cmd.Flags().GetString(prefix + "-password-command")
+	useKeyring, _ := cmd.Flags().GetBool("use-keyring")
+
+	if passwordCommand != "" {
+		password, err := runPasswordCommand(passwordCommand)
+		if err != nil {
+			return fmt.Errorf("password command failed: %v", err)
+		}
+		logger.Info(fmt.Sprintf("Using %s password from --%s-password-command", side, prefix))
+		config.Password = password
+		config.passwordSource = "command"
+		return nil
+	}
+
+	if useKeyring {
+		password, err := keyring.Get(keyringService, keyringUser(config))
+		if err == nil {
+			logger.Info(fmt.Sprintf("Using %s password from the OS keyring", side))
+			config.Password = password
+			config.passwordSource = "keyring"
+			return nil
+		}
+		if !errors.Is(err, keyring.ErrNotFound) {
+			warn(WarnKeyringUnavailable, fmt.Sprintf("Could not read OS keyring: %v", err))
+		}
+	}
+
+	if password, ok := lookupPgpass(config); ok {
+		logger.Info(fmt.Sprintf("Using %s password from pgpass file", side))
+		config.Password = password
+		config.passwordSource = "pgpass"
+		return nil
+	}
+
+	for _, name := range []string{envName, "PGPASSWORD"} {
+		if password, ok := os.LookupEnv(name); ok {
+			logger.Info(fmt.Sprintf("Using %s password from $%s", side, name))
+			config.Password = password
+			config.passwordSource = "env"
+			return nil
+		}
+	}
+
+	if passwordStdin, _ := cmd.Flags().GetBool("password-stdin"); passwordStdin {
+		password, err := readPasswordFromStdin()
+		if err != nil {
+			return err
+		}
+		config.Password = password
+		config.passwordSource = "stdin"
+		return nil
+	}
+
+	if !stdinIsTerminal() {
+		return fmt.Errorf("a %s password is required but stdin is not a terminal; use one of: "+
+			"--%s-password-command, --use-keyring, a pgpass entry, $%s or $PGPASSWORD, or --password-stdin",
+			side, prefix, envName)
+	}
+
+	fmt.Fprintf(os.Stderr, "Enter password for %s database (%s@%s): ", side, config.Username, config.Host)
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	config.Password = password
+	config.passwordSource = "prompt"
+	return nil
+}
+
+// stdinPassword caches the line read for --password-stdin so that source and
+// destination share it.
+var stdinPassword *string
+
+// readPasswordFromStdin reads the password from the first line of stdin, like
+// docker login --password-stdin.
+func readPasswordFromStdin() (string, error) {
+	if stdinPassword != nil {
+		return *stdinPassword, nil
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read password from stdin: %v", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("--password-stdin given but the first line of stdin is empty")
+	}
+
+	stdinPassword = &password
+	return password, nil
+}
+
+// stdinIsTerminal reports whether interactive prompts can be shown
+func stdinIsTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// runPasswordCommand runs command through the shell and returns its trimmed stdout
+func runPasswordCommand(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), passwordCommandTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("timed out after %s", passwordCommandTimeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%v: %s", err, msg)
+		}
+		return "", err
+	}
+
+	password := strings.TrimSpace(stdout.String())
+	if password == "" {
+		return "", fmt.Errorf("command produced no output")
+	}
+	return password, nil
+}
+
+// keyringUser is the keyring account of the password of config: user, host
+// and port of the server, also once an SSH tunnel has moved config to its
+// local end
+func keyringUser(config *DatabaseConfig) string {
+	host, port := config.Host, config.Port
+	if config.TunnelTarget != "" {
+		if h, p, err := net.SplitHostPort(config.TunnelTarget); err == nil {
+			host, port = h, p
+		}
+	}
+	return fmt.Sprintf("%s@%s:%s", config.Username, host, port)
+}
+
+// rememberPasswords stores passwords that were not already in the keyring,
+// called once the connections have been validated. Those of a password
+// command or pgpass are left where they are kept.
+func rememberPasswords(configs ...*DatabaseConfig) {
+	for _, config := range configs {
+		if config == nil || config.Auth == "iam" {
+			continue
+		}
+		switch config.passwordSource {
+		case "keyring", "command", "pgpass":
+			continue
+		}
+		if err := keyring.Set(keyringService, keyringUser(config), config.Password); err != nil {
+			warn(WarnKeyringUnavailable, fmt.Sprintf("Could not store password for %s in the OS keyring: %v", keyringUser(config), err))
+			continue
+		}
+		logger.Info(fmt.Sprintf("Stored password for %s in the OS keyring", keyringUser(config)))
+	}
+}
+
+// lookupPgpass finds a matching entry in the pgpass file (PGPASSFILE or
+// ~/.pgpass, %APPDATA%\postgresql\pgpass.conf on Windows).
+func lookupPgpass(config *DatabaseConfig) (string, bool) {
+	path := os.Getenv("PGPASSFILE")
+	if path == "" {
+		if runtime.GOOS == "windows" {
+			path = filepath.Join(os.Getenv("APPDATA"), "postgresql", "pgpass.conf")
+		} else if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, ".pgpass")
+		}
+	}
+	if path == "" {
+		return "", false
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	host := config.Host
+	if isUnixSocket(host) {
+		host = "localhost"
+	}
+	want := []string{host, config.Port, config.Database, config.Username}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := splitPgpassLine(line)
+		if len(fields) != 5 {
+			continue
+		}
+		matched := true
+		for i, value := range want {
+			if fields[i] != "*" && fields[i] != value {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return fields[4], true
+		}
+	}
+	return "", false
+}
+
+// splitPgpassLine splits a pgpass line on unescaped colons, unescaping \: and \\
+func splitPgpassLine(line string) []string {
+	var fields []string
+	var current strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			current.WriteByte(line[i])
+		case line[i] == ':' && len(fields) < 4:
+			fields = append(fields, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(line[i])
+		}
+	}
+	return append(fields, current.String())
+}
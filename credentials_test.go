@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/zalando/go-keyring"
+)
+
+func TestKeyringUserThroughTunnel(t *testing.T) {
+	for _, test := range []struct {
+		host, port string
+		want       string
+	}{
+		{"db.internal", "5432", "app@db.internal:5432"},
+		{"10.0.3.7", "6432", "app@10.0.3.7:6432"},
+		{"fd00::7", "5432", "app@fd00::7:5432"},
+	} {
+		config := &DatabaseConfig{Username: "app", Host: test.host, Port: test.port}
+		before := keyringUser(config)
+
+		// As startTunnels leaves it
+		config.TunnelTarget = net.JoinHostPort(test.host, test.port)
+		config.Host, config.Port = "127.0.0.1", "41873"
+		after := keyringUser(config)
+
+		if before != test.want || after != test.want {
+			t.Errorf("%s:%s: %s before the tunnel, %s through it, want %s", test.host, test.port, before, after, test.want)
+		}
+	}
+}
+
+func TestRememberPasswords(t *testing.T) {
+	keyring.MockInit()
+	captureLog(t)
+
+	configs := make(map[string]*DatabaseConfig)
+	var all []*DatabaseConfig
+	for _, source := range []string{"prompt", "stdin", "env", "command", "pgpass", "keyring"} {
+		config := &DatabaseConfig{Username: source, Host: "127.0.0.1", Port: "41873", TunnelTarget: "db.internal:5432", Password: "secret-" + source, passwordSource: source}
+		configs[source] = config
+		all = append(all, config)
+	}
+	rememberPasswords(all...)
+
+	for source, config := range configs {
+		password, err := keyring.Get(keyringService, source+"@db.internal:5432")
+		stored := err == nil && password == config.Password
+		if want := source == "prompt" || source == "stdin" || source == "env"; stored != want {
+			t.Errorf("password from %s stored: %v (%v)", source, stored, err)
+		}
+	}
+	if _, err := keyring.Get(keyringService, "prompt@127.0.0.1:41873"); err != keyring.ErrNotFound {
+		t.Errorf("stored under the local end of the tunnel: %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// What --on-collision does when a templated destination name is taken
+const (
+	OnCollisionFail    = "fail"
+	OnCollisionSuffix  = "suffix"
+	OnCollisionReplace = "replace"
+)
+
+// maxCollisionSuffix bounds the search for a free name with --on-collision suffix
+const maxCollisionSuffix = 99
+
+// DestNameTemplateData are the fields available to --dest-db-template
+type DestNameTemplateData struct {
+	SourceDB  string
+	Date      string // Start of the run, YYYYMMDD
+	Timestamp string // Start of the run, YYYYMMDD_HHMMSS as in file names
+	RunLabel  string
+}
+
+// DestinationName records how a destination name was made from --dest-db-template
+type DestinationName struct {
+	Template    string `json:"template"`
+	Rendered    string `json:"rendered"`
+	Collision   bool   `json:"collision"` // A database with the rendered name already existed
+	OnCollision string `json:"on_collision"`
+	Database    string `json:"database"` // Name used after the collision was resolved
+}
+
+// What to do when the destination database doesn't exist but one differing
+// only in case does
+const (
+	DatabaseCaseUseExisting = "use-existing"
+	DatabaseCaseCreateNew   = "create-new"
+)
+
+// DatabaseCase records a destination name that differed from existing
+// databases only in case, and which database the run went on with
+type DatabaseCase struct {
+	Requested string   `json:"requested"`
+	Existing  []string `json:"existing"`
+	Decision  string   `json:"decision"` // use-existing or create-new
+	DecidedBy string   `json:"decided_by"`
+	Database  string   `json:"database"`
+}
+
+// parseDestNameTemplate parses --dest-db-template, rejecting unknown fields
+func parseDestNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("dest-db-template").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --dest-db-template: %v", err)
+	}
+	// Fields are only resolved on execution, so try it before anything connects
+	if err := tmpl.Execute(io.Discard, DestNameTemplateData{}); err != nil {
+		return nil, fmt.Errorf("invalid --dest-db-template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// renderDestName evaluates --dest-db-template for the run in progress
+func renderDestName(text, sourceDB string, state *RunState) (string, error) {
+	tmpl, err := parseDestNameTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	data := DestNameTemplateData{
+		SourceDB:  sourceDB,
+		Date:      state.StartedAt.Format("20060102"),
+		Timestamp: state.Timestamp(),
+		RunLabel:  state.Label,
+	}
+
+	var name strings.Builder
+	if err := tmpl.Execute(&name, data); err != nil {
+		return "", fmt.Errorf("failed to render --dest-db-template: %v", err)
+	}
+	rendered := strings.TrimSpace(name.String())
+	if err := validateIdentifier("destination database name rendered from --dest-db-template", rendered); err != nil {
+		return "", err
+	}
+	return rendered, nil
+}
+
+// resolveDestNameCollision decides what happens when the database named by
+// --dest-db-template exists: fail, pick the first free name_N, or replace it
+// like any other direct migration does
+func resolveDestNameCollision(dest *DatabaseConfig, options *MigrationOptions, state *RunState) error {
+	name := state.DestinationName
+	if name == nil {
+		return nil
+	}
+
+	db, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	taken := func(database string) (bool, error) {
+		return rowExists(db, `SELECT EXISTS(SELECT 1 FROM pg_database WHERE datname = $1)`, database)
+	}
+	exists, err := taken(name.Rendered)
+	if err != nil {
+		return fmt.Errorf("failed to look up database '%s': %v", name.Rendered, err)
+	}
+	name.Collision = exists
+	if !exists {
+		return nil
+	}
+
+	switch options.OnCollision {
+	case OnCollisionReplace:
+		logger.Warning(fmt.Sprintf("Destination database '%s' already exists and is replaced (--on-collision replace)", name.Rendered))
+		return nil
+	case OnCollisionSuffix:
+		for n := 2; n <= maxCollisionSuffix; n++ {
+			candidate := fmt.Sprintf("%s_%d", name.Rendered, n)
+			if err := validateIdentifier("suffixed destination database name", candidate); err != nil {
+				return err
+			}
+			exists, err := taken(candidate)
+			if err != nil {
+				return fmt.Errorf("failed to look up database '%s': %v", candidate, err)
+			}
+			if !exists {
+				logger.Info(fmt.Sprintf("Destination database '%s' already exists; using '%s' (--on-collision suffix)", name.Rendered, candidate))
+				name.Database = candidate
+				dest.Database = candidate
+				return nil
+			}
+		}
+		return fmt.Errorf("databases '%s' through '%s_%d' all exist", name.Rendered, name.Rendered, maxCollisionSuffix)
+	default:
+		return fmt.Errorf("destination database '%s' rendered from --dest-db-template already exists; pass --on-collision suffix to use a free name or --on-collision replace to replace it", name.Rendered)
+	}
+}
+
+// resolveDatabaseCase stops a run whose destination doesn't exist while
+// databases differing from it only in case do, as when MyApp is asked for on
+// a server with myapp: the run would create a second database next to the
+// one in use. --use-existing-case or --create-new-case, or the answer at the
+// prompt, decides.
+func resolveDatabaseCase(dest *DatabaseConfig, options *MigrationOptions, state *RunState) error {
+	db, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(runContext(), `
+		SELECT datname FROM pg_database
+		WHERE lower(datname) = lower($1)
+		  AND NOT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)
+		ORDER BY datname`, dest.Database)
+	if err != nil {
+		return fmt.Errorf("failed to look up databases named like '%s': %v", dest.Database, err)
+	}
+	defer rows.Close()
+	var existing []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		existing = append(existing, name)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+
+	decision := &DatabaseCase{Requested: dest.Database, Existing: existing, Decision: options.DatabaseCase, DecidedBy: "flag"}
+	msg := fmt.Sprintf("Destination database '%s' does not exist, but '%s' differs from it only in case", dest.Database, strings.Join(existing, "', '"))
+	switch {
+	case options.DatabaseCase == DatabaseCaseUseExisting && len(existing) > 1:
+		return fmt.Errorf("%s; --use-existing-case can't choose between them, pass the exact name with --dest-db", msg)
+	case options.DatabaseCase == DatabaseCaseUseExisting:
+		decision.Database = existing[0]
+	case options.DatabaseCase == DatabaseCaseCreateNew:
+		decision.Database = dest.Database
+	case !stdinIsTerminal():
+		return fmt.Errorf("%s; pass --use-existing-case to migrate into the existing database or --create-new-case to create '%s' next to it", msg, dest.Database)
+	default:
+		decision.DecidedBy = "prompt"
+		fmt.Fprintf(os.Stderr, "\nThe destination database name differs only in case from an existing database:\n")
+		fmt.Fprintf(os.Stderr, "   requested:  %-30s (does not exist)\n", dest.Database)
+		for i, name := range existing {
+			fmt.Fprintf(os.Stderr, "   existing:   %-30s (%d)\n", name, i+1)
+		}
+		choices := "1"
+		if len(existing) > 1 {
+			choices = fmt.Sprintf("1-%d", len(existing))
+		}
+		fmt.Fprintf(os.Stderr, "Use the existing database (%s), create '%s' as a new database (n), or stop (s)? ", choices, dest.Database)
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read answer: %v", err)
+		}
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(existing) {
+			decision.Decision, decision.Database = DatabaseCaseUseExisting, existing[n-1]
+		} else if answer == "n" {
+			decision.Decision, decision.Database = DatabaseCaseCreateNew, dest.Database
+		} else {
+			return fmt.Errorf("stopped: destination database name '%s' differs from '%s' only in case", dest.Database, strings.Join(existing, "', '"))
+		}
+	}
+
+	state.DatabaseCase = decision
+	if decision.Decision == DatabaseCaseUseExisting {
+		warn(WarnDatabaseCase, fmt.Sprintf("%s; migrating into '%s'", msg, decision.Database))
+		dest.Database = decision.Database
+		if state.DestinationName != nil {
+			state.DestinationName.Database = decision.Database
+		}
+		return nil
+	}
+	warn(WarnDatabaseCase, fmt.Sprintf("%s; creating '%s' next to it", msg, dest.Database))
+	return nil
+}
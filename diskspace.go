@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+)
+
+// spaceSafetyFactor is the headroom required over the estimated size, for
+// indexes being built, WAL and temporary files during the load
+const spaceSafetyFactor = 1.5
+
+// SpaceCheckOptions controls the destination disk space check
+type SpaceCheckOptions struct {
+	Skip          bool
+	FreeBytesHint int64 // Free space on the destination data directory, when it can't be read
+}
+
+// formatBytes renders a byte count with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// requiredSpace estimates how much data the run loads into the destination:
+// the size of the source database when there is one, else the seed file
+func requiredSpace(source *DatabaseConfig, seedFile string) (int64, string, error) {
+	if source == nil {
+		return fileSize(seedFile), "seed file", nil
+	}
+
+	db, err := openDB(source, source.Database)
+	if err != nil {
+		return 0, "", err
+	}
+	defer db.Close()
+
+	var size int64
+	if err := db.QueryRow(`SELECT pg_database_size(current_database())`).Scan(&size); err != nil {
+		return 0, "", err
+	}
+	return size, "source database", nil
+}
+
+// destinationFreeSpace returns the free space on the destination's data
+// directory. It can only be read when the data directory setting is visible
+// to the destination user and the server runs on this machine.
+func destinationFreeSpace(dest *DatabaseConfig) (int64, bool) {
+	if clientTools.usesDocker() || !(isUnixSocket(dest.Host) || isLocalHost(dest.Host)) || dest.TunnelTarget != "" {
+		return 0, false
+	}
+
+	db, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return 0, false
+	}
+	defer db.Close()
+
+	var dataDir string
+	if err := db.QueryRow(`SELECT current_setting('data_directory')`).Scan(&dataDir); err != nil {
+		logger.Debug(fmt.Sprintf("Cannot read data_directory on the destination: %v", err))
+		return 0, false
+	}
+	free, err := freeSpace(dataDir)
+	if err != nil {
+		logger.Debug(fmt.Sprintf("Cannot read free space of %s: %v", dataDir, err))
+		return 0, false
+	}
+	return free, true
+}
+
+// checkDestinationSpace makes sure a data-inclusive run fits on the
+// destination before anything is dropped. Schema-only runs are not checked.
+func checkDestinationSpace(source, dest *DatabaseConfig, options *MigrationOptions) error {
+	if options.SeedFile == "" {
+		logger.Debug("Schema-only migration, skipping the disk space check")
+		return nil
+	}
+	if options.SpaceCheck.Skip {
+		logger.Info("Disk space check skipped (--skip-space-check)")
+		return nil
+	}
+	if dest.Flavor.is(FlavorAurora) {
+		logger.Info("Aurora storage grows with the data, skipping the disk space check")
+		return nil
+	}
+
+	size, basis, err := requiredSpace(source, options.SeedFile)
+	if err != nil {
+		return fmt.Errorf("failed to determine the size of the data: %v", err)
+	}
+	required := int64(float64(size) * spaceSafetyFactor)
+
+	free, known := options.SpaceCheck.FreeBytesHint, options.SpaceCheck.FreeBytesHint > 0
+	if !known {
+		free, known = destinationFreeSpace(dest)
+	}
+	if !known {
+		warn(WarnDiskSpaceUnknown, fmt.Sprintf("Free space on the destination can't be determined; %s needs about %s (pass --dest-free-space-bytes to check it)",
+			dest.Host, formatBytes(required)))
+		return nil
+	}
+
+	if free < required {
+		return fmt.Errorf("destination has %s free but needs about %s (%s size %s x %.1f); free up space or use --skip-space-check",
+			formatBytes(free), formatBytes(required), basis, formatBytes(size), spaceSafetyFactor)
+	}
+	logger.Info(fmt.Sprintf("Destination has %s free, about %s needed", formatBytes(free), formatBytes(required)))
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "fmt"
+
+// freeSpace is not available on this platform
+func freeSpace(path string) (int64, error) {
+	return 0, fmt.Errorf("not supported on this platform")
+}
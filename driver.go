@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/lib/pq"
+)
+
+// Driver backends of the tool's own connections; pg_dump and psql always use
+// libpq
+const (
+	DriverPQ  = "pq"
+	DriverPGX = "pgx"
+)
+
+// driverBackends are the values --driver accepts
+var driverBackends = []string{DriverPQ, DriverPGX}
+
+// validateDriver checks a --driver value
+func validateDriver(driver string) error {
+	if !slices.Contains(driverBackends, driver) {
+		return fmt.Errorf("driver must be one of: %s", strings.Join(driverBackends, ", "))
+	}
+	return nil
+}
+
+// driver is the backend of the Go connections to this database
+func (c *DatabaseConfig) driver() string {
+	if c.Driver == "" {
+		return DriverPQ
+	}
+	return c.Driver
+}
+
+// driverConnString is connString with what the backend of config needs on
+// top. pgx runs everything through the simple query protocol, as lib/pq does
+// for statements without parameters, so scripts of several statements keep
+// working; unlike lib/pq it honors channel_binding.
+func driverConnString(config *DatabaseConfig, dbname string) string {
+	dsn := connString(config, dbname)
+	if config.driver() != DriverPGX {
+		return dsn
+	}
+	dsn += " default_query_exec_mode=simple_protocol"
+	if config.ChannelBinding != "" {
+		dsn += " channel_binding=" + dsnQuote(config.ChannelBinding)
+	}
+	return dsn
+}
+
+// openDatabase opens a connection pool to dbname on the server described by
+// config, with the driver backend selected for it
+func openDatabase(config *DatabaseConfig, dbname string) (*sql.DB, error) {
+	return openPool(config, driverConnString(config, dbname), false)
+}
+
+// openPool opens a pool on dsn with the backend of config, dialing with TCP
+// keepalives every --keepalive-interval so connections idle during long
+// local steps aren't dropped by firewalls unnoticed. Read-only pools vet
+// every statement.
+func openPool(config *DatabaseConfig, dsn string, readOnly bool) (*sql.DB, error) {
+	dialer := newKeepaliveDialer(config.KeepaliveInterval)
+	var connector driver.Connector
+	if config.driver() == DriverPGX {
+		connConfig, err := pgx.ParseConfig(dsn)
+		if err != nil {
+			return nil, err
+		}
+		connConfig.DialFunc = dialer.DialContext
+		connector = stdlib.GetConnector(*connConfig)
+	} else {
+		pqConnector, err := pq.NewConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+		pqConnector.Dialer(dialer)
+		connector = pqConnector
+	}
+	if readOnly {
+		connector = readOnlyConnector{connector: connector}
+	}
+	return sql.OpenDB(connector), nil
+}
+
+// serverError is an error reported by the server, whichever driver got it
+type serverError struct {
+	Code    string // SQLSTATE
+	Message string // Primary message
+}
+
+// asServerError unwraps the server error in err from either driver
+func asServerError(err error) (serverError, bool) {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return serverError{Code: string(pqErr.Code), Message: pqErr.Message}, true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return serverError{Code: pgErr.Code, Message: pgErr.Message}, true
+	}
+	return serverError{}, false
+}
+
+// sslNotSupported reports whether err is the server turning down SSL
+func sslNotSupported(err error) bool {
+	return errors.Is(err, pq.ErrSSLNotSupported) || strings.Contains(err.Error(), "server refused TLS connection")
+}
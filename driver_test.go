@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+func TestValidateDriver(t *testing.T) {
+	for _, backend := range driverBackends {
+		if err := validateDriver(backend); err != nil {
+			t.Errorf("%s: %v", backend, err)
+		}
+	}
+	if err := validateDriver("pgx/v4"); err == nil {
+		t.Error("pgx/v4 accepted")
+	}
+	if got := (&DatabaseConfig{}).driver(); got != DriverPQ {
+		t.Errorf("default driver %s, want %s", got, DriverPQ)
+	}
+}
+
+func TestDriverConnString(t *testing.T) {
+	for _, backend := range driverBackends {
+		config := &DatabaseConfig{Host: "db.example.com", Port: "5432", Username: "app", Database: "app", SSLMode: "require", ChannelBinding: "require", Driver: backend}
+		dsn := driverConnString(config, "my db")
+		if !strings.HasPrefix(dsn, connString(config, "my db")) {
+			t.Errorf("%s: %q does not extend connString", backend, dsn)
+		}
+		parsed, err := pgconn.ParseConfig(dsn)
+		if err != nil {
+			t.Fatalf("%s: %q: %v", backend, dsn, err)
+		}
+		if parsed.Database != "my db" || parsed.User != "app" {
+			t.Errorf("%s: %q read back as dbname %q user %q", backend, dsn, parsed.Database, parsed.User)
+		}
+
+		switch backend {
+		case DriverPQ:
+			// lib/pq would send them to the server as settings
+			if dsn != connString(config, "my db") {
+				t.Errorf("pq: %q, want connString unchanged", dsn)
+			}
+		case DriverPGX:
+			connConfig, err := pgx.ParseConfig(dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if connConfig.DefaultQueryExecMode != pgx.QueryExecModeSimpleProtocol {
+				t.Errorf("pgx: query mode %v, want the simple protocol", connConfig.DefaultQueryExecMode)
+			}
+			if parsed.ChannelBinding != "require" {
+				t.Errorf("pgx: channel_binding %q, want require", parsed.ChannelBinding)
+			}
+		}
+	}
+}
+
+func TestOpenDBDrivers(t *testing.T) {
+	dir, startups := startupServer(t)
+	for _, backend := range driverBackends {
+		for _, readOnly := range []bool{false, true} {
+			name := fmt.Sprintf("%s read-only %v", backend, readOnly)
+			config := &DatabaseConfig{Host: dir, Port: "5433", Username: "app", Database: name, Driver: backend, ReadOnly: readOnly, SSLMode: "disable"}
+			db, err := openDB(config, config.Database)
+			if err != nil {
+				t.Fatalf("%s: %v", backend, err)
+			}
+			if _, vetted := db.Driver().(readOnlyDriver); vetted != readOnly {
+				t.Errorf("%s: statements vetted: %v", name, vetted)
+			}
+			db.Ping() // Fails once the test server hangs up
+			db.Close()
+
+			// Skipping the retries of the previous Ping
+			params := nextStartup(t, startups)
+			for params != nil && params["database"] != name {
+				params = nextStartup(t, startups)
+			}
+			if got := params["default_transaction_read_only"] == "on"; got != readOnly {
+				t.Errorf("%s: default_transaction_read_only sent: %v", name, got)
+			}
+		}
+	}
+}
+
+func TestAsServerError(t *testing.T) {
+	for _, err := range []error{
+		&pq.Error{Code: "42P04", Message: `database "app" already exists`},
+		&pgconn.PgError{Code: "42P04", Message: `database "app" already exists`},
+	} {
+		wrapped := fmt.Errorf("creating: %w", err)
+		got, ok := asServerError(wrapped)
+		if !ok || got.Code != "42P04" || got.Message != `database "app" already exists` {
+			t.Errorf("%T: %+v, %v", err, got, ok)
+		}
+	}
+	if _, ok := asServerError(errors.New("connection refused")); ok {
+		t.Error("a client error taken for a server error")
+	}
+}
+
+// TestDriverMatrix runs the tool's own queries on the test server with each
+// driver backend
+func TestDriverMatrix(t *testing.T) {
+	server := testServer(t)
+	for _, backend := range driverBackends {
+		t.Run(backend, func(t *testing.T) {
+			captureLog(t)
+			config := *server
+			config.Driver = backend
+			config.Database = "pgsm driver " + backend
+			admin := server.Database
+			drop := func() { execOn(t, server, admin, "DROP DATABASE IF EXISTS "+quoteIdentifier(config.Database)) }
+			drop()
+			t.Cleanup(drop)
+
+			if exists, err := databaseExists(&config); err != nil || exists {
+				t.Fatalf("databaseExists before the create: %v, %v", exists, err)
+			}
+			if err := createDatabase(&config, &CreateDatabaseOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if exists, err := databaseExists(&config); err != nil || !exists {
+				t.Fatalf("databaseExists after the create: %v, %v", exists, err)
+			}
+			err := createDatabase(&config, nil)
+			if serverErr, ok := asServerError(err); !ok || serverErr.Code != "42P04" {
+				t.Errorf("creating it again: %v", err)
+			}
+
+			// A script of several statements, as psql would be given
+			execOn(t, &config, config.Database, `CREATE SCHEMA billing;
+				CREATE TABLE billing.invoices (id integer PRIMARY KEY, total numeric);
+				ALTER TABLE billing.invoices ADD CONSTRAINT positive CHECK (total > 0) NOT VALID`)
+
+			discrepancies, err := verifyConstraints(nil, &config, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(discrepancies) != 1 || discrepancies[0].Name != "positive" {
+				t.Errorf("verify found %+v", discrepancies)
+			}
+
+			source := config
+			source.ReadOnly = true
+			db, err := openDB(&source, source.Database)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			objects, err := listDatabaseObjects(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Contains(objects, DatabaseObject{Type: "table", Schema: "billing", Name: "invoices"}) {
+				t.Errorf("objects %v", objects)
+			}
+			if _, err := db.Exec("DROP TABLE billing.invoices"); err == nil || !strings.Contains(err.Error(), "refusing") {
+				t.Errorf("DROP TABLE on a read-only connection: %v", err)
+			}
+			// Writes the statement check lets by are refused by the server
+			_, err = db.Exec("SELECT 1; CREATE TABLE billing.notes (id integer)")
+			if serverErr, ok := asServerError(err); !ok || serverErr.Code != "25006" {
+				t.Errorf("writing on a read-only connection: %v", err)
+			}
+
+			if err := dropDatabaseIfExists(&config); err != nil {
+				t.Fatal(err)
+			}
+			if exists, err := databaseExists(&config); err != nil || exists {
+				t.Errorf("databaseExists after the drop: %v, %v", exists, err)
+			}
+		})
+	}
+}
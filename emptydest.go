@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// How migrateDestination prepares the destination database, recorded as
+// destination_path
+const (
+	DestinationRecreate  = "recreate"  // Backed up, dropped and created anew
+	DestinationInPlace   = "in-place"  // Existed with nothing in it, so applied into as it is
+	DestinationBootstrap = "bootstrap" // Never dropped, created when missing
+)
+
+// destinationPathText describes a destination path for summaries
+func destinationPathText(path string) string {
+	switch path {
+	case DestinationInPlace:
+		return "applied in place (the destination was empty; no backup or drop)"
+	case DestinationBootstrap:
+		return "bootstrapped (nothing dropped)"
+	case DestinationRecreate:
+		return "backed up, dropped and recreated"
+	}
+	return path
+}
+
+// createOptionsChanged lists the CREATE DATABASE options that differ from
+// the existing database, which only a recreate applies
+func createOptionsChanged(existing *databaseSettings, opts *CreateDatabaseOptions) []string {
+	var changed []string
+	if opts.Template != "" {
+		changed = append(changed, "--dest-template")
+	}
+	if opts.Owner != "" && opts.Owner != existing.Owner {
+		changed = append(changed, "--dest-owner")
+	}
+	if tablespace := valueOr(opts.Tablespace, "pg_default"); tablespace != existing.Tablespace {
+		changed = append(changed, "--dest-tablespace")
+	}
+	if opts.ConnectionLimitSet && opts.ConnectionLimit != existing.ConnectionLimit {
+		changed = append(changed, "--dest-connection-limit")
+	}
+	return changed
+}
+
+// chooseDestinationPath decides once per run how the destination is
+// prepared. An existing database without user objects, as freshly
+// provisioned ones are, has nothing to back up or lose: the schema is
+// applied into it as it is, skipping the backup, the checks guarding the
+// drop and the drop itself. --force-recreate, or CREATE DATABASE options the
+// existing database lacks, keep the full recreate.
+func chooseDestinationPath(dest *DatabaseConfig, options *MigrationOptions, state *RunState) error {
+	if state.DestinationPath != "" {
+		return nil
+	}
+	if options.Bootstrap {
+		state.DestinationPath = DestinationBootstrap
+		return nil
+	}
+	state.DestinationPath = DestinationRecreate
+
+	exists, err := databaseExists(dest)
+	if err != nil || !exists {
+		return err
+	}
+	empty, err := databaseIsEmpty(dest)
+	if err != nil {
+		return fmt.Errorf("failed to list destination objects: %v", err)
+	}
+	if !empty {
+		return nil
+	}
+
+	if options.ForceRecreate {
+		logger.Info(fmt.Sprintf("Destination database '%s' is empty; recreating it anyway (--force-recreate)", dest.Database))
+		return nil
+	}
+	server, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	existing, err := queryDatabaseSettings(server, dest.Database)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if changed := createOptionsChanged(existing, &options.CreateDB); len(changed) > 0 {
+			logger.Info(fmt.Sprintf("Destination database '%s' is empty, but is recreated since %s only take effect on a new database",
+				dest.Database, strings.Join(changed, ", ")))
+			return nil
+		}
+	}
+
+	state.DestinationPath = DestinationInPlace
+	logger.Info(fmt.Sprintf("Destination database '%s' has no user objects; it is neither backed up nor dropped (--force-recreate recreates it)", dest.Database))
+	return nil
+}
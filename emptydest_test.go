@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDatabaseIsEmpty(t *testing.T) {
+	server := testServer(t)
+	dest := *server
+	dest.Database = "pgsm_empty_dest"
+	drop := func() { execOn(t, server, server.Database, "DROP DATABASE IF EXISTS "+quoteIdentifier(dest.Database)) }
+	t.Cleanup(drop)
+
+	for _, test := range []struct {
+		name       string
+		statements []string
+		empty      bool
+	}{
+		{"fresh", nil, true},
+		{"public dropped", []string{"DROP SCHEMA public"}, true},
+		{"schema", []string{"CREATE SCHEMA app"}, false},
+		{"table", []string{"CREATE TABLE t (id integer)"}, false},
+		{"sequence", []string{"CREATE SEQUENCE invoice_numbers"}, false},
+		{"enum", []string{"CREATE TYPE mood AS ENUM ('sad', 'happy')"}, false},
+		{"domain", []string{"CREATE DOMAIN positive AS integer CHECK (VALUE > 0)"}, false},
+		{"composite type", []string{"CREATE TYPE pair AS (a integer, b integer)"}, false},
+		{"range type", []string{"CREATE TYPE float_range AS RANGE (subtype = float8)"}, false},
+		{"function", []string{"CREATE FUNCTION answer() RETURNS integer LANGUAGE sql AS 'SELECT 42'"}, false},
+		{"materialized view", []string{"CREATE MATERIALIZED VIEW one AS SELECT 1 AS one"}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			drop()
+			execOn(t, server, server.Database, "CREATE DATABASE "+quoteIdentifier(dest.Database))
+			execOn(t, &dest, dest.Database, test.statements...)
+			empty, err := databaseIsEmpty(&dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if empty != test.empty {
+				t.Errorf("empty: %v, want %v", empty, test.empty)
+			}
+		})
+	}
+
+	// Extension members and what comes with them, such as their array
+	// types, are no user objects of the database
+	t.Run("extension", func(t *testing.T) {
+		drop()
+		execOn(t, server, server.Database, "CREATE DATABASE "+quoteIdentifier(dest.Database))
+		db, err := openDatabase(&dest, dest.Database)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.Exec("CREATE EXTENSION hstore"); err != nil {
+			t.Skipf("hstore not available: %v", err)
+		}
+		if empty, err := databaseIsEmpty(&dest); err != nil || !empty {
+			t.Errorf("with only an extension: empty %v, %v", empty, err)
+		}
+		if _, err := db.Exec("CREATE TABLE t (attrs hstore)"); err != nil {
+			t.Fatal(err)
+		}
+		if empty, err := databaseIsEmpty(&dest); err != nil || empty {
+			t.Errorf("with a table using the extension: empty %v, %v", empty, err)
+		}
+	})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// addValueInTransactionVersion is the first server version (server_version_num)
+// that accepts ALTER TYPE ... ADD VALUE inside a transaction block
+const addValueInTransactionVersion = 120000
+
+// EnumType is an enum type with its values in sort order
+type EnumType struct {
+	Name   string // Qualified
+	Values []string
+}
+
+// Definition is the statement creating the type
+func (e *EnumType) Definition() string {
+	quoted := make([]string, len(e.Values))
+	for i, v := range e.Values {
+		quoted[i] = pq.QuoteLiteral(v)
+	}
+	return fmt.Sprintf("CREATE TYPE %s AS ENUM (%s);", e.Name, strings.Join(quoted, ", "))
+}
+
+// EnumChange is how an enum type of the source differs on the destination
+type EnumChange struct {
+	Source *EnumType
+	Dest   *EnumType // nil for a new type
+
+	AddValues []string // ALTER TYPE ... ADD VALUE statements, in order
+	Removed   []string // Destination values the source lacks
+	Added     []string // Source values the destination lacks
+	Reordered bool     // Same values as the destination in another order
+}
+
+// manual reports whether the change needs a DBA: enum values can't be
+// removed, renamed or reordered with ALTER TYPE
+func (c *EnumChange) manual() bool {
+	return len(c.Removed) > 0 || c.Reordered
+}
+
+// loadEnumTypes reads the enum types of a database
+func loadEnumTypes(db *sql.DB) ([]*EnumType, error) {
+	rows, err := db.QueryContext(runContext(), `
+		SELECT format('%I.%I', n.nspname, t.typname), array_agg(e.enumlabel ORDER BY e.enumsortorder)
+		FROM pg_type t
+		JOIN pg_namespace n ON n.oid = t.typnamespace
+		JOIN pg_enum e ON e.enumtypid = t.oid
+		WHERE `+userSchemas+` AND `+fmt.Sprintf(notExtensionMember, "pg_type", "t.oid")+`
+		GROUP BY 1
+		ORDER BY 1`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read enum types: %v", err)
+	}
+	defer rows.Close()
+
+	var enums []*EnumType
+	for rows.Next() {
+		e := &EnumType{}
+		if err := rows.Scan(&e.Name, pq.Array(&e.Values)); err != nil {
+			return nil, err
+		}
+		enums = append(enums, e)
+	}
+	return enums, rows.Err()
+}
+
+// diffEnums compares the enum types of the source with the destination's.
+// Values added to the source become ADD VALUE statements that keep the
+// source's order; anything else is left to a DBA.
+func diffEnums(source, dest []*EnumType) []EnumChange {
+	destByName := make(map[string]*EnumType, len(dest))
+	for _, e := range dest {
+		destByName[e.Name] = e
+	}
+
+	var changes []EnumChange
+	for _, s := range source {
+		d, ok := destByName[s.Name]
+		if !ok {
+			changes = append(changes, EnumChange{Source: s})
+			continue
+		}
+
+		c := EnumChange{Source: s, Dest: d}
+		inSource := make(map[string]bool, len(s.Values))
+		for _, v := range s.Values {
+			inSource[v] = true
+		}
+		inDest := make(map[string]bool, len(d.Values))
+		for _, v := range d.Values {
+			inDest[v] = true
+			if !inSource[v] {
+				c.Removed = append(c.Removed, v)
+			}
+		}
+		var common []string
+		for _, v := range s.Values {
+			if inDest[v] {
+				common = append(common, v)
+			} else {
+				c.Added = append(c.Added, v)
+			}
+		}
+		if len(c.Removed) == 0 {
+			for i, v := range common {
+				if d.Values[i] != v {
+					c.Reordered = true
+					break
+				}
+			}
+		}
+		if len(c.Added) == 0 && !c.manual() {
+			continue
+		}
+
+		if !c.manual() {
+			// Each value goes after its predecessor in the source, which
+			// exists by then; a new first value goes before the old first one
+			for i, v := range s.Values {
+				if inDest[v] {
+					continue
+				}
+				position := fmt.Sprintf("BEFORE %s", pq.QuoteLiteral(d.Values[0]))
+				if i > 0 {
+					position = fmt.Sprintf("AFTER %s", pq.QuoteLiteral(s.Values[i-1]))
+				}
+				c.AddValues = append(c.AddValues, fmt.Sprintf("ALTER TYPE %s ADD VALUE IF NOT EXISTS %s %s;", s.Name, pq.QuoteLiteral(v), position))
+			}
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// writeEnumFile writes the statements creating the enum types to w
+func writeEnumFile(w io.Writer, enums []*EnumType) error {
+	for _, e := range enums {
+		if _, err := fmt.Fprintf(w, "-- TYPE %s\n%s\n\n", e.Name, e.Definition()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printEnumDiff shows the enum changes that will be applied
+func printEnumDiff(w io.Writer, changes []EnumChange) {
+	for _, c := range changes {
+		switch {
+		case c.Dest == nil:
+			fmt.Fprintf(w, "+++ new TYPE %s\n+ %s\n", c.Source.Name, c.Source.Definition())
+		case !c.manual():
+			fmt.Fprintf(w, "--- destination TYPE %s\n+++ source TYPE %s\n", c.Dest.Name, c.Source.Name)
+			for _, stmt := range c.AddValues {
+				fmt.Fprintf(w, "+ %s\n", stmt)
+			}
+		}
+	}
+}
+
+// enumColumns lists the destination columns using the enum type or arrays of it
+func enumColumns(db *sql.DB, name string) ([]string, error) {
+	rows, err := db.QueryContext(runContext(), `
+		SELECT format('%I.%I.%I', n.nspname, c.relname, a.attname)
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_type t ON t.oid = $1::regtype
+		WHERE a.atttypid IN (t.oid, t.typarray) AND a.attnum > 0 AND NOT a.attisdropped
+		  AND c.relkind IN ('r', 'p', 'v', 'm', 'f')
+		ORDER BY 1`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// reportEnumManualActions warns about the enum changes ALTER TYPE can't
+// make, with the destination columns affected
+func reportEnumManualActions(db *sql.DB, changes []EnumChange) {
+	for _, c := range changes {
+		if !c.manual() {
+			continue
+		}
+		columns, err := enumColumns(db, c.Dest.Name)
+		used := "no columns"
+		if err != nil {
+			used = fmt.Sprintf("columns unknown: %v", err)
+		} else if len(columns) > 0 {
+			used = "columns " + strings.Join(columns, ", ")
+		}
+
+		if c.Reordered {
+			warn(WarnEnumReordered, fmt.Sprintf("Enum %s has the same values in a different order on the destination (%s; source %s); reordering needs a manual migration of %s",
+				c.Source.Name, strings.Join(c.Dest.Values, ", "), strings.Join(c.Source.Values, ", "), used))
+			continue
+		}
+		action := fmt.Sprintf("values %s were removed", strings.Join(c.Removed, ", "))
+		if len(c.Removed) == len(c.Added) {
+			action = fmt.Sprintf("values %s were removed or renamed to %s (ALTER TYPE ... RENAME VALUE)", strings.Join(c.Removed, ", "), strings.Join(c.Added, ", "))
+		}
+		warn(WarnEnumManualAction, fmt.Sprintf("Enum %s can't be updated automatically: %s; used by %s", c.Source.Name, action, used))
+	}
+}
+
+// applyEnumChanges creates the new enum types in one transaction and adds
+// the new values. ADD VALUE runs outside a transaction before PostgreSQL 12,
+// and in its own transaction from 12 on, since a value added in a
+// transaction can't be used before it commits.
+func applyEnumChanges(dest *DatabaseConfig, changes []EnumChange) error {
+	db, err := openDatabase(dest, dest.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := setSessionRole(db, dest.Role); err != nil {
+		return err
+	}
+	ctx := runContext()
+
+	var creates, adds []string
+	for _, c := range changes {
+		if c.Dest == nil {
+			creates = append(creates, c.Source.Definition())
+		}
+		adds = append(adds, c.AddValues...)
+	}
+
+	if len(creates) > 0 {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range creates {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed to create enum type: %v", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		logger.Info(fmt.Sprintf("Created %d enum type(s)", len(creates)))
+	}
+	if len(adds) == 0 {
+		return nil
+	}
+
+	version, err := serverVersion(db)
+	if err != nil {
+		return err
+	}
+	if version >= addValueInTransactionVersion {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range adds {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed to add enum value: %v", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	} else {
+		// Each statement commits on its own; IF NOT EXISTS makes a rerun
+		// after a partial failure safe
+		for _, stmt := range adds {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("failed to add enum value: %v", err)
+			}
+		}
+	}
+	logger.Info(fmt.Sprintf("Added %d enum value(s)", len(adds)))
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Environment labels of a database
+const (
+	EnvProduction = "production"
+	EnvStaging    = "staging"
+	EnvDev        = "dev"
+)
+
+// environments are the accepted --source-environment and --dest-environment values
+var environments = []string{EnvProduction, EnvStaging, EnvDev}
+
+// validateEnvironment checks an environment label; empty means unlabeled
+func validateEnvironment(env string) error {
+	if env == "" {
+		return nil
+	}
+	for _, e := range environments {
+		if env == e {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s, got %q", strings.Join(environments, ", "), env)
+}
+
+// protectProduction adds friction to runs that change a destination labeled
+// production: they need --i-know-this-is-production and always take a backup.
+// Seed data is only loaded into it from a source labeled production too;
+// source is nil for commands that have none.
+func protectProduction(source, dest *DatabaseConfig, options *MigrationOptions) error {
+	if dest == nil || dest.Environment != EnvProduction || options.DryRun {
+		return nil
+	}
+	if source != nil && source.Environment != EnvProduction && options.SeedFile != "" {
+		label := source.Environment
+		if label == "" {
+			label = "unlabeled"
+		}
+		return fmt.Errorf("destination %s on %s is labeled production and the source %s is %s; data is only loaded into production from a production source, so leave out --seed-file or label the source with --source-environment production",
+			dest.Database, dest.Host, source.Database, label)
+	}
+	if !options.ConfirmProduction {
+		return fmt.Errorf("destination %s on %s is labeled production; pass --i-know-this-is-production to change it", dest.Database, dest.Host)
+	}
+
+	logger.Warning(fmt.Sprintf("Destination %s on %s is labeled production", dest.Database, dest.Host))
+	if !options.CreateBackup {
+		warn(WarnBackupForced, "--no-backup is ignored for production destinations")
+		options.CreateBackup = true
+	}
+	return nil
+}
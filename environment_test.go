@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProtectProduction(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		source     *DatabaseConfig // nil for commands without one
+		dest       string
+		options    MigrationOptions
+		refused    string // Part of the error, if any
+		backupOnly bool   // --no-backup given and overridden
+	}{
+		{"unlabeled", &DatabaseConfig{}, "", MigrationOptions{SeedFile: "seed.sql"}, "", false},
+		{"staging destination", &DatabaseConfig{Environment: EnvDev}, EnvStaging, MigrationOptions{SeedFile: "seed.sql"}, "", false},
+		{"unconfirmed", &DatabaseConfig{Environment: EnvProduction}, EnvProduction, MigrationOptions{}, "--i-know-this-is-production", false},
+		{"confirmed", &DatabaseConfig{Environment: EnvStaging}, EnvProduction, MigrationOptions{ConfirmProduction: true, CreateBackup: true}, "", false},
+		{"backup forced", nil, EnvProduction, MigrationOptions{ConfirmProduction: true}, "", true},
+		{"dry run", &DatabaseConfig{Environment: EnvDev}, EnvProduction, MigrationOptions{DryRun: true, SeedFile: "seed.sql"}, "", false},
+
+		// Seed data only goes from production into production
+		{"seed from production", &DatabaseConfig{Environment: EnvProduction}, EnvProduction, MigrationOptions{ConfirmProduction: true, CreateBackup: true, SeedFile: "seed.sql"}, "", false},
+		{"seed from staging", &DatabaseConfig{Database: "shop_staging", Environment: EnvStaging}, EnvProduction, MigrationOptions{ConfirmProduction: true, CreateBackup: true, SeedFile: "seed.sql"}, "the source shop_staging is staging", false},
+		{"seed from dev", &DatabaseConfig{Environment: EnvDev}, EnvProduction, MigrationOptions{ConfirmProduction: true, CreateBackup: true, SeedFile: "seed.sql"}, "--source-environment production", false},
+		{"seed from unlabeled", &DatabaseConfig{}, EnvProduction, MigrationOptions{ConfirmProduction: true, CreateBackup: true, SeedFile: "seed.sql"}, "is unlabeled", false},
+		{"seed unconfirmed", &DatabaseConfig{Environment: EnvDev}, EnvProduction, MigrationOptions{SeedFile: "seed.sql"}, "--seed-file", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			captureLog(t)
+			previous := currentRun
+			currentRun = &RunState{}
+			t.Cleanup(func() { currentRun = previous })
+			dest := &DatabaseConfig{Host: "db.example.com", Database: "shop", Environment: test.dest}
+			options := test.options
+			err := protectProduction(test.source, dest, &options)
+
+			switch {
+			case test.refused == "" && err != nil:
+				t.Fatalf("refused: %v", err)
+			case test.refused != "" && (err == nil || !strings.Contains(err.Error(), test.refused)):
+				t.Fatalf("%v, want an error with %q", err, test.refused)
+			}
+			forced := len(currentRun.Warnings) == 1 && currentRun.Warnings[0].Code == WarnBackupForced
+			if forced != test.backupOnly || (test.backupOnly && !options.CreateBackup) {
+				t.Errorf("backup forced %v, CreateBackup %v, warnings %v", forced, options.CreateBackup, currentRun.Warnings)
+			}
+		})
+	}
+}
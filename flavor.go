@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Server flavors told apart during connection validation
+const (
+	FlavorPostgreSQL = "postgresql"
+	FlavorRDS        = "rds"
+	FlavorAurora     = "aurora"
+	FlavorCockroach  = "cockroachdb"
+	FlavorRedshift   = "redshift"
+)
+
+// flavorLabels name the flavors in messages
+var flavorLabels = map[string]string{
+	FlavorPostgreSQL: "PostgreSQL",
+	FlavorRDS:        "Amazon RDS for PostgreSQL",
+	FlavorAurora:     "Amazon Aurora PostgreSQL",
+	FlavorCockroach:  "CockroachDB",
+	FlavorRedshift:   "Amazon Redshift",
+}
+
+// incompatibleFlavors are the servers that speak the PostgreSQL protocol but
+// can't be migrated, and why
+var incompatibleFlavors = map[string]string{
+	FlavorCockroach: "it speaks the PostgreSQL wire protocol, but pg_dump can't export from it and it can't run a pg_dump schema or the catalog queries of the tool",
+	FlavorRedshift:  "it descends from PostgreSQL 8.0 and can't run a pg_dump schema or the catalog queries of the tool",
+}
+
+// ServerFlavor is what kind of PostgreSQL server a database runs on
+type ServerFlavor struct {
+	Name          string `json:"name"`
+	Version       string `json:"version"`                  // version() of the server
+	VersionNum    int    `json:"version_num,omitempty"`    // server_version_num
+	AuroraVersion string `json:"aurora_version,omitempty"` // aurora_version(), on Aurora
+}
+
+func (f *ServerFlavor) String() string {
+	short, _, _ := strings.Cut(f.Version, " on ")
+	s := fmt.Sprintf("%s (%s)", flavorLabels[f.Name], short)
+	if f.AuroraVersion != "" {
+		s += fmt.Sprintf(", Aurora %s", f.AuroraVersion)
+	}
+	return s
+}
+
+// is reports whether the flavor is known to be name
+func (f *ServerFlavor) is(name string) bool {
+	return f != nil && f.Name == name
+}
+
+// detectServerFlavor tells the flavor from version(), which every server
+// claiming to be PostgreSQL answers, before anything PostgreSQL-specific is
+// asked. Aurora has aurora_version(); RDS has rds.* settings.
+func detectServerFlavor(db *sql.DB) (*ServerFlavor, error) {
+	flavor := &ServerFlavor{Name: FlavorPostgreSQL}
+	if err := db.QueryRowContext(runContext(), `SELECT version()`).Scan(&flavor.Version); err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.Contains(flavor.Version, "CockroachDB"):
+		flavor.Name = FlavorCockroach
+		return flavor, nil
+	case strings.Contains(flavor.Version, "Redshift"):
+		flavor.Name = FlavorRedshift
+		return flavor, nil
+	}
+
+	var err error
+	if flavor.VersionNum, err = serverVersion(db); err != nil {
+		return nil, err
+	}
+	var aurora, rds bool
+	err = db.QueryRowContext(runContext(), `
+		SELECT to_regprocedure('aurora_version()') IS NOT NULL,
+		       EXISTS (SELECT 1 FROM pg_settings WHERE name LIKE 'rds.%')`).Scan(&aurora, &rds)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case aurora:
+		flavor.Name = FlavorAurora
+		if err := db.QueryRowContext(runContext(), `SELECT aurora_version()`).Scan(&flavor.AuroraVersion); err != nil {
+			logger.Debug(fmt.Sprintf("Could not read aurora_version(): %v", err))
+		}
+	case rds:
+		flavor.Name = FlavorRDS
+	}
+	return flavor, nil
+}
+
+// checkServerFlavor detects and logs the flavor of a server and refuses the
+// ones that can't be migrated. A flavor that can't be told is left unknown.
+func checkServerFlavor(db *sql.DB, config *DatabaseConfig, side string) error {
+	flavor, err := detectServerFlavor(db)
+	if err != nil {
+		logger.Debug(fmt.Sprintf("Could not tell the %s server flavor: %v", side, err))
+		return nil
+	}
+	config.Flavor = flavor
+	logger.Info(fmt.Sprintf("%s server: %s", side, flavor))
+	if reason, ok := incompatibleFlavors[flavor.Name]; ok {
+		return fmt.Errorf("%s %s is %s, which can't be migrated: %s", strings.ToLower(side), config.Host, flavorLabels[flavor.Name], reason)
+	}
+	return nil
+}
+
+// majorVersionKey orders server_version_num by major version: 9.6 and 10
+// are both majors, though one counts two parts and the other one
+func majorVersionKey(versionNum int) int {
+	if versionNum >= 100000 {
+		return versionNum / 10000 * 100
+	}
+	return versionNum / 100
+}
+
+// majorVersion renders the major version of server_version_num
+func majorVersion(versionNum int) string {
+	if versionNum >= 100000 {
+		return fmt.Sprint(versionNum / 10000)
+	}
+	return fmt.Sprintf("%d.%d", versionNum/10000, versionNum/100%100)
+}
+
+// checkVersionCompatibility warns when the destination runs an older major
+// version than the source: the schema may use what the destination lacks.
+// Aurora and RDS report the community version they are based on.
+func checkVersionCompatibility(source, dest *DatabaseConfig) {
+	if source.Flavor == nil || dest.Flavor == nil || source.Flavor.VersionNum == 0 || dest.Flavor.VersionNum == 0 {
+		return
+	}
+	if majorVersionKey(source.Flavor.VersionNum) <= majorVersionKey(dest.Flavor.VersionNum) {
+		return
+	}
+	warn(WarnServerVersionDowngrade, fmt.Sprintf("Source is %s %s but the destination is %s %s; the schema may use features the destination lacks",
+		flavorLabels[source.Flavor.Name], majorVersion(source.Flavor.VersionNum), flavorLabels[dest.Flavor.Name], majorVersion(dest.Flavor.VersionNum)))
+}
+
+// settingPattern captures the parameter a SET statement or a set_config()
+// call of a pg_dump script sets
+var settingPattern = regexp.MustCompile(`(?is)^(?:SET\s+(?:SESSION\s+|LOCAL\s+)?([A-Za-z_][A-Za-z0-9_.]*)\s*(?:=|TO\b)|SELECT\s+pg_catalog\.set_config\('([^']+)')`)
+
+// skipUnsupportedSettings comments out the statements of a plain schema
+// script setting parameters the destination server doesn't know, such as
+// those of a newer pg_dump on Aurora. Custom parameters, with a dot in
+// their name, are left alone. Lines keep their numbers.
+func skipUnsupportedSettings(dest *DatabaseConfig, schemaFile string) (string, []string, error) {
+	if info, err := os.Stat(schemaFile); err != nil || info.IsDir() || isDumpArchive(schemaFile) {
+		return schemaFile, nil, err
+	}
+
+	db, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return "", nil, err
+	}
+	defer db.Close()
+	rows, err := db.QueryContext(runContext(), `SELECT name FROM pg_settings`)
+	if err != nil {
+		return "", nil, err
+	}
+	known := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return "", nil, err
+		}
+		known[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", nil, err
+	}
+
+	statements, err := splitScriptStatements(schemaFile)
+	if err != nil {
+		return "", nil, err
+	}
+	var skipped []string
+	var b strings.Builder
+	for _, s := range statements {
+		name := ""
+		if m := settingPattern.FindStringSubmatch(s.text); m != nil {
+			name = strings.ToLower(m[1] + m[2])
+		}
+		if name == "" || strings.Contains(name, ".") || known[name] {
+			for _, line := range s.lines {
+				b.WriteString(line + "\n")
+			}
+			continue
+		}
+		skipped = append(skipped, fmt.Sprintf("line %d: %s", s.line, firstLine(s.text)))
+		for _, line := range s.lines {
+			b.WriteString("-- Unsupported by the destination: " + line + "\n")
+		}
+	}
+	if len(skipped) == 0 {
+		return schemaFile, nil, nil
+	}
+
+	file, err := scratchFile("settings-*.sql")
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = file.WriteString(b.String())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return file.Name(), skipped, nil
+}
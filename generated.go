@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Server versions (server_version_num) of the ALTER COLUMN forms changing a
+// generated column in place
+const (
+	dropExpressionVersion = 130000 // ALTER COLUMN ... DROP EXPRESSION
+	setExpressionVersion  = 170000 // ALTER COLUMN ... SET EXPRESSION AS
+)
+
+// generatedColumnPattern matches a generated column of a CREATE TABLE, as
+// pg_dump prints it: its name and type, the expression pg_get_expr gives, the
+// kind and what follows, such as NOT NULL
+var generatedColumnPattern = regexp.MustCompile(`^(.*?) GENERATED ALWAYS AS \((.*)\) (STORED|VIRTUAL)(.*)$`)
+
+// identityPattern matches the statement pg_dump makes an identity column
+// with, under a SEQUENCE entry named after its sequence
+var identityPattern = regexp.MustCompile(`(?s)^ALTER TABLE (?:ONLY )?(.+?) ALTER COLUMN (.+?) ADD GENERATED (ALWAYS|BY DEFAULT) AS IDENTITY \((.*)\);$`)
+
+// canonicalExpression makes two spellings of an expression that differ only
+// in whitespace and outer parentheses the same. Quoted literals and names are
+// kept as they are.
+func canonicalExpression(expr string) string {
+	canonical := collapseSpace(expr)
+	for strings.HasPrefix(canonical, "(") && closingParen(canonical) == len(canonical)-1 {
+		canonical = canonical[1 : len(canonical)-1]
+	}
+	return canonical
+}
+
+func lastRune(s string) rune {
+	if s == "" {
+		return 0
+	}
+	return rune(s[len(s)-1])
+}
+
+// closingParen returns the index of the parenthesis closing the one s starts
+// with, or -1
+func closingParen(s string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitGeneratedColumn splits a column of a CREATE TABLE into its definition
+// without the generation, the generation expression and its kind. expr is ""
+// for a column that isn't generated.
+func splitGeneratedColumn(item string) (definition, expr, kind string) {
+	m := generatedColumnPattern.FindStringSubmatch(item)
+	if m == nil {
+		return item, "", ""
+	}
+	return m[1] + m[4], m[2], m[3]
+}
+
+// generatedColumnChange changes a column whose generation differs between
+// want and have in place, on a destination of the given version: a generated
+// column becoming a plain one keeps its values with DROP EXPRESSION, and a
+// changed stored expression is set with SET EXPRESSION from PostgreSQL 17.
+// ok is false when the column has to be dropped and added again.
+func generatedColumnChange(table, column, want, have string, version int) (statements []string, ok bool) {
+	wantDefinition, wantExpr, wantKind := splitGeneratedColumn(want)
+	haveDefinition, haveExpr, haveKind := splitGeneratedColumn(have)
+	if wantDefinition != haveDefinition || haveExpr == "" {
+		return nil, false
+	}
+	switch {
+	case wantExpr == "":
+		if version < dropExpressionVersion {
+			return nil, false
+		}
+		return []string{fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP EXPRESSION;", table, column)}, true
+	case wantKind != haveKind:
+		return nil, false
+	case canonicalExpression(wantExpr) == canonicalExpression(haveExpr):
+		return nil, true
+	case version >= setExpressionVersion && wantKind == "STORED":
+		return []string{fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET EXPRESSION AS (%s);", table, column, wantExpr)}, true
+	}
+	return nil, false
+}
+
+// identityColumn is an identity column as pg_dump makes it
+type identityColumn struct {
+	Table, Column string // Quoted as pg_dump prints them
+	Generated     string // ALWAYS or BY DEFAULT
+	Options       map[string]string
+}
+
+// identityOptionNames are the sequence options pg_dump lists for an identity
+// column, by the first words naming them
+var identityOptionNames = []string{"SEQUENCE NAME", "AS", "START WITH", "INCREMENT BY", "MINVALUE", "MAXVALUE", "CACHE", "CYCLE"}
+
+// parseIdentity reads the identity column a SEQUENCE entry makes, if it does
+func parseIdentity(e dumpEntry) (identityColumn, bool) {
+	if e.Type != "SEQUENCE" {
+		return identityColumn{}, false
+	}
+	m := identityPattern.FindStringSubmatch(strings.TrimSpace(e.Body))
+	if m == nil {
+		return identityColumn{}, false
+	}
+	id := identityColumn{Table: m[1], Column: m[2], Generated: m[3], Options: make(map[string]string)}
+	for _, line := range strings.Split(m[4], "\n") {
+		option := strings.TrimSpace(line)
+		if option == "" {
+			continue
+		}
+		name := strings.TrimPrefix(option, "NO ")
+		for _, known := range identityOptionNames {
+			if name == known || strings.HasPrefix(name, known+" ") {
+				name = known
+				break
+			}
+		}
+		id.Options[name] = option
+	}
+	return id, true
+}
+
+// identityChange alters an identity column to the generation and sequence
+// options of want. ok is false when the sequence is renamed or changes type,
+// which ALTER COLUMN can't do.
+func identityChange(want, have dumpEntry) (statement string, ok bool) {
+	w, ok1 := parseIdentity(want)
+	h, ok2 := parseIdentity(have)
+	if !ok1 || !ok2 || w.Table != h.Table || w.Column != h.Column ||
+		w.Options["SEQUENCE NAME"] != h.Options["SEQUENCE NAME"] || w.Options["AS"] != h.Options["AS"] {
+		return "", false
+	}
+	var actions []string
+	if w.Generated != h.Generated {
+		actions = append(actions, "SET GENERATED "+w.Generated)
+	}
+	for _, name := range identityOptionNames[2:] {
+		option, current := w.Options[name], h.Options[name]
+		if option == current {
+			continue
+		}
+		if option == "" {
+			// Options pg_dump leaves out are at their defaults
+			switch name {
+			case "MINVALUE", "MAXVALUE", "CYCLE":
+				option = "NO " + name
+			case "CACHE":
+				option = "CACHE 1"
+			default:
+				return "", false
+			}
+		}
+		actions = append(actions, "SET "+option)
+	}
+	if len(actions) == 0 {
+		return "", true
+	}
+	return fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s %s;", w.Table, w.Column, strings.Join(actions, " ")), true
+}
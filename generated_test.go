@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// columnVersions are the server versions with a testdata/columns_pgNN.sql
+// dump of the same generated and identity columns
+var columnVersions = []int{130000, 140000, 150000, 160000, 170000}
+
+// columnsDump parses the columns fixture pg_dump of version made, with each
+// pair of replace swapped in first
+func columnsDump(t *testing.T, version int, replace ...string) []dumpEntry {
+	t.Helper()
+	text, err := os.ReadFile(filepath.Join("testdata", fmt.Sprintf("columns_pg%d.sql", version/10000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := string(text)
+	for i := 0; i+1 < len(replace); i += 2 {
+		if !strings.Contains(dump, replace[i]) {
+			t.Fatalf("%q not in the pg%d dump", replace[i], version/10000)
+		}
+		dump = strings.Replace(dump, replace[i], replace[i+1], 1)
+	}
+	path := filepath.Join(t.TempDir(), "schema.sql")
+	if err := os.WriteFile(path, []byte(dump), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, entries, err := parseDumpEntries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// changeSQL lists the action and statements of each change
+func changeSQL(changes []ConvergeChange) []string {
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.Action+" "+c.SQL)
+	}
+	return got
+}
+
+const totalColumn = "total numeric GENERATED ALWAYS AS (((quantity)::numeric * unit_price)) STORED"
+
+func TestGeneratedColumnChanges(t *testing.T) {
+	for _, version := range columnVersions {
+		t.Run(fmt.Sprint(version/10000), func(t *testing.T) {
+			want := columnsDump(t, version)
+			if changes := diffDumps(want, columnsDump(t, version), false, version, false); len(changes) > 0 {
+				t.Errorf("the same dump: %q", changeSQL(changes))
+			}
+
+			// Written by hand with other spacing and parentheses, the
+			// expression is the same and the column is kept
+			have := columnsDump(t, version, totalColumn, "total numeric GENERATED ALWAYS AS (  (quantity)::numeric  *  unit_price ) STORED")
+			if changes := diffDumps(want, have, false, version, false); len(changes) > 0 {
+				t.Errorf("expression differing in whitespace: %q", changeSQL(changes))
+			}
+
+			// A changed expression is set in place from PostgreSQL 17 and
+			// the column is dropped and added again before
+			have = columnsDump(t, version, totalColumn, "total numeric GENERATED ALWAYS AS ((((quantity)::numeric * unit_price) * 1.2)) STORED")
+			got := changeSQL(diffDumps(want, have, false, version, false))
+			wantChanges := []string{"alter ALTER TABLE shop.order_lines ALTER COLUMN total SET EXPRESSION AS (((quantity)::numeric * unit_price));"}
+			if version < setExpressionVersion {
+				wantChanges = []string{"alter ALTER TABLE shop.order_lines DROP COLUMN total;\nALTER TABLE shop.order_lines ADD COLUMN " + totalColumn + ";"}
+			}
+			if !slices.Equal(got, wantChanges) {
+				t.Errorf("changed expression: %q, want %q", got, wantChanges)
+			}
+
+			// A column no longer generated keeps its values
+			want = columnsDump(t, version, totalColumn, "total numeric")
+			got = changeSQL(diffDumps(want, columnsDump(t, version), false, version, false))
+			wantChanges = []string{"alter ALTER TABLE shop.order_lines ALTER COLUMN total DROP EXPRESSION;"}
+			if !slices.Equal(got, wantChanges) {
+				t.Errorf("no longer generated: %q, want %q", got, wantChanges)
+			}
+		})
+	}
+}
+
+func TestIdentityChanges(t *testing.T) {
+	const always = "ALTER TABLE shop.orders ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY ("
+	const byDefault = "ALTER TABLE shop.orders ALTER COLUMN id ADD GENERATED BY DEFAULT AS IDENTITY ("
+	const sequence = "    SEQUENCE NAME shop.orders_id_seq\n    AS integer\n    START WITH 1\n    INCREMENT BY 1\n"
+
+	for _, version := range columnVersions {
+		t.Run(fmt.Sprint(version/10000), func(t *testing.T) {
+			want := columnsDump(t, version)
+			for _, test := range []struct {
+				name    string
+				replace []string
+				want    []string
+			}{
+				{"generation", []string{always, byDefault},
+					[]string{"alter ALTER TABLE shop.orders ALTER COLUMN id SET GENERATED ALWAYS;"}},
+				{"increment", []string{sequence, strings.Replace(sequence, "INCREMENT BY 1", "INCREMENT BY 10", 1)},
+					[]string{"alter ALTER TABLE shop.orders ALTER COLUMN id SET INCREMENT BY 1;"}},
+				{"generation and cache", []string{always, byDefault, sequence + "    NO MINVALUE\n    NO MAXVALUE\n    CACHE 1\n", sequence + "    NO MINVALUE\n    NO MAXVALUE\n    CACHE 20\n"},
+					[]string{"alter ALTER TABLE shop.orders ALTER COLUMN id SET GENERATED ALWAYS SET CACHE 1;"}},
+			} {
+				got := changeSQL(diffDumps(want, columnsDump(t, version, test.replace...), false, version, false))
+				if !slices.Equal(got, test.want) {
+					t.Errorf("%s: %q, want %q", test.name, got, test.want)
+				}
+			}
+
+			// ALTER COLUMN can't rename the sequence or change its type
+			for _, replace := range [][]string{
+				{"SEQUENCE NAME shop.orders_id_seq", "SEQUENCE NAME shop.order_numbers"},
+				{sequence, strings.Replace(sequence, "    AS integer\n", "", 1)},
+			} {
+				wantEntry, haveEntry := identityEntry(t, want), identityEntry(t, columnsDump(t, version, replace...))
+				if statement, ok := identityChange(wantEntry, haveEntry); ok {
+					t.Errorf("%q: altered with %q", replace[1], statement)
+				}
+				changes := diffDumps(want, columnsDump(t, version, replace...), false, version, false)
+				if len(changes) != 1 || changes[0].Action != ConvergeRebuild {
+					t.Errorf("%q: %q, want the sequence rebuilt", replace[1], changeSQL(changes))
+				}
+			}
+		})
+	}
+}
+
+// identityEntry finds the SEQUENCE entry of the identity of shop.orders
+func identityEntry(t *testing.T, entries []dumpEntry) dumpEntry {
+	t.Helper()
+	for _, e := range entries {
+		if e.Type == "SEQUENCE" && strings.Contains(e.Body, "ALTER TABLE shop.orders ") {
+			return e
+		}
+	}
+	t.Fatal("no identity of shop.orders in the dump")
+	return dumpEntry{}
+}
+
+func TestSeedKeepsIdentityValues(t *testing.T) {
+	server := testServer(t)
+	dest := *server
+	dest.Database = "pgsm_seed_identity"
+	drop := func() { execOn(t, server, server.Database, "DROP DATABASE IF EXISTS "+quoteIdentifier(dest.Database)) }
+	drop()
+	t.Cleanup(drop)
+	execOn(t, server, server.Database, "CREATE DATABASE "+quoteIdentifier(dest.Database))
+	if dest.Password != "" {
+		t.Setenv("PGPASSWORD", dest.Password)
+	}
+	captureLog(t)
+
+	db, err := openDatabase(&dest, dest.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	version, err := serverVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fixture of the server's version, without owners and the psql
+	// meta-commands older clients don't know
+	fixture := min(max(version/10000, 13), 17)
+	text, err := os.ReadFile(filepath.Join("testdata", fmt.Sprintf("columns_pg%d.sql", fixture)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema []string
+	for _, line := range strings.Split(string(text), "\n") {
+		if !strings.Contains(line, " OWNER TO ") && !strings.HasPrefix(line, `\`) {
+			schema = append(schema, line)
+		}
+	}
+	execOn(t, &dest, dest.Database, strings.Join(schema, "\n"))
+
+	seed := filepath.Join(t.TempDir(), "seed.sql")
+	if err := os.WriteFile(seed, []byte(`COPY shop.orders (id, placed_at) FROM stdin;
+1	2026-10-01 10:00:00+00
+7	2026-10-02 10:00:00+00
+\.
+
+INSERT INTO shop.orders (id, placed_at) VALUES (12, '2026-10-03 10:00:00+00');
+INSERT INTO shop.order_lines (id, order_id, quantity, unit_price, sku) VALUES (40, 12, 3, 2.50, '  AB-1 ');
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadSeedData(&dest, &MigrationOptions{SeedFile: seed}); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids string
+	var total, key string
+	if err := db.QueryRow(`SELECT string_agg(id::text, ',' ORDER BY id) FROM shop.orders`).Scan(&ids); err != nil || ids != "1,7,12" {
+		t.Errorf("order ids %q, %v", ids, err)
+	}
+	if err := db.QueryRow(`SELECT total::text, sku_key FROM shop.order_lines WHERE id = 40`).Scan(&total, &key); err != nil || total != "7.50" || key != "ab-1" {
+		t.Errorf("generated columns %q and %q, %v", total, key, err)
+	}
+
+	// The identity is GENERATED ALWAYS again and its sequence past the seed
+	var identity string
+	if err := db.QueryRow(`SELECT attidentity::text FROM pg_attribute WHERE attrelid = 'shop.orders'::regclass AND attname = 'id'`).Scan(&identity); err != nil || identity != "a" {
+		t.Errorf("identity %q, %v", identity, err)
+	}
+	if _, err := db.Exec(`INSERT INTO shop.orders (id) VALUES (13)`); err == nil {
+		t.Error("an id set without OVERRIDING SYSTEM VALUE was taken")
+	}
+	var next int
+	if err := db.QueryRow(`INSERT INTO shop.orders DEFAULT VALUES RETURNING id`).Scan(&next); err != nil || next <= 12 {
+		t.Errorf("next order id %d, %v", next, err)
+	}
+	if err := db.QueryRow(`INSERT INTO shop.order_lines (order_id, quantity, unit_price, sku) VALUES (12, 1, 1, 'x') RETURNING id`).Scan(&next); err != nil || next <= 40 {
+		t.Errorf("next order line id %d, %v", next, err)
+	}
+}
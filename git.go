@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// defaultGitCommitMessage is the message template of a bare --git-commit
+const defaultGitCommitMessage = "Schema of {{.SourceDB}} on {{.SourceHost}} at {{.Timestamp}}"
+
+// GitOptions are --git and --git-commit. The tool only ever reads the
+// repository and commits to it; pushing is left to the user.
+type GitOptions struct {
+	Enabled       bool
+	CommitMessage string // Template of the commit message; empty for no commit
+}
+
+// GitCommitData are the fields available to the --git-commit template
+type GitCommitData struct {
+	ArtifactNameData
+	SourceHost string
+}
+
+// GitFileChange is a file of the export that differs from HEAD
+type GitFileChange struct {
+	Status string `json:"status"` // added, modified or deleted
+	Path   string `json:"path"`   // Relative to the repository
+}
+
+// GitReport is what --git found about the repository the export went to,
+// how the export differs from HEAD and the commit made of it
+type GitReport struct {
+	Repository string          `json:"repository"`
+	Head       string          `json:"head,omitempty"` // Commit compared with; empty in a repository without commits
+	Files      []GitFileChange `json:"files,omitempty"`
+	Objects    *DriftChanges   `json:"objects,omitempty"` // Of a plain schema file HEAD already had
+	Commit     string          `json:"commit,omitempty"`
+}
+
+// renderGitCommitMessage evaluates the --git-commit template
+func renderGitCommitMessage(text string, data GitCommitData) (string, error) {
+	tmpl, err := template.New("git-commit").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid --git-commit: %v", err)
+	}
+	var message strings.Builder
+	if err := tmpl.Execute(&message, data); err != nil {
+		return "", fmt.Errorf("failed to render --git-commit: %v", err)
+	}
+	if strings.TrimSpace(message.String()) == "" {
+		return "", errors.New("--git-commit renders an empty message")
+	}
+	return strings.TrimSpace(message.String()), nil
+}
+
+// runGit runs git in dir and returns its output. Pathspecs are literal, so
+// file names are never read as patterns.
+func runGit(dir string, stdin []byte, args ...string) (string, error) {
+	cmd := exec.CommandContext(runContext(), "git", append([]string{"--literal-pathspecs", "-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return string(out), nil
+}
+
+// existingParent returns path, or its nearest parent that exists
+func existingParent(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// gitExportPaths lists what the export of a run may write: the schema file
+// or directory dump, the files made next to it, and the roles dump
+func gitExportPaths(source, dest *DatabaseConfig, options *MigrationOptions, state *RunState) ([]string, error) {
+	if options.Output == "-" {
+		return nil, nil
+	}
+	schemaFile, err := exportPath(source, dest, options, state)
+	if err != nil {
+		return nil, err
+	}
+	split := strings.TrimSuffix(schemaFile, ".sql")
+	if split == schemaFile {
+		split += ".split"
+	}
+	paths := []string{schemaFile, split, schemaFile + tocSuffix}
+	for _, archive := range []string{schemaFile + ".tar", schemaFile + ".tar.gz"} {
+		paths = append(paths, archive, archive+checksumSuffix)
+	}
+	if options.RoleHandling.Roles && source != nil {
+		paths = append(paths, rolesFilePath(options, source, state.Timestamp()))
+	}
+	return paths, nil
+}
+
+// gitPathspecs makes paths relative to dir, the directory git runs in
+func gitPathspecs(dir string, paths []string) ([]string, error) {
+	base, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	specs := make([]string, 0, len(paths))
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(base, abs)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, filepath.ToSlash(rel))
+	}
+	return specs, nil
+}
+
+// gitStatusEntry is a line of git status --porcelain
+type gitStatusEntry struct {
+	Index, Worktree byte
+	Path            string // Relative to the repository
+}
+
+func (e gitStatusEntry) untracked() bool { return e.Index == '?' }
+
+// gitStatus lists the files under the pathspecs that differ from HEAD, or
+// aren't tracked. Ignored files are left out.
+func gitStatus(dir string, specs []string) ([]gitStatusEntry, error) {
+	out, err := runGit(dir, nil, append([]string{"status", "--porcelain=v1", "-z", "--untracked-files=all", "--no-renames", "--"}, specs...)...)
+	if err != nil {
+		return nil, err
+	}
+	var entries []gitStatusEntry
+	for _, line := range strings.Split(out, "\x00") {
+		if len(line) > 3 {
+			entries = append(entries, gitStatusEntry{Index: line[0], Worktree: line[1], Path: line[3:]})
+		}
+	}
+	return entries, nil
+}
+
+// checkGitOutput runs before anything is written. With --git, the output
+// directory must be in a git working tree with no uncommitted changes to
+// tracked files there; untracked files, like the manifests of earlier runs,
+// are left alone. Without --git, an export that would overwrite tracked
+// files with local modifications is refused.
+func checkGitOutput(source, dest *DatabaseConfig, options *MigrationOptions, state *RunState) error {
+	paths, err := gitExportPaths(source, dest, options, state)
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	dir := existingParent(filepath.Dir(paths[0]))
+
+	root, err := runGit(dir, nil, "rev-parse", "--show-toplevel")
+	if err != nil {
+		if options.Git.Enabled {
+			return fmt.Errorf("--git needs the output directory in a git working tree: %v", err)
+		}
+		logger.Debug(fmt.Sprintf("Output directory is not in a git working tree: %v", err))
+		return nil
+	}
+	root = strings.TrimSpace(root)
+
+	if !options.Git.Enabled {
+		specs, err := gitPathspecs(dir, paths)
+		if err != nil {
+			return err
+		}
+		entries, err := gitStatus(dir, specs)
+		if err != nil {
+			return err
+		}
+		var modified []string
+		for _, e := range entries {
+			if !e.untracked() {
+				modified = append(modified, e.Path)
+			}
+		}
+		if len(modified) > 0 {
+			return fmt.Errorf("the export would overwrite tracked file(s) of the git repository %s with local modifications:\n   %s\ncommit or stash them first",
+				root, strings.Join(modified, "\n   "))
+		}
+		return nil
+	}
+
+	outputSpecs, err := gitPathspecs(dir, []string{options.OutputDir})
+	if err != nil {
+		return err
+	}
+	entries, err := gitStatus(dir, outputSpecs)
+	if err != nil {
+		return err
+	}
+	var dirty []string
+	for _, e := range entries {
+		if !e.untracked() {
+			dirty = append(dirty, fmt.Sprintf("%c%c %s", e.Index, e.Worktree, e.Path))
+		}
+	}
+	if len(dirty) > 0 {
+		return fmt.Errorf("the output directory %s has uncommitted changes in the git repository %s:\n   %s\ncommit or stash them first",
+			options.OutputDir, root, strings.Join(dirty, "\n   "))
+	}
+
+	head, err := runGit(dir, nil, "rev-parse", "--verify", "--quiet", "HEAD")
+	if err != nil {
+		head = "" // No commits yet
+	}
+	state.Git = &GitReport{Repository: root, Head: strings.TrimSpace(head)}
+	if state.Git.Head == "" {
+		logger.Info(fmt.Sprintf("Output directory is in the git repository %s, which has no commits yet", root))
+	} else {
+		logger.Info(fmt.Sprintf("Output directory is in the git repository %s at %.12s, with no uncommitted changes", root, state.Git.Head))
+	}
+	return nil
+}
+
+// gitFileStatus names the state of a file of git status
+func gitFileStatus(e gitStatusEntry) string {
+	switch {
+	case e.untracked() || e.Index == 'A':
+		return "added"
+	case e.Worktree == 'D' || e.Index == 'D':
+		return "deleted"
+	}
+	return "modified"
+}
+
+// recordGitChanges compares the export with HEAD, logs the changes and,
+// with --git-commit, commits the exported files and nothing else. A dry run
+// reports the changes without committing.
+func recordGitChanges(source *DatabaseConfig, schemaFile string, options *MigrationOptions, state *RunState) error {
+	report := state.Git
+	if report == nil {
+		return nil
+	}
+	paths, err := gitExportPaths(source, state.Dest, options, state)
+	if err != nil {
+		return err
+	}
+	var written []string
+	for _, p := range append(paths, state.SchemaFile, state.SplitDir, state.TOCFile, state.RolesFile) {
+		if _, err := os.Lstat(p); p != "" && err == nil && !slices.Contains(written, p) {
+			written = append(written, p)
+		}
+	}
+	if len(written) == 0 {
+		return nil
+	}
+	dir := filepath.Dir(written[0])
+	specs, err := gitPathspecs(dir, written)
+	if err != nil {
+		return err
+	}
+	entries, err := gitStatus(dir, specs)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		report.Files = append(report.Files, GitFileChange{Status: gitFileStatus(e), Path: e.Path})
+	}
+	if len(report.Files) == 0 {
+		logger.Info(fmt.Sprintf("The export is the same as at %.12s of %s; nothing to commit", report.Head, report.Repository))
+		return nil
+	}
+
+	// A plain schema file HEAD already had is compared object by object
+	if options.Format == DumpFormatPlain && schemaFile != "" && report.Head != "" {
+		objects, err := diffGitSchema(dir, schemaFile, options)
+		if err != nil {
+			logger.Debug(fmt.Sprintf("Objects of %s not compared with HEAD: %v", schemaFile, err))
+		}
+		report.Objects = objects
+	}
+	// The file header records the run, so an export of the same schema still
+	// differs from HEAD
+	if report.Objects != nil && report.Objects.empty() {
+		report.Files = nil
+		if options.Git.CommitMessage == "" || options.DryRun {
+			logger.Info(fmt.Sprintf("No object changed since %.12s of %s; only the file header differs", report.Head, report.Repository))
+			return nil
+		}
+		// Keep what HEAD has, so the tree is clean for the next run
+		for _, spec := range specs {
+			if _, err := runGit(dir, nil, "cat-file", "-e", "HEAD:./"+spec); err != nil {
+				continue
+			}
+			if _, err := runGit(dir, nil, "checkout", "HEAD", "--", spec); err != nil {
+				return err
+			}
+		}
+		logger.Info(fmt.Sprintf("No object changed since %.12s of %s; the export was reset to it, nothing to commit", report.Head, report.Repository))
+		return nil
+	}
+	summary := gitChangeSummary(report)
+	logger.Info(fmt.Sprintf("Changes of the export against HEAD of %s:", report.Repository))
+	for _, line := range summary {
+		logger.Info("   " + line)
+	}
+
+	if options.Git.CommitMessage == "" {
+		return nil
+	}
+	data := GitCommitData{ArtifactNameData: newArtifactNameData(source, state.Dest, state.Timestamp(), state)}
+	if source != nil {
+		data.SourceHost = source.Host
+	}
+	message, err := renderGitCommitMessage(options.Git.CommitMessage, data)
+	if err != nil {
+		return err
+	}
+	if options.DryRun {
+		logger.Info(fmt.Sprintf("DRY RUN: would commit the export to %s as %q", report.Repository, message))
+		return nil
+	}
+	if _, err := runGit(dir, nil, append([]string{"add", "--all", "--"}, specs...)...); err != nil {
+		return err
+	}
+	// Only the exported files are committed, whatever else is staged
+	body := message + "\n\n" + strings.Join(summary, "\n") + "\n"
+	if _, err := runGit(dir, []byte(body), append([]string{"commit", "--quiet", "--file=-", "--"}, specs...)...); err != nil {
+		return err
+	}
+	head, err := runGit(dir, nil, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	report.Commit = strings.TrimSpace(head)
+	logger.Success(fmt.Sprintf("Committed the export to %s as %.12s: %s", report.Repository, report.Commit, message))
+	return nil
+}
+
+// diffGitSchema compares the objects of a plain schema file with the version
+// HEAD has of it, the way watch compares fingerprints. It returns nil when
+// HEAD doesn't have the file.
+func diffGitSchema(dir, schemaFile string, options *MigrationOptions) (*DriftChanges, error) {
+	specs, err := gitPathspecs(dir, []string{schemaFile})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := runGit(dir, nil, "cat-file", "-e", "HEAD:./"+specs[0]); err != nil {
+		return nil, nil
+	}
+	committed, err := runGit(dir, nil, "show", "HEAD:./"+specs[0])
+	if err != nil {
+		return nil, err
+	}
+	file, err := scratchFile("git-head-*.sql")
+	if err != nil {
+		return nil, err
+	}
+	defer releaseScratch(file.Name())
+	_, err = file.WriteString(committed)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := hashDumpEntries(file.Name(), options.Ignore)
+	if err != nil {
+		return nil, err
+	}
+	after, err := hashDumpEntries(schemaFile, options.Ignore)
+	if err != nil {
+		return nil, err
+	}
+	return diffFingerprints(before, after), nil
+}
+
+// gitChangeSummary lists the changed objects when they were compared, and
+// the changed files otherwise, one per line as watch logs them
+func gitChangeSummary(report *GitReport) []string {
+	var lines []string
+	if objects := report.Objects; objects != nil {
+		for _, key := range objects.Added {
+			lines = append(lines, "+ "+key)
+		}
+		for _, key := range objects.Removed {
+			lines = append(lines, "- "+key)
+		}
+		for _, key := range objects.Changed {
+			lines = append(lines, "~ "+key)
+		}
+		if len(lines) > 0 {
+			return lines
+		}
+	}
+	marks := map[string]string{"added": "+", "deleted": "-", "modified": "~"}
+	for _, f := range report.Files {
+		lines = append(lines, marks[f.Status]+" "+f.Path)
+	}
+	return lines
+}
+
+// gitPlanLine is the step of a plan comparing the export with HEAD, and
+// committing it with --git-commit
+func gitPlanLine(options *MigrationOptions, state *RunState) string {
+	if state.Git == nil {
+		return ""
+	}
+	if options.Git.CommitMessage == "" {
+		return fmt.Sprintf("Compare the export with HEAD of the git repository %s", state.Git.Repository)
+	}
+	return fmt.Sprintf("Compare the export with HEAD of the git repository %s and commit it (never pushed)", state.Git.Repository)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// gitRepository makes a repository with an output directory in it, set up to
+// commit without a global git configuration
+func gitRepository(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	repo := t.TempDir()
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	if _, err := runGit(repo, nil, "init", "--quiet"); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(repo, "schema")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// exportAt returns the schema file an export of app started at at writes
+func exportAt(t *testing.T, options *MigrationOptions, at time.Time) string {
+	t.Helper()
+	path, err := exportPath(&DatabaseConfig{Database: "app"}, nil, options, &RunState{StartedAt: at})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGitSchemaNameHasNoTimestamp(t *testing.T) {
+	first, second := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC), time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)
+
+	options := &MigrationOptions{OutputDir: "schema"}
+	if exportAt(t, options, first) == exportAt(t, options, second) {
+		t.Error("without --git, exports share a name")
+	}
+
+	options.Git.Enabled = true
+	if got := exportAt(t, options, first); got != filepath.Join("schema", "schema_app.sql") || exportAt(t, options, second) != got {
+		t.Errorf("with --git, exports are named %s and %s", got, exportAt(t, options, second))
+	}
+
+	// A template of one's own still wins
+	options.ArtifactNames = map[string]string{ArtifactSchema: "{{.SourceDB}}-{{.Date}}.sql"}
+	if got := exportAt(t, options, first); got != filepath.Join("schema", "app-20261016.sql") {
+		t.Errorf("with a template, the export is named %s", got)
+	}
+}
+
+func TestGitReplacesTemplatedSchemaFile(t *testing.T) {
+	out := t.TempDir()
+	if err := os.WriteFile(filepath.Join(out, "schema.sql"), []byte("-- last export\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, git := range []bool{false, true} {
+		options := &MigrationOptions{OutputDir: out, ArtifactNames: map[string]string{ArtifactSchema: "schema.sql"}, Git: GitOptions{Enabled: git}}
+		state := &RunState{Source: &DatabaseConfig{Database: "app"}}
+		err := prepareArtifactNames(options, state)
+		if (err == nil) != git {
+			t.Errorf("--git %v: %v", git, err)
+		}
+	}
+}
+
+func TestGitDiffAgainstLastExport(t *testing.T) {
+	useScratch(t)
+	captureLog(t)
+	out := gitRepository(t)
+	options := &MigrationOptions{OutputDir: out, Git: GitOptions{Enabled: true}}
+
+	write := func(path string, entries ...string) {
+		t.Helper()
+		text := "SET client_encoding = 'UTF8';\n"
+		for _, e := range entries {
+			text += "\n--\n-- " + e + "\n"
+		}
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	orders := "Name: orders; Type: TABLE; Schema: public; Owner: app\n--\n\nCREATE TABLE public.orders (\n    id integer\n);\n"
+	notes := "Name: notes; Type: TABLE; Schema: public; Owner: app\n--\n\nCREATE TABLE public.notes (\n    id integer\n);\n"
+	lines := "Name: lines; Type: TABLE; Schema: public; Owner: app\n--\n\nCREATE TABLE public.lines (\n    id integer\n);\n"
+
+	// Yesterday's export, committed
+	schemaFile := exportAt(t, options, time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC))
+	write(schemaFile, orders, notes)
+	if _, err := runGit(out, nil, "add", "."); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runGit(out, nil, "commit", "--quiet", "-m", "Schema of app"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Today's replaces it, and is compared with it by object
+	if again := exportAt(t, options, time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)); again != schemaFile {
+		t.Fatalf("today's export is %s, yesterday's %s", again, schemaFile)
+	}
+	write(schemaFile, orders, lines)
+	changes, err := diffGitSchema(out, schemaFile, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes == nil || !slices.Equal(changes.Added, []string{"TABLE public.lines"}) || !slices.Equal(changes.Removed, []string{"TABLE public.notes"}) || len(changes.Changed) != 0 {
+		t.Errorf("changes against HEAD: %+v", changes)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// listSettings are the settings whose values are lists of identifiers, which
+// are stored quoted already and must not be quoted again as one literal
+var listSettings = map[string]bool{
+	"search_path":               true,
+	"temp_tablespaces":          true,
+	"session_preload_libraries": true,
+	"local_preload_libraries":   true,
+}
+
+// defaultACLKinds maps pg_default_acl.defaclobjtype to ALTER DEFAULT PRIVILEGES
+var defaultACLKinds = map[string]string{
+	"r": "TABLES",
+	"S": "SEQUENCES",
+	"f": "FUNCTIONS",
+	"T": "TYPES",
+	"n": "SCHEMAS",
+}
+
+// GrantsSnapshot records the grants and settings of the destination database
+// saved before the drop, which no dump of the database contains, and how
+// re-applying them went
+type GrantsSnapshot struct {
+	File         string   `json:"file"`
+	Statements   int      `json:"statements"`
+	Restored     int      `json:"restored"`
+	Skipped      bool     `json:"skipped,omitempty"`       // With --no-restore-grants
+	MissingRoles []string `json:"missing_roles,omitempty"` // Grantees and roles with settings that don't exist any more
+	Failed       []string `json:"failed,omitempty"`        // Statements that failed for other reasons, with the error
+}
+
+// grantsSnapshotPath returns where the grants of dest are saved before the drop
+func grantsSnapshotPath(dest *DatabaseConfig, options *MigrationOptions, state *RunState) string {
+	return filepath.Join(options.OutputDir, fmt.Sprintf("dest_grants_pre_drop_%s_%s.sql", dest.Database, state.Timestamp()))
+}
+
+// settingStatement sets a "name=value" entry of pg_db_role_setting on target
+func settingStatement(target, setting string) string {
+	name, value, _ := strings.Cut(setting, "=")
+	if !listSettings[name] {
+		value = pq.QuoteLiteral(value)
+	}
+	return fmt.Sprintf("ALTER %s SET %s = %s;", target, quoteIdentifier(name), value)
+}
+
+// grantStatement grants privilege on target, passing on the grant option
+func grantStatement(privilege, target, grantee string, grantable bool) string {
+	statement := fmt.Sprintf("GRANT %s ON %s TO %s", privilege, target, grantee)
+	if grantable {
+		statement += " WITH GRANT OPTION"
+	}
+	return statement + ";"
+}
+
+// destinationGrantStatements reads the database ACL and the database and
+// per-role settings of dest from the server catalogs, and the default
+// privileges from dest itself, as the statements that recreate them
+func destinationGrantStatements(dest *DatabaseConfig) ([]string, error) {
+	server, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return nil, err
+	}
+	defer server.Close()
+	database := quoteIdentifier(dest.Database)
+
+	var statements []string
+	var customACL bool
+	err = server.QueryRowContext(runContext(), `SELECT datacl IS NOT NULL FROM pg_database WHERE datname = $1`, dest.Database).Scan(&customACL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the database ACL: %v", err)
+	}
+	// A database without an ACL has the defaults, which a new one gets too
+	if customACL {
+		statements = append(statements, fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM PUBLIC;", database))
+		rows, err := server.QueryContext(runContext(), `
+			SELECT a.privilege_type, a.is_grantable,
+			       CASE WHEN a.grantee = 0 THEN 'PUBLIC' ELSE quote_ident(pg_get_userbyid(a.grantee)) END AS grantee
+			FROM pg_database d, aclexplode(d.datacl) a
+			WHERE d.datname = $1 AND a.grantee <> d.datdba
+			ORDER BY grantee, a.privilege_type`, dest.Database)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the database ACL: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var privilege, grantee string
+			var grantable bool
+			if err := rows.Scan(&privilege, &grantable, &grantee); err != nil {
+				return nil, err
+			}
+			statements = append(statements, grantStatement(privilege, "DATABASE "+database, grantee, grantable))
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := server.QueryContext(runContext(), `
+		SELECT COALESCE(quote_ident(r.rolname), ''), c.setting
+		FROM pg_db_role_setting s
+		JOIN pg_database d ON d.oid = s.setdatabase
+		LEFT JOIN pg_roles r ON r.oid = s.setrole,
+		     unnest(s.setconfig) AS c(setting)
+		WHERE d.datname = $1
+		ORDER BY 1, 2`, dest.Database)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the database settings: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role, setting string
+		if err := rows.Scan(&role, &setting); err != nil {
+			return nil, err
+		}
+		target := "DATABASE " + database
+		if role != "" {
+			target = fmt.Sprintf("ROLE %s IN DATABASE %s", role, database)
+		}
+		statements = append(statements, settingStatement(target, setting))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	db, err := openDatabase(dest, dest.Database)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	defaults, err := db.QueryContext(runContext(), `
+		SELECT quote_ident(pg_get_userbyid(d.defaclrole)), COALESCE(quote_ident(n.nspname), ''), d.defaclobjtype::text,
+		       a.privilege_type, a.is_grantable,
+		       CASE WHEN a.grantee = 0 THEN 'PUBLIC' ELSE quote_ident(pg_get_userbyid(a.grantee)) END AS grantee
+		FROM pg_default_acl d
+		LEFT JOIN pg_namespace n ON n.oid = d.defaclnamespace,
+		     aclexplode(d.defaclacl) a
+		ORDER BY 1, 2, 3, grantee, a.privilege_type`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the default privileges: %v", err)
+	}
+	defer defaults.Close()
+	revoked := make(map[string]bool)
+	for defaults.Next() {
+		var role, schema, kind, privilege, grantee string
+		var grantable bool
+		if err := defaults.Scan(&role, &schema, &kind, &privilege, &grantable, &grantee); err != nil {
+			return nil, err
+		}
+		objects, ok := defaultACLKinds[kind]
+		if !ok {
+			continue
+		}
+		prefix := "ALTER DEFAULT PRIVILEGES FOR ROLE " + role
+		if schema != "" {
+			prefix += " IN SCHEMA " + schema
+		} else if !revoked[role+" "+objects] {
+			// A global entry replaces the built-in defaults, so start from none
+			revoked[role+" "+objects] = true
+			statements = append(statements, fmt.Sprintf("%s REVOKE ALL ON %s FROM PUBLIC;", prefix, objects))
+		}
+		statements = append(statements, prefix+" "+grantStatement(privilege, objects, grantee, grantable))
+	}
+	return statements, defaults.Err()
+}
+
+// snapshotDestinationGrants saves the grants and settings of the destination
+// to a SQL file in the output directory before the drop takes them away
+func snapshotDestinationGrants(dest *DatabaseConfig, options *MigrationOptions, state *RunState) error {
+	exists, err := databaseExists(dest)
+	if err != nil || !exists {
+		return err
+	}
+	statements, err := destinationGrantStatements(dest)
+	if err != nil {
+		return err
+	}
+	if len(statements) == 0 {
+		logger.Info(fmt.Sprintf("Destination database '%s' has no grants, settings or default privileges of its own", dest.Database))
+		return nil
+	}
+
+	path := grantsSnapshotPath(dest, options, state)
+	var b strings.Builder
+	fmt.Fprintf(&b, "-- Grants, settings and default privileges of database %s before it was dropped\n", dest.Database)
+	b.WriteString("-- Re-applied after the migration unless --no-restore-grants was given\n\n")
+	for _, statement := range statements {
+		b.WriteString(statement)
+		b.WriteByte('\n')
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+
+	state.Grants = &GrantsSnapshot{File: path, Statements: len(statements)}
+	logger.Info(fmt.Sprintf("Saved %d grant(s) and setting(s) of the destination database to: %s", len(statements), path))
+	return nil
+}
+
+// readGrantsSnapshot returns the statements of a grants snapshot file
+func readGrantsSnapshot(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var statements []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "--") {
+			statements = append(statements, line)
+		}
+	}
+	return statements, scanner.Err()
+}
+
+// restoreDestinationGrants re-applies the saved grants and settings to the
+// new database one by one. Statements naming roles that no longer exist, or
+// failing otherwise, are reported and skipped; they never fail the run.
+func restoreDestinationGrants(dest *DatabaseConfig, snapshot *GrantsSnapshot) error {
+	statements, err := readGrantsSnapshot(snapshot.File)
+	if err != nil {
+		return err
+	}
+	snapshot.Statements = len(statements)
+
+	db, err := openDatabase(dest, dest.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	missing := make(map[string]bool)
+	for _, statement := range statements {
+		_, err := db.ExecContext(runContext(), statement)
+		if err == nil {
+			snapshot.Restored++
+			continue
+		}
+		serverErr, isServerErr := asServerError(err)
+		if isServerErr && serverErr.Code == "42704" { // undefined_object
+			if m := missingRolePattern.FindStringSubmatch(serverErr.Message); m != nil {
+				if !missing[m[1]] {
+					missing[m[1]] = true
+					snapshot.MissingRoles = append(snapshot.MissingRoles, m[1])
+				}
+				continue
+			}
+		}
+		if isServerErr {
+			err = errors.New(serverErr.Message)
+		}
+		if runContext().Err() != nil {
+			return err
+		}
+		snapshot.Failed = append(snapshot.Failed, fmt.Sprintf("%s (%v)", statement, err))
+	}
+
+	logger.Info(fmt.Sprintf("Re-applied %d of %d saved grant(s) and setting(s)", snapshot.Restored, snapshot.Statements))
+	if len(snapshot.MissingRoles) > 0 {
+		warn(WarnGrantsNotRestored, fmt.Sprintf("Grants and settings for %d role(s) that no longer exist were not re-applied: %s",
+			len(snapshot.MissingRoles), strings.Join(snapshot.MissingRoles, ", ")))
+	}
+	for _, failure := range snapshot.Failed {
+		warn(WarnGrantsNotRestored, "Failed to re-apply "+failure)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// version is the tool version, set at build time with
+// -ldflags "-X main.version=..."
+var version = "dev"
+
+// The header of a generated SQL file is a block of comments, which psql and
+// every dump parser of the tool skip like any other comment
+const (
+	headerStart = "-- pg-schema-migrate file header"
+	headerEnd   = "-- end of pg-schema-migrate file header"
+)
+
+// Kinds of generated SQL files
+const (
+	FileKindSchema   = "schema"
+	FileKindBackup   = "backup"
+	FileKindRoles    = "roles"
+	FileKindEnums    = "enums"
+	FileKindCode     = "code"
+	FileKindConverge = "converge"
+)
+
+// FileHeader records what produced a generated SQL file, so a file that
+// outlived its run manifest still says where it came from
+type FileHeader struct {
+	Kind          string    `json:"kind"`
+	ToolVersion   string    `json:"tool_version"`
+	ClientVersion string    `json:"client_version,omitempty"` // --version of the client tool that wrote it
+	ServerVersion string    `json:"server_version,omitempty"` // Of the database the file was generated from
+	Source        string    `json:"source"`                   // host:port/database, never credentials
+	GeneratedAt   time.Time `json:"generated_at"`
+	Options       string    `json:"options,omitempty"` // Command line flags of the run
+}
+
+// headerFields are the lines of a header, in order
+func (h *FileHeader) fields() [][2]string {
+	return [][2]string{
+		{"kind", h.Kind},
+		{"tool-version", h.ToolVersion},
+		{"client-version", h.ClientVersion},
+		{"server-version", h.ServerVersion},
+		{"source", h.Source},
+		{"generated-at", h.GeneratedAt.UTC().Format(time.RFC3339)},
+		{"options", h.Options},
+	}
+}
+
+// write writes the header followed by a blank line
+func (h *FileHeader) write(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString(headerStart + "\n")
+	for _, f := range h.fields() {
+		if f[1] != "" {
+			fmt.Fprintf(&b, "-- %s: %s\n", f[0], strings.ReplaceAll(f[1], "\n", " "))
+		}
+	}
+	b.WriteString(headerEnd + "\n\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// newFileHeader describes a file of kind generated from config by tool, or
+// by the tool itself when tool is "". A version that can't be read is left
+// out rather than failing the run.
+func newFileHeader(kind, tool string, config *DatabaseConfig, state *RunState) *FileHeader {
+	h := &FileHeader{
+		Kind:        kind,
+		ToolVersion: version,
+		Source:      fmt.Sprintf("%s:%s/%s", config.Host, config.Port, config.Database),
+		GeneratedAt: time.Now(),
+		Options:     state.Options,
+	}
+	if tool != "" {
+		if out, err := clientCommand(config, tool, []string{"--version"}).Output(); err == nil {
+			h.ClientVersion = strings.TrimSpace(string(out))
+		} else {
+			logger.Debug(fmt.Sprintf("Could not read the %s version: %v", tool, err))
+		}
+	}
+	if v, err := showServerVersion(config); err == nil {
+		h.ServerVersion = v
+	} else {
+		logger.Debug(fmt.Sprintf("Could not read the server version of %s: %v", config.Database, err))
+	}
+	return h
+}
+
+// showServerVersion reads server_version of config's database
+func showServerVersion(config *DatabaseConfig) (string, error) {
+	db, err := openDB(config, config.Database)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	var v string
+	err = db.QueryRowContext(runContext(), "SHOW server_version").Scan(&v)
+	return v, err
+}
+
+// prependFileHeader rewrites the file at path with h in front of it
+func prependFileHeader(path string, h *FileHeader) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(path), ".header-*.sql")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	err = h.write(out)
+	if err == nil {
+		_, err = io.Copy(out, in)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if info, err := in.Stat(); err == nil {
+		os.Chmod(out.Name(), info.Mode().Perm())
+	}
+	return os.Rename(out.Name(), path)
+}
+
+// readFileHeader reads the header of the SQL file at path, or returns nil
+// when it has none
+func readFileHeader(path string) (*FileHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() || scanner.Text() != headerStart {
+		return nil, scanner.Err()
+	}
+	h := &FileHeader{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == headerEnd {
+			return h, nil
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "-- "), ": ")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "kind":
+			h.Kind = value
+		case "tool-version":
+			h.ToolVersion = value
+		case "client-version":
+			h.ClientVersion = value
+		case "server-version":
+			h.ServerVersion = value
+		case "source":
+			h.Source = value
+		case "generated-at":
+			if t, err := time.Parse(time.RFC3339, value); err == nil {
+				h.GeneratedAt = t
+			}
+		case "options":
+			h.Options = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%s: file header is not terminated", path)
+}
+
+// commandOptions lists the flags set on the command line. The values of
+// password commands are left out, since they may hold secrets themselves,
+// and connection options are shown as redactOptions shows them.
+func commandOptions(cmd *cobra.Command) string {
+	var options []string
+	if cmd.HasParent() {
+		options = append(options, cmd.Name())
+	}
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		value := f.Value.String()
+		switch {
+		case strings.HasSuffix(f.Name, "-password-command"):
+			value = "<redacted>"
+		case f.Name == "source-options" || f.Name == "dest-options":
+			value = redactOptions(value)
+		}
+		if f.Value.Type() == "bool" && value == "true" {
+			options = append(options, "--"+f.Name)
+			return
+		}
+		options = append(options, fmt.Sprintf("--%s=%s", f.Name, value))
+	})
+	return strings.Join(options, " ")
+}
+
+func runRunsHeader(cmd *cobra.Command, args []string) error {
+	h, err := readFileHeader(args[0])
+	if err != nil {
+		return exitWith(exitFailure, err)
+	}
+	if h == nil {
+		return exitWith(exitFailure, fmt.Errorf("%s has no pg-schema-migrate file header", args[0]))
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(h)
+	return nil
+}
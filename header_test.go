@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestCommandOptionsRedacted(t *testing.T) {
+	cmd := &cobra.Command{Use: "pg-schema-migrate"}
+	cmd.Flags().String("source-options", "", "")
+	cmd.Flags().String("dest-options", "", "")
+	cmd.Flags().String("dest-password-command", "", "")
+	cmd.Flags().Bool("dry-run", false, "")
+	err := cmd.Flags().Parse([]string{
+		"--source-options=-c search_path=app",
+		"--dest-options=-c role=migrator -c app.api_token=abc --custom.secret=def",
+		"--dest-password-command=vault read secret/db",
+		"--dry-run",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "--dest-options=-c role=migrator -c app.api_token=***** --custom.secret=***** " +
+		"--dest-password-command=<redacted> --dry-run --source-options=-c search_path=app"
+	if got := commandOptions(cmd); got != want {
+		t.Errorf("commandOptions:\n got %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// progressInterval is how often a phase with an estimate reports progress
+const progressInterval = 30 * time.Second
+
+// loadRunHistory reads the manifests of earlier runs in dir, newest first.
+// Unreadable manifests are skipped.
+func loadRunHistory(dir string) []*RunResult {
+	paths, _ := filepath.Glob(filepath.Join(dir, "manifest_*.json"))
+
+	manifests := []*RunResult{} // Non-nil, so an empty history is loaded once
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var m RunResult
+		if err := json.Unmarshal(data, &m); err != nil {
+			logger.Debug(fmt.Sprintf("Skipping unreadable manifest %s: %v", path, err))
+			continue
+		}
+		m.upgrade()
+		manifests = append(manifests, &m)
+	}
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].StartedAt.After(manifests[j].StartedAt)
+	})
+	return manifests
+}
+
+// sameDatabase reports whether a manifest database is the one described by config
+func sameDatabase(m *ManifestDatabase, config *DatabaseConfig) bool {
+	want := manifestDatabase(config)
+	if m == nil || want == nil {
+		return m == nil && want == nil
+	}
+	return m.Host == want.Host && m.Database == want.Database
+}
+
+func totalObjects(counts map[string]int) int {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return total
+}
+
+// estimatePhase predicts how long the named phase takes, from the last run
+// between the same source and destination or, failing that, from the time
+// per object of other runs. It also describes where the estimate came from.
+func (r *RunState) estimatePhase(name string) (time.Duration, string) {
+	if r.history == nil {
+		r.history = loadRunHistory(r.OutputDir)
+	}
+
+	for _, m := range r.history {
+		if !sameDatabase(m.Source, r.Source) || !sameDatabase(m.Destination, r.Dest) {
+			continue
+		}
+		if seconds, ok := m.PhaseSeconds[name]; ok {
+			d := time.Duration(seconds * float64(time.Second))
+			return d, fmt.Sprintf("last time: %s", d.Round(time.Second))
+		}
+	}
+
+	objects := totalObjects(r.ObjectCounts)
+	if objects == 0 {
+		return 0, ""
+	}
+	var seconds float64
+	var counted int
+	for _, m := range r.history {
+		n := totalObjects(m.ObjectCounts)
+		if s, ok := m.PhaseSeconds[name]; ok && n > 0 {
+			seconds += s
+			counted += n
+		}
+	}
+	if counted == 0 {
+		return 0, ""
+	}
+	d := time.Duration(seconds / float64(counted) * float64(objects) * float64(time.Second))
+	return d, fmt.Sprintf("estimated %s for %d objects", d.Round(time.Second), objects)
+}
+
+// reportProgress logs the elapsed time and ETA of a phase to log until done is closed
+func reportProgress(log *Logger, name string, start time.Time, estimate time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			elapsed := time.Since(start)
+			if left := estimate - elapsed; left > 0 {
+				log.Info(fmt.Sprintf("%s: %s elapsed, ETA %s", name, elapsed.Round(time.Second), left.Round(time.Second)))
+			} else {
+				log.Info(fmt.Sprintf("%s: %s elapsed, %s over the estimate", name, elapsed.Round(time.Second), (-left).Round(time.Second)))
+			}
+		}
+	}
+}
+
+func newRunsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "runs",
+		Short: "Inspect the history of runs in the output directory",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "stats",
+		Short: "Show average phase durations per destination",
+		Args:  cobra.NoArgs,
+		Run:   runRunsStats,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "header <file>",
+		Short: "Print the header of a generated SQL file as JSON",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runRunsHeader,
+	})
+	return cmd
+}
+
+// phaseStats accumulates the durations of one phase
+type phaseStats struct {
+	total float64
+	count int
+}
+
+func runRunsStats(cmd *cobra.Command, args []string) {
+	outputDir, _ := cmd.Flags().GetString("output-dir")
+	manifests := loadRunHistory(outputDir)
+	if len(manifests) == 0 {
+		logger.Info(fmt.Sprintf("No run manifests in %s", outputDir))
+		return
+	}
+
+	type destinationStats struct {
+		runs, succeeded int
+		phases          map[string]*phaseStats
+		order           []string
+	}
+	byDest := make(map[string]*destinationStats)
+	var dests []string
+	for _, m := range manifests {
+		key := "-"
+		if m.Destination != nil {
+			key = fmt.Sprintf("%s/%s", m.Destination.Host, m.Destination.Database)
+		}
+		ds, ok := byDest[key]
+		if !ok {
+			ds = &destinationStats{phases: make(map[string]*phaseStats)}
+			byDest[key] = ds
+			dests = append(dests, key)
+		}
+		ds.runs++
+		if m.Success {
+			ds.succeeded++
+		}
+		for _, p := range m.Phases {
+			ps, ok := ds.phases[p.Name]
+			if !ok {
+				ps = &phaseStats{}
+				ds.phases[p.Name] = ps
+				ds.order = append(ds.order, p.Name)
+			}
+			ps.total += p.DurationSeconds
+			ps.count++
+		}
+	}
+	sort.Strings(dests)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DESTINATION\tRUNS\tSUCCEEDED\tAVERAGE PHASE DURATIONS")
+	for _, key := range dests {
+		ds := byDest[key]
+		averages := make([]string, 0, len(ds.order))
+		for _, name := range ds.order {
+			ps := ds.phases[name]
+			avg := time.Duration(ps.total / float64(ps.count) * float64(time.Second))
+			averages = append(averages, fmt.Sprintf("%s %s", name, avg.Round(time.Second)))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", key, ds.runs, ds.succeeded, strings.Join(averages, ", "))
+	}
+	w.Flush()
+}
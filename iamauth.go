@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/rds/auth"
+)
+
+// iamTokenRefreshAfter is how old an RDS auth token may get before a new phase
+// regenerates it. Tokens are valid for 15 minutes; the margin covers phase startup.
+const iamTokenRefreshAfter = 10 * time.Minute
+
+// AWSOptions holds AWS settings used for IAM database authentication
+type AWSOptions struct {
+	Region  string
+	Profile string
+}
+
+// iamAuth generates RDS IAM authentication tokens for one database endpoint
+type iamAuth struct {
+	endpoint string
+	user     string
+	region   string
+	creds    aws.CredentialsProvider
+	issued   time.Time
+}
+
+// validateAuthMode checks the value of --source-auth/--dest-auth
+func validateAuthMode(mode string) error {
+	if mode != "password" && mode != "iam" {
+		return fmt.Errorf("must be 'password' or 'iam'")
+	}
+	return nil
+}
+
+// setupIAMAuth configures config to authenticate with RDS IAM tokens and
+// generates the first token. SSL is required by RDS for IAM authentication.
+func setupIAMAuth(config *DatabaseConfig, awsOpts *AWSOptions) error {
+	if config.SSLMode == "disable" {
+		warn(WarnSSLModeOverridden, fmt.Sprintf("IAM authentication requires SSL, using sslmode=require for %s", config.Host))
+		config.SSLMode = "require"
+	}
+
+	var loadOpts []func(*awsconfig.LoadOptions) error
+	if awsOpts.Region != "" {
+		loadOpts = append(loadOpts, awsconfig.WithRegion(awsOpts.Region))
+	}
+	if awsOpts.Profile != "" {
+		loadOpts = append(loadOpts, awsconfig.WithSharedConfigProfile(awsOpts.Profile))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), loadOpts...)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS configuration: %v", err)
+	}
+	if cfg.Region == "" {
+		return fmt.Errorf("no AWS region configured (set AWS_REGION or pass --aws-region)")
+	}
+
+	config.iam = &iamAuth{
+		endpoint: net.JoinHostPort(config.Host, config.Port),
+		user:     config.Username,
+		region:   cfg.Region,
+		creds:    cfg.Credentials,
+	}
+	return config.iam.refresh(config)
+}
+
+func (a *iamAuth) refresh(config *DatabaseConfig) error {
+	token, err := auth.BuildAuthToken(context.Background(), a.endpoint, a.region, a.user, a.creds)
+	if err != nil {
+		return fmt.Errorf("failed to generate RDS IAM auth token for %s@%s: %v", a.user, a.endpoint, err)
+	}
+	config.Password = token
+	a.issued = time.Now()
+	logger.Info(fmt.Sprintf("Generated RDS IAM auth token for %s@%s (region %s)", a.user, a.endpoint, a.region))
+	return nil
+}
+
+// refreshCredentials regenerates IAM auth tokens that are close to expiry. It
+// is called at the start of every phase that opens new connections.
+func refreshCredentials(configs ...*DatabaseConfig) error {
+	for _, config := range configs {
+		if config == nil || config.iam == nil {
+			continue
+		}
+		if time.Since(config.iam.issued) < iamTokenRefreshAfter {
+			continue
+		}
+		if err := config.iam.refresh(config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
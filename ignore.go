@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// ignoreFileName is the ignore file read from the working directory
+const ignoreFileName = ".pgsmignore"
+
+// ignoreRule is one parsed ignore pattern
+type ignoreRule struct {
+	pattern string // As written, for messages
+	schema  string // Glob for the schema
+	name    string // Glob for the object name, empty when the rule names only a schema
+	negate  bool
+}
+
+// IgnoreList decides which objects are left out of comparisons. Rules are
+// applied in order and the last matching rule wins, so a later "!pattern"
+// brings back objects excluded by an earlier one.
+type IgnoreList struct {
+	rules []ignoreRule
+}
+
+// loadIgnoreList reads .pgsmignore from the working directory, if present, and
+// appends the --ignore-object patterns, which therefore take precedence.
+func loadIgnoreList(flagPatterns []string) (*IgnoreList, error) {
+	list := &IgnoreList{}
+
+	file, err := os.Open(ignoreFileName)
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		lineNo := 0
+		for scanner.Scan() {
+			lineNo++
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if err := list.add(line); err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", ignoreFileName, lineNo, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", ignoreFileName, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to open %s: %v", ignoreFileName, err)
+	}
+
+	for _, pattern := range flagPatterns {
+		if err := list.add(pattern); err != nil {
+			return nil, fmt.Errorf("--ignore-object %q: %v", pattern, err)
+		}
+	}
+
+	if len(list.rules) > 0 {
+		logger.Info(fmt.Sprintf("Loaded %d ignore pattern(s)", len(list.rules)))
+	}
+	return list, nil
+}
+
+func (l *IgnoreList) add(pattern string) error {
+	rule, err := parseIgnorePattern(pattern)
+	if err != nil {
+		return err
+	}
+	l.rules = append(l.rules, rule)
+	return nil
+}
+
+// parseIgnorePattern parses "[!]schema[.name]". The schema and name are split
+// at the first dot outside double quotes, so names containing dots can be
+// written as "my.schema".table; glob characters work inside quotes too.
+func parseIgnorePattern(pattern string) (ignoreRule, error) {
+	rule := ignoreRule{pattern: pattern}
+	p := pattern
+	if strings.HasPrefix(p, "!") {
+		rule.negate = true
+		p = p[1:]
+	}
+
+	var parts []string
+	var current strings.Builder
+	inQuotes := false
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == '"' && inQuotes && i+1 < len(p) && p[i+1] == '"':
+			current.WriteByte('"')
+			i++
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == '.' && !inQuotes && len(parts) == 0:
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	if inQuotes {
+		return rule, fmt.Errorf("unterminated quote")
+	}
+	parts = append(parts, current.String())
+
+	rule.schema = parts[0]
+	if len(parts) == 2 {
+		rule.name = parts[1]
+		if rule.name == "" {
+			return rule, fmt.Errorf("empty object name")
+		}
+	}
+	if rule.schema == "" {
+		return rule, fmt.Errorf("empty schema")
+	}
+
+	for _, glob := range []string{rule.schema, rule.name} {
+		if _, err := path.Match(glob, ""); err != nil {
+			return rule, fmt.Errorf("invalid glob %q: %v", glob, err)
+		}
+	}
+	return rule, nil
+}
+
+// matches reports whether the rule applies to obj. A rule naming only a schema
+// covers the schema and everything in it.
+func (r ignoreRule) matches(obj DatabaseObject) bool {
+	schema := obj.Schema
+	if obj.Type == "schema" {
+		schema = obj.Name
+	}
+	if ok, _ := path.Match(r.schema, schema); !ok {
+		return false
+	}
+
+	if r.name == "" {
+		return true
+	}
+	if obj.Type == "schema" {
+		return r.name == "*"
+	}
+	if ok, _ := path.Match(r.name, obj.Name); ok {
+		return true
+	}
+	// Functions are named with their argument types; let "fn" match "fn(integer)"
+	if i := strings.IndexByte(obj.Name, '('); i > 0 {
+		ok, _ := path.Match(r.name, obj.Name[:i])
+		return ok
+	}
+	return false
+}
+
+// Ignored reports whether obj is excluded
+func (l *IgnoreList) Ignored(obj DatabaseObject) bool {
+	if l == nil {
+		return false
+	}
+	ignored := false
+	for _, rule := range l.rules {
+		if rule.matches(obj) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreList(t *testing.T) {
+	table := func(schema, name string) DatabaseObject {
+		return DatabaseObject{Type: "table", Schema: schema, Name: name}
+	}
+	schema := func(name string) DatabaseObject { return DatabaseObject{Type: "schema", Name: name} }
+	function := func(schema, name string) DatabaseObject {
+		return DatabaseObject{Type: "function", Schema: schema, Name: name}
+	}
+
+	tests := []struct {
+		name     string
+		patterns []string
+		ignored  []DatabaseObject
+		kept     []DatabaseObject
+	}{
+		{
+			name:     "schema",
+			patterns: []string{"aws_commons"},
+			ignored:  []DatabaseObject{schema("aws_commons"), table("aws_commons", "t")},
+			kept:     []DatabaseObject{schema("aws_commons2"), table("public", "aws_commons")},
+		},
+		{
+			name:     "everything in a schema but not the schema",
+			patterns: []string{"pgagent.*"},
+			ignored:  []DatabaseObject{schema("pgagent"), table("pgagent", "pga_job")},
+			kept:     []DatabaseObject{table("public", "pga_job")},
+		},
+		{
+			name:     "negation brings back an object",
+			patterns: []string{"pg*.*", "!pgagent.keep"},
+			ignored:  []DatabaseObject{table("pgagent", "pga_job"), table("pglogical", "node")},
+			kept:     []DatabaseObject{table("pgagent", "keep"), table("public", "keep")},
+		},
+		{
+			name:     "negation of a schema",
+			patterns: []string{"*", "!public"},
+			ignored:  []DatabaseObject{schema("audit"), table("audit", "log")},
+			kept:     []DatabaseObject{schema("public"), table("public", "t")},
+		},
+		{
+			name:     "the last matching rule wins",
+			patterns: []string{"!public.keep", "public.*"},
+			ignored:  []DatabaseObject{table("public", "keep"), table("public", "t")},
+		},
+		{
+			name:     "negation then exclusion again",
+			patterns: []string{"public.*", "!public.k*", "public.kx"},
+			ignored:  []DatabaseObject{table("public", "t"), table("public", "kx")},
+			kept:     []DatabaseObject{table("public", "keep")},
+		},
+		{
+			name:     "quoted schema with a dot",
+			patterns: []string{`"my.schema".table`},
+			ignored:  []DatabaseObject{table("my.schema", "table")},
+			kept:     []DatabaseObject{table("my", "schema.table"), table("my.schema", "other")},
+		},
+		{
+			name:     "unquoted, the first dot splits",
+			patterns: []string{"my.schema.table"},
+			ignored:  []DatabaseObject{table("my", "schema.table")},
+			kept:     []DatabaseObject{table("my.schema", "table")},
+		},
+		{
+			name:     "quoted name with a dot",
+			patterns: []string{`public."a.b"`},
+			ignored:  []DatabaseObject{table("public", "a.b")},
+			kept:     []DatabaseObject{table("public", "a"), table("public", "aXb")},
+		},
+		{
+			name:     "globs work inside quotes",
+			patterns: []string{`"tmp.*".*`},
+			ignored:  []DatabaseObject{table("tmp.1", "t"), table("tmp.", "t")},
+			kept:     []DatabaseObject{table("tmp", "t"), table("tmp1", "t")},
+		},
+		{
+			name:     "doubled quotes",
+			patterns: []string{`"a""b".t`},
+			ignored:  []DatabaseObject{table(`a"b`, "t")},
+			kept:     []DatabaseObject{table("ab", "t")},
+		},
+		{
+			name:     "escaped wildcards match themselves",
+			patterns: []string{`public.\*`, `public.a\?`},
+			ignored:  []DatabaseObject{table("public", "*"), table("public", "a?")},
+			kept:     []DatabaseObject{table("public", "t"), table("public", "ab")},
+		},
+		{
+			name:     "character classes",
+			patterns: []string{"public.log_202[45]*"},
+			ignored:  []DatabaseObject{table("public", "log_2024_01"), table("public", "log_2025")},
+			kept:     []DatabaseObject{table("public", "log_2026"), table("public", "log_2023")},
+		},
+		{
+			name:     "functions match without their arguments",
+			patterns: []string{"public.fn", "!public.fn(text)"},
+			ignored:  []DatabaseObject{function("public", "fn(integer)"), function("public", "fn()")},
+			kept:     []DatabaseObject{function("public", "fn(text)"), function("public", "fn2(integer)")},
+		},
+		{
+			name: "no patterns",
+			kept: []DatabaseObject{schema("public"), table("public", "t")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			list := &IgnoreList{}
+			for _, pattern := range test.patterns {
+				if err := list.add(pattern); err != nil {
+					t.Fatalf("%q: %v", pattern, err)
+				}
+			}
+			for _, obj := range test.ignored {
+				if !list.Ignored(obj) {
+					t.Errorf("%s not ignored by %q", obj, test.patterns)
+				}
+			}
+			for _, obj := range test.kept {
+				if list.Ignored(obj) {
+					t.Errorf("%s ignored by %q", obj, test.patterns)
+				}
+			}
+		})
+	}
+
+	var none *IgnoreList
+	if none.Ignored(table("public", "t")) {
+		t.Error("a nil list ignores objects")
+	}
+}
+
+func TestParseIgnorePatternErrors(t *testing.T) {
+	for pattern, want := range map[string]string{
+		`"unterminated.t`: "unterminated quote",
+		".t":              "empty schema",
+		"!":               "empty schema",
+		"public.":         "empty object name",
+		"public.[a":       "invalid glob",
+		"[.t":             "invalid glob",
+	} {
+		if _, err := parseIgnorePattern(pattern); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want %q", pattern, err, want)
+		}
+	}
+}
+
+func TestLoadIgnoreList(t *testing.T) {
+	captureLog(t)
+	t.Chdir(t.TempDir())
+	file := "# provider schemas\n\naws_commons\n  pgagent.*  \n"
+	if err := os.WriteFile(ignoreFileName, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// --ignore-object patterns come after the file's, so they win
+	list, err := loadIgnoreList([]string{"!pgagent.keep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.rules) != 3 {
+		t.Fatalf("loaded %d rules, want 3", len(list.rules))
+	}
+	if !list.Ignored(DatabaseObject{Type: "table", Schema: "pgagent", Name: "pga_job"}) || list.Ignored(DatabaseObject{Type: "table", Schema: "pgagent", Name: "keep"}) {
+		t.Error("--ignore-object did not override the file")
+	}
+
+	if err := os.WriteFile(ignoreFileName, []byte("aws_commons\n\"broken\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadIgnoreList(nil); err == nil || !strings.Contains(err.Error(), ".pgsmignore line 2") {
+		t.Errorf("expected the bad line to be reported, got %v", err)
+	}
+	if err := os.Remove(ignoreFileName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadIgnoreList([]string{"public."}); err == nil || !strings.Contains(err.Error(), "--ignore-object") {
+		t.Errorf("expected the bad flag to be reported, got %v", err)
+	}
+}
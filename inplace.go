@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Values of --objects
+const (
+	ObjectsAll   = "all"   // The whole schema, replacing the destination database
+	ObjectsCode  = "code"  // Functions, procedures, views and triggers, updated in place
+	ObjectsEnums = "enums" // Enum types and their new values, updated in place
+)
+
+// migrates reports whether --objects selects the given kind of object
+func (o *MigrationOptions) migrates(kind string) bool {
+	for _, k := range o.Objects {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// parseObjects validates --objects: "all", or a comma-separated list of the
+// kinds updated in place
+func parseObjects(value string) ([]string, error) {
+	var kinds []string
+	for _, k := range strings.Split(value, ",") {
+		switch k = strings.TrimSpace(k); k {
+		case ObjectsAll, ObjectsCode, ObjectsEnums:
+			kinds = append(kinds, k)
+		case "":
+		default:
+			return nil, fmt.Errorf("--objects must be 'all' or a list of 'code' and 'enums', got %q", k)
+		}
+	}
+	if len(kinds) == 0 {
+		return []string{ObjectsAll}, nil
+	}
+	for _, k := range kinds {
+		if k == ObjectsAll && len(kinds) > 1 {
+			return nil, fmt.Errorf("--objects all cannot be combined with other kinds")
+		}
+	}
+	return kinds, nil
+}
+
+// inPlaceObjects holds the objects read from one database
+type inPlaceObjects struct {
+	enums []*EnumType
+	code  []*CodeObject
+}
+
+func loadInPlaceObjects(db *sql.DB, options *MigrationOptions) (*inPlaceObjects, error) {
+	objects := &inPlaceObjects{}
+	var err error
+	if options.migrates(ObjectsEnums) {
+		if objects.enums, err = loadEnumTypes(db); err != nil {
+			return nil, err
+		}
+	}
+	if options.migrates(ObjectsCode) {
+		if objects.code, err = loadCodeObjects(db); err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+func (p *inPlaceObjects) write(w io.Writer) error {
+	if err := writeEnumFile(w, p.enums); err != nil {
+		return err
+	}
+	return writeCodeFile(w, p.code)
+}
+
+// migrateInPlace exports the objects selected by --objects and, in direct
+// mode, applies what changed to the existing destination: new enum values
+// first, then the stored code that may use them
+func migrateInPlace(source, dest *DatabaseConfig, options *MigrationOptions, state *RunState) error {
+	kinds := strings.Join(options.Objects, ", ")
+
+	var sourceObjects *inPlaceObjects
+	err := state.phase("export", func() error {
+		if err := refreshCredentials(source); err != nil {
+			return err
+		}
+		db, err := openDB(source, source.Database)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		sourceObjects, err = loadInPlaceObjects(db, options)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export %s: %v", kinds, err)
+	}
+	state.ObjectCounts = codeCounts(sourceObjects.code)
+	if len(sourceObjects.enums) > 0 {
+		state.ObjectCounts["TYPE"] = len(sourceObjects.enums)
+	}
+	logger.Info(fmt.Sprintf("Exported %d enum type(s) and %d code object(s) from '%s'", len(sourceObjects.enums), len(sourceObjects.code), source.Database))
+
+	// The objects are read over the connection, so no client version
+	withHeader := func(kind string, write func(w io.Writer) error) func(w io.Writer) error {
+		header := newFileHeader(kind, "", source, state)
+		return func(w io.Writer) error {
+			if err := header.write(w); err != nil {
+				return err
+			}
+			return write(w)
+		}
+	}
+	switch options.Output {
+	case "-":
+		return withHeader(FileKindSchema, sourceObjects.write)(os.Stdout)
+	case "":
+		timestamp := state.Timestamp()
+		if options.migrates(ObjectsEnums) {
+			enumFile := filepath.Join(options.OutputDir, fmt.Sprintf("enums_%s_%s.sql", source.Database, timestamp))
+			if err := writeFileWith(enumFile, withHeader(FileKindEnums, func(w io.Writer) error { return writeEnumFile(w, sourceObjects.enums) })); err != nil {
+				return fmt.Errorf("failed to write enum file: %v", err)
+			}
+			logger.Info(fmt.Sprintf("Enum types written to: %s", enumFile))
+			state.SchemaFile = enumFile
+		}
+		if options.migrates(ObjectsCode) {
+			codeFile := filepath.Join(options.OutputDir, fmt.Sprintf("code_%s_%s.sql", source.Database, timestamp))
+			if err := writeFileWith(codeFile, withHeader(FileKindCode, func(w io.Writer) error { return writeCodeFile(w, sourceObjects.code) })); err != nil {
+				return fmt.Errorf("failed to write code file: %v", err)
+			}
+			logger.Info(fmt.Sprintf("Code written to: %s", codeFile))
+			state.SchemaFile = codeFile
+		}
+	default:
+		if err := writeFileWith(options.Output, withHeader(FileKindSchema, sourceObjects.write)); err != nil {
+			return fmt.Errorf("failed to write %s: %v", options.Output, err)
+		}
+		state.SchemaFile = options.Output
+	}
+	if options.Mode == "export" {
+		logger.Success(fmt.Sprintf("Exported %s", kinds))
+		return nil
+	}
+
+	if err := refreshCredentials(dest); err != nil {
+		return err
+	}
+	exists, err := databaseExists(dest)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("destination database '%s' does not exist; --objects %s only updates an already migrated database", dest.Database, kinds)
+	}
+
+	var enumChanges []EnumChange
+	var codeChanges []CodeChange
+	var destObjects *inPlaceObjects
+	err = state.phase("diff", func() error {
+		db, err := openDatabase(dest, dest.Database)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if destObjects, err = loadInPlaceObjects(db, options); err != nil {
+			return err
+		}
+
+		enumChanges = diffEnums(sourceObjects.enums, destObjects.enums)
+		reportEnumManualActions(db, enumChanges)
+
+		var destOnly []*CodeObject
+		codeChanges, destOnly = diffCode(sourceObjects.code, destObjects.code, options.StrictCodeCompare)
+		if len(destOnly) > 0 {
+			logger.Info(fmt.Sprintf("%d code object(s) exist only on the destination and are left alone", len(destOnly)))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to compare %s: %v", kinds, err)
+	}
+
+	applicable := 0
+	for _, c := range enumChanges {
+		if !c.manual() {
+			applicable++
+		}
+	}
+	state.CodeChanges = codeDiffs(codeChanges)
+	if applicable+len(codeChanges) == 0 {
+		logger.Success(fmt.Sprintf("Nothing to update in '%s'", dest.Database))
+		return nil
+	}
+	logger.Info(fmt.Sprintf("%d enum type(s) and %d code object(s) to update:", applicable, len(codeChanges)))
+	printEnumDiff(logger.Writer(), enumChanges)
+	printCodeDiff(logger.Writer(), codeChanges)
+
+	// Keep the replaced definitions so they can be restored by hand
+	var previous []*CodeObject
+	for _, c := range codeChanges {
+		if c.Dest != nil {
+			previous = append(previous, c.Dest)
+		}
+	}
+	if len(previous) > 0 {
+		previousFile := filepath.Join(options.OutputDir, fmt.Sprintf("code_previous_%s_%s.sql", dest.Database, state.Timestamp()))
+		if err := writeFileWith(previousFile, func(w io.Writer) error { return writeCodeFile(w, previous) }); err != nil {
+			return fmt.Errorf("failed to save the destination's definitions: %v", err)
+		}
+		logger.Info(fmt.Sprintf("Definitions being replaced saved to %s", previousFile))
+	}
+
+	if options.DryRun {
+		logger.Info(fmt.Sprintf("DRY RUN MODE - would update %d enum type(s) and %d code object(s) in '%s'", applicable, len(codeChanges), dest.Database))
+		return nil
+	}
+
+	return state.phase("apply", func() error {
+		if err := refreshCredentials(dest); err != nil {
+			return err
+		}
+		if err := applyEnumChanges(dest, enumChanges); err != nil {
+			return err
+		}
+		if len(codeChanges) == 0 {
+			return nil
+		}
+		return applyCodeChanges(dest, codeChanges, sourceObjects.code, destObjects.code)
+	})
+}
+
+// writeFileWith creates path and fills it with write
+func writeFileWith(path string, write func(w io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
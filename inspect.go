@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"pg-schema-migrator/internal/catalog"
+)
+
+func newInspectCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "inspect",
+		Short: "Describe the source schema as a JSON or YAML document",
+		Long: "Read the catalogs of the source database and write its schemas, with their tables, columns, " +
+			"constraints, indexes, triggers, views, sequences, functions and types, as a JSON or YAML document. " +
+			"The document carries a format version and is sorted by name, so two of them diff cleanly. Nothing " +
+			"is dumped and the source is only read.",
+		Args: cobra.NoArgs,
+		RunE: runInspect,
+	}
+
+	addSourceFlags(cmd.Flags())
+	cmd.Flags().StringP("out", "", "-", "File to write the document to, '-' for stdout, or an s3://, gs:// or az:// URI")
+	cmd.Flags().StringP("format", "", "", "Document format: 'json' or 'yaml' (default from the --out extension, else json)")
+	cmd.Flags().StringArrayP("schema", "", nil, "Describe only schemas matching this pattern (* and ? wildcards); repeatable")
+	cmd.Flags().StringArrayP("exclude-schema", "", nil, "Leave out schemas matching this pattern; repeatable")
+	return cmd
+}
+
+// inspectFormat returns the format of the inspect document: --format, or
+// the one the extension of --out names
+func inspectFormat(format, out string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(path.Ext(out)) {
+		case ".yaml", ".yml":
+			return catalog.FormatYAML, nil
+		}
+		return catalog.FormatJSON, nil
+	}
+	if format != catalog.FormatJSON && format != catalog.FormatYAML {
+		return "", fmt.Errorf("invalid --format %q, must be '%s' or '%s'", format, catalog.FormatJSON, catalog.FormatYAML)
+	}
+	return format, nil
+}
+
+func runInspect(cmd *cobra.Command, args []string) error {
+	out, _ := cmd.Flags().GetString("out")
+	// Keep stdout clean for the document
+	if out == "-" {
+		logger.SetOutput(os.Stderr)
+	}
+	if err := configureCIOutput(cmd); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	logger.Info("Starting PostgreSQL schema inspection...")
+	handleSignals()
+
+	formatFlag, _ := cmd.Flags().GetString("format")
+	schemas, _ := cmd.Flags().GetStringArray("schema")
+	excludeSchemas, _ := cmd.Flags().GetStringArray("exclude-schema")
+	awsRegion, _ := cmd.Flags().GetString("aws-region")
+	awsProfile, _ := cmd.Flags().GetString("aws-profile")
+	if out == "" {
+		return exitWith(exitOptionError, errors.New("--out must not be empty"))
+	}
+	format, err := inspectFormat(formatFlag, out)
+	if err != nil {
+		return exitWith(exitOptionError, err)
+	}
+	selection := catalog.Options{Schemas: schemas, ExcludeSchemas: excludeSchemas}
+	if err := selection.Validate(); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	if err := validateConnectionFlags(cmd, true, false); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+	options, err := parseMigrationOptions(cmd)
+	if err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Failed to parse options: %v", err))
+	}
+
+	// Open the storage first, so bad credentials fail before the source is read
+	var storage Storage
+	name := filepath.Base(out)
+	if out != "-" {
+		location := filepath.Dir(out)
+		if scheme, bucket, prefix, ok := storageURI(out); ok {
+			location, name = scheme+"://"+bucket, prefix
+			if name == "" {
+				return exitWith(exitOptionError, fmt.Errorf("--out %s names a bucket, not a file", out))
+			}
+		}
+		if storage, err = openStorage(runContext(), location, &AWSOptions{Region: awsRegion, Profile: awsProfile}); err != nil {
+			return exitWith(exitOptionError, fmt.Errorf("Invalid --out: %v", err))
+		}
+	}
+
+	sourceConfig, err := getSourceConfig(cmd)
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Failed to get source config: %v", err))
+	}
+	if err := startTunnels(&options.SSH, sourceConfig); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("SSH tunnel setup failed: %v", err))
+	}
+
+	db, err := openDB(sourceConfig, sourceConfig.Database)
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Failed to connect to the source: %v", err))
+	}
+	defer db.Close()
+
+	logger.Info(fmt.Sprintf("Reading the catalogs of '%s'...", sourceConfig.Database))
+	c, err := catalog.Read(runContext(), db, selection)
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Inspection failed: %v", err))
+	}
+	if len(c.Schemas) == 0 && (len(schemas) > 0 || len(excludeSchemas) > 0) {
+		logger.Warning("No schema matches --schema and --exclude-schema; the document lists none")
+	}
+
+	var doc bytes.Buffer
+	if err := catalog.Write(&doc, c, format); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Failed to encode the document: %v", err))
+	}
+	if storage == nil {
+		if _, err := os.Stdout.Write(doc.Bytes()); err != nil {
+			return exitWith(exitFailure, fmt.Errorf("Failed to write the document: %v", err))
+		}
+	} else {
+		if err := storage.Put(runContext(), name, &doc); err != nil {
+			return exitWith(exitFailure, fmt.Errorf("Failed to write the document to %s: %v", out, err))
+		}
+		logger.Success(fmt.Sprintf("Catalog of %d schema(s) written to %s", len(c.Schemas), out))
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"pg-schema-migrator/internal/catalog"
+)
+
+// inspectTestDatabase creates a database whose objects are created out of
+// name order, dropped after the test
+func inspectTestDatabase(t *testing.T) *DatabaseConfig {
+	t.Helper()
+	server := testServer(t)
+	source := *server
+	source.Database = "pgsm_inspect"
+	drop := func() {
+		execOn(t, server, server.Database, "DROP DATABASE IF EXISTS "+quoteIdentifier(source.Database))
+	}
+	drop()
+	t.Cleanup(drop)
+	execOn(t, server, server.Database, "CREATE DATABASE "+quoteIdentifier(source.Database))
+	execOn(t, &source, source.Database,
+		`CREATE SCHEMA zeta`,
+		`CREATE SCHEMA alpha`,
+		`CREATE SCHEMA "Billing"`,
+		`CREATE TABLE zeta.t (id integer)`,
+		`CREATE TABLE alpha.zebra (id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY, name text)`,
+		`CREATE TABLE alpha.apple (a integer, b integer, c numeric, d numeric GENERATED ALWAYS AS (c * 2) STORED)`,
+		`ALTER TABLE alpha.apple DROP COLUMN b`,
+		`ALTER TABLE alpha.apple ADD CONSTRAINT z_check CHECK (a > 0), ADD CONSTRAINT a_check CHECK (c > 0)`,
+		`CREATE TABLE alpha.events (id bigserial, created date NOT NULL) PARTITION BY RANGE (created)`,
+		`CREATE TABLE alpha.events_2026 PARTITION OF alpha.events FOR VALUES FROM ('2026-01-01') TO ('2027-01-01') WITH (fillfactor = 70)`,
+		`CREATE SEQUENCE alpha.invoice_numbers START 1000`,
+		`CREATE TYPE alpha.status AS ENUM ('draft', 'sent', 'paid')`,
+		`CREATE DOMAIN alpha.positive AS numeric NOT NULL CHECK (VALUE > 0)`,
+		`CREATE FUNCTION alpha.f(text) RETURNS integer LANGUAGE sql IMMUTABLE AS 'SELECT 1'`,
+		`CREATE FUNCTION alpha.f(integer) RETURNS integer LANGUAGE sql IMMUTABLE AS 'SELECT 2'`,
+		`CREATE VIEW alpha.names AS SELECT name FROM alpha.zebra`,
+		`COMMENT ON TABLE alpha.zebra IS 'Stripes'`)
+	if source.Password != "" {
+		t.Setenv("PGPASSWORD", source.Password)
+	}
+	return &source
+}
+
+func TestReadCatalog(t *testing.T) {
+	source := inspectTestDatabase(t)
+	db, err := openDatabase(source, source.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	c, err := catalog.Read(runContext(), db, catalog.Options{ExcludeSchemas: []string{"zet?"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Version != catalog.Version || c.Database != source.Database {
+		t.Errorf("version %d, database %s", c.Version, c.Database)
+	}
+
+	// Sorted by name, as the catalogs compare them, whatever the order
+	// they were created in
+	names := func(n int, name func(int) string) []string {
+		var list []string
+		for i := range n {
+			list = append(list, name(i))
+		}
+		return list
+	}
+	if got := names(len(c.Schemas), func(i int) string { return c.Schemas[i].Name }); !slices.Equal(got, []string{"Billing", "alpha", "public"}) {
+		t.Fatalf("schemas %q", got)
+	}
+	alpha := c.Schema("alpha")
+	for _, test := range []struct {
+		what string
+		got  []string
+		want []string
+	}{
+		{"tables", names(len(alpha.Tables), func(i int) string { return alpha.Tables[i].Name }), []string{"apple", "events", "events_2026", "zebra"}},
+		{"sequences", names(len(alpha.Sequences), func(i int) string { return alpha.Sequences[i].Name }), []string{"events_id_seq", "invoice_numbers"}},
+		{"functions", names(len(alpha.Functions), func(i int) string { return alpha.Functions[i].Name + "(" + alpha.Functions[i].ArgumentTypes + ")" }), []string{"f(integer)", "f(text)"}},
+		{"types", names(len(alpha.Types), func(i int) string { return alpha.Types[i].Name }), []string{"positive", "status"}},
+		{"views", names(len(alpha.Views), func(i int) string { return alpha.Views[i].Name }), []string{"names"}},
+		{"constraints", names(len(alpha.Tables[0].Constraints), func(i int) string { return alpha.Tables[0].Constraints[i].Name }), []string{"a_check", "z_check"}},
+		{"columns", names(len(alpha.Tables[0].Columns), func(i int) string { return alpha.Tables[0].Columns[i].Name }), []string{"a", "c", "d"}},
+	} {
+		if !slices.Equal(test.got, test.want) {
+			t.Errorf("%s %q, want %q", test.what, test.got, test.want)
+		}
+	}
+
+	apple, events, partition, zebra := alpha.Tables[0], alpha.Tables[1], alpha.Tables[2], alpha.Tables[3]
+	if apple.Columns[1].Position != 3 || apple.Columns[2].Generated != "(c * (2)::numeric)" {
+		t.Errorf("apple columns %+v %+v", apple.Columns[1], apple.Columns[2])
+	}
+	if zebra.Columns[0].Identity != catalog.IdentityAlways || zebra.Comment != "Stripes" || len(zebra.Indexes) != 1 || !zebra.Indexes[0].Primary {
+		t.Errorf("zebra %+v", zebra)
+	}
+	if events.Kind != catalog.KindPartitionedTable || events.PartitionKey != "RANGE (created)" {
+		t.Errorf("events %+v", events)
+	}
+	if partition.PartitionOf == nil || partition.PartitionOf.Name != "events" || !slices.Equal(partition.Options, []string{"fillfactor=70"}) {
+		t.Errorf("events_2026 %+v", partition)
+	}
+	if seq := alpha.Sequences[0]; seq.OwnedBy == nil || seq.OwnedBy.Name != "events" || seq.Type != "bigint" {
+		t.Errorf("events_id_seq %+v", seq)
+	}
+	if typ := alpha.Types[1]; !slices.Equal(typ.Labels, []string{"draft", "sent", "paid"}) {
+		t.Errorf("status labels %q", typ.Labels)
+	}
+
+	only, err := catalog.Read(runContext(), db, catalog.Options{Schemas: []string{"alpha", "B*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(len(only.Schemas), func(i int) string { return only.Schemas[i].Name }); !slices.Equal(got, []string{"Billing", "alpha"}) {
+		t.Errorf("selected schemas %q", got)
+	}
+}
+
+func TestInspectCommand(t *testing.T) {
+	source := inspectTestDatabase(t)
+	out := filepath.Join(t.TempDir(), "catalog.yaml")
+	code, output := runCommand(t, source, "inspect",
+		"--source-host", source.Host, "--source-port", source.Port, "--source-user", source.Username,
+		"--source-db", source.Database, "--source-ssl", source.SSLMode, "--no-remember",
+		"--schema", "alpha", "--out", out)
+	if code != 0 {
+		t.Fatalf("exit code %d:\n%s", code, output)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written catalog.Catalog
+	if err := yaml.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+
+	// The document is the catalog as read, in YAML for the .yaml name
+	db, err := openDatabase(source, source.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	read, err := catalog.Read(runContext(), db, catalog.Options{Schemas: []string{"alpha"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	written.ReadAt, read.ReadAt = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(&written, read) {
+		t.Errorf("the document differs from the catalog read:\n%s", data)
+	}
+}
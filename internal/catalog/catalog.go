@@ -0,0 +1,226 @@
+// Package catalog reads the structure of a PostgreSQL database from its
+// system catalogs: schemas with their tables, columns, constraints, indexes,
+// triggers, views, sequences, functions and types, and the comments on them.
+//
+// A Catalog is also a document. It is written as JSON or YAML with Write,
+// under a format version so tools reading it can tell when it changes. Names
+// are as the catalogs hold them, unquoted; QuoteIdent quotes them for SQL.
+// Everything is sorted by name, so two documents of the same structure are
+// byte for byte the same and diff cleanly.
+package catalog
+
+import "time"
+
+// Version is the format version of the documents Write produces. It changes
+// when a field is renamed, removed or changes meaning; new fields don't
+// change it.
+const Version = 1
+
+// Catalog is the structure of one database
+type Catalog struct {
+	Version       int       `json:"version" yaml:"version"`
+	Database      string    `json:"database" yaml:"database"`
+	ServerVersion string    `json:"server_version" yaml:"server_version"`
+	ReadAt        time.Time `json:"read_at" yaml:"read_at"`
+	Schemas       []*Schema `json:"schemas" yaml:"schemas"`
+}
+
+// Schema is a schema with the objects in it. Objects belonging to an
+// extension are left out, as pg_dump leaves them out.
+type Schema struct {
+	Name      string      `json:"name" yaml:"name"`
+	Owner     string      `json:"owner" yaml:"owner"`
+	Comment   string      `json:"comment,omitempty" yaml:"comment,omitempty"`
+	Tables    []*Table    `json:"tables" yaml:"tables"`
+	Views     []*View     `json:"views" yaml:"views"`
+	Sequences []*Sequence `json:"sequences" yaml:"sequences"`
+	Functions []*Function `json:"functions" yaml:"functions"`
+	Types     []*Type     `json:"types" yaml:"types"`
+}
+
+// Kinds of tables
+const (
+	KindTable            = "table"
+	KindPartitionedTable = "partitioned table"
+	KindForeignTable     = "foreign table"
+)
+
+// Table is an ordinary, partitioned or foreign table
+type Table struct {
+	Name           string        `json:"name" yaml:"name"`
+	Kind           string        `json:"kind" yaml:"kind"` // One of the Kind constants
+	Owner          string        `json:"owner" yaml:"owner"`
+	Unlogged       bool          `json:"unlogged,omitempty" yaml:"unlogged,omitempty"`
+	PartitionKey   string        `json:"partition_key,omitempty" yaml:"partition_key,omitempty"` // Of a partitioned table: "RANGE (created_at)"
+	PartitionOf    *ObjectRef    `json:"partition_of,omitempty" yaml:"partition_of,omitempty"`
+	PartitionBound string        `json:"partition_bound,omitempty" yaml:"partition_bound,omitempty"` // Of a partition: "FOR VALUES FROM (...) TO (...)"
+	Options        []string      `json:"options,omitempty" yaml:"options,omitempty"`                 // Storage parameters, "name=value"
+	Comment        string        `json:"comment,omitempty" yaml:"comment,omitempty"`
+	Columns        []*Column     `json:"columns" yaml:"columns"`
+	Constraints    []*Constraint `json:"constraints" yaml:"constraints"`
+	Indexes        []*Index      `json:"indexes" yaml:"indexes"`
+	Triggers       []*Trigger    `json:"triggers" yaml:"triggers"`
+}
+
+// Identity columns
+const (
+	IdentityAlways    = "always"
+	IdentityByDefault = "by default"
+)
+
+// Column is a column of a table or view, or an attribute of a composite type
+type Column struct {
+	Name      string `json:"name" yaml:"name"`
+	Position  int    `json:"position" yaml:"position"` // attnum; dropped columns leave gaps
+	Type      string `json:"type" yaml:"type"`         // With its modifiers: "character varying(255)"
+	NotNull   bool   `json:"not_null,omitempty" yaml:"not_null,omitempty"`
+	Default   string `json:"default,omitempty" yaml:"default,omitempty"`
+	Identity  string `json:"identity,omitempty" yaml:"identity,omitempty"`   // IdentityAlways or IdentityByDefault
+	Generated string `json:"generated,omitempty" yaml:"generated,omitempty"` // Expression of a stored generated column
+	Collation string `json:"collation,omitempty" yaml:"collation,omitempty"` // When it isn't the type's
+	Comment   string `json:"comment,omitempty" yaml:"comment,omitempty"`
+}
+
+// Types of constraints
+const (
+	ConstraintPrimaryKey = "primary key"
+	ConstraintUnique     = "unique"
+	ConstraintForeignKey = "foreign key"
+	ConstraintCheck      = "check"
+	ConstraintExclusion  = "exclusion"
+	ConstraintNotNull    = "not null"
+	ConstraintTrigger    = "trigger"
+)
+
+// Constraint is a constraint of a table or domain
+type Constraint struct {
+	Name              string     `json:"name" yaml:"name"`
+	Type              string     `json:"type" yaml:"type"` // One of the Constraint constants
+	Columns           []string   `json:"columns,omitempty" yaml:"columns,omitempty"`
+	References        *ObjectRef `json:"references,omitempty" yaml:"references,omitempty"` // Table and columns of a foreign key
+	Definition        string     `json:"definition" yaml:"definition"`                     // As pg_get_constraintdef gives it
+	Validated         bool       `json:"validated" yaml:"validated"`                       // False for NOT VALID
+	Deferrable        bool       `json:"deferrable,omitempty" yaml:"deferrable,omitempty"`
+	InitiallyDeferred bool       `json:"initially_deferred,omitempty" yaml:"initially_deferred,omitempty"`
+	Comment           string     `json:"comment,omitempty" yaml:"comment,omitempty"`
+}
+
+// Index is an index of a table or materialized view, including those backing
+// primary key, unique and exclusion constraints
+type Index struct {
+	Name       string `json:"name" yaml:"name"`
+	Method     string `json:"method" yaml:"method"` // btree, gin, ...
+	Unique     bool   `json:"unique,omitempty" yaml:"unique,omitempty"`
+	Primary    bool   `json:"primary,omitempty" yaml:"primary,omitempty"`
+	Valid      bool   `json:"valid" yaml:"valid"` // False for a failed CREATE INDEX CONCURRENTLY
+	Definition string `json:"definition" yaml:"definition"`
+	Comment    string `json:"comment,omitempty" yaml:"comment,omitempty"`
+}
+
+// TriggerModes names the firing modes of pg_trigger.tgenabled
+var TriggerModes = map[string]string{
+	"O": "origin",
+	"D": "disabled",
+	"R": "replica",
+	"A": "always",
+}
+
+// Trigger is a user trigger of a table or view
+type Trigger struct {
+	Name       string `json:"name" yaml:"name"`
+	Enabled    string `json:"enabled" yaml:"enabled"` // A value of TriggerModes
+	Definition string `json:"definition" yaml:"definition"`
+	Comment    string `json:"comment,omitempty" yaml:"comment,omitempty"`
+}
+
+// View is a view or materialized view
+type View struct {
+	Name         string     `json:"name" yaml:"name"`
+	Materialized bool       `json:"materialized,omitempty" yaml:"materialized,omitempty"`
+	Owner        string     `json:"owner" yaml:"owner"`
+	Definition   string     `json:"definition" yaml:"definition"`
+	Options      []string   `json:"options,omitempty" yaml:"options,omitempty"`
+	Comment      string     `json:"comment,omitempty" yaml:"comment,omitempty"`
+	Columns      []*Column  `json:"columns" yaml:"columns"`
+	Indexes      []*Index   `json:"indexes,omitempty" yaml:"indexes,omitempty"`   // Of a materialized view
+	Triggers     []*Trigger `json:"triggers,omitempty" yaml:"triggers,omitempty"` // INSTEAD OF triggers
+}
+
+// Sequence is a sequence other than the one behind an identity column, which
+// is part of its column
+type Sequence struct {
+	Name      string     `json:"name" yaml:"name"`
+	Owner     string     `json:"owner" yaml:"owner"`
+	Type      string     `json:"type" yaml:"type"`
+	Start     int64      `json:"start" yaml:"start"`
+	Increment int64      `json:"increment" yaml:"increment"`
+	Min       int64      `json:"min" yaml:"min"`
+	Max       int64      `json:"max" yaml:"max"`
+	Cache     int64      `json:"cache" yaml:"cache"`
+	Cycle     bool       `json:"cycle,omitempty" yaml:"cycle,omitempty"`
+	OwnedBy   *ObjectRef `json:"owned_by,omitempty" yaml:"owned_by,omitempty"` // Column of OWNED BY, such as a serial's
+	Comment   string     `json:"comment,omitempty" yaml:"comment,omitempty"`
+}
+
+// Kinds of functions
+const (
+	FunctionNormal    = "function"
+	FunctionProcedure = "procedure"
+	FunctionAggregate = "aggregate"
+	FunctionWindow    = "window"
+)
+
+// Function is a function, procedure or aggregate. Overloads are told apart
+// by their argument types.
+type Function struct {
+	Name          string `json:"name" yaml:"name"`
+	Kind          string `json:"kind" yaml:"kind"`                     // One of the Function constants
+	Arguments     string `json:"arguments" yaml:"arguments"`           // With names and defaults: "a integer, b text DEFAULT ''::text"
+	ArgumentTypes string `json:"argument_types" yaml:"argument_types"` // Input types only, identifying it: "integer, text"
+	Result        string `json:"result,omitempty" yaml:"result,omitempty"`
+	Language      string `json:"language" yaml:"language"`
+	Volatility    string `json:"volatility,omitempty" yaml:"volatility,omitempty"` // immutable, stable or volatile
+	Owner         string `json:"owner" yaml:"owner"`
+	Definition    string `json:"definition,omitempty" yaml:"definition,omitempty"` // CREATE OR REPLACE statement; none for aggregates
+	Comment       string `json:"comment,omitempty" yaml:"comment,omitempty"`
+}
+
+// Kinds of types
+const (
+	TypeEnum      = "enum"
+	TypeDomain    = "domain"
+	TypeComposite = "composite"
+	TypeRange     = "range"
+)
+
+// Type is a user-defined enum, domain, composite or range type
+type Type struct {
+	Name        string        `json:"name" yaml:"name"`
+	Kind        string        `json:"kind" yaml:"kind"` // One of the Type constants
+	Owner       string        `json:"owner" yaml:"owner"`
+	Labels      []string      `json:"labels,omitempty" yaml:"labels,omitempty"`       // Of an enum, in order
+	BaseType    string        `json:"base_type,omitempty" yaml:"base_type,omitempty"` // Of a domain
+	NotNull     bool          `json:"not_null,omitempty" yaml:"not_null,omitempty"`
+	Default     string        `json:"default,omitempty" yaml:"default,omitempty"`
+	Constraints []*Constraint `json:"constraints,omitempty" yaml:"constraints,omitempty"` // Of a domain
+	Attributes  []*Column     `json:"attributes,omitempty" yaml:"attributes,omitempty"`   // Of a composite type
+	Subtype     string        `json:"subtype,omitempty" yaml:"subtype,omitempty"`         // Of a range
+	Comment     string        `json:"comment,omitempty" yaml:"comment,omitempty"`
+}
+
+// ObjectRef refers to a table, or to columns of one
+type ObjectRef struct {
+	Schema  string   `json:"schema" yaml:"schema"`
+	Name    string   `json:"name" yaml:"name"`
+	Columns []string `json:"columns,omitempty" yaml:"columns,omitempty"`
+}
+
+// Schema returns the schema named name, or nil
+func (c *Catalog) Schema(name string) *Schema {
+	for _, s := range c.Schemas {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
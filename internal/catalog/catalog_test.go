@@ -0,0 +1,264 @@
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var update = flag.Bool("update", false, "rewrite the documents of testdata")
+
+// sample is a catalog as Read returns it, with one of each kind of object
+func sample() *Catalog {
+	return &Catalog{
+		Version:       Version,
+		Database:      "shop",
+		ServerVersion: "17.6",
+		ReadAt:        time.Date(2026, 10, 17, 9, 30, 0, 0, time.UTC),
+		Schemas: []*Schema{
+			{
+				Name: "Billing", Owner: "app", Comment: "Invoices",
+				Tables: []*Table{
+					{
+						Name: "invoices", Kind: KindPartitionedTable, Owner: "app", PartitionKey: "RANGE (issued)",
+						Columns: []*Column{
+							{Name: "id", Position: 1, Type: "bigint", NotNull: true, Identity: IdentityAlways},
+							{Name: "issued", Position: 2, Type: "date", NotNull: true, Default: "CURRENT_DATE"},
+							{Name: "net", Position: 4, Type: "numeric(12,2)", NotNull: true},
+							{Name: "gross", Position: 5, Type: "numeric", Generated: "(net * 1.2)"},
+							{Name: "customer", Position: 6, Type: "text", Collation: "C", Comment: "As printed"},
+						},
+						Constraints: []*Constraint{
+							{Name: "invoices_customer_fkey", Type: ConstraintForeignKey, Columns: []string{"customer"},
+								References: &ObjectRef{Schema: "public", Name: "customers", Columns: []string{"name"}},
+								Definition: "FOREIGN KEY (customer) REFERENCES public.customers(name)", Validated: false, Deferrable: true, InitiallyDeferred: true},
+							{Name: "invoices_pkey", Type: ConstraintPrimaryKey, Columns: []string{"id", "issued"}, Definition: "PRIMARY KEY (id, issued)", Validated: true},
+						},
+						Indexes: []*Index{
+							{Name: "invoices_pkey", Method: "btree", Unique: true, Primary: true, Valid: true, Definition: `CREATE UNIQUE INDEX invoices_pkey ON ONLY "Billing".invoices USING btree (id, issued)`},
+						},
+						Triggers: []*Trigger{},
+					},
+					{
+						Name: "invoices_2026", Kind: KindTable, Owner: "app", Unlogged: true,
+						PartitionOf:    &ObjectRef{Schema: "Billing", Name: "invoices"},
+						PartitionBound: "FOR VALUES FROM ('2026-01-01') TO ('2027-01-01')",
+						Options:        []string{"fillfactor=70"},
+						Columns:        []*Column{}, Constraints: []*Constraint{}, Indexes: []*Index{},
+						Triggers: []*Trigger{
+							{Name: "audit", Enabled: TriggerModes["D"], Definition: `CREATE TRIGGER audit AFTER INSERT ON "Billing".invoices_2026 FOR EACH ROW EXECUTE FUNCTION "Billing".audit()`},
+						},
+					},
+				},
+				Views: []*View{
+					{Name: "totals", Materialized: true, Owner: "app", Definition: " SELECT sum(net) AS net\n   FROM \"Billing\".invoices;",
+						Columns: []*Column{{Name: "net", Position: 1, Type: "numeric"}}},
+				},
+				Sequences: []*Sequence{
+					{Name: "invoice_numbers", Owner: "app", Type: "integer", Start: 1000, Increment: 1, Min: 1, Max: 2147483647, Cache: 1, Cycle: true,
+						OwnedBy: &ObjectRef{Schema: "Billing", Name: "invoices", Columns: []string{"id"}}},
+				},
+				Functions: []*Function{
+					{Name: "audit", Kind: FunctionNormal, Result: "trigger", Language: "plpgsql", Volatility: "volatile", Owner: "app",
+						Definition: "CREATE OR REPLACE FUNCTION \"Billing\".audit()\n RETURNS trigger\n LANGUAGE plpgsql\nAS $function$BEGIN RETURN NEW; END$function$\n"},
+					{Name: "close", Kind: FunctionProcedure, Arguments: "period date", ArgumentTypes: "date", Language: "sql", Owner: "app",
+						Definition: "CREATE OR REPLACE PROCEDURE \"Billing\".close(period date)\n LANGUAGE sql\nAS $procedure$SELECT 1$procedure$\n"},
+				},
+				Types: []*Type{
+					{Name: "status", Kind: TypeEnum, Owner: "app", Labels: []string{"draft", "sent", "paid"}},
+					{Name: "positive", Kind: TypeDomain, Owner: "app", BaseType: "numeric", NotNull: true,
+						Constraints: []*Constraint{{Name: "positive_check", Type: ConstraintCheck, Definition: "CHECK ((VALUE > (0)::numeric))", Validated: true}}},
+				},
+			},
+			{
+				Name: "public", Owner: "pg_database_owner",
+				Tables: []*Table{}, Views: []*View{}, Sequences: []*Sequence{}, Functions: []*Function{}, Types: []*Type{},
+			},
+		},
+	}
+}
+
+func TestWrite(t *testing.T) {
+	for _, format := range []string{FormatJSON, FormatYAML} {
+		var b bytes.Buffer
+		if err := Write(&b, sample(), format); err != nil {
+			t.Fatal(err)
+		}
+		golden := filepath.Join("testdata", "catalog."+format)
+		if *update {
+			if err := os.WriteFile(golden, b.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("%v (run go test -update to create it)", err)
+		}
+		if b.String() != string(want) {
+			t.Errorf("%s document differs from %s; run go test -update and review the diff:\n%s", format, golden, b.String())
+		}
+
+		// The same catalog gives the same bytes
+		var again bytes.Buffer
+		if err := Write(&again, sample(), format); err != nil || again.String() != b.String() {
+			t.Errorf("%s: writing the catalog again gives another document: %v", format, err)
+		}
+	}
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	for format, unmarshal := range map[string]func([]byte, any) error{
+		FormatJSON: json.Unmarshal,
+		FormatYAML: yaml.Unmarshal,
+	} {
+		var b bytes.Buffer
+		if err := Write(&b, sample(), format); err != nil {
+			t.Fatal(err)
+		}
+		var read Catalog
+		if err := unmarshal(b.Bytes(), &read); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if read.Version != Version {
+			t.Errorf("%s: version %d, want %d", format, read.Version, Version)
+		}
+		if !reflect.DeepEqual(&read, sample()) {
+			t.Errorf("%s: the document reads back as another catalog", format)
+		}
+	}
+}
+
+func TestWriteFields(t *testing.T) {
+	var b bytes.Buffer
+	if err := Write(&b, sample(), FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	doc := b.String()
+
+	// The format version leads the document, so readers can check it first
+	if !strings.HasPrefix(doc, "{\n  \"version\": 1,\n") {
+		t.Errorf("document starts %q", doc[:min(len(doc), 40)])
+	}
+	// Lists without entries are empty, not null, and false or empty
+	// optional fields are left out
+	if !strings.Contains(doc, `"tables": [],`) || strings.Contains(doc, ": null") {
+		t.Error("empty lists not written as []")
+	}
+	for _, field := range []string{`"unlogged": false`, `"cycle": false`, `"comment": ""`, `"identity": ""`, `"options"`} {
+		if strings.Count(doc, field) != strings.Count(doc, field+": [\n") {
+			t.Errorf("%s written", field)
+		}
+	}
+	if n := strings.Count(doc, `"partition_of"`); n != 1 {
+		t.Errorf("partition_of written %d times, want once", n)
+	}
+}
+
+func TestWriteInvalidFormat(t *testing.T) {
+	var b bytes.Buffer
+	err := Write(&b, sample(), "xml")
+	if err == nil || !strings.Contains(err.Error(), `invalid format "xml"`) {
+		t.Errorf("%v, want an invalid format error", err)
+	}
+	if b.Len() > 0 {
+		t.Errorf("wrote %q", b.String())
+	}
+}
+
+func TestQuoteIdent(t *testing.T) {
+	for name, want := range map[string]string{
+		"orders":      "orders",
+		"_tmp2":       "_tmp2",
+		"order_lines": "order_lines",
+		"Orders":      `"Orders"`,
+		"2fa":         `"2fa"`,
+		"line items":  `"line items"`,
+		"price$":      `"price$"`,
+		`say"hi"`:     `"say""hi"""`,
+		"café":        `"café"`,
+		"":            `""`,
+
+		// Reserved, type or function name, and column name keywords are
+		// quoted; unreserved ones aren't
+		"user":         `"user"`,
+		"order":        `"order"`,
+		"left":         `"left"`,
+		"integer":      `"integer"`,
+		"values":       `"values"`,
+		"system_user":  `"system_user"`,
+		"merge_action": `"merge_action"`,
+		"name":         "name",
+		"action":       "action",
+		"comment":      "comment",
+		"data":         "data",
+	} {
+		if got := QuoteIdent(name); got != want {
+			t.Errorf("QuoteIdent(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestQualifiedName(t *testing.T) {
+	for _, test := range []struct{ schema, name, want string }{
+		{"public", "orders", "public.orders"},
+		{"Billing", "invoices", `"Billing".invoices`},
+		{"public", "user", `public."user"`},
+		{"a.b", "c", `"a.b".c`},
+	} {
+		if got := QualifiedName(test.schema, test.name); got != test.want {
+			t.Errorf("QualifiedName(%q, %q) = %s, want %s", test.schema, test.name, got, test.want)
+		}
+	}
+}
+
+func TestOptionsSelects(t *testing.T) {
+	for _, test := range []struct {
+		options  Options
+		selected []string
+		left     []string
+	}{
+		{Options{}, []string{"public", "app", "Billing"}, nil},
+		{Options{Schemas: []string{"app"}}, []string{"app"}, []string{"app_old", "apps", "public"}},
+		{Options{Schemas: []string{"tenant_*"}}, []string{"tenant_", "tenant_42"}, []string{"tenant", "old_tenant_1"}},
+		{Options{Schemas: []string{"v?"}}, []string{"v1", "v2"}, []string{"v", "v10"}},
+		{Options{Schemas: []string{"[ab]*"}}, []string{"app", "billing"}, []string{"Billing", "crm"}},
+		{Options{Schemas: []string{"public", "app"}}, []string{"public", "app"}, []string{"crm"}},
+		{Options{ExcludeSchemas: []string{"*_old", "audit"}}, []string{"public", "old"}, []string{"app_old", "audit"}},
+		// Excluding wins over selecting
+		{Options{Schemas: []string{"tenant_*"}, ExcludeSchemas: []string{"tenant_test*"}}, []string{"tenant_1"}, []string{"tenant_test", "tenant_test2"}},
+	} {
+		for _, name := range test.selected {
+			if !test.options.selects(name) {
+				t.Errorf("%+v leaves out %s", test.options, name)
+			}
+		}
+		for _, name := range test.left {
+			if test.options.selects(name) {
+				t.Errorf("%+v selects %s", test.options, name)
+			}
+		}
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	if err := (Options{Schemas: []string{"app_*", "v?"}, ExcludeSchemas: []string{"[ab]*"}}).Validate(); err != nil {
+		t.Error(err)
+	}
+	for _, options := range []Options{
+		{Schemas: []string{"app", "[app"}},
+		{ExcludeSchemas: []string{`app\`}},
+	} {
+		if err := options.Validate(); err == nil || !strings.Contains(err.Error(), "invalid schema pattern") {
+			t.Errorf("%+v: %v, want an invalid pattern error", options, err)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of the documents Write produces
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+)
+
+// Write writes c to w as a JSON or YAML document
+func Write(w io.Writer, c *Catalog, format string) error {
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(c)
+	case FormatYAML:
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(c); err != nil {
+			return err
+		}
+		return encoder.Close()
+	}
+	return fmt.Errorf("invalid format %q, must be '%s' or '%s'", format, FormatJSON, FormatYAML)
+}
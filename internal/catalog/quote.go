@@ -0,0 +1,53 @@
+package catalog
+
+import (
+	"regexp"
+	"strings"
+)
+
+// plainIdent is a name quote_ident leaves unquoted, unless it is a keyword.
+// A $ is quoted, though the parser takes it unquoted after the first letter.
+var plainIdent = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// keywords are the keywords of PostgreSQL that can't be used as a name
+// unquoted everywhere: the reserved, type or function name, and column name
+// ones. Unreserved keywords need no quotes, as quote_ident has it.
+var keywords = map[string]bool{}
+
+func init() {
+	for _, word := range strings.Fields(`
+		all analyse analyze and any array as asc asymmetric both case cast check collate column
+		constraint create current_catalog current_date current_role current_time current_timestamp
+		current_user default deferrable desc distinct do else end except false fetch for foreign from
+		grant group having in initially intersect into lateral leading limit localtime localtimestamp
+		not null offset on only or order placing primary references returning select session_user
+		some symmetric system_user table then to trailing true union unique user using variadic when
+		where window with
+
+		authorization binary collation concurrently cross current_schema freeze full ilike inner is
+		isnull join left like natural notnull outer overlaps right similar tablesample verbose
+
+		between bigint bit boolean char character coalesce dec decimal exists extract float greatest
+		grouping inout int integer interval json json_array json_arrayagg json_exists json_object
+		json_objectagg json_query json_scalar json_serialize json_table json_value least merge_action
+		national nchar none normalize nullif numeric out overlay position precision real row setof
+		smallint substring time timestamp treat trim values varchar xmlattributes xmlconcat xmlelement
+		xmlexists xmlforest xmlnamespaces xmlparse xmlpi xmlroot xmlserialize xmltable`) {
+		keywords[word] = true
+	}
+}
+
+// QuoteIdent quotes a name for SQL the way quote_ident does: only when it
+// needs quotes, so names read back from the catalogs match what pg_dump and
+// the server print
+func QuoteIdent(name string) string {
+	if plainIdent.MatchString(name) && !keywords[name] {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// QualifiedName quotes and qualifies the name of an object in a schema
+func QualifiedName(schema, name string) string {
+	return QuoteIdent(schema) + "." + QuoteIdent(name)
+}
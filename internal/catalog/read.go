@@ -0,0 +1,473 @@
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Querier runs the catalog queries: a *sql.DB, *sql.Conn or *sql.Tx
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// Options selects the schemas Read describes. Patterns are matched against
+// the whole name with path.Match: * and ? are wildcards.
+type Options struct {
+	Schemas        []string // Only schemas matching one of these; all when empty
+	ExcludeSchemas []string // Never schemas matching one of these
+}
+
+// selects reports whether the schema named name is described
+func (o Options) selects(name string) bool {
+	for _, pattern := range o.ExcludeSchemas {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(o.Schemas) == 0 {
+		return true
+	}
+	for _, pattern := range o.Schemas {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the patterns of o
+func (o Options) Validate() error {
+	for _, pattern := range append(append([]string{}, o.Schemas...), o.ExcludeSchemas...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid schema pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// userSchemas leaves out the system schemas
+const userSchemas = `n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname !~ '^pg_(toast|temp)'`
+
+// notExtensionMember leaves out the objects of extensions
+const notExtensionMember = `NOT EXISTS (SELECT 1 FROM pg_depend e WHERE e.classid = '%s'::regclass AND e.objid = %s AND e.deptype = 'e')`
+
+// generatedColumnsVersion is the first server version (server_version_num)
+// with generated columns
+const generatedColumnsVersion = 120000
+
+// reader holds what Read has read so far, by OID
+type reader struct {
+	ctx     context.Context
+	db      Querier
+	version int
+
+	schemas   map[uint32]*Schema
+	tables    map[uint32]*Table
+	views     map[uint32]*View
+	composite map[uint32]*Type // By the OID of the type's relation
+	types     map[uint32]*Type
+}
+
+// Read describes the schemas of the database db is connected to that opts
+// selects. It needs no privileges beyond connecting.
+func Read(ctx context.Context, db Querier, opts Options) (*Catalog, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	c := &Catalog{Version: Version, ReadAt: time.Now().UTC()}
+	r := &reader{ctx: ctx, db: db,
+		schemas: make(map[uint32]*Schema), tables: make(map[uint32]*Table), views: make(map[uint32]*View),
+		composite: make(map[uint32]*Type), types: make(map[uint32]*Type)}
+
+	err := r.each(`SELECT current_database(), current_setting('server_version'), current_setting('server_version_num')::int`, func(rows *sql.Rows) error {
+		return rows.Scan(&c.Database, &c.ServerVersion, &r.version)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, step := range []struct {
+		what string
+		read func() error
+	}{
+		{"schemas", func() error { return r.readSchemas(c, opts) }},
+		{"relations", r.readRelations},
+		{"types", r.readTypes},
+		{"columns", r.readColumns},
+		{"constraints", r.readConstraints},
+		{"indexes", r.readIndexes},
+		{"triggers", r.readTriggers},
+		{"sequences", r.readSequences},
+		{"functions", r.readFunctions},
+	} {
+		if err := step.read(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", step.what, err)
+		}
+	}
+	return c, nil
+}
+
+// each runs query and calls scan for every row
+func (r *reader) each(query string, scan func(*sql.Rows) error) error {
+	rows, err := r.db.QueryContext(r.ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (r *reader) readSchemas(c *Catalog, opts Options) error {
+	c.Schemas = []*Schema{}
+	return r.each(`
+		SELECT n.oid, n.nspname, pg_get_userbyid(n.nspowner), COALESCE(obj_description(n.oid, 'pg_namespace'), '')
+		FROM pg_namespace n
+		WHERE `+userSchemas+` AND `+fmt.Sprintf(notExtensionMember, "pg_namespace", "n.oid")+`
+		ORDER BY n.nspname`, func(rows *sql.Rows) error {
+		var oid uint32
+		s := &Schema{Tables: []*Table{}, Views: []*View{}, Sequences: []*Sequence{}, Functions: []*Function{}, Types: []*Type{}}
+		if err := rows.Scan(&oid, &s.Name, &s.Owner, &s.Comment); err != nil {
+			return err
+		}
+		if opts.selects(s.Name) {
+			r.schemas[oid] = s
+			c.Schemas = append(c.Schemas, s)
+		}
+		return nil
+	})
+}
+
+// readRelations reads the tables and views. Sequences are read with their
+// parameters by readSequences.
+func (r *reader) readRelations() error {
+	partitionKey, partitionBound := "''", "''"
+	if r.version >= 100000 {
+		partitionKey = `CASE WHEN c.relkind = 'p' THEN pg_get_partkeydef(c.oid) ELSE '' END`
+		partitionBound = `CASE WHEN c.relispartition THEN pg_get_expr(c.relpartbound, c.oid) ELSE '' END`
+	}
+	return r.each(`
+		SELECT c.oid, c.relnamespace, c.relname, c.relkind::text, pg_get_userbyid(c.relowner), c.relpersistence = 'u',
+		       COALESCE(c.reloptions, '{}'), COALESCE(obj_description(c.oid, 'pg_class'), ''),
+		       CASE WHEN c.relkind IN ('v', 'm') THEN pg_get_viewdef(c.oid) ELSE '' END,
+		       `+partitionKey+`, COALESCE(`+partitionBound+`, ''),
+		       COALESCE(pn.nspname, ''), COALESCE(p.relname, '')
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_inherits i ON i.inhrelid = c.oid AND `+partitionBound+` <> ''
+		LEFT JOIN pg_class p ON p.oid = i.inhparent
+		LEFT JOIN pg_namespace pn ON pn.oid = p.relnamespace
+		WHERE c.relkind IN ('r', 'p', 'f', 'v', 'm') AND `+userSchemas+` AND `+fmt.Sprintf(notExtensionMember, "pg_class", "c.oid")+`
+		ORDER BY c.relname`, func(rows *sql.Rows) error {
+		var oid, schemaOID uint32
+		var name, kind, owner, comment, definition, key, bound, parentSchema, parent string
+		var unlogged bool
+		var options []string
+		if err := rows.Scan(&oid, &schemaOID, &name, &kind, &owner, &unlogged, pq.Array(&options), &comment, &definition, &key, &bound, &parentSchema, &parent); err != nil {
+			return err
+		}
+		s := r.schemas[schemaOID]
+		if s == nil {
+			return nil
+		}
+		if kind == "v" || kind == "m" {
+			v := &View{Name: name, Materialized: kind == "m", Owner: owner, Definition: definition, Options: options, Comment: comment, Columns: []*Column{}}
+			r.views[oid] = v
+			s.Views = append(s.Views, v)
+			return nil
+		}
+		t := &Table{Name: name, Kind: KindTable, Owner: owner, Unlogged: unlogged, PartitionKey: key, PartitionBound: bound, Options: options, Comment: comment,
+			Columns: []*Column{}, Constraints: []*Constraint{}, Indexes: []*Index{}, Triggers: []*Trigger{}}
+		switch kind {
+		case "p":
+			t.Kind = KindPartitionedTable
+		case "f":
+			t.Kind = KindForeignTable
+		}
+		if parent != "" {
+			t.PartitionOf = &ObjectRef{Schema: parentSchema, Name: parent}
+		}
+		r.tables[oid] = t
+		s.Tables = append(s.Tables, t)
+		return nil
+	})
+}
+
+func (r *reader) readTypes() error {
+	return r.each(`
+		SELECT t.oid, t.typnamespace, t.typname, t.typtype::text, t.typrelid, pg_get_userbyid(t.typowner),
+		       COALESCE((SELECT array_agg(e.enumlabel::text ORDER BY e.enumsortorder) FROM pg_enum e WHERE e.enumtypid = t.oid), '{}'),
+		       CASE WHEN t.typtype = 'd' THEN format_type(t.typbasetype, t.typtypmod) ELSE '' END,
+		       t.typnotnull, COALESCE(t.typdefault, ''),
+		       COALESCE((SELECT format_type(rg.rngsubtype, NULL) FROM pg_range rg WHERE rg.rngtypid = t.oid), ''),
+		       COALESCE(obj_description(t.oid, 'pg_type'), '')
+		FROM pg_type t
+		JOIN pg_namespace n ON n.oid = t.typnamespace
+		WHERE t.typtype IN ('e', 'd', 'c', 'r')
+		  AND (t.typtype <> 'c' OR (SELECT c.relkind FROM pg_class c WHERE c.oid = t.typrelid) = 'c')
+		  AND `+userSchemas+` AND `+fmt.Sprintf(notExtensionMember, "pg_type", "t.oid")+`
+		ORDER BY t.typname`, func(rows *sql.Rows) error {
+		var oid, schemaOID, relOID uint32
+		var kind string
+		t := &Type{}
+		if err := rows.Scan(&oid, &schemaOID, &t.Name, &kind, &relOID, &t.Owner, pq.Array(&t.Labels), &t.BaseType, &t.NotNull, &t.Default, &t.Subtype, &t.Comment); err != nil {
+			return err
+		}
+		s := r.schemas[schemaOID]
+		if s == nil {
+			return nil
+		}
+		switch kind {
+		case "e":
+			t.Kind = TypeEnum
+		case "d":
+			t.Kind = TypeDomain
+		case "c":
+			t.Kind = TypeComposite
+			r.composite[relOID] = t
+		case "r":
+			t.Kind = TypeRange
+		}
+		r.types[oid] = t
+		s.Types = append(s.Types, t)
+		return nil
+	})
+}
+
+// readColumns reads the columns of tables and views and the attributes of
+// composite types
+func (r *reader) readColumns() error {
+	generated := "''"
+	if r.version >= generatedColumnsVersion {
+		generated = "a.attgenerated::text"
+	}
+	identity := "''"
+	if r.version >= 100000 {
+		identity = "a.attidentity::text"
+	}
+	return r.each(`
+		SELECT a.attrelid, a.attname, a.attnum, format_type(a.atttypid, a.atttypmod), a.attnotnull,
+		       COALESCE(pg_get_expr(d.adbin, d.adrelid), ''), `+identity+`, `+generated+`,
+		       COALESCE(CASE WHEN a.attcollation <> t.typcollation THEN (SELECT co.collname FROM pg_collation co WHERE co.oid = a.attcollation) END, ''),
+		       COALESCE(col_description(a.attrelid, a.attnum), '')
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_type t ON t.oid = a.atttypid
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE a.attnum > 0 AND NOT a.attisdropped AND c.relkind IN ('r', 'p', 'f', 'v', 'm', 'c') AND `+userSchemas+`
+		ORDER BY a.attrelid, a.attnum`, func(rows *sql.Rows) error {
+		var rel uint32
+		var identity, generated string
+		col := &Column{}
+		if err := rows.Scan(&rel, &col.Name, &col.Position, &col.Type, &col.NotNull, &col.Default, &identity, &generated, &col.Collation, &col.Comment); err != nil {
+			return err
+		}
+		switch identity {
+		case "a":
+			col.Identity = IdentityAlways
+		case "d":
+			col.Identity = IdentityByDefault
+		}
+		if generated == "s" {
+			col.Generated, col.Default = col.Default, ""
+		}
+		switch {
+		case r.tables[rel] != nil:
+			r.tables[rel].Columns = append(r.tables[rel].Columns, col)
+		case r.views[rel] != nil:
+			r.views[rel].Columns = append(r.views[rel].Columns, col)
+		case r.composite[rel] != nil:
+			r.composite[rel].Attributes = append(r.composite[rel].Attributes, col)
+		}
+		return nil
+	})
+}
+
+// constraintTypes names the values of pg_constraint.contype
+var constraintTypes = map[string]string{
+	"p": ConstraintPrimaryKey,
+	"u": ConstraintUnique,
+	"f": ConstraintForeignKey,
+	"c": ConstraintCheck,
+	"x": ConstraintExclusion,
+	"n": ConstraintNotNull,
+	"t": ConstraintTrigger,
+}
+
+// readConstraints reads the constraints of tables and domains
+func (r *reader) readConstraints() error {
+	return r.each(`
+		SELECT con.conrelid, con.contypid, con.conname, con.contype::text, pg_get_constraintdef(con.oid),
+		       con.convalidated, con.condeferrable, con.condeferred,
+		       COALESCE(ARRAY(SELECT a.attname::text FROM unnest(con.conkey) WITH ORDINALITY k(num, i)
+		                      JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.num ORDER BY k.i), '{}'),
+		       COALESCE(fn.nspname, ''), COALESCE(fc.relname, ''),
+		       COALESCE(ARRAY(SELECT a.attname::text FROM unnest(con.confkey) WITH ORDINALITY k(num, i)
+		                      JOIN pg_attribute a ON a.attrelid = con.confrelid AND a.attnum = k.num ORDER BY k.i), '{}'),
+		       COALESCE(obj_description(con.oid, 'pg_constraint'), '')
+		FROM pg_constraint con
+		JOIN pg_namespace n ON n.oid = con.connamespace
+		LEFT JOIN pg_class fc ON fc.oid = con.confrelid
+		LEFT JOIN pg_namespace fn ON fn.oid = fc.relnamespace
+		WHERE `+userSchemas+`
+		ORDER BY con.conname`, func(rows *sql.Rows) error {
+		var rel, domain uint32
+		var kind, refSchema, refTable string
+		var refColumns []string
+		con := &Constraint{}
+		if err := rows.Scan(&rel, &domain, &con.Name, &kind, &con.Definition, &con.Validated, &con.Deferrable, &con.InitiallyDeferred,
+			pq.Array(&con.Columns), &refSchema, &refTable, pq.Array(&refColumns), &con.Comment); err != nil {
+			return err
+		}
+		con.Type = constraintTypes[kind]
+		if refTable != "" {
+			con.References = &ObjectRef{Schema: refSchema, Name: refTable, Columns: refColumns}
+		}
+		switch {
+		case r.tables[rel] != nil:
+			r.tables[rel].Constraints = append(r.tables[rel].Constraints, con)
+		case domain != 0 && r.types[domain] != nil:
+			r.types[domain].Constraints = append(r.types[domain].Constraints, con)
+		}
+		return nil
+	})
+}
+
+// readIndexes reads the indexes of tables and materialized views
+func (r *reader) readIndexes() error {
+	return r.each(`
+		SELECT i.indrelid, ic.relname, am.amname, i.indisunique, i.indisprimary, i.indisvalid,
+		       pg_get_indexdef(i.indexrelid), COALESCE(obj_description(i.indexrelid, 'pg_class'), '')
+		FROM pg_index i
+		JOIN pg_class ic ON ic.oid = i.indexrelid
+		JOIN pg_am am ON am.oid = ic.relam
+		JOIN pg_namespace n ON n.oid = ic.relnamespace
+		WHERE `+userSchemas+`
+		ORDER BY ic.relname`, func(rows *sql.Rows) error {
+		var rel uint32
+		idx := &Index{}
+		if err := rows.Scan(&rel, &idx.Name, &idx.Method, &idx.Unique, &idx.Primary, &idx.Valid, &idx.Definition, &idx.Comment); err != nil {
+			return err
+		}
+		switch {
+		case r.tables[rel] != nil:
+			r.tables[rel].Indexes = append(r.tables[rel].Indexes, idx)
+		case r.views[rel] != nil:
+			r.views[rel].Indexes = append(r.views[rel].Indexes, idx)
+		}
+		return nil
+	})
+}
+
+// readTriggers reads the user triggers of tables and views
+func (r *reader) readTriggers() error {
+	return r.each(`
+		SELECT t.tgrelid, t.tgname, t.tgenabled::text, pg_get_triggerdef(t.oid), COALESCE(obj_description(t.oid, 'pg_trigger'), '')
+		FROM pg_trigger t
+		JOIN pg_class c ON c.oid = t.tgrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE NOT t.tgisinternal AND `+userSchemas+`
+		ORDER BY t.tgname`, func(rows *sql.Rows) error {
+		var rel uint32
+		var mode string
+		tg := &Trigger{}
+		if err := rows.Scan(&rel, &tg.Name, &mode, &tg.Definition, &tg.Comment); err != nil {
+			return err
+		}
+		tg.Enabled = TriggerModes[mode]
+		switch {
+		case r.tables[rel] != nil:
+			r.tables[rel].Triggers = append(r.tables[rel].Triggers, tg)
+		case r.views[rel] != nil:
+			r.views[rel].Triggers = append(r.views[rel].Triggers, tg)
+		}
+		return nil
+	})
+}
+
+// readSequences reads the sequences, leaving out those of identity columns
+func (r *reader) readSequences() error {
+	return r.each(`
+		SELECT c.relnamespace, c.relname, pg_get_userbyid(c.relowner), format_type(s.seqtypid, NULL),
+		       s.seqstart, s.seqincrement, s.seqmin, s.seqmax, s.seqcache, s.seqcycle,
+		       COALESCE(tn.nspname, ''), COALESCE(t.relname, ''), COALESCE(a.attname, ''),
+		       COALESCE(obj_description(c.oid, 'pg_class'), '')
+		FROM pg_sequence s
+		JOIN pg_class c ON c.oid = s.seqrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_depend d ON d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.refclassid = 'pg_class'::regclass AND d.deptype = 'a'
+		LEFT JOIN pg_class t ON t.oid = d.refobjid
+		LEFT JOIN pg_namespace tn ON tn.oid = t.relnamespace
+		LEFT JOIN pg_attribute a ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+		WHERE `+userSchemas+` AND `+fmt.Sprintf(notExtensionMember, "pg_class", "c.oid")+`
+		  AND NOT EXISTS (SELECT 1 FROM pg_depend i WHERE i.classid = 'pg_class'::regclass AND i.objid = c.oid AND i.deptype = 'i')
+		ORDER BY c.relname`, func(rows *sql.Rows) error {
+		var schemaOID uint32
+		var ownerSchema, ownerTable, ownerColumn string
+		seq := &Sequence{}
+		if err := rows.Scan(&schemaOID, &seq.Name, &seq.Owner, &seq.Type, &seq.Start, &seq.Increment, &seq.Min, &seq.Max, &seq.Cache, &seq.Cycle,
+			&ownerSchema, &ownerTable, &ownerColumn, &seq.Comment); err != nil {
+			return err
+		}
+		if ownerTable != "" {
+			seq.OwnedBy = &ObjectRef{Schema: ownerSchema, Name: ownerTable, Columns: []string{ownerColumn}}
+		}
+		if s := r.schemas[schemaOID]; s != nil {
+			s.Sequences = append(s.Sequences, seq)
+		}
+		return nil
+	})
+}
+
+// functionKinds names the values of pg_proc.prokind
+var functionKinds = map[string]string{
+	"f": FunctionNormal,
+	"p": FunctionProcedure,
+	"a": FunctionAggregate,
+	"w": FunctionWindow,
+}
+
+// volatilities names the values of pg_proc.provolatile
+var volatilities = map[string]string{
+	"i": "immutable",
+	"s": "stable",
+	"v": "volatile",
+}
+
+func (r *reader) readFunctions() error {
+	return r.each(`
+		SELECT p.pronamespace, p.proname, p.prokind::text, pg_get_function_arguments(p.oid), oidvectortypes(p.proargtypes),
+		       COALESCE(pg_get_function_result(p.oid), ''), l.lanname, p.provolatile::text, pg_get_userbyid(p.proowner),
+		       CASE WHEN p.prokind <> 'a' THEN pg_get_functiondef(p.oid) ELSE '' END,
+		       COALESCE(obj_description(p.oid, 'pg_proc'), '')
+		FROM pg_proc p
+		JOIN pg_namespace n ON n.oid = p.pronamespace
+		JOIN pg_language l ON l.oid = p.prolang
+		WHERE `+userSchemas+` AND `+fmt.Sprintf(notExtensionMember, "pg_proc", "p.oid")+`
+		ORDER BY p.proname, oidvectortypes(p.proargtypes)`, func(rows *sql.Rows) error {
+		var schemaOID uint32
+		var kind, volatility string
+		f := &Function{}
+		if err := rows.Scan(&schemaOID, &f.Name, &kind, &f.Arguments, &f.ArgumentTypes, &f.Result, &f.Language, &volatility, &f.Owner, &f.Definition, &f.Comment); err != nil {
+			return err
+		}
+		f.Kind = functionKinds[kind]
+		if f.Kind != FunctionProcedure {
+			f.Volatility = volatilities[volatility]
+		}
+		if s := r.schemas[schemaOID]; s != nil {
+			s.Functions = append(s.Functions, f)
+		}
+		return nil
+	})
+}
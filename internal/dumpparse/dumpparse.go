@@ -0,0 +1,524 @@
+// Package dumpparse splits a plain-format pg_dump file into the objects of its
+// table of contents, using the "-- Name: ...; Type: ...; Schema: ..." comment
+// pg_dump writes before each one.
+//
+// Parsing never changes the text: a Dump writes back byte for byte what was
+// parsed, and objects can be dropped or replaced without touching the others.
+// Headers are only recognized outside string literals, quoted identifiers,
+// dollar-quoted bodies, block comments and COPY data, so a function body or
+// a row that happens to look like a header doesn't split an object.
+package dumpparse
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Trailer is the comment pg_dump ends a plain-format dump with
+const Trailer = "-- PostgreSQL database dump complete"
+
+// headerPattern matches the second line of an object's header. Names may
+// contain "; ", so the name is everything up to the last "; Type: ".
+var headerPattern = regexp.MustCompile(`^-- (Data for )?Name: (.*); Type: ([^;]+); Schema: ([^;]+); Owner: ([^;]*)(?:; Tablespace: (.*))?$`)
+
+// copyPattern matches a COPY statement whose data follows it in the dump
+var copyPattern = regexp.MustCompile(`^COPY .* FROM stdin;$`)
+
+// dollarTagPattern matches a dollar-quote delimiter at the start of a string
+var dollarTagPattern = regexp.MustCompile(`^\$(?:[A-Za-z_\x80-\xff][A-Za-z_0-9\x80-\xff]*)?\$`)
+
+// Object is one table of contents entry of a dump
+type Object struct {
+	Name       string
+	Type       string // TOC type: TABLE, FUNCTION, FK CONSTRAINT, COMMENT, ...
+	Schema     string // "-" for objects outside schemas
+	Owner      string // "-" in dumps made with --no-owner
+	Tablespace string
+	Data       bool // A "Data for Name" entry, such as TABLE DATA with its COPY
+
+	// Text is the entry as written, from the "--" opening its header up to
+	// the next entry, including trailing blank lines and SET statements
+	// pg_dump emits between entries
+	Text string
+}
+
+// Header returns the three comment lines naming the object
+func (o *Object) Header() string {
+	end := 0
+	for range 3 {
+		i := strings.IndexByte(o.Text[end:], '\n')
+		if i < 0 {
+			return o.Text
+		}
+		end += i + 1
+	}
+	return o.Text[:end]
+}
+
+// Body returns the statements of the object, without its header
+func (o *Object) Body() string {
+	return o.Text[len(o.Header()):]
+}
+
+// Qualified returns "schema.name", or just the name outside schemas, unquoted
+func (o *Object) Qualified() string {
+	if o.Schema == "-" {
+		return o.Name
+	}
+	return o.Schema + "." + o.Name
+}
+
+func (o *Object) String() string {
+	return o.Type + " " + o.Qualified()
+}
+
+// Dump is a parsed plain-format dump
+type Dump struct {
+	Head    string // The preamble before the first object: SET statements and the like
+	Objects []*Object
+	Tail    string // From the trailer comment to the end
+}
+
+// Parse reads a plain-format dump
+func Parse(r io.Reader) (*Dump, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return ParseString(string(data)), nil
+}
+
+// ParseFile reads the plain-format dump at path
+func ParseFile(path string) (*Dump, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseString(string(data)), nil
+}
+
+// ParseString splits a plain-format dump held in memory. Anything is
+// accepted: text without headers is all Head.
+func ParseString(data string) *Dump {
+	dump := &Dump{}
+	var lex lexer
+	objectStart, tailStart := -1, -1
+	finish := func(end int) {
+		if objectStart >= 0 {
+			dump.Objects[len(dump.Objects)-1].Text = data[objectStart:end]
+		} else {
+			dump.Head = data[:end]
+		}
+	}
+
+	for pos := 0; pos < len(data); {
+		line, next := nextLine(data, pos)
+		if lex.atStatementLevel() && line == "--" && next < len(data) {
+			second, _ := nextLine(data, next)
+			if m := headerPattern.FindStringSubmatch(second); m != nil {
+				finish(pos)
+				dump.Objects = append(dump.Objects, &Object{
+					Data:       m[1] != "",
+					Name:       m[2],
+					Type:       m[3],
+					Schema:     m[4],
+					Owner:      m[5],
+					Tablespace: m[6],
+				})
+				objectStart = pos
+			} else if strings.HasPrefix(second, Trailer) {
+				tailStart = pos
+				break
+			}
+		}
+		lex.line(line)
+		pos = next
+	}
+
+	if tailStart < 0 {
+		tailStart = len(data)
+	}
+	finish(tailStart)
+	dump.Tail = data[tailStart:]
+	return dump
+}
+
+// Statement is one statement of a SQL script, or one psql meta-command
+type Statement struct {
+	Line int    // Where it starts, from 1
+	Text string // From its first token to its semicolon, without the comments before it
+}
+
+// Statements splits a SQL script into its statements at the semicolons
+// outside string literals, quoted identifiers, dollar-quoted bodies,
+// comments, parentheses and BEGIN ATOMIC bodies, as psql does, so a function
+// body or rule holding statements of its own stays one. A
+// line starting with a backslash between statements is a psql meta-command
+// of its own, and the rows following a COPY ... FROM stdin belong to none.
+func Statements(data string) []Statement {
+	var statements []Statement
+	var lex lexer
+	start, startLine := -1, 0
+	for pos, n := 0, 1; pos < len(data); n++ {
+		line, next := nextLine(data, pos)
+		trimmed := strings.TrimSpace(line)
+		if start < 0 && lex.atStatementLevel() && strings.HasPrefix(trimmed, `\`) {
+			statements = append(statements, Statement{Line: n, Text: trimmed})
+			pos = next
+			continue
+		}
+		inCopy := lex.state == stateCopyData
+
+		from := 0
+		for _, end := range lex.line(line) {
+			if start < 0 {
+				start, startLine = pos+from, n
+			}
+			statements = append(statements, Statement{Line: startLine, Text: strings.TrimSpace(data[start : pos+end+1])})
+			start, from = -1, end+1
+		}
+		if rest := strings.TrimSpace(line[from:]); start < 0 && !inCopy && rest != "" && !strings.HasPrefix(rest, "--") {
+			start, startLine = pos+from, n
+		}
+		pos = next
+	}
+	if start >= 0 {
+		if text := strings.TrimSpace(data[start:]); text != "" {
+			statements = append(statements, Statement{Line: startLine, Text: text})
+		}
+	}
+	return statements
+}
+
+// nextLine returns the line starting at pos without its line ending, and
+// where the following line starts
+func nextLine(data string, pos int) (string, int) {
+	end := strings.IndexByte(data[pos:], '\n')
+	if end < 0 {
+		return strings.TrimSuffix(data[pos:], "\r"), len(data)
+	}
+	return strings.TrimSuffix(data[pos:pos+end], "\r"), pos + end + 1
+}
+
+// Scanner reads a SQL script too large to hold in memory a piece at a time.
+// A piece ends at the end of a line where one or more statements have ended
+// and no other has started, outside literals, comments and COPY data, so
+// pieces can be run one after another. The rows of a COPY ... FROM stdin are
+// in the piece of the COPY. Statements are split as Statements splits them.
+type Scanner struct {
+	r      *bufio.Reader
+	lex    lexer
+	offset int64 // After the last line read
+	line   int   // Number of the next line
+
+	open       bool // A statement has started and not ended
+	startLine  int
+	text       strings.Builder // Of the open statement
+	statements []Statement     // Ended in the current piece
+	err        error
+}
+
+// NewScanner reads the script from r, which starts at byte offset and line
+// of the script, between two pieces
+func NewScanner(r io.Reader, offset int64, line int) *Scanner {
+	return &Scanner{r: bufio.NewReaderSize(r, 1<<20), offset: offset, line: line}
+}
+
+// Scan reads the next piece. It returns false at the end of the script, or
+// when reading fails; Err tells which.
+func (s *Scanner) Scan() bool {
+	s.statements = nil
+	for {
+		raw, err := s.r.ReadString('\n')
+		if raw == "" {
+			if err != io.EOF {
+				s.err = err
+				return false
+			}
+			// A last statement without a semicolon
+			if s.open {
+				s.open = false
+				if text := strings.TrimSpace(s.text.String()); text != "" {
+					s.statements = append(s.statements, Statement{Line: s.startLine, Text: text})
+				}
+				s.text.Reset()
+			}
+			return len(s.statements) > 0
+		}
+		s.offset += int64(len(raw))
+		n := s.line
+		s.line++
+
+		line := strings.TrimSuffix(strings.TrimSuffix(raw, "\n"), "\r")
+		trimmed := strings.TrimSpace(line)
+		if !s.open && s.lex.atStatementLevel() && strings.HasPrefix(trimmed, `\`) {
+			s.statements = append(s.statements, Statement{Line: n, Text: trimmed})
+		} else {
+			inCopy := s.lex.state == stateCopyData
+			from := 0
+			for _, end := range s.lex.line(line) {
+				if !s.open {
+					s.open, s.startLine = true, n
+				}
+				s.text.WriteString(line[from : end+1])
+				s.statements = append(s.statements, Statement{Line: s.startLine, Text: strings.TrimSpace(s.text.String())})
+				s.text.Reset()
+				s.open, from = false, end+1
+			}
+			if rest := strings.TrimSpace(line[from:]); !s.open && !inCopy && rest != "" && !strings.HasPrefix(rest, "--") {
+				s.open, s.startLine = true, n
+			}
+			if s.open {
+				s.text.WriteString(line[from:] + "\n")
+			}
+		}
+		if len(s.statements) > 0 && !s.open && s.lex.atStatementLevel() {
+			return true
+		}
+	}
+}
+
+// Statements returns the statements of the piece Scan read
+func (s *Scanner) Statements() []Statement {
+	return s.statements
+}
+
+// Offset returns the byte offset of the script after the piece Scan read
+func (s *Scanner) Offset() int64 {
+	return s.offset
+}
+
+// Line returns the number of the line after the piece Scan read
+func (s *Scanner) Line() int {
+	return s.line
+}
+
+// Err returns the error reading the script, if Scan stopped for one
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// WriteTo writes the dump as text
+func (d *Dump) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	write := func(s string) error {
+		n, err := io.WriteString(w, s)
+		written += int64(n)
+		return err
+	}
+	if err := write(d.Head); err != nil {
+		return written, err
+	}
+	for _, o := range d.Objects {
+		if err := write(o.Text); err != nil {
+			return written, err
+		}
+	}
+	return written, write(d.Tail)
+}
+
+// String returns the dump as text
+func (d *Dump) String() string {
+	var b strings.Builder
+	d.WriteTo(&b)
+	return b.String()
+}
+
+// Filter returns a dump with the objects keep returns true for. The objects
+// are shared, not copied.
+func (d *Dump) Filter(keep func(*Object) bool) *Dump {
+	filtered := &Dump{Head: d.Head, Tail: d.Tail}
+	for _, o := range d.Objects {
+		if keep(o) {
+			filtered.Objects = append(filtered.Objects, o)
+		}
+	}
+	return filtered
+}
+
+// Find returns the object of type named schema.name, or nil
+func (d *Dump) Find(typ, schema, name string) *Object {
+	for _, o := range d.Objects {
+		if o.Type == typ && o.Schema == schema && o.Name == name {
+			return o
+		}
+	}
+	return nil
+}
+
+// lexer states between lines
+const (
+	stateNormal = iota
+	stateString
+	stateEscapeString // E'...', where backslashes escape
+	stateIdentifier
+	stateDollar
+	stateBlockComment
+	stateCopyData
+)
+
+// lexer follows the SQL lexical state from line to line, far enough to tell
+// whether a line starts at statement level
+type lexer struct {
+	state     int
+	dollarTag string
+	depth     int // Nesting of block comments
+
+	// Within a statement, as psql follows it: a semicolon inside parentheses,
+	// as in a rule with several actions, or inside the BEGIN ATOMIC ... END
+	// body of a SQL-standard function doesn't end the statement
+	parens      int
+	begins      int // Open BEGIN, and CASE within one, of a CREATE FUNCTION or PROCEDURE
+	words       int // Identifiers of the statement so far
+	createsCode bool
+	leading     [4]byte // First letters of its first words, when create, or, replace, function or procedure
+}
+
+// atStatementLevel reports whether the next line starts outside any literal,
+// comment or COPY data
+func (l *lexer) atStatementLevel() bool {
+	return l.state == stateNormal
+}
+
+// line advances the state over one line, returning the offsets of the
+// semicolons ending statements on it
+func (l *lexer) line(line string) (ends []int) {
+	if l.state == stateCopyData {
+		if line == `\.` {
+			l.state = stateNormal
+		}
+		return nil
+	}
+	startedNormal := l.state == stateNormal
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch l.state {
+		case stateNormal:
+			switch {
+			case c == '-' && strings.HasPrefix(line[i:], "--"):
+				i = len(line)
+			case c == '/' && strings.HasPrefix(line[i:], "/*"):
+				l.state, l.depth = stateBlockComment, 1
+				i++
+			case c == '\'':
+				l.state = stateString
+				if i > 0 && (line[i-1] == 'E' || line[i-1] == 'e') && (i == 1 || !isIdentChar(line[i-2])) {
+					l.state = stateEscapeString
+				}
+			case c == '"':
+				l.state = stateIdentifier
+			case c == '$' && (i == 0 || !isIdentChar(line[i-1])):
+				if tag := dollarTagPattern.FindString(line[i:]); tag != "" {
+					l.state, l.dollarTag = stateDollar, tag
+					i += len(tag) - 1
+				}
+			case c == '(':
+				l.parens++
+			case c == ')' && l.parens > 0:
+				l.parens--
+			case c == ';' && l.parens == 0 && l.begins == 0:
+				ends = append(ends, i)
+				l.parens, l.begins, l.words, l.createsCode = 0, 0, 0, false
+			case isIdentStart(c) && (i == 0 || !isIdentChar(line[i-1])):
+				end := i + 1
+				for end < len(line) && isIdentChar(line[end]) {
+					end++
+				}
+				l.word(strings.ToLower(line[i:end]))
+				i = end - 1
+			}
+		case stateString:
+			if c == '\'' {
+				if i+1 < len(line) && line[i+1] == '\'' {
+					i++
+				} else {
+					l.state = stateNormal
+				}
+			}
+		case stateEscapeString:
+			switch {
+			case c == '\\':
+				i++
+			case c == '\'' && i+1 < len(line) && line[i+1] == '\'':
+				i++
+			case c == '\'':
+				l.state = stateNormal
+			}
+		case stateIdentifier:
+			if c == '"' {
+				if i+1 < len(line) && line[i+1] == '"' {
+					i++
+				} else {
+					l.state = stateNormal
+				}
+			}
+		case stateDollar:
+			if c == '$' && strings.HasPrefix(line[i:], l.dollarTag) {
+				i += len(l.dollarTag) - 1
+				l.state = stateNormal
+			}
+		case stateBlockComment:
+			switch {
+			case c == '/' && strings.HasPrefix(line[i:], "/*"):
+				l.depth++
+				i++
+			case c == '*' && strings.HasPrefix(line[i:], "*/"):
+				l.depth--
+				i++
+				if l.depth == 0 {
+					l.state = stateNormal
+				}
+			}
+		}
+	}
+
+	// The rows of a COPY ... FROM stdin follow it up to a line "\."
+	if startedNormal && l.state == stateNormal && copyPattern.MatchString(line) {
+		l.state = stateCopyData
+	}
+	return ends
+}
+
+// word follows an identifier or keyword at statement level the way psql does
+// to find the BEGIN ATOMIC body of a CREATE [OR REPLACE] FUNCTION or
+// PROCEDURE, where CASE ... END nests too
+func (l *lexer) word(word string) {
+	if l.words == 0 {
+		l.leading = [4]byte{}
+	}
+	if l.words < len(l.leading) {
+		switch word {
+		case "create", "or", "replace", "function", "procedure":
+			l.leading[l.words] = word[0]
+		}
+	}
+	l.words++
+	if l.words <= 4 {
+		first := l.leading
+		l.createsCode = first[0] == 'c' && (first[1] == 'f' || first[1] == 'p' ||
+			first[1] == 'o' && first[2] == 'r' && (first[3] == 'f' || first[3] == 'p'))
+	}
+	if !l.createsCode || l.parens > 0 {
+		return
+	}
+	switch {
+	case word == "begin":
+		l.begins++
+	case word == "case" && l.begins > 0:
+		l.begins++
+	case word == "end" && l.begins > 0:
+		l.begins--
+	}
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
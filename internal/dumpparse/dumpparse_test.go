@@ -0,0 +1,267 @@
+package dumpparse
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the .golden files of testdata")
+
+// fixtures returns the SQL files of testdata: dumps of servers 12 to 17 and
+// a script of lexical corner cases
+func fixtures(t *testing.T) map[string]string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no fixtures in testdata")
+	}
+	files := make(map[string]string)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[path] = string(data)
+	}
+	return files
+}
+
+// describe lists the objects and statements found in a fixture, one per
+// line, for its golden file
+func describe(data string) string {
+	var b strings.Builder
+	b.WriteString("# objects\n")
+	for _, o := range ParseString(data).Objects {
+		fmt.Fprintf(&b, "%s (data %v, owner %s, tablespace %q)\n", o, o.Data, o.Owner, o.Tablespace)
+	}
+	b.WriteString("# statements\n")
+	for _, s := range Statements(data) {
+		fmt.Fprintf(&b, "%d %q\n", s.Line, s.Text)
+	}
+	return b.String()
+}
+
+func TestGolden(t *testing.T) {
+	for path, data := range fixtures(t) {
+		golden := strings.TrimSuffix(path, ".sql") + ".golden"
+		got := describe(data)
+		if *update {
+			if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("%v (run go test -update to create it)", err)
+		}
+		if got != string(want) {
+			t.Errorf("%s differs from %s; run go test -update and review the diff:\n%s", path, golden, got)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for path, data := range fixtures(t) {
+		dump := ParseString(data)
+		if got := dump.String(); got != data {
+			t.Errorf("%s: String() does not round-trip", path)
+		}
+
+		var b bytes.Buffer
+		n, err := dump.WriteTo(&b)
+		if err != nil || n != int64(len(data)) || b.String() != data {
+			t.Errorf("%s: WriteTo wrote %d of %d bytes, err %v", path, n, len(data), err)
+		}
+
+		read, err := Parse(strings.NewReader(data))
+		if err != nil || read.String() != data {
+			t.Errorf("%s: Parse does not round-trip: %v", path, err)
+		}
+		fromFile, err := ParseFile(path)
+		if err != nil || fromFile.String() != data {
+			t.Errorf("%s: ParseFile does not round-trip: %v", path, err)
+		}
+
+		if kept := dump.Filter(func(*Object) bool { return true }); kept.String() != data {
+			t.Errorf("%s: keeping every object changes the dump", path)
+		}
+		// Dropping an object leaves the text around it as it was
+		for i, o := range dump.Objects {
+			dropped := dump.Filter(func(other *Object) bool { return other != o })
+			if want := strings.Replace(data, o.Text, "", 1); dropped.String() != want {
+				t.Errorf("%s: dropping object %d, %s, changes the rest of the dump", path, i, o)
+			}
+		}
+	}
+}
+
+func TestDumpObjects(t *testing.T) {
+	for path, data := range fixtures(t) {
+		if !strings.Contains(filepath.Base(path), "pg") {
+			continue
+		}
+		dump := ParseString(data)
+		if !strings.HasPrefix(dump.Head, "--\n-- PostgreSQL database dump\n") || !strings.Contains(dump.Head, "SET row_security = off;") {
+			t.Errorf("%s: unexpected head %q", path, dump.Head)
+		}
+		if !strings.HasPrefix(dump.Tail, "--\n"+Trailer+"\n") {
+			t.Errorf("%s: unexpected tail %q", path, dump.Tail)
+		}
+		for _, o := range dump.Objects {
+			if o.Name == "fake" {
+				t.Errorf("%s: a header inside a function body or COPY data split an object", path)
+			}
+			if !strings.HasPrefix(o.Header(), "--\n-- ") || !strings.HasSuffix(o.Header(), "\n--\n") {
+				t.Errorf("%s: %s has header %q", path, o, o.Header())
+			}
+			if o.Header()+o.Body() != o.Text {
+				t.Errorf("%s: %s header and body don't make up its text", path, o)
+			}
+		}
+
+		weird := dump.Find("TABLE", "app", `Weird; "Name"`)
+		if weird == nil {
+			t.Fatalf("%s: the table with a quoted name was not found", path)
+		}
+		if !strings.Contains(weird.Body(), `mood app.mood DEFAULT 'it''s ok; really'::app.mood`) {
+			t.Errorf("%s: the table ends early: %q", path, weird.Body())
+		}
+		items := dump.Find("TABLE DATA", "app", "items")
+		if items == nil || !items.Data {
+			t.Fatalf("%s: the data of app.items was not found", path)
+		}
+		if !strings.Contains(items.Text, "7\tline\\nbreak\t\\N\n\\.\n") {
+			t.Errorf("%s: the COPY data ends early: %q", path, items.Text)
+		}
+	}
+}
+
+func TestStatementBoundaries(t *testing.T) {
+	data := fixtures(t)[filepath.Join("testdata", "pg17.sql")]
+	statements := Statements(data)
+	texts := make([]string, len(statements))
+	for i, s := range statements {
+		texts[i] = s.Text
+	}
+
+	// Whole statements, as psql sends them
+	for _, want := range []string{
+		`\restrict Qf3kT9vWm2LxY7pRb8NcZ1hJdU4sEaG5oHiKyP0tVnMqXwFe6rSgBlCjDzAuI`,
+		"CREATE TYPE app.mood AS ENUM (\n    'sad',\n    'it''s ok; really',\n    'happy'\n);",
+		"SELECT pg_catalog.setval('app.items_id_seq', 7, true);",
+		"COPY app.items (id, name, updated) FROM stdin;",
+		`\unrestrict Qf3kT9vWm2LxY7pRb8NcZ1hJdU4sEaG5oHiKyP0tVnMqXwFe6rSgBlCjDzAuI`,
+	} {
+		if !slices.Contains(texts, want) {
+			t.Errorf("statement %q not found", want)
+		}
+	}
+	for _, prefix := range []string{
+		"CREATE FUNCTION app.touch_row()",
+		"CREATE FUNCTION app.quote_all(",
+		"CREATE FUNCTION app.clamp(",
+		"CREATE PROCEDURE app.log_delete(",
+		`CREATE TABLE app."Weird; ""Name""" (`,
+		"CREATE RULE log_delete AS",
+		"COMMENT ON TABLE app.items",
+	} {
+		i := slices.IndexFunc(texts, func(text string) bool { return strings.HasPrefix(text, prefix) })
+		if i < 0 {
+			t.Errorf("no statement starts with %q", prefix)
+			continue
+		}
+		// The statement runs up to its own end, not a semicolon inside it
+		if next := texts[i+1]; !strings.HasPrefix(next, "ALTER ") && !strings.HasPrefix(next, "GRANT ") && !strings.HasPrefix(next, "CREATE ") {
+			t.Errorf("%q is followed by %q, so it was split", prefix, next)
+		}
+	}
+	for _, text := range texts {
+		if strings.HasPrefix(text, "1\t") || strings.HasPrefix(text, "-- Name") || strings.HasPrefix(text, "END") || strings.HasPrefix(text, "RETURN") {
+			t.Errorf("statement %q starts inside COPY data or a body", text)
+		}
+	}
+}
+
+func TestScriptStatements(t *testing.T) {
+	data := fixtures(t)[filepath.Join("testdata", "script.sql")]
+	var got []string
+	for _, s := range Statements(data) {
+		got = append(got, fmt.Sprintf("%d %s", s.Line, s.Text))
+	}
+	want := []string{
+		"2 SET client_encoding = 'UTF8';",
+		"3 /* A block comment; with a semicolon\n   /* nested; */ still in it; */\nCREATE TABLE \"a;b\" (\"c\"\"d\" text DEFAULT 'e;f', g text DEFAULT E'h\\';i');",
+		"6 SELECT 1;",
+		"6 SELECT 2;",
+		"7 SELECT 'it''s -- not a comment', /* inline; */ 3;",
+		`8 \connect other`,
+		"9 SELECT $fn$ a; $$ b; $fn$, $$x;$$;",
+		"10 INSERT INTO t VALUES ('multi\nline; value'),\n    (E'\\\\'), ('--');",
+		"13 COPY t (a, b) FROM stdin;",
+		"16 SELECT CASE WHEN true THEN 'begin' ELSE 'end' END;",
+		"17 CREATE OR REPLACE FUNCTION f() RETURNS int LANGUAGE sql\nBEGIN ATOMIC\n  SELECT CASE WHEN true THEN 1 END;\nEND;",
+		`21 CREATE TABLE begin_end (begin int, "end" int);`,
+		"22 SELECT 'no semicolon at the end'",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("statements:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestScanner(t *testing.T) {
+	for path, data := range fixtures(t) {
+		want := Statements(data)
+		var got []Statement
+		var offsets []int64
+		var lines []int
+		s := NewScanner(strings.NewReader(data), 0, 1)
+		for s.Scan() {
+			got = append(got, s.Statements()...)
+			offsets = append(offsets, s.Offset())
+			lines = append(lines, s.Line())
+		}
+		if err := s.Err(); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: the scanner found %d statements, Statements %d", path, len(got), len(want))
+			continue
+		}
+
+		for i, offset := range offsets {
+			// Pieces end at line ends, on the line counted
+			if offset < int64(len(data)) && data[offset-1] != '\n' {
+				t.Errorf("%s: piece %d ends within a line, at %d", path, i, offset)
+			}
+			if n := strings.Count(data[:offset], "\n") + 1; n != lines[i] && offset < int64(len(data)) {
+				t.Errorf("%s: piece %d ends before line %d, Line says %d", path, i, n, lines[i])
+			}
+
+			// A scanner started where a piece ended finds the rest
+			var rest []Statement
+			resumed := NewScanner(strings.NewReader(data[offset:]), offset, lines[i])
+			for resumed.Scan() {
+				rest = append(rest, resumed.Statements()...)
+			}
+			done := 0
+			for _, st := range want {
+				if st.Line < lines[i] {
+					done++
+				}
+			}
+			if !slices.Equal(rest, want[done:]) {
+				t.Errorf("%s: resuming after piece %d at line %d finds %d statements, want %d", path, i, lines[i], len(rest), len(want)-done)
+			}
+		}
+	}
+}
@@ -0,0 +1,271 @@
+--
+-- PostgreSQL database dump
+--
+
+-- Dumped from database version 16.8
+-- Dumped by pg_dump version 16.8
+
+SET statement_timeout = 0;
+SET lock_timeout = 0;
+SET idle_in_transaction_session_timeout = 0;
+SET client_encoding = 'UTF8';
+SET standard_conforming_strings = on;
+SELECT pg_catalog.set_config('search_path', '', false);
+SET check_function_bodies = false;
+SET xmloption = content;
+SET client_min_messages = warning;
+SET row_security = off;
+
+--
+-- Name: app; Type: SCHEMA; Schema: -; Owner: app
+--
+
+CREATE SCHEMA app;
+
+
+ALTER SCHEMA app OWNER TO app;
+
+--
+-- Name: mood; Type: TYPE; Schema: app; Owner: app
+--
+
+CREATE TYPE app.mood AS ENUM (
+    'sad',
+    'it''s ok; really',
+    'happy'
+);
+
+
+ALTER TYPE app.mood OWNER TO app;
+
+--
+-- Name: touch_row(); Type: FUNCTION; Schema: app; Owner: app
+--
+
+CREATE FUNCTION app.touch_row() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    -- Semicolons in here; don't end the statement
+    NEW.updated := now();
+    /* A block comment;
+--
+-- Name: fake; Type: TABLE; Schema: app; Owner: app
+--
+       with a header in it */
+    RAISE NOTICE 'row %; ''quoted''', NEW.id;
+    RETURN NEW;
+END;
+$$;
+
+
+ALTER FUNCTION app.touch_row() OWNER TO app;
+
+--
+-- Name: quote_all(text); Type: FUNCTION; Schema: app; Owner: app
+--
+
+CREATE FUNCTION app.quote_all(value text) RETURNS text
+    LANGUAGE sql IMMUTABLE STRICT
+    AS $body$
+    SELECT '$$' || replace(value, '$', '$$') || $q$;$q$;
+$body$;
+
+
+ALTER FUNCTION app.quote_all(value text) OWNER TO app;
+
+--
+-- Name: clamp(integer, integer, integer); Type: FUNCTION; Schema: app; Owner: app
+--
+
+CREATE FUNCTION app.clamp(value integer, low integer, high integer) RETURNS integer
+    LANGUAGE sql IMMUTABLE
+    BEGIN ATOMIC
+ SELECT
+         CASE
+             WHEN (clamp.value < clamp.low) THEN clamp.low
+             WHEN (clamp.value > clamp.high) THEN clamp.high
+             ELSE clamp.value
+         END AS "case";
+ SELECT 1;
+END;
+
+
+ALTER FUNCTION app.clamp(value integer, low integer, high integer) OWNER TO app;
+
+--
+-- Name: log_delete(integer); Type: PROCEDURE; Schema: app; Owner: app
+--
+
+CREATE PROCEDURE app.log_delete(IN item integer)
+    LANGUAGE sql
+    BEGIN ATOMIC
+ INSERT INTO app.log (item)
+   VALUES (log_delete.item);
+END;
+
+
+ALTER PROCEDURE app.log_delete(IN item integer) OWNER TO app;
+
+SET default_tablespace = '';
+
+SET default_table_access_method = heap;
+
+--
+-- Name: Weird; "Name"; Type: TABLE; Schema: app; Owner: app
+--
+
+CREATE TABLE app."Weird; ""Name""" (
+    id integer NOT NULL,
+    "semi;colon" text DEFAULT 'a; b'::text,
+    path text DEFAULT E'C:\\temp\\'';--'::text,
+    mood app.mood DEFAULT 'it''s ok; really'::app.mood
+);
+
+
+ALTER TABLE app."Weird; ""Name""" OWNER TO app;
+
+--
+-- Name: items; Type: TABLE; Schema: app; Owner: app
+--
+
+CREATE TABLE app.items (
+    id integer NOT NULL,
+    name text NOT NULL,
+    updated timestamp with time zone
+);
+
+
+ALTER TABLE app.items OWNER TO app;
+
+--
+-- Name: log; Type: TABLE; Schema: app; Owner: app
+--
+
+CREATE TABLE app.log (
+    item integer
+);
+
+
+ALTER TABLE app.log OWNER TO app;
+
+--
+-- Name: items_id_seq; Type: SEQUENCE; Schema: app; Owner: app
+--
+
+CREATE SEQUENCE app.items_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER SEQUENCE app.items_id_seq OWNER TO app;
+
+--
+-- Name: items_id_seq; Type: SEQUENCE OWNED BY; Schema: app; Owner: app
+--
+
+ALTER SEQUENCE app.items_id_seq OWNED BY app.items.id;
+
+
+--
+-- Name: items id; Type: DEFAULT; Schema: app; Owner: app
+--
+
+ALTER TABLE ONLY app.items ALTER COLUMN id SET DEFAULT nextval('app.items_id_seq'::regclass);
+
+
+--
+-- Data for Name: items; Type: TABLE DATA; Schema: app; Owner: app
+--
+
+COPY app.items (id, name, updated) FROM stdin;
+1	plain	2025-01-01 00:00:00+00
+2	semi; colon	\N
+3	--	\N
+4	-- Name: fake; Type: TABLE; Schema: app; Owner: app	\N
+5	it's $$ open /* comment	\N
+6	\\.	\N
+7	line\nbreak	\N
+\.
+
+
+--
+-- Data for Name: Weird; "Name"; Type: TABLE DATA; Schema: app; Owner: app
+--
+
+COPY app."Weird; ""Name""" (id, "semi;colon", path, mood) FROM stdin;
+\.
+
+
+--
+-- Name: items_id_seq; Type: SEQUENCE SET; Schema: app; Owner: app
+--
+
+SELECT pg_catalog.setval('app.items_id_seq', 7, true);
+
+
+--
+-- Name: items items_pkey; Type: CONSTRAINT; Schema: app; Owner: app
+--
+
+ALTER TABLE ONLY app.items
+    ADD CONSTRAINT items_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: items_name_idx; Type: INDEX; Schema: app; Owner: app
+--
+
+CREATE INDEX items_name_idx ON app.items USING btree (lower(name)) WHERE (name <> ';'::text);
+
+
+--
+-- Name: items log_delete; Type: RULE; Schema: app; Owner: app
+--
+
+CREATE RULE log_delete AS
+    ON DELETE TO app.items DO ( INSERT INTO app.log (item)
+  VALUES (old.id);
+ DELETE FROM app."Weird; ""Name"""
+  WHERE ("Weird; ""Name""".id = old.id);
+);
+
+
+--
+-- Name: items touch; Type: TRIGGER; Schema: app; Owner: app
+--
+
+CREATE TRIGGER touch BEFORE UPDATE ON app.items FOR EACH ROW EXECUTE FUNCTION app.touch_row();
+
+
+--
+-- Name: log log_item_fkey; Type: FK CONSTRAINT; Schema: app; Owner: app
+--
+
+ALTER TABLE ONLY app.log
+    ADD CONSTRAINT log_item_fkey FOREIGN KEY (item) REFERENCES app.items(id);
+
+
+--
+-- Name: TABLE items; Type: COMMENT; Schema: app; Owner: app
+--
+
+COMMENT ON TABLE app.items IS 'Items; see /* not a comment */ and -- not one either
+across lines';
+
+
+--
+-- Name: TABLE items; Type: ACL; Schema: app; Owner: app
+--
+
+GRANT SELECT ON TABLE app.items TO reader;
+
+
+--
+-- PostgreSQL database dump complete
+--
+
@@ -0,0 +1,22 @@
+-- A script rather than a dump: the lexical cases at statement level
+SET client_encoding = 'UTF8';
+/* A block comment; with a semicolon
+   /* nested; */ still in it; */
+CREATE TABLE "a;b" ("c""d" text DEFAULT 'e;f', g text DEFAULT E'h\';i');
+SELECT 1; SELECT 2;
+SELECT 'it''s -- not a comment', /* inline; */ 3;
+\connect other
+SELECT $fn$ a; $$ b; $fn$, $$x;$$;
+INSERT INTO t VALUES ('multi
+line; value'),
+    (E'\\'), ('--');
+COPY t (a, b) FROM stdin;
+x;	y
+\.
+SELECT CASE WHEN true THEN 'begin' ELSE 'end' END;
+CREATE OR REPLACE FUNCTION f() RETURNS int LANGUAGE sql
+BEGIN ATOMIC
+  SELECT CASE WHEN true THEN 1 END;
+END;
+CREATE TABLE begin_end (begin int, "end" int);
+SELECT 'no semicolon at the end'
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultKeepaliveInterval is how often idle connections are probed unless
+// --keepalive-interval says otherwise; well under the idle timeouts of
+// common firewalls and load balancers
+const defaultKeepaliveInterval = 30 * time.Second
+
+// keepaliveDialer dials the tool's own connections. Both drivers take it:
+// lib/pq as a Dialer, pgx through its DialFunc.
+type keepaliveDialer struct {
+	net.Dialer
+}
+
+// newKeepaliveDialer probes idle TCP connections every interval and gives up
+// on them after three unanswered probes. A zero interval leaves the system
+// defaults.
+func newKeepaliveDialer(interval time.Duration) *keepaliveDialer {
+	d := &keepaliveDialer{}
+	if interval > 0 {
+		d.KeepAliveConfig = net.KeepAliveConfig{Enable: true, Idle: interval, Interval: interval, Count: 3}
+	}
+	return d
+}
+
+func (d *keepaliveDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	dialer := d.Dialer
+	dialer.Timeout = timeout
+	return dialer.Dial(network, address)
+}
+
+// connectionLost reports whether err means the connection itself is gone,
+// rather than the statement failing or the phase running out of time
+func connectionLost(err error) bool {
+	if err == nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if serverErr, ok := asServerError(err); ok {
+		// connection_exception, admin_shutdown
+		return strings.HasPrefix(serverErr.Code, "08") || serverErr.Code == "57P01"
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &netErr) || strings.Contains(err.Error(), "conn closed")
+}
+
+// retryOnReconnect runs an idempotent operation, such as reading catalogs,
+// once more on a new connection when it lost its connection. fn must open
+// its own connection so the retry doesn't get the dead one.
+func retryOnReconnect(config *DatabaseConfig, what string, fn func() error) error {
+	err := fn()
+	if !connectionLost(err) {
+		return err
+	}
+	warn(WarnReconnected, fmt.Sprintf("Connection to %s/%s was lost while %s (%v); reconnecting", config.Host, config.Database, what, err))
+	if err := refreshCredentials(config); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// heartbeat keeps a pool held across a long local step, like a psql run,
+// from being dropped as idle
+type heartbeat struct {
+	stop chan struct{}
+	done chan struct{}
+
+	mu   sync.Mutex
+	lost error // First failed heartbeat: the session, with its SET ROLE, is gone
+}
+
+// startHeartbeat runs SELECT 1 on db every --keepalive-interval until
+// stopped. during names the step for the log.
+func startHeartbeat(db *sql.DB, config *DatabaseConfig, during string) *heartbeat {
+	h := &heartbeat{stop: make(chan struct{}), done: make(chan struct{})}
+	if config.KeepaliveInterval <= 0 {
+		close(h.done)
+		return h
+	}
+	go func() {
+		defer close(h.done)
+		ticker := time.NewTicker(config.KeepaliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-ticker.C:
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), config.KeepaliveInterval)
+			_, err := db.ExecContext(ctx, `SELECT 1`)
+			cancel()
+			if err != nil {
+				logger.Debug(fmt.Sprintf("Heartbeat to %s/%s during %s failed: %v", config.Host, config.Database, during, err))
+				h.mu.Lock()
+				if h.lost == nil {
+					h.lost = err
+				}
+				h.mu.Unlock()
+				continue
+			}
+			logger.Debug(fmt.Sprintf("Heartbeat to %s/%s during %s", config.Host, config.Database, during))
+		}
+	}()
+	return h
+}
+
+// Stop ends the heartbeat and returns why the held session was lost, if it
+// was
+func (h *heartbeat) Stop() error {
+	select {
+	case <-h.stop:
+	default:
+		close(h.stop)
+	}
+	<-h.done
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lost
+}
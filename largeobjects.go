@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+)
+
+// countLargeObjects returns the number of large objects stored in the database
+func countLargeObjects(config *DatabaseConfig) (int64, error) {
+	db, err := openDB(config, config.Database)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var count int64
+	err = db.QueryRow(`SELECT count(*) FROM pg_largeobject_metadata`).Scan(&count)
+	return count, err
+}
+
+// checkSourceLargeObjects warns when the source uses large objects, since the
+// schema-only export cannot carry them to the destination.
+func checkSourceLargeObjects(source *DatabaseConfig) {
+	count, err := countLargeObjects(source)
+	if err != nil {
+		warn(WarnLargeObjectsCheckFailed, fmt.Sprintf("Could not check source for large objects: %v", err))
+		return
+	}
+	if count > 0 {
+		warn(WarnLargeObjectsNotExported, fmt.Sprintf("Source database contains %d large object(s); they are not included in the schema-only export", count))
+	}
+}
+
+// largeObjectArgs returns the pg_dump flags controlling large objects for a
+// data-inclusive dump of the given database. Unless --no-blobs was passed,
+// large objects are requested explicitly so a rollback is complete.
+func largeObjectArgs(config *DatabaseConfig, options *MigrationOptions) []string {
+	if options.Blobs != "exclude" {
+		return []string{"--blobs"}
+	}
+
+	count, err := countLargeObjects(config)
+	if err != nil {
+		warn(WarnLargeObjectsCheckFailed, fmt.Sprintf("Could not check '%s' for large objects: %v", config.Database, err))
+	} else if count > 0 {
+		warn(WarnLargeObjectsExcluded, fmt.Sprintf("Database '%s' contains %d large object(s) which are excluded by --no-blobs", config.Database, count))
+	}
+	return []string{"--no-blobs"}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"pg-schema-migrator/internal/catalog"
+)
+
+// DatabaseObject identifies a schema object by kind, schema and name
+type DatabaseObject struct {
+	Type   string `json:"type"` // schema, table, view or function
+	Schema string `json:"schema,omitempty"`
+	Name   string `json:"name"`
+}
+
+func (o DatabaseObject) String() string {
+	if o.Schema == "" {
+		return fmt.Sprintf("%s %s", o.Type, o.Name)
+	}
+	return fmt.Sprintf("%s %s.%s", o.Type, o.Schema, o.Name)
+}
+
+// tocEntryPattern matches pg_dump's "-- Name: x; Type: T; Schema: s; Owner: o" headers
+var tocEntryPattern = regexp.MustCompile(`^-- Name: (.*); Type: ([^;]+); Schema: ([^;]+);`)
+
+// tocObjectTypes maps pg_dump TOC types to the object kinds compared for loss
+var tocObjectTypes = map[string]string{
+	"SCHEMA":            "schema",
+	"TABLE":             "table",
+	"FOREIGN TABLE":     "table",
+	"VIEW":              "view",
+	"MATERIALIZED VIEW": "view",
+	"FUNCTION":          "function",
+	"PROCEDURE":         "function",
+}
+
+// schemaFileObjects lists the schemas, tables, views and functions a
+// plain-format pg_dump file creates
+func schemaFileObjects(path string) (map[DatabaseObject]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	objects := make(map[DatabaseObject]bool)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		m := tocEntryPattern.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		kind, ok := tocObjectTypes[m[2]]
+		if !ok {
+			continue
+		}
+		schema := m[3]
+		if kind == "schema" || schema == "-" {
+			schema = ""
+		}
+		objects[DatabaseObject{Type: kind, Schema: schema, Name: m[1]}] = true
+	}
+	return objects, scanner.Err()
+}
+
+// listDatabaseObjects lists the user schemas other than public, and the
+// tables, views, functions and procedures of the user schemas, leaving out
+// those belonging to extensions
+func listDatabaseObjects(db *sql.DB) ([]DatabaseObject, error) {
+	c, err := catalog.Read(runContext(), db, catalog.Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []DatabaseObject
+	for _, s := range c.Schemas {
+		if s.Name != "public" {
+			objects = append(objects, DatabaseObject{Type: "schema", Name: s.Name})
+		}
+		for _, t := range s.Tables {
+			objects = append(objects, DatabaseObject{Type: "table", Schema: s.Name, Name: t.Name})
+		}
+		for _, v := range s.Views {
+			objects = append(objects, DatabaseObject{Type: "view", Schema: s.Name, Name: v.Name})
+		}
+		for _, f := range s.Functions {
+			if f.Kind == catalog.FunctionNormal || f.Kind == catalog.FunctionProcedure {
+				objects = append(objects, DatabaseObject{Type: "function", Schema: s.Name, Name: f.Name + "(" + f.ArgumentTypes + ")"})
+			}
+		}
+	}
+	return objects, nil
+}
+
+// findDestinationOnlyObjects returns the objects of the existing destination
+// database that the schema file does not recreate, leaving out ignored ones
+func findDestinationOnlyObjects(dest *DatabaseConfig, schemaFile string, ignore *IgnoreList) ([]DatabaseObject, error) {
+	exists, err := databaseExists(dest)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	expected, err := schemaFileObjects(schemaFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema file: %v", err)
+	}
+
+	db, err := openDatabase(dest, dest.Database)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	current, err := listDatabaseObjects(db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list destination objects: %v", err)
+	}
+
+	var lost []DatabaseObject
+	ignored := 0
+	for _, obj := range current {
+		if expected[obj] {
+			continue
+		}
+		if ignore.Ignored(obj) {
+			ignored++
+			continue
+		}
+		lost = append(lost, obj)
+	}
+	if ignored > 0 {
+		logger.Info(fmt.Sprintf("%d destination-only object(s) ignored by ignore patterns", ignored))
+	}
+	sort.Slice(lost, func(i, j int) bool {
+		return lost[i].String() < lost[j].String()
+	})
+	return lost, nil
+}
+
+// checkDestinationLoss reports destination objects that would be dropped
+// without being recreated and makes sure the loss is accepted, either with
+// --accept-destination-loss or interactively.
+func checkDestinationLoss(dest *DatabaseConfig, schemaFile string, options *MigrationOptions, state *RunState) error {
+	lost, err := findDestinationOnlyObjects(dest, schemaFile, options.Ignore)
+	if err != nil {
+		return err
+	}
+	state.DestinationOnly = lost
+	if len(lost) == 0 {
+		return nil
+	}
+
+	warn(WarnDestinationObjectsLost, fmt.Sprintf("%d object(s) exist only on the destination '%s' and will be lost:", len(lost), dest.Database))
+	for _, obj := range lost {
+		logger.Warning(fmt.Sprintf("   - %s", obj))
+	}
+
+	if options.DryRun {
+		return nil
+	}
+	if options.AcceptDestinationLoss {
+		logger.Warning("Continuing because of --accept-destination-loss; the objects remain in the backup")
+		return nil
+	}
+	if !stdinIsTerminal() {
+		return fmt.Errorf("destination-only objects would be lost; pass --accept-destination-loss to continue")
+	}
+
+	fmt.Fprintf(os.Stderr, "Type the destination database name (%s) to drop these objects: ", dest.Database)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read confirmation: %v", err)
+	}
+	if strings.TrimSpace(answer) != dest.Database {
+		return fmt.Errorf("destination loss not confirmed")
+	}
+	return nil
+}
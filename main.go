@@ -2,19 +2,25 @@ package main
 
 import (
 	"bufio"
-	"database/sql"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"syscall"
+	"text/template"
 	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"golang.org/x/term"
 )
 
@@ -26,6 +32,48 @@ type DatabaseConfig struct {
 	Password string
 	Database string
 	SSLMode  string
+	Role     string // Optional role to SET ROLE to after connecting
+	Options  string // Server options set at connection time, e.g. "-c search_path=app" (PGOPTIONS)
+
+	SSLRootCert    string // CA bundle used to verify the server certificate
+	SSLCert        string // Client certificate
+	SSLKey         string // Client certificate key
+	SSLMinProtocol string // Minimum TLS version, e.g. TLSv1.3
+	ChannelBinding string // SCRAM channel binding for pg_dump, psql and pgx: disable, prefer or require
+	GSSEncMode     string // GSSAPI encryption for pg_dump and psql: disable, prefer or require
+	Driver         string // Driver backend of the Go connections: pq (default) or pgx
+
+	KeepaliveInterval time.Duration // TCP keepalive and heartbeat interval of the Go connections; 0 for system defaults
+
+	negotiatedSSLMode string        // sslmode lib/pq uses when SSLMode is allow or prefer
+	SSLModeRequested  string        // The mode given, when pg_hba.conf made the run switch SSLMode
+	StrictSSL         bool          // Never switch SSLMode to the one pg_hba.conf admits
+	SSLState          *SSLState     // How the connection was secured, once validated
+	Flavor            *ServerFlavor // Kind of server, once validated
+
+	ReadOnly  bool // Only SELECT and SHOW may run on the Go connections
+	StandbyOK bool // Allow the server to be a hot standby
+	Replica   bool // Expect a hot standby and retry exports on recovery conflicts
+
+	Environment string // Optional label: production, staging or dev
+
+	SSH          string // Optional user@bastion[:port] to tunnel through
+	TunnelTarget string // Original host:port when connecting through a tunnel
+
+	Auth string   // "password" or "iam"
+	iam  *iamAuth // Token generator when Auth is "iam"
+
+	passwordSource string // Where the password came from (command, keyring, pgpass, env, prompt)
+
+	log *Logger // Scoped logger while work on this database runs alongside other work
+}
+
+// output is the logger for work on this database
+func (c *DatabaseConfig) output() *Logger {
+	if c.log != nil {
+		return c.log
+	}
+	return logger
 }
 
 // MigrationOptions holds migration configuration
@@ -34,14 +82,104 @@ type MigrationOptions struct {
 	OutputDir    string
 	CreateBackup bool
 	BackupDir    string
-	IncludeRoles bool
-	IncludeData  bool // For rollback scripts
-	DryRun       bool
+
+	Staged       *stagedOutput // --output-dir given as a storage URI; OutputDir is its local staging directory
+	BackupUpload Storage       // --backup-upload
+
+	ArtifactNames map[string]string // --artifact-name-template templates by artifact kind
+
+	RestoreGrants bool // Re-apply the destination's database grants and settings saved before the drop
+
+	ConfirmProduction bool // --i-know-this-is-production, for destinations labeled production
+
+	BlackoutWindows  []BlackoutWindow // Change freezes from the config file
+	OverrideBlackout bool             // Run inside a blackout window anyway
+
+	Notify *EmailNotification // --notify-email, nil without
+
+	RoleHandling   RoleHandling      // Whether roles, privileges and owners are migrated
+	Roles          RoleFilterOptions // Filtering of the roles dump made with --roles
+	MissingRoles   string            // What to do about roles the schema needs that the destination lacks
+	Comments       string            // "keep", "strip" or "only" for COMMENT statements
+	Objects        []string          // "all", or the kinds updated in place: "code", "enums"
+	Selection      ObjectSelection   // --only and --skip filtering of the export
+	Unlogged       string            // "keep", "to-logged" or "to-unlogged" for unlogged tables of the export
+	PinSearchPath  bool              // Add SET search_path to exported functions that set none
+	KeepOwnership  bool              // Leave OWNER TO and privilege statements in the export
+	ParallelPhases int               // How many of the export and backup may run at once
+	IncludeData    bool              // For rollback scripts
+	DryRun         bool
+	PlanOnly       bool   // --dry-run=plan-only: plan from the flags without connecting
+	PlanFormat     string // How a dry run shows its plan, "text" or "json"
+
+	Blobs string // "include", "exclude" or "" for pg_dump's default
+
+	NoSynchronizedSnapshots bool // For pg_dump against standbys that can't export snapshots
+
+	CreateDB             CreateDatabaseOptions // Options for the recreated destination database
+	MaintenanceWindow    bool                  // Block connections to the destination while migrating
+	Bootstrap            bool                  // Migrate into a new server: never drop, create roles and extensions
+	Force                bool                  // Let --bootstrap apply into a database that is not empty
+	ForceRecreate        bool                  // Back up, drop and recreate even an empty destination
+	OnCollision          string                // What to do when the database named by --dest-db-template exists
+	DatabaseCase         string                // What to do when only a database differing in case exists
+	SkipUnreadable       bool                  // Leave tables the source user can't read out of the export
+	ExcludeTables        []string              // pg_dump --exclude-table patterns, of the tables --skip-unreadable leaves out
+	AllowEphemeralOutput bool                  // Write the destination backup to tmpfs, overlay or the temp directory
+	ActivityCheck        ActivityCheckOptions  // Pre-export check for conflicting source activity
+	Collation            CollationCheckOptions // Pre-flight comparison of collation versions
+	SpaceCheck           SpaceCheckOptions     // Pre-drop check for destination disk space
+	SSH                  SSHOptions            // Settings for SSH tunnels
+
+	SeedFile                  string // Optional data file loaded after the schema apply
+	DisableTriggersDuringData bool
+	DeferConstraints          bool
+	Analyze                   AnalyzeOptions // Statistics refresh after data is loaded
+
+	Output string // Export target overriding the generated file name, "-" for stdout
+
+	Format      string // pg_dump format of the export, "plain" or "directory"
+	Archive     bool   // Pack a directory export into one tar with a checksum sidecar
+	ArchiveGzip bool   // Gzip the archive
+	Split       bool   // Also write a plain export as one file per object
+	Git         GitOptions
+
+	PreviewStatements int // Statements of the schema file shown by apply --dry-run
+
+	AcceptDestinationLoss  bool          // Drop destination objects the schema doesn't recreate without asking
+	RequireOlderThan       time.Duration // Refuse a destination the tool migrated more recently than this
+	AcceptStaleBackup      bool          // Drop a destination written to after its backup without asking
+	AllowMetaCommands      bool          // Apply schema files that \connect elsewhere or create or rename databases
+	AllowClusterStatements bool          // Apply schema files with ALTER SYSTEM, superuser roles or tablespaces
+	AllowEmptySchema       bool          // Go on when the export contains no objects
+
+	AcceptReplicationBreakage bool        // Drop a destination that logical replication subscribers depend on
+	RecreatePublications      bool        // Recreate the destination's publications after the apply
+	Ignore                    *IgnoreList // Objects left out of comparisons (.pgsmignore, --ignore-object)
+	StrictCodeCompare         bool        // Compare function and view definitions without normalizing them
+	CIMode                    bool        // Unattended in CI: checks that only warn otherwise fail the run
+
+	FailOnWarning bool             // Exit with exitWarnings when the run produced warnings
+	FailOnNotice  []*regexp.Regexp // psql notices that fail the apply
+
+	AllowApplyErrors    int           // Statements that may fail during the apply without failing the run
+	SlowObjectThreshold time.Duration // Warn about objects taking longer than this to apply
+
+	Timeouts TimeoutOptions // Time budget of the run and its phases
+
+	RunLabel    string // Free-form label identifying this run in reports
+	MetricsFile string // Optional Prometheus textfile-collector output
+	SummaryJSON string // Optional RunResult output, "-" for stdout
 }
 
 // Logger provides structured logging
 type Logger struct {
 	*log.Logger
+	adapter OutputAdapter // Optional CI-specific output
+
+	fields string      // "[key=value ...]" tag of a scoped logger
+	file   *log.Logger // Optional copy of a scoped logger's lines
+	tail   *logTail    // The last lines, kept for --notify-email
 }
 
 func NewLogger() *Logger {
@@ -51,23 +189,118 @@ func NewLogger() *Logger {
 }
 
 func (l *Logger) Info(msg string) {
-	l.Printf("[INFO] %s", msg)
+	l.emit("INFO", msg)
 }
 
 func (l *Logger) Error(msg string) {
-	l.Printf("[ERROR] %s", msg)
+	l.emit("ERROR", msg)
 }
 
 func (l *Logger) Success(msg string) {
-	l.Printf("[SUCCESS] %s", msg)
+	l.emit("SUCCESS", msg)
 }
 
 func (l *Logger) Warning(msg string) {
-	l.Printf("[WARNING] %s", msg)
+	l.emit("WARNING", msg)
 }
 
 func (l *Logger) Debug(msg string) {
-	l.Printf("[DEBUG] %s", msg)
+	l.emit("DEBUG", msg)
+}
+
+// WithField returns a logger that tags its lines with key=value, so output
+// of work running alongside other work can be told apart
+func (l *Logger) WithField(key, value string) *Logger {
+	scoped := *l
+	field := key + "=" + value
+	if l.fields == "" {
+		scoped.fields = "[" + field + "]"
+	} else {
+		scoped.fields = strings.TrimSuffix(l.fields, "]") + " " + field + "]"
+	}
+	return &scoped
+}
+
+// WithFile returns a logger that also writes its lines to w
+func (l *Logger) WithFile(w io.Writer) *Logger {
+	scoped := *l
+	scoped.file = log.New(w, "", log.LstdFlags)
+	return &scoped
+}
+
+// Stderr is where subprocesses run for the logger write their diagnostics:
+// os.Stderr, with each line tagged and copied to the file of a scoped logger
+func (l *Logger) Stderr() io.Writer {
+	if l.fields == "" && l.file == nil {
+		return os.Stderr
+	}
+	return &lineWriter{line: func(line string) {
+		if l.fields != "" {
+			line = l.fields + " " + line
+		}
+		fmt.Fprintln(os.Stderr, line)
+		if l.file != nil {
+			l.file.Print(line)
+		}
+	}}
+}
+
+// lineWriter calls line for every complete line written to it
+type lineWriter struct {
+	line func(string)
+	buf  []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.line(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// KeepTail keeps the last n lines logged, shared with scoped loggers made afterwards
+func (l *Logger) KeepTail(n int) {
+	l.tail = &logTail{max: n}
+}
+
+// SetAdapter installs a CI output adapter
+func (l *Logger) SetAdapter(adapter OutputAdapter) {
+	l.adapter = adapter
+}
+
+// StartGroup opens a collapsible output group if the adapter supports it
+func (l *Logger) StartGroup(name string) {
+	if l.adapter != nil {
+		l.adapter.StartGroup(name)
+	}
+}
+
+// EndGroup closes the group opened by StartGroup
+func (l *Logger) EndGroup() {
+	if l.adapter != nil {
+		l.adapter.EndGroup()
+	}
+}
+
+func (l *Logger) emit(level, msg string) {
+	if l.fields != "" {
+		msg = l.fields + " " + msg
+	}
+	if l.file != nil {
+		l.file.Printf("[%s] %s", level, msg)
+	}
+	if l.tail != nil {
+		l.tail.add(fmt.Sprintf("%s [%s] %s", time.Now().Format("2006/01/02 15:04:05"), level, msg))
+	}
+	if l.adapter != nil && l.adapter.Handle(level, msg) {
+		return
+	}
+	l.Printf("[%s] %s", level, msg)
 }
 
 var logger = NewLogger()
@@ -77,53 +310,239 @@ func main() {
 		Use:   "pg-schema-migrate",
 		Short: "PostgreSQL schema migration tool",
 		Long:  "A CLI tool to migrate PostgreSQL database schemas (structure only) between different hosts",
-		Run:   runSchemaMigration,
+		RunE:  runSchemaMigration,
+
+		PersistentPreRunE: configureScratch,
+		PreRunE:           promptRemembered,
 	}
 
 	// Source database flags
-	rootCmd.Flags().StringP("source-host", "s", "localhost", "Source database host")
-	rootCmd.Flags().StringP("source-port", "", "5432", "Source database port")
-	rootCmd.Flags().StringP("source-user", "u", "postgres", "Source database username")
-	rootCmd.Flags().StringP("source-db", "d", "", "Source database name (required)")
-	rootCmd.Flags().StringP("source-ssl", "", "require", "Source SSL mode (disable, require, verify-ca, verify-full)")
+	addSourceFlags(rootCmd.Flags())
 
 	// Destination database flags
-	rootCmd.Flags().StringP("dest-host", "", "localhost", "Destination database host")
-	rootCmd.Flags().StringP("dest-port", "", "5432", "Destination database port")
-	rootCmd.Flags().StringP("dest-user", "", "postgres", "Destination database username")
-	rootCmd.Flags().StringP("dest-db", "", "", "Destination database name (leave empty to prompt)")
-	rootCmd.Flags().StringP("dest-ssl", "", "require", "Destination SSL mode (disable, require, verify-ca, verify-full)")
+	rootCmd.PersistentFlags().StringP("dest-host", "", "localhost", "Destination database host")
+	rootCmd.PersistentFlags().StringP("dest-port", "", "5432", "Destination database port")
+	rootCmd.PersistentFlags().StringP("dest-user", "", "postgres", "Destination database username")
+	rootCmd.PersistentFlags().StringP("dest-db", "", "", "Destination database name (leave empty to use --dest-db-template or prompt)")
+	rootCmd.PersistentFlags().StringP("dest-ssl", "", "require", fmt.Sprintf("Destination SSL mode (%s)", strings.Join(sslModes, ", ")))
+	rootCmd.PersistentFlags().BoolP("strict-ssl", "", false, "Fail instead of switching --dest-ssl between disable and require when the destination's pg_hba.conf only admits the other")
+	rootCmd.PersistentFlags().StringP("dest-options", "", "", "Server options set when connecting to the destination, e.g. '-c search_path=app' (PGOPTIONS)")
+	rootCmd.PersistentFlags().StringP("dest-ssl-min-protocol", "", "", fmt.Sprintf("Minimum TLS version for the destination (%s)", strings.Join(sslProtocolVersions, ", ")))
+	rootCmd.PersistentFlags().StringP("dest-channel-binding", "", "", fmt.Sprintf("Destination SCRAM channel binding (%s); lib/pq can't bind, so require needs --driver pgx", strings.Join(channelBindingModes, ", ")))
+	rootCmd.PersistentFlags().StringP("gssencmode", "", "", fmt.Sprintf("GSSAPI encryption for pg_dump and psql on both sides (%s); neither driver can encrypt with GSSAPI, so require is refused", strings.Join(gssEncModes, ", ")))
+	rootCmd.PersistentFlags().StringP("dest-sslrootcert", "", "", "Destination root CA certificate file")
+	rootCmd.PersistentFlags().StringP("dest-sslcert", "", "", "Destination client certificate file")
+	rootCmd.PersistentFlags().StringP("dest-sslkey", "", "", "Destination client certificate key file")
+	rootCmd.PersistentFlags().StringP("dest-password-command", "", "", "Command whose output is the destination password")
+	rootCmd.PersistentFlags().StringP("dest-auth", "", "password", "Destination authentication: 'password' or 'iam' (AWS RDS IAM token)")
+	rootCmd.PersistentFlags().StringP("dest-ssh", "", "", "Reach the destination through an SSH tunnel (user@bastion[:port])")
+	rootCmd.PersistentFlags().StringP("dest-environment", "", "", fmt.Sprintf("Environment label of the destination (%s); production requires --i-know-this-is-production", strings.Join(environments, ", ")))
+	rootCmd.PersistentFlags().StringP("dest-role", "", "", "Role to SET ROLE to on the destination after connecting (owns the new database)")
+	rootCmd.PersistentFlags().StringP("dest-owner", "", "", "Owner of the recreated destination database (default: previous destination owner, else source owner)")
+	rootCmd.PersistentFlags().StringP("dest-template", "", "", "Template for the recreated destination database")
+	rootCmd.PersistentFlags().IntP("dest-connection-limit", "", -1, "Connection limit of the recreated destination database (default: previous destination, else source)")
+	rootCmd.PersistentFlags().StringP("dest-tablespace", "", "", "Tablespace of the recreated destination database (default: previous destination, else source)")
+
+	rootCmd.PersistentFlags().BoolP("use-keyring", "", false, "Read passwords from and store them in the OS keyring")
+	rootCmd.PersistentFlags().BoolP("password-stdin", "", false, "Read the password from the first line of stdin (used for both source and destination)")
+
+	// AWS flags (IAM authentication)
+	rootCmd.PersistentFlags().StringP("aws-region", "", "", "AWS region for RDS IAM auth tokens (default: AWS config)")
+	rootCmd.PersistentFlags().StringP("aws-profile", "", "", "AWS shared config profile for RDS IAM auth tokens")
+
+	// SSH tunnel flags
+	rootCmd.PersistentFlags().StringP("ssh-key", "", "", "Private key file for SSH tunnels (default: SSH agent, then ~/.ssh/id_*)")
+	rootCmd.PersistentFlags().BoolP("ssh-insecure-ignore-hostkey", "", false, "Skip SSH host key verification against known_hosts")
+
+	// Client tool flags
+	rootCmd.PersistentFlags().StringP("client-docker-image", "", "", "Run pg_dump and psql with 'docker run' in this image (e.g. postgres:16)")
+	rootCmd.PersistentFlags().StringP("client-docker-container", "", "", "Run pg_dump and psql with 'docker exec' in this running container")
+	rootCmd.PersistentFlags().DurationP("keepalive-interval", "", defaultKeepaliveInterval, "Probe idle Go connections with TCP keepalives this often, and run SELECT 1 on those held during long local steps; 0 for the system defaults and no heartbeat")
+	rootCmd.PersistentFlags().StringP("driver", "", DriverPQ, fmt.Sprintf("Go driver of the tool's own connections (%s); pg_dump and psql always use libpq", strings.Join(driverBackends, ", ")))
 
 	// Migration mode flags
 	rootCmd.Flags().StringP("mode", "m", "direct", "Migration mode: 'direct' or 'export'")
-	rootCmd.Flags().StringP("output-dir", "o", "./schema_migration", "Output directory for export mode")
-	rootCmd.Flags().BoolP("dry-run", "", false, "Show what would be done without executing")
-	rootCmd.Flags().BoolP("include-roles", "", false, "Include database roles and permissions")
-	rootCmd.Flags().BoolP("no-backup", "", false, "Skip creating rollback backup")
+	rootCmd.PersistentFlags().StringP("output-dir", "o", "./schema_migration", "Output directory for export mode, or an s3://, gs:// or az:// URI the files are uploaded to when the run ends")
+	rootCmd.PersistentFlags().StringP("backup-upload", "", "", "Also upload the destination backup and rollback script to this directory or s3://, gs:// or az:// URI")
+	rootCmd.Flags().StringP("format", "", DumpFormatPlain, "Export format: 'plain' SQL or pg_dump 'directory' format (export mode)")
+	rootCmd.Flags().BoolP("split", "", false, "Also write a plain export as one file per object with an objects.map.json (export mode)")
+	rootCmd.Flags().BoolP("archive", "", false, "Pack a --format directory export into one .tar with a .sha256 checksum file")
+	rootCmd.Flags().BoolP("archive-gzip", "", false, "Gzip the --archive tar into a .tar.gz")
+	rootCmd.Flags().BoolP("git", "", false, "The output directory is in a git repository: require no uncommitted changes there and report the export's changes against HEAD")
+	rootCmd.Flags().StringP("git-commit", "", "", "With --git, commit the export with this message template ({{.SourceDB}}, {{.SourceHost}}, {{.Timestamp}}, ...); never pushes")
+	rootCmd.Flags().Lookup("git-commit").NoOptDefVal = defaultGitCommitMessage
+	rootCmd.Flags().StringP("output", "", "", "Export to this file instead of a generated name in --output-dir, '-' for stdout (export mode)")
+	rootCmd.PersistentFlags().StringArrayP("artifact-name-template", "", nil, fmt.Sprintf("Name an artifact with a Go template, as <kind>=<template> (repeatable; kinds: %s)", strings.Join(artifactKinds(), ", ")))
+	rootCmd.PersistentFlags().StringP("dry-run", "", "", fmt.Sprintf("Show what would be done without executing: '%s' (the default) runs every check against the databases, '%s' plans from the flags alone without connecting", DryRunConnected, DryRunPlanOnly))
+	rootCmd.PersistentFlags().Lookup("dry-run").NoOptDefVal = DryRunConnected
+	rootCmd.PersistentFlags().StringP("plan-format", "", PlanFormatText, "Dry-run plan format: 'text' (logged) or 'json' (printed to stdout, logs go to stderr)")
+	rootCmd.Flags().BoolP("roles", "", false, "Export the roles with pg_dumpall and create them on the destination server")
+	rootCmd.Flags().BoolP("privileges", "", false, "Keep the GRANT, REVOKE and ALTER DEFAULT PRIVILEGES statements of the schema")
+	rootCmd.Flags().BoolP("owners", "", false, "Keep the OWNER TO statements of the schema")
+	rootCmd.Flags().BoolP("include-roles", "", false, "Same as --roles --privileges")
+	rootCmd.Flags().IntP("parallel-phases", "", 2, "Run the source export and destination backup concurrently, up to this many at once (1 runs them in turn)")
+	rootCmd.Flags().StringP("unlogged", "", UnloggedKeep, fmt.Sprintf("Unlogged tables of the export: %s", strings.Join(unloggedModes, ", ")))
+	rootCmd.Flags().BoolP("pin-search-path", "", false, "Add 'SET search_path TO <schema>, pg_temp' to exported functions that set no search_path")
+	rootCmd.Flags().BoolP("keep-ownership", "", false, "Only count, don't remove, the OWNER TO and GRANT/REVOKE statements pg_dump leaves in the export without --owners or --privileges")
+	rootCmd.Flags().StringP("objects", "", ObjectsAll, "Objects to migrate: 'all', or a comma-separated list of 'code' and 'enums' to update in the existing destination")
+	rootCmd.Flags().StringArrayP("only", "", nil, fmt.Sprintf("Migrate only objects matching type:schema.name, name a glob (repeatable; types: %s)", strings.Join(selectionKindNames, ", ")))
+	rootCmd.Flags().StringArrayP("skip", "", nil, "Leave out objects matching type:schema.name, name a glob (repeatable)")
+	rootCmd.Flags().BoolP("strict-selection", "", false, "Fail when objects selected with --only or --skip depend on objects left out, instead of including them")
+	rootCmd.Flags().StringArrayP("exclude-role", "", nil, "Leave roles matching this glob out of the roles dump (repeatable, adds to rds*, azure*, cloudsql*)")
+	rootCmd.Flags().BoolP("keep-superuser", "", false, "Keep SUPERUSER and REPLICATION attributes in the roles dump")
+	rootCmd.PersistentFlags().StringP("missing-roles", "", MissingRolesError, "Roles the schema refers to that the destination lacks: 'error', 'skip' or 'create' (as NOLOGIN)")
+	rootCmd.PersistentFlags().BoolP("create-missing-roles", "", false, "Create roles the schema refers to that the destination lacks as NOLOGIN (same as --missing-roles create)")
+	rootCmd.PersistentFlags().StringP("comments", "", CommentsKeep, "COMMENT statements: 'keep', 'strip', or 'only' to sync just the comments to an existing destination")
+	rootCmd.PersistentFlags().BoolP("no-backup", "", false, "Skip creating rollback backup")
+	rootCmd.PersistentFlags().BoolP("no-restore-grants", "", false, "Save the destination's database grants, settings and default privileges before the drop, but don't re-apply them")
+	rootCmd.PersistentFlags().BoolP("i-know-this-is-production", "", false, "Confirm changes to a destination labeled production")
+	rootCmd.PersistentFlags().BoolP("no-remember", "", false, "Neither offer the parameters of the last run at the prompts nor remember those of this one")
+	rootCmd.PersistentFlags().StringP("config", "", os.Getenv(configEnv), "Config file with blackout_windows and smtp_* settings (default $"+configEnv+")")
+	rootCmd.PersistentFlags().BoolP("override-blackout", "", false, "Change the destination even inside a blackout window of the config file")
+	rootCmd.PersistentFlags().StringP("notify-email", "", "", "Email the run summary to these comma-separated addresses when the run ends, with the SMTP settings of --config")
+	rootCmd.PersistentFlags().BoolP("accept-destination-loss", "", false, "Proceed when the destination has objects the schema does not recreate")
+	rootCmd.PersistentFlags().BoolP("use-existing-case", "", false, "When the destination database doesn't exist but one differing only in case does, migrate into that one")
+	rootCmd.PersistentFlags().BoolP("create-new-case", "", false, "When the destination database doesn't exist but one differing only in case does, create the requested one next to it")
+	rootCmd.PersistentFlags().BoolP("allow-meta-commands", "", false, "Apply a schema file containing \\connect, CREATE DATABASE or ALTER DATABASE ... RENAME")
+	rootCmd.PersistentFlags().BoolP("allow-cluster-statements", "", false, "Apply a schema file containing ALTER SYSTEM, CREATE or ALTER ROLE with SUPERUSER, or CREATE TABLESPACE")
+	rootCmd.PersistentFlags().BoolP("accept-stale-backup", "", false, "Drop the destination even when it was written to after its backup")
+	rootCmd.PersistentFlags().DurationP("require-older-than", "", 0, "Refuse a destination the tool last migrated less than this long ago (e.g. 24h), going by the marker in its comment")
+	rootCmd.Flags().BoolP("allow-empty-schema", "", false, "Proceed when the exported schema contains no objects")
+	rootCmd.PersistentFlags().BoolP("accept-replication-breakage", "", false, "Proceed when the destination has logical replication slots or publications, dropping the slots")
+	rootCmd.PersistentFlags().BoolP("recreate-publications", "", false, "Recreate the destination's publications after the apply when the schema doesn't")
+	rootCmd.PersistentFlags().StringArrayP("ignore-object", "", nil, "Leave objects matching this schema[.name] glob out of comparisons; '!' negates (repeatable, adds to .pgsmignore)")
+	rootCmd.PersistentFlags().BoolP("strict-code-compare", "", false, "Compare function and view definitions exactly as the servers print them, without collapsing whitespace or normalizing clauses")
+	rootCmd.PersistentFlags().BoolP("maintenance-window", "", false, "Block new connections to the destination from before the drop until the apply succeeds")
+	rootCmd.Flags().StringP("dest-db-template", "", "", "Go template naming the destination database when --dest-db is empty, e.g. '{{.SourceDB}}_staging_{{.Date}}' (fields: SourceDB, Date, Timestamp, RunLabel)")
+	rootCmd.Flags().StringP("on-collision", "", OnCollisionFail, "When the database named by --dest-db-template exists: fail, suffix (use name_2, name_3, ...) or replace")
+	rootCmd.Flags().BoolP("bootstrap", "", false, "Migrate into a new server: never drop or terminate, copy the source encoding, create missing roles and extensions")
+	rootCmd.Flags().BoolP("force", "", false, "With --bootstrap, apply into a destination database that is not empty")
+	rootCmd.PersistentFlags().BoolP("force-recreate", "", false, "Back up, drop and recreate the destination database even when it is empty, instead of applying into it")
+	rootCmd.PersistentFlags().BoolP("blobs", "", false, "Include large objects in data-inclusive dumps (destination backup)")
+	rootCmd.PersistentFlags().BoolP("no-blobs", "", false, "Exclude large objects from data-inclusive dumps (destination backup)")
+
+	// Pre-flight flags
+	rootCmd.Flags().BoolP("skip-unreadable", "", false, "Leave the tables the source user can't read out of the export instead of failing the pre-flight check")
+	rootCmd.Flags().BoolP("skip-activity-check", "", false, "Skip checking the source for long-running transactions and exclusive locks")
+	rootCmd.Flags().DurationP("long-transaction-threshold", "", 5*time.Minute, "Age after which a source transaction counts as long-running")
+	rootCmd.Flags().DurationP("wait-for-quiet", "", 0, "Wait up to this long for conflicting source activity to finish before exporting")
+	rootCmd.Flags().BoolP("strict-preflight", "", false, "Abort instead of warning when pre-flight checks find problems")
+	rootCmd.Flags().BoolP("fail-on-collation-mismatch", "", false, "Abort when source and destination collation versions differ")
+	rootCmd.Flags().BoolP("reindex-script", "", false, "Write REINDEX statements for indexes on mismatched collations to the output directory")
+
+	// Data loading flags
+	rootCmd.PersistentFlags().StringP("seed-file", "", "", "SQL data file to load into the destination after the schema is applied")
+	rootCmd.PersistentFlags().BoolP("disable-triggers-during-data", "", false, "Disable triggers on the destination while loading seed data")
+	rootCmd.PersistentFlags().BoolP("defer-constraints", "", false, "Defer deferrable constraints until the seed data transaction commits")
+	rootCmd.PersistentFlags().BoolP("no-analyze", "", false, "Don't ANALYZE the tables data was loaded into (seed data, a restored backup)")
+	rootCmd.PersistentFlags().BoolP("post-vacuum", "", false, "Run VACUUM ANALYZE instead of ANALYZE after loading data")
+	rootCmd.PersistentFlags().IntP("analyze-jobs", "", 4, "Tables analyzed at once after loading data")
+	rootCmd.PersistentFlags().Int64P("dest-free-space-bytes", "", 0, "Free space on the destination data directory, for the disk space check when it can't be read")
+	rootCmd.PersistentFlags().BoolP("skip-space-check", "", false, "Skip checking disk space for the destination backup and before loading seed data")
+	rootCmd.PersistentFlags().StringP("scratch-dir", "", "", "Directory for the run's intermediate files, in a private subdirectory removed on exit (default: the run directory)")
+	rootCmd.PersistentFlags().BoolP("keep-scratch", "", false, "Keep the intermediate files of the run and print where they are")
+	rootCmd.PersistentFlags().BoolP("allow-ephemeral-output", "", false, "Write the destination backup even when the output directory is on tmpfs, overlay or in the system temp directory")
+
+	// Timeout flags
+	rootCmd.PersistentFlags().DurationP("max-duration", "", 0, "Abort the run when it takes longer than this (e.g. 30m)")
+	rootCmd.PersistentFlags().DurationP("export-timeout", "", 0, "Abort when the schema export takes longer than this")
+	rootCmd.PersistentFlags().DurationP("apply-timeout", "", 0, "Abort when the schema apply takes longer than this")
+
+	// Reporting flags
+	rootCmd.PersistentFlags().StringP("run-label", "", "", "Label identifying this run in metrics and reports")
+	rootCmd.PersistentFlags().StringP("metrics-file", "", "", "Write Prometheus textfile-collector metrics for the run to this file")
+	rootCmd.PersistentFlags().StringP("summary-json", "", "", "Write the result of the run as JSON to this file ('-' for stdout), also on failure")
+	rootCmd.PersistentFlags().BoolP("fail-on-warning", "", false, "Exit with code 50 when the run succeeded with warnings")
+	rootCmd.PersistentFlags().StringArrayP("fail-on-notice", "", nil, "Fail the apply when a psql notice matches this regular expression (repeatable)")
+	rootCmd.PersistentFlags().IntP("allow-apply-errors", "", 0, "Number of statements that may fail during the apply without failing the run")
+	rootCmd.PersistentFlags().DurationP("slow-object-threshold", "", 0, "Warn about the objects of the schema taking longer than this to apply (e.g. 30s)")
+	rootCmd.PersistentFlags().StringP("ci", "", "", "CI output format: 'github' or 'none' (default: 'github' when GITHUB_ACTIONS=true)")
+
+	if err := rootCmd.MarkFlagRequired("source-db"); err != nil {
+		logger.Error(fmt.Sprintf("Failed to mark required flag: %v", err))
+		os.Exit(exitFailure)
+	}
 
-	rootCmd.MarkFlagRequired("source-db")
+	rootCmd.AddCommand(newApplyCommand())
+	rootCmd.AddCommand(newCleanupCommand())
+	rootCmd.AddCommand(newConfigCommand())
+	rootCmd.AddCommand(newConvergeCommand())
+	rootCmd.AddCommand(newInspectCommand())
+	rootCmd.AddCommand(newPushCommand())
+	rootCmd.AddCommand(newResumeCommand())
+	rootCmd.AddCommand(newRollbackCommand())
+	rootCmd.AddCommand(newRunsCommand())
+	rootCmd.AddCommand(newServeCommand())
+	rootCmd.AddCommand(newWatchCommand())
+
+	os.Exit(execute(rootCmd))
+}
 
-	if err := rootCmd.Execute(); err != nil {
-		logger.Error(fmt.Sprintf("Command execution failed: %v", err))
-		os.Exit(1)
-	}
+// addSourceFlags registers the source connection flags, which only the
+// commands reading from a source have
+func addSourceFlags(flags *pflag.FlagSet) {
+	flags.StringP("source-host", "s", "localhost", "Source database host")
+	flags.StringP("source-port", "", "5432", "Source database port")
+	flags.StringP("source-user", "u", "postgres", "Source database username")
+	flags.StringP("source-db", "d", "", "Source database name (required)")
+	flags.StringP("source-ssl", "", "require", fmt.Sprintf("Source SSL mode (%s)", strings.Join(sslModes, ", ")))
+	flags.StringP("source-options", "", "", "Server options set when connecting to the source, e.g. '-c search_path=app' (PGOPTIONS)")
+	flags.StringP("source-ssl-min-protocol", "", "", fmt.Sprintf("Minimum TLS version for the source (%s)", strings.Join(sslProtocolVersions, ", ")))
+	flags.StringP("source-channel-binding", "", "", fmt.Sprintf("Source SCRAM channel binding (%s); lib/pq can't bind, so require needs --driver pgx", strings.Join(channelBindingModes, ", ")))
+	flags.StringP("source-sslrootcert", "", "", "Source root CA certificate file")
+	flags.StringP("source-sslcert", "", "", "Source client certificate file")
+	flags.StringP("source-sslkey", "", "", "Source client certificate key file")
+	flags.StringP("source-password-command", "", "", "Command whose output is the source password")
+	flags.StringP("source-auth", "", "password", "Source authentication: 'password' or 'iam' (AWS RDS IAM token)")
+	flags.StringP("source-ssh", "", "", "Reach the source through an SSH tunnel (user@bastion[:port])")
+	flags.StringP("source-role", "", "", "Role to SET ROLE to on the source after connecting")
+	flags.BoolP("source-standby-ok", "", false, "Allow exporting from a source that is a hot standby")
+	flags.StringP("source-environment", "", "", fmt.Sprintf("Environment label of the source (%s)", strings.Join(environments, ", ")))
+	flags.BoolP("source-replica", "", false, "Export from a hot standby replica, retrying on recovery conflicts")
+	flags.BoolP("no-synchronized-snapshots", "", false, "Pass --no-synchronized-snapshots to pg_dump (pre-10 servers on a standby)")
 }
 
-func runSchemaMigration(cmd *cobra.Command, args []string) {
+func runSchemaMigration(cmd *cobra.Command, args []string) error {
+	// Keep stdout clean for the SQL stream or the JSON plan
+	if output, _ := cmd.Flags().GetString("output"); output == "-" {
+		logger.SetOutput(os.Stderr)
+	}
+	if format, _ := cmd.Flags().GetString("plan-format"); format == PlanFormatJSON {
+		logger.SetOutput(os.Stderr)
+	}
+
+	if err := configureCIOutput(cmd); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
 	logger.Info("Starting PostgreSQL schema migration...")
+	handleSignals()
 
 	// Parse migration options
 	options, err := parseMigrationOptions(cmd)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to parse options: %v", err))
-		os.Exit(1)
+		return exitWith(exitOptionError, fmt.Errorf("Failed to parse options: %v", err))
+	}
+
+	state, err := beginRun(cmd, options)
+	if err != nil {
+		return err
+	}
+
+	// Check all connection flags up front, before any prompt
+	if err := validateConnectionFlags(cmd, true, options.Mode == "direct"); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	// A plan-only dry run needs no passwords, since nothing connects
+	if options.PlanOnly {
+		return runPlanOnly(cmd, "", options, state)
 	}
 
 	// Get source configuration
 	sourceConfig, err := getSourceConfig(cmd)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to get source config: %v", err))
-		os.Exit(1)
+		return exitWith(exitFailure, fmt.Errorf("Failed to get source config: %v", err))
 	}
 
 	// Get destination configuration (only for direct mode)
@@ -131,100 +550,662 @@ func runSchemaMigration(cmd *cobra.Command, args []string) {
 	if options.Mode == "direct" {
 		destConfig, err = getDestConfig(cmd, sourceConfig.Database)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to get destination config: %v", err))
-			os.Exit(1)
+			return exitWith(exitFailure, fmt.Errorf("Failed to get destination config: %v", err))
 		}
+		if err := protectProduction(sourceConfig, destConfig, options); err != nil {
+			return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+		}
+		if err := checkBlackout(options, state, time.Now()); err != nil {
+			return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+		}
+	}
+
+	state.Source, state.Dest = sourceConfig, destConfig
 
+	// Open SSH tunnels before anything connects
+	if err := startTunnels(&options.SSH, sourceConfig, destConfig); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("SSH tunnel setup failed: %v", err))
+	}
+
+	if options.Mode == "direct" {
 		// Validate connections
 		if err := validateConnections(sourceConfig, destConfig); err != nil {
-			logger.Error(fmt.Sprintf("Connection validation failed: %v", err))
-			os.Exit(1)
+			return exitWith(exitFailure, fmt.Errorf("Connection validation failed: %v", err))
+		}
+		if err := resolveDestNameCollision(destConfig, options, state); err != nil {
+			return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+		}
+		if err := resolveDatabaseCase(destConfig, options, state); err != nil {
+			return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
 		}
 	} else {
 		// For export mode, only validate source
 		if err := validateSourceConnection(sourceConfig); err != nil {
-			logger.Error(fmt.Sprintf("Source connection validation failed: %v", err))
-			os.Exit(1)
+			return exitWith(exitFailure, fmt.Errorf("Source connection validation failed: %v", err))
 		}
 	}
 
+	if useKeyring, _ := cmd.Flags().GetBool("use-keyring"); useKeyring {
+		rememberPasswords(sourceConfig, destConfig)
+	}
+
+	if err := prepareArtifactNames(options, state); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+
 	// Perform schema migration
-	if err := performSchemaMigration(sourceConfig, destConfig, options); err != nil {
-		logger.Error(fmt.Sprintf("Schema migration failed: %v", err))
-		os.Exit(1)
+	result, err := performSchemaMigration(sourceConfig, destConfig, options, state)
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Schema migration failed after %s: %v", result.Duration().Round(time.Second), err))
 	}
 
-	logger.Success("Schema migration completed successfully!")
+	saveRemembered(cmd, destConfig)
+	if err := finishRun(state, options); err != nil {
+		return err
+	}
+	logger.Success(fmt.Sprintf("Schema migration completed successfully in %s!", result.Duration().Round(time.Second)))
+	return nil
 }
 
 func parseMigrationOptions(cmd *cobra.Command) (*MigrationOptions, error) {
 	mode, _ := cmd.Flags().GetString("mode")
+	if cmd.Flags().Lookup("mode") == nil {
+		mode = "direct" // Subcommands without --mode, like apply, always target a destination
+	}
 	outputDir, _ := cmd.Flags().GetString("output-dir")
-	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	backupUploadTo, _ := cmd.Flags().GetString("backup-upload")
+	awsRegion, _ := cmd.Flags().GetString("aws-region")
+	awsProfile, _ := cmd.Flags().GetString("aws-profile")
+	artifactTemplates, _ := cmd.Flags().GetStringArray("artifact-name-template")
+	output, _ := cmd.Flags().GetString("output")
+	// inspect has a --format of its own, naming the document it writes
+	var format string
+	if cmd.Flags().Lookup("out") == nil {
+		format, _ = cmd.Flags().GetString("format")
+	}
+	archive, _ := cmd.Flags().GetBool("archive")
+	split, _ := cmd.Flags().GetBool("split")
+	gitEnabled, _ := cmd.Flags().GetBool("git")
+	gitCommit, _ := cmd.Flags().GetString("git-commit")
+	archiveGzip, _ := cmd.Flags().GetBool("archive-gzip")
+	previewStatements, _ := cmd.Flags().GetInt("preview-statements")
+	acceptLoss, _ := cmd.Flags().GetBool("accept-destination-loss")
+	requireOlderThan, _ := cmd.Flags().GetDuration("require-older-than")
+	acceptStaleBackup, _ := cmd.Flags().GetBool("accept-stale-backup")
+	allowMetaCommands, _ := cmd.Flags().GetBool("allow-meta-commands")
+	allowClusterStatements, _ := cmd.Flags().GetBool("allow-cluster-statements")
+	allowEmpty, _ := cmd.Flags().GetBool("allow-empty-schema")
+	acceptReplication, _ := cmd.Flags().GetBool("accept-replication-breakage")
+	recreatePubs, _ := cmd.Flags().GetBool("recreate-publications")
+	ignorePatterns, _ := cmd.Flags().GetStringArray("ignore-object")
+	strictCodeCompare, _ := cmd.Flags().GetBool("strict-code-compare")
+	ciRun := ciMode(cmd)
+	dryRunLevel, _ := cmd.Flags().GetString("dry-run")
+	planFormat, _ := cmd.Flags().GetString("plan-format")
 	includeRoles, _ := cmd.Flags().GetBool("include-roles")
+	roles, _ := cmd.Flags().GetBool("roles")
+	privileges, _ := cmd.Flags().GetBool("privileges")
+	owners, _ := cmd.Flags().GetBool("owners")
+	noSyncSnapshots, _ := cmd.Flags().GetBool("no-synchronized-snapshots")
+	excludeRoles, _ := cmd.Flags().GetStringArray("exclude-role")
+	keepSuperuser, _ := cmd.Flags().GetBool("keep-superuser")
+	missingRoles, _ := cmd.Flags().GetString("missing-roles")
+	createMissingRoles, _ := cmd.Flags().GetBool("create-missing-roles")
+	comments, _ := cmd.Flags().GetString("comments")
+	objects, _ := cmd.Flags().GetString("objects")
+	pinSearchPath, _ := cmd.Flags().GetBool("pin-search-path")
+	unlogged, _ := cmd.Flags().GetString("unlogged")
+	// rollback has an --only of its own, naming what to restore
+	var onlyPatterns, skipPatterns []string
+	if cmd.Flags().Lookup("skip") != nil {
+		onlyPatterns, _ = cmd.Flags().GetStringArray("only")
+		skipPatterns, _ = cmd.Flags().GetStringArray("skip")
+	}
+	strictSelection, _ := cmd.Flags().GetBool("strict-selection")
+	keepOwnership, _ := cmd.Flags().GetBool("keep-ownership")
+	parallelPhases, _ := cmd.Flags().GetInt("parallel-phases")
+	if cmd.Flags().Lookup("parallel-phases") == nil {
+		parallelPhases = 1 // Subcommands without an export to run alongside
+	}
 	noBackup, _ := cmd.Flags().GetBool("no-backup")
+	noRestoreGrants, _ := cmd.Flags().GetBool("no-restore-grants")
+	confirmProduction, _ := cmd.Flags().GetBool("i-know-this-is-production")
+	configPath, _ := cmd.Flags().GetString("config")
+	overrideBlackout, _ := cmd.Flags().GetBool("override-blackout")
+	notifyEmail, _ := cmd.Flags().GetString("notify-email")
+	blobs, _ := cmd.Flags().GetBool("blobs")
+	noBlobs, _ := cmd.Flags().GetBool("no-blobs")
+	maintenanceWindow, _ := cmd.Flags().GetBool("maintenance-window")
+	bootstrap, _ := cmd.Flags().GetBool("bootstrap")
+	force, _ := cmd.Flags().GetBool("force")
+	forceRecreate, _ := cmd.Flags().GetBool("force-recreate")
+	destDBTemplate, _ := cmd.Flags().GetString("dest-db-template")
+	onCollision, _ := cmd.Flags().GetString("on-collision")
+	sshKey, _ := cmd.Flags().GetString("ssh-key")
+	sshInsecure, _ := cmd.Flags().GetBool("ssh-insecure-ignore-hostkey")
+	skipActivityCheck, _ := cmd.Flags().GetBool("skip-activity-check")
+	skipUnreadable, _ := cmd.Flags().GetBool("skip-unreadable")
+	longTxThreshold, _ := cmd.Flags().GetDuration("long-transaction-threshold")
+	waitForQuiet, _ := cmd.Flags().GetDuration("wait-for-quiet")
+	strictPreflight, _ := cmd.Flags().GetBool("strict-preflight")
+	failOnCollation, _ := cmd.Flags().GetBool("fail-on-collation-mismatch")
+	reindexScript, _ := cmd.Flags().GetBool("reindex-script")
+	destOwner, _ := cmd.Flags().GetString("dest-owner")
+	destTemplate, _ := cmd.Flags().GetString("dest-template")
+	destConnLimit, _ := cmd.Flags().GetInt("dest-connection-limit")
+	destTablespace, _ := cmd.Flags().GetString("dest-tablespace")
+	seedFile, _ := cmd.Flags().GetString("seed-file")
+	disableTriggers, _ := cmd.Flags().GetBool("disable-triggers-during-data")
+	deferConstraints, _ := cmd.Flags().GetBool("defer-constraints")
+	noAnalyze, _ := cmd.Flags().GetBool("no-analyze")
+	postVacuum, _ := cmd.Flags().GetBool("post-vacuum")
+	analyzeJobs, _ := cmd.Flags().GetInt("analyze-jobs")
+	destFreeSpace, _ := cmd.Flags().GetInt64("dest-free-space-bytes")
+	skipSpaceCheck, _ := cmd.Flags().GetBool("skip-space-check")
+	allowEphemeralOutput, _ := cmd.Flags().GetBool("allow-ephemeral-output")
+	maxDuration, _ := cmd.Flags().GetDuration("max-duration")
+	exportTimeout, _ := cmd.Flags().GetDuration("export-timeout")
+	applyTimeout, _ := cmd.Flags().GetDuration("apply-timeout")
+	runLabel, _ := cmd.Flags().GetString("run-label")
+	metricsFile, _ := cmd.Flags().GetString("metrics-file")
+	summaryJSON, _ := cmd.Flags().GetString("summary-json")
+	failOnWarning, _ := cmd.Flags().GetBool("fail-on-warning")
+	failOnNoticePatterns, _ := cmd.Flags().GetStringArray("fail-on-notice")
+	allowApplyErrors, _ := cmd.Flags().GetInt("allow-apply-errors")
+	slowObjectThreshold, _ := cmd.Flags().GetDuration("slow-object-threshold")
 
 	if mode != "direct" && mode != "export" {
 		return nil, fmt.Errorf("mode must be 'direct' or 'export'")
 	}
 
+	if output != "" && mode != "export" {
+		return nil, fmt.Errorf("--output is only supported in export mode")
+	}
+	if summaryJSON == "-" && output == "-" {
+		return nil, fmt.Errorf("--summary-json - cannot be used with --output -, which writes the schema to stdout")
+	}
+
+	if format == "" {
+		format = DumpFormatPlain // Subcommands without --format
+	}
+	if format != DumpFormatPlain && format != DumpFormatDirectory {
+		return nil, fmt.Errorf("--format must be 'plain' or 'directory'")
+	}
+	if archive && format != DumpFormatDirectory {
+		return nil, fmt.Errorf("--archive needs --format directory")
+	}
+	if archiveGzip && !archive {
+		return nil, fmt.Errorf("--archive-gzip needs --archive")
+	}
+	if split && (mode != "export" || format != DumpFormatPlain || output == "-") {
+		return nil, fmt.Errorf("--split needs export mode with --format plain and a file output")
+	}
+	if gitCommit != "" && !gitEnabled {
+		return nil, fmt.Errorf("--git-commit needs --git")
+	}
+	if gitEnabled && output != "" {
+		return nil, fmt.Errorf("--git needs the export written to --output-dir, not --output")
+	}
+	if gitEnabled && strings.Contains(outputDir, "://") {
+		return nil, fmt.Errorf("--git needs a local --output-dir")
+	}
+	if _, err := template.New("git-commit").Parse(gitCommit); err != nil {
+		return nil, fmt.Errorf("invalid --git-commit: %v", err)
+	}
+
+	if missingRoles != MissingRolesError && missingRoles != MissingRolesSkip && missingRoles != MissingRolesCreate {
+		return nil, fmt.Errorf("--missing-roles must be 'error', 'skip' or 'create'")
+	}
+	if createMissingRoles {
+		if cmd.Flags().Changed("missing-roles") && missingRoles != MissingRolesCreate {
+			return nil, fmt.Errorf("--create-missing-roles conflicts with --missing-roles %s", missingRoles)
+		}
+		missingRoles = MissingRolesCreate
+	}
+
+	if force && !bootstrap {
+		return nil, fmt.Errorf("--force only applies with --bootstrap")
+	}
+	if forceRecreate && bootstrap {
+		return nil, fmt.Errorf("--force-recreate cannot be combined with --bootstrap, which never drops the destination")
+	}
+	if bootstrap {
+		if mode != "direct" || maintenanceWindow || comments == CommentsOnly {
+			return nil, fmt.Errorf("--bootstrap needs direct mode and cannot be combined with --maintenance-window or --comments only")
+		}
+		// A new server has none of the roles the schema grants to
+		if !cmd.Flags().Changed("missing-roles") {
+			missingRoles = MissingRolesCreate
+		}
+	}
+
+	if destDBTemplate != "" {
+		if mode != "direct" {
+			return nil, fmt.Errorf("--dest-db-template is only supported in direct mode")
+		}
+		if destDB, _ := cmd.Flags().GetString("dest-db"); destDB != "" {
+			return nil, fmt.Errorf("give the destination database either with --dest-db or --dest-db-template, not both")
+		}
+		if _, err := parseDestNameTemplate(destDBTemplate); err != nil {
+			return nil, err
+		}
+	}
+	if cmd.Flags().Changed("on-collision") && destDBTemplate == "" {
+		return nil, fmt.Errorf("--on-collision only applies with --dest-db-template")
+	}
+	if onCollision != "" && onCollision != OnCollisionFail && onCollision != OnCollisionSuffix && onCollision != OnCollisionReplace {
+		return nil, fmt.Errorf("--on-collision must be 'fail', 'suffix' or 'replace'")
+	}
+	useExistingCase, _ := cmd.Flags().GetBool("use-existing-case")
+	createNewCase, _ := cmd.Flags().GetBool("create-new-case")
+	var databaseCase string
+	switch {
+	case useExistingCase && createNewCase:
+		return nil, fmt.Errorf("--use-existing-case and --create-new-case cannot be used together")
+	case useExistingCase:
+		databaseCase = DatabaseCaseUseExisting
+	case createNewCase:
+		databaseCase = DatabaseCaseCreateNew
+	}
+
+	if comments != CommentsKeep && comments != CommentsStrip && comments != CommentsOnly {
+		return nil, fmt.Errorf("--comments must be 'keep', 'strip' or 'only'")
+	}
+
+	objectKinds, err := parseObjects(objects)
+	if err != nil {
+		return nil, err
+	}
+	// --include-roles is the combination it always stood for
+	roleHandling := RoleHandling{
+		Roles:      roles || includeRoles,
+		Privileges: privileges || includeRoles,
+		Owners:     owners,
+	}
+	if objectKinds[0] != ObjectsAll && (comments == CommentsOnly || roleHandling.Roles || seedFile != "" || bootstrap) {
+		return nil, fmt.Errorf("--objects %s cannot be combined with --comments only, --roles, --seed-file or --bootstrap", objects)
+	}
+	dryRun, planOnly, err := parseDryRun(dryRunLevel)
+	if err != nil {
+		return nil, err
+	}
+	if planOnly && cmd.HasParent() && cmd.Name() != "apply" {
+		return nil, fmt.Errorf("--dry-run=%s plans migrations and applies only; use --dry-run=%s with %s", DryRunPlanOnly, DryRunConnected, cmd.Name())
+	}
+	if planOnly && (objectKinds[0] != ObjectsAll || comments == CommentsOnly) {
+		return nil, fmt.Errorf("--dry-run=%s cannot plan --objects %s or --comments only, which depend on what the destination holds; use --dry-run=%s", DryRunPlanOnly, objects, DryRunConnected)
+	}
+	if planFormat != PlanFormatText && planFormat != PlanFormatJSON {
+		return nil, fmt.Errorf("invalid --plan-format %q, must be 'text' or 'json'", planFormat)
+	}
+	if planFormat == PlanFormatJSON && (!dryRun || mode != "direct" || objectKinds[0] != ObjectsAll || comments == CommentsOnly) {
+		return nil, fmt.Errorf("--plan-format json needs a --dry-run of a full direct migration or apply")
+	}
+	if analyzeJobs < 1 {
+		return nil, fmt.Errorf("--analyze-jobs must be at least 1")
+	}
+	if parallelPhases < 1 {
+		return nil, fmt.Errorf("--parallel-phases must be at least 1")
+	}
+	if pinSearchPath && (objectKinds[0] != ObjectsAll || comments == CommentsOnly || output == "-") {
+		return nil, fmt.Errorf("--pin-search-path needs a full schema export to a file; it cannot be combined with --objects, --comments only or --output -")
+	}
+	if unlogged == "" {
+		unlogged = UnloggedKeep // Subcommands without --unlogged
+	}
+	if err := validateUnloggedMode(unlogged); err != nil {
+		return nil, err
+	}
+	if unlogged != UnloggedKeep && (objectKinds[0] != ObjectsAll || comments == CommentsOnly || output == "-" || format == DumpFormatDirectory) {
+		return nil, fmt.Errorf("--unlogged %s rewrites a plain schema export in a file; it cannot be combined with --objects, --comments only, --output - or --format directory", unlogged)
+	}
+	selection, err := parseObjectSelection(onlyPatterns, skipPatterns, strictSelection)
+	if err != nil {
+		return nil, err
+	}
+	if selection.active() && (objectKinds[0] != ObjectsAll || comments == CommentsOnly || output == "-" || format == DumpFormatDirectory) {
+		return nil, fmt.Errorf("--only and --skip filter a plain schema export in a file; they cannot be combined with --objects, --comments only, --output - or --format directory")
+	}
+	// Directory dumps are handed on as pg_dump wrote them; nothing rewrites them
+	if format == DumpFormatDirectory && (mode != "export" || output != "" || objectKinds[0] != ObjectsAll || comments == CommentsOnly || pinSearchPath) {
+		return nil, fmt.Errorf("--format directory needs export mode and cannot be combined with --output, --objects, --comments only or --pin-search-path")
+	}
+
+	if slowObjectThreshold < 0 {
+		return nil, fmt.Errorf("--slow-object-threshold must not be negative")
+	}
+	if allowApplyErrors < 0 {
+		return nil, fmt.Errorf("--allow-apply-errors must not be negative")
+	}
+	if maxDuration < 0 || exportTimeout < 0 || applyTimeout < 0 {
+		return nil, fmt.Errorf("--max-duration, --export-timeout and --apply-timeout must not be negative")
+	}
+
+	if blobs && noBlobs {
+		return nil, fmt.Errorf("--blobs and --no-blobs are mutually exclusive")
+	}
+	blobMode := ""
+	if blobs {
+		blobMode = "include"
+	} else if noBlobs {
+		blobMode = "exclude"
+	}
+
+	if destConnLimit < -1 {
+		return nil, fmt.Errorf("--dest-connection-limit must be -1 (unlimited) or greater")
+	}
+
+	if seedFile == "" && (disableTriggers || deferConstraints) {
+		return nil, fmt.Errorf("--disable-triggers-during-data and --defer-constraints require --seed-file")
+	}
+	if destFreeSpace < 0 {
+		return nil, fmt.Errorf("--dest-free-space-bytes must not be negative")
+	}
+	if requireOlderThan < 0 {
+		return nil, fmt.Errorf("--require-older-than must not be negative")
+	}
+	artifactNames, err := parseArtifactNameTemplates(artifactTemplates)
+	if err != nil {
+		return nil, err
+	}
+
+	if seedFile != "" {
+		if mode != "direct" {
+			return nil, fmt.Errorf("--seed-file is only supported in direct mode")
+		}
+		if _, err := os.Stat(seedFile); err != nil {
+			return nil, fmt.Errorf("seed file not accessible: %v", err)
+		}
+	}
+
+	ignore, err := loadIgnoreList(ignorePatterns)
+	if err != nil {
+		return nil, err
+	}
+
+	// Export-only runs change nothing and are allowed in blackout windows
+	var blackoutWindows []BlackoutWindow
+	if configPath != "" && mode == "direct" {
+		if blackoutWindows, err = loadBlackoutWindows(configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	notify, err := parseNotifyEmail(notifyEmail, configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var failOnNotice []*regexp.Regexp
+	for _, pattern := range failOnNoticePatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --fail-on-notice pattern %q: %v", pattern, err)
+		}
+		failOnNotice = append(failOnNotice, re)
+	}
+
+	// pg_dump and psql write local files, staged for the upload
+	awsOpts := &AWSOptions{Region: awsRegion, Profile: awsProfile}
+	var staged *stagedOutput
+	if strings.Contains(outputDir, "://") {
+		if staged, err = stageOutput(outputDir, awsOpts); err != nil {
+			return nil, fmt.Errorf("--output-dir: %v", err)
+		}
+		outputDir = staged.dir
+	}
+	var backupUpload Storage
+	if backupUploadTo != "" {
+		if backupUpload, err = openStorage(context.Background(), backupUploadTo, awsOpts); err != nil {
+			return nil, fmt.Errorf("--backup-upload: %v", err)
+		}
+	}
+
 	return &MigrationOptions{
 		Mode:         mode,
 		OutputDir:    outputDir,
 		CreateBackup: !noBackup,
-		BackupDir:    filepath.Join(outputDir, "backup"),
-		IncludeRoles: includeRoles,
+
+		RestoreGrants: !noRestoreGrants,
+
+		ConfirmProduction: confirmProduction,
+		BlackoutWindows:   blackoutWindows,
+		OverrideBlackout:  overrideBlackout,
+
+		Notify: notify,
+
+		BackupDir:     filepath.Join(outputDir, "backup"),
+		Staged:        staged,
+		BackupUpload:  backupUpload,
+		ArtifactNames: artifactNames,
+		RoleHandling:  roleHandling,
+		Roles: RoleFilterOptions{
+			Exclude:       excludeRoles,
+			KeepSuperuser: keepSuperuser,
+		},
+		MissingRoles: missingRoles,
+		Comments:     comments,
+		Objects:      objectKinds,
 		IncludeData:  true, // For rollback scripts
 		DryRun:       dryRun,
+		PlanOnly:     planOnly,
+		PlanFormat:   planFormat,
+		Blobs:        blobMode,
+
+		NoSynchronizedSnapshots: noSyncSnapshots,
+
+		CreateDB: CreateDatabaseOptions{
+			Owner:              destOwner,
+			Template:           destTemplate,
+			Tablespace:         destTablespace,
+			ConnectionLimit:    destConnLimit,
+			ConnectionLimitSet: cmd.Flags().Changed("dest-connection-limit"),
+		},
+		MaintenanceWindow:    maintenanceWindow,
+		Bootstrap:            bootstrap,
+		Force:                force,
+		ForceRecreate:        forceRecreate,
+		OnCollision:          onCollision,
+		DatabaseCase:         databaseCase,
+		SkipUnreadable:       skipUnreadable,
+		AllowEphemeralOutput: allowEphemeralOutput,
+		ActivityCheck: ActivityCheckOptions{
+			Skip:         skipActivityCheck,
+			Threshold:    longTxThreshold,
+			WaitForQuiet: waitForQuiet,
+			Strict:       strictPreflight,
+		},
+		Collation: CollationCheckOptions{
+			FailOnMismatch: failOnCollation || strictPreflight,
+			ReindexScript:  reindexScript,
+		},
+		SpaceCheck: SpaceCheckOptions{
+			Skip:          skipSpaceCheck,
+			FreeBytesHint: destFreeSpace,
+		},
+		SSH: SSHOptions{
+			KeyFile:               sshKey,
+			InsecureIgnoreHostKey: sshInsecure,
+		},
+
+		SeedFile:                  seedFile,
+		DisableTriggersDuringData: disableTriggers,
+		DeferConstraints:          deferConstraints,
+		Analyze: AnalyzeOptions{
+			Skip:   noAnalyze,
+			Vacuum: postVacuum,
+			Jobs:   analyzeJobs,
+		},
+
+		Output:      output,
+		Format:      format,
+		Archive:     archive,
+		Split:       split,
+		Git:         GitOptions{Enabled: gitEnabled, CommitMessage: gitCommit},
+		ArchiveGzip: archiveGzip,
+
+		Selection:      selection,
+		Unlogged:       unlogged,
+		PinSearchPath:  pinSearchPath,
+		KeepOwnership:  keepOwnership,
+		ParallelPhases: parallelPhases,
+
+		PreviewStatements: previewStatements,
+
+		AcceptDestinationLoss:  acceptLoss,
+		RequireOlderThan:       requireOlderThan,
+		AcceptStaleBackup:      acceptStaleBackup,
+		AllowMetaCommands:      allowMetaCommands,
+		AllowClusterStatements: allowClusterStatements,
+		AllowEmptySchema:       allowEmpty,
+
+		AcceptReplicationBreakage: acceptReplication,
+		RecreatePublications:      recreatePubs,
+		Ignore:                    ignore,
+		StrictCodeCompare:         strictCodeCompare,
+		CIMode:                    ciRun,
+
+		FailOnWarning: failOnWarning,
+		FailOnNotice:  failOnNotice,
+
+		AllowApplyErrors:    allowApplyErrors,
+		SlowObjectThreshold: slowObjectThreshold,
+
+		Timeouts: TimeoutOptions{
+			MaxDuration: maxDuration,
+			Phases: map[string]time.Duration{
+				"export": exportTimeout,
+				"apply":  applyTimeout,
+			},
+		},
+
+		RunLabel:    runLabel,
+		MetricsFile: metricsFile,
+		SummaryJSON: summaryJSON,
 	}, nil
 }
 
 func getSourceConfig(cmd *cobra.Command) (*DatabaseConfig, error) {
+	config, err := sourceConfigFromFlags(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if err := obtainCredentials(cmd, config, "source"); err != nil {
+		return nil, fmt.Errorf("failed to read source password: %v", err)
+	}
+	return config, nil
+}
+
+// sourceConfigFromFlags reads and checks the source connection flags,
+// without obtaining a password
+func sourceConfigFromFlags(cmd *cobra.Command) (*DatabaseConfig, error) {
 	sourceHost, _ := cmd.Flags().GetString("source-host")
 	sourcePort, _ := cmd.Flags().GetString("source-port")
 	sourceUser, _ := cmd.Flags().GetString("source-user")
 	sourceDB, _ := cmd.Flags().GetString("source-db")
 	sourceSSL, _ := cmd.Flags().GetString("source-ssl")
+	sourceRole, _ := cmd.Flags().GetString("source-role")
+	sourceOptions, _ := cmd.Flags().GetString("source-options")
+	sourceRootCert, _ := cmd.Flags().GetString("source-sslrootcert")
+	sourceCert, _ := cmd.Flags().GetString("source-sslcert")
+	sourceKey, _ := cmd.Flags().GetString("source-sslkey")
+	sourceMinProtocol, _ := cmd.Flags().GetString("source-ssl-min-protocol")
+	sourceChannelBinding, _ := cmd.Flags().GetString("source-channel-binding")
+	gssEncMode, _ := cmd.Flags().GetString("gssencmode")
+	driver, _ := cmd.Flags().GetString("driver")
+	keepalive, _ := cmd.Flags().GetDuration("keepalive-interval")
+	sourceSSH, _ := cmd.Flags().GetString("source-ssh")
+	sourceStandbyOK, _ := cmd.Flags().GetBool("source-standby-ok")
+	sourceReplica, _ := cmd.Flags().GetBool("source-replica")
+	sourceEnvironment, _ := cmd.Flags().GetString("source-environment")
+
+	sourceAuth, _ := cmd.Flags().GetString("source-auth")
 
 	if err := validateSSLMode(sourceSSL); err != nil {
 		return nil, fmt.Errorf("invalid source SSL mode: %v", err)
 	}
-
-	fmt.Printf("Enter password for source database (%s@%s): ", sourceUser, sourceHost)
-	sourcePassword, err := readPassword()
-	if err != nil {
-		return nil, fmt.Errorf("failed to read source password: %v", err)
+	sourceSSL = sslModeForHost(sourceHost, sourceSSL, cmd.Flags().Changed("source-ssl"))
+	if err := validateSSLMinProtocol(sourceMinProtocol); err != nil {
+		return nil, fmt.Errorf("invalid source SSL minimum protocol: %v", err)
+	}
+	if err := validateDriver(driver); err != nil {
+		return nil, fmt.Errorf("invalid driver: %v", err)
+	}
+	if err := validateClientSecurity(sourceChannelBinding, gssEncMode, sourceSSL, driver); err != nil {
+		return nil, fmt.Errorf("invalid source connection security: %v", err)
+	}
+	if err := validateAuthMode(sourceAuth); err != nil {
+		return nil, fmt.Errorf("invalid source auth mode: %v", err)
+	}
+	if err := validateEnvironment(sourceEnvironment); err != nil {
+		return nil, fmt.Errorf("invalid source environment: %v", err)
 	}
 
-	return &DatabaseConfig{
+	config := &DatabaseConfig{
 		Host:     sourceHost,
 		Port:     sourcePort,
 		Username: sourceUser,
-		Password: sourcePassword,
 		Database: sourceDB,
 		SSLMode:  sourceSSL,
-	}, nil
-}
+		Role:     sourceRole,
+		Options:  sourceOptions,
 
-func getDestConfig(cmd *cobra.Command, sourceDBName string) (*DatabaseConfig, error) {
-	destHost, _ := cmd.Flags().GetString("dest-host")
-	destPort, _ := cmd.Flags().GetString("dest-port")
-	destUser, _ := cmd.Flags().GetString("dest-user")
-	destDB, _ := cmd.Flags().GetString("dest-db")
-	destSSL, _ := cmd.Flags().GetString("dest-ssl")
+		SSLRootCert:    sourceRootCert,
+		SSLCert:        sourceCert,
+		SSLKey:         sourceKey,
+		SSLMinProtocol: sourceMinProtocol,
+		ChannelBinding: sourceChannelBinding,
+		GSSEncMode:     gssEncMode,
+		Driver:         driver,
 
-	if err := validateSSLMode(destSSL); err != nil {
-		return nil, fmt.Errorf("invalid destination SSL mode: %v", err)
+		KeepaliveInterval: keepalive,
+
+		ReadOnly:  true,
+		StandbyOK: sourceStandbyOK,
+		Replica:   sourceReplica,
+
+		Environment: sourceEnvironment,
+
+		SSH:  sourceSSH,
+		Auth: sourceAuth,
 	}
+	return config, nil
+}
 
-	fmt.Printf("Enter password for destination database (%s@%s): ", destUser, destHost)
-	destPassword, err := readPassword()
+func getDestConfig(cmd *cobra.Command, sourceDBName string) (*DatabaseConfig, error) {
+	config, err := destConfigFromFlags(cmd)
 	if err != nil {
+		return nil, err
+	}
+	destDB := config.Database
+
+	if err := obtainCredentials(cmd, config, "destination"); err != nil {
 		return nil, fmt.Errorf("failed to read destination password: %v", err)
 	}
 
+	// Name the destination after the template instead of prompting
+	if destTemplate, _ := cmd.Flags().GetString("dest-db-template"); destDB == "" && destTemplate != "" && currentRun != nil {
+		rendered, err := renderDestName(destTemplate, sourceDBName, currentRun)
+		if err != nil {
+			return nil, err
+		}
+		onCollision, _ := cmd.Flags().GetString("on-collision")
+		currentRun.DestinationName = &DestinationName{
+			Template:    destTemplate,
+			Rendered:    rendered,
+			OnCollision: onCollision,
+			Database:    rendered,
+		}
+		logger.Info(fmt.Sprintf("Destination database: %s (from --dest-db-template %q)", rendered, destTemplate))
+		destDB = rendered
+	}
+
 	// Ask for destination database name if not provided
 	if destDB == "" {
+		if !stdinIsTerminal() {
+			return nil, fmt.Errorf("no destination database given and stdin is not a terminal; pass --dest-db")
+		}
+
 		fmt.Printf("\nDestination database options:\n")
 		fmt.Printf("1. Use same name as source (%s)\n", sourceDBName)
 		fmt.Printf("2. Use different name\n")
@@ -250,53 +1231,139 @@ func getDestConfig(cmd *cobra.Command, sourceDBName string) (*DatabaseConfig, er
 		default:
 			return nil, fmt.Errorf("invalid choice: %s", choice)
 		}
+		if err := validateIdentifier("database name", destDB); err != nil {
+			return nil, err
+		}
+	}
+
+	config.Database = destDB
+	return config, nil
+}
+
+// destConfigFromFlags reads and checks the destination connection flags,
+// without obtaining a password or naming a missing database
+func destConfigFromFlags(cmd *cobra.Command) (*DatabaseConfig, error) {
+	destHost, _ := cmd.Flags().GetString("dest-host")
+	destPort, _ := cmd.Flags().GetString("dest-port")
+	destUser, _ := cmd.Flags().GetString("dest-user")
+	destDB, _ := cmd.Flags().GetString("dest-db")
+	destSSL, _ := cmd.Flags().GetString("dest-ssl")
+	destRole, _ := cmd.Flags().GetString("dest-role")
+	destOptions, _ := cmd.Flags().GetString("dest-options")
+	destRootCert, _ := cmd.Flags().GetString("dest-sslrootcert")
+	destCert, _ := cmd.Flags().GetString("dest-sslcert")
+	destKey, _ := cmd.Flags().GetString("dest-sslkey")
+	destMinProtocol, _ := cmd.Flags().GetString("dest-ssl-min-protocol")
+	destChannelBinding, _ := cmd.Flags().GetString("dest-channel-binding")
+	gssEncMode, _ := cmd.Flags().GetString("gssencmode")
+	driver, _ := cmd.Flags().GetString("driver")
+	keepalive, _ := cmd.Flags().GetDuration("keepalive-interval")
+	destSSH, _ := cmd.Flags().GetString("dest-ssh")
+	destEnvironment, _ := cmd.Flags().GetString("dest-environment")
+	strictSSL, _ := cmd.Flags().GetBool("strict-ssl")
+
+	destAuth, _ := cmd.Flags().GetString("dest-auth")
+
+	if err := validateSSLMode(destSSL); err != nil {
+		return nil, fmt.Errorf("invalid destination SSL mode: %v", err)
+	}
+	destSSL = sslModeForHost(destHost, destSSL, cmd.Flags().Changed("dest-ssl"))
+	if err := validateSSLMinProtocol(destMinProtocol); err != nil {
+		return nil, fmt.Errorf("invalid destination SSL minimum protocol: %v", err)
+	}
+	if err := validateDriver(driver); err != nil {
+		return nil, fmt.Errorf("invalid driver: %v", err)
+	}
+	if err := validateClientSecurity(destChannelBinding, gssEncMode, destSSL, driver); err != nil {
+		return nil, fmt.Errorf("invalid destination connection security: %v", err)
+	}
+	if err := validateAuthMode(destAuth); err != nil {
+		return nil, fmt.Errorf("invalid destination auth mode: %v", err)
+	}
+	if err := validateEnvironment(destEnvironment); err != nil {
+		return nil, fmt.Errorf("invalid destination environment: %v", err)
 	}
 
-	return &DatabaseConfig{
+	config := &DatabaseConfig{
 		Host:     destHost,
 		Port:     destPort,
 		Username: destUser,
-		Password: destPassword,
 		Database: destDB,
 		SSLMode:  destSSL,
-	}, nil
-}
+		Role:     destRole,
+		Options:  destOptions,
 
-func validateSSLMode(sslMode string) error {
-	validModes := []string{"disable", "require", "verify-ca", "verify-full"}
-	for _, mode := range validModes {
-		if sslMode == mode {
-			return nil
-		}
+		SSLRootCert:    destRootCert,
+		SSLCert:        destCert,
+		SSLKey:         destKey,
+		SSLMinProtocol: destMinProtocol,
+		ChannelBinding: destChannelBinding,
+		GSSEncMode:     gssEncMode,
+		Driver:         driver,
+
+		KeepaliveInterval: keepalive,
+		StrictSSL:         strictSSL,
+
+		Environment: destEnvironment,
+
+		SSH:  destSSH,
+		Auth: destAuth,
 	}
-	return fmt.Errorf("must be one of: %s", strings.Join(validModes, ", "))
+	return config, nil
 }
 
 func readPassword() (string, error) {
+	if !stdinIsTerminal() {
+		return "", fmt.Errorf("cannot prompt for a password: stdin is not a terminal")
+	}
 	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
 	if err != nil {
 		return "", err
 	}
-	fmt.Println() // New line after password input
+	fmt.Fprintln(os.Stderr) // New line after password input
 	return string(bytePassword), nil
 }
 
 func validateSourceConnection(source *DatabaseConfig) error {
 	logger.Info("Validating source database connection...")
 
-	sourceConnStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		source.Host, source.Port, source.Username, source.Password, source.Database, source.SSLMode)
+	if err := validateSSLFiles(source); err != nil {
+		return fmt.Errorf("invalid source SSL files: %v", err)
+	}
 
-	sourceDB, err := sql.Open("postgres", sourceConnStr)
+	warnOptionalSSL(source, "Source")
+	if err := negotiateSSLMode(source, source.Database); err != nil {
+		return fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	sourceDB, err := openDB(source, source.Database)
 	if err != nil {
 		return fmt.Errorf("failed to connect to source database: %v", err)
 	}
 	defer sourceDB.Close()
 
 	if err := sourceDB.Ping(); err != nil {
-		return fmt.Errorf("source database ping failed: %v", err)
+		return fmt.Errorf("source database ping failed: %v%s%s", err, connectionErrorHint(err, source, "source"), optionsHint(source, "source"))
 	}
 	logger.Info("Source database connection successful")
+	if err := checkServerFlavor(sourceDB, source, "Source"); err != nil {
+		return err
+	}
+	recordSSLState(sourceDB, source, "Source")
+
+	if err := checkSSLProtocol(sourceDB, source); err != nil {
+		return fmt.Errorf("source SSL check failed: %v", err)
+	}
+	if err := checkClientNegotiation(source, source.Database, "Source"); err != nil {
+		return fmt.Errorf("source client tools connection failed: %v", err)
+	}
+
+	if err := validateRoleMembership(sourceDB, source); err != nil {
+		return fmt.Errorf("source role check failed: %v", err)
+	}
+
+	if err := checkStandby(sourceDB, source); err != nil {
+		return fmt.Errorf("source standby check failed: %v", err)
+	}
 	return nil
 }
 
@@ -305,87 +1372,787 @@ func validateConnections(source, dest *DatabaseConfig) error {
 	if err := validateSourceConnection(source); err != nil {
 		return err
 	}
+	if err := validateDestinationConnection(dest); err != nil {
+		return err
+	}
+	checkVersionCompatibility(source, dest)
+	return nil
+}
 
+func validateDestinationConnection(dest *DatabaseConfig) error {
 	// Validate destination server
 	logger.Info("Validating destination database connection...")
-	destConnStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=postgres sslmode=%s",
-		dest.Host, dest.Port, dest.Username, dest.Password, dest.SSLMode)
+	if err := validateSSLFiles(dest); err != nil {
+		return fmt.Errorf("invalid destination SSL files: %v", err)
+	}
 
-	destDB, err := sql.Open("postgres", destConnStr)
+	warnOptionalSSL(dest, "Destination")
+	if err := negotiateSSLMode(dest, "postgres"); err != nil {
+		return fmt.Errorf("failed to connect to destination server: %v", err)
+	}
+	if err := adjustSSLMode(dest, "postgres", "dest"); err != nil {
+		return fmt.Errorf("failed to connect to destination server: %v", err)
+	}
+	destDB, err := openDatabase(dest, "postgres")
 	if err != nil {
 		return fmt.Errorf("failed to connect to destination server: %v", err)
 	}
 	defer destDB.Close()
 
 	if err := destDB.Ping(); err != nil {
-		return fmt.Errorf("destination server ping failed: %v", err)
+		return fmt.Errorf("destination server ping failed: %v%s%s", err, connectionErrorHint(err, dest, "dest"), optionsHint(dest, "dest"))
 	}
 	logger.Info("Destination server connection successful")
+	if err := checkServerFlavor(destDB, dest, "Destination"); err != nil {
+		return err
+	}
+	if err := checkDestinationWritable(destDB, dest); err != nil {
+		return err
+	}
+	recordSSLState(destDB, dest, "Destination")
+
+	if err := checkSSLProtocol(destDB, dest); err != nil {
+		return fmt.Errorf("destination SSL check failed: %v", err)
+	}
+	if err := checkClientNegotiation(dest, "postgres", "Destination"); err != nil {
+		return fmt.Errorf("destination client tools connection failed: %v", err)
+	}
+
+	if err := validateRoleMembership(destDB, dest); err != nil {
+		return fmt.Errorf("destination role check failed: %v", err)
+	}
 
 	return nil
 }
 
-func performSchemaMigration(source, dest *DatabaseConfig, options *MigrationOptions) error {
-	timestamp := time.Now().Format("20060102_150405")
+// performSchemaMigration runs the migration and returns its result, which
+// records how far the run got when it fails
+func performSchemaMigration(source, dest *DatabaseConfig, options *MigrationOptions, state *RunState) (*RunResult, error) {
+	err := migrateSchema(source, dest, options, state)
+	return state.finish(err), err
+}
+
+func migrateSchema(source, dest *DatabaseConfig, options *MigrationOptions, state *RunState) error {
+	timestamp := state.Timestamp()
 
 	// Create output directories
 	if err := createDirectories(options); err != nil {
 		return fmt.Errorf("failed to create directories: %v", err)
 	}
 
+	// Large objects never travel with a schema-only export, so make that visible
+	checkSourceLargeObjects(source)
+
+	logger.Info(fmt.Sprintf("Roles and privileges: %s", options.RoleHandling))
+	checkRoleHandling(options)
+
+	// Resolve CREATE DATABASE options up front so bad values fail before any changes
+	if options.Mode == "direct" {
+		if err := resolveCreateDatabaseOptions(source, dest, &options.CreateDB); err != nil {
+			return fmt.Errorf("invalid destination database options: %v", err)
+		}
+		if options.Bootstrap {
+			if err := copySourceLocale(source, &options.CreateDB); err != nil {
+				return fmt.Errorf("failed to read the source encoding and locale: %v", err)
+			}
+		}
+	}
+
+	// The backup and export must outlive the run
+	err := state.phase("output-check", func() error {
+		return checkOutputLocations(dest, options, state)
+	})
+	if err != nil {
+		return fmt.Errorf("output directory check failed: %v", err)
+	}
+
+	// An export into a git repository must not clobber local edits there
+	err = state.phase("git-check", func() error {
+		return checkGitOutput(source, dest, options, state)
+	})
+	if err != nil {
+		return fmt.Errorf("git check failed: %v", err)
+	}
+
+	// Make sure nothing on the source is likely to block the export
+	err = state.phase("preflight", func() error {
+		return checkSourceActivity(source, &options.ActivityCheck)
+	})
+	if err != nil {
+		return fmt.Errorf("source activity check failed: %v", err)
+	}
+
+	// Stored code and enums are updated in place, without replacing the database
+	if options.Objects[0] != ObjectsAll {
+		return migrateInPlace(source, dest, options, state)
+	}
+
+	// pg_dump fails on the first table it may not lock, after minutes of work
+	err = state.phase("privilege-check", func() error {
+		return checkSourceReadable(source, options, state)
+	})
+	if err != nil {
+		return fmt.Errorf("source privilege check failed: %v", err)
+	}
+
+	// Indexes built under one collation library version can be corrupt under another
+	if options.Mode == "direct" {
+		err = state.phase("collation-check", func() error {
+			if err := refreshCredentials(source, dest); err != nil {
+				return err
+			}
+			return checkCollations(source, dest, options, state)
+		})
+		if err != nil {
+			return fmt.Errorf("collation check failed: %v", err)
+		}
+	}
+
+	// An empty destination needs no backup, which may run alongside the export
+	if options.Mode == "direct" && options.Comments != CommentsOnly {
+		err = state.phase("empty-check", func() error {
+			if err := refreshCredentials(dest); err != nil {
+				return err
+			}
+			return chooseDestinationPath(dest, options, state)
+		})
+		if err != nil {
+			return fmt.Errorf("destination check failed: %v", err)
+		}
+	}
+
 	// Step 1: Export source schema
-	schemaFile := filepath.Join(options.OutputDir, fmt.Sprintf("schema_%s_%s.sql", source.Database, timestamp))
-	if err := exportSchema(source, schemaFile, options); err != nil {
-		return fmt.Errorf("failed to export schema: %v", err)
+	schemaFile, err := exportPath(source, dest, options, state)
+	if err != nil {
+		return err
+	}
+	var stdout io.Writer
+	switch options.Output {
+	case "":
+		if err := os.MkdirAll(filepath.Dir(schemaFile), 0755); err != nil {
+			return err
+		}
+	case "-":
+		schemaFile = ""
+		stdout = os.Stdout
+	}
+	export := concurrentPhase{name: "export", config: source, fn: func() error {
+		if err := refreshCredentials(source); err != nil {
+			return err
+		}
+		if source.Replica {
+			replica, err := measureReplicaLag(source)
+			if err != nil {
+				warn(WarnReplicaLagUnknown, fmt.Sprintf("Could not measure the replay lag of the source replica: %v", err))
+				replica = &ReplicaExport{Host: source.Host}
+			} else {
+				source.output().Info(fmt.Sprintf("Exporting from replica %s, %s", source.Host, replica))
+			}
+			state.SourceReplica = replica
+		}
+		header := newFileHeader(FileKindSchema, "pg_dump", source, state)
+		if stdout != nil {
+			if err := header.write(stdout); err != nil {
+				return err
+			}
+		}
+		if err := exportSchema(source, schemaFile, stdout, options, state.SourceReplica); err != nil {
+			return fmt.Errorf("failed to export schema: %v", err)
+		}
+		if schemaFile != "" && options.Format == DumpFormatPlain {
+			if err := prependFileHeader(schemaFile, header); err != nil {
+				return fmt.Errorf("failed to write the file header: %v", err)
+			}
+		}
+		return nil
+	}}
+	phases := []concurrentPhase{export}
+	// The backup reads the destination while the export reads the source;
+	// nothing destructive starts before both are done
+	if options.Mode == "direct" && options.CreateBackup && options.Comments != CommentsOnly && state.DestinationPath != DestinationInPlace {
+		phases = append(phases, concurrentPhase{name: "backup", config: dest, fn: func() error {
+			return backupDestination(dest, timestamp, options, state)
+		}})
+	}
+	if err := state.concurrentPhases(options.ParallelPhases, phases...); err != nil {
+		return err
+	}
+	if options.Selection.active() {
+		err = state.phase("selection", func() error {
+			report, err := selectDumpObjects(schemaFile, &options.Selection, options.DryRun)
+			state.Selection = report
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("object selection failed: %v", err)
+		}
+	}
+	if schemaFile != "" {
+		state.SchemaFile = schemaFile
+		if counts, err := countDumpObjects(schemaFile); err == nil {
+			state.ObjectCounts = counts
+		}
+	}
+	// An export of the wrong database succeeds just the same, and the drop
+	// would then leave an empty destination behind
+	if schemaFile != "" && options.Format == DumpFormatPlain && options.Comments != CommentsOnly {
+		if err := checkExportedSchema(source, schemaFile, state.ObjectCounts, options); err != nil {
+			return err
+		}
+	}
+
+	// pg_dump --no-owner still leaves some ownership statements behind
+	if schemaFile != "" && options.Format == DumpFormatPlain && options.Comments != CommentsOnly {
+		err = state.phase("ownership-strip", func() error {
+			return stripOwnership(schemaFile, timestamp, source, options, state)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to strip ownership statements: %v", err)
+		}
+
+		// Unlogged tables are emptied after a crash; temporary objects don't belong in a dump
+		err = state.phase("unlogged", func() error {
+			return applyUnloggedMode(schemaFile, options, state)
+		})
+		if err != nil {
+			return fmt.Errorf("unlogged table handling failed: %v", err)
+		}
+	}
+
+	// Function bodies are the one place names are still resolved at runtime
+	if options.Comments != CommentsOnly {
+		err = state.phase("search-path-audit", func() error {
+			if err := refreshCredentials(source); err != nil {
+				return err
+			}
+			findings, err := auditSearchPath(source)
+			if err != nil {
+				warn(WarnSearchPathAuditFailed, fmt.Sprintf("Search path audit failed (continuing): %v", err))
+			} else {
+				state.SearchPathFindings = findings
+				reportSearchPathFindings(findings)
+			}
+			if !options.PinSearchPath {
+				return nil
+			}
+			pinned, err := pinSearchPathFile(schemaFile)
+			if err != nil {
+				return fmt.Errorf("failed to pin search_path: %v", err)
+			}
+			state.PinnedFunctions = pinned
+			logger.Info(fmt.Sprintf("Pinned the search_path of %d function(s) (--pin-search-path)", len(pinned)))
+			for _, name := range pinned {
+				logger.Info("   " + name)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Roles are cluster-wide and not part of pg_dump's output
+	if options.RoleHandling.Roles && options.Output != "-" {
+		rolesFile := rolesFilePath(options, source, timestamp)
+		err = state.phase("roles-export", func() error {
+			report, err := exportRoles(source, rolesFile, options)
+			state.RoleFilter = report
+			if err != nil {
+				return err
+			}
+			return prependFileHeader(rolesFile, newFileHeader(FileKindRoles, "pg_dumpall", source, state))
+		})
+		if err != nil {
+			return fmt.Errorf("failed to export roles: %v", err)
+		}
+		state.RolesFile = rolesFile
 	}
 
-	// if options.Mode == "export" {
-	// 	logger.Success(fmt.Sprintf("Schema exported to: %s", schemaFile))
-	// 	return generateMigrationInstructions(options.OutputDir, schemaFile)
-	// }
+	// A directory dump can't be read without pg_restore, so its table of
+	// contents is saved as text next to it
+	if schemaFile != "" && options.Format == DumpFormatDirectory {
+		err = state.phase("toc", func() error {
+			path, entries, err := writeDumpTOC(source, schemaFile)
+			state.TOCFile, state.TOC = path, entries
+			if state.ObjectCounts == nil && err == nil {
+				state.ObjectCounts = make(map[string]int)
+				for _, e := range entries {
+					state.ObjectCounts[strings.ToLower(e.Type)]++
+				}
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list the dump's table of contents: %v", err)
+		}
+	}
+
+	// Thousands of files travel better as one
+	if options.Archive {
+		archive := schemaFile + ".tar"
+		if options.ArchiveGzip {
+			archive += ".gz"
+		}
+		err = state.phase("archive", func() error {
+			return archiveDumpDirectory(schemaFile, archive, options.ArchiveGzip)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to archive the directory dump: %v", err)
+		}
+		logger.Info(fmt.Sprintf("Archived the directory dump with its checksum in %s", archive+checksumSuffix))
+		schemaFile = archive
+		state.SchemaFile = archive
+	}
+
+	// One file per object reviews and versions better than one large file
+	if options.Split && schemaFile != "" {
+		err = state.phase("split", func() error {
+			dir, err := splitSchemaFile(schemaFile)
+			state.SplitDir = dir
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to split the schema: %v", err)
+		}
+	}
+
+	// What changed since the last export committed, and the commit of this one
+	if state.Git != nil {
+		err = state.phase("git", func() error {
+			return recordGitChanges(source, schemaFile, options, state)
+		})
+		if err != nil {
+			return fmt.Errorf("git commit of the export failed: %v", err)
+		}
+	}
+
+	if options.Mode == "export" {
+		if schemaFile != "" {
+			logger.Success(fmt.Sprintf("Schema exported to: %s", schemaFile))
+		}
+		return nil
+	}
 
 	// Direct migration mode continues...
+	return migrateDestination(dest, schemaFile, timestamp, options, state)
+}
+
+// migrateDestination replaces the destination database with schemaFile:
+// backup, drop and recreate, apply, optional seed data and rollback script.
+// Each completed step is recorded so an interrupted run can be resumed, and
+// steps a resumed run already completed are skipped.
+func migrateDestination(dest *DatabaseConfig, schemaFile, timestamp string, options *MigrationOptions, state *RunState) error {
+	if options.Comments == CommentsOnly {
+		return syncComments(dest, schemaFile, options, state)
+	}
+
+	state.startResumeState(dest, schemaFile, timestamp, options)
+
+	// Aurora lacks some of the parameters a pg_dump script sets
+	if dest.Flavor.is(FlavorAurora) && !state.done(StepApplied) {
+		err := state.phase("aurora-settings", func() error {
+			if err := refreshCredentials(dest); err != nil {
+				return err
+			}
+			filtered, skipped, err := skipUnsupportedSettings(dest, schemaFile)
+			if err != nil {
+				return err
+			}
+			schemaFile, state.SkippedSettings = filtered, skipped
+			if len(skipped) > 0 {
+				warn(WarnSettingsSkipped, fmt.Sprintf("Skipping %d statement(s) of the schema setting parameters Aurora doesn't have:\n   %s", len(skipped), strings.Join(skipped, "\n   ")))
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to check the schema's settings against Aurora: %v", err)
+		}
+	}
+
+	// A bootstrap only goes ahead on a destination with nothing to lose
+	if options.Bootstrap && !state.done(StepCreated) {
+		err := state.phase("bootstrap-check", func() error {
+			if err := refreshCredentials(dest); err != nil {
+				return err
+			}
+			return checkBootstrapTarget(dest, schemaFile, options, state)
+		})
+		if err != nil {
+			return fmt.Errorf("bootstrap check failed: %v", err)
+		}
+	}
+
+	// Runs of apply haven't looked at the destination yet
+	if !state.done(StepCreated) && state.DestinationPath == "" {
+		err := state.phase("empty-check", func() error {
+			if err := refreshCredentials(dest); err != nil {
+				return err
+			}
+			return chooseDestinationPath(dest, options, state)
+		})
+		if err != nil {
+			return fmt.Errorf("destination check failed: %v", err)
+		}
+	}
+	inPlace := state.DestinationPath == DestinationInPlace
+
+	// psql follows \connect out of the destination for the rest of the file
+	err := state.phase("database-switch-check", func() error {
+		return checkDatabaseSwitches(schemaFile, options)
+	})
+	if err != nil {
+		return fmt.Errorf("schema file check failed: %v", err)
+	}
+	err = state.phase("cluster-statement-check", func() error {
+		return checkClusterStatements(schemaFile, options)
+	})
+	if err != nil {
+		return fmt.Errorf("schema file check failed: %v", err)
+	}
 
-	// Step 2: Create backup of destination (if exists and backup enabled)
-	var backupFile string
-	if options.CreateBackup {
-		backupFile = filepath.Join(options.BackupDir, fmt.Sprintf("backup_%s_%s.sql", dest.Database, timestamp))
-		if err := createDestinationBackup(dest, backupFile, options); err != nil {
-			logger.Warning(fmt.Sprintf("Backup creation failed (continuing): %v", err))
+	// The checks only matter while the destination is still intact
+	if !state.done(StepDropped) {
+		// Show where the last migration left the destination
+		err := state.phase("marker-check", func() error {
+			if err := refreshCredentials(dest); err != nil {
+				return err
+			}
+			return checkMigrationMarker(dest, schemaFile, options, state)
+		})
+		if err != nil {
+			return fmt.Errorf("migration marker check failed: %v", err)
 		}
+
+		// Show what the drop destroys that the schema doesn't bring back
+		if !options.Bootstrap && !inPlace {
+			err := state.phase("loss-check", func() error {
+				if err := refreshCredentials(dest); err != nil {
+					return err
+				}
+				return checkDestinationLoss(dest, schemaFile, options, state)
+			})
+			if err != nil {
+				return fmt.Errorf("destination loss check failed: %v", err)
+			}
+
+			// Subscribers of the destination silently stop receiving changes
+			err = state.phase("replication-check", func() error {
+				if err := refreshCredentials(dest); err != nil {
+					return err
+				}
+				return checkReplicationBreakage(dest, options, state)
+			})
+			if err != nil {
+				return fmt.Errorf("replication check failed: %v", err)
+			}
+
+			// Database-level grants and settings go with the database
+			err = state.phase("grants-snapshot", func() error {
+				if err := refreshCredentials(dest); err != nil {
+					return err
+				}
+				return snapshotDestinationGrants(dest, options, state)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to save destination grants: %v", err)
+			}
+		}
+
+		// Fail before the drop when grants and ownership would name unknown roles
+		err = state.phase("roles-check", func() error {
+			if err := refreshCredentials(dest); err != nil {
+				return err
+			}
+			return checkMissingRoles(dest, schemaFile, options, state)
+		})
+		if err != nil {
+			return fmt.Errorf("missing roles check failed: %v", err)
+		}
+
+		// A load that runs out of disk leaves a half-restored database behind
+		err = state.phase("space-check", func() error {
+			if err := refreshCredentials(state.Source, dest); err != nil {
+				return err
+			}
+			return checkDestinationSpace(state.Source, dest, options)
+		})
+		if err != nil {
+			return fmt.Errorf("disk space check failed: %v", err)
+		}
+	}
+
+	// Step 2: Create backup of destination (if exists and backup enabled),
+	// unless it was taken alongside the export or there is nothing in it
+	if options.CreateBackup && !inPlace && !state.done(StepBackedUp) {
+		if !state.backupTaken {
+			err := state.phase("backup", func() error {
+				return backupDestination(dest, timestamp, options, state)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		state.checkpoint(StepBackedUp)
 	}
+	backupFile := state.BackupFile
 
+	if options.DryRun && options.PlanFormat == PlanFormatJSON {
+		if err := writePlan(os.Stdout, buildPlan(dest, schemaFile, backupFile, options, state)); err != nil {
+			return fmt.Errorf("failed to write plan: %v", err)
+		}
+		return generateRollbackScript(dest, backupFile, options, state)
+	}
 	if options.DryRun {
-		logger.Info("DRY RUN MODE - showing what would be done:")
-		logger.Info(fmt.Sprintf("1. Drop and recreate database: %s", dest.Database))
-		logger.Info(fmt.Sprintf("2. Apply schema from: %s", schemaFile))
-		if options.CreateBackup && backupFile != "" {
-			logger.Info(fmt.Sprintf("3. Backup created at: %s", backupFile))
+		logPlan(dest, schemaFile, backupFile, options, state)
+		return generateRollbackScript(dest, backupFile, options, state)
+	}
+
+	var window *maintenanceWindow
+	if options.MaintenanceWindow {
+		window = newMaintenanceWindow(dest)
+		defer window.RestoreUnlessFinished()
+
+		if err := window.Begin(); err != nil {
+			return fmt.Errorf("failed to block connections to destination: %v", err)
 		}
-		return generateRollbackScript(dest, backupFile, options)
 	}
 
-	// Step 3: Drop and recreate destination database
-	if err := recreateDestinationDatabase(dest); err != nil {
-		return fmt.Errorf("failed to recreate destination database: %v", err)
+	// Writes since the backup would be lost by a rollback
+	if options.CreateBackup && !options.Bootstrap && !inPlace && !state.done(StepDropped) {
+		err := state.phase("stale-backup-check", func() error {
+			if err := refreshCredentials(dest); err != nil {
+				return err
+			}
+			return checkStaleBackup(dest, timestamp, options, state, window)
+		})
+		if err != nil {
+			return fmt.Errorf("stale backup check failed: %v", err)
+		}
+		// Taken again, or put back
+		backupFile = state.BackupFile
+	}
+
+	// Step 3: Drop and recreate destination database; a bootstrap only
+	// creates it when missing
+	if options.Bootstrap && !state.done(StepCreated) {
+		err := state.phase("create", func() error {
+			if state.Bootstrap.DatabaseExisted {
+				return nil
+			}
+			if err := refreshCredentials(dest); err != nil {
+				return err
+			}
+			return createDatabase(dest, &options.CreateDB)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create destination database: %v", err)
+		}
+		state.checkpoint(StepCreated)
+	}
+	if inPlace && !state.done(StepCreated) {
+		logger.Info(fmt.Sprintf("Destination database '%s' is empty, applying schema in place", dest.Database))
+		state.checkpoint(StepCreated)
+	}
+	if !state.done(StepCreated) {
+		err := state.phase("recreate", func() error {
+			if err := refreshCredentials(dest); err != nil {
+				return err
+			}
+			if err := recreateDestinationDatabase(dest, &options.CreateDB, state); err != nil {
+				return fmt.Errorf("failed to recreate destination database: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if window != nil {
+		if err := window.LockNew(); err != nil {
+			return fmt.Errorf("failed to block connections to new database: %v", err)
+		}
+	}
+
+	// Roles first, so grants and ownership in the schema resolve
+	if state.RolesFile != "" && !state.done(StepRolesApplied) {
+		err := state.phase("roles", func() error {
+			if err := refreshCredentials(dest); err != nil {
+				return err
+			}
+			return applyRoles(dest, state.RolesFile)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply roles: %v", err)
+		}
+		state.checkpoint(StepRolesApplied)
+	}
+	if len(state.MissingRoles) > 0 && !state.done(StepRolesCreated) {
+		err := state.phase("missing-roles", func() error {
+			if err := refreshCredentials(dest); err != nil {
+				return err
+			}
+			return createMissingRoles(dest, state)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create missing roles: %v", err)
+		}
+		state.checkpoint(StepRolesCreated)
+	}
+
+	if options.Bootstrap && !state.done(StepApplied) {
+		err := state.phase("extensions", func() error {
+			if err := refreshCredentials(dest); err != nil {
+				return err
+			}
+			return createBootstrapExtensions(dest, schemaFile, state)
+		})
+		if err != nil {
+			return err
+		}
 	}
 
 	// Step 4: Apply schema to destination
-	if err := applySchema(dest, schemaFile); err != nil {
-		return fmt.Errorf("failed to apply schema: %v", err)
+	if !state.done(StepApplied) {
+		state.checkpoint(StepApplying)
+		if err := applyPhase(dest, schemaFile, options, state); err != nil {
+			reportTimedOutApply(dest, backupFile, options, state)
+			return err
+		}
+		state.checkpoint(StepApplied)
 	}
 
-	// Step 5: Generate rollback script
-	if err := generateRollbackScript(dest, backupFile, options); err != nil {
-		logger.Warning(fmt.Sprintf("Failed to generate rollback script: %v", err))
+	// Give subscribers something to be re-pointed to
+	if state.Replication != nil && !state.done(StepSeeded) {
+		err := state.phase("publications", func() error {
+			if err := refreshCredentials(dest); err != nil {
+				return err
+			}
+			return restoreReplication(dest, state.Replication, options)
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	return nil
+	// Step 5: Load seed data (optional); it runs in one transaction, so an
+	// interrupted load is simply repeated
+	if options.SeedFile != "" && !state.done(StepSeeded) {
+		err := state.phase("seed", func() error {
+			if err := refreshCredentials(dest); err != nil {
+				return err
+			}
+			if err := loadSeedData(dest, options); err != nil {
+				return fmt.Errorf("failed to load seed data: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			reportTimedOutApply(dest, backupFile, options, state)
+			return err
+		}
+		state.checkpoint(StepSeeded)
+
+		// Freshly loaded tables have no statistics to plan with
+		if !options.Analyze.Skip {
+			err := state.phase("analyze", func() error {
+				if err := refreshCredentials(dest); err != nil {
+					return err
+				}
+				return analyzeLoadedTables(dest, &options.Analyze, state)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if window != nil {
+		if err := window.End(); err != nil {
+			return fmt.Errorf("failed to restore connections to destination: %v", err)
+		}
+	}
+
+	// After the connection settings, so a revoked CONNECT stays revoked
+	if state.Grants != nil && !options.RestoreGrants {
+		state.Grants.Skipped = true
+		logger.Info(fmt.Sprintf("Destination grants and settings not re-applied (--no-restore-grants); they are saved in %s", state.Grants.File))
+	} else if state.Grants != nil {
+		err := state.phase("grants", func() error {
+			if err := refreshCredentials(dest); err != nil {
+				return err
+			}
+			return restoreDestinationGrants(dest, state.Grants)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to re-apply destination grants: %v", err)
+		}
+	}
+
+	// Step 6: Generate rollback script
+	if err := generateRollbackScript(dest, backupFile, options, state); errors.Is(err, errRollbackScriptInvalid) {
+		return err
+	} else if err != nil {
+		warn(WarnRollbackScriptFailed, fmt.Sprintf("Failed to generate rollback script: %v", err))
+	}
+
+	state.checkpoint(StepCompleted)
+
+	// The next run shows where this one left the destination
+	recordMigrationMarker(dest, schemaFile, options, state)
+
+	// An apply can succeed and still leave constraints unvalidated
+	return state.phase("verify", func() error {
+		if err := refreshCredentials(state.Source, dest); err != nil {
+			return err
+		}
+		return verifyDestination(dest, schemaFile, timestamp, options, state)
+	})
+}
+
+// applyPhase applies schemaFile to dest as the run's apply phase, recording
+// the server notices it raises and failing on more errors than allowed
+func applyPhase(dest *DatabaseConfig, schemaFile string, options *MigrationOptions, state *RunState) error {
+	return state.phase("apply", func() error {
+		if err := refreshCredentials(dest); err != nil {
+			return err
+		}
+		notices := &noticeCollector{}
+		timer, err := newObjectTimer(schemaFile)
+		if err != nil {
+			logger.Warning(fmt.Sprintf("Not timing the objects of the apply: %v", err))
+			timer = nil
+		}
+		err = applySchema(dest, schemaFile, notices, timer)
+		state.Notices = notices.notices
+		if timer != nil {
+			releaseScratch(timer.path)
+			state.ObjectTimings = timer.timings
+			reportObjectTimings(timer.timings, options.SlowObjectThreshold)
+		}
+		if len(notices.notices) > 0 {
+			logger.Info(fmt.Sprintf("Apply notices: %s", notices.summary()))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to apply schema: %v", err)
+		}
+		if err := checkApplyErrors(notices, schemaFile, options.AllowApplyErrors, state.SkippedRoles, state); err != nil {
+			return err
+		}
+		return checkFailOnNotice(notices.notices, options.FailOnNotice)
+	})
 }
 
 func createDirectories(options *MigrationOptions) error {
-	dirs := []string{options.OutputDir}
-	if options.CreateBackup {
+	var dirs []string
+	switch options.Output {
+	case "":
+		dirs = append(dirs, options.OutputDir)
+	case "-":
+	default:
+		dirs = append(dirs, filepath.Dir(options.Output))
+	}
+	if options.CreateBackup && options.Mode == "direct" {
 		dirs = append(dirs, options.BackupDir)
 	}
 
@@ -397,48 +2164,176 @@ func createDirectories(options *MigrationOptions) error {
 	return nil
 }
 
-func exportSchema(config *DatabaseConfig, outputFile string, options *MigrationOptions) error {
-	logger.Info(fmt.Sprintf("Exporting schema from database '%s'...", config.Database))
+// exportPath is where the schema of source is exported to: --output, or the
+// schema artifact in the output directory ("-" streams it to stdout)
+func exportPath(source, dest *DatabaseConfig, options *MigrationOptions, state *RunState) (string, error) {
+	if options.Output != "" {
+		return options.Output, nil
+	}
+	schemaFile, err := options.artifactPath(ArtifactSchema, newArtifactNameData(source, dest, state.Timestamp(), state))
+	if err != nil {
+		return "", err
+	}
+	if options.Format == DumpFormatDirectory {
+		schemaFile = strings.TrimSuffix(schemaFile, ".sql")
+	}
+	return schemaFile, nil
+}
+
+// checkExportedSchema fails when the plain-format export of source is empty
+// or holds no objects, unless --allow-empty-schema is given
+func checkExportedSchema(source *DatabaseConfig, schemaFile string, counts map[string]int, options *MigrationOptions) error {
+	info, err := os.Stat(schemaFile)
+	if err != nil {
+		return err
+	}
+	var problem string
+	switch {
+	case info.Size() == 0:
+		problem = fmt.Sprintf("the exported schema file %s is empty", schemaFile)
+	case totalObjects(counts) == 0:
+		problem = fmt.Sprintf("the exported schema of '%s' contains no objects", source.Database)
+	default:
+		logger.Info(fmt.Sprintf("Exported %d object(s) from '%s'", totalObjects(counts), source.Database))
+		return nil
+	}
+	if options.AllowEmptySchema {
+		warn(WarnEmptySchema, fmt.Sprintf("Continuing because of --allow-empty-schema: %s", problem))
+		return nil
+	}
+	return fmt.Errorf("%s; check that --source-db names the right database, or pass --allow-empty-schema if it is meant to be empty", problem)
+}
+
+// exportSchema dumps the schema of config to outputFile, or streams it to w
+// when w is not nil.
+func exportSchema(config *DatabaseConfig, outputFile string, w io.Writer, options *MigrationOptions, replica *ReplicaExport) error {
+	config.output().Info(fmt.Sprintf("Exporting schema from database '%s'...", config.Database))
+	args := exportSchemaArgs(config, options)
+
+	// COMMENT entries are picked out of the complete dump, so a stream goes
+	// through a temporary file first
+	var stream io.Writer
+	if w != nil && options.Comments == CommentsOnly {
+		tmp, err := scratchFile("export-*.sql")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		outputFile, stream, w = tmp.Name(), w, nil
+	}
+
+	if w != nil {
+		// Output already streamed can't be taken back, so no retries
+		cmd := clientCommand(config, "pg_dump", args)
+		cmd.Stdout = w
+		cmd.Stderr = config.output().Stderr()
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("pg_dump failed: %v", err)
+		}
+	} else {
+		args = append(args, "-f", outputFile)
+		err := retryRecoveryConflicts(config, replica, func(stderr io.Writer) error {
+			// pg_dump refuses to write a directory dump into an existing directory
+			if options.Format == DumpFormatDirectory {
+				if err := os.RemoveAll(outputFile); err != nil {
+					return err
+				}
+			}
+			cmd := clientCommand(config, "pg_dump", args, outputFile)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = stderr
+			return cmd.Run()
+		})
+		if err != nil {
+			return fmt.Errorf("pg_dump failed: %v", err)
+		}
+	}
 
-	// Set environment variables
-	os.Setenv("PGPASSWORD", config.Password)
-	defer os.Unsetenv("PGPASSWORD")
-	os.Setenv("PGSSLMODE", config.SSLMode)
-	defer os.Unsetenv("PGSSLMODE")
+	if options.Comments == CommentsOnly {
+		if err := keepOnlyComments(outputFile, stream); err != nil {
+			return fmt.Errorf("failed to filter comments: %v", err)
+		}
+	}
 
+	config.output().Info("Schema export completed")
+	return nil
+}
+
+// exportSchemaArgs returns the pg_dump arguments exporting the schema of
+// config, without the output file
+func exportSchemaArgs(config *DatabaseConfig, options *MigrationOptions) []string {
 	// Build pg_dump command for schema only
 	args := []string{
 		"-h", config.Host,
 		"-p", config.Port,
 		"-U", config.Username,
-		"-d", config.Database,
-		"-f", outputFile,
+		"-d", dbnameArg(config.Database),
 		"--schema-only",   // Schema only, no data
-		"--no-owner",      // Don't include ownership commands
-		"--no-privileges", // Don't include privilege commands (unless explicitly wanted)
+		"--no-owner",      // Don't include ownership commands (unless --owners)
+		"--no-privileges", // Don't include privilege commands (unless --privileges)
 		"--verbose",
 		"--no-password",
 	}
 
-	// Include roles and privileges if requested
-	if options.IncludeRoles {
-		// Remove --no-privileges flag
+	if config.Role != "" {
+		args = append(args, "--role="+config.Role)
+	}
+
+	if options.RoleHandling.Owners {
+		args = removeFromSlice(args, "--no-owner")
+	}
+	if options.RoleHandling.Privileges {
 		args = removeFromSlice(args, "--no-privileges")
 	}
 
-	cmd := exec.Command("pg_dump", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	if options.Comments == CommentsStrip {
+		args = append(args, "--no-comments")
+	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("pg_dump failed: %v", err)
+	if options.NoSynchronizedSnapshots {
+		args = append(args, "--no-synchronized-snapshots")
+	}
+	if options.Format == DumpFormatDirectory {
+		args = append(args, "--format=directory")
 	}
+	for _, table := range options.ExcludeTables {
+		args = append(args, "--exclude-table="+table)
+	}
+	return args
+}
 
-	logger.Info("Schema export completed")
+// backupDestination runs the backup step: a failed backup is only a warning,
+// except for production destinations
+func backupDestination(dest *DatabaseConfig, timestamp string, options *MigrationOptions, state *RunState) error {
+	state.backupTaken = true
+	if err := refreshCredentials(dest); err != nil {
+		return err
+	}
+	backupFile, err := options.artifactPath(ArtifactBackup, newArtifactNameData(state.Source, dest, timestamp, state))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(backupFile), 0755); err != nil {
+		return err
+	}
+	activity := backupActivity(dest)
+	err = createDestinationBackup(dest, backupFile, options, state)
+	if err != nil && dest.Environment == EnvProduction {
+		return fmt.Errorf("backup of production destination failed: %v", err)
+	}
+	if err != nil {
+		warn(WarnBackupSkipped, fmt.Sprintf("Backup creation failed (continuing): %v", err))
+		return nil
+	}
+	state.BackupActivity = activity
+	state.BackupFile = backupFile
 	return nil
 }
 
-func createDestinationBackup(config *DatabaseConfig, backupFile string, options *MigrationOptions) error {
+// createDestinationBackup backs config up to backupFile. pg_dump writes next
+// to it and the file is renamed into place once complete, so a failed dump
+// leaves an earlier backup of the same name as it was.
+func createDestinationBackup(config *DatabaseConfig, backupFile string, options *MigrationOptions, state *RunState) error {
 	// Check if destination database exists
 	exists, err := databaseExists(config)
 	if err != nil {
@@ -446,65 +2341,81 @@ func createDestinationBackup(config *DatabaseConfig, backupFile string, options
 	}
 
 	if !exists {
-		logger.Info("Destination database doesn't exist, skipping backup")
+		config.output().Info("Destination database doesn't exist, skipping backup")
 		return nil
 	}
 
-	logger.Info(fmt.Sprintf("Creating backup of destination database '%s'...", config.Database))
+	config.output().Info(fmt.Sprintf("Creating backup of destination database '%s'...", config.Database))
 
-	// Set environment variables
-	os.Setenv("PGPASSWORD", config.Password)
-	defer os.Unsetenv("PGPASSWORD")
-	os.Setenv("PGSSLMODE", config.SSLMode)
-	defer os.Unsetenv("PGSSLMODE")
+	header := newFileHeader(FileKindBackup, "pg_dump", config, state)
+	partial := backupFile + ".partial"
+	defer os.Remove(partial)
+	cmd := clientCommand(config, "pg_dump", backupArgs(config, partial, options), partial)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = config.output().Stderr()
 
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("backup pg_dump failed: %v", err)
+	}
+	if err := prependFileHeader(partial, header); err != nil {
+		return fmt.Errorf("failed to write the backup file header: %v", err)
+	}
+	if err := os.Rename(partial, backupFile); err != nil {
+		return fmt.Errorf("failed to move the backup into place: %v", err)
+	}
+
+	config.output().Info("Backup created successfully")
+	return nil
+}
+
+// backupArgs returns the pg_dump arguments backing config up to backupFile
+func backupArgs(config *DatabaseConfig, backupFile string, options *MigrationOptions) []string {
 	args := []string{
 		"-h", config.Host,
 		"-p", config.Port,
 		"-U", config.Username,
-		"-d", config.Database,
+		"-d", dbnameArg(config.Database),
 		"-f", backupFile,
 		"--verbose",
 		"--no-password",
 	}
+	if config.Role != "" {
+		args = append(args, "--role="+config.Role)
+	}
 
 	// Include data in backup for complete rollback capability
 	if options.IncludeData {
 		// Full backup including data
+		args = append(args, largeObjectArgs(config, options)...)
 	} else {
 		args = append(args, "--schema-only")
 	}
-
-	cmd := exec.Command("pg_dump", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("backup pg_dump failed: %v", err)
-	}
-
-	logger.Info("Backup created successfully")
-	return nil
+	return args
 }
 
-func recreateDestinationDatabase(config *DatabaseConfig) error {
+func recreateDestinationDatabase(config *DatabaseConfig, createOpts *CreateDatabaseOptions, state *RunState) error {
 	// Drop database if exists
-	if err := dropDatabaseIfExists(config); err != nil {
-		return err
+	if !state.done(StepDropped) {
+		// Logical slots keep a database from being dropped
+		if err := dropReplicationSlots(config, state.Replication); err != nil {
+			return err
+		}
+		if err := dropDatabaseIfExists(config); err != nil {
+			return err
+		}
+		state.checkpoint(StepDropped)
 	}
 
 	// Create database
-	if err := createDatabase(config); err != nil {
+	if err := createDatabase(config, createOpts); err != nil {
 		return err
 	}
+	state.checkpoint(StepCreated)
 
 	return nil
 }
 func databaseExists(config *DatabaseConfig) (bool, error) {
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=postgres sslmode=%s",
-		config.Host, config.Port, config.Username, config.Password, config.SSLMode)
-
-	db, err := sql.Open("postgres", connStr)
+	db, err := openDatabase(config, "postgres")
 	if err != nil {
 		return false, err
 	}
@@ -517,6 +2428,17 @@ func databaseExists(config *DatabaseConfig) (bool, error) {
 	return exists, err
 }
 
+// terminateConnectionsQuery ends the other sessions on database $1 before the drop
+const terminateConnectionsQuery = `
+		SELECT pg_terminate_backend(pid)
+		FROM pg_stat_activity
+		WHERE datname = $1 AND pid <> pg_backend_pid()`
+
+// dropDatabaseStatement drops the database called name, quoted to preserve case
+func dropDatabaseStatement(name string) string {
+	return fmt.Sprintf(`DROP DATABASE %s`, quoteIdentifier(name))
+}
+
 func dropDatabaseIfExists(config *DatabaseConfig) error {
 	exists, err := databaseExists(config)
 	if err != nil {
@@ -530,29 +2452,23 @@ func dropDatabaseIfExists(config *DatabaseConfig) error {
 
 	logger.Info(fmt.Sprintf("Dropping existing database '%s'", config.Database))
 
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=postgres sslmode=%s",
-		config.Host, config.Port, config.Username, config.Password, config.SSLMode)
-
-	db, err := sql.Open("postgres", connStr)
+	db, err := openDatabase(config, "postgres")
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	// Terminate connections to the database
-	terminateQuery := `
-		SELECT pg_terminate_backend(pid)
-		FROM pg_stat_activity
-		WHERE datname = $1 AND pid <> pg_backend_pid()`
+	if err := setSessionRole(db, config.Role); err != nil {
+		return err
+	}
 
-	_, err = db.Exec(terminateQuery, config.Database)
+	// Terminate connections to the database
+	_, err = db.Exec(terminateConnectionsQuery, config.Database)
 	if err != nil {
-		logger.Warning(fmt.Sprintf("Could not terminate all connections: %v", err))
+		warn(WarnConnectionsNotTerminated, fmt.Sprintf("Could not terminate all connections: %v", err))
 	}
 
-	// Drop the database - use quoted identifier to preserve case
-	dropQuery := fmt.Sprintf(`DROP DATABASE "%s"`, config.Database)
-	_, err = db.Exec(dropQuery)
+	_, err = db.Exec(dropDatabaseStatement(config.Database))
 	if err != nil {
 		return err
 	}
@@ -561,20 +2477,22 @@ func dropDatabaseIfExists(config *DatabaseConfig) error {
 	return nil
 }
 
-func createDatabase(config *DatabaseConfig) error {
+func createDatabase(config *DatabaseConfig, createOpts *CreateDatabaseOptions) error {
 	logger.Info(fmt.Sprintf("Creating destination database '%s'...", config.Database))
 
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=postgres sslmode=%s",
-		config.Host, config.Port, config.Username, config.Password, config.SSLMode)
-
-	db, err := sql.Open("postgres", connStr)
+	db, err := openDatabase(config, "postgres")
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
+	// Create the database as the target role so that role owns it
+	if err := setSessionRole(db, config.Role); err != nil {
+		return err
+	}
+
 	// Create database - use quoted identifier to preserve case
-	createQuery := fmt.Sprintf(`CREATE DATABASE "%s"`, config.Database)
+	createQuery := buildCreateDatabaseStatement(config.Database, createOpts)
 	_, err = db.Exec(createQuery)
 	if err != nil {
 		return err
@@ -583,25 +2501,27 @@ func createDatabase(config *DatabaseConfig) error {
 	logger.Info("Database created successfully")
 	return nil
 }
-func applySchema(config *DatabaseConfig, schemaFile string) error {
-	logger.Info(fmt.Sprintf("Applying schema to destination database '%s'...", config.Database))
 
-	// Set environment variables
-	os.Setenv("PGPASSWORD", config.Password)
-	defer os.Unsetenv("PGPASSWORD")
-	os.Setenv("PGSSLMODE", config.SSLMode)
-	defer os.Unsetenv("PGSSLMODE")
-
-	cmd := exec.Command("psql",
-		"-h", config.Host,
-		"-p", config.Port,
-		"-U", config.Username,
-		"-d", config.Database,
-		"-f", schemaFile,
-		"--no-password")
+// applySchema runs schemaFile against config with psql, recording server
+// notices in notices when it is not nil. With timer, psql runs its marked
+// copy of the file instead, and the time of each object is recorded.
+func applySchema(config *DatabaseConfig, schemaFile string, notices *noticeCollector, timer *objectTimer) error {
+	logger.Info(fmt.Sprintf("Applying schema to destination database '%s'...", config.Database))
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	var cmd *exec.Cmd
+	stderr := psqlStderr(notices)
+	if timer == nil {
+		cmd = clientCommand(config, "psql", applySchemaArgs(config, schemaFile), schemaFile)
+		cmd.Stdout = os.Stdout
+	} else {
+		cmd = clientCommandEnv(config, timingEnv, "psql", applySchemaArgs(config, timer.path), timer.path)
+		cmd.Stdout = timer
+		defer timer.close()
+		if w, ok := stderr.(*psqlMessageWriter); ok {
+			w.ran, w.file = timer.path, schemaFile
+		}
+	}
+	cmd.Stderr = stderr
 
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("psql schema application failed: %v", err)
@@ -611,58 +2531,56 @@ func applySchema(config *DatabaseConfig, schemaFile string) error {
 	return nil
 }
 
-func generateRollbackScript(config *DatabaseConfig, backupFile string, options *MigrationOptions) error {
+// applySchemaArgs returns the psql arguments that apply schemaFile to config
+func applySchemaArgs(config *DatabaseConfig, schemaFile string) []string {
+	args := []string{
+		"-h", config.Host,
+		"-p", config.Port,
+		"-U", config.Username,
+		"-d", dbnameArg(config.Database),
+	}
+
+	// psql runs -c and -f in order within one session, so the role applies to the whole file
+	if config.Role != "" {
+		args = append(args, "-c", setRoleStatement(config.Role))
+	}
+	return append(args, "-f", schemaFile, "--no-password")
+}
+
+func generateRollbackScript(config *DatabaseConfig, backupFile string, options *MigrationOptions, state *RunState) error {
 	if !options.CreateBackup || backupFile == "" {
 		return nil
 	}
 
-	rollbackScript := filepath.Join(options.OutputDir, "rollback.sh")
+	rollbackScript, err := options.artifactPath(ArtifactRollback, newArtifactNameData(state.Source, config, state.Timestamp(), state))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(rollbackScript), 0755); err != nil {
+		return err
+	}
 	logger.Info(fmt.Sprintf("Generating rollback script: %s", rollbackScript))
 
-	script := fmt.Sprintf(`#!/bin/bash
-# Rollback script generated by pg-schema-migrate
-# Created: %s
-# Database: %s@%s:%s
-
-echo "WARNING: This will restore the database to its previous state!"
-echo "This will DROP the current database and restore from backup."
-read -p "Are you sure you want to continue? (yes/no): " confirm
-
-if [ "$confirm" = "yes" ]; then
-    echo "Starting rollback..."
-
-    # Set password (you'll need to enter it)
-    export PGPASSWORD=""
-    export PGSSLMODE="%s"
-
-    # Drop current database
-    echo "Dropping current database..."
-    psql -h %s -p %s -U %s -d postgres -c "DROP DATABASE IF EXISTS %s;"
-
-    # Create database
-    echo "Creating database..."
-    psql -h %s -p %s -U %s -d postgres -c "CREATE DATABASE %s;"
-
-    # Restore from backup
-    echo "Restoring from backup..."
-    psql -h %s -p %s -U %s -d %s -f %s
-
-    echo "Rollback completed!"
-else
-    echo "Rollback cancelled."
-fi
-`,
-		time.Now().Format("2006-01-02 15:04:05"),
-		config.Username, config.Host, config.Port,
-		config.SSLMode,
-		config.Host, config.Port, config.Username, config.Database,
-		config.Host, config.Port, config.Username, config.Database,
-		config.Host, config.Port, config.Username, config.Database, backupFile)
-
+	data := newRollbackScriptData(config, backupFile, time.Now().Format("2006-01-02 15:04:05"))
+	script, err := data.render()
+	if err != nil {
+		return fmt.Errorf("failed to render rollback script: %v", err)
+	}
 	if err := ioutil.WriteFile(rollbackScript, []byte(script), 0755); err != nil {
 		return err
 	}
 
+	// A broken rollback script is found out when it's needed most, so it is
+	// checked now. In CI nobody reads the warning, so it fails the run.
+	if problems := checkRollbackScript(script, data); len(problems) > 0 {
+		listed := strings.Join(problems, "\n   ")
+		if options.CIMode {
+			return fmt.Errorf("%w %s:\n   %s", errRollbackScriptInvalid, rollbackScript, listed)
+		}
+		warn(WarnRollbackScriptInvalid, fmt.Sprintf("Rollback script %s would not restore the backup as written:\n   %s", rollbackScript, listed))
+		return nil
+	}
+
 	logger.Success(fmt.Sprintf("Rollback script created: %s", rollbackScript))
 	return nil
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// maintenanceWindow keeps applications out of the destination database while
+// it is dropped, recreated and populated.
+type maintenanceWindow struct {
+	config *DatabaseConfig
+
+	allowConnections bool // Original datallowconn
+	publicConnect    bool // Whether PUBLIC originally had CONNECT
+	started          bool
+	blocked          bool // Begin turned off ALLOW_CONNECTIONS
+	finished         bool
+}
+
+func newMaintenanceWindow(config *DatabaseConfig) *maintenanceWindow {
+	return &maintenanceWindow{
+		config:           config,
+		allowConnections: true,
+		publicConnect:    true,
+	}
+}
+
+func (w *maintenanceWindow) open() (*sql.DB, error) {
+	db, err := openDatabase(w.config, "postgres")
+	if err != nil {
+		return nil, err
+	}
+	if err := setSessionRole(db, w.config.Role); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Begin records the current connectability of the destination database and
+// stops new connections to it. It must run before existing sessions are terminated.
+func (w *maintenanceWindow) Begin() error {
+	db, err := w.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	w.started = true
+
+	err = db.QueryRow(`
+		SELECT datallowconn, has_database_privilege('public', datname, 'CONNECT')
+		FROM pg_database WHERE datname = $1`, w.config.Database).Scan(&w.allowConnections, &w.publicConnect)
+	if err == sql.ErrNoRows {
+		logger.Info("Destination database doesn't exist yet, nothing to lock")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("Blocking new connections to '%s' for the maintenance window", w.config.Database))
+	query := fmt.Sprintf(`ALTER DATABASE %s WITH ALLOW_CONNECTIONS false`, quoteIdentifier(w.config.Database))
+	if _, err = db.Exec(query); err != nil {
+		return err
+	}
+	w.blocked = true
+	return nil
+}
+
+// Suspend allows connections to the destination again as it originally did,
+// so pg_dump can back it up once more, until Resume blocks them again. Both
+// do nothing for a nil window or one that blocked nothing.
+func (w *maintenanceWindow) Suspend() error {
+	if w == nil || !w.blocked {
+		return nil
+	}
+	logger.Info(fmt.Sprintf("Allowing connections to '%s' again while it is backed up", w.config.Database))
+	return w.setAllowConnections(w.allowConnections)
+}
+
+// Resume blocks new connections again after Suspend
+func (w *maintenanceWindow) Resume() error {
+	if w == nil || !w.blocked {
+		return nil
+	}
+	logger.Info(fmt.Sprintf("Blocking new connections to '%s' again", w.config.Database))
+	return w.setAllowConnections(false)
+}
+
+func (w *maintenanceWindow) setAllowConnections(allow bool) error {
+	db, err := w.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(fmt.Sprintf(`ALTER DATABASE %s WITH ALLOW_CONNECTIONS %t`, quoteIdentifier(w.config.Database), allow))
+	return err
+}
+
+// LockNew keeps the freshly created database closed to everyone but the
+// migration user until the schema has been applied.
+func (w *maintenanceWindow) LockNew() error {
+	db, err := w.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	logger.Info(fmt.Sprintf("Revoking CONNECT on '%s' from PUBLIC until the apply completes", w.config.Database))
+	query := fmt.Sprintf(`REVOKE CONNECT ON DATABASE %s FROM PUBLIC`, quoteIdentifier(w.config.Database))
+	_, err = db.Exec(query)
+	return err
+}
+
+// End restores the original connectability once the migration has succeeded.
+func (w *maintenanceWindow) End() error {
+	if err := w.restore(); err != nil {
+		return err
+	}
+	w.finished = true
+	logger.Info(fmt.Sprintf("Connections to '%s' allowed again", w.config.Database))
+	return nil
+}
+
+// RestoreUnlessFinished is deferred so a failed run never leaves the
+// destination locked.
+func (w *maintenanceWindow) RestoreUnlessFinished() {
+	if !w.started || w.finished {
+		return
+	}
+	warn(WarnMaintenanceWindowRestored, fmt.Sprintf("Migration did not complete, restoring original connection settings on '%s'", w.config.Database))
+	if err := w.restore(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to restore connection settings on '%s': %v", w.config.Database, err))
+	}
+}
+
+func (w *maintenanceWindow) restore() error {
+	db, err := w.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	exists, err := rowExists(db, `SELECT EXISTS(SELECT 1 FROM pg_database WHERE datname = $1)`, w.config.Database)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	name := quoteIdentifier(w.config.Database)
+	if _, err := db.Exec(fmt.Sprintf(`ALTER DATABASE %s WITH ALLOW_CONNECTIONS %t`, name, w.allowConnections)); err != nil {
+		return err
+	}
+	if w.publicConnect {
+		if _, err := db.Exec(fmt.Sprintf(`GRANT CONNECT ON DATABASE %s TO PUBLIC`, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
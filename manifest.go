@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// manifestVersion is the version of the manifest format written. Version 1
+// manifests have no version field and no phase_seconds or object_counts;
+// version 2 manifests have no phase status, error or backup_sha256.
+const manifestVersion = 3
+
+// ManifestDatabase identifies one side of the run
+type ManifestDatabase struct {
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Database string `json:"database"`
+
+	Environment string `json:"environment,omitempty"`
+
+	SSL *SSLState `json:"ssl,omitempty"` // How the tool's own connections were secured
+
+	SSLMode          string `json:"sslmode,omitempty"`           // The sslmode the run used
+	SSLModeRequested string `json:"sslmode_requested,omitempty"` // The one given, when pg_hba.conf made the run switch
+
+	Flavor *ServerFlavor `json:"flavor,omitempty"`
+}
+
+// ManifestPhase is the duration and outcome of one phase
+type ManifestPhase struct {
+	Name            string  `json:"name"`
+	StartedSeconds  float64 `json:"started_seconds"` // After the start of the run; overlaps for concurrent phases
+	DurationSeconds float64 `json:"duration_seconds"`
+	Status          string  `json:"status"` // ok, failed or timed_out
+}
+
+// Started is when the phase started, after the start of the run
+func (p ManifestPhase) Started() time.Duration {
+	return time.Duration(p.StartedSeconds * float64(time.Second))
+}
+
+// Duration is how long the phase ran
+func (p ManifestPhase) Duration() time.Duration {
+	return time.Duration(p.DurationSeconds * float64(time.Second))
+}
+
+func manifestDatabase(config *DatabaseConfig) *ManifestDatabase {
+	if config == nil {
+		return nil
+	}
+	host, port := config.Host, config.Port
+	if config.TunnelTarget != "" {
+		host = config.TunnelTarget
+		port = ""
+	}
+	return &ManifestDatabase{Host: host, Port: port, Database: config.Database, Environment: config.Environment, SSL: config.SSLState, Flavor: config.Flavor,
+		SSLMode: config.SSLMode, SSLModeRequested: config.SSLModeRequested}
+}
+
+// manifestPath returns where the manifest of a run is written
+func manifestPath(options *MigrationOptions, state *RunState) string {
+	return filepath.Join(options.OutputDir, fmt.Sprintf("manifest_%s.json", state.Timestamp()))
+}
+
+// writeRunManifest writes the manifest of a finished run, its result
+func writeRunManifest(path string, result *RunResult) error {
+	return writeResultJSON(path, result)
+}
+
+// upgrade fills in what older manifest versions did not record
+func (m *RunResult) upgrade() {
+	if m.Version == 0 {
+		m.Version = 1
+	}
+	if m.PhaseSeconds == nil {
+		m.PhaseSeconds = make(map[string]float64)
+		for _, p := range m.Phases {
+			m.PhaseSeconds[p.Name] += p.DurationSeconds
+		}
+	}
+	if m.Version < 3 {
+		for i := range m.Phases {
+			m.Phases[i].Status = StepOK
+			if !m.Success && m.Phases[i].Name == m.FailedPhase {
+				m.Phases[i].Status = StepFailed
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// migrationMarkerPrefix starts the line of the destination database comment
+// that records the last migration into it. The rest of the comment is the
+// owner's and is kept as it is.
+const migrationMarkerPrefix = "pg-schema-migrate migrated: "
+
+// MigrationMarker is the record of the last migration the tool keeps in the
+// comment of the destination database
+type MigrationMarker struct {
+	Fingerprint string    `json:"fingerprint"` // Of the schema applied
+	Source      string    `json:"source"`      // host:port/database it was exported from, or the schema file
+	MigratedAt  time.Time `json:"migrated_at"`
+	RunLabel    string    `json:"run_label,omitempty"`
+	Mode        string    `json:"mode,omitempty"` // Mode of the run that applied it
+}
+
+// String describes the marker for the log
+func (m *MigrationMarker) String() string {
+	s := fmt.Sprintf("last migrated from %s on %s, fingerprint %s", m.Source, m.MigratedAt.Local().Format(time.RFC3339), shortFingerprint(m.Fingerprint))
+	if m.RunLabel != "" {
+		s += fmt.Sprintf(" (run %s)", m.RunLabel)
+	}
+	return s
+}
+
+// shortFingerprint is the start of a fingerprint, enough to tell two apart
+func shortFingerprint(fingerprint string) string {
+	if len(fingerprint) > 12 {
+		return fingerprint[:12]
+	}
+	return fingerprint
+}
+
+// migrationFingerprint identifies the schema a run applies. A plain dump is
+// fingerprinted by its objects, the way watch does, so header, ownership and
+// ignored objects don't count; directory dumps and archives by their files.
+func migrationFingerprint(schemaFile string, ignore *IgnoreList) (string, error) {
+	if info, err := os.Stat(schemaFile); err == nil && !info.IsDir() && !isDumpArchive(schemaFile) {
+		objects, err := hashDumpEntries(schemaFile, ignore)
+		if err != nil {
+			return "", err
+		}
+		return schemaFingerprint(objects), nil
+	}
+	sum, _, err := backupFingerprint(schemaFile)
+	return sum, err
+}
+
+// splitMarkerComment separates the marker line of a database comment from
+// the rest of the comment
+func splitMarkerComment(comment string) (rest, marker string) {
+	var kept []string
+	for _, line := range strings.Split(comment, "\n") {
+		if strings.HasPrefix(line, migrationMarkerPrefix) {
+			marker = strings.TrimPrefix(line, migrationMarkerPrefix)
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.TrimRight(strings.Join(kept, "\n"), "\n"), marker
+}
+
+// destinationComment reads the comment of the destination database; exists
+// is false when there is no such database
+func destinationComment(db *sql.DB, database string) (comment string, exists bool, err error) {
+	var text sql.NullString
+	err = db.QueryRowContext(runContext(), `SELECT shobj_description(oid, 'pg_database') FROM pg_database WHERE datname = $1`, database).Scan(&text)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return text.String, err == nil, err
+}
+
+// readMigrationMarker returns the marker of the destination database, or nil
+// when it doesn't exist or carries none
+func readMigrationMarker(dest *DatabaseConfig) (*MigrationMarker, error) {
+	db, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	comment, _, err := destinationComment(db, dest.Database)
+	if err != nil {
+		return nil, err
+	}
+	_, text := splitMarkerComment(comment)
+	if text == "" {
+		return nil, nil
+	}
+	var marker MigrationMarker
+	if err := json.Unmarshal([]byte(text), &marker); err != nil {
+		return nil, fmt.Errorf("the marker in its comment is not valid: %v", err)
+	}
+	if marker.MigratedAt.IsZero() {
+		return nil, fmt.Errorf("the marker in its comment has no migration time")
+	}
+	return &marker, nil
+}
+
+// checkMigrationMarker shows when and from where the destination was last
+// migrated, and whether it already has the schema about to be applied.
+// With --require-older-than, a destination migrated more recently is
+// refused. A missing or unreadable marker never stops the run.
+func checkMigrationMarker(dest *DatabaseConfig, schemaFile string, options *MigrationOptions, state *RunState) error {
+	if schemaFile != "" {
+		fingerprint, err := migrationFingerprint(schemaFile, options.Ignore)
+		if err != nil {
+			logger.Debug(fmt.Sprintf("Could not fingerprint %s: %v", schemaFile, err))
+		} else {
+			state.Fingerprint = fingerprint
+			logger.Info(fmt.Sprintf("Schema fingerprint: %s", shortFingerprint(fingerprint)))
+		}
+	}
+
+	marker, err := readMigrationMarker(dest)
+	if err != nil {
+		msg := fmt.Sprintf("Could not read the migration marker of %s: %v", dest.Database, err)
+		if options.RequireOlderThan > 0 {
+			msg += "; --require-older-than can't be checked"
+		}
+		warn(WarnMigrationMarkerUnreadable, msg)
+		return nil
+	}
+	if marker == nil {
+		if options.RequireOlderThan > 0 {
+			logger.Info(fmt.Sprintf("Destination %s carries no migration marker; --require-older-than has nothing to check", dest.Database))
+		} else {
+			logger.Info(fmt.Sprintf("Destination %s carries no migration marker", dest.Database))
+		}
+		return nil
+	}
+
+	state.PreviousMigration = marker
+	age := time.Since(marker.MigratedAt)
+	logger.Info(fmt.Sprintf("Destination %s %s, %s ago", dest.Database, marker, age.Round(time.Second)))
+	if state.Fingerprint != "" && marker.Fingerprint == state.Fingerprint {
+		warn(WarnSchemaAlreadyMigrated, fmt.Sprintf("Destination %s already has this schema (fingerprint %s); this run repeats the migration of %s",
+			dest.Database, shortFingerprint(marker.Fingerprint), marker.MigratedAt.Local().Format(time.RFC3339)))
+	}
+	if options.RequireOlderThan > 0 && age < options.RequireOlderThan {
+		return fmt.Errorf("destination %s was migrated from %s %s ago, more recently than --require-older-than %s allows; it may hold something fresher than this run",
+			dest.Database, marker.Source, age.Round(time.Second), options.RequireOlderThan)
+	}
+	return nil
+}
+
+// migrationSource names where the schema of a run came from
+func migrationSource(state *RunState) string {
+	switch {
+	case state.Source != nil:
+		source := manifestDatabase(state.Source)
+		if source.Port == "" {
+			return fmt.Sprintf("%s/%s", source.Host, source.Database)
+		}
+		return fmt.Sprintf("%s:%s/%s", source.Host, source.Port, source.Database)
+	case state.SchemaHeader != nil:
+		return state.SchemaHeader.Source
+	default:
+		return "schema file " + filepath.Base(state.SchemaFile)
+	}
+}
+
+// writeMigrationMarker records the migration in the comment of the
+// destination database, replacing an earlier marker and keeping the rest
+func writeMigrationMarker(dest *DatabaseConfig, marker *MigrationMarker) error {
+	data, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := setSessionRole(db, dest.Role); err != nil {
+		return err
+	}
+
+	comment, exists, err := destinationComment(db, dest.Database)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("database %s does not exist", dest.Database)
+	}
+	rest, _ := splitMarkerComment(comment)
+	comment = migrationMarkerPrefix + string(data)
+	if rest != "" {
+		comment = rest + "\n" + comment
+	}
+	_, err = db.ExecContext(runContext(), fmt.Sprintf("COMMENT ON DATABASE %s IS %s", quoteIdentifier(dest.Database), pq.QuoteLiteral(comment)))
+	return err
+}
+
+// recordMigrationMarker marks the destination after a successful apply, so
+// the next run can show where it was left. A marker that can't be written
+// is only a warning.
+func recordMigrationMarker(dest *DatabaseConfig, schemaFile string, options *MigrationOptions, state *RunState) {
+	if state.Fingerprint == "" {
+		fingerprint, err := migrationFingerprint(schemaFile, options.Ignore)
+		if err != nil {
+			warn(WarnMigrationMarkerNotWritten, fmt.Sprintf("Could not fingerprint %s for the migration marker: %v", schemaFile, err))
+			return
+		}
+		state.Fingerprint = fingerprint
+	}
+
+	marker := &MigrationMarker{
+		Fingerprint: state.Fingerprint,
+		Source:      migrationSource(state),
+		MigratedAt:  time.Now().UTC(),
+		RunLabel:    state.Label,
+		Mode:        state.Mode,
+	}
+	if err := writeMigrationMarker(dest, marker); err != nil {
+		warn(WarnMigrationMarkerNotWritten, fmt.Sprintf("Could not record the migration in the comment of %s: %v", dest.Database, err))
+		return
+	}
+	logger.Info(fmt.Sprintf("Recorded the migration in the comment of %s (fingerprint %s)", dest.Database, shortFingerprint(marker.Fingerprint)))
+}
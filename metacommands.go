@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// databaseSwitchPatterns match the statements of a schema file that make psql
+// continue in another database, or that create or rename databases, so part
+// of the file would be applied somewhere else than the destination
+var databaseSwitchPatterns = []struct {
+	pattern *regexp.Regexp
+	what    string
+}{
+	{regexp.MustCompile(`^\\(?:c|connect)(?:\s|$)`), `\connect`},
+	{regexp.MustCompile(`(?i)^CREATE\s+DATABASE\b`), "CREATE DATABASE"},
+	{regexp.MustCompile(`(?i)^ALTER\s+DATABASE\s+(?:"[^"]+"|\S+)\s+RENAME\b`), "ALTER DATABASE ... RENAME"},
+}
+
+// findDatabaseSwitches lists the statements of a plain schema file matching
+// databaseSwitchPatterns, as "line N: <what>: <first line>"
+func findDatabaseSwitches(schemaFile string) ([]string, error) {
+	statements, err := splitScriptStatements(schemaFile)
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	for _, s := range statements {
+		for _, p := range databaseSwitchPatterns {
+			if p.pattern.MatchString(s.text) {
+				found = append(found, fmt.Sprintf("line %d: %s: %s", s.line, p.what, firstLine(s.text)))
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+// checkDatabaseSwitches refuses a schema file that would have psql leave the
+// destination database part way, as hand-edited files and dumps made with
+// --create do, unless --allow-meta-commands is given. Directory dumps and
+// archives are restored with pg_restore into the destination only.
+func checkDatabaseSwitches(schemaFile string, options *MigrationOptions) error {
+	if info, err := os.Stat(schemaFile); err != nil || info.IsDir() || isDumpArchive(schemaFile) {
+		return err
+	}
+	found, err := findDatabaseSwitches(schemaFile)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	if options.AllowMetaCommands {
+		warn(WarnDatabaseSwitches, fmt.Sprintf("%s has %d statement(s) leaving, creating or renaming databases, applied because of --allow-meta-commands:\n   %s",
+			schemaFile, len(found), strings.Join(found, "\n   ")))
+		return nil
+	}
+	return fmt.Errorf("%s has %d statement(s) leaving, creating or renaming databases; psql would apply the rest of the file elsewhere. Remove them, or pass --allow-meta-commands:\n   %s",
+		schemaFile, len(found), strings.Join(found, "\n   "))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"pg-schema-migrator/internal/dumpparse"
+)
+
+// countDumpObjects counts the objects in a plain-format pg_dump file by type
+func countDumpObjects(path string) (map[string]int, error) {
+	dump, err := dumpparse.ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, o := range dump.Objects {
+		counts[strings.ToLower(o.Type)]++
+	}
+	return counts, nil
+}
+
+// writeMetricsFile writes the run's metrics in Prometheus textfile-collector
+// format. The file is written next to its destination and renamed into place
+// so collectors never see a partial file.
+func writeMetricsFile(path string, result *RunResult) error {
+	var destHost, destDB string
+	if result.Destination != nil {
+		destHost, destDB = result.Destination.Host, result.Destination.Database
+	}
+	base := fmt.Sprintf(`dest_host="%s",dest_db="%s",run_label="%s"`,
+		escapeLabel(destHost), escapeLabel(destDB), escapeLabel(result.RunLabel))
+
+	var b strings.Builder
+
+	b.WriteString("# HELP pgsm_migration_duration_seconds Duration of each migration phase.\n")
+	b.WriteString("# TYPE pgsm_migration_duration_seconds gauge\n")
+	for _, p := range result.Phases {
+		fmt.Fprintf(&b, "pgsm_migration_duration_seconds{phase=\"%s\",%s} %g\n", escapeLabel(p.Name), base, p.DurationSeconds)
+	}
+
+	success := 0
+	if result.Success {
+		success = 1
+	}
+	b.WriteString("# HELP pgsm_migration_success Whether the last migration run succeeded.\n")
+	b.WriteString("# TYPE pgsm_migration_success gauge\n")
+	fmt.Fprintf(&b, "pgsm_migration_success{failed_phase=\"%s\",%s} %d\n", escapeLabel(result.FailedPhase), base, success)
+
+	b.WriteString("# HELP pgsm_schema_file_bytes Size of the exported schema file.\n")
+	b.WriteString("# TYPE pgsm_schema_file_bytes gauge\n")
+	fmt.Fprintf(&b, "pgsm_schema_file_bytes{%s} %d\n", base, fileSize(result.SchemaFile))
+
+	b.WriteString("# HELP pgsm_backup_file_bytes Size of the destination backup file.\n")
+	b.WriteString("# TYPE pgsm_backup_file_bytes gauge\n")
+	fmt.Fprintf(&b, "pgsm_backup_file_bytes{%s} %d\n", base, fileSize(result.BackupFile))
+
+	b.WriteString("# HELP pgsm_objects_migrated Number of exported schema objects by type.\n")
+	b.WriteString("# TYPE pgsm_objects_migrated gauge\n")
+	types := make([]string, 0, len(result.ObjectCounts))
+	for t := range result.ObjectCounts {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Fprintf(&b, "pgsm_objects_migrated{type=\"%s\",%s} %d\n", escapeLabel(t), base, result.ObjectCounts[t])
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".pgsm-metrics-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// escapeLabel escapes a Prometheus label value
+func escapeLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+func fileSize(path string) int64 {
+	if path == "" {
+		return 0
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Missing role modes for --missing-roles
+const (
+	MissingRolesError  = "error"
+	MissingRolesSkip   = "skip"
+	MissingRolesCreate = "create"
+)
+
+// roleListPattern matches a comma-separated list of role names
+const roleListPattern = `(` + roleNamePattern + `(?:, ` + roleNamePattern + `)*)`
+
+var (
+	ownerToPattern      = regexp.MustCompile(` OWNER TO ` + roleNamePattern + `;`)
+	grantToPattern      = regexp.MustCompile(`^(?:ALTER DEFAULT PRIVILEGES .+? )?GRANT .+? TO ` + roleListPattern)
+	revokeFromPattern   = regexp.MustCompile(`^(?:ALTER DEFAULT PRIVILEGES .+? )?REVOKE .+? FROM ` + roleListPattern)
+	policyToPattern     = regexp.MustCompile(`^CREATE POLICY .+? TO ` + roleListPattern)
+	defaultPrivsPattern = regexp.MustCompile(`^ALTER DEFAULT PRIVILEGES FOR ROLE ` + roleNamePattern)
+	roleListItemPattern = regexp.MustCompile(`"(?:[^"]|"")*"|[^\s,;"]+`)
+	pseudoRoles         = map[string]bool{"PUBLIC": true, "CURRENT_USER": true, "SESSION_USER": true, "CURRENT_ROLE": true}
+)
+
+// placeholderRoleFormat creates a role that exists only so grants resolve
+const placeholderRoleFormat = "CREATE ROLE %s NOLOGIN"
+
+// schemaFileRoles lists the roles a schema file refers to in OWNER TO,
+// GRANT, REVOKE, CREATE POLICY and ALTER DEFAULT PRIVILEGES statements
+func schemaFileRoles(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	seen := make(map[string]bool)
+	addList := func(list string) {
+		for _, quoted := range roleListItemPattern.FindAllString(list, -1) {
+			if !pseudoRoles[quoted] {
+				seen[unquoteRoleName(quoted)] = true
+			}
+		}
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := ownerToPattern.FindStringSubmatch(line); m != nil {
+			addList(m[1])
+		}
+		if m := defaultPrivsPattern.FindStringSubmatch(line); m != nil {
+			addList(m[1])
+		}
+		for _, pattern := range []*regexp.Regexp{grantToPattern, revokeFromPattern, policyToPattern} {
+			if m := pattern.FindStringSubmatch(line); m != nil {
+				addList(m[1])
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	roles := make([]string, 0, len(seen))
+	for role := range seen {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles, nil
+}
+
+// rolesFileRoles lists the roles a roles dump creates
+func rolesFileRoles(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	roles := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		if m := createRolePattern.FindStringSubmatch(line); m != nil {
+			roles[unquoteRoleName(m[1])] = true
+		}
+	}
+	return roles, nil
+}
+
+// findMissingRoles returns the roles schemaFile refers to that neither exist
+// on the destination server nor are created by rolesFile
+func findMissingRoles(dest *DatabaseConfig, schemaFile, rolesFile string) ([]string, error) {
+	referenced, err := schemaFileRoles(schemaFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema file: %v", err)
+	}
+	if len(referenced) == 0 {
+		return nil, nil
+	}
+
+	planned := make(map[string]bool)
+	if rolesFile != "" {
+		if planned, err = rolesFileRoles(rolesFile); err != nil {
+			return nil, fmt.Errorf("failed to read roles file: %v", err)
+		}
+	}
+
+	db, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var missing []string
+	for _, role := range referenced {
+		if planned[role] {
+			continue
+		}
+		exists, err := rowExists(db, `SELECT EXISTS(SELECT 1 FROM pg_roles WHERE rolname = $1)`, role)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, role)
+		}
+	}
+	return missing, nil
+}
+
+// checkMissingRoles looks for roles the schema needs that the destination
+// lacks and handles them according to --missing-roles. Roles to create are
+// recorded on the state and created by createMissingRoles.
+func checkMissingRoles(dest *DatabaseConfig, schemaFile string, options *MigrationOptions, state *RunState) error {
+	missing, err := findMissingRoles(dest, schemaFile, state.RolesFile)
+	if err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	list := strings.Join(missing, ", ")
+	switch options.MissingRoles {
+	case MissingRolesCreate:
+		logger.Info(fmt.Sprintf("%d role(s) referenced by the schema do not exist on the destination and will be created as NOLOGIN: %s", len(missing), list))
+		state.MissingRoles = missing
+		return nil
+	case MissingRolesSkip:
+		state.SkippedRoles = missing
+		warn(WarnRolesMissing, fmt.Sprintf("%d role(s) referenced by the schema do not exist on the destination; statements using them will fail: %s", len(missing), list))
+		return nil
+	default:
+		if options.DryRun {
+			warn(WarnRolesMissing, fmt.Sprintf("%d role(s) referenced by the schema do not exist on the destination; the apply would stop here: %s", len(missing), list))
+			return nil
+		}
+		return fmt.Errorf("%d role(s) referenced by the schema do not exist on the destination: %s; use --missing-roles create or skip, or --roles", len(missing), list)
+	}
+}
+
+// createMissingRoles creates the roles recorded by checkMissingRoles as
+// NOLOGIN placeholders for a DBA to configure later
+func createMissingRoles(dest *DatabaseConfig, state *RunState) error {
+	db, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := setSessionRole(db, dest.Role); err != nil {
+		return err
+	}
+
+	for _, role := range state.MissingRoles {
+		if _, err := db.Exec(fmt.Sprintf(placeholderRoleFormat, quoteIdentifier(role))); err != nil {
+			return fmt.Errorf("failed to create role %s: %v", role, err)
+		}
+		state.CreatedRoles = append(state.CreatedRoles, role)
+	}
+
+	warn(WarnPlaceholderRolesCreated, fmt.Sprintf("Created %d placeholder role(s) as NOLOGIN, configure them before use: %s",
+		len(state.CreatedRoles), strings.Join(state.CreatedRoles, ", ")))
+	return nil
+}
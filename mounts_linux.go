@@ -0,0 +1,55 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// mountOf returns the file system type and mount point of the mount holding
+// path, from /proc/mounts. path must be absolute with symlinks resolved.
+func mountOf(path string) (string, string, error) {
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	fstype, mountPoint := "", ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		point := unescapeMountPath(fields[1])
+		if !pathWithin(path, point) || len(point) < len(mountPoint) {
+			continue
+		}
+		// Later mounts on the same point hide earlier ones
+		fstype, mountPoint = fields[2], point
+	}
+	return fstype, mountPoint, scanner.Err()
+}
+
+// unescapeMountPath decodes the octal escapes (\040 for a space) of /proc/mounts
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// mountOf is not available on this platform
+func mountOf(path string) (string, string, error) {
+	return "", "", fmt.Errorf("not supported on this platform")
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// nonTransactionalPatterns match the statements PostgreSQL refuses to run in
+// a transaction block, and name why
+var nonTransactionalPatterns = []struct {
+	pattern *regexp.Regexp
+	reason  string
+}{
+	{regexp.MustCompile(`(?is)^CREATE\s+(?:UNIQUE\s+)?INDEX\s+CONCURRENTLY\b`), "CREATE INDEX CONCURRENTLY"},
+	{regexp.MustCompile(`(?is)^DROP\s+INDEX\s+CONCURRENTLY\b`), "DROP INDEX CONCURRENTLY"},
+	{regexp.MustCompile(`(?is)^REINDEX\b.*\bCONCURRENTLY\b`), "REINDEX CONCURRENTLY"},
+	{regexp.MustCompile(`(?is)^REINDEX\s+(?:\(.*?\)\s*)?(?:DATABASE|SYSTEM)\b`), "REINDEX DATABASE"},
+	{regexp.MustCompile(`(?is)^ALTER\s+TABLE\b.*\bDETACH\s+PARTITION\b.*\bCONCURRENTLY\b`), "DETACH PARTITION CONCURRENTLY"},
+	{regexp.MustCompile(`(?is)^VACUUM\b`), "VACUUM"},
+	{regexp.MustCompile(`(?is)^(?:CREATE|DROP)\s+DATABASE\b`), "CREATE/DROP DATABASE"},
+	{regexp.MustCompile(`(?is)^(?:CREATE|DROP)\s+TABLESPACE\b`), "CREATE/DROP TABLESPACE"},
+	{regexp.MustCompile(`(?is)^ALTER\s+SYSTEM\b`), "ALTER SYSTEM"},
+}
+
+// addValuePattern matches ALTER TYPE ... ADD VALUE, which can't run in a
+// transaction block before PostgreSQL 12
+var addValuePattern = regexp.MustCompile(`(?is)^ALTER\s+TYPE\b.*\bADD\s+VALUE\b`)
+
+// concurrentIndexPattern captures the index a CREATE or DROP INDEX
+// CONCURRENTLY is about, so statements using it later can follow it
+var concurrentIndexPattern = regexp.MustCompile(`(?is)^(?:CREATE\s+(?:UNIQUE\s+)?INDEX\s+CONCURRENTLY\s+(?:IF\s+NOT\s+EXISTS\s+)?|DROP\s+INDEX\s+CONCURRENTLY\s+(?:IF\s+EXISTS\s+)?)((?:"[^"]+"|[^\s".]+)(?:\.(?:"[^"]+"|[^\s".]+))?)`)
+
+// sessionSettingPattern matches the statements of a pg_dump script setting up
+// the session, which the statements run after the transaction need as well
+var sessionSettingPattern = regexp.MustCompile(`(?is)^(?:SET\s|SELECT\s+pg_catalog\.set_config\()`)
+
+// Statuses of a NonTransactionalStatement
+const (
+	NonTransactionalPending = "not applied"
+	NonTransactionalApplied = "applied"
+	NonTransactionalFailed  = "failed"
+)
+
+// NonTransactionalStatement is a statement of a single-transaction apply
+// that runs after the transaction has committed, on its own
+type NonTransactionalStatement struct {
+	SQL    string `json:"sql"`
+	Line   int    `json:"line"`   // Where it starts in the script
+	Reason string `json:"reason"` // What keeps it out of the transaction
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	settings []string // Session settings of the script in effect where it was
+}
+
+// scriptStatement is a statement of a script, or a run of lines between
+// statements
+type scriptStatement struct {
+	lines []string
+	line  int    // Of its first line, from 1
+	text  string // Without comment lines, empty between statements
+}
+
+// splitScriptStatements splits a SQL script into statements at lines ending
+// in a semicolon outside dollar quotes, which is enough for pg_dump output.
+// psql meta-commands are statements of their own.
+func splitScriptStatements(path string) ([]scriptStatement, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var statements []scriptStatement
+	current := scriptStatement{line: 1}
+	var text []string
+	quote := "" // Delimiter of the dollar-quoted string being read
+	flush := func(next int) {
+		if len(current.lines) > 0 {
+			current.text = strings.TrimSpace(strings.Join(text, "\n"))
+			statements = append(statements, current)
+		}
+		current = scriptStatement{line: next}
+		text = nil
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if quote == "" && len(text) == 0 {
+			if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+				current.lines = append(current.lines, line)
+				continue
+			}
+			// What precedes a statement stays apart from it
+			flush(n)
+			if strings.HasPrefix(trimmed, `\`) {
+				current.lines, text = []string{line}, []string{line}
+				flush(n + 1)
+				continue
+			}
+		}
+		current.lines = append(current.lines, line)
+		if quote == "" && strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		text = append(text, line)
+		for _, delimiter := range dollarQuotePattern.FindAllString(line, -1) {
+			switch quote {
+			case "":
+				quote = delimiter
+			case delimiter:
+				quote = ""
+			}
+		}
+		if quote == "" && strings.HasSuffix(trimmed, ";") {
+			flush(n + 1)
+		}
+	}
+	flush(0)
+	return statements, scanner.Err()
+}
+
+// nonTransactionalReason says why a statement can't run in a transaction
+// block on a server of version, or returns ""
+func nonTransactionalReason(statement string, version int) string {
+	for _, p := range nonTransactionalPatterns {
+		if p.pattern.MatchString(statement) {
+			return p.reason
+		}
+	}
+	if version < addValueInTransactionVersion && addValuePattern.MatchString(statement) {
+		return "ALTER TYPE ... ADD VALUE before PostgreSQL 12"
+	}
+	return ""
+}
+
+// mentionPattern matches the object of a possibly qualified name as a word of
+// a statement, quoted or not
+func mentionPattern(name string) *regexp.Regexp {
+	if _, object := splitQualifiedName(name); object != "" {
+		name = object
+	} else {
+		name = unquoteName(name)
+	}
+	return regexp.MustCompile(`(?i)(?:^|[^A-Za-z0-9_$])"?` + regexp.QuoteMeta(name) + `"?(?:[^A-Za-z0-9_$]|$)`)
+}
+
+// splitNonTransactional takes the statements that can't run in a transaction
+// block out of a script. They keep their order and run after the
+// transaction, together with the later statements naming an index they
+// create or drop. The script without them is written to the scratch
+// directory, the statements moved commented out so lines keep their numbers.
+// Without such statements the script is returned as it is.
+func splitNonTransactional(script string, version int) (string, []NonTransactionalStatement, error) {
+	statements, err := splitScriptStatements(script)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var moved []NonTransactionalStatement
+	var settings []string
+	var mentions []*regexp.Regexp
+	var b strings.Builder
+	for _, s := range statements {
+		reason := ""
+		if s.text != "" {
+			reason = nonTransactionalReason(s.text, version)
+			for _, mention := range mentions {
+				if reason == "" && mention.MatchString(s.text) {
+					reason = "uses an index created or dropped after the transaction"
+				}
+			}
+		}
+		if reason == "" {
+			if sessionSettingPattern.MatchString(s.text) {
+				settings = append(settings, s.text)
+			}
+			for _, line := range s.lines {
+				b.WriteString(line + "\n")
+			}
+			continue
+		}
+
+		if m := concurrentIndexPattern.FindStringSubmatch(s.text); m != nil {
+			mentions = append(mentions, mentionPattern(m[1]))
+		}
+		moved = append(moved, NonTransactionalStatement{SQL: s.text, Line: s.line, Reason: reason, Status: NonTransactionalPending, settings: append([]string(nil), settings...)})
+		for i, line := range s.lines {
+			if i == 0 {
+				b.WriteString("-- Run after the transaction: ")
+			} else {
+				b.WriteString("-- ")
+			}
+			b.WriteString(line + "\n")
+		}
+	}
+	if len(moved) == 0 {
+		return script, nil, nil
+	}
+
+	file, err := scratchFile("transaction-*.sql")
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = file.WriteString(b.String())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return file.Name(), moved, nil
+}
+
+// destinationVersion returns the server_version_num of dest
+func destinationVersion(dest *DatabaseConfig) (int, error) {
+	db, err := openDatabase(dest, dest.Database)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	return serverVersion(db)
+}
+
+// firstLine is the first line of a statement, for listing it
+func firstLine(statement string) string {
+	first, _, more := strings.Cut(statement, "\n")
+	if more {
+		return first + " ..."
+	}
+	return first
+}
+
+// runNonTransactional runs the statements moved out of a transaction one by
+// one, each with the session settings it had in the script. At the first
+// failure it stops and lists the statements left unapplied.
+func runNonTransactional(dest *DatabaseConfig, statements []NonTransactionalStatement) error {
+	db, err := openDatabase(dest, dest.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	// One session, so settings and the role hold for every statement
+	db.SetMaxOpenConns(1)
+	if err := setSessionRole(db, dest.Role); err != nil {
+		return err
+	}
+
+	ctx := runContext()
+	for i := range statements {
+		s := &statements[i]
+		logger.Info(fmt.Sprintf("Running after the transaction (%d/%d): %s", i+1, len(statements), firstLine(s.SQL)))
+		for _, setting := range s.settings {
+			if _, err = db.ExecContext(ctx, setting); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			_, err = db.ExecContext(ctx, s.SQL)
+		}
+		if err != nil {
+			s.Status, s.Error = NonTransactionalFailed, err.Error()
+			remaining := statements[i:]
+			var lines []string
+			for _, r := range remaining {
+				lines = append(lines, fmt.Sprintf("   line %d: %s", r.Line, firstLine(r.SQL)))
+			}
+			logger.Error(fmt.Sprintf("%d statement(s) after the transaction are not applied:\n%s", len(remaining), strings.Join(lines, "\n")))
+			return fmt.Errorf("statement at line %d failed after the transaction had committed, %d of %d statement(s) not applied: %v", s.Line, len(remaining), len(statements), err)
+		}
+		s.Status = NonTransactionalApplied
+	}
+	return nil
+}
+
+// runSingleTransaction runs a script with psql in one transaction, stopping
+// at the first error. Statements that can't run in a transaction block are
+// taken out and run after it has committed. committed reports whether the
+// transaction did, so that a failure after it changed the destination.
+func runSingleTransaction(dest *DatabaseConfig, script string, state *RunState) (committed bool, err error) {
+	version, err := destinationVersion(dest)
+	if err != nil {
+		return false, err
+	}
+	inTransaction, moved, err := splitNonTransactional(script, version)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %v", script, err)
+	}
+	state.NonTransactional = moved
+	if len(moved) > 0 {
+		logger.Info(fmt.Sprintf("%d statement(s) can't run in a transaction and run after it, in order:", len(moved)))
+		for _, s := range moved {
+			logger.Info(fmt.Sprintf("   line %d: %s (%s)", s.Line, firstLine(s.SQL), s.Reason))
+		}
+	}
+
+	notices := &noticeCollector{}
+	args := append(applySchemaArgs(dest, inTransaction), "-v", "ON_ERROR_STOP=1", "--single-transaction")
+	cmd := clientCommand(dest, "psql", args, inTransaction)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = psqlStderr(notices)
+	err = cmd.Run()
+	state.Notices = notices.notices
+	if err != nil || len(moved) == 0 {
+		return err == nil, err
+	}
+	return true, runNonTransactional(dest, state.NonTransactional)
+}
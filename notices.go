@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PsqlNotice is a NOTICE or WARNING raised by the server while psql ran a file
+type PsqlNotice struct {
+	Severity string `json:"severity"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Message  string `json:"message"`
+	Category string `json:"category"`
+}
+
+// noticeCategories classify notices by message, first match wins
+var noticeCategories = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	{"identifier truncation", regexp.MustCompile(`^identifier ".*" will be truncated`)},
+	{"skipped object", regexp.MustCompile(`does not exist, skipping$`)},
+	{"existing object", regexp.MustCompile(`already exists, skipping$`)},
+	{"implicit object", regexp.MustCompile(`will create implicit`)},
+}
+
+func classifyNotice(msg string) string {
+	for _, c := range noticeCategories {
+		if c.pattern.MatchString(msg) {
+			return c.name
+		}
+	}
+	return "other"
+}
+
+// maxApplyErrors is how many errors of an apply are kept with their statement
+const maxApplyErrors = 10
+
+// maxStatementLines limits the statement context of an error
+const maxStatementLines = 20
+
+// PsqlError is an ERROR raised by a statement of the file psql ran, which
+// psql reports and then moves on from
+type PsqlError struct {
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Message   string `json:"message"`
+	Statement string `json:"statement,omitempty"` // The statement ending at Line, from the file
+}
+
+// noticeCollector records the notices and errors of one psql run
+type noticeCollector struct {
+	notices []PsqlNotice
+	errors  []PsqlError
+}
+
+func (c *noticeCollector) add(severity, file string, line int, msg string) {
+	c.notices = append(c.notices, PsqlNotice{
+		Severity: severity,
+		File:     file,
+		Line:     line,
+		Message:  msg,
+		Category: classifyNotice(msg),
+	})
+}
+
+func (c *noticeCollector) addError(file string, line int, msg string) {
+	c.errors = append(c.errors, PsqlError{File: file, Line: line, Message: msg})
+}
+
+// attachStatements fills in the statements of errors from the file psql ran.
+// psql reports the line a statement ends on, so the statement is read back
+// from there to the end of the previous one or a blank line.
+func attachStatements(errors []PsqlError, path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	lines := strings.Split(string(data), "\n")
+	for i := range errors {
+		end := errors[i].Line
+		if end < 1 || end > len(lines) {
+			continue
+		}
+		start := end
+		for start > 1 && end-start < maxStatementLines-1 {
+			prev := strings.TrimSpace(lines[start-2])
+			if prev == "" || strings.HasSuffix(prev, ";") {
+				break
+			}
+			start--
+		}
+		errors[i].Statement = strings.Join(lines[start-1:end], "\n")
+	}
+}
+
+// missingRolePattern matches the error of a statement naming a role that doesn't exist
+var missingRolePattern = regexp.MustCompile(`^role "((?:[^"]|"")*)" does not exist$`)
+
+// checkApplyErrors reports the errors psql went past while applying
+// schemaFile and fails when there are more than allowed. Errors for roles
+// --missing-roles skip let fail are expected and don't count.
+func checkApplyErrors(c *noticeCollector, schemaFile string, allowed int, skippedRoles []string, state *RunState) error {
+	skipped := make(map[string]bool)
+	for _, role := range skippedRoles {
+		skipped[role] = true
+	}
+	var failed []PsqlError
+	for _, e := range c.errors {
+		if m := missingRolePattern.FindStringSubmatch(e.Message); m != nil && skipped[strings.ReplaceAll(m[1], `""`, `"`)] {
+			continue
+		}
+		failed = append(failed, e)
+	}
+	if expected := len(c.errors) - len(failed); expected > 0 {
+		logger.Info(fmt.Sprintf("%d statement(s) failed on roles skipped with --missing-roles skip", expected))
+	}
+	count := len(failed)
+	if count == 0 {
+		return nil
+	}
+
+	kept := failed[:min(count, maxApplyErrors)]
+	attachStatements(kept, schemaFile)
+	state.ApplyErrors, state.ApplyErrorCount = kept, count
+	logger.Error(fmt.Sprintf("%d statement(s) failed during the apply:", count))
+	for _, e := range kept {
+		logger.Error(fmt.Sprintf("   %s:%d: %s", e.File, e.Line, e.Message))
+	}
+	if count > len(kept) {
+		logger.Error(fmt.Sprintf("   ... and %d more (see the psql output)", count-len(kept)))
+	}
+	if count > allowed {
+		return fmt.Errorf("%d statement(s) failed during the apply; --allow-apply-errors permits %d", count, allowed)
+	}
+	warn(WarnApplyErrorsAllowed, fmt.Sprintf("%d statement(s) failed during the apply, within --allow-apply-errors %d", count, allowed))
+	return nil
+}
+
+// summary describes the notices by category, e.g.
+// "3 identifier truncation, 1 skipped object"
+func (c *noticeCollector) summary() string {
+	counts := make(map[string]int)
+	for _, n := range c.notices {
+		counts[n.Category]++
+	}
+	categories := make([]string, 0, len(counts))
+	for category := range counts {
+		categories = append(categories, category)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		if counts[categories[i]] != counts[categories[j]] {
+			return counts[categories[i]] > counts[categories[j]]
+		}
+		return categories[i] < categories[j]
+	})
+
+	parts := make([]string, len(categories))
+	for i, category := range categories {
+		parts[i] = fmt.Sprintf("%d %s", counts[category], category)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// checkFailOnNotice returns an error for the first notice matching one of
+// the --fail-on-notice patterns
+func checkFailOnNotice(notices []PsqlNotice, patterns []*regexp.Regexp) error {
+	for _, n := range notices {
+		for _, pattern := range patterns {
+			if pattern.MatchString(n.Message) {
+				return fmt.Errorf("%s at %s:%d matches --fail-on-notice %q: %s", n.Severity, n.File, n.Line, pattern, n.Message)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// notifyTimeout bounds sending a notification, from connecting to the end
+	notifyTimeout = 30 * time.Second
+
+	// notifyLogLines is how much of the end of the run log a failure mail carries
+	notifyLogLines = 50
+
+	// smtpPasswordEnv holds the SMTP password unless smtp_password_env names another variable
+	smtpPasswordEnv = "PGSM_SMTP_PASSWORD"
+)
+
+// SMTPConfig is the smtp_* settings of the config file used by --notify-email
+type SMTPConfig struct {
+	Host            string `json:"smtp_host"`
+	Port            int    `json:"smtp_port,omitempty"` // 587 when not set
+	User            string `json:"smtp_user,omitempty"`
+	PasswordEnv     string `json:"smtp_password_env,omitempty"`
+	PasswordCommand string `json:"smtp_password_command,omitempty"` // Takes precedence over the environment
+	From            string `json:"smtp_from,omitempty"`             // smtp_user when not set
+	StartTLS        string `json:"smtp_starttls,omitempty"`         // auto (when offered), require or off
+}
+
+// EmailNotification is where --notify-email sends the result of a run
+type EmailNotification struct {
+	To   []string
+	SMTP SMTPConfig
+}
+
+// loadSMTPConfig reads the smtp_* settings of a config file
+func loadSMTPConfig(path string) (SMTPConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return SMTPConfig{}, err
+	}
+	var config SMTPConfig
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&config); err != nil {
+		return SMTPConfig{}, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	if err := config.check(path); err != nil {
+		return SMTPConfig{}, err
+	}
+	return config, nil
+}
+
+// check validates the smtp_* settings read from the config file at path and
+// fills in their defaults
+func (c *SMTPConfig) check(path string) error {
+	if c.Host == "" {
+		return fmt.Errorf("config file %s has no smtp_host", path)
+	}
+	if c.Port == 0 {
+		c.Port = 587
+	}
+	switch c.StartTLS {
+	case "":
+		c.StartTLS = "auto"
+	case "auto", "require", "off":
+	default:
+		return fmt.Errorf("config file %s: smtp_starttls must be auto, require or off", path)
+	}
+	if c.From == "" {
+		c.From = c.User
+	}
+	if _, err := mail.ParseAddress(c.From); err != nil {
+		return fmt.Errorf("config file %s: smtp_from (or smtp_user) must be an email address: %v", path, err)
+	}
+	return nil
+}
+
+// parseNotifyEmail reads the comma-separated addresses of --notify-email
+func parseNotifyEmail(value, configPath string) (*EmailNotification, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if configPath == "" {
+		return nil, fmt.Errorf("--notify-email needs the smtp_* settings of a --config file")
+	}
+	notification := &EmailNotification{}
+	for _, address := range strings.Split(value, ",") {
+		parsed, err := mail.ParseAddress(strings.TrimSpace(address))
+		if err != nil {
+			return nil, fmt.Errorf("--notify-email %q: %v", address, err)
+		}
+		notification.To = append(notification.To, parsed.Address)
+	}
+	var err error
+	if notification.SMTP, err = loadSMTPConfig(configPath); err != nil {
+		return nil, err
+	}
+	return notification, nil
+}
+
+// password returns the SMTP password from smtp_password_command or the
+// environment, empty when there is none
+func (c SMTPConfig) password() (string, error) {
+	if c.PasswordCommand != "" {
+		return runPasswordCommand(c.PasswordCommand)
+	}
+	name := c.PasswordEnv
+	if name == "" {
+		name = smtpPasswordEnv
+	}
+	return os.Getenv(name), nil
+}
+
+// logTail keeps the last lines a logger wrote, for failure notifications
+type logTail struct {
+	mu    sync.Mutex
+	lines []string
+	max   int
+}
+
+func (t *logTail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+// Lines returns the kept lines, oldest first
+func (t *logTail) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.lines...)
+}
+
+// runSummaryText is the result of a run as plain text, with its phases as a table
+func runSummaryText(result *RunResult) string {
+	var b strings.Builder
+	if result.Success {
+		b.WriteString("Result:      succeeded\n")
+	} else {
+		fmt.Fprintf(&b, "Result:      failed in phase %s\n", result.FailedPhase)
+		if result.Error != "" {
+			fmt.Fprintf(&b, "Error:       %s\n", result.Error)
+		}
+	}
+	if result.TimedOut != "" {
+		fmt.Fprintf(&b, "Time budget: used up in phase %s\n", result.TimedOut)
+	}
+	if result.Source != nil {
+		fmt.Fprintf(&b, "Source:      %s\n", databaseLabel(result.Source))
+	}
+	if result.Destination != nil {
+		fmt.Fprintf(&b, "Destination: %s\n", databaseLabel(result.Destination))
+	}
+	if result.DestinationPath != "" {
+		fmt.Fprintf(&b, "Strategy:    %s\n", destinationPathText(result.DestinationPath))
+	}
+	if result.RunLabel != "" {
+		fmt.Fprintf(&b, "Run label:   %s\n", result.RunLabel)
+	}
+	fmt.Fprintf(&b, "Started:     %s\n", result.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "Duration:    %s\n", result.Duration().Round(time.Second))
+	if result.ObjectCounts != nil {
+		fmt.Fprintf(&b, "Objects:     %d\n", totalObjects(result.ObjectCounts))
+	}
+	b.WriteString("\n")
+
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Phase\tStarted\tDuration\tStatus")
+	for _, p := range result.Phases {
+		fmt.Fprintf(w, "%s\t+%s\t%s\t%s\n", p.Name, p.Started().Round(10*time.Millisecond), p.Duration().Round(10*time.Millisecond), p.Status)
+	}
+	w.Flush()
+
+	if slowest := slowestObjects(result.ObjectTimings, slowestObjectsShown); len(slowest) > 0 {
+		b.WriteString("\nSlowest objects to apply:\n")
+		for _, t := range slowest {
+			fmt.Fprintf(&b, "  %s\n", objectTimingText(t))
+		}
+	}
+
+	if len(result.NonTransactional) > 0 {
+		fmt.Fprintf(&b, "\nRun after the transaction: %d\n", len(result.NonTransactional))
+		for _, s := range result.NonTransactional {
+			fmt.Fprintf(&b, "  [%s] line %d: %s\n", s.Status, s.Line, firstLine(s.SQL))
+		}
+	}
+
+	if result.Unlogged != nil {
+		if len(result.Unlogged.Converted) > 0 {
+			fmt.Fprintf(&b, "\nPersistence changed (--unlogged %s): %d\n", result.Unlogged.Mode, len(result.Unlogged.Converted))
+			for _, name := range result.Unlogged.Converted {
+				fmt.Fprintf(&b, "  %s\n", name)
+			}
+		}
+		if len(result.Unlogged.Unlogged) > 0 {
+			fmt.Fprintf(&b, "\nUnlogged: %d\n", len(result.Unlogged.Unlogged))
+			for _, name := range result.Unlogged.Unlogged {
+				fmt.Fprintf(&b, "  %s\n", name)
+			}
+		}
+	}
+
+	if len(result.Warnings) > 0 {
+		fmt.Fprintf(&b, "\nWarnings: %d\n", len(result.Warnings))
+		for _, warning := range result.Warnings {
+			fmt.Fprintf(&b, "  [%s] %s\n", warning.Code, warning.Message)
+		}
+	}
+	return b.String()
+}
+
+// databaseLabel is host:port/database, without the port when a tunnel hides it
+func databaseLabel(m *ManifestDatabase) string {
+	host := m.Host
+	if m.Port != "" {
+		host += ":" + m.Port
+	}
+	return host + "/" + m.Database
+}
+
+// notificationSubject names the outcome and the destination of a run
+func notificationSubject(result *RunResult) string {
+	outcome := "succeeded"
+	if !result.Success {
+		outcome = "FAILED"
+	}
+	subject := fmt.Sprintf("pg-schema-migrate %s %s", result.Mode, outcome)
+	if result.Destination != nil {
+		subject += ": " + result.Destination.Database
+	}
+	if result.RunLabel != "" {
+		subject += " (" + result.RunLabel + ")"
+	}
+	return subject
+}
+
+// buildNotification renders the mail for a run: the summary, and for a failed
+// run the end of the log as an attachment
+func buildNotification(from string, to []string, result *RunResult, logLines []string) ([]byte, error) {
+	var boundaryBytes [12]byte
+	if _, err := rand.Read(boundaryBytes[:]); err != nil {
+		return nil, err
+	}
+	boundary := "pgsm-" + hex.EncodeToString(boundaryBytes[:])
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", notificationSubject(result)))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", boundary)
+
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	writeBase64Lines(&b, []byte(runSummaryText(result)))
+
+	if !result.Success && len(logLines) > 0 {
+		fmt.Fprintf(&b, "--%s\r\n", boundary)
+		b.WriteString("Content-Type: text/plain; charset=utf-8; name=\"run.log\"\r\n")
+		b.WriteString("Content-Disposition: attachment; filename=\"run.log\"\r\n")
+		b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		writeBase64Lines(&b, []byte(strings.Join(logLines, "\n")+"\n"))
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return b.Bytes(), nil
+}
+
+// writeBase64Lines writes data base64 encoded in lines of 76 characters
+func writeBase64Lines(b *bytes.Buffer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded + "\r\n")
+}
+
+// sendMail delivers message over SMTP within notifyTimeout, upgrading the
+// connection with STARTTLS as smtp_starttls says
+func sendMail(config SMTPConfig, to []string, message []byte) error {
+	address := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	conn, err := net.DialTimeout("tcp", address, notifyTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+
+	client, err := smtp.NewClient(conn, config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if config.StartTLS != "off" {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(&tls.Config{ServerName: config.Host}); err != nil {
+				return fmt.Errorf("STARTTLS failed: %v", err)
+			}
+		} else if config.StartTLS == "require" {
+			return fmt.Errorf("%s does not offer STARTTLS (smtp_starttls is require)", address)
+		}
+	}
+
+	if config.User != "" {
+		password, err := config.password()
+		if err != nil {
+			return fmt.Errorf("failed to get the SMTP password: %v", err)
+		}
+		// PlainAuth refuses to send the password unencrypted except to localhost
+		if err := client.Auth(smtp.PlainAuth("", config.User, password, config.Host)); err != nil {
+			return fmt.Errorf("authentication failed: %v", err)
+		}
+	}
+
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return err
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, address := range to {
+		if err := client.Rcpt(address); err != nil {
+			return fmt.Errorf("recipient %s refused: %v", address, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// notifyByEmail mails the result of a run to --notify-email. Sending is best
+// effort: a failure is only logged. It is not recorded as a warning of the
+// run, which is reported already and must not turn into a failure with
+// --fail-on-warning.
+func notifyByEmail(notification *EmailNotification, result *RunResult) {
+	var lines []string
+	if logger.tail != nil {
+		lines = logger.tail.Lines()
+	}
+	message, err := buildNotification(notification.SMTP.From, notification.To, result, lines)
+	if err == nil {
+		err = sendMail(notification.SMTP, notification.To, message)
+	}
+	if err != nil {
+		logger.Warning(fmt.Sprintf("Failed to send the run notification to %s: %v", strings.Join(notification.To, ", "), err))
+		return
+	}
+	logger.Info(fmt.Sprintf("Run notification sent to %s", strings.Join(notification.To, ", ")))
+}
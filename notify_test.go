@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpTestServer is a local SMTP server taking one mail per connection
+type smtpTestServer struct {
+	listener net.Listener
+	starttls bool // Offer STARTTLS in the EHLO reply
+
+	mails chan smtpTestMail
+}
+
+// smtpTestMail is what a client sent to the test server
+type smtpTestMail struct {
+	auth string // Decoded AUTH PLAIN response
+	from string
+	to   []string
+	data string
+}
+
+func newSMTPTestServer(t *testing.T, starttls bool) *smtpTestServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpTestServer{listener: listener, starttls: starttls, mails: make(chan smtpTestMail, 1)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// config returns the SMTP settings for the test server
+func (s *smtpTestServer) config(t *testing.T) SMTPConfig {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	n, _ := strconv.Atoi(port)
+	return SMTPConfig{Host: host, Port: n, From: "pgsm@example.com", StartTLS: "auto"}
+}
+
+func (s *smtpTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	var m smtpTestMail
+	reply("220 localhost ESMTP test")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250-localhost")
+			if s.starttls {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			fields := strings.Fields(line)
+			decoded, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			m.auth = string(decoded)
+			reply("235 2.7.0 Authentication successful")
+		case "MAIL":
+			m.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+			reply("250 OK")
+		case "RCPT":
+			m.to = append(m.to, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			m.data = data.String()
+			reply("250 OK")
+			s.mails <- m
+		case "QUIT":
+			reply("221 Bye")
+			return
+		case "STARTTLS":
+			reply("454 TLS not available")
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func testRunResult(success bool) *RunResult {
+	result := &RunResult{
+		Mode:        "direct",
+		Success:     success,
+		StartedAt:   time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Destination: &ManifestDatabase{Host: "db.example.com", Port: "5432", Database: "app"},
+		RunLabel:    "nightly",
+	}
+	if !success {
+		result.FailedPhase = "apply"
+		result.Error = "syntax error at line 12"
+	}
+	return result
+}
+
+func TestSendMailToLocalServer(t *testing.T) {
+	for _, success := range []bool{true, false} {
+		server := newSMTPTestServer(t, false)
+		config := server.config(t)
+		config.User = "pgsm@example.com"
+		config.PasswordEnv = "PGSM_TEST_SMTP_PASSWORD"
+		t.Setenv("PGSM_TEST_SMTP_PASSWORD", "secret")
+
+		to := []string{"dba@example.com", "oncall@example.com"}
+		logLines := []string{"[INFO] Starting", "[ERROR] syntax error at line 12"}
+		message, err := buildNotification(config.From, to, testRunResult(success), logLines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sendMail(config, to, message); err != nil {
+			t.Fatalf("sending to the local server: %v", err)
+		}
+
+		var m smtpTestMail
+		select {
+		case m = <-server.mails:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the test server received no mail")
+		}
+		if m.auth != "\x00pgsm@example.com\x00secret" {
+			t.Errorf("AUTH PLAIN sent %q", m.auth)
+		}
+		if m.from != "pgsm@example.com" || strings.Join(m.to, ",") != "dba@example.com,oncall@example.com" {
+			t.Errorf("envelope from %q to %q", m.from, m.to)
+		}
+
+		parsed, err := mail.ReadMessage(strings.NewReader(m.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject := parsed.Header.Get("Subject")
+		if want := map[bool]string{true: "pg-schema-migrate direct succeeded: app (nightly)", false: "pg-schema-migrate direct FAILED: app (nightly)"}[success]; subject != want {
+			t.Errorf("subject %q, want %q", subject, want)
+		}
+		if attached := strings.Contains(m.data, `filename="run.log"`); attached == success {
+			t.Errorf("run.log attached %v for a run that succeeded %v", attached, success)
+		}
+	}
+}
+
+func TestSendMailStartTLS(t *testing.T) {
+	// A server that doesn't offer STARTTLS is refused with require
+	server := newSMTPTestServer(t, false)
+	config := server.config(t)
+	config.StartTLS = "require"
+	err := sendMail(config, []string{"dba@example.com"}, []byte("Subject: test\r\n\r\ntest\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "does not offer STARTTLS") {
+		t.Errorf("expected require to refuse a server without STARTTLS, got %v", err)
+	}
+
+	// A failed STARTTLS is not silently skipped
+	server = newSMTPTestServer(t, true)
+	config = server.config(t)
+	err = sendMail(config, []string{"dba@example.com"}, []byte("Subject: test\r\n\r\ntest\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS failed") {
+		t.Errorf("expected the failed STARTTLS to fail the send, got %v", err)
+	}
+
+	// off sends over the plain connection
+	config.StartTLS = "off"
+	if err := sendMail(config, []string{"dba@example.com"}, []byte("Subject: test\r\n\r\ntest\r\n")); err != nil {
+		t.Errorf("smtp_starttls off: %v", err)
+	}
+}
+
+func TestNotifyEmailWithServeConfig(t *testing.T) {
+	// serve passes its own config file to every run as --config
+	path := filepath.Join(t.TempDir(), "serve.json")
+	config := `{
+  "profiles": {"prod": {"host": "db.example.com", "database": "app"}},
+  "smtp_host": "smtp.example.com",
+  "smtp_user": "pgsm@example.com",
+  "smtp_password_command": "echo secret"
+}`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	serve, err := loadServeConfig(path)
+	if err != nil {
+		t.Fatalf("the serve config with smtp_* settings was refused: %v", err)
+	}
+	if serve.SMTPConfig.Port != 587 || serve.SMTPConfig.StartTLS != "auto" {
+		t.Errorf("smtp defaults not filled in: %+v", serve.SMTPConfig)
+	}
+
+	notification, err := parseNotifyEmail("dba@example.com, Oncall <oncall@example.com>", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notification.SMTP.Host != "smtp.example.com" || notification.SMTP.From != "pgsm@example.com" {
+		t.Errorf("SMTP settings read as %+v", notification.SMTP)
+	}
+	if strings.Join(notification.To, ",") != "dba@example.com,oncall@example.com" {
+		t.Errorf("recipients %q", notification.To)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.json")
+	if err := os.WriteFile(bad, []byte(`{"profiles": {}, "smtp_host": "smtp.example.com", "smtp_starttls": "maybe"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadServeConfig(bad); err == nil || !strings.Contains(err.Error(), "smtp_starttls") {
+		t.Errorf("expected an invalid smtp_starttls to be refused, got %v", err)
+	}
+}
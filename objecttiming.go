@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"pg-schema-migrator/internal/dumpparse"
+)
+
+// ObjectTiming is how long the statements of one object of the schema took
+// to apply, as psql's \timing measured them
+type ObjectTiming struct {
+	Object  string  `json:"object"` // As its dump header names it: "TABLE public.users"
+	Line    int     `json:"line"`   // Where its header starts in the schema file
+	Seconds float64 `json:"seconds"`
+}
+
+// slowestObjectsShown is how many of the slowest objects the log and the
+// summaries list
+const slowestObjectsShown = 10
+
+// objectMarker is echoed by psql before the statements of each object; the
+// end marker follows the last
+const (
+	objectMarker    = "pgsm-object "
+	objectMarkerEnd = "end"
+)
+
+// timingPattern matches the line \timing prints after each statement, which
+// timingEnv keeps untranslated and with a decimal point
+var timingPattern = regexp.MustCompile(`^Time: ([0-9]+(?:\.[0-9]+)?) ms`)
+
+var timingEnv = map[string]string{"LC_MESSAGES": "C", "LC_NUMERIC": "C"}
+
+// objectTimer times the objects of a schema file while psql applies a copy
+// of it. Every entry of a pg_dump script opens with a line holding just
+// "--"; in the copy that line turns \timing on or echoes a marker naming the
+// entry, so the line numbers psql reports stay those of the schema file. As
+// the psql output passes through, the statement times following a marker are
+// added up for its object, and the markers and times are left out.
+type objectTimer struct {
+	path    string // The copy psql runs
+	timings []ObjectTiming
+	current int // Index into timings, -1 outside any object
+	out     io.Writer
+	pending []byte
+}
+
+// newObjectTimer writes the marked copy of schemaFile to the scratch
+// directory. It returns nil for files that aren't plain pg_dump scripts with
+// objects, which are applied untimed.
+func newObjectTimer(schemaFile string) (*objectTimer, error) {
+	if info, err := os.Stat(schemaFile); err != nil || info.IsDir() || isDumpArchive(schemaFile) {
+		return nil, err
+	}
+	dump, err := dumpparse.ParseFile(schemaFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(dump.Objects) == 0 || !strings.HasPrefix(dump.Head, "--\n") || dump.Tail != "" && !strings.HasPrefix(dump.Tail, "--\n") {
+		return nil, nil
+	}
+
+	t := &objectTimer{current: -1, out: os.Stdout}
+	var b strings.Builder
+	b.WriteString(`\timing on` + dump.Head[2:])
+	line := 1 + strings.Count(dump.Head, "\n")
+	for i, o := range dump.Objects {
+		if !strings.HasPrefix(o.Text, "--\n") {
+			return nil, nil
+		}
+		t.timings = append(t.timings, ObjectTiming{Object: o.String(), Line: line})
+		fmt.Fprintf(&b, `\echo %s%d%s`, objectMarker, i, o.Text[2:])
+		line += strings.Count(o.Text, "\n")
+	}
+	if dump.Tail != "" {
+		fmt.Fprintf(&b, `\echo %s%s%s`, objectMarker, objectMarkerEnd, dump.Tail[2:])
+	}
+
+	file, err := scratchFile("timed-*.sql")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := file.WriteString(b.String()); err != nil {
+		return nil, err
+	}
+	t.path = file.Name()
+	return t, file.Close()
+}
+
+// Write takes the output of psql, passing on what isn't a marker or a time
+func (t *objectTimer) Write(p []byte) (int, error) {
+	t.pending = append(t.pending, p...)
+	for {
+		i := bytes.IndexByte(t.pending, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := string(t.pending[:i+1])
+		t.pending = t.pending[i+1:]
+		if err := t.line(line); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+func (t *objectTimer) line(line string) error {
+	text := strings.TrimRight(line, "\r\n")
+	if marker, ok := strings.CutPrefix(text, objectMarker); ok {
+		t.current = -1
+		if i, err := strconv.Atoi(marker); err == nil && i >= 0 && i < len(t.timings) {
+			t.current = i
+		}
+		return nil
+	}
+	if m := timingPattern.FindStringSubmatch(text); m != nil {
+		if ms, err := strconv.ParseFloat(m[1], 64); err == nil && t.current >= 0 {
+			t.timings[t.current].Seconds += ms / 1000
+		}
+		return nil
+	}
+	_, err := io.WriteString(t.out, line)
+	return err
+}
+
+// close passes on a last line without a newline
+func (t *objectTimer) close() error {
+	if len(t.pending) == 0 {
+		return nil
+	}
+	line := string(t.pending)
+	t.pending = nil
+	return t.line(line)
+}
+
+// slowestObjects returns up to n of the objects that took longest, slowest
+// first. Objects that took no measurable time are left out.
+func slowestObjects(timings []ObjectTiming, n int) []ObjectTiming {
+	var slowest []ObjectTiming
+	for _, t := range timings {
+		if t.Seconds > 0 {
+			slowest = append(slowest, t)
+		}
+	}
+	slices.SortStableFunc(slowest, func(a, b ObjectTiming) int {
+		switch {
+		case a.Seconds > b.Seconds:
+			return -1
+		case a.Seconds < b.Seconds:
+			return 1
+		}
+		return 0
+	})
+	return slowest[:min(n, len(slowest))]
+}
+
+// objectTimingText describes the time an object took, for lists
+func objectTimingText(t ObjectTiming) string {
+	return fmt.Sprintf("%s (line %d): %s", t.Object, t.Line, objectSeconds(t.Seconds))
+}
+
+// objectSeconds rounds a duration to what's worth telling apart
+func objectSeconds(seconds float64) time.Duration {
+	d := time.Duration(seconds * float64(time.Second))
+	if d < time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(10 * time.Millisecond)
+}
+
+// reportObjectTimings logs the slowest objects of the apply, and warns about
+// those that took longer than --slow-object-threshold
+func reportObjectTimings(timings []ObjectTiming, threshold time.Duration) {
+	slowest := slowestObjects(timings, slowestObjectsShown)
+	if len(slowest) == 0 {
+		return
+	}
+	logger.Info("Slowest objects to apply:")
+	for _, t := range slowest {
+		logger.Info(fmt.Sprintf("   %s", objectTimingText(t)))
+	}
+
+	if threshold <= 0 {
+		return
+	}
+	var slow []string
+	for _, t := range slowestObjects(timings, len(timings)) {
+		if t.Seconds < threshold.Seconds() {
+			break
+		}
+		slow = append(slow, objectTimingText(t))
+	}
+	if len(slow) > 0 {
+		warn(WarnSlowObjects, fmt.Sprintf("%d object(s) took longer than --slow-object-threshold %s to apply:\n   %s",
+			len(slow), threshold, strings.Join(slow, "\n   ")))
+	}
+}
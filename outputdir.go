@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ephemeralFilesystems are the mount types whose files don't outlive a reboot
+// or the container they belong to
+var ephemeralFilesystems = map[string]string{
+	"tmpfs":   "memory-backed, lost on reboot",
+	"ramfs":   "memory-backed, lost on reboot",
+	"overlay": "a container file system, lost with the container",
+	"aufs":    "a container file system, lost with the container",
+}
+
+// OutputLocation is what the pre-flight check found out about a directory
+// the run writes files to
+type OutputLocation struct {
+	Purpose       string `json:"purpose"` // output or backup
+	Path          string `json:"path"`
+	Filesystem    string `json:"filesystem,omitempty"` // Mount type, when it can be read
+	MountPoint    string `json:"mount_point,omitempty"`
+	Ephemeral     string `json:"ephemeral,omitempty"` // Why files there may be lost
+	FreeBytes     *int64 `json:"free_bytes"`          // null when it can't be read
+	RequiredBytes int64  `json:"required_bytes,omitempty"`
+}
+
+func (l OutputLocation) String() string {
+	var details []string
+	if l.Filesystem != "" {
+		details = append(details, fmt.Sprintf("%s on %s", l.Filesystem, l.MountPoint))
+	}
+	if l.FreeBytes != nil {
+		details = append(details, formatBytes(*l.FreeBytes)+" free")
+	}
+	if l.RequiredBytes > 0 {
+		details = append(details, "about "+formatBytes(l.RequiredBytes)+" needed")
+	}
+	if len(details) == 0 {
+		return fmt.Sprintf("%s directory %s", l.Purpose, l.Path)
+	}
+	return fmt.Sprintf("%s directory %s (%s)", l.Purpose, l.Path, strings.Join(details, ", "))
+}
+
+// pathWithin reports whether path is dir or inside it
+func pathWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// inspectOutputLocation reads the mount, free space and temp-dir status of dir
+func inspectOutputLocation(purpose, dir string) OutputLocation {
+	loc := OutputLocation{Purpose: purpose, Path: dir}
+	path, err := filepath.Abs(dir)
+	if err == nil {
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			path = resolved
+		}
+	}
+	if err != nil {
+		logger.Debug(fmt.Sprintf("Cannot resolve %s: %v", dir, err))
+		return loc
+	}
+
+	if free, err := freeSpace(path); err == nil {
+		loc.FreeBytes = &free
+	} else {
+		logger.Debug(fmt.Sprintf("Cannot read free space of %s: %v", path, err))
+	}
+
+	if fstype, mountPoint, err := mountOf(path); err == nil {
+		loc.Filesystem, loc.MountPoint = fstype, mountPoint
+		if reason, ok := ephemeralFilesystems[fstype]; ok {
+			loc.Ephemeral = fmt.Sprintf("%s is %s", fstype, reason)
+		}
+	} else {
+		logger.Debug(fmt.Sprintf("Cannot read the mount of %s: %v", path, err))
+	}
+
+	if loc.Ephemeral == "" {
+		temp := os.TempDir()
+		if resolved, err := filepath.EvalSymlinks(temp); err == nil {
+			temp = resolved
+		}
+		if pathWithin(path, temp) {
+			loc.Ephemeral = fmt.Sprintf("it is inside the system temp directory %s, which may be cleaned at any time", temp)
+		}
+	}
+	return loc
+}
+
+// destinationDatabaseSize returns the size of the destination database, or
+// 0 when it doesn't exist yet
+func destinationDatabaseSize(dest *DatabaseConfig) (int64, error) {
+	db, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var size int64
+	err = db.QueryRowContext(runContext(), `SELECT pg_database_size(datname) FROM pg_database WHERE datname = $1`, dest.Database).Scan(&size)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return size, err
+}
+
+// checkOutputLocations makes sure the files of the run end up somewhere they
+// survive it. A data-inclusive backup on a memory-backed or container file
+// system, or in the temp directory, needs --allow-ephemeral-output, and must
+// fit in the free space there; other files only warn. Dry runs only warn.
+func checkOutputLocations(dest *DatabaseConfig, options *MigrationOptions, state *RunState) error {
+	var locations []OutputLocation
+	switch options.Output {
+	case "-":
+	case "":
+		locations = append(locations, inspectOutputLocation("output", options.OutputDir))
+	default:
+		locations = append(locations, inspectOutputLocation("output", filepath.Dir(options.Output)))
+	}
+
+	// The destination backup includes data for the rollback script
+	if options.Mode == "direct" && options.CreateBackup && options.Comments != CommentsOnly && dest != nil {
+		loc := inspectOutputLocation("backup", options.BackupDir)
+		if options.IncludeData && !options.PlanOnly { // Only the destination knows its size
+			size, err := destinationDatabaseSize(dest)
+			if err != nil {
+				warn(WarnDiskSpaceUnknown, fmt.Sprintf("Size of the destination backup can't be estimated: %v", err))
+			}
+			loc.RequiredBytes = size
+		}
+		locations = append(locations, loc)
+	}
+	// Staged files only need to last until the upload at the end of the run
+	for i := range locations {
+		if options.Staged != nil && strings.HasPrefix(locations[i].Path, options.Staged.dir) {
+			locations[i].Ephemeral = ""
+		}
+	}
+	state.OutputLocations = locations
+
+	for _, loc := range locations {
+		logger.Info(fmt.Sprintf("Writing %s", loc))
+
+		if loc.FreeBytes != nil && *loc.FreeBytes < loc.RequiredBytes {
+			msg := fmt.Sprintf("%s has %s free but the backup needs about %s (destination database size)", loc.Path, formatBytes(*loc.FreeBytes), formatBytes(loc.RequiredBytes))
+			switch {
+			case options.SpaceCheck.Skip:
+				warn(WarnDiskSpaceLow, msg+"; continuing because of --skip-space-check")
+			case options.DryRun:
+				warn(WarnDiskSpaceLow, msg+"; the run would stop here")
+			default:
+				return fmt.Errorf("%s; free up space, choose another --output-dir or use --skip-space-check", msg)
+			}
+		}
+
+		if loc.Ephemeral == "" {
+			continue
+		}
+		msg := fmt.Sprintf("The %s directory %s is not a safe place for files that must outlive this run: %s", loc.Purpose, loc.Path, loc.Ephemeral)
+		if loc.Purpose != "backup" || !options.IncludeData {
+			warn(WarnEphemeralOutput, msg)
+			continue
+		}
+		switch {
+		case options.AllowEphemeralOutput:
+			warn(WarnEphemeralOutput, msg+". The destination backup, the only way back after the drop, is written there anyway because of --allow-ephemeral-output; copy it somewhere safe")
+		case options.DryRun:
+			warn(WarnEphemeralOutput, msg+". The run would stop here without --allow-ephemeral-output")
+		default:
+			return fmt.Errorf("%s; the destination backup would be lost with it. Choose another --output-dir, or pass --allow-ephemeral-output to write it there anyway", msg)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// dollarQuotePattern matches the delimiters of dollar-quoted strings, such as
+// function bodies, whose lines are not statements of the dump
+var dollarQuotePattern = regexp.MustCompile(`\$(?:[A-Za-z_][A-Za-z_0-9]*)?\$`)
+
+// RoleHandling is the resolved combination of --roles, --privileges and
+// --owners, each of which can be given on its own
+type RoleHandling struct {
+	Roles      bool `json:"roles"`      // Roles exported with pg_dumpall and created on the destination
+	Privileges bool `json:"privileges"` // GRANT, REVOKE and ALTER DEFAULT PRIVILEGES kept in the schema
+	Owners     bool `json:"owners"`     // OWNER TO kept in the schema
+}
+
+func (h RoleHandling) String() string {
+	describe := func(what string, kept bool, yes, no string) string {
+		if kept {
+			return what + " " + yes
+		}
+		return what + " " + no
+	}
+	return strings.Join([]string{
+		describe("roles", h.Roles, "migrated", "not migrated"),
+		describe("privileges", h.Privileges, "kept", "stripped"),
+		describe("owners", h.Owners, "kept", "stripped"),
+	}, ", ")
+}
+
+// checkRoleHandling warns when the schema keeps statements naming source
+// roles that the run doesn't migrate
+func checkRoleHandling(options *MigrationOptions) {
+	h := options.RoleHandling
+	if h.Roles || (!h.Owners && !h.Privileges) {
+		return
+	}
+	var kept []string
+	if h.Owners {
+		kept = append(kept, "OWNER TO (--owners)")
+	}
+	if h.Privileges {
+		kept = append(kept, "GRANT/REVOKE (--privileges)")
+	}
+	warn(WarnRolesNotMigrated, fmt.Sprintf("The schema keeps %s statements naming source roles, but roles are not migrated without --roles; "+
+		"roles missing on the destination are handled by --missing-roles (%s)", strings.Join(kept, " and "), options.MissingRoles))
+}
+
+// ownershipStatement returns the kind of ownership or ACL statement line is,
+// or "" when it is neither. OWNER TO only counts when stripOwner is set, ACL
+// statements only when stripACL is.
+func ownershipStatement(line string, stripOwner, stripACL bool) string {
+	if !strings.HasSuffix(line, ";") {
+		return ""
+	}
+	switch {
+	case strings.HasPrefix(line, "ALTER ") && ownerToPattern.MatchString(line):
+		if stripOwner {
+			return "OWNER TO"
+		}
+		return ""
+	case !stripACL:
+		return ""
+	case strings.HasPrefix(line, "ALTER DEFAULT PRIVILEGES "):
+		return "ALTER DEFAULT PRIVILEGES"
+	case strings.HasPrefix(line, "GRANT "):
+		return "GRANT"
+	case strings.HasPrefix(line, "REVOKE "):
+		return "REVOKE"
+	}
+	return ""
+}
+
+// filterOwnership copies a plain-format pg_dump from r to w without, with
+// stripOwner, its OWNER TO statements and, with stripACL, its GRANT, REVOKE
+// and ALTER DEFAULT PRIVILEGES statements. The statements removed are written
+// to skipped; the counts by kind are returned.
+func filterOwnership(r io.Reader, w, skipped io.Writer, stripOwner, stripACL bool) (map[string]int, error) {
+	out := bufio.NewWriter(w)
+	skip := bufio.NewWriter(skipped)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	counts := make(map[string]int)
+	quote := "" // Delimiter of the dollar-quoted string being read
+	for scanner.Scan() {
+		line := scanner.Text()
+		if quote == "" {
+			if kind := ownershipStatement(line, stripOwner, stripACL); kind != "" {
+				counts[kind]++
+				skip.WriteString(line)
+				skip.WriteByte('\n')
+				continue
+			}
+		}
+		for _, delimiter := range dollarQuotePattern.FindAllString(line, -1) {
+			switch quote {
+			case "":
+				quote = delimiter
+			case delimiter:
+				quote = ""
+			}
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return counts, err
+	}
+	if err := skip.Flush(); err != nil {
+		return counts, err
+	}
+	return counts, out.Flush()
+}
+
+// stripOwnershipFile rewrites the dump at path with filterOwnership, saving
+// the statements removed to skippedPath. skippedPath is only kept when
+// something was removed.
+func stripOwnershipFile(path, skippedPath string, stripOwner, stripACL bool) (map[string]int, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(path), ".ownership-*.sql")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(out.Name())
+
+	skipped, err := os.Create(skippedPath)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(skipped, "-- Ownership and privilege statements removed from %s\n", filepath.Base(path))
+	fmt.Fprintf(skipped, "-- Apply them manually once the roles they name exist on the destination\n\n")
+
+	counts, err := filterOwnership(in, out, skipped, stripOwner, stripACL)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := skipped.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && len(counts) == 0 {
+		err = os.Remove(skippedPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info, err := in.Stat(); err == nil {
+		os.Chmod(out.Name(), info.Mode().Perm())
+	}
+	return counts, os.Rename(out.Name(), path)
+}
+
+// formatOwnershipCounts lists the statements removed by kind, e.g. "3 OWNER TO, 2 GRANT"
+func formatOwnershipCounts(counts map[string]int) (string, int) {
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	total := 0
+	parts := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[kind], kind))
+		total += counts[kind]
+	}
+	return strings.Join(parts, ", "), total
+}
+
+// stripOwnership removes the ownership statements pg_dump leaves in the
+// export despite --no-owner unless --owners is given, and the privilege
+// statements unless --privileges is, so they don't fail on a destination
+// without the roles. With --keep-ownership they are only counted.
+func stripOwnership(schemaFile, timestamp string, source *DatabaseConfig, options *MigrationOptions, state *RunState) error {
+	stripOwner, stripACL := !options.RoleHandling.Owners, !options.RoleHandling.Privileges
+	if !stripOwner && !stripACL {
+		return nil
+	}
+	if options.KeepOwnership {
+		in, err := os.Open(schemaFile)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		counts, err := filterOwnership(in, io.Discard, io.Discard, stripOwner, stripACL)
+		if err != nil {
+			return err
+		}
+		if summary, total := formatOwnershipCounts(counts); total > 0 {
+			warn(WarnOwnershipRemnants, fmt.Sprintf("The export contains %d ownership or privilege statement(s) (%s), kept by --keep-ownership; they fail where the roles they name are missing", total, summary))
+		}
+		return nil
+	}
+
+	skippedPath := filepath.Join(options.OutputDir, fmt.Sprintf("ownership_skipped_%s_%s.sql", source.Database, timestamp))
+	counts, err := stripOwnershipFile(schemaFile, skippedPath, stripOwner, stripACL)
+	if err != nil {
+		return err
+	}
+	summary, total := formatOwnershipCounts(counts)
+	if total == 0 {
+		return nil
+	}
+	state.OwnershipSkipped = counts
+	state.OwnershipSkippedFile = skippedPath
+	logger.Info(fmt.Sprintf("Removed %d ownership or privilege statement(s) from the export (%s), saved to: %s", total, summary, skippedPath))
+	return nil
+}
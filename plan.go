@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Dry-run plan formats for --plan-format
+const (
+	PlanFormatText = "text"
+	PlanFormatJSON = "json"
+)
+
+// planVersion is the version of the JSON plan. Within a version fields and
+// step types are only added, never renamed or removed, and every field is
+// always present, so consumers should ignore what they don't know.
+const planVersion = 1
+
+// Step types of a plan, in the order they run
+const (
+	PlanStepExport         = "export"
+	PlanStepBackup         = "backup"
+	PlanStepBlock          = "block-connections"
+	PlanStepTerminate      = "terminate"
+	PlanStepDrop           = "drop"
+	PlanStepCreate         = "create"
+	PlanStepRoles          = "roles"
+	PlanStepExtensions     = "extensions"
+	PlanStepApply          = "apply"
+	PlanStepPublications   = "publications"
+	PlanStepSeed           = "seed"
+	PlanStepAnalyze        = "analyze"
+	PlanStepUnblock        = "restore-connections"
+	PlanStepGrants         = "grants"
+	PlanStepRollbackScript = "rollback-script"
+	PlanStepVerify         = "verify"
+)
+
+// planStepPhases are the run phases whose history estimates a step
+var planStepPhases = map[string]string{
+	PlanStepExport:       "export",
+	PlanStepBackup:       "backup",
+	PlanStepCreate:       "recreate",
+	PlanStepRoles:        "roles",
+	PlanStepExtensions:   "extensions",
+	PlanStepApply:        "apply",
+	PlanStepPublications: "publications",
+	PlanStepSeed:         "seed",
+	PlanStepAnalyze:      "analyze",
+	PlanStepGrants:       "grants",
+	PlanStepVerify:       "verify",
+}
+
+// Plan is the machine-readable form of a dry run
+type Plan struct {
+	Version     int               `json:"version"`
+	Mode        string            `json:"mode"` // direct, bootstrap or apply
+	GeneratedAt time.Time         `json:"generated_at"`
+	Source      *ManifestDatabase `json:"source"` // null for apply
+	Destination *ManifestDatabase `json:"destination"`
+	SchemaFile  string            `json:"schema_file"`
+
+	DestinationPath string `json:"destination_path"` // recreate, in-place (empty destination, no backup or drop) or bootstrap
+
+	ObjectCounts     map[string]int `json:"object_counts"` // Objects in the schema by pg_dump TOC type
+	EstimatedSeconds *float64       `json:"estimated_seconds"`
+
+	Steps    []PlanStep  `json:"steps"`
+	Checks   []PlanCheck `json:"checks"` // Pre-flight phases the dry run went through
+	Warnings []Warning   `json:"warnings"`
+
+	OutputLocations []OutputLocation `json:"output_locations"` // Where files are written, and how safe that is
+
+	RoleHandling *RoleHandling `json:"role_handling"` // null for apply
+
+	Selection *SelectionReport `json:"selection"` // Objects left by --only and --skip; null without them
+}
+
+// PlanStep is one step of the migration. Commands are shell command lines,
+// SQL statements run over a connection of the tool; neither holds passwords,
+// which are passed in the environment.
+type PlanStep struct {
+	Type             string   `json:"type"`
+	Description      string   `json:"description"`
+	Commands         []string `json:"commands"`
+	SQL              []string `json:"sql"`
+	Executed         bool     `json:"executed"`          // Already done by the dry run, like the export
+	EstimatedSeconds *float64 `json:"estimated_seconds"` // From earlier runs, null when there are none
+}
+
+// PlanCheck is a phase the dry run completed before planning
+type PlanCheck struct {
+	Name            string  `json:"name"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// buildPlan describes the steps migrateDestination would take
+func buildPlan(dest *DatabaseConfig, schemaFile, backupFile string, options *MigrationOptions, state *RunState) *Plan {
+	plan := &Plan{
+		Version:     planVersion,
+		Mode:        state.Mode,
+		GeneratedAt: time.Now(),
+		Source:      manifestDatabase(state.Source),
+		Destination: manifestDatabase(dest),
+		SchemaFile:  schemaFile,
+
+		DestinationPath: state.DestinationPath,
+
+		ObjectCounts: state.ObjectCounts,
+		Steps:        []PlanStep{},
+		Checks:       []PlanCheck{},
+		Warnings:     state.Warnings,
+
+		OutputLocations: state.OutputLocations,
+		RoleHandling:    state.RoleHandling,
+		Selection:       state.Selection,
+	}
+	if plan.ObjectCounts == nil {
+		plan.ObjectCounts = map[string]int{}
+	}
+	if plan.Warnings == nil {
+		plan.Warnings = []Warning{}
+	}
+	if plan.OutputLocations == nil {
+		plan.OutputLocations = []OutputLocation{}
+	}
+
+	add := func(step PlanStep) {
+		if step.Commands == nil {
+			step.Commands = []string{}
+		}
+		if step.SQL == nil {
+			step.SQL = []string{}
+		}
+		if phase, ok := planStepPhases[step.Type]; ok {
+			if estimate, _ := state.estimatePhase(phase); estimate > 0 {
+				seconds := estimate.Seconds()
+				step.EstimatedSeconds = &seconds
+			}
+		}
+		plan.Steps = append(plan.Steps, step)
+	}
+	name := quoteIdentifier(dest.Database)
+
+	if source := state.Source; source != nil {
+		args := append(exportSchemaArgs(source, options), "-f", schemaFile)
+		step := PlanStep{
+			Type:        PlanStepExport,
+			Description: fmt.Sprintf("Export the schema of %s", source.Database),
+			Commands:    []string{commandLine(clientCommand(source, "pg_dump", args, schemaFile))},
+			Executed:    !options.PlanOnly,
+		}
+		if rolesFile := plannedRolesFile(options, state); options.PlanOnly && rolesFile != "" {
+			step.Commands = append(step.Commands, commandLine(clientCommand(source, "pg_dumpall", exportRolesArgs(source, rolesFile), rolesFile)))
+		}
+		add(step)
+	}
+	inPlace := state.DestinationPath == DestinationInPlace
+	if options.CreateBackup && !inPlace {
+		file := backupFile
+		if file == "" {
+			file, _ = options.artifactPath(ArtifactBackup, newArtifactNameData(state.Source, dest, state.Timestamp(), state))
+		}
+		add(PlanStep{
+			Type:        PlanStepBackup,
+			Description: fmt.Sprintf("Back up %s to %s", dest.Database, file),
+			Commands:    []string{commandLine(clientCommand(dest, "pg_dump", backupArgs(dest, file, options), file))},
+			Executed:    backupFile != "",
+		})
+	}
+	if options.MaintenanceWindow {
+		add(PlanStep{
+			Type:        PlanStepBlock,
+			Description: "Block new connections to the destination",
+			SQL:         []string{fmt.Sprintf("ALTER DATABASE %s WITH ALLOW_CONNECTIONS false", name)},
+		})
+	}
+	// A bootstrap never drops, and only creates a missing database; an empty
+	// destination is applied into as it is
+	if !options.Bootstrap && !inPlace {
+		add(PlanStep{
+			Type:        PlanStepTerminate,
+			Description: fmt.Sprintf("Terminate the other sessions on %s", dest.Database),
+			SQL:         []string{fmt.Sprintf("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = %s AND pid <> pg_backend_pid()", pq.QuoteLiteral(dest.Database))},
+		})
+		drop := []string{dropDatabaseStatement(dest.Database)}
+		if state.Replication != nil {
+			// Logical slots keep the database from being dropped
+			var slots []string
+			for _, slot := range state.Replication.Slots {
+				slots = append(slots, fmt.Sprintf("SELECT pg_drop_replication_slot(%s)", pq.QuoteLiteral(slot.Name)))
+			}
+			drop = append(slots, drop...)
+		}
+		add(PlanStep{
+			Type:        PlanStepDrop,
+			Description: fmt.Sprintf("Drop %s if it exists", dest.Database),
+			SQL:         drop,
+		})
+	}
+	if !inPlace && (!options.Bootstrap || !state.Bootstrap.DatabaseExisted) {
+		create := []string{buildCreateDatabaseStatement(dest.Database, &options.CreateDB)}
+		if options.MaintenanceWindow {
+			create = append(create, fmt.Sprintf("REVOKE CONNECT ON DATABASE %s FROM PUBLIC", name))
+		}
+		add(PlanStep{
+			Type:        PlanStepCreate,
+			Description: fmt.Sprintf("Create %s", dest.Database),
+			SQL:         create,
+		})
+	}
+	rolesFile := plannedRolesFile(options, state)
+	if rolesFile != "" || len(state.MissingRoles) > 0 {
+		step := PlanStep{Type: PlanStepRoles, Description: "Create the roles the schema refers to"}
+		if rolesFile != "" {
+			step.Commands = []string{commandLine(clientCommand(dest, "psql", applyRolesArgs(dest, rolesFile), rolesFile))}
+		}
+		for _, role := range state.MissingRoles {
+			step.SQL = append(step.SQL, fmt.Sprintf(placeholderRoleFormat, quoteIdentifier(role)))
+		}
+		add(step)
+	}
+	if options.Bootstrap && len(state.Bootstrap.Extensions) > 0 {
+		// Only public exists before the apply; the dump creates the rest
+		step := PlanStep{Type: PlanStepExtensions, Description: "Create the extensions of the schema that go into public ahead of the apply"}
+		if extensions, err := schemaFileExtensions(schemaFile); err == nil {
+			for _, ext := range extensions {
+				if ext.Schema == "public" {
+					step.SQL = append(step.SQL, fmt.Sprintf("CREATE EXTENSION IF NOT EXISTS %s WITH SCHEMA public", quoteIdentifier(ext.Name)))
+				}
+			}
+		}
+		add(step)
+	}
+	add(PlanStep{
+		Type:        PlanStepApply,
+		Description: fmt.Sprintf("Apply %s", schemaFile),
+		Commands:    []string{commandLine(clientCommand(dest, "psql", applySchemaArgs(dest, schemaFile), schemaFile))},
+	})
+	if options.RecreatePublications && state.Replication != nil && len(state.Replication.Publications) > 0 {
+		step := PlanStep{Type: PlanStepPublications, Description: "Recreate the publications of the old database the schema doesn't create"}
+		for _, pub := range state.Replication.Publications {
+			step.SQL = append(step.SQL, pub.createStatement(pub.Tables))
+		}
+		add(step)
+	}
+	if options.SeedFile != "" {
+		add(PlanStep{
+			Type: PlanStepSeed,
+			Description: fmt.Sprintf("Load seed data from %s (triggers disabled: %t, constraints deferred: %t)",
+				options.SeedFile, options.DisableTriggersDuringData, options.DeferConstraints),
+		})
+		if !options.Analyze.Skip {
+			add(PlanStep{
+				Type:        PlanStepAnalyze,
+				Description: fmt.Sprintf("%s each table changed since it was last analyzed, %d at a time; failures only warn", options.Analyze.command(), options.Analyze.Jobs),
+			})
+		}
+	}
+	if options.MaintenanceWindow {
+		add(PlanStep{Type: PlanStepUnblock, Description: "Restore the original connection settings (also on failure)"})
+	}
+	if state.Grants != nil && options.RestoreGrants {
+		step := PlanStep{Type: PlanStepGrants, Description: fmt.Sprintf("Re-apply the grants and settings of the old database saved to %s", state.Grants.File)}
+		if statements, err := readGrantsSnapshot(state.Grants.File); err == nil {
+			step.SQL = statements
+		}
+		add(step)
+	}
+	if options.CreateBackup {
+		rollbackScript, _ := options.artifactPath(ArtifactRollback, newArtifactNameData(state.Source, dest, state.Timestamp(), state))
+		add(PlanStep{Type: PlanStepRollbackScript, Description: fmt.Sprintf("Write %s", rollbackScript)})
+	}
+	add(PlanStep{Type: PlanStepVerify, Description: "Check that constraints are validated and triggers are in the same state as on the source"})
+
+	// A failed check ends the run before planning, so these all passed
+	for _, p := range state.Phases {
+		if p.Name != "export" && p.Name != "backup" {
+			plan.Checks = append(plan.Checks, PlanCheck{Name: p.Name, DurationSeconds: p.Duration.Seconds()})
+		}
+	}
+
+	var total float64
+	for _, step := range plan.Steps {
+		if step.EstimatedSeconds != nil && !step.Executed {
+			total += *step.EstimatedSeconds
+		}
+	}
+	if total > 0 {
+		plan.EstimatedSeconds = &total
+	}
+	return plan
+}
+
+// plannedRolesFile is the roles file the plan applies: the one exported, or
+// the one a plan-only dry run would export
+func plannedRolesFile(options *MigrationOptions, state *RunState) string {
+	if options.PlanOnly && options.RoleHandling.Roles && state.Source != nil && options.Output != "-" {
+		return rolesFilePath(options, state.Source, state.Timestamp())
+	}
+	return state.RolesFile
+}
+
+// logPlan logs the steps migrateDestination would take, the text form of
+// buildPlan
+func logPlan(dest *DatabaseConfig, schemaFile, backupFile string, options *MigrationOptions, state *RunState) {
+	if options.PlanOnly {
+		logger.Info("DRY RUN MODE (plan only, nothing connected) - showing what would be done:")
+	} else {
+		logger.Info("DRY RUN MODE - showing what would be done:")
+	}
+	inPlace := state.DestinationPath == DestinationInPlace
+	rolesFile := plannedRolesFile(options, state)
+	if options.PlanOnly {
+		// Nothing has run yet: the export and the backup come first
+		if source := state.Source; source != nil {
+			args := append(exportSchemaArgs(source, options), "-f", schemaFile)
+			logger.Info(fmt.Sprintf("Export the schema of %s: %s", source.Database, commandLine(clientCommand(source, "pg_dump", args, schemaFile))))
+			if rolesFile != "" {
+				logger.Info(fmt.Sprintf("Export the roles of the source cluster: %s", commandLine(clientCommand(source, "pg_dumpall", exportRolesArgs(source, rolesFile), rolesFile))))
+			}
+		}
+		if options.CreateBackup && !inPlace {
+			file, _ := options.artifactPath(ArtifactBackup, newArtifactNameData(state.Source, dest, state.Timestamp(), state))
+			logger.Info(fmt.Sprintf("Back up %s: %s", dest.Database, commandLine(clientCommand(dest, "pg_dump", backupArgs(dest, file, options), file))))
+		}
+	}
+	if options.MaintenanceWindow {
+		logger.Info(fmt.Sprintf("   Block new connections: ALTER DATABASE %s WITH ALLOW_CONNECTIONS false", quoteIdentifier(dest.Database)))
+	}
+	switch {
+	case inPlace:
+		logger.Info(fmt.Sprintf("1. Apply into the existing empty database %s (nothing is backed up or dropped; --force-recreate recreates it)", dest.Database))
+	case !options.Bootstrap:
+		logger.Info(fmt.Sprintf("1. Drop and recreate database: %s", dest.Database))
+		logger.Info(fmt.Sprintf("   %s", buildCreateDatabaseStatement(dest.Database, &options.CreateDB)))
+	case state.Bootstrap.DatabaseExisted:
+		logger.Info(fmt.Sprintf("1. Bootstrap into the existing database %s (nothing is dropped)", dest.Database))
+	default:
+		logger.Info(fmt.Sprintf("1. Bootstrap: create database %s (nothing is dropped)", dest.Database))
+		logger.Info(fmt.Sprintf("   %s", buildCreateDatabaseStatement(dest.Database, &options.CreateDB)))
+	}
+	if options.MaintenanceWindow {
+		logger.Info(fmt.Sprintf("   Keep others out: REVOKE CONNECT ON DATABASE %s FROM PUBLIC", quoteIdentifier(dest.Database)))
+	}
+	if rolesFile != "" {
+		logger.Info(fmt.Sprintf("   Apply roles from: %s", rolesFile))
+	}
+	for _, role := range state.MissingRoles {
+		logger.Info(fmt.Sprintf("   "+placeholderRoleFormat, quoteIdentifier(role)))
+	}
+	if options.Bootstrap && len(state.Bootstrap.Extensions) > 0 {
+		logger.Info(fmt.Sprintf("   Create extensions: %s", strings.Join(state.Bootstrap.Extensions, ", ")))
+	}
+	if state.Replication != nil {
+		for _, slot := range state.Replication.Slots {
+			logger.Info(fmt.Sprintf("   Drop replication %s first (needs --accept-replication-breakage)", slot))
+		}
+	}
+	logger.Info(fmt.Sprintf("2. Apply schema from: %s", schemaFile))
+	if state.Selection != nil {
+		logger.Info(fmt.Sprintf("   Only the %d object(s) selected with --only/--skip, listed above", len(state.Selection.Objects)))
+	}
+	logger.Info(fmt.Sprintf("   Roles and privileges: %s", options.RoleHandling))
+	if options.RecreatePublications && state.Replication != nil {
+		for _, pub := range state.Replication.Publications {
+			logger.Info(fmt.Sprintf("   Then recreate %s unless the schema does", pub))
+		}
+	}
+	logger.Info(fmt.Sprintf("   %s", commandLine(clientCommand(dest, "psql", applySchemaArgs(dest, schemaFile), schemaFile))))
+	if options.CreateBackup && backupFile != "" {
+		logger.Info(fmt.Sprintf("3. Backup created at: %s", backupFile))
+	}
+	if options.SeedFile != "" {
+		logger.Info(fmt.Sprintf("Then load seed data from: %s (triggers disabled: %t, constraints deferred: %t)",
+			options.SeedFile, options.DisableTriggersDuringData, options.DeferConstraints))
+		if !options.Analyze.Skip {
+			logger.Info(fmt.Sprintf("Then %s the tables loaded, %d at a time", options.Analyze.command(), options.Analyze.Jobs))
+		}
+	}
+	if options.MaintenanceWindow {
+		logger.Info("Finally restore the original connection settings (also on failure)")
+	}
+	if state.Grants != nil && options.RestoreGrants {
+		logger.Info(fmt.Sprintf("Then re-apply %d grant(s) and setting(s) of the old database from: %s", state.Grants.Statements, state.Grants.File))
+	} else if state.Grants != nil {
+		logger.Info(fmt.Sprintf("Grants and settings of the old database are saved to %s but not re-applied (--no-restore-grants)", state.Grants.File))
+	}
+	for _, loc := range state.OutputLocations {
+		if loc.Ephemeral != "" {
+			logger.Warning(fmt.Sprintf("Files go to the %s, which is ephemeral: %s", loc, loc.Ephemeral))
+		} else {
+			logger.Info(fmt.Sprintf("Files go to the %s", loc))
+		}
+	}
+	if options.Staged != nil {
+		logger.Info(fmt.Sprintf("When the run ends, upload them to %s", options.Staged.storage))
+	}
+	if line := gitPlanLine(options, state); line != "" {
+		logger.Info(line)
+	}
+	if options.BackupUpload != nil && options.CreateBackup {
+		logger.Info(fmt.Sprintf("When the run ends, upload the backup and rollback script to %s (--backup-upload)", options.BackupUpload))
+	}
+}
+
+// writePlan writes plan as indented JSON, leaving the < and > of SQL as they are
+func writePlan(w io.Writer, plan *Plan) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(plan)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// planScenarios are the dry runs whose JSON plans are kept as golden files
+func planScenarios(dir string) map[string]func() *Plan {
+	started := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+	source := &DatabaseConfig{Host: "source.example.com", Port: "5432", Username: "reader", Database: "app", SSLMode: "require"}
+	dest := func() *DatabaseConfig {
+		return &DatabaseConfig{Host: "dest.example.com", Port: "5432", Username: "migrator", Database: "App Prod", SSLMode: "require", Role: "owner"}
+	}
+	options := func() *MigrationOptions {
+		return &MigrationOptions{
+			OutputDir:    dir,
+			BackupDir:    filepath.Join(dir, "backups"),
+			CreateBackup: true,
+			Analyze:      AnalyzeOptions{Jobs: 4},
+		}
+	}
+	state := func(mode string) *RunState {
+		s := newRunState("")
+		s.StartedAt = started
+		s.Mode = mode
+		s.OutputDir = dir
+		s.ObjectCounts = map[string]int{"TABLE": 12, "INDEX": 20, "FUNCTION": 3}
+		s.Phases = []PhaseTiming{
+			{Name: "export", Start: started, Duration: 4 * time.Second},
+			{Name: "preflight", Start: started.Add(4 * time.Second), Duration: 1500 * time.Millisecond},
+			{Name: "backup", Start: started.Add(6 * time.Second), Duration: 9 * time.Second},
+		}
+		s.history = []*RunResult{}
+		return s
+	}
+	schemaFile := filepath.Join(dir, "schema_App Prod_20260304_050607.sql")
+	backupFile := filepath.Join(dir, "backups", "backup_App Prod_20260304_050607.sql")
+
+	return map[string]func() *Plan{
+		"direct": func() *Plan {
+			o := options()
+			o.MaintenanceWindow = true
+			o.SeedFile = "seed.sql"
+			o.DisableTriggersDuringData = true
+			s := state("direct")
+			s.Source = source
+			s.Dest = dest()
+			s.DestinationPath = DestinationRecreate
+			s.Warnings = []Warning{{Code: WarnBackupSkipped, Message: "an example warning"}}
+			// An earlier run of the same migration estimates the steps
+			s.history = []*RunResult{{
+				Source:       manifestDatabase(source),
+				Destination:  manifestDatabase(s.Dest),
+				PhaseSeconds: map[string]float64{"export": 3, "backup": 8, "apply": 20, "seed": 60},
+			}}
+			return buildPlan(s.Dest, schemaFile, backupFile, o, s)
+		},
+		"apply-in-place": func() *Plan {
+			o := options()
+			s := state("apply")
+			s.Dest = dest()
+			s.DestinationPath = DestinationInPlace
+			return buildPlan(s.Dest, schemaFile, "", o, s)
+		},
+		"bootstrap": func() *Plan {
+			o := options()
+			o.Bootstrap = true
+			o.CreateBackup = false
+			s := state("bootstrap")
+			s.Source = source
+			s.Dest = dest()
+			s.DestinationPath = DestinationBootstrap
+			s.Bootstrap = &BootstrapReport{DatabaseExisted: false}
+			return buildPlan(s.Dest, schemaFile, "", o, s)
+		},
+	}
+}
+
+// TestPlanGolden keeps the JSON plan stable for the tools that read it. A
+// plan that differs from its golden file of the current planVersion fails;
+// go test -update rewrites the golden files, but only when the plan still
+// has every field and step type of the golden file, as a plan of the same
+// version must. Anything else needs planVersion raised, which starts new
+// golden files.
+func TestPlanGolden(t *testing.T) {
+	t.Setenv("PGOPTIONS", "")
+	dir := "/var/lib/pgsm"
+	for name, build := range planScenarios(dir) {
+		plan := build()
+		plan.GeneratedAt = time.Date(2026, 3, 4, 5, 7, 0, 0, time.UTC)
+		var b bytes.Buffer
+		if err := writePlan(&b, plan); err != nil {
+			t.Fatal(err)
+		}
+		got := b.String()
+
+		golden := filepath.Join("testdata", fmt.Sprintf("plan_v%d_%s.golden", planVersion, name))
+		want, err := os.ReadFile(golden)
+		if os.IsNotExist(err) && *updateGolden {
+			if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v (go test -update creates it)", err)
+		}
+		if got == string(want) {
+			continue
+		}
+
+		var before, after any
+		if err := json.Unmarshal(want, &before); err != nil {
+			t.Fatalf("%s: %v", golden, err)
+		}
+		if err := json.Unmarshal([]byte(got), &after); err != nil {
+			t.Fatal(err)
+		}
+		if problems := planCompatible("", before, after); len(problems) > 0 {
+			t.Errorf("the %s plan changed incompatibly with version %d of the plan; raise planVersion:\n   %s",
+				name, planVersion, strings.Join(problems, "\n   "))
+			continue
+		}
+		if *updateGolden {
+			if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		t.Errorf("the %s plan differs from %s; review the change and run go test -update:\n%s", name, golden, got)
+	}
+}
+
+// planCompatible lists what a consumer of plan before would miss in after:
+// fields that are gone or hold another kind of value, and step types gone.
+// Elements of arrays may be added anywhere, so those of before must appear
+// in after in the same order.
+func planCompatible(path string, before, after any) []string {
+	if before == nil || after == nil {
+		return nil // null is allowed for any field
+	}
+	switch b := before.(type) {
+	case map[string]any:
+		a, ok := after.(map[string]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s is no longer an object", path)}
+		}
+		var problems []string
+		for key, value := range b {
+			other, ok := a[key]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s.%s was removed", path, key))
+				continue
+			}
+			if key == "type" && other != value {
+				problems = append(problems, fmt.Sprintf("%s.type %v became %v", path, value, other))
+				continue
+			}
+			problems = append(problems, planCompatible(path+"."+key, value, other)...)
+		}
+		return problems
+	case []any:
+		a, ok := after.([]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s is no longer an array", path)}
+		}
+		j := 0
+		for i, value := range b {
+			for j < len(a) && len(planCompatible("", value, a[j])) > 0 {
+				j++
+			}
+			if j == len(a) {
+				return []string{fmt.Sprintf("%s[%d] has no counterpart: %v", path, i, value)}
+			}
+			j++
+		}
+		return nil
+	default:
+		if fmt.Sprintf("%T", before) != fmt.Sprintf("%T", after) {
+			return []string{fmt.Sprintf("%s changed from %T to %T", path, before, after)}
+		}
+		return nil
+	}
+}
+
+func TestPlanCompatible(t *testing.T) {
+	parse := func(s string) any {
+		var v any
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	base := `{"version": 1, "steps": [{"type": "export", "sql": []}, {"type": "apply", "sql": ["x"]}], "estimated_seconds": null}`
+	for _, test := range []struct {
+		after      string
+		compatible bool
+	}{
+		{base, true},
+		{`{"version": 1, "steps": [{"type": "export", "sql": []}, {"type": "apply", "sql": ["y"]}], "estimated_seconds": 3, "new": true}`, true},
+		{`{"version": 1, "steps": [{"type": "export", "sql": []}, {"type": "block", "sql": []}, {"type": "apply", "sql": ["x"]}], "estimated_seconds": null}`, true},
+		{`{"version": 1, "steps": [{"type": "export", "sql": []}], "estimated_seconds": null}`, false},
+		{`{"version": 1, "steps": [{"type": "export", "sql": []}, {"type": "run", "sql": ["x"]}], "estimated_seconds": null}`, false},
+		{`{"version": 1, "steps": [{"type": "export", "sql": ""}, {"type": "apply", "sql": ["x"]}], "estimated_seconds": null}`, false},
+		{`{"version": "1", "steps": [{"type": "export", "sql": []}, {"type": "apply", "sql": ["x"]}], "estimated_seconds": null}`, false},
+		{`{"steps": [{"type": "export", "sql": []}, {"type": "apply", "sql": ["x"]}], "estimated_seconds": null}`, false},
+	} {
+		problems := planCompatible("", parse(base), parse(test.after))
+		if (len(problems) == 0) != test.compatible {
+			t.Errorf("%s: compatible %v, want %v: %q", test.after, len(problems) == 0, test.compatible, problems)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Levels of --dry-run
+const (
+	DryRunConnected = "connected" // Connects and runs every check, changing nothing
+	DryRunPlanOnly  = "plan-only" // Plans from the flags alone, without connecting
+)
+
+// planOnlyDestDB stands in for a destination database a plan-only dry run
+// would otherwise prompt for
+const planOnlyDestDB = "<dest-db>"
+
+// parseDryRun reads --dry-run. A bare --dry-run is connected, as is true,
+// from when the flag was a bool.
+func parseDryRun(value string) (dryRun, planOnly bool, err error) {
+	switch value {
+	case "", "false":
+		return false, false, nil
+	case DryRunConnected, "true":
+		return true, false, nil
+	case DryRunPlanOnly:
+		return true, true, nil
+	}
+	return false, false, fmt.Errorf("invalid --dry-run %q, must be '%s' or '%s'", value, DryRunConnected, DryRunPlanOnly)
+}
+
+// runPlanOnly plans a migration, or the apply of schemaFile, from the flags
+// alone for --dry-run=plan-only. Nothing connects and no password is asked
+// for: the checks are the ones needing no server, and what only the servers
+// could tell, like whether the destination is empty or which roles it
+// lacks, is left out of the plan.
+func runPlanOnly(cmd *cobra.Command, schemaFile string, options *MigrationOptions, state *RunState) error {
+	var source, dest *DatabaseConfig
+	var err error
+	if !cmd.HasParent() {
+		if source, err = sourceConfigFromFlags(cmd); err != nil {
+			return exitWith(exitOptionError, fmt.Errorf("Failed to get source config: %v", err))
+		}
+		if err := validateSSLFiles(source); err != nil {
+			return exitWith(exitOptionError, fmt.Errorf("Invalid source SSL files: %v", err))
+		}
+	}
+	if options.Mode == "direct" {
+		if dest, err = destConfigFromFlags(cmd); err != nil {
+			return exitWith(exitOptionError, fmt.Errorf("Failed to get destination config: %v", err))
+		}
+		if err := validateSSLFiles(dest); err != nil {
+			return exitWith(exitOptionError, fmt.Errorf("Invalid destination SSL files: %v", err))
+		}
+		if dest.Database == "" {
+			dest.Database = planOnlyDestDB
+			if template, _ := cmd.Flags().GetString("dest-db-template"); template != "" {
+				if dest.Database, err = renderDestName(template, source.Database, state); err != nil {
+					return exitWith(exitOptionError, err)
+				}
+			}
+		}
+		state.DestinationPath = DestinationRecreate
+		if options.Bootstrap {
+			state.DestinationPath = DestinationBootstrap
+		}
+	}
+	state.Source, state.Dest = source, dest
+
+	if err := prepareArtifactNames(options, state); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+	if source != nil {
+		if schemaFile, err = exportPath(source, dest, options, state); err != nil {
+			return exitWith(exitOptionError, err)
+		}
+	}
+
+	err = state.phase("client-check", func() error {
+		return checkClientBinaries(plannedClientTools(source, dest, schemaFile, options))
+	})
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("client tools check failed: %v", err))
+	}
+	err = state.phase("output-check", func() error {
+		if err := checkOutputLocations(dest, options, state); err != nil {
+			return err
+		}
+		return checkDirectoriesWritable(state.OutputLocations)
+	})
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("output directory check failed: %v", err))
+	}
+	err = state.phase("git-check", func() error {
+		return checkGitOutput(source, dest, options, state)
+	})
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("git check failed: %v", err))
+	}
+
+	switch {
+	case dest == nil:
+		logExportPlan(source, schemaFile, options, state)
+	case options.PlanFormat == PlanFormatJSON:
+		if err := writePlan(os.Stdout, buildPlan(dest, schemaFile, "", options, state)); err != nil {
+			return exitWith(exitFailure, fmt.Errorf("Failed to write plan: %v", err))
+		}
+	default:
+		logPlan(dest, schemaFile, "", options, state)
+	}
+	if dest != nil && !options.Bootstrap && !options.ForceRecreate {
+		logger.Info(fmt.Sprintf("An empty destination would be applied into in place instead, without the backup and drop; --dry-run=%s checks", DryRunConnected))
+	}
+
+	if err := finishRun(state, options); err != nil {
+		return err
+	}
+	logger.Success("Plan complete; nothing was connected to")
+	return nil
+}
+
+// logExportPlan logs the steps of a plan-only export
+func logExportPlan(source *DatabaseConfig, schemaFile string, options *MigrationOptions, state *RunState) {
+	logger.Info("DRY RUN MODE (plan only, nothing connected) - showing what would be done:")
+	args, to := exportSchemaArgs(source, options), "stdout"
+	if schemaFile != "-" {
+		args, to = append(args, "-f", schemaFile), schemaFile
+	}
+	logger.Info(fmt.Sprintf("1. Export the schema of %s to %s", source.Database, to))
+	logger.Info(fmt.Sprintf("   %s", commandLine(clientCommand(source, "pg_dump", args, schemaFile))))
+	if rolesFile := plannedRolesFile(options, state); rolesFile != "" {
+		logger.Info(fmt.Sprintf("2. Export the roles of the source cluster to %s", rolesFile))
+		logger.Info(fmt.Sprintf("   %s", commandLine(clientCommand(source, "pg_dumpall", exportRolesArgs(source, rolesFile), rolesFile))))
+	}
+	for _, loc := range state.OutputLocations {
+		logger.Info(fmt.Sprintf("Files go to the %s", loc))
+	}
+	if options.Staged != nil {
+		logger.Info(fmt.Sprintf("When the run ends, upload them to %s", options.Staged.storage))
+	}
+	if line := gitPlanLine(options, state); line != "" {
+		logger.Info(line)
+	}
+}
+
+// plannedClientTools lists the client programs a run would start
+func plannedClientTools(source, dest *DatabaseConfig, schemaFile string, options *MigrationOptions) []string {
+	var tools []string
+	if source != nil || dest != nil && options.CreateBackup {
+		tools = append(tools, "pg_dump")
+	}
+	if source != nil && options.RoleHandling.Roles {
+		tools = append(tools, "pg_dumpall")
+	}
+	if dest != nil {
+		tools = append(tools, "psql")
+	}
+	// Directory dumps are read with pg_restore
+	if info, err := os.Stat(schemaFile); options.Format == DumpFormatDirectory || isDumpArchive(schemaFile) || err == nil && info.IsDir() && !isSplitSchema(schemaFile) {
+		tools = append(tools, "pg_restore")
+	}
+	return tools
+}
+
+// checkClientBinaries finds the client programs in PATH. Through docker they
+// are in the image or container, which configureClientTools leaves to docker.
+func checkClientBinaries(tools []string) error {
+	if clientTools.usesDocker() {
+		return nil
+	}
+	var missing []string
+	for _, tool := range tools {
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			missing = append(missing, tool)
+			continue
+		}
+		logger.Debug(fmt.Sprintf("Found %s at %s", tool, path))
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s not found in PATH; install the PostgreSQL client tools or use --client-docker-image", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkDirectoriesWritable makes sure a file can be written to each
+// location: an existing directory must take one, and a missing one must be
+// creatable in its nearest existing parent. Nothing is left behind.
+func checkDirectoriesWritable(locations []OutputLocation) error {
+	for _, loc := range locations {
+		dir := loc.Path
+		for {
+			info, err := os.Stat(dir)
+			if err == nil && !info.IsDir() {
+				return fmt.Errorf("the %s directory %s can't be created: %s is not a directory", loc.Purpose, loc.Path, dir)
+			}
+			if err == nil {
+				break
+			}
+			parent := filepath.Dir(dir)
+			if !os.IsNotExist(err) || parent == dir {
+				return fmt.Errorf("the %s directory %s can't be created: %v", loc.Purpose, loc.Path, err)
+			}
+			dir = parent
+		}
+		file, err := os.CreateTemp(dir, ".pgsm-write-check-*")
+		if err != nil {
+			return fmt.Errorf("the %s directory %s is not writable: %v", loc.Purpose, loc.Path, err)
+		}
+		file.Close()
+		os.Remove(file.Name())
+	}
+	return nil
+}
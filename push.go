@@ -0,0 +1,715 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"pg-schema-migrator/internal/dumpparse"
+)
+
+// pushTransactionPrefix starts the line each chunk prints with the ID of its
+// transaction, so a chunk whose commit was not seen can be looked up
+const pushTransactionPrefix = "pg-schema-migrate push transaction "
+
+// Exit statuses of psql
+const (
+	psqlConnectionLost = 2 // The connection failed or was lost
+	psqlScriptFailed   = 3 // A statement failed with ON_ERROR_STOP set
+)
+
+// pushRetryDelay is the wait before a chunk is tried again after the
+// connection dropped, doubled for every further attempt
+const pushRetryDelay = 2 * time.Second
+
+// pushStatusChecks is how often the transaction of a chunk is looked up while
+// the destination still has it in progress, pushRetryDelay apart
+const pushStatusChecks = 5
+
+// transactionControlPattern matches statements ending or starting a
+// transaction, which would break up the transaction of a chunk
+var transactionControlPattern = regexp.MustCompile(`(?i)^(?:BEGIN|START\s+TRANSACTION|COMMIT|END|ROLLBACK|ABORT)\b`)
+
+// byteSizePattern matches a size such as 64MB, 1.5GiB or 512k
+var byteSizePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([kKmMgGtT]?)(?:i?[bB])?$`)
+
+// PushState is the progress of a push, checkpointed after every chunk so an
+// interrupted push continues after the last chunk that committed
+type PushState struct {
+	File        string    `json:"file"`
+	SHA256      string    `json:"sha256"`
+	Size        int64     `json:"size"`
+	Destination string    `json:"destination"` // host:port/database
+	Statements  int       `json:"statements"`  // In the whole file
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	Applied   int      `json:"statements_applied"`
+	Chunks    int      `json:"chunks_applied"`
+	Offset    int64    `json:"offset"`             // Byte offset after the last chunk applied
+	Line      int      `json:"line"`               // Line of the file after the last chunk applied
+	Settings  []string `json:"settings,omitempty"` // Session settings of the file before Offset
+	Completed bool     `json:"completed,omitempty"`
+
+	Pending *PushCheckpoint `json:"pending,omitempty"` // Chunk sent whose commit was not seen
+}
+
+// PushCheckpoint is where a push stands once a chunk has committed
+type PushCheckpoint struct {
+	Transaction string   `json:"transaction,omitempty"` // txid_current() of the chunk
+	Offset      int64    `json:"offset"`
+	Line        int      `json:"line"`
+	Statements  int      `json:"statements"` // Of the chunk
+	Settings    []string `json:"settings,omitempty"`
+}
+
+// PushReport is what a push did, for the run manifest
+type PushReport struct {
+	File         string `json:"file"`
+	StateFile    string `json:"state_file"`
+	ChunkSize    int64  `json:"chunk_size"`
+	MaxRate      int64  `json:"max_rate,omitempty"` // Bytes per second
+	Statements   int    `json:"statements"`         // In the file
+	Applied      int    `json:"statements_applied"` // By this and earlier runs
+	ResumedAt    int    `json:"resumed_at_line,omitempty"`
+	Chunks       int    `json:"chunks"` // Applied by this run
+	Bytes        int64  `json:"bytes"`  // Of the file applied by this run
+	Retries      int    `json:"retries,omitempty"`
+	Transactions int    `json:"transactions_looked_up,omitempty"` // Chunks whose commit was only known from txid_status
+}
+
+// parseByteSize reads a size in bytes with an optional unit, k, M, G or T,
+// which count in powers of 1024 as PostgreSQL settings do
+func parseByteSize(value string) (int64, error) {
+	m := byteSizePattern.FindStringSubmatch(strings.TrimSpace(value))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q, expected a number with an optional unit such as 64MB", value)
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	exponent := strings.IndexByte("kmgt", strings.ToLower(m[2] + " ")[0]) + 1
+	size := int64(n * float64(int64(1)<<(10*exponent)))
+	if size <= 0 {
+		return 0, fmt.Errorf("invalid size %q, must be more than 0 bytes", value)
+	}
+	return size, nil
+}
+
+// throttledReader reads from r at no more than rate bytes per second on average
+type throttledReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	// Bursts of at most a tenth of a second
+	if burst := t.rate/10 + 1; int64(len(p)) > burst {
+		p = p[:burst]
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	due := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+	if wait := due - time.Since(t.start); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-runContext().Done():
+			return n, runContext().Err()
+		}
+	}
+	return n, err
+}
+
+// pushDestination identifies the destination in the state file, as given on
+// the command line rather than through a tunnel
+func pushDestination(dest *DatabaseConfig) string {
+	address := dest.Host + ":" + dest.Port
+	if dest.TunnelTarget != "" {
+		address = dest.TunnelTarget
+	}
+	return address + "/" + dest.Database
+}
+
+func newPushCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "push [file]",
+		Short: "Apply a large SQL file to the destination in resumable chunks",
+		Long: "Apply a plain SQL file, such as a schema with seed data, to the existing destination database in chunks of " +
+			"about --chunk-size bytes. Chunks end between statements and each is applied in a transaction of its own, so " +
+			"the destination holds every statement up to the end of a chunk or none of it. Progress is checkpointed in a " +
+			"state file after every chunk: a chunk that fails because the connection dropped is tried again, and pushing " +
+			"the same file again continues after the last chunk that committed. Once done, the statements applied are " +
+			"checked against those of the file.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: runPush,
+	}
+
+	cmd.Flags().StringP("file", "f", "", "SQL file to push")
+	cmd.Flags().StringP("chunk-size", "", "64MB", "Bytes of the file applied per transaction, ended at the next statement (k, M, G, T count in powers of 1024)")
+	cmd.Flags().StringP("max-rate", "", "", "Send at most this many bytes of the file per second, e.g. 10MB (default unlimited)")
+	cmd.Flags().StringP("state-file", "", "", "Progress of the push (default push_<db>_<file>.json in --output-dir)")
+	cmd.Flags().IntP("retries", "", 5, "Times a chunk is tried again after the connection to the destination dropped")
+	cmd.Flags().BoolP("restart", "", false, "Start at the beginning of the file even when the state file records progress")
+	return cmd
+}
+
+func runPush(cmd *cobra.Command, args []string) error {
+	if err := configureCIOutput(cmd); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	logger.Info("Starting PostgreSQL schema push...")
+	handleSignals()
+
+	file, _ := cmd.Flags().GetString("file")
+	if len(args) == 1 {
+		if file != "" {
+			return exitWith(exitOptionError, errors.New("give the file either as argument or with --file, not both"))
+		}
+		file = args[0]
+	}
+	switch {
+	case file == "":
+		return exitWith(exitOptionError, errors.New("a file to push is required"))
+	case file == "-":
+		return exitWith(exitOptionError, errors.New("push needs a file it can continue reading at a checkpoint, not stdin"))
+	}
+	info, err := os.Stat(file)
+	if err == nil && info.IsDir() {
+		err = fmt.Errorf("%s is a directory; push takes a plain SQL file", file)
+	}
+	if err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("file not accessible: %v", err))
+	}
+
+	chunkSizeFlag, _ := cmd.Flags().GetString("chunk-size")
+	chunkSize, err := parseByteSize(chunkSizeFlag)
+	if err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("invalid --chunk-size: %v", err))
+	}
+	var maxRate int64
+	if maxRateFlag, _ := cmd.Flags().GetString("max-rate"); maxRateFlag != "" {
+		if maxRate, err = parseByteSize(maxRateFlag); err != nil {
+			return exitWith(exitOptionError, fmt.Errorf("invalid --max-rate: %v", err))
+		}
+	}
+	retries, _ := cmd.Flags().GetInt("retries")
+	if retries < 0 {
+		return exitWith(exitOptionError, errors.New("--retries must not be negative"))
+	}
+	stateFile, _ := cmd.Flags().GetString("state-file")
+	restart, _ := cmd.Flags().GetBool("restart")
+
+	options, err := parseMigrationOptions(cmd)
+	if err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Failed to parse options: %v", err))
+	}
+	destDB, _ := cmd.Flags().GetString("dest-db")
+	if destDB == "" {
+		return exitWith(exitOptionError, errors.New("--dest-db is required for push"))
+	}
+	if err := validateConnectionFlags(cmd, false, true); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+	if stateFile == "" {
+		stateFile = filepath.Join(options.OutputDir, fmt.Sprintf("push_%s_%s.json", destDB, strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))))
+	}
+
+	state, err := beginRun(cmd, options)
+	if err != nil {
+		return err
+	}
+	state.SchemaFile = file
+	report := &PushReport{File: file, StateFile: stateFile, ChunkSize: chunkSize, MaxRate: maxRate}
+	state.Push = report
+
+	destConfig, err := getDestConfig(cmd, "")
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Failed to get destination config: %v", err))
+	}
+	if err := protectProduction(nil, destConfig, options); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+	if err := checkBlackout(options, state, time.Now()); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+	state.Dest = destConfig
+
+	// Read before connecting, so a file push can't apply fails first
+	var scan *PushState
+	err = state.phase("scan", func() error {
+		scan, err = scanPushFile(file, options)
+		return err
+	})
+	if err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to push %s: %v", file, err))
+	}
+	scan.Destination = pushDestination(destConfig)
+	report.Statements = scan.Statements
+	logger.Info(fmt.Sprintf("%s: %s, %d statement(s), sha256 %s", file, formatBytes(scan.Size), scan.Statements, scan.SHA256))
+
+	progress, err := loadPushState(stateFile, scan, restart)
+	if err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+	if progress.Completed {
+		report.Applied = progress.Applied
+		logger.Success(fmt.Sprintf("%s was already pushed to '%s' (%s); use --restart to push it again", file, destConfig.Database, stateFile))
+		return finishRun(state, options)
+	}
+
+	if options.DryRun {
+		chunks := (scan.Size-progress.Offset)/chunkSize + 1
+		logger.Info(fmt.Sprintf("DRY RUN MODE - would push %d statement(s) from line %d of %s (%s) in about %d chunk(s) of %s",
+			scan.Statements-progress.Applied, progress.Line, file, formatBytes(scan.Size-progress.Offset), chunks, formatBytes(chunkSize)))
+		return finishRun(state, options)
+	}
+
+	if err := startTunnels(&options.SSH, destConfig); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("SSH tunnel setup failed: %v", err))
+	}
+	if err := validateDestinationConnection(destConfig); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Connection validation failed: %v", err))
+	}
+	if err := resolveDatabaseCase(destConfig, options, state); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+	if useKeyring, _ := cmd.Flags().GetBool("use-keyring"); useKeyring {
+		rememberPasswords(destConfig)
+	}
+
+	p := &pusher{dest: destConfig, file: file, stateFile: stateFile, state: progress, report: report, chunkSize: chunkSize, maxRate: maxRate, retries: retries, run: state}
+	if err := state.phase("push", p.push); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Push failed at line %d of %s, %d of %d statement(s) applied; run it again to continue: %v",
+			progress.Line, file, progress.Applied, progress.Statements, err))
+	}
+	if progress.Applied != progress.Statements {
+		return exitWith(exitFailure, fmt.Errorf("Push applied %d statement(s), but %s has %d", progress.Applied, file, progress.Statements))
+	}
+
+	if err := finishRun(state, options); err != nil {
+		return err
+	}
+	logger.Success(fmt.Sprintf("Pushed all %d statement(s) of %s to '%s' in %d chunk(s)", progress.Statements, file, destConfig.Database, progress.Chunks))
+	return nil
+}
+
+// scanPushFile reads the whole file once for its checksum and statement
+// count, and refuses statements that don't fit in the chunks of a push:
+// transaction control, which would end the transaction of a chunk, and
+// \connect, which only a single session can follow
+func scanPushFile(path string, options *MigrationOptions) (*PushState, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	counter := &countingWriter{w: hash}
+	scanner := dumpparse.NewScanner(io.TeeReader(file, counter), 0, 1)
+	scan := &PushState{File: path, Line: 1}
+	var refused, switches []string
+	for scanner.Scan() {
+		for _, s := range scanner.Statements() {
+			scan.Statements++
+			switch {
+			case transactionControlPattern.MatchString(s.Text):
+				refused = append(refused, fmt.Sprintf("line %d: transaction control: %s", s.Line, firstLine(s.Text)))
+			case databaseSwitchPatterns[0].pattern.MatchString(s.Text):
+				refused = append(refused, fmt.Sprintf("line %d: %s: %s", s.Line, databaseSwitchPatterns[0].what, firstLine(s.Text)))
+			}
+			for _, p := range databaseSwitchPatterns[1:] {
+				if p.pattern.MatchString(s.Text) {
+					switches = append(switches, fmt.Sprintf("line %d: %s: %s", s.Line, p.what, firstLine(s.Text)))
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(counter, file); err != nil {
+		return nil, err
+	}
+	if len(refused) > 0 {
+		return nil, fmt.Errorf("each chunk runs in a transaction and session of its own, so these %d statement(s) can't be pushed:\n   %s",
+			len(refused), strings.Join(refused, "\n   "))
+	}
+	if len(switches) > 0 {
+		if !options.AllowMetaCommands {
+			return nil, fmt.Errorf("%d statement(s) create or rename databases, use --allow-meta-commands to push them anyway:\n   %s",
+				len(switches), strings.Join(switches, "\n   "))
+		}
+		warn(WarnDatabaseSwitches, fmt.Sprintf("%s has %d statement(s) creating or renaming databases, pushed because of --allow-meta-commands:\n   %s",
+			path, len(switches), strings.Join(switches, "\n   ")))
+	}
+	scan.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	scan.Size = counter.n
+	return scan, nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// loadPushState returns the progress to continue from: that of the state
+// file when it records a push of the same file to the same destination, or
+// the beginning of the file
+func loadPushState(path string, scan *PushState, restart bool) (*PushState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) || err == nil && restart {
+		return scan, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved PushState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %v", path, err)
+	}
+	switch {
+	case saved.SHA256 != scan.SHA256 || saved.Size != scan.Size:
+		return nil, fmt.Errorf("state file %s records a push of another version of %s (sha256 %s); use --restart to push this one from the beginning, or another --state-file",
+			path, saved.File, saved.SHA256)
+	case saved.Destination != scan.Destination:
+		return nil, fmt.Errorf("state file %s records a push to %s; use --restart to push to %s from the beginning, or another --state-file",
+			path, saved.Destination, scan.Destination)
+	}
+	saved.File, saved.Statements = scan.File, scan.Statements
+	return &saved, nil
+}
+
+// pushChunk is a range of the file applied in one transaction, or on its
+// own when a statement of it can't run in a transaction block
+type pushChunk struct {
+	number        int
+	start, end    int64
+	line          int // Where it starts
+	next          PushCheckpoint
+	transactional bool
+}
+
+// pusher applies a file chunk by chunk, checkpointing after each
+type pusher struct {
+	dest      *DatabaseConfig
+	file      string
+	stateFile string
+	state     *PushState
+	report    *PushReport
+	chunkSize int64
+	maxRate   int64
+	retries   int
+	run       *RunState
+}
+
+// push applies the file from the checkpoint of the state on
+func (p *pusher) push() error {
+	if err := p.resolvePending(); err != nil {
+		return err
+	}
+	if p.state.Offset > 0 {
+		p.report.ResumedAt = p.state.Line
+		logger.Info(fmt.Sprintf("Continuing at line %d: %d of %d statement(s) and %s of %s applied in %d chunk(s)",
+			p.state.Line, p.state.Applied, p.state.Statements, formatBytes(p.state.Offset), formatBytes(p.state.Size), p.state.Chunks))
+	}
+	if err := p.checkpoint(); err != nil {
+		return err
+	}
+
+	version, err := destinationVersion(p.dest)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(p.file)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := dumpparse.NewScanner(io.NewSectionReader(file, p.state.Offset, p.state.Size-p.state.Offset), p.state.Offset, p.state.Line)
+	chunk := p.newChunk()
+	flush := func() error {
+		if chunk.next.Statements == 0 {
+			return nil
+		}
+		if err := p.apply(file, chunk); err != nil {
+			return err
+		}
+		chunk = p.newChunk()
+		return nil
+	}
+	for scanner.Scan() {
+		statements := scanner.Statements()
+		transactional := true
+		for _, s := range statements {
+			transactional = transactional && nonTransactionalReason(s.Text, version) == ""
+		}
+		if !transactional {
+			if err := flush(); err != nil {
+				return err
+			}
+			chunk.transactional = false
+		}
+		chunk.end = scanner.Offset()
+		chunk.next.Offset, chunk.next.Line = scanner.Offset(), scanner.Line()
+		chunk.next.Statements += len(statements)
+		for _, s := range statements {
+			if sessionSettingPattern.MatchString(s.Text) {
+				chunk.next.Settings = append(chunk.next.Settings, strings.ReplaceAll(s.Text, "\n", " "))
+			}
+		}
+		if !transactional || chunk.end-chunk.start >= p.chunkSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	p.state.Completed = p.state.Applied == p.state.Statements
+	return p.checkpoint()
+}
+
+func (p *pusher) newChunk() *pushChunk {
+	return &pushChunk{
+		number:        p.state.Chunks + 1,
+		start:         p.state.Offset,
+		end:           p.state.Offset,
+		line:          p.state.Line,
+		next:          PushCheckpoint{Line: p.state.Line, Settings: append([]string(nil), p.state.Settings...)},
+		transactional: true,
+	}
+}
+
+// apply runs a chunk, trying it again while the connection drops before it
+// commits, and checkpoints it
+func (p *pusher) apply(file *os.File, c *pushChunk) error {
+	delay := pushRetryDelay
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		committed, err := p.send(file, c)
+		if committed {
+			p.advance(c.next)
+			if err := p.checkpoint(); err != nil {
+				return err
+			}
+			p.report.Chunks++
+			p.report.Bytes += c.end - c.start
+			elapsed := time.Since(started)
+			logger.Info(fmt.Sprintf("Chunk %d: lines %d-%d, %d statement(s), %s in %s (%s/s); %d of %d statement(s), %d%% of the file applied",
+				c.number, c.line, c.next.Line-1, c.next.Statements, formatBytes(c.end-c.start), elapsed.Round(time.Millisecond),
+				formatBytes(int64(float64(c.end-c.start)/max(elapsed.Seconds(), 0.001))), p.state.Applied, p.state.Statements, p.state.Offset*100/max(p.state.Size, 1)))
+			return nil
+		}
+		var lost *pushConnectionLost
+		if !errors.As(err, &lost) || attempt > p.retries || runContext().Err() != nil {
+			return err
+		}
+
+		p.report.Retries++
+		warn(WarnPushRetried, fmt.Sprintf("Connection to the destination dropped during chunk %d (line %d), which did not commit; trying it again in %s (%d/%d): %v",
+			c.number, c.line, delay, attempt, p.retries, lost.err))
+		select {
+		case <-time.After(delay):
+		case <-runContext().Done():
+			return err
+		}
+		delay *= 2
+		if err := refreshCredentials(p.dest); err != nil {
+			return err
+		}
+	}
+}
+
+// pushConnectionLost is a chunk that failed without committing because psql
+// lost the destination, so it can be sent again
+type pushConnectionLost struct {
+	err error
+}
+
+func (e *pushConnectionLost) Error() string {
+	return e.err.Error()
+}
+
+// send runs a chunk with psql, preceded by the session settings in effect
+// where it starts. committed reports whether the chunk is applied, which
+// for a transaction whose end psql did not see is asked of the destination.
+func (p *pusher) send(file *os.File, c *pushChunk) (committed bool, err error) {
+	// One line, so psql's line numbers are those of the file less c.line-2
+	var prelude strings.Builder
+	prelude.WriteString(strings.Join(p.state.Settings, " "))
+	if c.transactional {
+		fmt.Fprintf(&prelude, " SELECT '%s' || txid_current();", pushTransactionPrefix)
+	}
+	prelude.WriteString("\n")
+
+	var body io.Reader = io.NewSectionReader(file, c.start, c.end-c.start)
+	if p.maxRate > 0 {
+		body = &throttledReader{r: body, rate: p.maxRate}
+	}
+
+	args := append(applySchemaArgs(p.dest, "-"), "-v", "ON_ERROR_STOP=1", "-q", "-A", "-t")
+	if c.transactional {
+		args = append(args, "--single-transaction")
+	}
+	notices := &noticeCollector{}
+	transaction := ""
+	cmd := clientCommand(p.dest, "psql", args)
+	cmd.Stdin = io.MultiReader(strings.NewReader(prelude.String()), body)
+	cmd.Stdout = &lineWriter{line: func(line string) {
+		if id, ok := strings.CutPrefix(strings.TrimSuffix(line, "\r"), pushTransactionPrefix); ok && transaction == "" {
+			transaction = id
+			p.state.Pending = &c.next
+			p.state.Pending.Transaction = id
+			if err := p.checkpoint(); err != nil {
+				logger.Debug(fmt.Sprintf("Failed to record the transaction of chunk %d: %v", c.number, err))
+			}
+			return
+		}
+		logger.Debug(line)
+	}}
+	cmd.Stderr = psqlStderr(notices)
+	err = cmd.Run()
+	p.run.Notices = append(p.run.Notices, notices.notices...)
+	if err == nil {
+		return true, nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == psqlScriptFailed {
+		p.state.Pending = nil
+		if err := p.checkpoint(); err != nil {
+			logger.Debug(err.Error())
+		}
+		return false, fmt.Errorf("a statement of chunk %d failed and the chunk was rolled back; psql's line N is line N+%d of %s: %v",
+			c.number, c.line-2, p.file, err)
+	}
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != psqlConnectionLost {
+		return false, err
+	}
+	if transaction == "" {
+		// No transaction had started, or the chunk runs outside one
+		return false, &pushConnectionLost{err: err}
+	}
+	status, statusErr := p.transactionStatus(transaction)
+	switch {
+	case statusErr != nil:
+		return false, fmt.Errorf("connection lost during chunk %d and whether its transaction %s committed can't be told, push again once the destination is reachable: %v (%v)",
+			c.number, transaction, statusErr, err)
+	case status == "committed":
+		p.report.Transactions++
+		logger.Info(fmt.Sprintf("Connection lost at the end of chunk %d, but its transaction %s committed", c.number, transaction))
+		return true, nil
+	}
+	p.state.Pending = nil
+	return false, &pushConnectionLost{err: err}
+}
+
+// resolvePending settles the chunk an earlier push sent without seeing its
+// commit, from the status of its transaction on the destination
+func (p *pusher) resolvePending() error {
+	pending := p.state.Pending
+	if pending == nil {
+		return nil
+	}
+	status, err := p.transactionStatus(pending.Transaction)
+	if err != nil {
+		return fmt.Errorf("the previous push lost the destination during transaction %s, whose status can't be read: %v", pending.Transaction, err)
+	}
+	if status == "committed" {
+		p.report.Transactions++
+		logger.Info(fmt.Sprintf("The chunk the previous push sent last committed (transaction %s)", pending.Transaction))
+		p.advance(*pending)
+	} else {
+		logger.Info(fmt.Sprintf("The chunk the previous push sent last did not commit (transaction %s %s), it is sent again", pending.Transaction, status))
+	}
+	p.state.Pending = nil
+	return nil
+}
+
+// transactionStatus asks the destination whether a transaction committed,
+// waiting while it is still in progress because the server has not yet
+// noticed the connection is gone
+func (p *pusher) transactionStatus(transaction string) (string, error) {
+	if err := refreshCredentials(p.dest); err != nil {
+		return "", err
+	}
+	db, err := openDatabase(p.dest, p.dest.Database)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	for check := 1; ; check++ {
+		var status sql.NullString
+		if err := db.QueryRowContext(runContext(), `SELECT txid_status($1::bigint)`, transaction).Scan(&status); err != nil {
+			return "", err
+		}
+		switch {
+		case !status.Valid:
+			return "", fmt.Errorf("transaction %s is too old for its status to be known", transaction)
+		case status.String != "in progress":
+			return status.String, nil
+		case check == pushStatusChecks:
+			return "", fmt.Errorf("transaction %s is still in progress on the destination", transaction)
+		}
+		select {
+		case <-time.After(pushRetryDelay):
+		case <-runContext().Done():
+			return "", runContext().Err()
+		}
+	}
+}
+
+// advance moves the progress past a committed chunk
+func (p *pusher) advance(next PushCheckpoint) {
+	p.state.Offset, p.state.Line, p.state.Settings = next.Offset, next.Line, next.Settings
+	p.state.Applied += next.Statements
+	p.state.Chunks++
+	p.state.Pending = nil
+	p.report.Applied = p.state.Applied
+}
+
+// checkpoint writes the progress to the state file
+func (p *pusher) checkpoint() error {
+	p.state.UpdatedAt = time.Now().UTC()
+	if err := os.MkdirAll(filepath.Dir(p.stateFile), 0755); err != nil {
+		return err
+	}
+	if err := replaceJSONFile(p.stateFile, p.state); err != nil {
+		return fmt.Errorf("failed to write the state file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UnreadableObject is a table pg_dump would fail to lock on the source
+type UnreadableObject struct {
+	Name    string `json:"name"` // Qualified and quoted as needed
+	Schema  string `json:"schema"`
+	Table   string `json:"table"`
+	Missing string `json:"missing"` // USAGE on the schema, SELECT on the table, or both
+}
+
+// excludePattern is the --exclude-table pattern matching just this table
+func (o UnreadableObject) excludePattern() string {
+	return quoteIdentifier(o.Schema) + "." + quoteIdentifier(o.Table)
+}
+
+// findUnreadableTables lists the tables pg_dump locks, as the source user or
+// --source-role, that it can't: LOCK TABLE needs USAGE on the schema and
+// SELECT on the table, and pg_dump fails on the first it lacks
+func findUnreadableTables(config *DatabaseConfig) ([]UnreadableObject, error) {
+	db, err := openDB(config, config.Database)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(runContext(), `
+		SELECT format('%I.%I', n.nspname, c.relname), n.nspname, c.relname,
+		       has_schema_privilege(r.name, n.oid, 'USAGE'),
+		       has_table_privilege(r.name, c.oid, 'SELECT')
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		CROSS JOIN (SELECT coalesce(nullif($1, ''), current_user) AS name) r
+		WHERE c.relkind IN ('r', 'p') AND `+userSchemas+` AND `+fmt.Sprintf(notExtensionMember, "pg_class", "c.oid")+`
+		  AND NOT (has_schema_privilege(r.name, n.oid, 'USAGE') AND has_table_privilege(r.name, c.oid, 'SELECT'))
+		ORDER BY 2, 3`, config.Role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var unreadable []UnreadableObject
+	for rows.Next() {
+		var o UnreadableObject
+		var usage, sel bool
+		if err := rows.Scan(&o.Name, &o.Schema, &o.Table, &usage, &sel); err != nil {
+			return nil, err
+		}
+		var missing []string
+		if !usage {
+			missing = append(missing, "USAGE on schema "+quoteIdentifier(o.Schema))
+		}
+		if !sel {
+			missing = append(missing, "SELECT")
+		}
+		o.Missing = strings.Join(missing, " and ")
+		unreadable = append(unreadable, o)
+	}
+	return unreadable, rows.Err()
+}
+
+// checkSourceReadable makes sure pg_dump can lock every table it exports,
+// so it doesn't fail with "permission denied" after minutes of work. All
+// tables it can't are reported together; with --skip-unreadable they are
+// left out of the export instead.
+func checkSourceReadable(source *DatabaseConfig, options *MigrationOptions, state *RunState) error {
+	unreadable, err := findUnreadableTables(source)
+	if err != nil {
+		return fmt.Errorf("failed to check the source privileges: %v", err)
+	}
+	if len(unreadable) == 0 {
+		logger.Info("The source user can read every table to export")
+		return nil
+	}
+
+	user := source.Username
+	if source.Role != "" {
+		user = source.Role
+	}
+	lines := make([]string, len(unreadable))
+	for i, o := range unreadable {
+		lines[i] = fmt.Sprintf("%s: no %s", o.Name, o.Missing)
+	}
+	if !options.SkipUnreadable {
+		return fmt.Errorf("%s can't read %d table(s), which pg_dump would fail on; grant the privileges, or pass --skip-unreadable to leave them out:\n   %s",
+			user, len(unreadable), strings.Join(lines, "\n   "))
+	}
+
+	warn(WarnUnreadableSkipped, fmt.Sprintf("%s can't read %d table(s); leaving them out of the export (--skip-unreadable). Objects depending on them fail on apply:\n   %s",
+		user, len(unreadable), strings.Join(lines, "\n   ")))
+	state.SkippedUnreadable = unreadable
+	for _, o := range unreadable {
+		options.ExcludeTables = append(options.ExcludeTables, o.excludePattern())
+	}
+	return nil
+}
+
+// skippedTables is the set of tables left out by --skip-unreadable, by
+// qualified name as the catalogs quote it
+func skippedTables(state *RunState) map[string]bool {
+	skipped := make(map[string]bool)
+	for _, o := range state.SkippedUnreadable {
+		skipped[o.Name] = true
+	}
+	return skipped
+}
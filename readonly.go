@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+)
+
+// openDB opens a connection pool to dbname on the server described by
+// config. Read-only configs, like the source, go through a driver that
+// rejects anything but SELECT and SHOW and run with
+// default_transaction_read_only on, so a bug can't write to them.
+func openDB(config *DatabaseConfig, dbname string) (*sql.DB, error) {
+	if !config.ReadOnly {
+		return openDatabase(config, dbname)
+	}
+	return openPool(config, driverConnString(config, dbname)+" default_transaction_read_only=on", true)
+}
+
+// checkReadOnlyStatement accepts only statements that start with SELECT or SHOW
+func checkReadOnlyStatement(query string) error {
+	fields := strings.Fields(strings.TrimLeft(query, " \t\r\n("))
+	if len(fields) > 0 {
+		switch strings.ToUpper(fields[0]) {
+		case "SELECT", "SHOW":
+			return nil
+		}
+	}
+	first := strings.TrimSpace(query)
+	if len(first) > 40 {
+		first = first[:40] + "..."
+	}
+	return fmt.Errorf("refusing to run a non-read statement on a read-only connection: %q", first)
+}
+
+// readOnlyConnector wraps the connector of lib/pq or pgx, vetting every
+// statement before it is sent
+type readOnlyConnector struct {
+	connector driver.Connector
+}
+
+func (c readOnlyConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyConn{conn: conn}, nil
+}
+
+func (c readOnlyConnector) Driver() driver.Driver {
+	return readOnlyDriver{open: c.connector.Driver().Open}
+}
+
+// readOnlyDriver is the driver of readOnlyConnector, for connections opened
+// by name
+type readOnlyDriver struct {
+	open func(dsn string) (driver.Conn, error)
+}
+
+func (d readOnlyDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyConn{conn: conn}, nil
+}
+
+type readOnlyConn struct {
+	conn driver.Conn
+}
+
+func (c *readOnlyConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *readOnlyConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := checkReadOnlyStatement(query); err != nil {
+		return nil, err
+	}
+	return c.conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+}
+
+func (c *readOnlyConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := checkReadOnlyStatement(query); err != nil {
+		return nil, err
+	}
+	return c.conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c *readOnlyConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := checkReadOnlyStatement(query); err != nil {
+		return nil, err
+	}
+	return c.conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c *readOnlyConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx starts every transaction READ ONLY
+func (c *readOnlyConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	opts.ReadOnly = true
+	return c.conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *readOnlyConn) Ping(ctx context.Context) error {
+	return c.conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *readOnlyConn) ResetSession(ctx context.Context) error {
+	return c.conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+// IsValid asks the wrapped connection when it can tell; pgx can't
+func (c *readOnlyConn) IsValid() bool {
+	if validator, ok := c.conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+// CheckNamedValue lets pgx convert arguments itself
+func (c *readOnlyConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+func (c *readOnlyConn) Close() error {
+	return c.conn.Close()
+}
+
+// checkDestinationWritable refuses a destination server that can't take the
+// migration's writes: a physical replica, or a server whose sessions are
+// read-only. Found before the export, rather than at DROP DATABASE.
+func checkDestinationWritable(db *sql.DB, config *DatabaseConfig) error {
+	var inRecovery bool
+	var readOnly string
+	if err := db.QueryRow(`SELECT pg_is_in_recovery(), current_setting('transaction_read_only')`).Scan(&inRecovery, &readOnly); err != nil {
+		return err
+	}
+	if inRecovery {
+		primary := "its primary"
+		var senderHost sql.NullString
+		var senderPort sql.NullInt64
+		// The sender is hidden from roles without pg_read_all_stats
+		if err := db.QueryRow(`SELECT sender_host, sender_port FROM pg_stat_wal_receiver`).Scan(&senderHost, &senderPort); err == nil && senderHost.Valid {
+			primary = fmt.Sprintf("its primary at %s", senderHost.String)
+			if senderPort.Valid {
+				primary = fmt.Sprintf("its primary at %s:%d", senderHost.String, senderPort.Int64)
+			}
+		}
+		return fmt.Errorf("destination %s is a replica in recovery (pg_is_in_recovery() is true): it is read-only and can't be a migration target. Point --dest-host at %s", config.Host, primary)
+	}
+	if readOnly == "on" {
+		return fmt.Errorf("sessions on destination %s are read-only (transaction_read_only is on), so the destination can't be dropped or written; check default_transaction_read_only of the server, database and --dest-user, and --dest-options", config.Host)
+	}
+	return nil
+}
+
+// checkStandby makes sure a source in recovery is only used when allowed
+func checkStandby(db *sql.DB, config *DatabaseConfig) error {
+	var inRecovery bool
+	if err := db.QueryRow(`SELECT pg_is_in_recovery()`).Scan(&inRecovery); err != nil {
+		return err
+	}
+	if config.Replica {
+		return checkReplica(db, config, inRecovery)
+	}
+	if !inRecovery {
+		return nil
+	}
+	if !config.StandbyOK {
+		return fmt.Errorf("source %s is a hot standby; pass --source-replica or --source-standby-ok to export from it", config.Host)
+	}
+
+	logger.Info(fmt.Sprintf("Source %s is a hot standby, exporting from it (--source-standby-ok)", config.Host))
+	warn(WarnSourceStandby, "pg_dump on a standby can be cancelled by recovery conflicts; raise max_standby_streaming_delay or enable hot_standby_feedback if the export fails")
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// rememberedFile holds the parameters of the last successful run of each
+// command, in --output-dir
+const rememberedFile = ".pgsm-defaults.json"
+
+// rememberedVersion is the format of rememberedFile written by this version.
+// A file written by a newer version is neither used nor overwritten.
+const rememberedVersion = 1
+
+// Defaults is the content of rememberedFile
+type Defaults struct {
+	Version  int                       `json:"version"`
+	Commands map[string]*RememberedRun `json:"commands"` // By command: "migrate", "apply"
+}
+
+// RememberedRun is what a successful run was given, without passwords
+type RememberedRun struct {
+	SavedAt    time.Time           `json:"saved_at"`
+	Connection map[string]string   `json:"connection,omitempty"` // Flags prompted for one by one
+	Options    map[string][]string `json:"options,omitempty"`    // Other flags, offered together
+}
+
+// rememberedConnectionFlags are prompted for one by one, in this order
+var rememberedConnectionFlags = []struct {
+	flag, label string
+}{
+	{"source-host", "Source host"},
+	{"source-port", "Source port"},
+	{"source-user", "Source user"},
+	{"source-db", "Source database"},
+	{"dest-host", "Destination host"},
+	{"dest-port", "Destination port"},
+	{"dest-user", "Destination user"},
+	{"dest-db", "Destination database"},
+}
+
+// forgottenFlags are never remembered: secrets, flags that locate the
+// defaults or make a run one-off, and overrides of safety checks, which are
+// given again each time
+var forgottenFlags = []string{"no-remember", "output-dir", "dry-run", "keep-scratch", "schema-file", "force", "i-know-this-is-production"}
+
+// rememberable reports whether the value of a flag may be stored
+func rememberable(name string) bool {
+	return !strings.Contains(name, "password") && !strings.HasPrefix(name, "accept-") && !slices.Contains(forgottenFlags, name)
+}
+
+// rememberedCommand names the entry of a command in rememberedFile
+func rememberedCommand(cmd *cobra.Command) string {
+	if cmd.HasParent() {
+		return cmd.Name()
+	}
+	return "migrate"
+}
+
+// rememberedPath is the defaults file of the --output-dir of cmd, "" when
+// --output-dir is a storage URI: a staged output directory holds no earlier
+// runs
+func rememberedPath(cmd *cobra.Command) string {
+	outputDir, _ := cmd.Flags().GetString("output-dir")
+	if isStorageURI(outputDir) {
+		return ""
+	}
+	return filepath.Join(outputDir, rememberedFile)
+}
+
+// loadDefaults reads a defaults file. A missing file has no defaults; one
+// written by a newer version is an error, so it is left alone.
+func loadDefaults(path string) (*Defaults, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var d Defaults
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("invalid defaults file %s: %v", path, err)
+	}
+	if d.Version > rememberedVersion {
+		return nil, fmt.Errorf("%s has format version %d, newer than this version of the tool reads (%d)", path, d.Version, rememberedVersion)
+	}
+	return &d, nil
+}
+
+// promptRemembered fills the flags omitted on an interactive run from the
+// last successful run with the same --output-dir: each connection parameter
+// at a prompt showing the previous value, which Enter accepts, and the other
+// options together. It runs before cobra checks the required flags, so a
+// remembered --source-db satisfies them.
+func promptRemembered(cmd *cobra.Command, args []string) error {
+	if noRemember, _ := cmd.Flags().GetBool("no-remember"); noRemember || !stdinIsTerminal() {
+		return nil
+	}
+	defaults, err := loadDefaults(rememberedPath(cmd))
+	if err != nil {
+		logger.Warning(fmt.Sprintf("Not using remembered defaults: %v", err))
+		return nil
+	}
+	if defaults == nil || defaults.Commands[rememberedCommand(cmd)] == nil {
+		return nil
+	}
+	last := defaults.Commands[rememberedCommand(cmd)]
+	flags := cmd.Flags()
+	reader := bufio.NewReader(os.Stdin)
+
+	for _, c := range rememberedConnectionFlags {
+		value, ok := last.Connection[c.flag]
+		if !ok || flags.Lookup(c.flag) == nil || flags.Changed(c.flag) {
+			continue
+		}
+		// Exports have no destination, and a templated name is rendered instead
+		if strings.HasPrefix(c.flag, "dest-") && rememberedMode(cmd, last) == "export" ||
+			c.flag == "dest-db" && flags.Changed("dest-db-template") {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s [%s]: ", c.label, value)
+		answer, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", strings.ToLower(c.label), err)
+		}
+		if answer = strings.TrimSpace(answer); answer != "" {
+			value = answer
+		}
+		if err := flags.Set(c.flag, value); err != nil {
+			return fmt.Errorf("invalid %s: %v", strings.ToLower(c.label), err)
+		}
+	}
+
+	var names, shown []string
+	for name := range last.Options {
+		if flags.Lookup(name) != nil && !flags.Changed(name) && rememberable(name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		shown = append(shown, formatFlag(flags.Lookup(name), last.Options[name]))
+	}
+	fmt.Fprintf(os.Stderr, "Options of the last run: %s\nUse them again? [Y/n]: ", strings.Join(shown, " "))
+	answer, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read answer: %v", err)
+	}
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "" && answer != "y" && answer != "yes" {
+		return nil
+	}
+	for _, name := range names {
+		for _, value := range last.Options[name] {
+			if err := flags.Set(name, value); err != nil {
+				return fmt.Errorf("invalid remembered --%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// rememberedMode is the --mode the run will have if the remembered options
+// are used again
+func rememberedMode(cmd *cobra.Command, last *RememberedRun) string {
+	if cmd.Flags().Lookup("mode") == nil {
+		return "direct"
+	}
+	mode, _ := cmd.Flags().GetString("mode")
+	if values := last.Options["mode"]; !cmd.Flags().Changed("mode") && len(values) == 1 {
+		mode = values[0]
+	}
+	return mode
+}
+
+// formatFlag shows a flag with its values as it would be typed
+func formatFlag(f *pflag.Flag, values []string) string {
+	if f.Value.Type() == "bool" && len(values) == 1 && values[0] == "true" {
+		return "--" + f.Name
+	}
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = fmt.Sprintf("--%s=%s", f.Name, value)
+	}
+	return strings.Join(parts, " ")
+}
+
+// saveRemembered stores the flags of a successful run, given or accepted at
+// the prompts, for the next one. dest is the destination the run used, so a
+// database name typed at the destination prompt is remembered too.
+func saveRemembered(cmd *cobra.Command, dest *DatabaseConfig) {
+	path := rememberedPath(cmd)
+	if noRemember, _ := cmd.Flags().GetBool("no-remember"); noRemember || path == "" {
+		return
+	}
+	defaults, err := loadDefaults(path)
+	if err != nil {
+		logger.Warning(fmt.Sprintf("Not remembering this run's parameters: %v", err))
+		return
+	}
+	if defaults == nil {
+		defaults = &Defaults{}
+	}
+	defaults.Version = rememberedVersion
+	if defaults.Commands == nil {
+		defaults.Commands = make(map[string]*RememberedRun)
+	}
+
+	run := &RememberedRun{SavedAt: time.Now().UTC(), Connection: make(map[string]string), Options: make(map[string][]string)}
+	connection := make(map[string]bool)
+	for _, c := range rememberedConnectionFlags {
+		connection[c.flag] = true
+	}
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		switch {
+		case !rememberable(f.Name):
+		case connection[f.Name]:
+			run.Connection[f.Name] = f.Value.String()
+		default:
+			if slice, ok := f.Value.(pflag.SliceValue); ok {
+				run.Options[f.Name] = slice.GetSlice()
+			} else {
+				run.Options[f.Name] = []string{f.Value.String()}
+			}
+		}
+	})
+	if template, _ := cmd.Flags().GetString("dest-db-template"); dest != nil && template == "" {
+		run.Connection["dest-db"] = dest.Database
+	}
+	defaults.Commands[rememberedCommand(cmd)] = run
+
+	if err := writeDefaults(path, defaults); err != nil {
+		logger.Warning(fmt.Sprintf("Failed to remember this run's parameters: %v", err))
+	}
+}
+
+// writeDefaults replaces a defaults file atomically, readable by its owner
+// only
+func writeDefaults(path string, d *Defaults) error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".pgsm-defaults-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func newConfigCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Manage the defaults remembered from earlier runs",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "forget",
+		Short: "Delete the parameters remembered in the output directory",
+		Long: "Delete the " + rememberedFile + " file in --output-dir, which holds the parameters of the last successful " +
+			"migration and apply offered at the prompts of interactive runs.",
+		Args: cobra.NoArgs,
+		RunE: runConfigForget,
+	})
+	return cmd
+}
+
+func runConfigForget(cmd *cobra.Command, args []string) error {
+	path := rememberedPath(cmd)
+	if path == "" {
+		return exitWith(exitOptionError, errors.New("Nothing is remembered for an --output-dir in a storage"))
+	}
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		logger.Info(fmt.Sprintf("Nothing remembered in %s", filepath.Dir(path)))
+		return nil
+	}
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Failed to forget defaults: %v", err))
+	}
+	logger.Success(fmt.Sprintf("Forgot the defaults in %s", path))
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// An export from a replica cancelled by a recovery conflict is retried up to
+// replicaRetries times, waiting replicaRetryDelay and doubling it each time
+const (
+	replicaRetries    = 4
+	replicaRetryDelay = 5 * time.Second
+)
+
+// ReplicaExport records the standby an export was taken from
+type ReplicaExport struct {
+	Host             string   `json:"host"`
+	ReplayLagBytes   *int64   `json:"replay_lag_bytes,omitempty"`   // WAL received but not yet replayed
+	ReplayLagSeconds *float64 `json:"replay_lag_seconds,omitempty"` // Since the last replayed transaction
+	ConflictRetries  int      `json:"conflict_retries,omitempty"`
+}
+
+// String describes the replay lag for the logs and summaries
+func (r *ReplicaExport) String() string {
+	var lag []string
+	if r.ReplayLagBytes != nil {
+		lag = append(lag, formatBytes(*r.ReplayLagBytes))
+	}
+	if r.ReplayLagSeconds != nil {
+		lag = append(lag, (time.Duration(*r.ReplayLagSeconds * float64(time.Second))).Round(time.Second).String())
+	}
+	if len(lag) == 0 {
+		return "replay lag unknown"
+	}
+	return "replay lag " + strings.Join(lag, ", ")
+}
+
+// checkReplica prepares an export from a source given with --source-replica
+func checkReplica(db *sql.DB, config *DatabaseConfig, inRecovery bool) error {
+	if !inRecovery {
+		warn(WarnSourceNotStandby, fmt.Sprintf("--source-replica was given but source %s is not in recovery; exporting from it as a primary", config.Host))
+		return nil
+	}
+	logger.Info(fmt.Sprintf("Source %s is a hot standby, exporting from the replica", config.Host))
+	// Aurora replicas read the storage of the writer and don't replay WAL
+	if config.Flavor.is(FlavorAurora) {
+		return nil
+	}
+
+	var feedback string
+	if err := db.QueryRow(`SHOW hot_standby_feedback`).Scan(&feedback); err != nil {
+		return err
+	}
+	if feedback != "on" {
+		warn(WarnHotStandbyFeedbackOff, "hot_standby_feedback is off on the source replica; vacuum on the primary can cancel the export with a recovery conflict. Conflicts are retried, but for long exports turn hot_standby_feedback on or raise max_standby_streaming_delay")
+	}
+	return nil
+}
+
+// measureReplicaLag records how far the source replica trails its primary
+// just before the export
+func measureReplicaLag(config *DatabaseConfig) (*ReplicaExport, error) {
+	db, err := openDB(config, config.Database)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var lagBytes sql.NullInt64
+	var lagSeconds sql.NullFloat64
+	err = db.QueryRowContext(runContext(), `
+		SELECT pg_wal_lsn_diff(pg_last_wal_receive_lsn(), pg_last_wal_replay_lsn())::bigint,
+		       extract(epoch FROM now() - pg_last_xact_replay_timestamp())::float8
+	`).Scan(&lagBytes, &lagSeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	replica := &ReplicaExport{Host: config.Host}
+	if lagBytes.Valid {
+		replica.ReplayLagBytes = &lagBytes.Int64
+	}
+	if lagSeconds.Valid {
+		replica.ReplayLagSeconds = &lagSeconds.Float64
+	}
+	return replica, nil
+}
+
+// isRecoveryConflict reports whether pg_dump's output shows it was cancelled
+// because the standby had to replay changes its snapshot still needed
+func isRecoveryConflict(stderr string) bool {
+	return strings.Contains(stderr, "conflict with recovery")
+}
+
+// retryRecoveryConflicts runs dump, and when the source is a replica runs it
+// again with exponential backoff as long as it fails on recovery conflicts
+func retryRecoveryConflicts(config *DatabaseConfig, replica *ReplicaExport, dump func(stderr io.Writer) error) error {
+	delay := replicaRetryDelay
+	for attempt := 1; ; attempt++ {
+		var stderr bytes.Buffer
+		err := dump(io.MultiWriter(config.output().Stderr(), &stderr))
+		if err == nil || !config.Replica || attempt > replicaRetries || !isRecoveryConflict(stderr.String()) {
+			return err
+		}
+
+		config.output().Warning(fmt.Sprintf("pg_dump was cancelled by a recovery conflict on the replica, retrying in %s (%d/%d)", delay, attempt, replicaRetries))
+		if replica != nil {
+			replica.ConflictRetries++
+		}
+		select {
+		case <-time.After(delay):
+		case <-runContext().Done():
+			return err
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// slotDropAttempts is how often dropping a slot is tried while its consumer exits
+const slotDropAttempts = 10
+
+// ReplicationSlot is a logical replication slot on the destination database
+type ReplicationSlot struct {
+	Name     string `json:"name"`
+	Plugin   string `json:"plugin"`
+	Active   bool   `json:"active"`
+	Consumer string `json:"consumer,omitempty"` // application_name and address of the walsender's client
+}
+
+func (s ReplicationSlot) String() string {
+	state := "inactive"
+	if s.Active {
+		state = "active"
+	}
+	if s.Consumer != "" {
+		state += ", consumed by " + s.Consumer
+	}
+	return fmt.Sprintf("slot %s (%s, %s)", s.Name, s.Plugin, state)
+}
+
+// Publication is a publication of the destination database, captured before
+// the drop so it can be recreated
+type Publication struct {
+	Name      string   `json:"name"`
+	AllTables bool     `json:"all_tables"`
+	Tables    []string `json:"tables,omitempty"` // Qualified and quoted
+	Publish   string   `json:"publish"`          // Operations, as in WITH (publish = ...)
+}
+
+func (p Publication) String() string {
+	if p.AllTables {
+		return fmt.Sprintf("publication %s (all tables, publish %s)", p.Name, p.Publish)
+	}
+	return fmt.Sprintf("publication %s (%d table(s), publish %s)", p.Name, len(p.Tables), p.Publish)
+}
+
+// createStatement recreates the publication for the tables that exist
+func (p Publication) createStatement(tables []string) string {
+	target := "FOR ALL TABLES"
+	if !p.AllTables {
+		target = ""
+		if len(tables) > 0 {
+			target = "FOR TABLE " + strings.Join(tables, ", ")
+		}
+	}
+	statement := "CREATE PUBLICATION " + quoteIdentifier(p.Name)
+	if target != "" {
+		statement += " " + target
+	}
+	return statement + " WITH (publish = " + pq.QuoteLiteral(p.Publish) + ")"
+}
+
+// ReplicationReport records the logical replication the drop breaks, and
+// what was done about it
+type ReplicationReport struct {
+	Slots        []ReplicationSlot `json:"slots,omitempty"`
+	Publications []Publication     `json:"publications,omitempty"`
+	Accepted     bool              `json:"accepted,omitempty"`      // With --accept-replication-breakage
+	DroppedSlots []string          `json:"dropped_slots,omitempty"` // Dropped so the database could be
+	Recreated    []string          `json:"recreated_publications,omitempty"`
+}
+
+// inspectReplication lists the logical replication slots and publications of
+// the destination database, or returns nil when it doesn't exist yet
+func inspectReplication(dest *DatabaseConfig) (*ReplicationReport, error) {
+	exists, err := databaseExists(dest)
+	if err != nil || !exists {
+		return nil, err
+	}
+	report := &ReplicationReport{}
+
+	server, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return nil, err
+	}
+	defer server.Close()
+
+	rows, err := server.QueryContext(runContext(), `
+		SELECT s.slot_name, COALESCE(s.plugin, ''), s.active,
+		       concat_ws(' ', NULLIF(r.application_name, ''), host(r.client_addr))
+		FROM pg_replication_slots s
+		LEFT JOIN pg_stat_replication r ON r.pid = s.active_pid
+		WHERE s.slot_type = 'logical' AND s.database = $1
+		ORDER BY s.slot_name`, dest.Database)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list replication slots: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var slot ReplicationSlot
+		if err := rows.Scan(&slot.Name, &slot.Plugin, &slot.Active, &slot.Consumer); err != nil {
+			return nil, err
+		}
+		report.Slots = append(report.Slots, slot)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	db, err := openDatabase(dest, dest.Database)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	report.Publications, err = listPublications(db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list publications: %v", err)
+	}
+	return report, nil
+}
+
+// listPublications reads the publications of a database with their tables
+func listPublications(db *sql.DB) ([]Publication, error) {
+	rows, err := db.QueryContext(runContext(), `
+		SELECT p.pubname, p.puballtables,
+		       concat_ws(',', CASE WHEN p.pubinsert THEN 'insert' END, CASE WHEN p.pubupdate THEN 'update' END,
+		                 CASE WHEN p.pubdelete THEN 'delete' END, CASE WHEN p.pubtruncate THEN 'truncate' END),
+		       COALESCE((SELECT string_agg(quote_ident(t.schemaname) || '.' || quote_ident(t.tablename), E'\n' ORDER BY t.schemaname, t.tablename)
+		                 FROM pg_publication_tables t WHERE t.pubname = p.pubname AND NOT p.puballtables), '')
+		FROM pg_publication p
+		ORDER BY p.pubname`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var publications []Publication
+	for rows.Next() {
+		var pub Publication
+		var tables string
+		if err := rows.Scan(&pub.Name, &pub.AllTables, &pub.Publish, &tables); err != nil {
+			return nil, err
+		}
+		if tables != "" {
+			pub.Tables = strings.Split(tables, "\n")
+		}
+		publications = append(publications, pub)
+	}
+	return publications, rows.Err()
+}
+
+// checkReplicationBreakage reports the logical replication slots and
+// publications the drop would break and makes sure the breakage is accepted
+// with --accept-replication-breakage. Subscribers aren't told anything when
+// their publisher disappears; they just stop receiving changes.
+func checkReplicationBreakage(dest *DatabaseConfig, options *MigrationOptions, state *RunState) error {
+	report, err := inspectReplication(dest)
+	if err != nil || report == nil {
+		return err
+	}
+	if len(report.Slots) == 0 && len(report.Publications) == 0 {
+		return nil
+	}
+	state.Replication = report
+
+	warn(WarnReplicationBreakage, fmt.Sprintf("Destination database '%s' is a logical replication publisher; dropping it breaks %d slot(s) and %d publication(s):",
+		dest.Database, len(report.Slots), len(report.Publications)))
+	for _, slot := range report.Slots {
+		logger.Warning("   - " + slot.String())
+	}
+	for _, pub := range report.Publications {
+		logger.Warning("   - " + pub.String())
+	}
+
+	if options.DryRun {
+		return nil
+	}
+	if !options.AcceptReplicationBreakage {
+		return fmt.Errorf("subscribers of '%s' would stop receiving changes; pass --accept-replication-breakage to continue", dest.Database)
+	}
+	report.Accepted = true
+	logger.Warning("Continuing because of --accept-replication-breakage; the slots are dropped with the database")
+	return nil
+}
+
+// dropReplicationSlots drops the logical slots of the destination database,
+// which would otherwise keep DROP DATABASE from going ahead. Walsenders still
+// streaming from a slot are terminated first.
+func dropReplicationSlots(dest *DatabaseConfig, report *ReplicationReport) error {
+	if report == nil || len(report.Slots) == 0 {
+		return nil
+	}
+	db, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, slot := range report.Slots {
+		_, err := db.ExecContext(runContext(), `
+			SELECT pg_terminate_backend(active_pid)
+			FROM pg_replication_slots
+			WHERE slot_name = $1 AND active_pid IS NOT NULL`, slot.Name)
+		if err != nil {
+			warn(WarnConnectionsNotTerminated, fmt.Sprintf("Could not stop the consumer of slot %s: %v", slot.Name, err))
+		}
+		// A terminated walsender takes a moment to release its slot
+		for attempt := 1; ; attempt++ {
+			_, err = db.ExecContext(runContext(), `SELECT pg_drop_replication_slot($1)`, slot.Name)
+			if err == nil || attempt == slotDropAttempts {
+				break
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to drop replication slot %s: %v", slot.Name, err)
+		}
+		logger.Info(fmt.Sprintf("Dropped replication slot %s", slot.Name))
+		report.DroppedSlots = append(report.DroppedSlots, slot.Name)
+	}
+	return nil
+}
+
+// restoreReplication lists the slots subscribers need before they can be
+// re-pointed, and with --recreate-publications first creates the publications
+// captured before the drop that the schema didn't bring back, for the tables
+// that still exist
+func restoreReplication(dest *DatabaseConfig, report *ReplicationReport, options *MigrationOptions) error {
+	if options.RecreatePublications && len(report.Publications) > 0 {
+		if err := recreatePublications(dest, report); err != nil {
+			return err
+		}
+	} else if len(report.Publications) > 0 {
+		logger.Warning(fmt.Sprintf("%d publication(s) of the old database were not recreated (see --recreate-publications)", len(report.Publications)))
+	}
+
+	if len(report.DroppedSlots) > 0 {
+		logger.Warning("These replication slots were dropped with the database and must be recreated before subscribers are re-pointed; changes made in between are not replicated:")
+		for _, slot := range report.Slots {
+			logger.Warning(fmt.Sprintf("   SELECT pg_create_logical_replication_slot(%s, %s);  -- %s",
+				pq.QuoteLiteral(slot.Name), pq.QuoteLiteral(slot.Plugin), slot))
+		}
+		logger.Warning("Then on each subscriber: ALTER SUBSCRIPTION <name> ENABLE; ALTER SUBSCRIPTION <name> REFRESH PUBLICATION;")
+	}
+	return nil
+}
+
+// recreatePublications creates the captured publications missing from dest
+func recreatePublications(dest *DatabaseConfig, report *ReplicationReport) error {
+	db, err := openDatabase(dest, dest.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	existing, err := listPublications(db)
+	if err != nil {
+		return fmt.Errorf("failed to list publications: %v", err)
+	}
+	present := make(map[string]bool)
+	for _, pub := range existing {
+		present[pub.Name] = true
+	}
+
+	for _, pub := range report.Publications {
+		if present[pub.Name] {
+			logger.Info(fmt.Sprintf("Publication %s was recreated by the schema", pub.Name))
+			continue
+		}
+		var tables, missing []string
+		for _, table := range pub.Tables {
+			exists, err := rowExists(db, `SELECT to_regclass($1) IS NOT NULL`, table)
+			if err != nil {
+				return err
+			}
+			if exists {
+				tables = append(tables, table)
+			} else {
+				missing = append(missing, table)
+			}
+		}
+		if len(missing) > 0 {
+			warn(WarnPublicationIncomplete, fmt.Sprintf("Publication %s is recreated without %d table(s) the schema no longer has: %s",
+				pub.Name, len(missing), strings.Join(missing, ", ")))
+		}
+		if _, err := db.ExecContext(runContext(), pub.createStatement(tables)); err != nil {
+			return fmt.Errorf("failed to recreate publication %s: %v", pub.Name, err)
+		}
+		logger.Info(fmt.Sprintf("Recreated %s", pub))
+		report.Recreated = append(report.Recreated, pub.Name)
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Status of a step in a RunResult
+const (
+	StepOK       = "ok"
+	StepFailed   = "failed"
+	StepTimedOut = "timed_out"
+)
+
+// RunResult is everything a run did, as far as it got. It is returned by
+// performSchemaMigration and performSchemaApply, also when they fail, and is
+// what the manifest, --summary-json, the metrics file and the CI summary are
+// written from.
+type RunResult struct {
+	Version     int       `json:"version"`
+	RunLabel    string    `json:"run_label,omitempty"`
+	Mode        string    `json:"mode"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	Success     bool      `json:"success"`
+	FailedPhase string    `json:"failed_phase,omitempty"`
+	TimedOut    string    `json:"timed_out_phase,omitempty"`
+	Error       string    `json:"error,omitempty"` // Why the run failed
+
+	BlackoutOverride string `json:"blackout_override,omitempty"` // Window overridden with --override-blackout
+
+	Bootstrap *BootstrapReport `json:"bootstrap,omitempty"`
+
+	DestinationPath string `json:"destination_path,omitempty"` // recreate, in-place or bootstrap
+
+	Replication *ReplicationReport `json:"replication,omitempty"`
+
+	Grants *GrantsSnapshot `json:"grants_snapshot,omitempty"`
+
+	Analyze *AnalyzeReport `json:"analyze,omitempty"`
+
+	Selection *SelectionReport `json:"selection,omitempty"`
+
+	PartialRestore   *PartialRestoreReport `json:"partial_restore,omitempty"`
+	RollbackPlanFile string                `json:"rollback_plan_file,omitempty"`
+
+	DestinationName *DestinationName `json:"destination_name,omitempty"` // Set when --dest-db-template named the destination
+	DatabaseCase    *DatabaseCase    `json:"database_case,omitempty"`
+
+	OutputLocations []OutputLocation `json:"output_locations,omitempty"`
+
+	StaleBackup *StaleBackupCheck `json:"stale_backup_check,omitempty"`
+
+	Source      *ManifestDatabase `json:"source,omitempty"`
+	Destination *ManifestDatabase `json:"destination,omitempty"`
+
+	SourceReplica     *ReplicaExport     `json:"source_replica,omitempty"`
+	SkippedUnreadable []UnreadableObject `json:"skipped_unreadable,omitempty"`
+
+	SchemaFile   string `json:"schema_file,omitempty"`
+	SchemaSHA256 string `json:"schema_sha256,omitempty"`
+	BackupFile   string `json:"backup_file,omitempty"`
+	RunDir       string `json:"run_dir,omitempty"`
+	UploadTo     string `json:"upload_to,omitempty"` // Storage of --output-dir; the paths here are in its local staging directory
+	BackupSHA256 string `json:"backup_sha256,omitempty"`
+	ReindexFile  string `json:"reindex_file,omitempty"`
+	TOCFile      string `json:"toc_file,omitempty"`
+	SplitDir     string `json:"split_dir,omitempty"`
+
+	Git *GitReport `json:"git,omitempty"`
+
+	Push *PushReport `json:"push,omitempty"`
+
+	SchemaFingerprint string           `json:"schema_fingerprint,omitempty"`
+	PreviousMigration *MigrationMarker `json:"previous_migration,omitempty"` // Marker the destination carried before the run
+
+	TOC []TOCEntry `json:"toc,omitempty"` // Table of contents of a directory dump
+
+	SchemaHeader *FileHeader `json:"schema_header,omitempty"` // What generated the schema file applied
+
+	RoleHandling *RoleHandling `json:"role_handling,omitempty"` // Resolved --roles, --privileges and --owners
+
+	RolesFile  string            `json:"roles_file,omitempty"`
+	RoleFilter *RoleFilterReport `json:"role_filter,omitempty"`
+
+	CreatedRoles []string `json:"created_roles,omitempty"`
+
+	VerifyDiscrepancies []VerifyDiscrepancy `json:"verify_discrepancies,omitempty"`
+	VerifyFixFile       string              `json:"verify_fix_file,omitempty"`
+
+	SearchPathFindings []SearchPathFinding `json:"search_path_findings,omitempty"`
+	PinnedFunctions    []string            `json:"pinned_functions,omitempty"`
+
+	OwnershipSkipped     map[string]int `json:"ownership_skipped,omitempty"`
+	OwnershipSkippedFile string         `json:"ownership_skipped_file,omitempty"`
+
+	Unlogged *UnloggedReport `json:"unlogged,omitempty"`
+
+	Phases       []ManifestPhase    `json:"phases"`
+	PhaseSeconds map[string]float64 `json:"phase_seconds"` // Total duration by phase
+	ObjectCounts map[string]int     `json:"object_counts,omitempty"`
+
+	DestinationOnlyObjects []DatabaseObject `json:"destination_only_objects,omitempty"`
+
+	Warnings []Warning    `json:"warnings"`
+	Notices  []PsqlNotice `json:"notices,omitempty"`
+
+	ObjectTimings []ObjectTiming `json:"object_timings,omitempty"` // In schema file order
+
+	ApplyErrors     []PsqlError `json:"apply_errors,omitempty"` // The first ones, with their statements
+	ApplyErrorCount int         `json:"apply_error_count,omitempty"`
+
+	CodeChanges []CodeDiff `json:"code_changes,omitempty"`
+
+	ConvergeFile    string           `json:"converge_file,omitempty"`
+	ConvergeChanges []ConvergeChange `json:"converge_changes,omitempty"`
+
+	NonTransactional []NonTransactionalStatement `json:"non_transactional,omitempty"`
+
+	SkippedSettings []string `json:"skipped_settings,omitempty"`
+}
+
+// Result collects the state of the run into its RunResult
+func (r *RunState) Result() *RunResult {
+	result := &RunResult{
+		Version:     manifestVersion,
+		RunLabel:    r.Label,
+		Mode:        r.Mode,
+		StartedAt:   r.StartedAt,
+		FinishedAt:  time.Now(),
+		Success:     r.Success,
+		FailedPhase: r.FailedPhase,
+		TimedOut:    r.TimedOutPhase,
+		Error:       r.Error,
+
+		BlackoutOverride: r.BlackoutOverride,
+
+		Bootstrap: r.Bootstrap,
+
+		DestinationPath: r.DestinationPath,
+
+		Replication: r.Replication,
+
+		Grants: r.Grants,
+
+		Analyze: r.Analyze,
+
+		Selection: r.Selection,
+
+		PartialRestore:   r.PartialRestore,
+		RollbackPlanFile: r.RollbackPlanFile,
+
+		DestinationName: r.DestinationName,
+		DatabaseCase:    r.DatabaseCase,
+
+		OutputLocations: r.OutputLocations,
+		StaleBackup:     r.StaleBackup,
+
+		Source:      manifestDatabase(r.Source),
+		Destination: manifestDatabase(r.Dest),
+		SchemaFile:  r.SchemaFile,
+
+		SourceReplica:     r.SourceReplica,
+		SkippedUnreadable: r.SkippedUnreadable,
+		BackupFile:        r.BackupFile,
+		RunDir:            r.RunDir,
+		UploadTo:          r.UploadTo,
+		ReindexFile:       r.ReindexFile,
+		TOCFile:           r.TOCFile,
+		SplitDir:          r.SplitDir,
+		Git:               r.Git,
+		Push:              r.Push,
+		TOC:               r.TOC,
+		SchemaHeader:      r.SchemaHeader,
+		RolesFile:         r.RolesFile,
+		RoleHandling:      r.RoleHandling,
+		RoleFilter:        r.RoleFilter,
+
+		CreatedRoles: r.CreatedRoles,
+
+		VerifyDiscrepancies: r.VerifyDiscrepancies,
+		VerifyFixFile:       r.VerifyFixFile,
+
+		SearchPathFindings: r.SearchPathFindings,
+		PinnedFunctions:    r.PinnedFunctions,
+
+		OwnershipSkipped:     r.OwnershipSkipped,
+		OwnershipSkippedFile: r.OwnershipSkippedFile,
+		Unlogged:             r.Unlogged,
+
+		Phases:       []ManifestPhase{},
+		PhaseSeconds: make(map[string]float64),
+		ObjectCounts: r.ObjectCounts,
+
+		DestinationOnlyObjects: r.DestinationOnly,
+
+		Warnings: append([]Warning{}, r.Warnings...),
+		Notices:  r.Notices,
+
+		ObjectTimings: r.ObjectTimings,
+
+		ApplyErrors:     r.ApplyErrors,
+		ApplyErrorCount: r.ApplyErrorCount,
+
+		CodeChanges: r.CodeChanges,
+
+		ConvergeFile:    r.ConvergeFile,
+		ConvergeChanges: r.ConvergeChanges,
+
+		NonTransactional: r.NonTransactional,
+
+		SkippedSettings: r.SkippedSettings,
+
+		SchemaFingerprint: r.Fingerprint,
+		PreviousMigration: r.PreviousMigration,
+	}
+	result.SchemaSHA256 = optionalChecksum(r.SchemaFile)
+	result.BackupSHA256 = optionalChecksum(r.BackupFile)
+	for _, p := range r.Phases {
+		result.Phases = append(result.Phases, ManifestPhase{
+			Name:            p.Name,
+			StartedSeconds:  p.Start.Sub(r.StartedAt).Seconds(),
+			DurationSeconds: p.Duration.Seconds(),
+			Status:          StepOK,
+		})
+		result.PhaseSeconds[p.Name] += p.Duration.Seconds()
+	}
+
+	// A phase may run more than once; only its last run failed
+	for i := len(result.Phases) - 1; i >= 0; i-- {
+		p := &result.Phases[i]
+		if p.Name == r.TimedOutPhase {
+			p.Status = StepTimedOut
+			break
+		}
+		if !r.Success && p.Name == r.FailedPhase {
+			p.Status = StepFailed
+			break
+		}
+	}
+	return result
+}
+
+// optionalChecksum returns the sha256 of path, or "" when there is no such file
+func optionalChecksum(path string) string {
+	if path == "" {
+		return ""
+	}
+	sum, err := fileChecksum(path)
+	if err != nil {
+		return ""
+	}
+	return sum
+}
+
+// Duration is how long the run took
+func (r *RunResult) Duration() time.Duration {
+	return r.FinishedAt.Sub(r.StartedAt)
+}
+
+// finish records how the run ended and returns its result
+func (r *RunState) finish(err error) *RunResult {
+	r.Success = err == nil
+	if err != nil {
+		r.Error = err.Error()
+		r.fail()
+	}
+	return r.Result()
+}
+
+// writeRunReports writes the reports of a finished run from its result.
+// Reports that can't be written only warn; the run's outcome stands.
+func writeRunReports(result *RunResult, options *MigrationOptions, manifest string) {
+	if manifest != "" {
+		if err := writeRunManifest(manifest, result); err != nil {
+			warn(WarnReportNotWritten, fmt.Sprintf("Failed to write run manifest: %v", err))
+		}
+	}
+	if logger.adapter != nil {
+		if err := logger.adapter.WriteSummary(result); err != nil {
+			warn(WarnReportNotWritten, fmt.Sprintf("Failed to write run summary: %v", err))
+		}
+	}
+	if options.MetricsFile != "" {
+		if err := writeMetricsFile(options.MetricsFile, result); err != nil {
+			warn(WarnReportNotWritten, fmt.Sprintf("Failed to write metrics file: %v", err))
+		}
+	}
+	if options.SummaryJSON != "" {
+		if err := writeSummaryJSON(options.SummaryJSON, result); err != nil {
+			warn(WarnReportNotWritten, fmt.Sprintf("Failed to write --summary-json: %v", err))
+		}
+	}
+	if options.Notify != nil {
+		notifyByEmail(options.Notify, result)
+	}
+}
+
+// writeResultJSON writes result as indented JSON to path
+func writeResultJSON(path string, result *RunResult) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// writeSummaryJSON writes the result for --summary-json, to stdout for "-"
+func writeSummaryJSON(path string, result *RunResult) error {
+	if path != "-" {
+		return writeResultJSON(path, result)
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return err
+}
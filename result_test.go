@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// failedRun runs a migration that gets as far as apply and fails there
+func failedRun(t *testing.T) (*RunState, *RunResult) {
+	t.Helper()
+	captureLog(t)
+	dir := t.TempDir()
+	schema := filepath.Join(dir, "schema_app_20260304_050607.sql")
+	if err := os.WriteFile(schema, []byte("CREATE TABLE t (id integer);\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newRunState("nightly")
+	s.Mode = "direct"
+	s.OutputDir = dir
+	s.history = []*RunResult{}
+	s.Source = &DatabaseConfig{Host: "source.example.com", Port: "5432", Database: "app"}
+	s.Dest = &DatabaseConfig{Host: "dest.example.com", Port: "5432", Database: "app", Environment: "staging"}
+	s.ObjectCounts = map[string]int{"TABLE": 1}
+	previous := currentRun
+	currentRun = s
+	t.Cleanup(func() { currentRun = previous })
+
+	err := s.phase("export", func() error {
+		s.SchemaFile = schema
+		return nil
+	})
+	if err == nil {
+		err = s.phase("backup", func() error {
+			s.BackupFile = filepath.Join(dir, "backup_that_was_never_written.sql")
+			warn(WarnBackupSkipped, "an example warning")
+			return nil
+		})
+	}
+	if err == nil {
+		err = s.phase("apply", func() error {
+			return errors.New(`ERROR:  relation "t" already exists`)
+		})
+	}
+	if err == nil {
+		t.Fatal("the apply phase did not fail")
+	}
+	return s, s.finish(err)
+}
+
+func TestRunResultPopulatedOnFailure(t *testing.T) {
+	_, result := failedRun(t)
+
+	if result.Success || result.FailedPhase != "apply" || !strings.Contains(result.Error, "already exists") {
+		t.Errorf("success %v, failed phase %q, error %q", result.Success, result.FailedPhase, result.Error)
+	}
+	var statuses []string
+	for _, p := range result.Phases {
+		statuses = append(statuses, p.Name+" "+p.Status)
+	}
+	if want := []string{"export ok", "backup ok", "apply failed"}; !slices.Equal(statuses, want) {
+		t.Errorf("phases %q, want %q", statuses, want)
+	}
+	for _, name := range []string{"export", "backup", "apply"} {
+		if _, ok := result.PhaseSeconds[name]; !ok {
+			t.Errorf("no phase_seconds for %s", name)
+		}
+	}
+	if result.SchemaFile == "" || len(result.SchemaSHA256) != 64 {
+		t.Errorf("schema file %q with checksum %q", result.SchemaFile, result.SchemaSHA256)
+	}
+	if result.BackupFile == "" || result.BackupSHA256 != "" {
+		t.Errorf("a backup file not written has checksum %q", result.BackupSHA256)
+	}
+	if len(result.Warnings) != 1 || result.Warnings[0].Code != WarnBackupSkipped {
+		t.Errorf("warnings %+v", result.Warnings)
+	}
+	if result.Destination == nil || result.Destination.Environment != "staging" || result.ObjectCounts["TABLE"] != 1 {
+		t.Errorf("destination %+v, object counts %v", result.Destination, result.ObjectCounts)
+	}
+	if result.Version != manifestVersion || result.RunLabel != "nightly" || result.Duration() < 0 {
+		t.Errorf("version %d, label %q, duration %s", result.Version, result.RunLabel, result.Duration())
+	}
+}
+
+func TestRunResultRoundTrip(t *testing.T) {
+	_, result := failedRun(t)
+	result.ApplyErrors = []PsqlError{{Message: `relation "t" already exists`}}
+	result.ApplyErrorCount = 1
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "manifest_20260304_050607.json")
+	if err := writeRunManifest(path, result); err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history := loadRunHistory(dir)
+	if len(history) != 1 {
+		t.Fatalf("loaded %d manifests, want 1", len(history))
+	}
+	again, err := json.MarshalIndent(history[0], "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(again, '\n'), written) {
+		t.Errorf("the manifest changes when read back:\n%s\nwant:\n%s", again, written)
+	}
+	if !history[0].StartedAt.Equal(result.StartedAt) || !history[0].FinishedAt.Equal(result.FinishedAt) {
+		t.Errorf("times read back as %s to %s", history[0].StartedAt, history[0].FinishedAt)
+	}
+
+	// --summary-json writes the same document
+	summary := filepath.Join(dir, "summary", "run.json")
+	if err := writeSummaryJSON(summary, result); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(summary); err != nil || !bytes.Equal(data, written) {
+		t.Errorf("--summary-json differs from the manifest: %v", err)
+	}
+}
+
+func TestRunResultJSONFields(t *testing.T) {
+	captureLog(t)
+	s := newRunState("")
+	s.Mode = "apply"
+	s.history = []*RunResult{}
+	data, err := json.Marshal(s.finish(errors.New("--dest-db is required")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	// Always present, also for a run that failed before its first phase
+	want := map[string]string{
+		"version":       "3",
+		"mode":          `"apply"`,
+		"success":       "false",
+		"failed_phase":  `"setup"`,
+		"error":         `"--dest-db is required"`,
+		"phases":        "[]",
+		"phase_seconds": "{}",
+		"warnings":      "[]",
+	}
+	for key, value := range want {
+		if got := string(fields[key]); got != value {
+			t.Errorf("%s is %s, want %s", key, got, value)
+		}
+	}
+	// Empty optional fields are left out
+	for _, key := range []string{"run_label", "schema_file", "backup_sha256", "source", "destination", "apply_errors"} {
+		if _, ok := fields[key]; ok {
+			t.Errorf("%s written for a run without it", key)
+		}
+	}
+}
+
+func TestRunResultUpgrade(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		version  int
+		statuses []string
+		seconds  map[string]float64
+	}{
+		{
+			name:     "version 1",
+			manifest: `{"mode": "direct", "success": false, "failed_phase": "apply", "phases": [{"name": "export", "duration_seconds": 2}, {"name": "apply", "duration_seconds": 1}, {"name": "apply", "duration_seconds": 3}]}`,
+			version:  1,
+			statuses: []string{"ok", "failed", "failed"},
+			seconds:  map[string]float64{"export": 2, "apply": 4},
+		},
+		{
+			name:     "version 2",
+			manifest: `{"version": 2, "mode": "direct", "success": true, "phases": [{"name": "export", "duration_seconds": 2}], "phase_seconds": {"export": 2}}`,
+			version:  2,
+			statuses: []string{"ok"},
+			seconds:  map[string]float64{"export": 2},
+		},
+		{
+			name:     "version 3",
+			manifest: `{"version": 3, "mode": "direct", "success": false, "timed_out_phase": "apply", "failed_phase": "apply", "phases": [{"name": "apply", "duration_seconds": 9, "status": "timed_out"}], "phase_seconds": {"apply": 9}}`,
+			version:  3,
+			statuses: []string{"timed_out"},
+			seconds:  map[string]float64{"apply": 9},
+		},
+	}
+	for _, test := range tests {
+		var m RunResult
+		if err := json.Unmarshal([]byte(test.manifest), &m); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		m.upgrade()
+		var statuses []string
+		for _, p := range m.Phases {
+			statuses = append(statuses, p.Status)
+		}
+		if m.Version != test.version || !slices.Equal(statuses, test.statuses) {
+			t.Errorf("%s: version %d, statuses %q, want %d, %q", test.name, m.Version, statuses, test.version, test.statuses)
+		}
+		for name, seconds := range test.seconds {
+			if m.PhaseSeconds[name] != seconds {
+				t.Errorf("%s: phase_seconds[%s] = %v, want %v", test.name, name, m.PhaseSeconds[name], seconds)
+			}
+		}
+	}
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// resumeStateFile is written to the output directory of every direct
+// migration and apply, and read by the resume subcommand
+const resumeStateFile = "run_state.json"
+
+// Steps recorded in the resume state, in the order they complete
+const (
+	StepExported     = "exported"
+	StepBackedUp     = "backed-up"
+	StepDropped      = "dropped"
+	StepCreated      = "created"
+	StepRolesApplied = "roles-applied"
+	StepRolesCreated = "roles-created"
+	StepApplying     = "applying" // Apply started; a partial apply cannot be continued
+	StepApplied      = "applied"
+	StepSeeded       = "seeded"
+	StepCompleted    = "completed"
+	StepRolledBack   = "rolled-back"
+)
+
+// Resume strategies for an interrupted apply
+const (
+	ResumeRollback = "rollback"
+	ResumeRecreate = "recreate"
+)
+
+// ResumeState is what a resumed run needs to continue where an interrupted
+// one stopped. Passwords are never stored; they are obtained again.
+type ResumeState struct {
+	Timestamp string `json:"timestamp"` // Artifact timestamp of the interrupted run
+	RunLabel  string `json:"run_label,omitempty"`
+
+	Destination ResumeDestination `json:"destination"`
+
+	SchemaFile     string            `json:"schema_file"`
+	SchemaSHA256   string            `json:"schema_sha256"`
+	BackupFile     string            `json:"backup_file,omitempty"`
+	BackupActivity *DatabaseActivity `json:"backup_activity,omitempty"` // Destination statistics as the backup started
+	RolesFile      string            `json:"roles_file,omitempty"`
+	GrantsFile     string            `json:"grants_file,omitempty"` // Destination grants saved before the drop
+	MissingRoles   []string          `json:"missing_roles,omitempty"`
+
+	CreateBackup              bool                  `json:"create_backup"`
+	CreateDB                  CreateDatabaseOptions `json:"create_database"`
+	MaintenanceWindow         bool                  `json:"maintenance_window,omitempty"`
+	Bootstrap                 bool                  `json:"bootstrap,omitempty"`
+	InPlace                   bool                  `json:"in_place,omitempty"` // The destination was empty and applied into without a drop
+	SeedFile                  string                `json:"seed_file,omitempty"`
+	DisableTriggersDuringData bool                  `json:"disable_triggers_during_data,omitempty"`
+	DeferConstraints          bool                  `json:"defer_constraints,omitempty"`
+	ArtifactNames             map[string]string     `json:"artifact_names,omitempty"` // --artifact-name-template of the interrupted run
+
+	Steps []string `json:"steps"`
+}
+
+// ResumeDestination identifies the destination as given on the command line
+type ResumeDestination struct {
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Username string `json:"user"`
+	Database string `json:"database"`
+	SSLMode  string `json:"sslmode"`
+	Role     string `json:"role,omitempty"`
+	Options  string `json:"options,omitempty"`
+	SSH      string `json:"ssh,omitempty"`
+
+	Environment string `json:"environment,omitempty"`
+}
+
+func newResumeState(dest *DatabaseConfig, schemaFile, timestamp string, options *MigrationOptions, state *RunState) (*ResumeState, error) {
+	checksum, err := fileChecksum(schemaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	host, port := dest.Host, dest.Port
+	if dest.TunnelTarget != "" {
+		if host, port, err = net.SplitHostPort(dest.TunnelTarget); err != nil {
+			return nil, err
+		}
+	}
+
+	return &ResumeState{
+		Timestamp: timestamp,
+		RunLabel:  options.RunLabel,
+		Destination: ResumeDestination{
+			Host:     host,
+			Port:     port,
+			Username: dest.Username,
+			Database: dest.Database,
+			SSLMode:  dest.SSLMode,
+			Role:     dest.Role,
+			Options:  dest.Options,
+			SSH:      dest.SSH,
+
+			Environment: dest.Environment,
+		},
+		SchemaFile:                schemaFile,
+		SchemaSHA256:              checksum,
+		RolesFile:                 state.RolesFile,
+		CreateBackup:              options.CreateBackup,
+		CreateDB:                  options.CreateDB,
+		MaintenanceWindow:         options.MaintenanceWindow,
+		Bootstrap:                 options.Bootstrap,
+		SeedFile:                  options.SeedFile,
+		DisableTriggersDuringData: options.DisableTriggersDuringData,
+		DeferConstraints:          options.DeferConstraints,
+		ArtifactNames:             options.ArtifactNames,
+		Steps:                     []string{StepExported},
+	}, nil
+}
+
+func (s *ResumeState) done(step string) bool {
+	for _, done := range s.Steps {
+		if done == step {
+			return true
+		}
+	}
+	return false
+}
+
+// forget removes steps so they run again
+func (s *ResumeState) forget(steps ...string) {
+	kept := s.Steps[:0]
+	for _, done := range s.Steps {
+		forgotten := false
+		for _, step := range steps {
+			forgotten = forgotten || done == step
+		}
+		if !forgotten {
+			kept = append(kept, done)
+		}
+	}
+	s.Steps = kept
+}
+
+func loadResumeState(path string) (*ResumeState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s ResumeState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %v", path, err)
+	}
+	return &s, nil
+}
+
+// writeResumeState replaces the state file atomically, so an interruption
+// never leaves a truncated one behind
+func writeResumeState(path string, s *ResumeState) error {
+	return replaceJSONFile(path, s)
+}
+
+// replaceJSONFile writes v as indented JSON to a new file next to path and
+// renames it over path
+func replaceJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+strings.TrimSuffix(filepath.Base(path), ".json")+"-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// startResumeState begins recording the steps of a migration so it can be
+// resumed. Runs without a lasting schema file (stdin) are not resumable.
+func (r *RunState) startResumeState(dest *DatabaseConfig, schemaFile, timestamp string, options *MigrationOptions) {
+	if r.Resume != nil || options.DryRun {
+		return
+	}
+	s, err := newResumeState(dest, schemaFile, timestamp, options, r)
+	if err != nil {
+		warn(WarnResumeStateNotWritten, fmt.Sprintf("Run cannot be resumed: %v", err))
+		return
+	}
+	r.Resume = s
+	r.ResumePath = filepath.Join(options.OutputDir, resumeStateFile)
+	r.checkpoint("")
+}
+
+// done reports whether step completed in the run being resumed
+func (r *RunState) done(step string) bool {
+	return r.Resume != nil && r.Resume.done(step)
+}
+
+// checkpoint records a completed step in the state file
+func (r *RunState) checkpoint(step string) {
+	if r.Resume == nil {
+		return
+	}
+	if step != "" && !r.Resume.done(step) {
+		r.Resume.Steps = append(r.Resume.Steps, step)
+	}
+	r.Resume.BackupFile = r.BackupFile
+	r.Resume.BackupActivity = r.BackupActivity
+	r.Resume.MissingRoles = r.MissingRoles
+	r.Resume.InPlace = r.DestinationPath == DestinationInPlace
+	if r.Grants != nil {
+		r.Resume.GrantsFile = r.Grants.File
+	}
+	if err := writeResumeState(r.ResumePath, r.Resume); err != nil {
+		warn(WarnResumeStateNotWritten, fmt.Sprintf("Failed to write resume state: %v", err))
+	}
+}
+
+func newResumeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "resume <run-dir>",
+		Short: "Continue an interrupted migration from its run directory",
+		Long: "Continue a direct migration or apply that was interrupted, using the " + resumeStateFile + " file in its output directory. " +
+			"The destination and schema file must match the interrupted run. " +
+			"An apply that was cut off part way is not continued; it is rolled back from the backup or the destination is recreated.",
+		Args: cobra.ExactArgs(1),
+		RunE: runResume,
+	}
+
+	cmd.Flags().StringP("resume-strategy", "", "", "For an interrupted apply: 'rollback' (restore the backup and stop) or 'recreate' (drop, recreate and apply again); prompts when empty")
+	return cmd
+}
+
+// resumeDestinationFlags maps destination flags to the saved values they must match
+func resumeDestinationFlags(d *ResumeDestination) map[string]string {
+	return map[string]string{
+		"dest-host":    d.Host,
+		"dest-port":    d.Port,
+		"dest-user":    d.Username,
+		"dest-db":      d.Database,
+		"dest-ssl":     d.SSLMode,
+		"dest-role":    d.Role,
+		"dest-options": d.Options,
+		"dest-ssh":     d.SSH,
+
+		"dest-environment": d.Environment,
+	}
+}
+
+func runResume(cmd *cobra.Command, args []string) error {
+	if err := configureCIOutput(cmd); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	logger.Info("Resuming interrupted migration...")
+	handleSignals()
+
+	runDir := args[0]
+	statePath := filepath.Join(runDir, resumeStateFile)
+	saved, err := loadResumeState(statePath)
+	if err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Failed to read resume state: %v", err))
+	}
+	if saved.done(StepCompleted) || saved.done(StepRolledBack) {
+		logger.Success(fmt.Sprintf("Nothing to resume: the run finished (%s)", saved.Steps[len(saved.Steps)-1]))
+		return nil
+	}
+
+	strategy, _ := cmd.Flags().GetString("resume-strategy")
+	if strategy != "" && strategy != ResumeRollback && strategy != ResumeRecreate {
+		return exitWith(exitOptionError, errors.New("--resume-strategy must be 'rollback' or 'recreate'"))
+	}
+
+	// The destination comes from the state file; flags may only repeat it
+	for flag, value := range resumeDestinationFlags(&saved.Destination) {
+		if cmd.Flags().Changed(flag) {
+			if given, _ := cmd.Flags().GetString(flag); given != value {
+				return exitWith(exitOptionError, fmt.Errorf("--%s %q does not match the interrupted run (%q)", flag, given, value))
+			}
+			continue
+		}
+		cmd.Flags().Set(flag, value)
+	}
+
+	options, err := parseMigrationOptions(cmd)
+	if err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Failed to parse options: %v", err))
+	}
+	if options.DryRun {
+		return exitWith(exitOptionError, errors.New("--dry-run cannot be used with resume"))
+	}
+	options.OutputDir = runDir
+	options.BackupDir = filepath.Join(runDir, "backup")
+	options.CreateBackup = saved.CreateBackup
+	options.CreateDB = saved.CreateDB
+	options.MaintenanceWindow = saved.MaintenanceWindow
+	options.SeedFile = saved.SeedFile
+	options.DisableTriggersDuringData = saved.DisableTriggersDuringData
+	options.DeferConstraints = saved.DeferConstraints
+	options.ArtifactNames = saved.ArtifactNames
+	if options.RunLabel == "" {
+		options.RunLabel = saved.RunLabel
+	}
+
+	if err := validateConnectionFlags(cmd, false, true); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	checksum, err := fileChecksum(saved.SchemaFile)
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Schema file of the interrupted run is not readable: %v", err))
+	}
+	if checksum != saved.SchemaSHA256 {
+		return exitWith(exitFailure, fmt.Errorf("Schema file %s changed since the interrupted run (sha256 %s, was %s)", saved.SchemaFile, checksum, saved.SchemaSHA256))
+	}
+
+	state, err := beginRun(cmd, options)
+	if err != nil {
+		return err
+	}
+	state.Resume = saved
+	state.ResumePath = statePath
+	state.SchemaFile = saved.SchemaFile
+	state.BackupFile = saved.BackupFile
+	state.BackupActivity = saved.BackupActivity
+	state.RolesFile = saved.RolesFile
+	state.MissingRoles = saved.MissingRoles
+	if saved.GrantsFile != "" {
+		state.Grants = &GrantsSnapshot{File: saved.GrantsFile}
+	}
+	logger.Info(fmt.Sprintf("Completed steps of the interrupted run: %s", strings.Join(saved.Steps, ", ")))
+
+	destConfig, err := getDestConfig(cmd, "")
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Failed to get destination config: %v", err))
+	}
+	if err := protectProduction(nil, destConfig, options); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+	if err := checkBlackout(options, state, time.Now()); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+	state.Dest = destConfig
+
+	if err := startTunnels(&options.SSH, destConfig); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("SSH tunnel setup failed: %v", err))
+	}
+
+	if err := validateDestinationConnection(destConfig); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Connection validation failed: %v", err))
+	}
+
+	if useKeyring, _ := cmd.Flags().GetBool("use-keyring"); useKeyring {
+		rememberPasswords(destConfig)
+	}
+
+	err = state.phase("resume-check", func() error {
+		return checkResumable(destConfig, state, strategy)
+	})
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Cannot resume: %v", err))
+	}
+
+	// Set after the check, which clears them when the partial apply is recreated
+	options.Bootstrap = saved.Bootstrap
+	if saved.InPlace {
+		state.DestinationPath = DestinationInPlace
+	}
+
+	if state.done(StepRolledBack) {
+		// The restored backup has no statistics to plan with
+		if !options.Analyze.Skip {
+			err := state.phase("analyze", func() error {
+				if err := refreshCredentials(destConfig); err != nil {
+					return err
+				}
+				return analyzeLoadedTables(destConfig, &options.Analyze, state)
+			})
+			if err != nil {
+				return exitWith(exitFailure, fmt.Errorf("Statistics refresh failed: %v", err))
+			}
+		}
+		if err := finishRun(state, options); err != nil {
+			return err
+		}
+		logger.Success("Destination restored from the backup; start a new migration when ready")
+		return nil
+	}
+
+	if err := migrateDestination(destConfig, saved.SchemaFile, saved.Timestamp, options, state); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Resumed migration failed: %v", err))
+	}
+
+	if err := finishRun(state, options); err != nil {
+		return err
+	}
+	logger.Success("Resumed migration completed successfully!")
+	return nil
+}
+
+// checkResumable makes sure the destination is in the state the completed
+// steps left it in. An apply that was cut off is rolled back or recreated.
+func checkResumable(dest *DatabaseConfig, state *RunState, strategy string) error {
+	if err := refreshCredentials(dest); err != nil {
+		return err
+	}
+	exists, err := databaseExists(dest)
+	if err != nil {
+		return err
+	}
+
+	s := state.Resume
+	switch {
+	case s.done(StepCreated):
+		if !exists {
+			return fmt.Errorf("destination database '%s' was created by the interrupted run but no longer exists", dest.Database)
+		}
+	case s.done(StepDropped):
+		if exists {
+			return fmt.Errorf("destination database '%s' was dropped by the interrupted run but exists again", dest.Database)
+		}
+		return nil
+	default:
+		// Nothing was changed yet, so the run starts over from the loss check
+		return nil
+	}
+
+	if s.done(StepApplied) {
+		return nil
+	}
+	partial := s.done(StepApplying)
+	if !partial {
+		empty, err := databaseIsEmpty(dest)
+		if err != nil {
+			return err
+		}
+		partial = !empty
+	}
+	if !partial {
+		return nil
+	}
+
+	warn(WarnPartialApply, fmt.Sprintf("The schema was partially applied to '%s' and cannot be continued", dest.Database))
+	if strategy == "" {
+		if strategy, err = promptResumeStrategy(state); err != nil {
+			return err
+		}
+	}
+	switch strategy {
+	case ResumeRecreate:
+		logger.Info("Recreating the destination database and applying the schema again")
+		s.forget(StepDropped, StepCreated, StepApplying)
+		s.Bootstrap = false // Holds the partial apply, which a bootstrap would refuse
+		s.InPlace = false   // Nor is it empty any more
+		state.checkpoint("")
+		return nil
+	default:
+		if state.BackupFile == "" {
+			return fmt.Errorf("no backup to roll back to; use --resume-strategy recreate")
+		}
+		err := state.phase("rollback", func() error {
+			return restoreBackup(dest, state.BackupFile, &s.CreateDB)
+		})
+		if err != nil {
+			return fmt.Errorf("rollback failed: %v", err)
+		}
+		state.checkpoint(StepRolledBack)
+		return nil
+	}
+}
+
+func promptResumeStrategy(state *RunState) (string, error) {
+	if !stdinIsTerminal() {
+		return "", fmt.Errorf("an interrupted apply needs --resume-strategy rollback or recreate")
+	}
+
+	choices := "recreate"
+	if state.BackupFile != "" {
+		choices = "rollback/recreate"
+	}
+	fmt.Fprintf(os.Stderr, "Roll back to the backup or recreate the destination and apply again? (%s): ", choices)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("failed to read answer: %v", err)
+	}
+	answer = strings.TrimSpace(answer)
+	if answer != ResumeRecreate && (answer != ResumeRollback || state.BackupFile == "") {
+		return "", fmt.Errorf("no resume strategy chosen")
+	}
+	return answer, nil
+}
+
+// userObjectsQuery tells whether a database has schemas besides public, or
+// relations of any kind, types or functions outside the system schemas.
+// Extension members don't count, nor do the objects made along with them:
+// their indexes, owned sequences, row and array types.
+const userObjectsQuery = `
+	WITH RECURSIVE extension_objects AS (
+		SELECT classid, objid FROM pg_depend WHERE deptype = 'e'
+		UNION
+		SELECT d.classid, d.objid
+		FROM pg_depend d
+		JOIN extension_objects e ON d.refclassid = e.classid AND d.refobjid = e.objid
+		WHERE d.deptype IN ('a', 'i')
+	), user_namespaces AS (
+		SELECT oid, nspname FROM pg_namespace
+		WHERE nspname NOT IN ('pg_catalog', 'information_schema', 'pg_toast')
+			AND nspname NOT LIKE 'pg\_temp\_%' AND nspname NOT LIKE 'pg\_toast\_temp\_%'
+			AND oid NOT IN (SELECT objid FROM extension_objects WHERE classid = 'pg_namespace'::regclass)
+	)
+	SELECT EXISTS (SELECT 1 FROM user_namespaces WHERE nspname <> 'public')
+		OR EXISTS (SELECT 1 FROM pg_class WHERE relnamespace IN (SELECT oid FROM user_namespaces)
+			AND oid NOT IN (SELECT objid FROM extension_objects WHERE classid = 'pg_class'::regclass))
+		OR EXISTS (SELECT 1 FROM pg_type WHERE typnamespace IN (SELECT oid FROM user_namespaces)
+			AND oid NOT IN (SELECT objid FROM extension_objects WHERE classid = 'pg_type'::regclass))
+		OR EXISTS (SELECT 1 FROM pg_proc WHERE pronamespace IN (SELECT oid FROM user_namespaces)
+			AND oid NOT IN (SELECT objid FROM extension_objects WHERE classid = 'pg_proc'::regclass))`
+
+// databaseIsEmpty reports whether the destination database has no user
+// objects besides the public schema; see userObjectsQuery
+func databaseIsEmpty(config *DatabaseConfig) (bool, error) {
+	db, err := openDatabase(config, config.Database)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	var hasObjects bool
+	if err := db.QueryRowContext(runContext(), userObjectsQuery).Scan(&hasObjects); err != nil {
+		return false, err
+	}
+	return !hasObjects, nil
+}
+
+// restoreBackup replaces the destination database with its backup, as the
+// rollback script does
+func restoreBackup(config *DatabaseConfig, backupFile string, createOpts *CreateDatabaseOptions) error {
+	logger.Info(fmt.Sprintf("Restoring '%s' from backup %s...", config.Database, backupFile))
+
+	// A backup that can't be read must not cost the destination first
+	if err := checkDumpTOC(config, backupFile); err != nil {
+		return err
+	}
+
+	if err := dropDatabaseIfExists(config); err != nil {
+		return err
+	}
+	if err := createDatabase(config, createOpts); err != nil {
+		return err
+	}
+	if err := applySchema(config, backupFile, nil, nil); err != nil {
+		return err
+	}
+
+	logger.Info("Backup restored")
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// setRoleStatement returns the SET ROLE statement for the given role
+func setRoleStatement(role string) string {
+	return fmt.Sprintf("SET ROLE %s", quoteIdentifier(role))
+}
+
+// setSessionRole switches the connection to the configured role. The pool is
+// limited to a single connection so every later statement on db runs under
+// that role.
+func setSessionRole(db *sql.DB, role string) error {
+	if role == "" {
+		return nil
+	}
+
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(setRoleStatement(role)); err != nil {
+		return fmt.Errorf("failed to set role %s: %v", role, err)
+	}
+	return nil
+}
+
+// validateRoleMembership checks that the login user may SET ROLE to the
+// configured role.
+func validateRoleMembership(db *sql.DB, config *DatabaseConfig) error {
+	if config.Role == "" {
+		return nil
+	}
+
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM pg_roles WHERE rolname = $1)`, config.Role).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("role %q does not exist on %s", config.Role, config.Host)
+	}
+
+	var member bool
+	if err := db.QueryRow(`SELECT pg_has_role(current_user, $1, 'MEMBER')`, config.Role).Scan(&member); err != nil {
+		return err
+	}
+	if !member {
+		return fmt.Errorf("login role %q is not a member of %q on %s; grant it with: GRANT %s TO %s",
+			config.Username, config.Role, config.Host, quoteIdentifier(config.Role), quoteIdentifier(config.Username))
+	}
+
+	logger.Info(fmt.Sprintf("Login role %s may SET ROLE to %s", config.Username, config.Role))
+	return nil
+}
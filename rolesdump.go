@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// defaultExcludedRoles are provider-managed roles that cannot be created
+// elsewhere. Roles starting with pg_ are predefined and never dumped.
+var defaultExcludedRoles = []string{"rds*", "azure*", "cloudsql*"}
+
+// RoleFilterOptions controls which parts of the roles dump are kept
+type RoleFilterOptions struct {
+	Exclude       []string // Globs of role names to leave out, on top of the defaults
+	KeepSuperuser bool     // Keep SUPERUSER and REPLICATION attributes
+}
+
+// RoleFilterReport lists what filtering removed from the roles dump
+type RoleFilterReport struct {
+	ExcludedRoles      []string            `json:"excluded_roles,omitempty"`
+	StrippedAttributes map[string][]string `json:"stripped_attributes,omitempty"` // By role
+}
+
+// roleNamePattern matches a plain or double-quoted role name
+const roleNamePattern = `("(?:[^"]|"")*"|[^\s;"]+)`
+
+var (
+	createRolePattern  = regexp.MustCompile(`^CREATE ROLE ` + roleNamePattern + `;`)
+	alterRolePattern   = regexp.MustCompile(`^ALTER ROLE ` + roleNamePattern + ` (.*);$`)
+	roleObjectPattern  = regexp.MustCompile(`^(?:COMMENT ON|SECURITY LABEL FOR \S+ ON) ROLE ` + roleNamePattern + ` `)
+	grantRolePattern   = regexp.MustCompile(`^GRANT ` + roleNamePattern + ` TO ` + roleNamePattern + `(.*);$`)
+	grantedByPattern   = regexp.MustCompile(` GRANTED BY ` + roleNamePattern)
+	strippedAttributes = map[string]string{"SUPERUSER": "NOSUPERUSER", "REPLICATION": "NOREPLICATION"}
+)
+
+// unquoteRoleName returns the role name a plain or quoted identifier denotes
+func unquoteRoleName(name string) string {
+	if len(name) >= 2 && strings.HasPrefix(name, `"`) && strings.HasSuffix(name, `"`) {
+		return strings.ReplaceAll(name[1:len(name)-1], `""`, `"`)
+	}
+	return name
+}
+
+func roleExcluded(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRolesSQL removes statements about excluded roles from a
+// pg_dumpall --roles-only dump and strips superuser attributes.
+func filterRolesSQL(dump string, opts *RoleFilterOptions) (string, *RoleFilterReport) {
+	patterns := append(append([]string{}, defaultExcludedRoles...), opts.Exclude...)
+	report := &RoleFilterReport{StrippedAttributes: make(map[string][]string)}
+	excluded := make(map[string]bool)
+
+	exclude := func(quoted string) bool {
+		name := unquoteRoleName(quoted)
+		if !roleExcluded(name, patterns) {
+			return false
+		}
+		excluded[name] = true
+		return true
+	}
+
+	lines := strings.Split(dump, "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if m := createRolePattern.FindStringSubmatch(line); m != nil && exclude(m[1]) {
+			continue
+		}
+		if m := roleObjectPattern.FindStringSubmatch(line); m != nil && exclude(m[1]) {
+			continue
+		}
+		if m := grantRolePattern.FindStringSubmatch(line); m != nil {
+			if exclude(m[1]) || exclude(m[2]) {
+				continue
+			}
+			// Drop the grantor rather than the grant when only the grantor is excluded
+			if g := grantedByPattern.FindStringSubmatch(m[3]); g != nil && exclude(g[1]) {
+				line = strings.Replace(line, g[0], "", 1)
+			}
+		}
+		if m := alterRolePattern.FindStringSubmatch(line); m != nil {
+			if exclude(m[1]) {
+				continue
+			}
+			if !opts.KeepSuperuser && strings.HasPrefix(m[2], "WITH ") {
+				words := strings.Fields(m[2])
+				for i, word := range words {
+					if replacement, ok := strippedAttributes[word]; ok {
+						words[i] = replacement
+						role := unquoteRoleName(m[1])
+						report.StrippedAttributes[role] = append(report.StrippedAttributes[role], word)
+					}
+				}
+				line = fmt.Sprintf("ALTER ROLE %s %s;", m[1], strings.Join(words, " "))
+			}
+		}
+		kept = append(kept, line)
+	}
+
+	for name := range excluded {
+		report.ExcludedRoles = append(report.ExcludedRoles, name)
+	}
+	sort.Strings(report.ExcludedRoles)
+	return strings.Join(kept, "\n"), report
+}
+
+// rolesFilePath is where the roles of the source cluster are exported to
+func rolesFilePath(options *MigrationOptions, source *DatabaseConfig, timestamp string) string {
+	return filepath.Join(options.OutputDir, fmt.Sprintf("roles_%s_%s.sql", source.Database, timestamp))
+}
+
+// exportRolesArgs are the pg_dumpall arguments exporting the roles of config
+func exportRolesArgs(config *DatabaseConfig, rolesFile string) []string {
+	args := []string{
+		"-h", config.Host,
+		"-p", config.Port,
+		"-U", config.Username,
+		"-l", dbnameArg(config.Database),
+		"--roles-only",
+		"-f", rolesFile,
+		"--no-password",
+	}
+	if config.Role != "" {
+		args = append(args, "--role="+config.Role)
+	}
+	return args
+}
+
+// exportRoles dumps the source cluster's roles to rolesFile with pg_dumpall
+// and filters the result.
+func exportRoles(config *DatabaseConfig, rolesFile string, options *MigrationOptions) (*RoleFilterReport, error) {
+	logger.Info("Exporting roles from source cluster...")
+
+	cmd := clientCommand(config, "pg_dumpall", exportRolesArgs(config, rolesFile), rolesFile)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("pg_dumpall failed: %v", err)
+	}
+
+	dump, err := os.ReadFile(rolesFile)
+	if err != nil {
+		return nil, err
+	}
+	filtered, report := filterRolesSQL(string(dump), &options.Roles)
+	if err := os.WriteFile(rolesFile, []byte(filtered), 0600); err != nil {
+		return nil, err
+	}
+
+	if len(report.ExcludedRoles) > 0 {
+		logger.Info(fmt.Sprintf("Excluded %d role(s) from the roles dump: %s", len(report.ExcludedRoles), strings.Join(report.ExcludedRoles, ", ")))
+	}
+	roles := make([]string, 0, len(report.StrippedAttributes))
+	for role := range report.StrippedAttributes {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	for _, role := range roles {
+		logger.Info(fmt.Sprintf("Stripped %s from role %s (use --keep-superuser to keep them)", strings.Join(report.StrippedAttributes[role], ", "), role))
+	}
+
+	logger.Info(fmt.Sprintf("Roles exported to: %s", rolesFile))
+	return report, nil
+}
+
+// applyRoles runs the roles dump against the destination server. Errors for
+// roles that already exist are expected and do not stop psql; the ALTER ROLE
+// that follows each CREATE ROLE still updates them.
+func applyRoles(config *DatabaseConfig, rolesFile string) error {
+	logger.Info("Applying roles to destination server...")
+
+	cmd := clientCommand(config, "psql", applyRolesArgs(config, rolesFile), rolesFile)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = psqlStderr(nil)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("psql roles application failed: %v", err)
+	}
+
+	logger.Info("Roles applied")
+	return nil
+}
+
+// applyRolesArgs returns the psql arguments that apply rolesFile to the server of config
+func applyRolesArgs(config *DatabaseConfig, rolesFile string) []string {
+	args := []string{
+		"-h", config.Host,
+		"-p", config.Port,
+		"-U", config.Username,
+		"-d", "postgres",
+	}
+	if config.Role != "" {
+		args = append(args, "-c", setRoleStatement(config.Role))
+	}
+	return append(args, "-f", rolesFile, "--no-password")
+}
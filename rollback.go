@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"pg-schema-migrator/internal/dumpparse"
+)
+
+// identifierPattern matches one identifier as pg_dump writes it
+var identifierPattern = regexp.MustCompile(`^("(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)$`)
+
+// ownedByPattern finds the table of a SEQUENCE OWNED BY entry
+var ownedByPattern = regexp.MustCompile(`OWNED BY ((?:"(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)\.(?:"(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*))\.`)
+
+// schemaDependentsQuery lists what outside a schema would go with a DROP
+// SCHEMA ... CASCADE of it: views on its relations and columns of its types
+const schemaDependentsQuery = `
+SELECT DISTINCT 'view ' || format('%I.%I', vn.nspname, v.relname)
+FROM pg_depend d
+JOIN pg_rewrite r ON d.classid = 'pg_rewrite'::regclass AND r.oid = d.objid
+JOIN pg_class v ON v.oid = r.ev_class
+JOIN pg_namespace vn ON vn.oid = v.relnamespace
+JOIN pg_class t ON d.refclassid = 'pg_class'::regclass AND t.oid = d.refobjid
+JOIN pg_namespace tn ON tn.oid = t.relnamespace
+WHERE tn.nspname = $1 AND vn.nspname <> $1
+UNION
+SELECT 'column ' || format('%I.%I.%I', n.nspname, c.relname, a.attname)
+FROM pg_attribute a
+JOIN pg_class c ON c.oid = a.attrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+JOIN pg_type ty ON ty.oid = a.atttypid
+JOIN pg_namespace tn ON tn.oid = ty.typnamespace
+WHERE tn.nspname = $1 AND n.nspname <> $1
+  AND a.attnum > 0 AND NOT a.attisdropped AND c.relkind IN ('r', 'p', 'f')
+ORDER BY 1`
+
+// restoreScope is one --only of rollback: a table, or a whole schema
+type restoreScope struct {
+	kind   string // "table" or "schema"
+	schema string
+	name   string // The table, empty for a schema
+}
+
+// parseRestoreScope parses "table:schema.name" or "schema:name", with names
+// quoted as in SQL: unquoted names are folded to lower case
+func parseRestoreScope(value string) (restoreScope, error) {
+	kind, name, _ := strings.Cut(value, ":")
+	switch kind {
+	case "table":
+		m := qualifiedNamePattern.FindStringSubmatch(name)
+		if m == nil || m[0] != name {
+			return restoreScope{}, fmt.Errorf("expected table:schema.name")
+		}
+		return restoreScope{kind: kind, schema: unquoteName(m[1]), name: unquoteName(m[2])}, nil
+	case "schema":
+		if !identifierPattern.MatchString(name) {
+			return restoreScope{}, fmt.Errorf("expected schema:name")
+		}
+		return restoreScope{kind: kind, schema: unquoteName(name)}, nil
+	}
+	return restoreScope{}, fmt.Errorf("expected table:schema.name or schema:name")
+}
+
+func (s restoreScope) String() string {
+	if s.kind == "schema" {
+		return "schema " + s.schema
+	}
+	return fmt.Sprintf("table %s.%s", s.schema, s.name)
+}
+
+// PartialRestoreReport records what a partial rollback restored
+type PartialRestoreReport struct {
+	Backup  string   `json:"backup"`
+	Only    []string `json:"only"`
+	Dropped []string `json:"dropped"` // Statements run before the entries of the backup
+	Objects []string `json:"objects"` // Entries of the backup restored, in dump order
+}
+
+// planPartialRestore picks the entries of a backup that restore scopes: a
+// table with everything dropped along with it (constraints, defaults,
+// indexes, triggers, policies, comments, grants, its owned sequences and the
+// data of both), or every entry of a schema. Foreign keys of other tables
+// referring to what is restored are dropped first and restored too. It
+// returns the entries to keep and the statements clearing the way for them.
+func planPartialRestore(blocks []*dumpBlock, scopes []restoreScope) ([]bool, []string, error) {
+	idx := newDumpIndex(blocks)
+	for i := range blocks {
+		idx.link(i)
+	}
+
+	keep := make([]bool, len(blocks))
+	var drops []string
+	for _, scope := range scopes {
+		switch scope.kind {
+		case "table":
+			t := idx.find(scope.schema, scope.name, "TABLE", "FOREIGN TABLE")
+			if t < 0 {
+				return nil, nil, fmt.Errorf("%s is not in the backup", scope)
+			}
+			keep[t] = true
+			drops = append(drops, dropEntryStatement(blocks[t].entry))
+		case "schema":
+			s := idx.find("-", scope.schema, "SCHEMA")
+			if s < 0 {
+				return nil, nil, fmt.Errorf("%s is not created by the backup (pg_dump leaves out public); restore its tables one by one", scope)
+			}
+			keep[s] = true
+			for i, b := range blocks {
+				if b.entry.Schema == scope.schema || b.schema == scope.schema {
+					keep[i] = true
+				}
+			}
+			drops = append(drops, fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE;", quoteIdentifier(scope.schema)))
+		}
+	}
+
+	// What belongs to a kept entry is dropped with it, so it comes back too
+	attach := func() {
+		for changed := true; changed; {
+			changed = false
+			for i, b := range blocks {
+				if keep[i] {
+					continue
+				}
+				if b.parent >= 0 && keep[b.parent] {
+					keep[i], changed = true, true
+					continue
+				}
+				// DROP TABLE takes the sequences the table owns with it
+				if b.entry.Type == "SEQUENCE OWNED BY" && b.parent >= 0 {
+					if m := ownedByPattern.FindStringSubmatch(b.body()); m != nil {
+						schema, name := splitQualifiedName(m[1])
+						if t := idx.find(schema, name, relationTypes...); t >= 0 && keep[t] {
+							keep[b.parent], changed = true, true
+						}
+					}
+				}
+			}
+		}
+	}
+	attach()
+
+	// Foreign keys from elsewhere would keep the drop from going through
+	var fkDrops []string
+	for i, b := range blocks {
+		if keep[i] || b.entry.Type != "FK CONSTRAINT" || b.parent < 0 {
+			continue
+		}
+		for _, j := range idx.references(i) {
+			if keep[j] && j != b.parent && (blocks[j].entry.Type == "TABLE" || blocks[j].entry.Type == "FOREIGN TABLE") {
+				table := blocks[b.parent].entry
+				fkDrops = append(fkDrops, fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s;", table.qualified(table.Name), quoteIdentifier(b.name)))
+				keep[i] = true
+				break
+			}
+		}
+	}
+	attach()
+	return keep, append(fkDrops, drops...), nil
+}
+
+// writeKeptEntries writes the entries of a dump keep marks in order, and the
+// top-level SET statements of the others, since later entries may rely on them
+func writeKeptEntries(b *strings.Builder, blocks []*dumpBlock, keep []bool, order []int) {
+	for _, i := range order {
+		block := blocks[i]
+		if keep[i] {
+			b.WriteString(block.object.Text)
+			continue
+		}
+		for _, line := range strings.Split(block.body(), "\n") {
+			if strings.HasPrefix(line, "SET ") {
+				b.WriteString(line + "\n\n")
+			}
+		}
+	}
+}
+
+// schemaDependents lists the objects outside schema that dropping it with
+// CASCADE would take along
+func schemaDependents(dest *DatabaseConfig, schema string) ([]string, error) {
+	db, err := openDatabase(dest, dest.Database)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(runContext(), schemaDependentsQuery, schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dependents []string
+	for rows.Next() {
+		var object string
+		if err := rows.Scan(&object); err != nil {
+			return nil, err
+		}
+		dependents = append(dependents, object)
+	}
+	return dependents, rows.Err()
+}
+
+// scriptIncludesData reports whether a pg_dump script has table data, by the
+// "Data for Name" comments pg_dump writes before each TABLE DATA entry. It
+// reads the script line by line since data backups can be large.
+func scriptIncludesData(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "-- Data for Name: ") {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// planRollback works out what restoring a backup on dest does: without
+// scopes the database is dropped, created again and restored whole; with
+// them only their tables and schemas are, on the live database and in one
+// transaction. The script psql will run is kept in the output directory.
+// Directory dumps are turned into a script with pg_restore first.
+func planRollback(dest *DatabaseConfig, backup string, only []string, scopes []restoreScope, options *MigrationOptions, state *RunState) (*RollbackPlan, error) {
+	script, err := dumpScriptFor(dest, backup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the backup: %v", err)
+	}
+	includesData, err := scriptIncludesData(script)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the backup: %v", err)
+	}
+	described, err := describeBackup(backup, includesData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the backup: %v", err)
+	}
+
+	if err := refreshCredentials(dest); err != nil {
+		return nil, err
+	}
+	oid, err := databaseOID(dest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up database %s: %v", dest.Database, err)
+	}
+
+	plan := &RollbackPlan{
+		CreatedAt:   time.Now(),
+		Backup:      described,
+		Destination: *manifestDatabase(dest),
+		DatabaseOID: oid,
+		Only:        only,
+	}
+	if len(scopes) == 0 {
+		plan.DropDatabase = true
+		plan.CreateDatabase = &options.CreateDB
+		plan.Script = script
+		if script != backup {
+			plan.Script = rollbackScriptPath(dest, options, state)
+			if err := copyRollbackScript(script, plan.Script); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if err := planPartialScript(dest, script, scopes, plan, options, state); err != nil {
+			return nil, err
+		}
+	}
+
+	if plan.ScriptSHA256, err = fileChecksum(plan.Script); err != nil {
+		return nil, err
+	}
+	plan.Commands = rollbackCommands(dest, plan)
+	return plan, nil
+}
+
+// planPartialScript writes the script restoring the tables and schemas of
+// scopes from a backup script, and records what it drops and restores
+func planPartialScript(dest *DatabaseConfig, script string, scopes []restoreScope, plan *RollbackPlan, options *MigrationOptions, state *RunState) error {
+	dump, err := dumpparse.ParseFile(script)
+	if err != nil {
+		return fmt.Errorf("failed to read the backup: %v", err)
+	}
+	blocks := dumpBlocks(dump)
+	keep, drops, err := planPartialRestore(blocks, scopes)
+	if err != nil {
+		return err
+	}
+
+	plan.Dropped = drops
+	plan.Objects = []string{}
+	for i, b := range blocks {
+		if keep[i] {
+			plan.Objects = append(plan.Objects, b.entry.String())
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(dump.Head)
+	b.WriteString("\n")
+	for _, statement := range drops {
+		b.WriteString(statement + "\n")
+	}
+	b.WriteString("\n")
+	writeKeptEntries(&b, blocks, keep, dependencyOrder(blocks, keep))
+
+	plan.Script = rollbackScriptPath(dest, options, state)
+	return writeRollbackScript(plan.Script, b.String())
+}
+
+// executeRollbackPlan runs a plan against dest once it is checked to still
+// hold. A dry run stops after the checks.
+func executeRollbackPlan(dest *DatabaseConfig, plan *RollbackPlan, options *MigrationOptions, state *RunState) error {
+	if err := refreshCredentials(dest); err != nil {
+		return err
+	}
+	if err := checkRollbackPlan(dest, plan); err != nil {
+		return fmt.Errorf("the plan no longer holds: %v", err)
+	}
+
+	if !plan.DropDatabase {
+		report := &PartialRestoreReport{Backup: plan.Backup.Path, Dropped: plan.Dropped, Objects: plan.Objects}
+		for _, value := range plan.Only {
+			scope, err := parseRestoreScope(value)
+			if err != nil {
+				return fmt.Errorf("--only %q of the plan: %v", value, err)
+			}
+			report.Only = append(report.Only, scope.String())
+			if scope.kind != "schema" {
+				continue
+			}
+			dependents, err := schemaDependents(dest, scope.schema)
+			if err != nil {
+				return fmt.Errorf("failed to check what depends on schema %s: %v", scope.schema, err)
+			}
+			if len(dependents) > 0 {
+				return fmt.Errorf("objects outside schema %s depend on it and would be dropped with it: %s", scope.schema, strings.Join(dependents, ", "))
+			}
+		}
+		state.PartialRestore = report
+	}
+
+	if options.DryRun {
+		logger.Info("DRY RUN MODE - nothing was restored")
+		return nil
+	}
+
+	if plan.DropDatabase {
+		err := state.phase("drop", func() error {
+			if err := dropDatabaseIfExists(dest); err != nil {
+				return err
+			}
+			return createDatabase(dest, plan.CreateDatabase)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return state.phase("restore", func() error {
+		if err := refreshCredentials(dest); err != nil {
+			return err
+		}
+		committed, err := runSingleTransaction(dest, plan.Script, state)
+		switch {
+		case err == nil || committed:
+			return err
+		case plan.DropDatabase:
+			return fmt.Errorf("psql failed, database %s is left empty: %v", dest.Database, err)
+		default:
+			return fmt.Errorf("psql failed, nothing was changed: %v", err)
+		}
+	})
+}
+
+func newRollbackCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rollback [<backup>]",
+		Short: "Restore the destination, or single tables or schemas of it, from a backup",
+		Long: "Restore the destination from a backup taken by a migration: the database is dropped, created again and " +
+			"restored whole. A backup uploaded with --output-dir or --backup-upload is given by its s3://, gs:// or az:// URI. With --only just the tables and schemas named are restored, on the live destination and in " +
+			"one transaction: they are dropped and created again from the backup with their constraints, indexes, " +
+			"triggers, owned sequences and, in data backups, their rows. The rest of the database is left alone. " +
+			"Every run writes what it does to rollback_plan.json in the output directory; --dry-run stops there, and " +
+			"--plan runs a reviewed plan as it is, refusing when the backup or the database changed since.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: runRollback,
+	}
+
+	cmd.Flags().StringArrayP("only", "", nil, "What to restore: table:schema.name or schema:name (repeatable)")
+	cmd.Flags().StringP("plan", "", "", "Run the rollback_plan.json of an earlier rollback instead of planning again")
+	return cmd
+}
+
+func runRollback(cmd *cobra.Command, args []string) error {
+	if err := configureCIOutput(cmd); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	logger.Info("Starting rollback...")
+	handleSignals()
+
+	only, _ := cmd.Flags().GetStringArray("only")
+	planPath, _ := cmd.Flags().GetString("plan")
+	var plan *RollbackPlan
+	var backup string
+	if planPath != "" {
+		var err error
+		if plan, err = readRollbackPlan(planPath); err != nil {
+			return exitWith(exitOptionError, fmt.Errorf("Failed to read the plan: %v", err))
+		}
+		if len(only) > 0 {
+			return exitWith(exitOptionError, errors.New("--only can't be combined with --plan; the plan says what is restored"))
+		}
+		if len(args) == 1 && !sameArgument(args[0], plan.Backup.Path) {
+			return exitWith(exitOptionError, fmt.Errorf("The plan restores %s, not %s", plan.Backup.Path, args[0]))
+		}
+		backup = plan.Backup.Path
+	} else {
+		if len(args) == 0 {
+			return exitWith(exitOptionError, errors.New("Give the backup to restore, or --plan"))
+		}
+		backup = args[0]
+		if isStorageURI(backup) {
+			var err error
+			if backup, err = fetchArtifact(backup); err != nil {
+				return exitWith(exitOptionError, fmt.Errorf("Backup not accessible: %v", err))
+			}
+		}
+	}
+	if _, err := os.Stat(backup); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Backup not accessible: %v", err))
+	}
+	var scopes []restoreScope
+	for _, value := range only {
+		scope, err := parseRestoreScope(value)
+		if err != nil {
+			return exitWith(exitOptionError, fmt.Errorf("--only %q: %v", value, err))
+		}
+		scopes = append(scopes, scope)
+	}
+
+	options, err := parseMigrationOptions(cmd)
+	if err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Failed to parse options: %v", err))
+	}
+
+	if destDB, _ := cmd.Flags().GetString("dest-db"); destDB == "" {
+		return exitWith(exitOptionError, errors.New("--dest-db is required for rollback"))
+	}
+	if err := validateConnectionFlags(cmd, false, true); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	state, err := beginRun(cmd, options)
+	if err != nil {
+		return err
+	}
+	state.BackupFile = backup
+
+	destConfig, err := getDestConfig(cmd, "")
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Failed to get destination config: %v", err))
+	}
+	if err := protectProduction(nil, destConfig, options); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+	if err := checkBlackout(options, state, time.Now()); err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Refusing to run: %v", err))
+	}
+	state.Dest = destConfig
+
+	if err := startTunnels(&options.SSH, destConfig); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("SSH tunnel setup failed: %v", err))
+	}
+	if err := validateDestinationConnection(destConfig); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Connection validation failed: %v", err))
+	}
+
+	if useKeyring, _ := cmd.Flags().GetBool("use-keyring"); useKeyring {
+		rememberPasswords(destConfig)
+	}
+
+	if plan == nil {
+		plan, err = planRollback(destConfig, backup, only, scopes, options, state)
+		if err != nil {
+			return exitWith(exitFailure, fmt.Errorf("Rollback failed: %v", err))
+		}
+		if planPath, err = writeRollbackPlan(plan, options); err != nil {
+			return exitWith(exitFailure, fmt.Errorf("Failed to write the rollback plan: %v", err))
+		}
+		logger.Info(fmt.Sprintf("Rollback plan written to: %s", planPath))
+	}
+	state.RollbackPlanFile = planPath
+	logRollbackPlan(plan)
+
+	if err := executeRollbackPlan(destConfig, plan, options, state); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Rollback failed: %v", err))
+	}
+
+	if err := finishRun(state, options); err != nil {
+		return err
+	}
+	if options.DryRun {
+		logger.Success(fmt.Sprintf("Rollback plan checked; run it with 'rollback --plan %s'", planPath))
+		return nil
+	}
+	logger.Success("Rollback completed successfully!")
+	return nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// rollbackPlanFile is the name of the plan rollback writes to the output directory
+const rollbackPlanFile = "rollback_plan.json"
+
+// RollbackBackup identifies the backup a rollback restores
+type RollbackBackup struct {
+	Path         string     `json:"path"`
+	SHA256       string     `json:"sha256"` // Of the file, or of every file of a directory dump
+	Size         int64      `json:"size"`
+	ModifiedAt   time.Time  `json:"modified_at"`
+	GeneratedAt  *time.Time `json:"generated_at,omitempty"` // From the header of the backup, when it has one
+	IncludesData bool       `json:"includes_data"`
+}
+
+// RollbackPlan is what a rollback does, written to rollback_plan.json for
+// review. rollback --plan runs it as it is, after checking that the backup,
+// the script and the destination database are still the ones planned for.
+type RollbackPlan struct {
+	CreatedAt   time.Time        `json:"created_at"`
+	Backup      RollbackBackup   `json:"backup"`
+	Destination ManifestDatabase `json:"destination"`
+	DatabaseOID uint32           `json:"database_oid"` // Of the destination database when planned, 0 if it did not exist
+
+	DropDatabase   bool                   `json:"drop_database"` // A full rollback: the database is dropped and created again
+	CreateDatabase *CreateDatabaseOptions `json:"create_database,omitempty"`
+
+	Only    []string `json:"only,omitempty"`    // --only of a partial rollback, as given
+	Dropped []string `json:"dropped,omitempty"` // Statements the script runs before the entries of the backup
+	Objects []string `json:"objects,omitempty"` // Entries of the backup the script restores
+
+	Script       string   `json:"script"` // What psql runs: the backup itself, or a script made from it
+	ScriptSHA256 string   `json:"script_sha256"`
+	Commands     []string `json:"commands"` // Everything run against the destination, in order
+}
+
+// backupFingerprint returns the checksum and size of a backup. A directory
+// dump is summed over the names and contents of all its files, so changing
+// any of them shows.
+func backupFingerprint(path string) (string, int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", 0, err
+	}
+	if !info.IsDir() {
+		sum, err := fileChecksum(path)
+		return sum, info.Size(), err
+	}
+
+	hash := sha256.New()
+	var size int64
+	err = filepath.WalkDir(path, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(path, name)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		fmt.Fprintf(hash, "%s\x00", filepath.ToSlash(rel))
+		n, err := io.Copy(hash, file)
+		size += n
+		return err
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// databaseOID returns the OID of the database of config, 0 when there is none.
+// A database renamed or dropped and created again gets through a name check
+// but not this one.
+func databaseOID(config *DatabaseConfig) (uint32, error) {
+	db, err := openDatabase(config, "postgres")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var oid uint32
+	err = db.QueryRowContext(runContext(), `SELECT oid FROM pg_database WHERE datname = $1`, config.Database).Scan(&oid)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return oid, err
+}
+
+// rollbackArgs returns the psql arguments running a rollback script: in one
+// transaction, stopping at the first error
+func rollbackArgs(dest *DatabaseConfig, script string) []string {
+	return append(applySchemaArgs(dest, script), "-v", "ON_ERROR_STOP=1", "--single-transaction")
+}
+
+// writeRollbackPlan writes plan to the output directory
+func writeRollbackPlan(plan *RollbackPlan, options *MigrationOptions) (string, error) {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(options.OutputDir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(options.OutputDir, rollbackPlanFile)
+	return path, os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// readRollbackPlan reads a plan written by an earlier rollback
+func readRollbackPlan(path string) (*RollbackPlan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plan := &RollbackPlan{}
+	if err := json.Unmarshal(data, plan); err != nil {
+		return nil, fmt.Errorf("%s is not a rollback plan: %v", path, err)
+	}
+	if plan.Backup.Path == "" || plan.Script == "" || plan.Destination.Database == "" {
+		return nil, fmt.Errorf("%s is not a rollback plan: backup, script or destination missing", path)
+	}
+	return plan, nil
+}
+
+// checkRollbackPlan compares a plan with what is there now. Any difference
+// means the plan that was reviewed is not the one that would run.
+func checkRollbackPlan(dest *DatabaseConfig, plan *RollbackPlan) error {
+	current := manifestDatabase(dest)
+	planned := plan.Destination
+	if current.Host != planned.Host || current.Port != planned.Port || current.Database != planned.Database {
+		return fmt.Errorf("the plan is for %s:%s/%s, not %s:%s/%s", planned.Host, planned.Port, planned.Database, current.Host, current.Port, current.Database)
+	}
+
+	sum, size, err := backupFingerprint(plan.Backup.Path)
+	if err != nil {
+		return fmt.Errorf("the backup of the plan is not accessible: %v", err)
+	}
+	if sum != plan.Backup.SHA256 || size != plan.Backup.Size {
+		return fmt.Errorf("the backup %s changed since the plan was made (sha256 %s, %d bytes; planned %s, %d bytes)", plan.Backup.Path, sum, size, plan.Backup.SHA256, plan.Backup.Size)
+	}
+	if plan.Script != plan.Backup.Path {
+		sum, err := fileChecksum(plan.Script)
+		if err != nil {
+			return fmt.Errorf("the script of the plan is not accessible: %v", err)
+		}
+		if sum != plan.ScriptSHA256 {
+			return fmt.Errorf("the script %s changed since the plan was made", plan.Script)
+		}
+	}
+
+	oid, err := databaseOID(dest)
+	if err != nil {
+		return fmt.Errorf("failed to look up database %s: %v", dest.Database, err)
+	}
+	switch {
+	case oid == plan.DatabaseOID:
+	case oid == 0:
+		return fmt.Errorf("database %s no longer exists; it was renamed or dropped since the plan was made", dest.Database)
+	case plan.DatabaseOID == 0:
+		return fmt.Errorf("database %s did not exist when the plan was made", dest.Database)
+	default:
+		return fmt.Errorf("database %s is not the one the plan was made for (oid %d, planned %d); it was renamed or created again since", dest.Database, oid, plan.DatabaseOID)
+	}
+	return nil
+}
+
+// logRollbackPlan shows what a plan restores, drops and runs
+func logRollbackPlan(plan *RollbackPlan) {
+	backup := plan.Backup
+	logger.Info(fmt.Sprintf("Backup: %s", backup.Path))
+	logger.Info(fmt.Sprintf("   sha256 %s, %s, modified %s", backup.SHA256, formatBytes(backup.Size), backup.ModifiedAt.Format(time.RFC3339)))
+	if backup.GeneratedAt != nil {
+		logger.Info(fmt.Sprintf("   taken %s", backup.GeneratedAt.Format(time.RFC3339)))
+	}
+	if backup.IncludesData {
+		logger.Info("   includes data")
+	} else {
+		logger.Info("   schema only: restored tables will be empty")
+	}
+
+	dest := plan.Destination
+	if plan.DropDatabase {
+		if plan.DatabaseOID != 0 {
+			logger.Info(fmt.Sprintf("Database dropped: %s on %s:%s (oid %d)", dest.Database, dest.Host, dest.Port, plan.DatabaseOID))
+		} else {
+			logger.Info(fmt.Sprintf("Database %s does not exist on %s:%s, nothing is dropped", dest.Database, dest.Host, dest.Port))
+		}
+	} else {
+		logger.Info(fmt.Sprintf("Dropping on '%s' first:", dest.Database))
+		for _, statement := range plan.Dropped {
+			logger.Info("   " + statement)
+		}
+		logger.Info(fmt.Sprintf("Then restoring %d entries of the backup:", len(plan.Objects)))
+		for _, object := range plan.Objects {
+			logger.Info("   " + object)
+		}
+	}
+	logger.Info("Commands:")
+	for _, command := range plan.Commands {
+		logger.Info("   " + command)
+	}
+}
+
+// rollbackScriptPath is where the script of a rollback of dest is kept
+func rollbackScriptPath(dest *DatabaseConfig, options *MigrationOptions, state *RunState) string {
+	return filepath.Join(options.OutputDir, fmt.Sprintf("rollback_%s_%s.sql", dest.Database, state.Timestamp()))
+}
+
+// writeRollbackScript writes the script of a rollback to the output directory
+func writeRollbackScript(path, script string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(script), 0644)
+}
+
+// copyRollbackScript keeps the script pg_restore made from a directory or
+// archive backup, which lives in a temporary directory, next to the plan
+func copyRollbackScript(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// describeBackup fills in the backup part of a plan
+func describeBackup(backup string, includesData bool) (RollbackBackup, error) {
+	info, err := os.Stat(backup)
+	if err != nil {
+		return RollbackBackup{}, err
+	}
+	sum, size, err := backupFingerprint(backup)
+	if err != nil {
+		return RollbackBackup{}, err
+	}
+	described := RollbackBackup{Path: backup, SHA256: sum, Size: size, ModifiedAt: info.ModTime(), IncludesData: includesData}
+	if !info.IsDir() {
+		if header, err := readFileHeader(backup); err == nil && header != nil && !header.GeneratedAt.IsZero() {
+			described.GeneratedAt = &header.GeneratedAt
+		}
+	}
+	return described, nil
+}
+
+// rollbackCommands lists what a plan runs against dest
+func rollbackCommands(dest *DatabaseConfig, plan *RollbackPlan) []string {
+	var commands []string
+	if plan.DropDatabase {
+		if plan.DatabaseOID != 0 {
+			commands = append(commands, dropDatabaseStatement(dest.Database)+";")
+		}
+		commands = append(commands, buildCreateDatabaseStatement(dest.Database, plan.CreateDatabase)+";")
+	}
+	psql := clientCommand(dest, "psql", rollbackArgs(dest, plan.Script), plan.Script)
+	return append(commands, commandLine(psql))
+}
+
+// sameArgument reports whether a backup given on the command line is the one
+// of the plan, allowing for a different spelling of the same path
+func sameArgument(given, planned string) bool {
+	if given == planned {
+		return true
+	}
+	a, errA := filepath.Abs(given)
+	b, errB := filepath.Abs(planned)
+	return errA == nil && errB == nil && a == b
+}
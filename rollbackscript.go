@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// rollbackScriptTemplate is the rollback script written next to the backup.
+// Every value is shell-quoted with shell, and comment keeps a value on its
+// comment line.
+var rollbackScriptTemplate = template.Must(template.New("rollback").Funcs(template.FuncMap{
+	"shell":   shellQuote,
+	"comment": commentText,
+}).Parse(`{{define "conn"}}-h {{shell .Host}} -p {{shell .Port}} -U {{shell .Username}}{{end -}}
+#!/bin/bash
+# Rollback script generated by pg-schema-migrate
+# Created: {{.Created}}
+# Database: {{comment .Username}}@{{comment .Host}}:{{comment .Port}}/{{comment .Database}}
+
+echo "WARNING: This will restore the database to its previous state!"
+echo "This will DROP the current database and restore from backup."
+read -p "Are you sure you want to continue? (yes/no): " confirm
+
+if [ "$confirm" = "yes" ]; then
+    echo "Starting rollback..."
+
+    # Set password (you'll need to enter it)
+    export PGPASSWORD=""
+    export PGSSLMODE={{shell .SSLMode}}
+{{- if .TunnelTarget}}
+    # NOTE: the migration reached {{comment .TunnelTarget}} through an SSH tunnel via {{comment .SSH}};
+    # re-open it on local port {{comment .Port}} before running this script.
+{{- end}}
+{{- range .Env}}
+    export {{.Name}}={{shell .Value}}
+{{- end}}
+
+    # Drop current database
+    echo "Dropping current database..."
+    psql {{template "conn" .}} -d postgres -c {{shell .DropSQL}}
+
+    # Create database
+    echo "Creating database..."
+    psql {{template "conn" .}} -d postgres -c {{shell .CreateSQL}}
+
+    # Restore from backup
+    echo "Restoring from backup..."
+    psql {{template "conn" .}} -d {{shell .DBName}} -f {{shell .BackupFile}}
+
+    echo "Rollback completed!"
+else
+    echo "Rollback cancelled."
+fi
+`))
+
+// rollbackScriptData is what the rollback script is rendered from
+type rollbackScriptData struct {
+	Created  string
+	Username string
+	Host     string
+	Port     string
+	Database string
+	SSLMode  string
+
+	TunnelTarget string // Where the migration's SSH tunnel led, to be re-opened by hand
+	SSH          string
+
+	Env []rollbackEnv // Role and SSL settings the migration used
+
+	DropSQL    string
+	CreateSQL  string
+	DBName     string // -d of the restore
+	BackupFile string
+}
+
+// rollbackEnv is a libpq environment variable the rollback script exports
+type rollbackEnv struct {
+	Name  string
+	Value string
+}
+
+// newRollbackScriptData fills the rollback script for config and its backup.
+// The database name is quoted as an SQL identifier too, so mixed case and
+// spaces survive.
+func newRollbackScriptData(config *DatabaseConfig, backupFile, created string) *rollbackScriptData {
+	data := &rollbackScriptData{
+		Created:      created,
+		Username:     config.Username,
+		Host:         config.Host,
+		Port:         config.Port,
+		Database:     config.Database,
+		SSLMode:      config.SSLMode,
+		TunnelTarget: config.TunnelTarget,
+		SSH:          config.SSH,
+		DropSQL:      fmt.Sprintf("DROP DATABASE IF EXISTS %s;", quoteIdentifier(config.Database)),
+		CreateSQL:    fmt.Sprintf("CREATE DATABASE %s;", quoteIdentifier(config.Database)),
+		DBName:       dbnameArg(config.Database),
+		BackupFile:   backupFile,
+	}
+
+	pgOptions := config.Options
+	if config.Role != "" {
+		pgOptions = strings.TrimSpace(pgOptions + " -c role=" + strings.ReplaceAll(config.Role, " ", `\ `))
+	}
+	for _, env := range []rollbackEnv{
+		{"PGOPTIONS", pgOptions},
+		{"PGSSLROOTCERT", config.SSLRootCert},
+		{"PGSSLCERT", config.SSLCert},
+		{"PGSSLKEY", config.SSLKey},
+		{"PGSSLMINPROTOCOLVERSION", config.SSLMinProtocol},
+		{"PGCHANNELBINDING", config.ChannelBinding},
+		{"PGGSSENCMODE", config.GSSEncMode},
+	} {
+		if env.Value != "" {
+			data.Env = append(data.Env, env)
+		}
+	}
+	return data
+}
+
+// render writes out the rollback script
+func (d *rollbackScriptData) render() (string, error) {
+	var b bytes.Buffer
+	if err := rollbackScriptTemplate.Execute(&b, d); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// commands are the arguments the psql lines of the script must pass, in order
+func (d *rollbackScriptData) commands() [][]string {
+	conn := []string{"-h", d.Host, "-p", d.Port, "-U", d.Username}
+	return [][]string{
+		append(slices.Clone(conn), "-d", "postgres", "-c", d.DropSQL),
+		append(slices.Clone(conn), "-d", "postgres", "-c", d.CreateSQL),
+		append(slices.Clone(conn), "-d", d.DBName, "-f", d.BackupFile),
+	}
+}
+
+// files are the files the script reads when it runs
+func (d *rollbackScriptData) files() []string {
+	files := []string{d.BackupFile}
+	for _, env := range d.Env {
+		if env.Name == "PGSSLROOTCERT" || env.Name == "PGSSLCERT" || env.Name == "PGSSLKEY" {
+			files = append(files, env.Value)
+		}
+	}
+	return files
+}
+
+// commentText keeps a value on one line of a shell comment
+func commentText(value string) string {
+	return strings.NewReplacer("\r", `\r`, "\n", `\n`).Replace(value)
+}
+
+// checkRollbackScript checks a rendered rollback script before the night it is
+// needed, without running any of it: bash -n must parse it when bash is
+// installed, no placeholder may be left unfilled, the files it reads must
+// exist, and each psql and export line must hand over exactly the values it
+// was rendered from, whatever quotes, spaces or dollar signs they hold, with
+// nothing the shell would expand or run. It returns the problems found.
+func checkRollbackScript(script string, data *rollbackScriptData) []string {
+	var problems []string
+	bash, _ := exec.LookPath("bash")
+
+	for i, line := range strings.Split(script, "\n") {
+		if strings.Contains(line, "<no value>") || strings.Contains(line, "%!") {
+			problems = append(problems, fmt.Sprintf("line %d has an unfilled placeholder: %s", i+1, strings.TrimSpace(line)))
+		}
+	}
+	if bash != "" {
+		cmd := exec.Command(bash, "-n")
+		cmd.Stdin = strings.NewReader(script)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			problems = append(problems, fmt.Sprintf("bash -n: %s", valueOr(strings.TrimSpace(string(out)), err.Error())))
+		}
+	}
+
+	for _, file := range data.files() {
+		if _, err := os.Stat(file); err != nil {
+			problems = append(problems, fmt.Sprintf("it reads %s: %v", file, err))
+		}
+	}
+
+	commands, exported, err := parseRollbackScript(script)
+	if err != nil {
+		return append(problems, fmt.Sprintf("failed to evaluate it: %v", err))
+	}
+
+	want := data.commands()
+	if len(commands) != len(want) {
+		return append(problems, fmt.Sprintf("it runs psql %d time(s), expected %d", len(commands), len(want)))
+	}
+	for i, got := range commands {
+		if !slices.Equal(got, want[i]) {
+			problems = append(problems, fmt.Sprintf("psql command %d passes %q, expected %q", i+1, got, want[i]))
+		}
+	}
+	for _, env := range append([]rollbackEnv{{"PGSSLMODE", data.SSLMode}}, data.Env...) {
+		if got, ok := exported[env.Name]; !ok || got != env.Value {
+			problems = append(problems, fmt.Sprintf("it exports %s=%q, expected %q", env.Name, got, env.Value))
+		}
+	}
+	return problems
+}
+
+// errRollbackScriptInvalid fails a CI run whose rollback script doesn't pass
+// checkRollbackScript
+var errRollbackScriptInvalid = errors.New("invalid rollback script")
+
+// parseRollbackScript reads the psql calls and exports of the script with
+// shellWords. A quoted value may span lines. A psql or export line the shell
+// would expand or run anything in is an error.
+func parseRollbackScript(script string) ([][]string, map[string]string, error) {
+	var commands [][]string
+	exported := make(map[string]string)
+	pending := ""
+	for _, line := range strings.Split(script, "\n") {
+		if pending != "" {
+			line = pending + "\n" + line
+		}
+		words, err := shellWords(strings.TrimSpace(line))
+		if err == errUnterminatedQuote {
+			pending = line
+			continue
+		}
+		pending = ""
+		if err == errShellExpansion && len(words) > 0 && (words[0] == "psql" || words[0] == "export") {
+			return nil, nil, fmt.Errorf("%s line %w: %s", words[0], err, strings.TrimSpace(line))
+		}
+		if err != nil && err != errShellExpansion {
+			return nil, nil, err
+		}
+		switch {
+		case len(words) > 0 && words[0] == "psql":
+			commands = append(commands, words[1:])
+		case len(words) == 2 && words[0] == "export":
+			name, value, _ := strings.Cut(words[1], "=")
+			exported[name] = value
+		}
+	}
+	if pending != "" {
+		return nil, nil, errUnterminatedQuote
+	}
+	return commands, exported, nil
+}
+
+var (
+	errUnterminatedQuote = errors.New("unterminated quote")
+	errShellExpansion    = errors.New("has text the shell would expand or run")
+)
+
+// shellWords splits a line into words as the shell does with the quoting
+// shellQuote uses: single quotes, double quotes and backslashes. Nothing is
+// expanded, and a comment is one word. A $ or backquote outside single quotes
+// or an unquoted operator such as ; or | makes it return the words with
+// errShellExpansion, since the shell would not pass them on as written.
+func shellWords(line string) ([]string, error) {
+	if strings.HasPrefix(line, "#") {
+		return []string{line}, nil
+	}
+	var words []string
+	var word strings.Builder
+	inWord, expands := false, false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errUnterminatedQuote
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("\"\\$`", line[i+1]) >= 0 {
+					i++
+				} else if line[i] == '$' || line[i] == '`' {
+					expands = true
+				}
+				word.WriteByte(line[i])
+			}
+			if i == len(line) {
+				return nil, errUnterminatedQuote
+			}
+			inWord = true
+		case c == '\\':
+			if i+1 == len(line) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			word.WriteByte(line[i])
+			inWord = true
+		default:
+			expands = expands || strings.IndexByte("$`;&|<>(){}*?[~", c) >= 0
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	if expands {
+		return words, errShellExpansion
+	}
+	return words, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRollbackScriptQuoting(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"plain",
+		"My Database",
+		"it's",
+		`say "hi"`,
+		"price$1",
+		"$(touch pwned)",
+		"`touch pwned`",
+		`back\slash`,
+		"semi;colon | pipe",
+		"two\nlines",
+	} {
+		t.Run(name, func(t *testing.T) {
+			backup := filepath.Join(dir, "backup of "+strings.ReplaceAll(name, "/", "_")+".sql")
+			if err := os.WriteFile(backup, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			config := &DatabaseConfig{
+				Host:     "db " + name,
+				Port:     "5432",
+				Username: "user " + name,
+				Database: name,
+				SSLMode:  "require",
+				Role:     "role " + name,
+			}
+			data := newRollbackScriptData(config, backup, "2026-01-02 03:04:05")
+			script, err := data.render()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if problems := checkRollbackScript(script, data); len(problems) > 0 {
+				t.Fatalf("problems with a correctly quoted script:\n%s\n%s", strings.Join(problems, "\n"), script)
+			}
+
+			commands, exported, err := parseRollbackScript(script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(commands) != 3 || commands[2][len(commands[2])-1] != backup {
+				t.Fatalf("unexpected psql commands %q", commands)
+			}
+			if !slices.Contains(commands[0], `DROP DATABASE IF EXISTS `+quoteIdentifier(name)+`;`) {
+				t.Errorf("drop statement not passed as one argument: %q", commands[0])
+			}
+			if exported["PGSSLMODE"] != "require" {
+				t.Errorf("PGSSLMODE exported as %q", exported["PGSSLMODE"])
+			}
+			if _, err := os.Stat(filepath.Join(dir, "pwned")); err == nil {
+				t.Fatal("checking the script ran a command from it")
+			}
+		})
+	}
+}
+
+func TestRollbackScriptCheckDoesNotRunIt(t *testing.T) {
+	dir := t.TempDir()
+	backup := filepath.Join(dir, "backup.sql")
+	if err := os.WriteFile(backup, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	marker := filepath.Join(dir, "ran")
+	data := newRollbackScriptData(&DatabaseConfig{Host: "localhost", Port: "5432", Username: "postgres", Database: "app", SSLMode: "prefer"}, backup, "now")
+	script, err := data.render()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A database name quoted the way a broken template would
+	broken := strings.Replace(script, "-d 'app'", `-d "app$(touch `+marker+`)"`, 1)
+	if broken == script {
+		t.Fatal("the restore line was not found in the script")
+	}
+	problems := checkRollbackScript(broken, data)
+	if len(problems) == 0 {
+		t.Fatal("no problems found in a script with a command substitution")
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Fatal("checking the script ran a command from it")
+	}
+}
+
+func TestRollbackScriptMissingFile(t *testing.T) {
+	data := newRollbackScriptData(&DatabaseConfig{Host: "localhost", Port: "5432", Username: "postgres", Database: "app", SSLMode: "prefer"}, filepath.Join(t.TempDir(), "missing.sql"), "now")
+	script, err := data.render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := checkRollbackScript(script, data)
+	if len(problems) != 1 || !strings.Contains(problems[0], "missing.sql") {
+		t.Fatalf("expected the missing backup to be reported, got %q", problems)
+	}
+}
+
+func TestShellWords(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    []string
+		expands bool
+	}{
+		{`psql -h 'my host' -c 'SELECT 1;'`, []string{"psql", "-h", "my host", "-c", "SELECT 1;"}, false},
+		{`export X='it'\''s'`, []string{"export", "X=it's"}, false},
+		{`a "b \"c\" \$d"`, []string{"a", `b "c" $d`}, false},
+		{`a\ b`, []string{"a b"}, false},
+		{`# a comment; $x`, []string{"# a comment; $x"}, false},
+		{`psql -d $DB`, []string{"psql", "-d", "$DB"}, true},
+		{`psql -d "$(id)"`, []string{"psql", "-d", "$(id)"}, true},
+		{"psql -d `id`", []string{"psql", "-d", "`id`"}, true},
+		{`psql -d a; rm -rf x`, []string{"psql", "-d", "a;", "rm", "-rf", "x"}, true},
+	}
+	for _, test := range tests {
+		words, err := shellWords(test.line)
+		if test.expands != (err == errShellExpansion) {
+			t.Errorf("shellWords(%q) error %v, expansion expected %v", test.line, err, test.expands)
+		}
+		if err != nil && err != errShellExpansion {
+			continue
+		}
+		if !slices.Equal(words, test.want) {
+			t.Errorf("shellWords(%q) = %q, want %q", test.line, words, test.want)
+		}
+	}
+
+	if _, err := shellWords(`a 'b`); err != errUnterminatedQuote {
+		t.Errorf("unterminated quote: got %v", err)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+)
+
+// PhaseTiming records how long one phase of a run took
+type PhaseTiming struct {
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+}
+
+// RunState collects what happened during a run so it can be reported once the
+// run finishes, whether it succeeded or not.
+type RunState struct {
+	Label     string
+	Mode      string // direct, bootstrap, export, apply or resume
+	Options   string // Command line flags, for the headers of generated files
+	StartedAt time.Time
+
+	Source *DatabaseConfig
+	Dest   *DatabaseConfig
+
+	Phases       []PhaseTiming
+	CurrentPhase string // Phase in progress, or the phase that failed
+	FailedPhase  string
+	Success      bool
+	Error        string // Why the run failed, when it returned an error
+
+	SchemaFile        string
+	SchemaHeader      *FileHeader // Header of a schema file generated by an earlier run
+	BackupFile        string
+	BackupActivity    *DatabaseActivity  // Destination statistics as the backup started
+	RunDir            string             // Directory of --artifact-name-template run-dir the artifacts went to
+	UploadTo          string             // Storage of --output-dir the files are uploaded to
+	backupTaken       bool               // The backup step ran in this run, possibly alongside the export
+	SourceReplica     *ReplicaExport     // Set when the export came from a standby
+	SkippedUnreadable []UnreadableObject // Tables left out of the export with --skip-unreadable
+	ObjectCounts      map[string]int     // Exported objects by pg_dump TOC type
+	TOCFile           string             // pg_restore --list of a directory dump
+	SplitDir          string             // One file per object of the export, with --split
+	Git               *GitReport         // Repository of --git, the export's changes and the commit made
+	Push              *PushReport        // Chunks push applied and the state file they are checkpointed in
+	TOC               []TOCEntry         // Its entries
+	Fingerprint       string             // Of the schema applied, as recorded in the migration marker
+
+	PreviousMigration *MigrationMarker // Marker the destination carried before the run
+
+	DestinationOnly []DatabaseObject // Destination objects the schema does not recreate
+
+	ReindexFile string // REINDEX statements for indexes on mismatched collations
+
+	BlackoutOverride string // Blackout window the run was started in with --override-blackout
+
+	Bootstrap *BootstrapReport // What --bootstrap found on the destination
+
+	DestinationPath string // How the destination was prepared: recreate, in-place or bootstrap
+
+	Replication *ReplicationReport // Logical replication the drop broke
+
+	DestinationName *DestinationName // How the destination name was made from --dest-db-template
+	DatabaseCase    *DatabaseCase    // The destination name differed from existing databases only in case
+
+	OutputLocations []OutputLocation // Where the output and backup are written, and how safe that is
+
+	StaleBackup *StaleBackupCheck // Writes to the destination between its backup and the drop
+
+	VerifyDiscrepancies []VerifyDiscrepancy // Constraints and triggers left in another state than on the source
+	VerifyFixFile       string              // Statements fixing VerifyDiscrepancies
+
+	SearchPathFindings []SearchPathFinding // Objects depending on the search_path at runtime
+	PinnedFunctions    []string            // Functions given a search_path by --pin-search-path
+
+	OwnershipSkipped     map[string]int // Ownership and privilege statements removed from the export, by kind
+	OwnershipSkippedFile string         // The statements removed, for applying manually
+
+	Unlogged *UnloggedReport // Unlogged tables of the export, and what --unlogged changed
+
+	Analyze *AnalyzeReport // Statistics refresh after a data load
+
+	Selection *SelectionReport // What --only and --skip left in the export
+
+	PartialRestore   *PartialRestoreReport // What rollback --only restored
+	RollbackPlanFile string                // The plan rollback ran, or checked in a dry run
+
+	Grants *GrantsSnapshot // Grants and settings of the destination saved before the drop
+
+	RoleHandling *RoleHandling // Resolved --roles, --privileges and --owners; nil for apply and resume
+
+	RolesFile  string            // Filtered roles dump made with --roles
+	RoleFilter *RoleFilterReport // What filtering removed from the roles dump
+
+	MissingRoles []string // Roles the schema needs that the destination lacks, to be created
+	SkippedRoles []string // Missing roles whose statements --missing-roles skip lets fail
+	CreatedRoles []string // Placeholder roles created on the destination
+
+	Warnings []Warning
+	Notices  []PsqlNotice // Server notices raised while applying the schema
+
+	ObjectTimings []ObjectTiming // How long each object of the schema took to apply
+
+	ApplyErrors     []PsqlError // The first statements that failed during the apply
+	ApplyErrorCount int         // All statements that failed, beyond those expected
+
+	CodeChanges []CodeDiff // Code objects --objects code found new or different on the destination
+
+	ConvergeFile    string           // Statements converge applied, or would apply
+	ConvergeChanges []ConvergeChange // What converge found different on the destination
+
+	NonTransactional []NonTransactionalStatement // Statements run after a single-transaction apply
+
+	SkippedSettings []string // Statements of the schema setting parameters the destination lacks
+
+	Resume     *ResumeState // Completed steps, for resuming an interrupted run
+	ResumePath string
+
+	OutputDir string       // Where earlier runs left their manifests
+	history   []*RunResult // Earlier runs, loaded for estimates
+
+	Timeouts      TimeoutOptions
+	TimedOutPhase string          // Phase that ran out of time
+	ctx           context.Context // Context of the phase in progress
+}
+
+func newRunState(label string) *RunState {
+	return &RunState{
+		Label:     label,
+		StartedAt: time.Now(),
+	}
+}
+
+// Timestamp is the run's start time as used in artifact names
+func (r *RunState) Timestamp() string {
+	return r.StartedAt.Format("20060102_150405")
+}
+
+// phase runs fn as the named phase, recording its duration. On error the
+// phase stays current so a failure of the run can be attributed to it. The
+// phase does not start once the run's time budget is used up, and its
+// subprocesses and queries are cut off when the budget or its own limit
+// runs out.
+func (r *RunState) phase(name string, fn func() error) error {
+	r.CurrentPhase = name
+	start := time.Now()
+	ctx, cancel, limit := r.phaseContext(r.context(), name, start)
+	defer cancel()
+	if ctx.Err() != nil {
+		return r.budgetExceeded(name, limit, nil)
+	}
+	prev := r.ctx
+	r.ctx = ctx
+	defer func() { r.ctx = prev }()
+
+	logger.StartGroup(name)
+	defer logger.EndGroup()
+
+	if estimate, basis := r.estimatePhase(name); estimate > 0 {
+		logger.Info(fmt.Sprintf("%s (%s)", name, basis))
+		done := make(chan struct{})
+		defer close(done)
+		go reportProgress(logger, name, start, estimate, done)
+	}
+
+	err := fn()
+	r.Phases = append(r.Phases, PhaseTiming{Name: name, Start: start, Duration: time.Since(start)})
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = r.budgetExceeded(name, limit, err)
+	}
+	if err == nil {
+		r.CurrentPhase = ""
+	}
+	return err
+}
+
+// concurrentPhase is one of the phases run by concurrentPhases
+type concurrentPhase struct {
+	name   string
+	config *DatabaseConfig // The database the phase works on
+	fn     func() error
+}
+
+// scopeOutput gives the database of a concurrent phase a logger tagged with
+// its name that also writes to <phase>_<db>_<timestamp>.log in the output
+// directory, and returns a function that restores the shared logger
+func (r *RunState) scopeOutput(p concurrentPhase) (string, func()) {
+	scoped := logger.WithField("db", p.config.Database).WithField("phase", p.name)
+	path := filepath.Join(r.OutputDir, fmt.Sprintf("%s_%s_%s.log", p.name, p.config.Database, r.Timestamp()))
+	file, err := os.Create(path)
+	if err != nil {
+		scoped.Warning(fmt.Sprintf("Could not create the %s log, logging to the console only: %v", p.name, err))
+		path = ""
+	} else {
+		scoped = scoped.WithFile(file)
+	}
+	p.config.log = scoped
+	return path, func() {
+		p.config.log = nil
+		if file != nil {
+			file.Close()
+		}
+	}
+}
+
+// concurrentPhases runs phases that use different servers at the same time,
+// at most limit at once, and returns the errors of all that failed. With a
+// limit below 2 they run one after another like phase. The phases share one
+// context: a phase that fails or runs out of time cancels the others, whose
+// resulting errors are left out. While they run, output about each database
+// is tagged with its name and copied to a log file of its own, and the
+// results are logged in order once all are done.
+func (r *RunState) concurrentPhases(limit int, phases ...concurrentPhase) error {
+	if limit < 2 || len(phases) < 2 {
+		for _, p := range phases {
+			if err := r.phase(p.name, p.fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	names := make([]string, len(phases))
+	estimates := make([]time.Duration, len(phases))
+	for i, p := range phases {
+		names[i] = p.name
+		var basis string
+		if estimates[i], basis = r.estimatePhase(p.name); estimates[i] > 0 {
+			logger.Info(fmt.Sprintf("%s (%s)", p.name, basis))
+		}
+	}
+	logger.Info(fmt.Sprintf("Running %s concurrently", strings.Join(names, " and ")))
+
+	groupCtx, cancel := context.WithCancel(r.context())
+	defer cancel()
+	prev := r.ctx
+	r.ctx = groupCtx
+	defer func() { r.ctx = prev }()
+	r.CurrentPhase = names[0]
+	start := time.Now()
+
+	logs := make([]string, len(phases))
+	for i, p := range phases {
+		var restore func()
+		logs[i], restore = r.scopeOutput(p)
+		defer restore()
+	}
+
+	var mu sync.Mutex
+	var failed []string
+	errs := make([]error, len(phases))
+	results := make([]string, len(phases))
+	var g errgroup.Group
+	g.SetLimit(limit)
+	for i, p := range phases {
+		g.Go(func() error {
+			phaseStart := time.Now()
+			ctx, cancelPhase, phaseLimit := r.phaseContext(groupCtx, p.name, phaseStart)
+			defer cancelPhase()
+			// The phase's own limit ending cancels the whole group
+			defer context.AfterFunc(ctx, cancel)()
+
+			var err error
+			ran := ctx.Err() == nil
+			if ran {
+				if estimates[i] > 0 {
+					done := make(chan struct{})
+					defer close(done)
+					go reportProgress(p.config.output(), p.name, phaseStart, estimates[i], done)
+				}
+				err = p.fn()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			duration := time.Since(phaseStart)
+			r.Phases = append(r.Phases, PhaseTiming{Name: p.name, Start: phaseStart, Duration: duration})
+			switch {
+			case ctx.Err() == context.DeadlineExceeded:
+				errs[i] = r.budgetExceeded(p.name, phaseLimit, err)
+			case (err != nil || !ran) && groupCtx.Err() != nil:
+				results[i] = "cancelled after another phase failed"
+				return nil
+			default:
+				errs[i] = err
+			}
+			if errs[i] != nil {
+				results[i] = fmt.Sprintf("failed after %s", duration.Round(time.Second))
+				failed = append(failed, p.name)
+				cancel()
+			} else {
+				results[i] = fmt.Sprintf("done in %s", duration.Round(time.Second))
+			}
+			return nil
+		})
+	}
+	g.Wait()
+
+	for i, p := range phases {
+		result := fmt.Sprintf("%s of %s: %s", p.name, p.config.Database, results[i])
+		if logs[i] != "" {
+			result += fmt.Sprintf(" (log: %s)", logs[i])
+		}
+		logger.Info(result)
+	}
+	if len(failed) > 0 {
+		r.CurrentPhase = failed[0]
+		return errors.Join(errs...)
+	}
+	r.CurrentPhase = ""
+
+	var total time.Duration
+	for _, p := range r.Phases[len(r.Phases)-len(phases):] {
+		total += p.Duration
+	}
+	wall := time.Since(start)
+	logger.Info(fmt.Sprintf("%s took %s together, %s less than one after another", strings.Join(names, " and "), wall.Round(time.Second), (total - wall).Round(time.Second)))
+	return nil
+}
+
+// fail marks the run as failed in its current phase
+func (r *RunState) fail() {
+	r.Success = false
+	r.FailedPhase = r.CurrentPhase
+	if r.FailedPhase == "" {
+		r.FailedPhase = "setup"
+	}
+}
+
+// beginRun creates the run state and registers the reports written when the
+// run ends, then sets up the client tools.
+func beginRun(cmd *cobra.Command, options *MigrationOptions) (*RunState, error) {
+	state := newRunState(options.RunLabel)
+	state.Mode = options.Mode
+	if options.Bootstrap {
+		state.Mode = "bootstrap"
+	}
+	state.Timeouts = options.Timeouts
+	state.OutputDir = options.OutputDir
+	if options.Staged != nil {
+		state.UploadTo = options.Staged.storage.String()
+	}
+	state.Options = commandOptions(cmd)
+	if cmd.HasParent() {
+		state.Mode = cmd.Name() // apply or resume
+	} else {
+		state.RoleHandling = &options.RoleHandling
+	}
+	currentRun = state
+
+	if options.Notify != nil {
+		logger.KeepTail(notifyLogLines)
+	}
+
+	// Registered first so it runs last, after any warnings from the reports
+	registerCleanup(func() { printWarningSummary(state) })
+
+	// Uploads run after the reports, so the manifest goes up too
+	if !options.PlanOnly && (options.Staged != nil || options.BackupUpload != nil) {
+		registerCleanup(func() { uploadArtifacts(state, options) })
+	}
+
+	// The manifest records every run except streamed exports
+	manifest := ""
+	if options.Output != "-" {
+		manifest = manifestPath(options, state)
+	}
+	registerCleanup(func() {
+		if !state.Success {
+			state.fail()
+		}
+		writeRunReports(state.Result(), options, manifest)
+	})
+
+	if err := configureClientTools(cmd); err != nil {
+		return nil, exitWith(exitOptionError, fmt.Errorf("Failed to set up client tools: %v", err))
+	}
+	return state, nil
+}
+
+// finishRun ends a successful run. With --fail-on-warning, warnings turn the
+// exit code into exitWarnings once all reports have been written.
+func finishRun(state *RunState, options *MigrationOptions) error {
+	state.Success = true
+	runCleanups()
+
+	if options.FailOnWarning && len(state.Warnings) > 0 {
+		return exitWith(exitWarnings, fmt.Errorf("Failing because of %d warning(s) (--fail-on-warning)", len(state.Warnings)))
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/spf13/cobra"
+)
+
+// Kinds of databases the tool leaves behind on purpose
+const (
+	ScratchKindOld      = "old"           // <db>_old_<timestamp>, a replaced database kept for rollback
+	ScratchKindValidate = "pgsm_validate" // <db>_pgsm_validate_<timestamp>, a throwaway export check
+)
+
+// scratchNamePattern matches the names of scratch databases: the database
+// they belong to, their kind and the timestamp of the run that made them
+var scratchNamePattern = regexp.MustCompile(`^(.+)_(old|pgsm_validate)_(\d{8}_\d{6})$`)
+
+// scratchCommentPrefix starts the database comment marking a scratch database.
+// A database is only ever cleaned up when both its name and this comment say
+// the tool made it.
+const scratchCommentPrefix = "pg-schema-migrate scratch database: "
+
+// ScratchMarker is the record the tool keeps in the comment of a scratch database
+type ScratchMarker struct {
+	Kind      string    `json:"kind"`
+	Database  string    `json:"database"` // The database it was made for
+	CreatedAt time.Time `json:"created_at"`
+	RunLabel  string    `json:"run_label,omitempty"`
+	Mode      string    `json:"mode,omitempty"` // Mode of the run that made it
+}
+
+// ScratchDatabase is a database found by the cleanup command
+type ScratchDatabase struct {
+	Name      string
+	SizeBytes int64
+	Marker    ScratchMarker
+}
+
+// scratchDatabaseName names the scratch database of kind for database and run
+func scratchDatabaseName(database, kind string, state *RunState) string {
+	return fmt.Sprintf("%s_%s_%s", database, kind, state.Timestamp())
+}
+
+// markScratchDatabase records in its comment that the tool made the scratch
+// database name, so the cleanup command can tell it from look-alikes
+func markScratchDatabase(db *sql.DB, name, kind, database string, state *RunState) error {
+	marker, err := json.Marshal(ScratchMarker{
+		Kind:      kind,
+		Database:  database,
+		CreatedAt: state.StartedAt.UTC(),
+		RunLabel:  state.Label,
+		Mode:      state.Mode,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(runContext(), fmt.Sprintf("COMMENT ON DATABASE %s IS %s",
+		quoteIdentifier(name), pq.QuoteLiteral(scratchCommentPrefix+string(marker))))
+	return err
+}
+
+// parseScratchMarker returns the marker of a scratch database, or false when
+// its name and comment don't both say the tool made it
+func parseScratchMarker(name, comment string) (ScratchMarker, bool) {
+	var marker ScratchMarker
+	m := scratchNamePattern.FindStringSubmatch(name)
+	if m == nil || !strings.HasPrefix(comment, scratchCommentPrefix) {
+		return marker, false
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(comment, scratchCommentPrefix)), &marker); err != nil {
+		return marker, false
+	}
+	if marker.Database != m[1] || marker.Kind != m[2] || marker.CreatedAt.IsZero() {
+		return marker, false
+	}
+	return marker, true
+}
+
+// listScratchDatabases lists the scratch databases of the tool on the server
+// of dest, oldest first. Databases whose name matches but whose comment
+// doesn't are reported with a debug line and otherwise left alone.
+func listScratchDatabases(dest *DatabaseConfig) ([]ScratchDatabase, error) {
+	db, err := openDatabase(dest, "postgres")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(runContext(), `
+		SELECT datname, COALESCE(shobj_description(oid, 'pg_database'), ''), pg_database_size(oid)
+		FROM pg_database
+		WHERE datname ~ '_(old|pgsm_validate)_[0-9]{8}_[0-9]{6}$'
+		ORDER BY datname`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []ScratchDatabase
+	for rows.Next() {
+		var scratch ScratchDatabase
+		var comment string
+		if err := rows.Scan(&scratch.Name, &comment, &scratch.SizeBytes); err != nil {
+			return nil, err
+		}
+		marker, ok := parseScratchMarker(scratch.Name, comment)
+		if !ok {
+			logger.Debug(fmt.Sprintf("Ignoring database %s: its name looks like a scratch database but it carries no pg-schema-migrate marker", scratch.Name))
+			continue
+		}
+		scratch.Marker = marker
+		found = append(found, scratch)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Marker.CreatedAt.Before(found[j].Marker.CreatedAt)
+	})
+	return found, nil
+}
+
+func newCleanupCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cleanup",
+		Short: "Drop old scratch databases the tool left on the destination server",
+		Long: "List the <db>_old_<timestamp> and <db>_pgsm_validate_<timestamp> databases on the destination server " +
+			"and drop those older than --older-than after confirmation. Only databases whose comment marks them as " +
+			"made by pg-schema-migrate are considered; look-alikes are never touched.",
+		Args: cobra.NoArgs,
+		RunE: runCleanup,
+	}
+
+	cmd.Flags().DurationP("older-than", "", 168*time.Hour, "Drop scratch databases made longer ago than this")
+	cmd.Flags().BoolP("yes", "y", false, "Drop without asking for confirmation")
+	return cmd
+}
+
+func runCleanup(cmd *cobra.Command, args []string) error {
+	if err := configureCIOutput(cmd); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	logger.Info("Looking for scratch databases...")
+	handleSignals()
+
+	olderThan, _ := cmd.Flags().GetDuration("older-than")
+	yes, _ := cmd.Flags().GetBool("yes")
+	dryRunLevel, _ := cmd.Flags().GetString("dry-run")
+	dryRun, _, err := parseDryRun(dryRunLevel)
+	if err != nil {
+		return exitWith(exitOptionError, err)
+	}
+	if olderThan < 0 {
+		return exitWith(exitOptionError, errors.New("--older-than must not be negative"))
+	}
+
+	// The command works on the server; --dest-db only picks the database to connect through
+	if destDB, _ := cmd.Flags().GetString("dest-db"); destDB == "" {
+		if err := cmd.Flags().Set("dest-db", "postgres"); err != nil {
+			return exitWith(exitFailure, err)
+		}
+	}
+	if err := validateConnectionFlags(cmd, false, true); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	options, err := parseMigrationOptions(cmd)
+	if err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Failed to parse options: %v", err))
+	}
+
+	destConfig, err := getDestConfig(cmd, "")
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Failed to get destination config: %v", err))
+	}
+	if err := startTunnels(&options.SSH, destConfig); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("SSH tunnel setup failed: %v", err))
+	}
+	if err := validateDestinationConnection(destConfig); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Connection validation failed: %v", err))
+	}
+
+	found, err := listScratchDatabases(destConfig)
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Failed to list databases: %v", err))
+	}
+	if len(found) == 0 {
+		logger.Success("No scratch databases found")
+		return nil
+	}
+
+	var expired []ScratchDatabase
+	var total int64
+	now := time.Now()
+	logger.Info(fmt.Sprintf("%d scratch database(s) on %s:", len(found), destConfig.Host))
+	for _, scratch := range found {
+		age := now.Sub(scratch.Marker.CreatedAt)
+		context := fmt.Sprintf("%s run", scratch.Marker.Mode)
+		if scratch.Marker.RunLabel != "" {
+			context += fmt.Sprintf(" %q", scratch.Marker.RunLabel)
+		}
+		status := "kept"
+		if age > olderThan {
+			status = "expired"
+			expired = append(expired, scratch)
+			total += scratch.SizeBytes
+		}
+		logger.Info(fmt.Sprintf("   %s: %s, %s of %s, made %s ago by a %s [%s]", scratch.Name, formatBytes(scratch.SizeBytes),
+			scratch.Marker.Kind, scratch.Marker.Database, age.Truncate(time.Minute), context, status))
+	}
+	if len(expired) == 0 {
+		logger.Success(fmt.Sprintf("No scratch databases older than %s", olderThan))
+		return nil
+	}
+
+	if dryRun {
+		logger.Info(fmt.Sprintf("DRY RUN MODE - would drop %d database(s), freeing about %s", len(expired), formatBytes(total)))
+		return nil
+	}
+	if !yes {
+		if !stdinIsTerminal() {
+			return exitWith(exitOptionError, errors.New("Not dropping without confirmation; pass --yes when stdin is not a terminal"))
+		}
+		fmt.Fprintf(os.Stderr, "Drop %d database(s), freeing about %s? Type 'drop' to continue: ", len(expired), formatBytes(total))
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil || strings.TrimSpace(answer) != "drop" {
+			return exitWith(exitFailure, errors.New("Cleanup not confirmed; nothing was dropped"))
+		}
+	}
+
+	failed := 0
+	for _, scratch := range expired {
+		config := *destConfig
+		config.Database = scratch.Name
+		if err := dropDatabaseIfExists(&config); err != nil {
+			logger.Error(fmt.Sprintf("Failed to drop %s: %v", scratch.Name, err))
+			failed++
+		}
+	}
+	if failed > 0 {
+		return exitWith(exitFailure, fmt.Errorf("%d of %d scratch database(s) could not be dropped", failed, len(expired)))
+	}
+	logger.Success(fmt.Sprintf("Dropped %d scratch database(s), freeing about %s", len(expired), formatBytes(total)))
+	return nil
+}
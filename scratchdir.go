@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+// scratchDirPattern names the directory of a run's intermediate files, made
+// in --scratch-dir or the run directory
+const scratchDirPattern = ".pgsm-scratch-*"
+
+// scratchSpace is the private directory every intermediate file of a run is
+// written to: buffered stdin, pg_restore output, rewritten scripts and dumps
+// only compared. It is created on first use and removed with everything in
+// it when the process exits, interrupted or not.
+type scratchSpace struct {
+	mu        sync.Mutex
+	parent    string // --scratch-dir; the run directory when empty
+	outputDir string
+	keep      bool   // --keep-scratch
+	dir       string // Created on first use, "" once removed
+}
+
+var scratch scratchSpace
+
+// configureScratch reads --scratch-dir and --keep-scratch. It runs before
+// every command, so intermediate files written before the options are
+// parsed, like schema read from stdin, land there too.
+func configureScratch(cmd *cobra.Command, args []string) error {
+	parent, _ := cmd.Flags().GetString("scratch-dir")
+	outputDir, _ := cmd.Flags().GetString("output-dir")
+	keep, _ := cmd.Flags().GetBool("keep-scratch")
+	if isStorageURI(outputDir) {
+		outputDir = "" // The run directory is staged; see stageOutput
+	}
+
+	scratch.mu.Lock()
+	defer scratch.mu.Unlock()
+	scratch.parent, scratch.outputDir, scratch.keep = parent, outputDir, keep
+	return nil
+}
+
+// path returns the scratch directory, creating it readable by the owner
+// only. It is made absolute so the paths handed to client tools in Docker
+// are mounted as they are.
+func (s *scratchSpace) path() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir != "" {
+		return s.dir, nil
+	}
+
+	// A --scratch-dir made here is private; a run directory is not
+	parent, perm := s.parent, os.FileMode(0700)
+	if parent == "" {
+		parent, perm = s.outputDir, 0755
+		if currentRun != nil && currentRun.RunDir != "" {
+			parent = currentRun.RunDir
+		}
+	}
+	if parent == "" {
+		parent = os.TempDir()
+	}
+	parent, err := filepath.Abs(parent)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(parent, perm); err != nil {
+		return "", fmt.Errorf("failed to create scratch directory: %v", err)
+	}
+	dir, err := os.MkdirTemp(parent, scratchDirPattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create scratch directory: %v", err)
+	}
+	s.dir = dir
+	registerCleanup(s.remove)
+	return dir, nil
+}
+
+// remove deletes the scratch directory, or with --keep-scratch tells where
+// it was kept. A later intermediate file makes a new one.
+func (s *scratchSpace) remove() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir == "" {
+		return
+	}
+	if s.keep {
+		logger.Info(fmt.Sprintf("Kept the intermediate files in %s (--keep-scratch)", s.dir))
+	} else if err := os.RemoveAll(s.dir); err != nil {
+		logger.Warning(fmt.Sprintf("Failed to remove scratch directory %s: %v", s.dir, err))
+	}
+	s.dir = ""
+}
+
+// scratchFile creates a new file in the scratch directory, like
+// os.CreateTemp. The file is readable by the owner only.
+func scratchFile(pattern string) (*os.File, error) {
+	dir, err := scratch.path()
+	if err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(dir, pattern)
+}
+
+// scratchDirectory creates a new directory in the scratch directory, like
+// os.MkdirTemp. The directory is readable by the owner only.
+func scratchDirectory(pattern string) (string, error) {
+	dir, err := scratch.path()
+	if err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(dir, pattern)
+}
+
+// releaseScratch removes an intermediate file no longer needed before the
+// run ends, unless --keep-scratch keeps it for inspection
+func releaseScratch(path string) {
+	scratch.mu.Lock()
+	keep := scratch.keep
+	scratch.mu.Unlock()
+	if !keep {
+		os.RemoveAll(path)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// scratchCommand is a command taking the scratch flags whose run writes
+// intermediate files, records where, calls during unless nil and then fails
+// with err
+func scratchCommand(err error, written *[]string, during func()) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "run",
+		PersistentPreRunE: configureScratch,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			file, ferr := scratchFile("schema-*.sql")
+			if ferr != nil {
+				return ferr
+			}
+			file.WriteString("CREATE TABLE t (id integer);\n")
+			file.Close()
+			dir, derr := scratchDirectory("restore-*")
+			if derr != nil {
+				return derr
+			}
+			if werr := os.WriteFile(filepath.Join(dir, "toc.dat"), []byte("toc"), 0600); werr != nil {
+				return werr
+			}
+			*written = append(*written, filepath.Dir(file.Name()), file.Name(), dir)
+			if during != nil {
+				during()
+			}
+			return err
+		},
+	}
+	cmd.Flags().String("scratch-dir", "", "")
+	cmd.Flags().String("output-dir", "", "")
+	cmd.Flags().Bool("keep-scratch", false, "")
+	return cmd
+}
+
+func TestScratchRemovedWhenAStageFails(t *testing.T) {
+	failures := []struct {
+		name string
+		err  error
+	}{
+		{"error", errors.New("apply failed")},
+		{"exitWith", exitWith(exitDrift, errors.New("drift found"))},
+		{"reported", exitWith(exitWarnings, nil)},
+		{"success", nil},
+	}
+	for _, failure := range failures {
+		for _, where := range []string{"--scratch-dir", "--output-dir"} {
+			t.Run(failure.name+where, func(t *testing.T) {
+				captureLog(t)
+				parent := t.TempDir()
+				var written []string
+				cmd := scratchCommand(failure.err, &written, nil)
+				cmd.SetArgs([]string{where, parent})
+
+				if code := execute(cmd); code != exitCode(failure.err) {
+					t.Errorf("exit code %d, want %d", code, exitCode(failure.err))
+				}
+				if len(written) != 3 {
+					t.Fatalf("the run wrote %q", written)
+				}
+				dir := written[0]
+				if filepath.Dir(dir) != parent || !strings.HasPrefix(filepath.Base(dir), ".pgsm-scratch-") {
+					t.Errorf("scratch directory %s not in %s", dir, parent)
+				}
+				for _, path := range written {
+					if _, err := os.Stat(path); !os.IsNotExist(err) {
+						t.Errorf("%s left behind after the run: %v", path, err)
+					}
+				}
+				if _, err := os.Stat(parent); err != nil {
+					t.Errorf("the directory the scratch directory was made in is gone: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestScratchPermissions(t *testing.T) {
+	captureLog(t)
+	parent := filepath.Join(t.TempDir(), "scratch")
+	var written []string
+	var modes []os.FileMode
+	cmd := scratchCommand(nil, &written, func() {
+		for _, path := range append([]string{parent}, written...) {
+			if info, err := os.Stat(path); err == nil {
+				modes = append(modes, info.Mode().Perm())
+			}
+		}
+	})
+	cmd.SetArgs([]string{"--scratch-dir", parent})
+	if code := execute(cmd); code != 0 {
+		t.Fatalf("exit code %d", code)
+	}
+	// --scratch-dir, the scratch directory, a file and a directory in it
+	want := []os.FileMode{0700, 0700, 0600, 0700}
+	if fmt.Sprint(modes) != fmt.Sprint(want) {
+		t.Errorf("modes %v, want %v", modes, want)
+	}
+}
+
+func TestScratchKept(t *testing.T) {
+	log := captureLog(t)
+	parent := t.TempDir()
+	var written []string
+	cmd := scratchCommand(errors.New("apply failed"), &written, nil)
+	cmd.SetArgs([]string{"--scratch-dir", parent, "--keep-scratch"})
+	if code := execute(cmd); code != exitFailure {
+		t.Errorf("exit code %d", code)
+	}
+	for _, path := range written {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s not kept: %v", path, err)
+		}
+	}
+	if len(written) > 0 && !strings.Contains(log.String(), "Kept the intermediate files in "+written[0]) {
+		t.Errorf("the kept directory was not reported:\n%s", log)
+	}
+}
+
+// scratchSignalEnv makes TestScratchRemovedOnSignal the interrupted run
+const scratchSignalEnv = "PGSM_TEST_SCRATCH_SIGNAL"
+
+func TestScratchRemovedOnSignal(t *testing.T) {
+	if parent := os.Getenv(scratchSignalEnv); parent != "" {
+		// The run: write intermediate files, then be terminated
+		var written []string
+		cmd := scratchCommand(errors.New("not interrupted"), &written, func() {
+			fmt.Println(strings.Join(written, "\n"))
+			handleSignals()
+			syscall.Kill(os.Getpid(), syscall.SIGTERM)
+			time.Sleep(10 * time.Second)
+		})
+		cmd.SetArgs([]string{"--scratch-dir", parent})
+		os.Exit(execute(cmd))
+	}
+
+	parent := t.TempDir()
+	child := exec.Command(os.Args[0], "-test.run=^TestScratchRemovedOnSignal$")
+	child.Env = append(os.Environ(), scratchSignalEnv+"="+parent)
+	var stdout, stderr bytes.Buffer
+	child.Stdout, child.Stderr = &stdout, &stderr
+	err := child.Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 130 {
+		t.Fatalf("the interrupted run ended with %v, want exit code 130:\n%s", err, stderr.String())
+	}
+
+	// The log goes to stdout too
+	var written []string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if strings.HasPrefix(line, parent+string(filepath.Separator)) {
+			written = append(written, line)
+		}
+	}
+	if len(written) != 3 {
+		t.Fatalf("the run wrote %q:\n%s", written, stderr.String())
+	}
+	for _, path := range written {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind after SIGTERM: %v", path, err)
+		}
+	}
+}
+
+// useScratch makes the scratch directory of the functions a test calls in
+// a temporary directory of the test
+func useScratch(t *testing.T) {
+	t.Helper()
+	scratch.mu.Lock()
+	scratch.parent, scratch.outputDir, scratch.keep = t.TempDir(), "", false
+	scratch.mu.Unlock()
+	t.Cleanup(func() {
+		scratch.remove()
+		scratch.parent = ""
+	})
+}
+
+func TestOutputStagedInScratch(t *testing.T) {
+	for _, uploaded := range []bool{true, false} {
+		t.Run(fmt.Sprint("uploaded ", uploaded), func(t *testing.T) {
+			log := captureLog(t)
+			parent := t.TempDir()
+			storage := t.TempDir()
+			if !uploaded {
+				// Nothing can be put below a file
+				storage = filepath.Join(storage, "file")
+				if err := os.WriteFile(storage, nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var staged, kept string
+			cmd := scratchCommand(nil, new([]string), nil)
+			cmd.RunE = func(cmd *cobra.Command, args []string) error {
+				output, err := stageOutput(storage, nil)
+				if err != nil {
+					return err
+				}
+				staged = output.dir
+				if err := os.WriteFile(filepath.Join(staged, "manifest.json"), []byte("{}"), 0600); err != nil {
+					return err
+				}
+				uploadArtifacts(&RunState{}, &MigrationOptions{Staged: output})
+				kept = output.dir
+				return nil
+			}
+			cmd.SetArgs([]string{"--scratch-dir", parent})
+			if code := execute(cmd); code != 0 {
+				t.Fatalf("exit code %d", code)
+			}
+
+			scratchDir := filepath.Dir(staged)
+			if filepath.Dir(scratchDir) != parent || !strings.HasPrefix(filepath.Base(scratchDir), ".pgsm-scratch-") ||
+				!strings.HasPrefix(filepath.Base(staged), ".pgsm-output-") {
+				t.Fatalf("staged in %s, not in the scratch directory in %s", staged, parent)
+			}
+			if _, err := os.Stat(scratchDir); !os.IsNotExist(err) {
+				t.Errorf("scratch directory left behind: %v", err)
+			}
+
+			if uploaded {
+				if _, err := os.Stat(filepath.Join(storage, "manifest.json")); err != nil {
+					t.Errorf("not uploaded: %v", err)
+				}
+				if _, err := os.Stat(staged); !os.IsNotExist(err) {
+					t.Errorf("staging directory left behind: %v", err)
+				}
+				return
+			}
+			// Moved beside the scratch directory, and the warning says where
+			if want := filepath.Join(parent, filepath.Base(staged)); kept != want {
+				t.Errorf("kept in %s, want %s", kept, want)
+			}
+			if _, err := os.Stat(filepath.Join(kept, "manifest.json")); err != nil {
+				t.Errorf("the files of the failed upload are gone: %v", err)
+			}
+			if !strings.Contains(log.String(), "they are kept in "+kept) {
+				t.Errorf("the kept directory was not reported:\n%s", log)
+			}
+		})
+	}
+}
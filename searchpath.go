@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// sqlBodyVersion is the first server version (server_version_num) with
+// SQL-standard function bodies, which are bound at creation like views
+const sqlBodyVersion = 140000
+
+// textSequencePattern matches sequence functions given a text argument, which
+// look the sequence up through the search_path on every call
+var textSequencePattern = regexp.MustCompile(`\b(nextval|currval|setval)\('(?:[^']|'')*'::text`)
+
+// SearchPathFinding is an object whose behavior depends on the search_path at runtime
+type SearchPathFinding struct {
+	Kind    string `json:"kind"` // function, view or default
+	Object  string `json:"object"`
+	Problem string `json:"problem"`
+}
+
+// searchPathProblem describes what is wrong with the search_path a function
+// pins, or "" when nothing is
+func searchPathProblem(path string, securityDefiner bool) string {
+	if path == "" {
+		return "no search_path set; names in the body resolve against the caller's search_path"
+	}
+	var schemas []string
+	for _, s := range strings.Split(path, ",") {
+		schemas = append(schemas, strings.Trim(strings.TrimSpace(s), `"`))
+	}
+	for _, s := range schemas {
+		if s == "$user" {
+			return fmt.Sprintf("search_path %s depends on the calling user", path)
+		}
+	}
+	if securityDefiner && schemas[len(schemas)-1] != "pg_temp" {
+		return fmt.Sprintf("SECURITY DEFINER with search_path %s; pg_temp is searched first unless it is listed last", path)
+	}
+	return ""
+}
+
+// auditSearchPath looks for functions that don't pin their search_path, and
+// for views and column defaults that rely on them or look up sequences by
+// name. Views and defaults are otherwise bound to the objects they reference
+// when created, so only what is resolved at runtime is reported.
+func auditSearchPath(config *DatabaseConfig) ([]SearchPathFinding, error) {
+	db, err := openDB(config, config.Database)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	version, err := serverVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	sqlBody := ""
+	if version >= sqlBodyVersion {
+		sqlBody = " AND p.prosqlbody IS NULL"
+	}
+
+	rows, err := db.QueryContext(runContext(), `
+		SELECT p.oid, format('%I.%I(%s)', n.nspname, p.proname, pg_get_function_identity_arguments(p.oid)), p.prosecdef,
+		       coalesce((SELECT substr(s, 13) FROM unnest(p.proconfig) s WHERE s LIKE 'search_path=%'), '')
+		FROM pg_proc p
+		JOIN pg_namespace n ON n.oid = p.pronamespace
+		JOIN pg_language l ON l.oid = p.prolang
+		WHERE p.prokind IN ('f', 'p') AND l.lanname NOT IN ('c', 'internal')
+		  AND `+userSchemas+` AND `+fmt.Sprintf(notExtensionMember, "pg_proc", "p.oid")+sqlBody+`
+		ORDER BY 2`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read functions: %v", err)
+	}
+	defer rows.Close()
+
+	var findings []SearchPathFinding
+	unpinned := make(map[int64]string)
+	for rows.Next() {
+		var oid int64
+		var name, path string
+		var securityDefiner bool
+		if err := rows.Scan(&oid, &name, &securityDefiner, &path); err != nil {
+			return nil, err
+		}
+		if problem := searchPathProblem(path, securityDefiner); problem != "" {
+			findings = append(findings, SearchPathFinding{Kind: "function", Object: name, Problem: problem})
+		}
+		if path == "" {
+			unpinned[oid] = name
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	views, err := auditViews(db, unpinned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read views: %v", err)
+	}
+	defaults, err := auditDefaults(db, unpinned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read column defaults: %v", err)
+	}
+	return append(append(findings, views...), defaults...), nil
+}
+
+// auditViews reports the views and materialized views calling unpinned functions
+func auditViews(db *sql.DB, unpinned map[int64]string) ([]SearchPathFinding, error) {
+	rows, err := db.QueryContext(runContext(), `
+		SELECT DISTINCT format('%I.%I', n.nspname, c.relname), d.refobjid::bigint
+		FROM pg_depend d
+		JOIN pg_rewrite r ON r.oid = d.objid
+		JOIN pg_class c ON c.oid = r.ev_class
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE d.classid = 'pg_rewrite'::regclass AND d.refclassid = 'pg_proc'::regclass
+		  AND c.relkind IN ('v', 'm') AND `+userSchemas+`
+		ORDER BY 1, 2`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var findings []SearchPathFinding
+	for rows.Next() {
+		var view string
+		var function int64
+		if err := rows.Scan(&view, &function); err != nil {
+			return nil, err
+		}
+		if name, ok := unpinned[function]; ok {
+			findings = append(findings, SearchPathFinding{Kind: "view", Object: view, Problem: fmt.Sprintf("calls %s, which has no search_path set", name)})
+		}
+	}
+	return findings, rows.Err()
+}
+
+// auditDefaults reports column defaults calling unpinned functions or naming
+// sequences as text
+func auditDefaults(db *sql.DB, unpinned map[int64]string) ([]SearchPathFinding, error) {
+	rows, err := db.QueryContext(runContext(), `
+		SELECT format('%I.%I.%I', n.nspname, c.relname, a.attname), pg_get_expr(ad.adbin, ad.adrelid),
+		       ARRAY(SELECT d.refobjid::bigint FROM pg_depend d
+		             WHERE d.classid = 'pg_attrdef'::regclass AND d.objid = ad.oid AND d.refclassid = 'pg_proc'::regclass)
+		FROM pg_attrdef ad
+		JOIN pg_class c ON c.oid = ad.adrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_attribute a ON a.attrelid = ad.adrelid AND a.attnum = ad.adnum
+		WHERE c.relkind IN ('r', 'p', 'f') AND `+userSchemas+`
+		ORDER BY 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var findings []SearchPathFinding
+	for rows.Next() {
+		var column, expr string
+		var functions []int64
+		if err := rows.Scan(&column, &expr, pq.Array(&functions)); err != nil {
+			return nil, err
+		}
+		if textSequencePattern.MatchString(expr) {
+			findings = append(findings, SearchPathFinding{Kind: "default", Object: column, Problem: fmt.Sprintf("%s names its sequence as text, resolved through the search_path on every call", expr)})
+		}
+		for _, oid := range functions {
+			if name, ok := unpinned[oid]; ok {
+				findings = append(findings, SearchPathFinding{Kind: "default", Object: column, Problem: fmt.Sprintf("calls %s, which has no search_path set", name)})
+			}
+		}
+	}
+	return findings, rows.Err()
+}
+
+// reportSearchPathFindings warns about the audit's findings
+func reportSearchPathFindings(findings []SearchPathFinding) {
+	if len(findings) == 0 {
+		logger.Info("No search_path dependent objects found")
+		return
+	}
+	warn(WarnSearchPathDependent, fmt.Sprintf("%d object(s) depend on the search_path at runtime and may break where the destination's default differs (see search_path_findings in the manifest):", len(findings)))
+	for _, f := range findings {
+		logger.Warning(fmt.Sprintf("   [%s] %s: %s", f.Kind, f.Object, f.Problem))
+	}
+}
+
+// pinSearchPath copies a plain-format pg_dump from r to w, adding
+// SET search_path TO <schema>, pg_temp to every function and procedure
+// that sets no search_path. Functions in C, internal functions and
+// SQL-standard bodies are left alone. It returns the functions changed.
+func pinSearchPath(r io.Reader, w io.Writer) ([]string, error) {
+	out := bufio.NewWriter(w)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var pinned []string
+	var name, schema string // From the TOC entry of the function being read
+	inHeader := false       // Between CREATE FUNCTION and its body
+	skip := false           // The function needs no pinning
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case tocEntryPattern.MatchString(line):
+			m := tocEntryPattern.FindStringSubmatch(line)
+			name, schema = m[3]+"."+m[1], m[3]
+		case strings.HasPrefix(line, "CREATE FUNCTION ") || strings.HasPrefix(line, "CREATE PROCEDURE "):
+			inHeader, skip = true, false
+		case inHeader && (strings.HasPrefix(line, "    SET search_path ") || isLanguageLine(line, "c") || isLanguageLine(line, "internal")):
+			skip = true
+		case inHeader && (line == "    BEGIN ATOMIC" || strings.HasPrefix(line, "    RETURN ")):
+			inHeader = false
+		case inHeader && strings.HasPrefix(line, "    AS "):
+			inHeader = false
+			if !skip {
+				fmt.Fprintf(out, "    SET search_path TO %s, pg_temp\n", quoteIdentifier(schema))
+				pinned = append(pinned, name)
+			}
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return pinned, err
+	}
+	return pinned, out.Flush()
+}
+
+// isLanguageLine reports whether line is the LANGUAGE clause of a function header for lang
+func isLanguageLine(line, lang string) bool {
+	return line == "    LANGUAGE "+lang || strings.HasPrefix(line, "    LANGUAGE "+lang+" ")
+}
+
+// pinSearchPathFile rewrites the dump at path with pinSearchPath
+func pinSearchPathFile(path string) ([]string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(path), ".search-path-*.sql")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(out.Name())
+
+	pinned, err := pinSearchPath(in, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info, err := in.Stat(); err == nil {
+		os.Chmod(out.Name(), info.Mode().Perm())
+	}
+	return pinned, os.Rename(out.Name(), path)
+}
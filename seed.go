@@ -0,0 +1,361 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"pg-schema-migrator/internal/catalog"
+)
+
+// disabledTrigger identifies a trigger that was switched off for the data load
+type disabledTrigger struct {
+	Table   string // Schema-qualified, already quoted
+	Trigger string
+}
+
+// sequenceColumn is a column taking its values from a sequence: an identity
+// column, or one owning its sequence like a serial
+type sequenceColumn struct {
+	Table  string // Schema-qualified, already quoted
+	Column string
+	Always bool // GENERATED ALWAYS identity
+}
+
+// loadSeedData loads the seed data file into the destination after the schema
+// has been applied, optionally with triggers disabled and constraints deferred.
+// Identity columns take the values the seed data gives them, and sequences
+// are moved past those values afterwards.
+func loadSeedData(config *DatabaseConfig, options *MigrationOptions) (err error) {
+	logger.Info(fmt.Sprintf("Loading seed data from '%s' into '%s'...", options.SeedFile, config.Database))
+
+	db, err := openDatabase(config, config.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := setSessionRole(db, config.Role); err != nil {
+		return err
+	}
+
+	// PGOPTIONS only affects the psql session below, so session_replication_role
+	// reverts on its own when that session ends.
+	var pgOptions string
+
+	if options.DisableTriggersDuringData {
+		superuser, suErr := isSuperuser(db)
+		if suErr != nil {
+			return fmt.Errorf("failed to check superuser status: %v", suErr)
+		}
+
+		if superuser {
+			logger.Info("Disabling triggers via session_replication_role = replica")
+			pgOptions = "-c session_replication_role=replica"
+		} else {
+			disabled, disableErr := disableUserTriggers(db)
+			// Re-enable whatever was disabled, even if disabling stopped half way
+			// or the load below fails.
+			defer func() {
+				if restoreErr := enableTriggers(db, disabled); restoreErr != nil {
+					logger.Error(fmt.Sprintf("Failed to re-enable triggers: %v", restoreErr))
+					if err == nil {
+						err = restoreErr
+					}
+				}
+			}()
+			if disableErr != nil {
+				return fmt.Errorf("failed to disable triggers: %v", disableErr)
+			}
+		}
+	}
+
+	// COPY fills GENERATED ALWAYS columns, but INSERT needs OVERRIDING SYSTEM
+	// VALUE, which psql can't add to the statements of the file
+	columns, err := sequenceColumns(db)
+	if err != nil {
+		return fmt.Errorf("failed to list identity columns: %v", err)
+	}
+	relaxed, relaxErr := relaxIdentityColumns(db, columns)
+	defer func() {
+		if restoreErr := restoreIdentityColumns(db, relaxed); restoreErr != nil {
+			logger.Error(fmt.Sprintf("Failed to make identity columns GENERATED ALWAYS again: %v", restoreErr))
+			if err == nil {
+				err = restoreErr
+			}
+		}
+	}()
+	if relaxErr != nil {
+		return fmt.Errorf("failed to let the seed data set identity columns: %v", relaxErr)
+	}
+
+	if options.DeferConstraints {
+		if err := reportNonDeferrableForeignKeys(db); err != nil {
+			warn(WarnForeignKeyCheckFailed, fmt.Sprintf("Could not list non-deferrable foreign keys: %v", err))
+		}
+	}
+
+	args := []string{
+		"-h", config.Host,
+		"-p", config.Port,
+		"-U", config.Username,
+		"-d", dbnameArg(config.Database),
+		"--single-transaction",
+		"-v", "ON_ERROR_STOP=1",
+		"--no-password",
+	}
+
+	if config.Role != "" {
+		args = append(args, "-c", setRoleStatement(config.Role))
+	}
+
+	// SET CONSTRAINTS is transaction scoped, so the original checking mode
+	// comes back automatically when the transaction commits or rolls back.
+	if options.DeferConstraints {
+		args = append(args, "-c", "SET CONSTRAINTS ALL DEFERRED")
+	}
+	args = append(args, "-f", options.SeedFile)
+
+	var env map[string]string
+	if pgOptions != "" {
+		env = map[string]string{"PGOPTIONS": strings.TrimSpace(config.Options + " " + pgOptions)}
+	}
+	cmd := clientCommandEnv(config, env, "psql", args, options.SeedFile)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = psqlStderr(nil)
+
+	// The connection above waits, idle, for the triggers to be re-enabled
+	beat := startHeartbeat(db, config, "the seed data load")
+	runErr := cmd.Run()
+	if lost := beat.Stop(); lost != nil && config.Role != "" {
+		// A new connection would re-enable the triggers as the login user
+		if err := setSessionRole(db, config.Role); err != nil {
+			return fmt.Errorf("connection to %s was lost during the seed data load (%v) and SET ROLE could not be restored: %v", config.Database, lost, err)
+		}
+		warn(WarnReconnected, fmt.Sprintf("Connection to %s was lost during the seed data load (%v); reconnected as role %s", config.Database, lost, config.Role))
+	}
+	if runErr != nil {
+		return fmt.Errorf("psql seed data load failed: %v", runErr)
+	}
+
+	synced, err := syncSequences(db, columns)
+	if err != nil {
+		return fmt.Errorf("failed to move sequences past the seed data: %v", err)
+	}
+	if synced > 0 {
+		logger.Info(fmt.Sprintf("Moved %d sequence(s) past the values the seed data gave their columns", synced))
+	}
+
+	logger.Info("Seed data loaded successfully")
+	return nil
+}
+
+func isSuperuser(db *sql.DB) (bool, error) {
+	var superuser bool
+	err := db.QueryRow(`SELECT rolsuper FROM pg_roles WHERE rolname = current_user`).Scan(&superuser)
+	return superuser, err
+}
+
+// disableUserTriggers disables every currently enabled user trigger and returns
+// the ones it touched so exactly those can be re-enabled afterwards. Internal
+// constraint triggers are left alone since only superusers may disable them.
+func disableUserTriggers(db *sql.DB) ([]disabledTrigger, error) {
+	rows, err := db.Query(`
+		SELECT format('%I.%I', n.nspname, c.relname), t.tgname
+		FROM pg_trigger t
+		JOIN pg_class c ON c.oid = t.tgrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE NOT t.tgisinternal
+		  AND t.tgenabled <> 'D'
+		  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+		ORDER BY 1, 2`)
+	if err != nil {
+		return nil, err
+	}
+
+	var triggers []disabledTrigger
+	for rows.Next() {
+		var t disabledTrigger
+		if err := rows.Scan(&t.Table, &t.Trigger); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		triggers = append(triggers, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	logger.Info(fmt.Sprintf("Disabling %d trigger(s) for the data load", len(triggers)))
+
+	var disabled []disabledTrigger
+	for _, t := range triggers {
+		query := fmt.Sprintf(`ALTER TABLE %s DISABLE TRIGGER %s`, t.Table, quoteIdentifier(t.Trigger))
+		if _, err := db.Exec(query); err != nil {
+			return disabled, fmt.Errorf("%s on %s: %v", t.Trigger, t.Table, err)
+		}
+		disabled = append(disabled, t)
+	}
+	return disabled, nil
+}
+
+func enableTriggers(db *sql.DB, triggers []disabledTrigger) error {
+	if len(triggers) == 0 {
+		return nil
+	}
+
+	logger.Info(fmt.Sprintf("Re-enabling %d trigger(s)", len(triggers)))
+
+	var failed []string
+	for _, t := range triggers {
+		query := fmt.Sprintf(`ALTER TABLE %s ENABLE TRIGGER %s`, t.Table, quoteIdentifier(t.Trigger))
+		if _, err := db.Exec(query); err != nil {
+			failed = append(failed, fmt.Sprintf("%s on %s: %v", t.Trigger, t.Table, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// sequenceColumns lists the identity columns and the columns owning a
+// sequence. Partitions are left out: their identity is their parent's.
+func sequenceColumns(db *sql.DB) ([]sequenceColumn, error) {
+	c, err := catalog.Read(runContext(), db, catalog.Options{})
+	if err != nil {
+		return nil, err
+	}
+	var columns []sequenceColumn
+	for _, s := range c.Schemas {
+		for _, t := range s.Tables {
+			if t.PartitionOf != nil {
+				continue
+			}
+			for _, col := range t.Columns {
+				if col.Identity != "" {
+					columns = append(columns, sequenceColumn{Table: catalog.QualifiedName(s.Name, t.Name), Column: col.Name, Always: col.Identity == catalog.IdentityAlways})
+				}
+			}
+		}
+		for _, seq := range s.Sequences {
+			if owner := seq.OwnedBy; owner != nil && len(owner.Columns) == 1 {
+				columns = append(columns, sequenceColumn{Table: catalog.QualifiedName(owner.Schema, owner.Name), Column: owner.Columns[0]})
+			}
+		}
+	}
+	return columns, nil
+}
+
+// relaxIdentityColumns makes the GENERATED ALWAYS identity columns BY
+// DEFAULT for the data load, so values given for them are kept as with
+// OVERRIDING SYSTEM VALUE. It returns the columns it changed so exactly those
+// are made ALWAYS again.
+func relaxIdentityColumns(db *sql.DB, columns []sequenceColumn) ([]sequenceColumn, error) {
+	var relaxed []sequenceColumn
+	for _, c := range columns {
+		if !c.Always {
+			continue
+		}
+		query := fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN %s SET GENERATED BY DEFAULT`, c.Table, quoteIdentifier(c.Column))
+		if _, err := db.Exec(query); err != nil {
+			return relaxed, fmt.Errorf("%s of %s: %v", c.Column, c.Table, err)
+		}
+		relaxed = append(relaxed, c)
+	}
+	if len(relaxed) > 0 {
+		logger.Info(fmt.Sprintf("Letting the seed data set %d GENERATED ALWAYS identity column(s)", len(relaxed)))
+	}
+	return relaxed, nil
+}
+
+func restoreIdentityColumns(db *sql.DB, columns []sequenceColumn) error {
+	var failed []string
+	for _, c := range columns {
+		query := fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN %s SET GENERATED ALWAYS`, c.Table, quoteIdentifier(c.Column))
+		if _, err := db.Exec(query); err != nil {
+			failed = append(failed, fmt.Sprintf("%s of %s: %v", c.Column, c.Table, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// syncSequences moves the sequence of each column past the largest value
+// the column holds, so the next generated value doesn't collide with the
+// seed data. Sequences already past it, or counting down, are left alone.
+// It returns how many sequences it moved.
+func syncSequences(db *sql.DB, columns []sequenceColumn) (int, error) {
+	synced := 0
+	for _, c := range columns {
+		var sequence sql.NullString
+		var increment int64
+		err := db.QueryRow(`
+			SELECT s.seqrelid::regclass::text, s.seqincrement
+			FROM pg_sequence s
+			WHERE s.seqrelid = pg_get_serial_sequence($1, $2)::regclass`, c.Table, c.Column).Scan(&sequence, &increment)
+		if errors.Is(err, sql.ErrNoRows) || err == nil && (!sequence.Valid || increment < 0) {
+			continue
+		}
+		if err != nil {
+			return synced, fmt.Errorf("%s of %s: %v", c.Column, c.Table, err)
+		}
+
+		var moved bool
+		err = db.QueryRow(fmt.Sprintf(`
+			SELECT setval($1::regclass, m.value) IS NOT NULL
+			FROM (SELECT max(%s) AS value FROM %s) m, %s q
+			WHERE m.value > q.last_value OR NOT q.is_called AND m.value = q.last_value`,
+			quoteIdentifier(c.Column), c.Table, sequence.String), sequence.String).Scan(&moved)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return synced, fmt.Errorf("%s of %s: %v", sequence.String, c.Table, err)
+		}
+		synced++
+	}
+	return synced, nil
+}
+
+// reportNonDeferrableForeignKeys warns about foreign keys that SET CONSTRAINTS
+// cannot defer and which may therefore fail on out-of-order seed data.
+func reportNonDeferrableForeignKeys(db *sql.DB) error {
+	rows, err := db.Query(`
+		SELECT format('%I.%I', n.nspname, c.relname), con.conname
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE con.contype = 'f'
+		  AND NOT con.condeferrable
+		  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+		ORDER BY 1, 2`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var count int
+	for rows.Next() {
+		var table, name string
+		if err := rows.Scan(&table, &name); err != nil {
+			return err
+		}
+		if count == 0 {
+			warn(WarnNonDeferrableForeignKeys, "The following foreign keys are not deferrable and may fail if seed data is out of order:")
+		}
+		logger.Warning(fmt.Sprintf("  %s (%s)", name, table))
+		count++
+	}
+	return rows.Err()
+}
+
+// quoteIdentifier quotes a SQL identifier, doubling any embedded quotes
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
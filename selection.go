@@ -0,0 +1,639 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"pg-schema-migrator/internal/dumpparse"
+)
+
+// selectionKinds maps the object kinds of --only and --skip to the pg_dump
+// TOC types they select
+var selectionKinds = map[string][]string{
+	"table":    {"TABLE", "FOREIGN TABLE"},
+	"view":     {"VIEW"},
+	"matview":  {"MATERIALIZED VIEW"},
+	"function": {"FUNCTION", "PROCEDURE", "AGGREGATE"},
+	"sequence": {"SEQUENCE"},
+	"type":     {"TYPE", "DOMAIN"},
+	"index":    {"INDEX"},
+	"trigger":  {"TRIGGER"},
+}
+
+// selectionKindNames lists the kinds in the order they are documented
+var selectionKindNames = []string{"table", "view", "matview", "function", "sequence", "type", "index", "trigger"}
+
+// tocSelectionKinds maps pg_dump TOC types back to their selection kind
+var tocSelectionKinds = func() map[string]string {
+	kinds := make(map[string]string)
+	for kind, types := range selectionKinds {
+		for _, t := range types {
+			kinds[t] = kind
+		}
+	}
+	return kinds
+}()
+
+// relationTypes are the TOC types constraints, triggers and indexes belong to
+var relationTypes = []string{"TABLE", "FOREIGN TABLE", "VIEW", "MATERIALIZED VIEW"}
+
+// referenceTypes are the TOC types other entries refer to by qualified name,
+// which makes them dependencies of the entries that do
+var referenceTypes = map[string]bool{
+	"TABLE": true, "FOREIGN TABLE": true, "VIEW": true, "MATERIALIZED VIEW": true, "SEQUENCE": true,
+	"TYPE": true, "DOMAIN": true, "FUNCTION": true, "PROCEDURE": true, "AGGREGATE": true, "COLLATION": true,
+	"TEXT SEARCH CONFIGURATION": true, "TEXT SEARCH DICTIONARY": true,
+}
+
+// optionalAttachments only follow a table selected itself, not one pulled in
+// because a selected object needs it
+var optionalAttachments = map[string]bool{"INDEX": true, "TRIGGER": true, "INDEX ATTACH": true}
+
+// auxiliaryTypes are the TOC types that extend types and functions rather
+// than stand on their own. With --only they are kept in the schemas anything
+// is kept in, and casts with the types they convert.
+var auxiliaryTypes = map[string]bool{
+	"OPERATOR": true, "OPERATOR CLASS": true, "OPERATOR FAMILY": true, "CAST": true, "AGGREGATE": true,
+	"TEXT SEARCH CONFIGURATION": true, "TEXT SEARCH DICTIONARY": true,
+}
+
+// namedOnTable are the TOC types named "<table> <name>"
+var namedOnTable = map[string]bool{
+	"CONSTRAINT": true, "FK CONSTRAINT": true, "CHECK CONSTRAINT": true, "DEFAULT": true,
+	"TRIGGER": true, "RULE": true, "POLICY": true,
+}
+
+// commentTargets are the object types COMMENT, ACL and SECURITY LABEL entries
+// name, longest first so "MATERIALIZED VIEW" wins over "VIEW"
+var commentTargets = []string{
+	"TEXT SEARCH CONFIGURATION", "TEXT SEARCH DICTIONARY", "MATERIALIZED VIEW", "FOREIGN TABLE",
+	"CONSTRAINT", "PROCEDURE", "AGGREGATE", "COLLATION", "EXTENSION", "FUNCTION", "SEQUENCE",
+	"TRIGGER", "COLUMN", "DOMAIN", "POLICY", "SCHEMA", "INDEX", "TABLE", "RULE", "TYPE", "VIEW",
+}
+
+// qualifiedNamePattern matches schema-qualified names as pg_dump writes them
+var qualifiedNamePattern = regexp.MustCompile(`("(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)\.("(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)`)
+
+// indexTablePattern finds the table of a CREATE INDEX, identityTablePattern
+// the table of an identity column's sequence
+var (
+	indexTablePattern    = regexp.MustCompile(`\bON (?:ONLY )?((?:"(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)\.(?:"(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*))`)
+	identityTablePattern = regexp.MustCompile(`ALTER TABLE (?:ONLY )?((?:"(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)\.(?:"(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*))[\s\S]*ADD GENERATED `)
+)
+
+// extensionSchemaPattern finds the schema of a CREATE EXTENSION
+var extensionSchemaPattern = regexp.MustCompile(`WITH SCHEMA ("(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)`)
+
+// objectSelector is one --only or --skip pattern
+type objectSelector struct {
+	kind string
+	rule ignoreRule
+}
+
+// parseObjectSelector parses "type:schema.name", where schema and name are
+// globs quoted like the .pgsmignore patterns
+func parseObjectSelector(value string) (objectSelector, error) {
+	kind, pattern, ok := strings.Cut(value, ":")
+	if !ok {
+		return objectSelector{}, fmt.Errorf("expected type:schema.name")
+	}
+	if _, ok := selectionKinds[kind]; !ok {
+		return objectSelector{}, fmt.Errorf("unknown object type %q, must be one of %s", kind, strings.Join(selectionKindNames, ", "))
+	}
+	if strings.HasPrefix(pattern, "!") {
+		return objectSelector{}, fmt.Errorf("'!' is not supported here, use --skip")
+	}
+	rule, err := parseIgnorePattern(pattern)
+	if err != nil {
+		return objectSelector{}, err
+	}
+	return objectSelector{kind: kind, rule: rule}, nil
+}
+
+func (s objectSelector) matches(b *dumpBlock) bool {
+	return b.kind == s.kind && s.rule.matches(DatabaseObject{Type: s.kind, Schema: b.entry.Schema, Name: b.name})
+}
+
+// ObjectSelection is the parsed --only, --skip and --strict-selection
+type ObjectSelection struct {
+	Only   []string
+	Skip   []string
+	Strict bool // Fail instead of including the dependencies of selected objects
+
+	only, skip []objectSelector
+}
+
+// parseObjectSelection parses the --only and --skip patterns
+func parseObjectSelection(only, skip []string, strict bool) (ObjectSelection, error) {
+	selection := ObjectSelection{Only: only, Skip: skip, Strict: strict}
+	for _, value := range only {
+		selector, err := parseObjectSelector(value)
+		if err != nil {
+			return selection, fmt.Errorf("--only %q: %v", value, err)
+		}
+		selection.only = append(selection.only, selector)
+	}
+	for _, value := range skip {
+		selector, err := parseObjectSelector(value)
+		if err != nil {
+			return selection, fmt.Errorf("--skip %q: %v", value, err)
+		}
+		selection.skip = append(selection.skip, selector)
+	}
+	if strict && len(only) == 0 && len(skip) == 0 {
+		return selection, fmt.Errorf("--strict-selection needs --only or --skip")
+	}
+	return selection, nil
+}
+
+// active reports whether the export is filtered at all
+func (s *ObjectSelection) active() bool {
+	return len(s.only) > 0 || len(s.skip) > 0
+}
+
+func matchesAny(selectors []objectSelector, b *dumpBlock) bool {
+	for _, s := range selectors {
+		if s.matches(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectedDependency is an object kept because a selected one needs it
+type SelectedDependency struct {
+	Object   string `json:"object"`
+	NeededBy string `json:"needed_by"`
+	Skipped  bool   `json:"skipped,omitempty"` // Matched --skip, and was kept anyway
+}
+
+// SelectionReport records what --only and --skip left in the export
+type SelectionReport struct {
+	Only         []string             `json:"only,omitempty"`
+	Skip         []string             `json:"skip,omitempty"`
+	Objects      []string             `json:"objects"`                // Objects kept, in dump order
+	Dependencies []SelectedDependency `json:"dependencies,omitempty"` // Included only because selected objects need them
+	Removed      int                  `json:"removed"`                // Dump entries filtered out
+}
+
+// dumpBlock is one object of a parsed dump with what the selection knows of it
+type dumpBlock struct {
+	object *dumpparse.Object
+	entry  dumpEntry
+	kind   string // Selection kind, "" for entries --only and --skip don't name
+	name   string // Name patterns match: the trigger name without its table
+	schema string // Schema it is created in, which is kept with it
+	parent int    // Entry it belongs to, such as the table of a constraint, or -1
+}
+
+// body returns the statements of the entry, without its header
+func (b *dumpBlock) body() string {
+	return b.object.Body()
+}
+
+// dumpBlocks wraps the objects of a parsed dump
+func dumpBlocks(dump *dumpparse.Dump) []*dumpBlock {
+	blocks := make([]*dumpBlock, len(dump.Objects))
+	for i, o := range dump.Objects {
+		blocks[i] = &dumpBlock{object: o, entry: dumpEntry{Name: o.Name, Type: o.Type, Schema: o.Schema}, parent: -1}
+	}
+	return blocks
+}
+
+// unquoteName returns an identifier as written by pg_dump as the name it stands for
+func unquoteName(ident string) string {
+	if strings.HasPrefix(ident, `"`) {
+		return strings.ReplaceAll(ident[1:len(ident)-1], `""`, `"`)
+	}
+	return strings.ToLower(ident)
+}
+
+// splitQualifiedName splits a name matched by qualifiedNamePattern
+func splitQualifiedName(qualified string) (string, string) {
+	m := qualifiedNamePattern.FindStringSubmatch(qualified)
+	if m == nil {
+		return "", ""
+	}
+	return unquoteName(m[1]), unquoteName(m[2])
+}
+
+// baseName strips the argument list from a function's TOC name
+func baseName(name string) string {
+	if i := strings.IndexByte(name, '('); i > 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// dumpIndex looks up the entries of a dump by type and name
+type dumpIndex struct {
+	blocks []*dumpBlock
+	byType map[string]int   // "TYPE\x00schema\x00name"
+	byName map[string][]int // "schema\x00name" of referenceTypes, functions without arguments
+}
+
+func newDumpIndex(blocks []*dumpBlock) *dumpIndex {
+	idx := &dumpIndex{blocks: blocks, byType: make(map[string]int), byName: make(map[string][]int)}
+	for i, b := range blocks {
+		e := b.entry
+		idx.byType[e.Type+"\x00"+e.Schema+"\x00"+e.Name] = i
+		if referenceTypes[e.Type] {
+			key := e.Schema + "\x00" + baseName(e.Name)
+			idx.byName[key] = append(idx.byName[key], i)
+		}
+	}
+	return idx
+}
+
+// find returns the entry of one of types named schema.name, or -1
+func (idx *dumpIndex) find(schema, name string, types ...string) int {
+	for _, t := range types {
+		if i, ok := idx.byType[t+"\x00"+schema+"\x00"+name]; ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// relationPrefix finds the relation a "<table> <name>" entry belongs to,
+// trying the longest table name first, and returns it with the rest of the name
+func (idx *dumpIndex) relationPrefix(schema, name string) (int, string) {
+	for at := strings.LastIndexByte(name, ' '); at > 0; at = strings.LastIndexByte(name[:at], ' ') {
+		if i := idx.find(schema, name[:at], relationTypes...); i >= 0 {
+			return i, name[at+1:]
+		}
+	}
+	return -1, name
+}
+
+// commentTarget finds the entry a COMMENT, ACL or SECURITY LABEL entry is on
+func (idx *dumpIndex) commentTarget(schema, name string) int {
+	for _, t := range commentTargets {
+		rest, ok := strings.CutPrefix(name, t+" ")
+		if !ok {
+			continue
+		}
+		switch t {
+		case "COLUMN":
+			for at := strings.IndexByte(rest, '.'); at > 0; at = nextIndex(rest, '.', at) {
+				if i := idx.find(schema, rest[:at], relationTypes...); i >= 0 {
+					return i
+				}
+			}
+			return -1
+		case "CONSTRAINT", "TRIGGER", "POLICY", "RULE":
+			at := strings.LastIndex(rest, " ON ")
+			if at < 0 {
+				return -1
+			}
+			onTable := rest[at+4:] + " " + rest[:at]
+			if t == "CONSTRAINT" {
+				return idx.find(schema, onTable, "CONSTRAINT", "FK CONSTRAINT", "CHECK CONSTRAINT")
+			}
+			return idx.find(schema, onTable, t)
+		case "SCHEMA", "EXTENSION":
+			return idx.find("-", rest, t)
+		}
+		return idx.find(schema, rest, t)
+	}
+	return -1
+}
+
+// nextIndex returns the next index of c in s after at, or -1
+func nextIndex(s string, c byte, at int) int {
+	if i := strings.IndexByte(s[at+1:], c); i >= 0 {
+		return at + 1 + i
+	}
+	return -1
+}
+
+// link sets the selection kind, the matched name and the parent of an entry
+func (idx *dumpIndex) link(i int) {
+	b := idx.blocks[i]
+	e := b.entry
+	b.kind = tocSelectionKinds[e.Type]
+	b.name = e.Name
+	b.schema = e.Schema
+
+	qualifiedTable := func(pattern *regexp.Regexp) int {
+		m := pattern.FindStringSubmatch(b.body())
+		if m == nil {
+			return -1
+		}
+		schema, name := splitQualifiedName(m[1])
+		return idx.find(schema, name, relationTypes...)
+	}
+
+	switch {
+	case namedOnTable[e.Type]:
+		b.parent, b.name = idx.relationPrefix(e.Schema, e.Name)
+	case e.Type == "ROW SECURITY":
+		b.parent = idx.find(e.Schema, e.Name, relationTypes...)
+	case e.Type == "INDEX":
+		b.parent = qualifiedTable(indexTablePattern)
+	case e.Type == "INDEX ATTACH":
+		b.parent = idx.find(e.Schema, e.Name, "INDEX")
+	case e.Type == "TABLE ATTACH":
+		b.parent = idx.find(e.Schema, e.Name, "TABLE")
+	case e.Type == "SEQUENCE OWNED BY" || e.Type == "SEQUENCE SET":
+		b.parent = idx.find(e.Schema, e.Name, "SEQUENCE")
+	case e.Type == "TABLE DATA":
+		b.parent = idx.find(e.Schema, e.Name, "TABLE")
+	case e.Type == "MATERIALIZED VIEW DATA":
+		b.parent = idx.find(e.Schema, e.Name, "MATERIALIZED VIEW")
+	case e.Type == "SEQUENCE":
+		// An identity column's sequence comes with its table
+		b.parent = qualifiedTable(identityTablePattern)
+	case e.Type == "EXTENSION":
+		if m := extensionSchemaPattern.FindStringSubmatch(b.body()); m != nil {
+			b.schema = unquoteName(m[1])
+		}
+	case e.Type == "SHELL TYPE":
+		b.parent = idx.find(e.Schema, e.Name, "TYPE")
+	case e.Type == "COMMENT" || e.Type == "ACL" || e.Type == "SECURITY LABEL":
+		b.parent = idx.commentTarget(e.Schema, e.Name)
+	}
+	if b.parent == i {
+		b.parent = -1
+	}
+}
+
+// references returns the entries the statements of entry i name
+func (idx *dumpIndex) references(i int) []int {
+	var refs []int
+	seen := make(map[int]bool)
+	for _, m := range qualifiedNamePattern.FindAllStringSubmatch(idx.blocks[i].body(), -1) {
+		key := unquoteName(m[1]) + "\x00" + unquoteName(m[2])
+		for _, j := range idx.byName[key] {
+			if j != i && !seen[j] {
+				seen[j] = true
+				refs = append(refs, j)
+			}
+		}
+	}
+	return refs
+}
+
+// auxiliaryKept reports whether the auxiliary entry i goes with what is kept:
+// a cast with a type it converts, anything else with its schema
+func (idx *dumpIndex) auxiliaryKept(i int, keep []bool, keptSchemas map[string]bool) bool {
+	b := idx.blocks[i]
+	if b.entry.Type != "CAST" {
+		return keptSchemas[b.schema]
+	}
+	for _, j := range idx.references(i) {
+		if t := idx.blocks[j].entry.Type; keep[j] && (t == "TYPE" || t == "DOMAIN") {
+			return true
+		}
+	}
+	return false
+}
+
+// dependencyOrder returns the order to write the entries of a dump in: the
+// dump's own, except that kept entries come after the kept entries they
+// belong to and auxiliary ones after what they refer to. Entries in a cycle,
+// like a type and its I/O functions, keep their order in the dump.
+func dependencyOrder(blocks []*dumpBlock, keep []bool) []int {
+	idx := newDumpIndex(blocks)
+	n := len(blocks)
+	after := make([][]int, n) // Entries that must come after each entry
+	waiting := make([]int, n) // Entries each entry must come after, not yet written
+	edge := func(from, to int) {
+		if from != to && keep[from] && keep[to] {
+			after[from] = append(after[from], to)
+			waiting[to]++
+		}
+	}
+	for i, b := range blocks {
+		if !keep[i] {
+			continue
+		}
+		// A shell type belongs to its type but must come first
+		if b.parent >= 0 && b.entry.Type != "SHELL TYPE" {
+			edge(b.parent, i)
+		}
+		if auxiliaryTypes[b.entry.Type] {
+			for _, j := range idx.references(i) {
+				edge(j, i)
+			}
+		}
+	}
+
+	// Kahn's algorithm, always taking the first entry of the dump that is ready
+	ready := &intHeap{}
+	for i := range n {
+		if waiting[i] == 0 {
+			heap.Push(ready, i)
+		}
+	}
+	order := make([]int, 0, n)
+	written := make([]bool, n)
+	next := 0 // Where to look for an entry to break a cycle with
+	for len(order) < n {
+		if ready.Len() == 0 {
+			for written[next] {
+				next++
+			}
+			waiting[next] = 0
+			heap.Push(ready, next)
+		}
+		i := heap.Pop(ready).(int)
+		if written[i] {
+			continue
+		}
+		written[i] = true
+		order = append(order, i)
+		for _, j := range after[i] {
+			if waiting[j]--; waiting[j] == 0 && !written[j] {
+				heap.Push(ready, j)
+			}
+		}
+	}
+	return order
+}
+
+// intHeap is a min-heap of entry indexes
+type intHeap []int
+
+func (h intHeap) Len() int           { return len(h) }
+func (h intHeap) Less(i, j int) bool { return h[i] < h[j] }
+func (h intHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *intHeap) Push(x any)        { *h = append(*h, x.(int)) }
+func (h *intHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// resolveSelection decides which entries of a dump --only and --skip keep.
+// Entries belonging to another, like constraints, comments and grants, follow
+// it. Objects the kept entries refer to are kept as dependencies and
+// reported, or fail the selection with --strict-selection.
+func resolveSelection(blocks []*dumpBlock, selection *ObjectSelection) ([]bool, *SelectionReport, error) {
+	idx := newDumpIndex(blocks)
+	for i := range blocks {
+		idx.link(i)
+	}
+
+	n := len(blocks)
+	keep := make([]bool, n)
+	full := make([]bool, n)    // Selected for itself, so its optional attachments come along
+	decided := make([]bool, n) // Kept or dropped by the patterns, not by the entry it belongs to
+	skipped := make([]bool, n)
+	hasOnly := len(selection.only) > 0
+	schemas := make(map[string]int)
+	for i, b := range blocks {
+		switch {
+		case matchesAny(selection.skip, b):
+			decided[i], skipped[i] = true, true
+		case hasOnly && matchesAny(selection.only, b):
+			decided[i], keep[i] = true, true
+		case b.parent >= 0:
+		case hasOnly && auxiliaryTypes[b.entry.Type]:
+			// Decided with the schemas and types kept, below
+		case b.entry.Type == "SCHEMA":
+			// Kept when anything in it is
+			schemas[b.entry.Name] = i
+			decided[i], keep[i] = true, !hasOnly
+		case b.entry.Type == "EXTENSION":
+			decided[i], keep[i] = true, true
+		default:
+			decided[i], keep[i] = true, !hasOnly
+		}
+		full[i] = keep[i]
+	}
+
+	report := &SelectionReport{Only: selection.Only, Skip: selection.Skip, Objects: []string{}}
+	neededBy := make(map[int]int)
+	scanned := make([]bool, n)
+	for changed := true; changed; {
+		changed = false
+		keptSchemas := make(map[string]bool)
+		for i, b := range blocks {
+			if keep[i] {
+				keptSchemas[b.schema] = true
+			}
+		}
+		for i, b := range blocks {
+			if !decided[i] && b.parent >= 0 && keep[b.parent] && !keep[i] && (full[b.parent] || !optionalAttachments[b.entry.Type]) {
+				keep[i], full[i], changed = true, full[b.parent], true
+			}
+			if !decided[i] && b.parent < 0 && !keep[i] && auxiliaryTypes[b.entry.Type] && idx.auxiliaryKept(i, keep, keptSchemas) {
+				keep[i], full[i], changed = true, true, true
+			}
+			if !keep[i] {
+				continue
+			}
+			if p := b.parent; p >= 0 && !keep[p] {
+				keep[p], neededBy[p], changed = true, i, true
+			}
+			if s, ok := schemas[b.schema]; ok && !keep[s] {
+				keep[s], changed = true, true
+			}
+			if scanned[i] {
+				continue
+			}
+			scanned[i] = true
+			for _, j := range idx.references(i) {
+				if !keep[j] {
+					keep[j], neededBy[j], changed = true, i, true
+				}
+			}
+		}
+	}
+
+	for i, b := range blocks {
+		if !keep[i] {
+			report.Removed++
+			continue
+		}
+		if b.parent < 0 || b.kind != "" {
+			report.Objects = append(report.Objects, b.entry.String())
+		}
+		if by, ok := neededBy[i]; ok {
+			report.Dependencies = append(report.Dependencies, SelectedDependency{
+				Object:   b.entry.String(),
+				NeededBy: blocks[by].entry.String(),
+				Skipped:  skipped[i],
+			})
+		}
+	}
+	if len(report.Objects) == 0 {
+		return keep, report, fmt.Errorf("--only and --skip leave no objects to migrate")
+	}
+	if selection.Strict && len(report.Dependencies) > 0 {
+		missing := make([]string, 0, len(report.Dependencies))
+		for _, dep := range report.Dependencies {
+			missing = append(missing, fmt.Sprintf("%s (needed by %s)", dep.Object, dep.NeededBy))
+		}
+		sort.Strings(missing)
+		return keep, report, fmt.Errorf("--strict-selection: %d object(s) the selection depends on are not selected: %s",
+			len(missing), strings.Join(missing, "; "))
+	}
+	return keep, report, nil
+}
+
+// selectDumpObjects rewrites the plain-format dump at path to the objects
+// --only and --skip select and what they depend on. Top-level SET statements
+// of the entries removed stay, since later entries may rely on them.
+func selectDumpObjects(path string, selection *ObjectSelection, listAll bool) (*SelectionReport, error) {
+	dump, err := dumpparse.ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	blocks := dumpBlocks(dump)
+	keep, report, err := resolveSelection(blocks, selection)
+	if err != nil {
+		return report, err
+	}
+
+	var b strings.Builder
+	b.WriteString(dump.Head)
+	writeKeptEntries(&b, blocks, keep, dependencyOrder(blocks, keep))
+	b.WriteString(dump.Tail)
+
+	out, err := os.CreateTemp(filepath.Dir(path), ".selection-*.sql")
+	if err != nil {
+		return report, err
+	}
+	defer os.Remove(out.Name())
+	_, err = out.WriteString(b.String())
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return report, err
+	}
+	if info, err := os.Stat(path); err == nil {
+		os.Chmod(out.Name(), info.Mode().Perm())
+	}
+	if err := os.Rename(out.Name(), path); err != nil {
+		return report, err
+	}
+
+	logger.Info(fmt.Sprintf("Selected %d object(s) with --only/--skip; %d dump entries removed", len(report.Objects), report.Removed))
+	for _, object := range report.Objects {
+		if listAll {
+			logger.Info("   " + object)
+		} else {
+			logger.Debug("   " + object)
+		}
+	}
+	if len(report.Dependencies) > 0 {
+		logger.Info(fmt.Sprintf("Also included %d object(s) the selection depends on (--strict-selection fails instead):", len(report.Dependencies)))
+		for _, dep := range report.Dependencies {
+			note := ""
+			if dep.Skipped {
+				note = ", despite --skip"
+			}
+			logger.Info(fmt.Sprintf("   %s (needed by %s%s)", dep.Object, dep.NeededBy, note))
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"pg-schema-migrator/internal/dumpparse"
+)
+
+// selectFixture runs --only and --skip on a copy of a dump of testdata and
+// returns the report and the entries of the rewritten dump, in order
+func selectFixture(t *testing.T, name string, only, skip []string) (*SelectionReport, []string) {
+	t.Helper()
+	captureLog(t)
+	path := copyTestdata(t, name)
+	selection, err := parseObjectSelection(only, skip, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := selectDumpObjects(path, &selection, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump, err := dumpparse.ParseFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []string
+	for _, o := range dump.Objects {
+		entries = append(entries, dumpEntry{Name: o.Name, Type: o.Type, Schema: o.Schema}.String())
+	}
+	return report, entries
+}
+
+// checkKept fails the test unless entries are want, in any order
+func checkKept(t *testing.T, entries, want []string) {
+	t.Helper()
+	got, want := slices.Sorted(slices.Values(entries)), slices.Sorted(slices.Values(want))
+	if !slices.Equal(got, want) {
+		t.Errorf("kept:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// checkOrder fails the test unless the first entry of each pair is written
+// ahead of the second, which needs it
+func checkOrder(t *testing.T, entries []string, pairs [][2]string) {
+	t.Helper()
+	for _, pair := range pairs {
+		first, then := slices.Index(entries, pair[0]), slices.Index(entries, pair[1])
+		switch {
+		case first < 0 || then < 0:
+			t.Errorf("%s or %s is missing", pair[0], pair[1])
+		case first > then:
+			t.Errorf("%s is written after %s, which needs it", pair[0], pair[1])
+		}
+	}
+}
+
+func TestSelectionKeepsAuxiliaryObjects(t *testing.T) {
+	report, entries := selectFixture(t, "selection_auxiliary.sql", []string{"table:ledger.entries"}, nil)
+
+	want := []string{
+		"SCHEMA ledger",
+		"SHELL TYPE ledger.cents",
+		"FUNCTION ledger.cents_in(cstring)",
+		"FUNCTION ledger.cents_out(ledger.cents)",
+		"TYPE ledger.cents",
+		"FUNCTION ledger.cents_add(ledger.cents, ledger.cents)",
+		"AGGREGATE ledger.total(ledger.cents)",
+		"OPERATOR ledger.+",
+		"FUNCTION ledger.cents_lt(ledger.cents, ledger.cents)",
+		"OPERATOR ledger.<",
+		"OPERATOR FAMILY ledger.cents_ops",
+		"FUNCTION ledger.cents_cmp(ledger.cents, ledger.cents)",
+		"OPERATOR CLASS ledger.cents_ops",
+		"FUNCTION ledger.cents_from_bigint(bigint)",
+		"CAST CAST (bigint AS ledger.cents)",
+		"TEXT SEARCH DICTIONARY ledger.plain_words",
+		"TEXT SEARCH CONFIGURATION ledger.words",
+		"TABLE ledger.entries",
+		"CONSTRAINT ledger.entries entries_pkey",
+	}
+	checkKept(t, entries, want)
+
+	// Whatever the order of the dump, each comes after what it needs
+	checkOrder(t, entries, [][2]string{
+		{"SHELL TYPE ledger.cents", "FUNCTION ledger.cents_in(cstring)"},
+		{"FUNCTION ledger.cents_out(ledger.cents)", "TYPE ledger.cents"},
+		{"TYPE ledger.cents", "OPERATOR ledger.+"},
+		{"FUNCTION ledger.cents_add(ledger.cents, ledger.cents)", "OPERATOR ledger.+"},
+		{"FUNCTION ledger.cents_add(ledger.cents, ledger.cents)", "AGGREGATE ledger.total(ledger.cents)"},
+		{"FUNCTION ledger.cents_lt(ledger.cents, ledger.cents)", "OPERATOR ledger.<"},
+		{"FUNCTION ledger.cents_cmp(ledger.cents, ledger.cents)", "OPERATOR CLASS ledger.cents_ops"},
+		{"OPERATOR FAMILY ledger.cents_ops", "OPERATOR CLASS ledger.cents_ops"},
+		{"TYPE ledger.cents", "CAST CAST (bigint AS ledger.cents)"},
+		{"FUNCTION ledger.cents_from_bigint(bigint)", "CAST CAST (bigint AS ledger.cents)"},
+		{"TEXT SEARCH DICTIONARY ledger.plain_words", "TEXT SEARCH CONFIGURATION ledger.words"},
+	})
+
+	for _, entry := range entries {
+		if strings.Contains(entry, "other.") {
+			t.Errorf("%s kept, but nothing of schema other is selected", entry)
+		}
+	}
+
+	// Only the table was selected; the rest is reported as needed by it or
+	// by what came with it
+	var dependencies []string
+	for _, dep := range report.Dependencies {
+		dependencies = append(dependencies, dep.Object)
+	}
+	for _, dep := range []string{
+		"TYPE ledger.cents",
+		"FUNCTION ledger.cents_add(ledger.cents, ledger.cents)",
+		"FUNCTION ledger.cents_from_bigint(bigint)",
+		"TEXT SEARCH DICTIONARY ledger.plain_words",
+	} {
+		if !slices.Contains(dependencies, dep) {
+			t.Errorf("dependency %s not reported in %q", dep, dependencies)
+		}
+	}
+}
+
+func TestSelectionCastFollowsItsType(t *testing.T) {
+	// The type of schema other is selected, so its cast comes along, but
+	// nothing of schema ledger does
+	_, entries := selectFixture(t, "selection_auxiliary.sql", []string{"type:other.mood"}, nil)
+	want := []string{
+		"SCHEMA other",
+		"TYPE other.mood",
+		"OPERATOR other.###",
+		"CAST CAST (text AS other.mood)",
+		"FUNCTION other.mood_eq(other.mood, other.mood)",
+	}
+	checkKept(t, entries, want)
+	checkOrder(t, entries, [][2]string{
+		{"TYPE other.mood", "CAST CAST (text AS other.mood)"},
+		{"FUNCTION other.mood_eq(other.mood, other.mood)", "OPERATOR other.###"},
+	})
+}
+
+func TestSelectionAggregateOnly(t *testing.T) {
+	// Aggregates are selected as functions; their state function and type
+	// come with them and are written first
+	_, entries := selectFixture(t, "selection_auxiliary.sql", []string{"function:ledger.total"}, nil)
+	checkOrder(t, entries, [][2]string{
+		{"TYPE ledger.cents", "AGGREGATE ledger.total(ledger.cents)"},
+		{"FUNCTION ledger.cents_add(ledger.cents, ledger.cents)", "AGGREGATE ledger.total(ledger.cents)"},
+	})
+	if slices.Contains(entries, "TABLE ledger.entries") {
+		t.Error("the table of the schema came with the aggregate")
+	}
+}
+
+func TestSelectionSkipOrdersAuxiliaryObjects(t *testing.T) {
+	// Without --only the auxiliary entries are kept as any other, and only
+	// reordered where the dump has them ahead of what they need
+	_, entries := selectFixture(t, "selection_auxiliary.sql", nil, []string{"table:other.notes"})
+	data, err := os.ReadFile("testdata/selection_auxiliary.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(entries, "TABLE other.notes") || len(entries) != len(dumpparse.ParseString(string(data)).Objects)-1 {
+		t.Errorf("--skip table:other.notes left %d entries", len(entries))
+	}
+	checkOrder(t, entries, [][2]string{
+		{"SCHEMA ledger", "SCHEMA other"},
+		{"FUNCTION ledger.cents_add(ledger.cents, ledger.cents)", "OPERATOR ledger.+"},
+		{"FUNCTION ledger.cents_from_bigint(bigint)", "CAST CAST (bigint AS ledger.cents)"},
+		{"TABLE ledger.entries", "CONSTRAINT ledger.entries entries_pkey"},
+	})
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// apiTokenEnv holds the bearer token clients of the serve API must present
+const apiTokenEnv = "PGSM_API_TOKEN"
+
+// logPollInterval is how often a followed run log is checked for new output
+const logPollInterval = 500 * time.Millisecond
+
+// Statuses of a migration triggered through the API
+const (
+	MigrationQueued    = "queued" // Waiting for another run on the same destination
+	MigrationRunning   = "running"
+	MigrationSucceeded = "succeeded"
+	MigrationFailed    = "failed"
+	MigrationAborted   = "aborted" // Stopped or never started because the server shut down
+)
+
+// ConnectionProfile is a named connection from the serve config file.
+// Passwords are never part of a profile: they come from password_command,
+// the environment variable named by password_env, a pgpass file or IAM.
+type ConnectionProfile struct {
+	Host            string `json:"host"`
+	Port            string `json:"port,omitempty"`
+	User            string `json:"user,omitempty"`
+	Database        string `json:"database"`
+	SSLMode         string `json:"sslmode,omitempty"`
+	SSLRootCert     string `json:"sslrootcert,omitempty"`
+	SSLCert         string `json:"sslcert,omitempty"`
+	SSLKey          string `json:"sslkey,omitempty"`
+	SSLMinProtocol  string `json:"ssl_min_protocol,omitempty"`
+	Role            string `json:"role,omitempty"`
+	Options         string `json:"options,omitempty"` // Server options set at connection time (PGOPTIONS)
+	Auth            string `json:"auth,omitempty"`
+	SSH             string `json:"ssh,omitempty"`
+	PasswordCommand string `json:"password_command,omitempty"`
+	PasswordEnv     string `json:"password_env,omitempty"`
+	Environment     string `json:"environment,omitempty"` // production, staging or dev
+}
+
+// ServeConfig is the config file of the serve subcommand
+type ServeConfig struct {
+	Profiles        map[string]*ConnectionProfile `json:"profiles"`
+	BlackoutWindows []BlackoutWindow              `json:"blackout_windows,omitempty"` // Checked by each run
+
+	// The smtp_* settings, for runs requesting --notify-email: each run is
+	// given this file as --config
+	SMTPConfig
+}
+
+// profileFlags are the connection flags a profile sets, without the side prefix
+var profileFlags = []string{
+	"host", "port", "user", "db", "ssl", "sslrootcert", "sslcert", "sslkey",
+	"ssl-min-protocol", "role", "options", "auth", "ssh", "password-command", "environment",
+}
+
+// serverFlags are set by the server for every run and can't be requested
+var serverFlags = []string{"output-dir", "output", "password-stdin", "use-keyring", "ci", "config"}
+
+func loadServeConfig(path string) (*ServeConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config ServeConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields() // Catches a stray "password" as well as typos
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	for name, p := range config.Profiles {
+		if p == nil || p.Host == "" || p.Database == "" {
+			return nil, fmt.Errorf("profile %q needs a host and a database", name)
+		}
+		if p.SSLMode != "" {
+			if err := validateSSLMode(p.SSLMode); err != nil {
+				return nil, fmt.Errorf("profile %q: %v", name, err)
+			}
+		}
+		if err := validateEnvironment(p.Environment); err != nil {
+			return nil, fmt.Errorf("profile %q: environment %v", name, err)
+		}
+	}
+	if err := validateBlackoutWindows(config.BlackoutWindows); err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	if config.SMTPConfig != (SMTPConfig{}) {
+		if err := config.SMTPConfig.check(path); err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// args returns the command-line flags for the profile on one side, "source" or "dest"
+func (p *ConnectionProfile) args(prefix string) []string {
+	values := map[string]string{
+		"host":             p.Host,
+		"port":             p.Port,
+		"user":             p.User,
+		"db":               p.Database,
+		"ssl":              p.SSLMode,
+		"sslrootcert":      p.SSLRootCert,
+		"sslcert":          p.SSLCert,
+		"sslkey":           p.SSLKey,
+		"ssl-min-protocol": p.SSLMinProtocol,
+		"role":             p.Role,
+		"options":          p.Options,
+		"auth":             p.Auth,
+		"ssh":              p.SSH,
+		"password-command": p.PasswordCommand,
+		"environment":      p.Environment,
+	}
+	var args []string
+	for _, name := range profileFlags {
+		if values[name] != "" {
+			args = append(args, fmt.Sprintf("--%s-%s=%s", prefix, name, values[name]))
+		}
+	}
+	return args
+}
+
+// key identifies the database a profile points at, for serializing runs
+func (p *ConnectionProfile) key() string {
+	port := p.Port
+	if port == "" {
+		port = "5432"
+	}
+	return fmt.Sprintf("%s:%s/%s", p.Host, port, p.Database)
+}
+
+// MigrationRequest is the body of POST /migrations
+type MigrationRequest struct {
+	Source      string         `json:"source"`            // Profile name
+	Destination string         `json:"destination"`       // Profile name
+	Options     map[string]any `json:"options,omitempty"` // Command-line flags by name, without the dashes
+}
+
+// Migration is a run triggered through the API
+type Migration struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Source      string     `json:"source"`
+	Destination string     `json:"destination"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	ExitCode    *int       `json:"exit_code,omitempty"`
+	Phase       string     `json:"phase,omitempty"` // Last completed step, or the phase that failed
+	Steps       []string   `json:"steps,omitempty"`
+	Summary     *RunResult `json:"summary,omitempty"` // Result of the finished run, from its manifest
+
+	dir     string
+	destKey string
+	args    []string
+	env     []string
+	cmd     *exec.Cmd
+	aborted bool
+	done    chan struct{}
+}
+
+// migrationServer runs migrations as child processes of this binary, so each
+// run has its own logger, cleanups and exit code
+type migrationServer struct {
+	token      string
+	executable string
+	root       *cobra.Command
+	config     *ServeConfig
+	configPath string // Passed to runs, which check its blackout windows
+	outputDir  string
+
+	mu         sync.Mutex
+	migrations map[string]*Migration
+	destLocks  map[string]chan struct{}
+	stopping   chan struct{} // Closed on shutdown
+	runs       sync.WaitGroup
+}
+
+func newServeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Run an HTTP API for triggering migrations",
+		Long: "Serve a small HTTP API that runs migrations between the connection profiles of a config file. " +
+			"Clients authenticate with the bearer token in $" + apiTokenEnv + ". " +
+			"Runs on the same destination execute one at a time.",
+		Args: cobra.NoArgs,
+		RunE: runServe,
+	}
+
+	cmd.Flags().StringP("listen", "", ":8080", "Address to listen on")
+	cmd.Flags().StringP("config", "", "", "Config file with the connection profiles (required)")
+	cmd.Flags().DurationP("shutdown-grace", "", time.Minute, "How long in-flight runs may continue after SIGTERM before they are aborted")
+	return cmd
+}
+
+func runServe(cmd *cobra.Command, args []string) error {
+	listen, _ := cmd.Flags().GetString("listen")
+	configPath, _ := cmd.Flags().GetString("config")
+	grace, _ := cmd.Flags().GetDuration("shutdown-grace")
+	outputDir, _ := cmd.Flags().GetString("output-dir")
+
+	token := os.Getenv(apiTokenEnv)
+	if token == "" {
+		return exitWith(exitOptionError, fmt.Errorf("$%s must be set to the API bearer token", apiTokenEnv))
+	}
+	if configPath == "" {
+		return exitWith(exitOptionError, errors.New("--config is required"))
+	}
+	config, err := loadServeConfig(configPath)
+	if err != nil {
+		return exitWith(exitOptionError, err)
+	}
+	if configPath, err = filepath.Abs(configPath); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Failed to locate the pg-schema-migrate binary: %v", err))
+	}
+
+	s := &migrationServer{
+		token:      token,
+		executable: executable,
+		root:       cmd.Root(),
+		config:     config,
+		configPath: configPath,
+		outputDir:  outputDir,
+		migrations: make(map[string]*Migration),
+		destLocks:  make(map[string]chan struct{}),
+		stopping:   make(chan struct{}),
+	}
+	srv := &http.Server{Addr: listen, Handler: s.handler()}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.ListenAndServe() }()
+	logger.Info(fmt.Sprintf("Serving the migration API on %s with %d connection profile(s)", listen, len(config.Profiles)))
+
+	select {
+	case err := <-serveErr:
+		return exitWith(exitFailure, fmt.Errorf("Server failed: %v", err))
+	case sig := <-signals:
+		logger.Warning(fmt.Sprintf("Received %s, no longer accepting migrations", sig))
+	}
+	s.shutdown(grace, signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warning(fmt.Sprintf("Server shutdown: %v", err))
+	}
+	logger.Info("Server stopped")
+	return nil
+}
+
+// shutdown stops new runs and waits for the ones in flight, aborting them
+// once the grace period ends or a second signal arrives
+func (s *migrationServer) shutdown(grace time.Duration, signals <-chan os.Signal) {
+	s.mu.Lock()
+	close(s.stopping)
+	s.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		s.runs.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return
+	case <-time.After(grace):
+		logger.Warning(fmt.Sprintf("Runs still in flight after %s, aborting them", grace))
+	case <-signals:
+		logger.Warning("Received a second signal, aborting runs in flight")
+	}
+	s.abortRunning()
+	<-finished
+}
+
+// abortRunning asks every running child to stop, which runs its cleanups
+func (s *migrationServer) abortRunning() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.migrations {
+		if m.cmd == nil || m.cmd.Process == nil || m.FinishedAt != nil {
+			continue
+		}
+		m.aborted = true
+		if err := m.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			m.cmd.Process.Kill()
+		}
+	}
+}
+
+func (s *migrationServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /migrations", s.handleCreate)
+	mux.HandleFunc("GET /migrations/{id}", s.handleStatus)
+	mux.HandleFunc("GET /migrations/{id}/log", s.handleLog)
+	return s.authenticate(mux)
+}
+
+// authenticate rejects requests without the bearer token
+func (s *migrationServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func (s *migrationServer) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var req MigrationRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+
+	m, err := s.newMigration(&req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	select {
+	case <-s.stopping:
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusServiceUnavailable, "server is shutting down")
+		return
+	default:
+	}
+	s.migrations[m.ID] = m
+	s.runs.Add(1)
+	s.mu.Unlock()
+
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		s.finish(m, MigrationFailed, nil)
+		s.runs.Done()
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("failed to create run directory: %v", err))
+		return
+	}
+	logger.Info(fmt.Sprintf("Migration %s queued: %s -> %s", m.ID, m.Source, m.Destination))
+	go s.run(m)
+
+	writeJSON(w, http.StatusAccepted, s.status(m))
+}
+
+// newMigration turns a request into the command line of a run
+func (s *migrationServer) newMigration(req *MigrationRequest) (*Migration, error) {
+	source, ok := s.config.Profiles[req.Source]
+	if !ok {
+		return nil, fmt.Errorf("unknown source profile %q", req.Source)
+	}
+	dest, ok := s.config.Profiles[req.Destination]
+	if !ok {
+		return nil, fmt.Errorf("unknown destination profile %q", req.Destination)
+	}
+	options, err := s.optionArgs(req.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := newMigrationID()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(s.outputDir, id)
+
+	args := append(source.args("source"), dest.args("dest")...)
+	args = append(args, options...)
+	args = append(args, "--output-dir="+dir, "--config="+s.configPath)
+
+	env := make([]string, 0, len(os.Environ())+2)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, apiTokenEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	for _, side := range []struct {
+		profile *ConnectionProfile
+		envName string
+	}{{source, "PGSM_SOURCE_PASSWORD"}, {dest, "PGSM_DEST_PASSWORD"}} {
+		if side.profile.PasswordEnv != "" {
+			env = append(env, side.envName+"="+os.Getenv(side.profile.PasswordEnv))
+		}
+	}
+
+	return &Migration{
+		ID:          id,
+		Status:      MigrationQueued,
+		Source:      req.Source,
+		Destination: req.Destination,
+		CreatedAt:   time.Now(),
+		dir:         dir,
+		destKey:     dest.key(),
+		args:        args,
+		env:         env,
+		done:        make(chan struct{}),
+	}, nil
+}
+
+// optionArgs converts the options of a request to command-line flags,
+// refusing flags that profiles or the server set
+func (s *migrationServer) optionArgs(options map[string]any) ([]string, error) {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var args []string
+	for _, name := range names {
+		if reservedOption(name) {
+			return nil, fmt.Errorf("option %q is set by the connection profiles or the server", name)
+		}
+		if s.root.Flags().Lookup(name) == nil && s.root.PersistentFlags().Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown option %q", name)
+		}
+
+		values, ok := options[name].([]any)
+		if !ok {
+			values = []any{options[name]}
+		}
+		for _, v := range values {
+			switch v := v.(type) {
+			case bool:
+				args = append(args, fmt.Sprintf("--%s=%t", name, v))
+			case string:
+				args = append(args, fmt.Sprintf("--%s=%s", name, v))
+			case float64:
+				args = append(args, fmt.Sprintf("--%s=%s", name, strconv.FormatFloat(v, 'f', -1, 64)))
+			default:
+				return nil, fmt.Errorf("option %q must be a string, number, boolean or a list of them", name)
+			}
+		}
+	}
+	return args, nil
+}
+
+func reservedOption(name string) bool {
+	if strings.Contains(name, "password") {
+		return true
+	}
+	for _, flag := range serverFlags {
+		if name == flag {
+			return true
+		}
+	}
+	for _, flag := range profileFlags {
+		if name == "source-"+flag || name == "dest-"+flag {
+			return true
+		}
+	}
+	return false
+}
+
+func newMigrationID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return time.Now().Format("20060102_150405") + "_" + hex.EncodeToString(b), nil
+}
+
+// destLock returns the lock serializing runs on one destination
+func (s *migrationServer) destLock(key string) chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lock, ok := s.destLocks[key]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		s.destLocks[key] = lock
+	}
+	return lock
+}
+
+// run waits for the destination to be free, then runs the migration as a
+// child process logging to run.log in its output directory
+func (s *migrationServer) run(m *Migration) {
+	defer s.runs.Done()
+
+	lock := s.destLock(m.destKey)
+	select {
+	case lock <- struct{}{}:
+	case <-s.stopping:
+		logger.Warning(fmt.Sprintf("Migration %s aborted before it started", m.ID))
+		s.finish(m, MigrationAborted, nil)
+		return
+	}
+	defer func() { <-lock }()
+
+	logFile, err := os.Create(filepath.Join(m.dir, "run.log"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Migration %s: failed to create log: %v", m.ID, err))
+		s.finish(m, MigrationFailed, nil)
+		return
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(s.executable, m.args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.Env = m.env
+
+	s.mu.Lock()
+	select {
+	case <-s.stopping:
+		// Shutdown began while waiting; the run must not start now
+		s.mu.Unlock()
+		s.finish(m, MigrationAborted, nil)
+		return
+	default:
+	}
+	if err := cmd.Start(); err != nil {
+		s.mu.Unlock()
+		fmt.Fprintf(logFile, "failed to start migration: %v\n", err)
+		s.finish(m, MigrationFailed, nil)
+		return
+	}
+	now := time.Now()
+	m.StartedAt = &now
+	m.Status = MigrationRunning
+	m.cmd = cmd
+	s.mu.Unlock()
+	logger.Info(fmt.Sprintf("Migration %s started", m.ID))
+
+	err = cmd.Wait()
+	code := cmd.ProcessState.ExitCode()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		fmt.Fprintf(logFile, "migration process failed: %v\n", err)
+	}
+
+	status := MigrationSucceeded
+	s.mu.Lock()
+	switch {
+	case m.aborted:
+		status = MigrationAborted
+	case code != 0:
+		status = MigrationFailed
+	}
+	s.mu.Unlock()
+	s.finish(m, status, &code)
+	logger.Info(fmt.Sprintf("Migration %s %s (exit code %d)", m.ID, status, code))
+}
+
+func (s *migrationServer) finish(m *Migration, status string, code *int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	m.Status = status
+	m.FinishedAt = &now
+	m.ExitCode = code
+	close(m.done)
+}
+
+// status returns a snapshot of the migration with the progress its child
+// has recorded in the run directory
+func (s *migrationServer) status(m *Migration) Migration {
+	s.mu.Lock()
+	snapshot := *m
+	s.mu.Unlock()
+
+	if saved, err := loadResumeState(filepath.Join(m.dir, resumeStateFile)); err == nil {
+		snapshot.Steps = saved.Steps
+		if len(saved.Steps) > 0 {
+			snapshot.Phase = saved.Steps[len(saved.Steps)-1]
+		}
+	}
+	if snapshot.FinishedAt != nil {
+		if history := loadRunHistory(m.dir); len(history) > 0 {
+			snapshot.Summary = history[0]
+			if history[0].FailedPhase != "" {
+				snapshot.Phase = history[0].FailedPhase
+			}
+		}
+	}
+	return snapshot
+}
+
+func (s *migrationServer) lookup(w http.ResponseWriter, r *http.Request) *Migration {
+	s.mu.Lock()
+	m, ok := s.migrations[r.PathValue("id")]
+	s.mu.Unlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "no such migration")
+		return nil
+	}
+	return m
+}
+
+func (s *migrationServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if m := s.lookup(w, r); m != nil {
+		writeJSON(w, http.StatusOK, s.status(m))
+	}
+}
+
+// handleLog streams the run log, following it until the run finishes or
+// the client goes away
+func (s *migrationServer) handleLog(w http.ResponseWriter, r *http.Request) {
+	m := s.lookup(w, r)
+	if m == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	flusher, _ := w.(http.Flusher)
+
+	var offset int64
+	for {
+		finished := false
+		select {
+		case <-m.done:
+			finished = true
+		default:
+		}
+
+		if file, err := os.Open(filepath.Join(m.dir, "run.log")); err == nil {
+			file.Seek(offset, io.SeekStart)
+			n, _ := io.Copy(w, file)
+			file.Close()
+			offset += n
+			if n > 0 && flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if finished {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-m.done:
+		case <-time.After(logPollInterval):
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"pg-schema-migrator/internal/dumpparse"
+)
+
+const (
+	// splitMapFile lists the files of a split schema and the object in each.
+	// It is the only thing reading a split schema relies on: file names are
+	// made for people and never parsed.
+	splitMapFile = "objects.map.json"
+
+	// splitMapVersion is the version of the objects.map.json format written
+	splitMapVersion = 1
+
+	// splitHeadFile and splitTailFile hold what comes before the first entry
+	// of the dump and after the last one
+	splitHeadFile = "_head.sql"
+	splitTailFile = "_tail.sql"
+
+	// splitNameMax bounds the object name part of a file name, in bytes
+	splitNameMax = 80
+)
+
+// invalidFileChars are the characters Windows refuses in file names, path
+// separators and control characters
+var invalidFileChars = regexp.MustCompile(`[:*?"<>|/\\\x00-\x1f]`)
+
+// reservedFileNames are device names Windows reserves with any extension
+var reservedFileNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// SplitObject is one entry of a split schema: a dump entry and its file
+type SplitObject struct {
+	Type   string `json:"type"`
+	Schema string `json:"schema"` // "-" outside schemas
+	Name   string `json:"name"`   // As pg_dump names it: with the signature of a function
+	File   string `json:"file"`   // Relative to the directory, with forward slashes
+	SHA256 string `json:"sha256"`
+}
+
+// SplitMap is objects.map.json: the files of a split schema in the order
+// they make up the dump again
+type SplitMap struct {
+	Version int           `json:"version"`
+	Source  string        `json:"source"` // The schema file split
+	Head    string        `json:"head"`   // Preamble before the first entry
+	Tail    string        `json:"tail"`   // From the trailer comment to the end
+	Objects []SplitObject `json:"objects"`
+}
+
+// shortHash is the first 8 hex digits of the sha256 of s
+func shortHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:4])
+}
+
+// sanitizeFileName makes s usable as a file name on Linux, macOS and Windows:
+// invalid characters become "_", trailing dots and spaces go, reserved
+// device names get a "_" prefix and long names are cut at a rune boundary.
+func sanitizeFileName(s string) string {
+	s = invalidFileChars.ReplaceAllString(s, "_")
+	s = strings.ReplaceAll(s, " ", "_")
+	if len(s) > splitNameMax {
+		cut := splitNameMax
+		for cut > 0 && (s[cut]&0xC0) == 0x80 {
+			cut--
+		}
+		s = s[:cut]
+	}
+	s = strings.TrimRight(s, ". ")
+	if s == "" {
+		s = "_"
+	}
+	base, _, _ := strings.Cut(strings.ToLower(s), ".")
+	if reservedFileNames[base] {
+		s = "_" + s
+	}
+	return s
+}
+
+// splitFileName is the file of an entry, without collision handling:
+// <schema>/<type>/<name>.sql, with "_global" for entries outside schemas.
+// Routines are named with a hash of their signature added, since overloads
+// share a name; a name cut to length gets one of its full name too.
+func splitFileName(o *dumpparse.Object) string {
+	schema := "_global"
+	if o.Schema != "-" {
+		schema = sanitizeFileName(o.Schema)
+	}
+	kind := sanitizeFileName(strings.ToLower(o.Type))
+
+	name := o.Name
+	routine := false
+	if i := strings.IndexByte(name, '('); i > 0 && strings.HasSuffix(name, ")") {
+		name, routine = name[:i], true
+	}
+	file := sanitizeFileName(name)
+	if routine || len(name) > splitNameMax {
+		file += "-" + shortHash(o.Name)
+	}
+	return schema + "/" + kind + "/" + file + ".sql"
+}
+
+// splitFileNames names the files of entries so that no two collide, also on
+// case-insensitive file systems: a name already taken, ignoring case, gets a
+// hash of the entry's identity and position added
+func splitFileNames(objects []*dumpparse.Object) []string {
+	names := make([]string, len(objects))
+	taken := map[string]bool{strings.ToLower(splitHeadFile): true, strings.ToLower(splitTailFile): true, strings.ToLower(splitMapFile): true}
+	for i, o := range objects {
+		name := splitFileName(o)
+		for n := 0; taken[strings.ToLower(name)]; n++ {
+			base := strings.TrimSuffix(splitFileName(o), ".sql")
+			name = fmt.Sprintf("%s-%s.sql", base, shortHash(fmt.Sprintf("%s\x00%s\x00%s\x00%d", o.Type, o.Schema, o.Name, n)))
+		}
+		taken[strings.ToLower(name)] = true
+		names[i] = name
+	}
+	return names
+}
+
+// splitSchemaFile writes a plain schema file as a directory with one file
+// per dump entry and objects.map.json, next to it under the same name
+// without .sql. Concatenating the files in map order gives the dump back
+// byte for byte.
+func splitSchemaFile(schemaFile string) (string, error) {
+	dump, err := dumpparse.ParseFile(schemaFile)
+	if err != nil {
+		return "", err
+	}
+	dir := strings.TrimSuffix(schemaFile, ".sql")
+	if dir == schemaFile {
+		dir += ".split"
+	}
+	// Only an earlier split of the same file is replaced
+	if _, err := os.Stat(dir); err == nil {
+		if !isSplitSchema(dir) {
+			return "", fmt.Errorf("%s already exists and is not a split schema", dir)
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return "", err
+		}
+	}
+
+	write := func(name, text string) (string, error) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256([]byte(text))
+		return hex.EncodeToString(sum[:]), os.WriteFile(path, []byte(text), 0644)
+	}
+
+	splitMap := &SplitMap{Version: splitMapVersion, Source: filepath.Base(schemaFile), Head: splitHeadFile, Tail: splitTailFile, Objects: []SplitObject{}}
+	if _, err := write(splitHeadFile, dump.Head); err != nil {
+		return "", err
+	}
+	if _, err := write(splitTailFile, dump.Tail); err != nil {
+		return "", err
+	}
+	for i, name := range splitFileNames(dump.Objects) {
+		o := dump.Objects[i]
+		sum, err := write(name, o.Text)
+		if err != nil {
+			return "", err
+		}
+		splitMap.Objects = append(splitMap.Objects, SplitObject{Type: o.Type, Schema: o.Schema, Name: o.Name, File: name, SHA256: sum})
+	}
+
+	data, err := json.MarshalIndent(splitMap, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, splitMapFile), append(data, '\n'), 0644); err != nil {
+		return "", err
+	}
+	logger.Info(fmt.Sprintf("Split the schema into %d files in %s", len(splitMap.Objects), dir))
+	return dir, nil
+}
+
+// isSplitSchema reports whether path is a directory written by splitSchemaFile
+func isSplitSchema(path string) bool {
+	_, err := os.Stat(filepath.Join(path, splitMapFile))
+	return err == nil
+}
+
+// readSplitFile reads a file named in the map of a split schema, refusing
+// names leading outside the directory. It also reports whether the file was
+// edited since the split.
+func readSplitFile(dir, name, sum string) (string, bool, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", false, fmt.Errorf("%s names %q, outside the directory", splitMapFile, name)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, clean))
+	if err != nil {
+		return "", false, err
+	}
+	actual := sha256.Sum256(data)
+	return string(data), sum != "" && hex.EncodeToString(actual[:]) != sum, nil
+}
+
+// joinSplitSchema puts a split schema back together into a temporary SQL
+// script, reading the files objects.map.json lists in its order. Files not in
+// the map are left out, and files edited since the split are used as they
+// are, each with a warning.
+func joinSplitSchema(dir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, splitMapFile))
+	if err != nil {
+		return "", err
+	}
+	var splitMap SplitMap
+	if err := json.Unmarshal(data, &splitMap); err != nil {
+		return "", fmt.Errorf("invalid %s: %v", splitMapFile, err)
+	}
+	if splitMap.Version > splitMapVersion {
+		return "", fmt.Errorf("%s has version %d; this version of the tool reads up to %d", splitMapFile, splitMap.Version, splitMapVersion)
+	}
+
+	var b strings.Builder
+	var edited []string
+	listed := map[string]bool{splitMapFile: true}
+	parts := []SplitObject{{File: splitMap.Head}}
+	parts = append(parts, splitMap.Objects...)
+	parts = append(parts, SplitObject{File: splitMap.Tail})
+	for _, part := range parts {
+		if part.File == "" {
+			continue
+		}
+		text, changed, err := readSplitFile(dir, part.File, part.SHA256)
+		if err != nil {
+			return "", err
+		}
+		if changed {
+			edited = append(edited, part.File)
+		}
+		b.WriteString(text)
+		listed[filepath.Clean(filepath.FromSlash(part.File))] = true
+	}
+
+	var unlisted []string
+	filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		if rel, err := filepath.Rel(dir, path); err == nil && !listed[rel] {
+			unlisted = append(unlisted, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if len(edited) > 0 {
+		warn(WarnSplitFilesEdited, fmt.Sprintf("%d file(s) of %s were edited since the split and are applied as edited: %s", len(edited), dir, strings.Join(edited, ", ")))
+	}
+	if len(unlisted) > 0 {
+		warn(WarnSplitFilesIgnored, fmt.Sprintf("%d file(s) in %s are not in %s and were left out: %s", len(unlisted), dir, splitMapFile, strings.Join(unlisted, ", ")))
+	}
+
+	file, err := scratchFile("split-*.sql")
+	if err != nil {
+		return "", err
+	}
+	_, err = file.WriteString(b.String())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	logger.Info(fmt.Sprintf("Joined %d objects of the split schema %s", len(splitMap.Objects), dir))
+	return file.Name(), nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Outcomes of the stale backup check
+const (
+	StaleBackupUnchanged = "unchanged"       // No writes since the backup
+	StaleBackupAccepted  = "accepted"        // --accept-stale-backup
+	StaleBackupConfirmed = "confirmed"       // Confirmed at the prompt
+	StaleBackupRetaken   = "backed-up-again" // The backup was taken again
+	StaleBackupUnknown   = "unknown"         // The counters could not be read
+)
+
+// DatabaseActivity is a reading of the cumulative statistics of a database
+type DatabaseActivity struct {
+	ReadAt     time.Time  `json:"read_at"`
+	XactCommit int64      `json:"xact_commit"`
+	TupWrites  int64      `json:"tup_writes"`            // Rows inserted, updated and deleted
+	LastCommit *time.Time `json:"last_commit,omitempty"` // pg_last_committed_xact(), with track_commit_timestamp on
+}
+
+// StaleBackupCheck is how the destination changed between its backup and
+// the drop, and what was done about it
+type StaleBackupCheck struct {
+	Backup            *DatabaseActivity `json:"backup"`
+	BeforeDrop        *DatabaseActivity `json:"before_drop,omitempty"`
+	WritesSinceBackup int64             `json:"writes_since_backup"`
+	Outcome           string            `json:"outcome"`
+}
+
+// readDatabaseActivity reads the statistics of the destination database from
+// the maintenance database, so the reading itself doesn't count. The tool's
+// own checks only read, so rows written are the measure of activity;
+// xact_commit also counts their transactions.
+func readDatabaseActivity(config *DatabaseConfig) (*DatabaseActivity, error) {
+	db, err := openDatabase(config, "postgres")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	activity := &DatabaseActivity{ReadAt: time.Now().UTC()}
+	err = db.QueryRowContext(runContext(), `
+		SELECT xact_commit, tup_inserted + tup_updated + tup_deleted
+		FROM pg_stat_database WHERE datname = $1`, config.Database).Scan(&activity.XactCommit, &activity.TupWrites)
+	if err != nil {
+		return nil, err
+	}
+
+	var trackCommits string
+	if err := db.QueryRowContext(runContext(), `SHOW track_commit_timestamp`).Scan(&trackCommits); err == nil && trackCommits == "on" {
+		var last sql.NullTime
+		if err := db.QueryRowContext(runContext(), `SELECT timestamp FROM pg_last_committed_xact()`).Scan(&last); err == nil && last.Valid {
+			activity.LastCommit = &last.Time
+		}
+	}
+	return activity, nil
+}
+
+// backupActivity takes the reading the drop is compared with, right before
+// the backup starts, so rows written while pg_dump runs, which it may not
+// see, count as written after it. A destination that doesn't exist has none.
+func backupActivity(dest *DatabaseConfig) *DatabaseActivity {
+	activity, err := readDatabaseActivity(dest)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		warn(WarnStaleBackupUnchecked, fmt.Sprintf("Could not read the activity of %s before its backup; writes before the drop go unnoticed: %v", dest.Database, err))
+		return nil
+	}
+	return activity
+}
+
+// checkStaleBackup makes sure nothing was written to the destination since
+// its backup before it is dropped: those writes would be missing from a
+// rollback. Writes are accepted with --accept-stale-backup or at the
+// prompt, which also offers to take the backup again. The maintenance
+// window, nil without one, lets pg_dump in for that.
+func checkStaleBackup(dest *DatabaseConfig, timestamp string, options *MigrationOptions, state *RunState, window *maintenanceWindow) error {
+	if state.BackupActivity == nil {
+		return nil
+	}
+	check := &StaleBackupCheck{Backup: state.BackupActivity}
+	state.StaleBackup = check
+
+	for {
+		current, err := readDatabaseActivity(dest)
+		if err != nil {
+			check.Outcome = StaleBackupUnknown
+			warn(WarnStaleBackupUnchecked, fmt.Sprintf("Could not tell whether %s changed after its backup: %v", dest.Database, err))
+			return nil
+		}
+		check.BeforeDrop = current
+		check.WritesSinceBackup = current.TupWrites - check.Backup.TupWrites
+		if check.WritesSinceBackup <= 0 {
+			if check.Outcome == "" {
+				check.Outcome = StaleBackupUnchanged
+			}
+			logger.Info(fmt.Sprintf("No writes to %s since its backup", dest.Database))
+			return nil
+		}
+
+		msg := fmt.Sprintf("%d row(s) were written to %s in %d transaction(s) after its backup at %s; a rollback would lose them",
+			check.WritesSinceBackup, dest.Database, current.XactCommit-check.Backup.XactCommit, check.Backup.ReadAt.Local().Format(time.RFC3339))
+		if current.LastCommit != nil {
+			msg += fmt.Sprintf(" (last commit on the server at %s)", current.LastCommit.Local().Format(time.RFC3339))
+		}
+		warn(WarnStaleBackup, msg)
+
+		if options.AcceptStaleBackup {
+			logger.Warning("Continuing because of --accept-stale-backup")
+			check.Outcome = StaleBackupAccepted
+			return nil
+		}
+		if !stdinIsTerminal() {
+			return fmt.Errorf("the backup of %s is stale; stop the writers and run again, or pass --accept-stale-backup to continue", dest.Database)
+		}
+
+		fmt.Fprintf(os.Stderr, "Back up %s again (b), drop it anyway (y) or stop (n)? ", dest.Database)
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read answer: %v", err)
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			check.Outcome = StaleBackupConfirmed
+			return nil
+		case "b":
+			if err := window.Suspend(); err != nil {
+				return fmt.Errorf("failed to allow connections for the backup: %v", err)
+			}
+			// The new backup replaces the stale one only once complete, so
+			// the stale one is still whole when taking it fails
+			staleFile := state.BackupFile
+			state.backupTaken, state.BackupFile = false, ""
+			err := backupDestination(dest, timestamp, options, state)
+			if resumeErr := window.Resume(); err == nil && resumeErr != nil {
+				err = fmt.Errorf("failed to block connections to destination again: %v", resumeErr)
+			}
+			if err == nil && state.BackupFile == "" {
+				err = fmt.Errorf("backing up %s again failed; the backup %s is stale", dest.Database, staleFile)
+			}
+			if err != nil {
+				state.BackupFile = valueOr(state.BackupFile, staleFile)
+				return err
+			}
+			state.checkpoint("")
+			if state.BackupActivity == nil {
+				check.Outcome = StaleBackupUnknown
+				return nil
+			}
+			check.Backup = state.BackupActivity
+			check.Outcome = StaleBackupRetaken
+		default:
+			return fmt.Errorf("stale backup not accepted")
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakePgDump puts a pg_dump first on PATH that runs script, a shell script
+// given the pg_dump arguments, with $REAL_PG_DUMP the one it replaces and
+// $FILE, $HOST, $PORT, $USER and $DB read from them
+func fakePgDump(t *testing.T, script string) {
+	t.Helper()
+	real, err := exec.LookPath("pg_dump")
+	if err != nil {
+		t.Skip("pg_dump not found")
+	}
+	dir := t.TempDir()
+	wrapper := `#!/bin/sh
+REAL_PG_DUMP='` + real + `'
+prev=
+for arg in "$@"; do
+	case "$prev" in
+	-f) FILE=$arg ;;
+	-h) HOST=$arg ;;
+	-p) PORT=$arg ;;
+	-U) USER=$arg ;;
+	-d) DB=$arg ;;
+	esac
+	prev=$arg
+done
+` + script + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "pg_dump"), []byte(wrapper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// backupTestDatabase creates an empty database with table t on the test
+// server, dropped after the test
+func backupTestDatabase(t *testing.T, name string) *DatabaseConfig {
+	t.Helper()
+	server := testServer(t)
+	dest := *server
+	dest.Database = name
+	drop := func() { execOn(t, server, server.Database, "DROP DATABASE IF EXISTS "+quoteIdentifier(name)) }
+	drop()
+	t.Cleanup(drop)
+	execOn(t, server, server.Database, "CREATE DATABASE "+quoteIdentifier(name))
+	execOn(t, &dest, name, "CREATE TABLE t (id integer)")
+	if dest.Password != "" {
+		t.Setenv("PGPASSWORD", dest.Password)
+	}
+	return &dest
+}
+
+func TestFailedBackupKeepsEarlierOne(t *testing.T) {
+	dest := backupTestDatabase(t, "pgsm_stale_backup")
+	captureLog(t)
+	options := &MigrationOptions{BackupDir: t.TempDir()}
+	state := &RunState{}
+	const timestamp = "20261017_093000"
+
+	if err := backupDestination(dest, timestamp, options, state); err != nil {
+		t.Fatal(err)
+	}
+	first := state.BackupFile
+	backup, err := os.ReadFile(first)
+	if err != nil || !strings.Contains(string(backup), "CREATE TABLE public.t ") {
+		t.Fatalf("backup %s: %v", first, err)
+	}
+
+	// Taken again under the same name, the dump writes part of its output
+	// and fails
+	fakePgDump(t, `echo '-- cut short' > "$FILE"; exit 1`)
+	for _, env := range []string{EnvStaging, EnvProduction} {
+		dest.Environment = env
+		state.BackupFile = ""
+		err := backupDestination(dest, timestamp, options, state)
+		if (err != nil) != (env == EnvProduction) {
+			t.Errorf("%s: %v", env, err)
+		}
+		if state.BackupFile != "" {
+			t.Errorf("%s: the failed backup recorded as %s", env, state.BackupFile)
+		}
+		if after, err := os.ReadFile(first); err != nil || string(after) != string(backup) {
+			t.Errorf("%s: the earlier backup was overwritten: %v", env, err)
+		}
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(options.BackupDir, "*.partial")); len(leftovers) > 0 {
+		t.Errorf("left behind: %q", leftovers)
+	}
+}
+
+func TestWritesDuringBackupAreStale(t *testing.T) {
+	dest := backupTestDatabase(t, "pgsm_stale_backup")
+	captureLog(t)
+	options := &MigrationOptions{BackupDir: t.TempDir(), AcceptStaleBackup: true}
+	state := &RunState{}
+
+	// A row is written while pg_dump runs, after it took its snapshot
+	fakePgDump(t, `"$REAL_PG_DUMP" "$@" || exit 1
+psql -h "$HOST" -p "$PORT" -U "$USER" -d "$DB" --no-password -c 'INSERT INTO t VALUES (1)' >/dev/null || exit 1`)
+	if err := backupDestination(dest, "20261017_093000", options, state); err != nil {
+		t.Fatal(err)
+	}
+	if state.BackupFile == "" || state.BackupActivity == nil {
+		t.Fatalf("no backup taken: %q, %v", state.BackupFile, state.BackupActivity)
+	}
+
+	if err := checkStaleBackup(dest, "20261017_093000", options, state, nil); err != nil {
+		t.Fatal(err)
+	}
+	if check := state.StaleBackup; check == nil || check.WritesSinceBackup < 1 || check.Outcome != StaleBackupAccepted {
+		t.Errorf("the row written during the backup went unnoticed: %+v", check)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage keeps the artifacts of runs: a local directory, or a bucket or
+// container of a cloud provider. Names are slash-separated and relative to
+// where the storage was opened; a missing artifact is an fs.ErrNotExist.
+type Storage interface {
+	// Put stores what r yields under name, replacing any artifact there. r
+	// is streamed, never read into memory as a whole.
+	Put(ctx context.Context, name string, r io.Reader) error
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the names of the artifacts starting with prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, name string) error
+	// String is the URI of the storage, for messages
+	String() string
+}
+
+// storageSchemes are the URI schemes of --output-dir, --backup-upload and of
+// the files apply and rollback read that name a cloud storage
+var storageSchemes = []string{"s3", "gs", "az"}
+
+// Retries of a storage request that failed in a way that may pass
+const (
+	storageAttempts     = 5
+	storageRetryBackoff = time.Second
+)
+
+// storageURI splits a storage URI into its scheme, its bucket (or for az,
+// account and container) and the path within. ok is false for a local path.
+func storageURI(uri string) (scheme, bucket, prefix string, ok bool) {
+	scheme, rest, found := strings.Cut(uri, "://")
+	if !found {
+		return "", "", "", false
+	}
+	for _, s := range storageSchemes {
+		if scheme == s {
+			bucket, prefix, _ = strings.Cut(rest, "/")
+			if scheme == "az" {
+				container, within, _ := strings.Cut(prefix, "/")
+				bucket, prefix = bucket+"/"+container, within
+			}
+			return scheme, bucket, strings.Trim(prefix, "/"), true
+		}
+	}
+	return "", "", "", false
+}
+
+// isStorageURI reports whether a path given on the command line names a
+// cloud storage rather than a local file
+func isStorageURI(value string) bool {
+	_, _, _, ok := storageURI(value)
+	return ok
+}
+
+// openStorage opens the storage a URI or local directory names. Cloud
+// credentials are resolved the way each provider's own tools do: the AWS
+// credential chain, Google application default credentials, and Azure's
+// default credential or AZURE_STORAGE_CONNECTION_STRING.
+func openStorage(ctx context.Context, location string, aws *AWSOptions) (Storage, error) {
+	scheme, bucket, prefix, ok := storageURI(location)
+	if !ok {
+		if strings.Contains(location, "://") {
+			return nil, fmt.Errorf("unsupported storage %q, must be a local directory or an s3://, gs:// or az:// URI", location)
+		}
+		return &localStorage{root: location}, nil
+	}
+	if bucket == "" || strings.HasSuffix(bucket, "/") {
+		return nil, fmt.Errorf("invalid storage URI %q: the bucket or container is missing", location)
+	}
+	switch scheme {
+	case "s3":
+		return openS3Storage(ctx, bucket, prefix, aws)
+	case "gs":
+		return openGCSStorage(ctx, bucket, prefix)
+	default:
+		account, container, _ := strings.Cut(bucket, "/")
+		return openAzureStorage(account, container, prefix)
+	}
+}
+
+// localStorage is a directory of the local file system
+type localStorage struct {
+	root string
+}
+
+func (s *localStorage) String() string { return s.root }
+
+func (s *localStorage) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+// Put writes a temporary file next to name and renames it, so a reader never
+// sees half an artifact
+func (s *localStorage) Put(ctx context.Context, name string, r io.Reader) error {
+	dest := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".pgsm-put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+func (s *localStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s *localStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(s.root, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return names, err
+}
+
+func (s *localStorage) Delete(ctx context.Context, name string) error {
+	return os.Remove(s.path(name))
+}
+
+// storageName joins the prefix a storage was opened at with an artifact name
+func storageName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return path.Join(prefix, name)
+}
+
+// storageListPrefix is the prefix listing the artifacts of a storage opened
+// at root whose names start with prefix. It is not cleaned like a name: "a/"
+// must not list "ab".
+func storageListPrefix(root, prefix string) string {
+	if root == "" {
+		return prefix
+	}
+	return root + "/" + prefix
+}
+
+// retryStorage runs a storage request until it succeeds, fails for good or
+// has been tried storageAttempts times, backing off exponentially with
+// jitter. A Put can only be retried when its reader can be rewound.
+func retryStorage(ctx context.Context, what string, retryable func(error) bool, request func() error) error {
+	backoff := storageRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := request()
+		if err == nil || attempt == storageAttempts || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		wait := backoff/2 + rand.N(backoff)
+		logger.Debug(fmt.Sprintf("%s failed (attempt %d of %d), retrying in %s: %v", what, attempt, storageAttempts, wait.Round(time.Millisecond), err))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// uploadFile puts a local file, or every file of a local directory, into
+// storage under name
+func uploadFile(ctx context.Context, storage Storage, local, name string) error {
+	info, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		file, err := os.Open(local)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err := storage.Put(ctx, name, file); err != nil {
+			return fmt.Errorf("failed to upload %s to %s: %v", local, storage, err)
+		}
+		logger.Debug(fmt.Sprintf("Uploaded %s to %s as %s", local, storage, name))
+		return nil
+	}
+	return filepath.WalkDir(local, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(local, p)
+		if err != nil {
+			return err
+		}
+		return uploadFile(ctx, storage, p, path.Join(name, filepath.ToSlash(rel)))
+	})
+}
+
+// stagedOutput is the local directory the files of a run are written to
+// when --output-dir is a storage URI. pg_dump and psql need local files, so
+// everything is written here as usual and put into the storage when the run
+// ends, succeeded or not.
+type stagedOutput struct {
+	storage Storage
+	dir     string
+	keep    bool // The upload failed, so the files stay
+}
+
+// stageOutput opens the storage of --output-dir and creates the local
+// directory staging its files in the scratch directory. It is removed with
+// it when the process exits, unless the upload failed.
+func stageOutput(uri string, aws *AWSOptions) (*stagedOutput, error) {
+	storage, err := openStorage(context.Background(), uri, aws)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := scratchDirectory(".pgsm-output-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the staging directory: %v", err)
+	}
+	staged := &stagedOutput{storage: storage, dir: dir}
+	registerCleanup(func() {
+		if !staged.keep {
+			os.RemoveAll(staged.dir)
+		}
+	})
+	return staged, nil
+}
+
+// keepFiles keeps the staged files after a failed upload. They are moved out
+// of the scratch directory, which goes when the process exits, to beside it;
+// should that fail, the scratch directory is kept as a whole. It returns
+// where path, a file or directory in the staging directory, is now.
+func (s *stagedOutput) keepFiles(path string) string {
+	if !s.keep {
+		s.keep = true
+		kept := filepath.Join(filepath.Dir(filepath.Dir(s.dir)), filepath.Base(s.dir))
+		if err := os.Rename(s.dir, kept); err != nil {
+			logger.Warning(fmt.Sprintf("Failed to move the staged files out of the scratch directory, keeping it: %v", err))
+			scratch.mu.Lock()
+			scratch.keep = true
+			scratch.mu.Unlock()
+			return path
+		}
+		if rel, err := filepath.Rel(s.dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+			path = filepath.Join(kept, rel)
+		}
+		s.dir = kept
+	}
+	return path
+}
+
+// uploadArtifacts puts the files of a run into the storage of --output-dir,
+// and the destination backup and rollback script taken in this run into the
+// storage of --backup-upload. It runs when the run ends, after the manifest
+// is written. A failed upload warns, and the files stay where they were
+// written.
+func uploadArtifacts(state *RunState, options *MigrationOptions) {
+	ctx := context.Background()
+	if staged := options.Staged; staged != nil {
+		logger.Info(fmt.Sprintf("Uploading the files of the run to %s...", staged.storage))
+		if err := uploadFile(ctx, staged.storage, staged.dir, ""); err != nil {
+			warn(WarnUploadFailed, fmt.Sprintf("Not all files of the run were uploaded to %s, they are kept in %s: %v", staged.storage, staged.keepFiles(staged.dir), err))
+		} else {
+			logger.Success(fmt.Sprintf("Files of the run uploaded to %s", staged.storage))
+		}
+	}
+
+	if options.BackupUpload == nil || !state.backupTaken || state.BackupFile == "" {
+		return
+	}
+	files := []string{state.BackupFile}
+	if script, err := options.artifactPath(ArtifactRollback, newArtifactNameData(state.Source, state.Dest, state.Timestamp(), state)); err == nil {
+		if _, err := os.Stat(script); err == nil {
+			files = append(files, script)
+		}
+	}
+	for _, file := range files {
+		name := filepath.Base(file)
+		if rel, err := filepath.Rel(options.BackupDir, file); err == nil && !strings.HasPrefix(rel, "..") {
+			name = filepath.ToSlash(rel)
+		}
+		if err := uploadFile(ctx, options.BackupUpload, file, name); err != nil {
+			if options.Staged != nil {
+				file = options.Staged.keepFiles(file)
+			}
+			warn(WarnUploadFailed, fmt.Sprintf("The destination backup was not uploaded to %s (--backup-upload), it is in %s: %v", options.BackupUpload, file, err))
+			return
+		}
+	}
+	logger.Success(fmt.Sprintf("Destination backup uploaded to %s", options.BackupUpload))
+}
+
+// fetchArtifact downloads the artifact a storage URI names into the scratch
+// directory and returns its local path. A URI naming a prefix rather than an
+// object, like a directory dump, is downloaded as a directory.
+func fetchArtifact(uri string) (string, error) {
+	scheme, bucket, name, _ := storageURI(uri)
+	if name == "" {
+		return "", fmt.Errorf("%s names a bucket, not a file", uri)
+	}
+	ctx := runContext()
+	storage, err := openStorage(ctx, scheme+"://"+bucket, nil)
+	if err != nil {
+		return "", err
+	}
+	dir, err := scratchDirectory("fetched-*")
+	if err != nil {
+		return "", err
+	}
+	local := filepath.Join(dir, path.Base(name))
+
+	logger.Info(fmt.Sprintf("Downloading %s...", uri))
+	err = download(ctx, storage, name, local)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return local, err
+	}
+	names, err := storage.List(ctx, name+"/")
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("%s: %w", uri, fs.ErrNotExist)
+	}
+	for _, n := range names {
+		if err := download(ctx, storage, n, filepath.Join(local, filepath.FromSlash(strings.TrimPrefix(n, name+"/")))); err != nil {
+			return "", err
+		}
+	}
+	return local, nil
+}
+
+// download copies one artifact of storage to a local file
+func download(ctx context.Context, storage Storage, name, local string) error {
+	r, err := storage.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := os.MkdirAll(filepath.Dir(local), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(local, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to download %s from %s: %v", name, storage, err)
+	}
+	return file.Close()
+}
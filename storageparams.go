@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Table settings are keyed by table and setting: a storage parameter of the
+// table like fillfactor, one of its TOAST table as toast.<name>, or a column
+// setting as "<column> STATISTICS" or "<column> STORAGE", with the column
+// quoted as in the dump
+const (
+	settingStatistics = "STATISTICS"
+	settingStorage    = "STORAGE"
+)
+
+// storageNames maps pg_attribute.attstorage to its SET STORAGE keyword
+var storageNames = map[string]string{
+	"p": "PLAIN",
+	"e": "EXTERNAL",
+	"m": "MAIN",
+	"x": "EXTENDED",
+}
+
+// How pg_dump writes the settings of a table: WITH (...) after the column
+// list of CREATE TABLE, and ALTER TABLE ONLY statements following it
+var (
+	tableOptionsPattern  = regexp.MustCompile(`\nWITH \((.+)\)(;|$)`)
+	reloptionPattern     = regexp.MustCompile(`([\w.]+)='((?:[^']|'')*)'`)
+	columnSettingPattern = regexp.MustCompile(`(?m)^ALTER TABLE ONLY (\S+) ALTER COLUMN (\S+) SET (STATISTICS|STORAGE) (\w+);\n?`)
+)
+
+// columnSetting is the setting key of a column setting
+func columnSetting(column, kind string) string {
+	return column + " " + kind
+}
+
+// splitTableSettings takes the storage parameters and the column statistics
+// targets and storage modes out of what follows the column list of a CREATE
+// TABLE in a dump, so tables differing only in those can be altered
+func splitTableSettings(tail string) (rest string, settings map[string]string) {
+	settings = make(map[string]string)
+	if m := tableOptionsPattern.FindStringSubmatch(tail); m != nil {
+		for _, option := range reloptionPattern.FindAllStringSubmatch(m[1], -1) {
+			settings[option[1]] = strings.ReplaceAll(option[2], "''", "'")
+		}
+		tail = tableOptionsPattern.ReplaceAllString(tail, "$2")
+	}
+	for _, m := range columnSettingPattern.FindAllStringSubmatch(tail, -1) {
+		settings[columnSetting(m[2], m[3])] = m[4]
+	}
+	return strings.TrimSpace(columnSettingPattern.ReplaceAllString(tail, "")), settings
+}
+
+// tableSettingStatement sets a table setting to value, or back to its default
+// when value is "". defaultStorage is the storage mode of the column's type,
+// where known.
+func tableSettingStatement(table, setting, value, defaultStorage string) string {
+	if column, ok := strings.CutSuffix(setting, " "+settingStatistics); ok {
+		if value == "" {
+			value = "-1"
+		}
+		return fmt.Sprintf("ALTER TABLE ONLY %s ALTER COLUMN %s SET STATISTICS %s;", table, column, value)
+	}
+	if column, ok := strings.CutSuffix(setting, " "+settingStorage); ok {
+		if value == "" {
+			value = defaultStorage
+		}
+		if value == "" {
+			value = "DEFAULT" // PostgreSQL 16 and later
+		}
+		return fmt.Sprintf("ALTER TABLE ONLY %s ALTER COLUMN %s SET STORAGE %s;", table, column, value)
+	}
+	if value == "" {
+		return fmt.Sprintf("ALTER TABLE ONLY %s RESET (%s);", table, setting)
+	}
+	return fmt.Sprintf("ALTER TABLE ONLY %s SET (%s='%s');", table, setting, strings.ReplaceAll(value, "'", "''"))
+}
+
+// settingChanges lists the statements bringing the settings have of a table
+// to want. The settings of the columns in dropped went with them; those of
+// columns added again are set anew.
+func settingChanges(table string, want, have map[string]string, dropped map[string]bool) []string {
+	keys := make(map[string]bool)
+	for key := range want {
+		keys[key] = true
+	}
+	for key := range have {
+		keys[key] = true
+	}
+	var changes []string
+	for _, key := range slices.Sorted(maps.Keys(keys)) {
+		current := have[key]
+		if column, _, ok := strings.Cut(key, " "); ok && dropped[column] {
+			current = ""
+		}
+		if want[key] != current {
+			changes = append(changes, tableSettingStatement(table, key, want[key], ""))
+		}
+	}
+	return changes
+}
+
+// tableSettings reads the storage parameters of the tables of a database and
+// of their TOAST tables, and the column statistics targets and storage modes
+// that differ from the defaults. storageDefaults holds the storage mode of
+// every column's type, for resetting one.
+func tableSettings(db *sql.DB) (settings map[[2]string]string, storageDefaults map[[2]string]string, err error) {
+	settings = make(map[[2]string]string)
+	storageDefaults = make(map[[2]string]string)
+
+	rows, err := db.QueryContext(runContext(), `
+		SELECT format('%I.%I', n.nspname, c.relname), o.option
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		CROSS JOIN unnest(c.reloptions) AS o(option)
+		WHERE c.relkind IN ('r', 'p') AND `+userSchemas+`
+		UNION ALL
+		SELECT format('%I.%I', n.nspname, c.relname), 'toast.' || o.option
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_class t ON t.oid = c.reltoastrelid
+		CROSS JOIN unnest(t.reloptions) AS o(option)
+		WHERE c.relkind IN ('r', 'p') AND `+userSchemas)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, option string
+		if err := rows.Scan(&table, &option); err != nil {
+			return nil, nil, err
+		}
+		name, value, _ := strings.Cut(option, "=")
+		settings[[2]string{table, name}] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// attstattarget is NULL by default from PostgreSQL 17, -1 before
+	columns, err := db.QueryContext(runContext(), `
+		SELECT format('%I.%I', n.nspname, c.relname), quote_ident(a.attname),
+		       coalesce(a.attstattarget, -1)::int, a.attstorage::text, ty.typstorage::text
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_type ty ON ty.oid = a.atttypid
+		WHERE a.attnum > 0 AND NOT a.attisdropped AND c.relkind IN ('r', 'p') AND `+userSchemas)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer columns.Close()
+	for columns.Next() {
+		var table, column, storage, typeStorage string
+		var target int
+		if err := columns.Scan(&table, &column, &target, &storage, &typeStorage); err != nil {
+			return nil, nil, err
+		}
+		if target >= 0 {
+			settings[[2]string{table, columnSetting(column, settingStatistics)}] = strconv.Itoa(target)
+		}
+		key := [2]string{table, columnSetting(column, settingStorage)}
+		if storage != typeStorage {
+			settings[key] = storageNames[storage]
+		}
+		storageDefaults[key] = storageNames[typeStorage]
+	}
+	return settings, storageDefaults, columns.Err()
+}
+
+// declaredSettings reads the tables a plain-format schema file creates and
+// their settings, for when there is no source to compare with
+func declaredSettings(schemaFile string) (settings map[[2]string]string, tables map[string]bool, err error) {
+	if info, err := os.Stat(schemaFile); err != nil || info.IsDir() || isDumpArchive(schemaFile) {
+		return nil, nil, err
+	}
+	statements, err := splitScriptStatements(schemaFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	settings = make(map[[2]string]string)
+	tables = make(map[string]bool)
+	for _, s := range statements {
+		first, _, _ := strings.Cut(s.text, "\n")
+		if m := createTablePattern.FindStringSubmatch(first); m != nil {
+			tables[m[1]] = true
+			_, declared := splitTableSettings(s.text)
+			for name, value := range declared {
+				settings[[2]string{m[1], name}] = value
+			}
+			continue
+		}
+		if m := columnSettingPattern.FindStringSubmatch(s.text); m != nil {
+			settings[[2]string{m[1], columnSetting(m[2], m[3])}] = m[4]
+		}
+	}
+	return settings, tables, nil
+}
+
+// settingTables lists the tables of a database by the storage defaults of
+// their columns, which every table with columns has
+func settingTables(storageDefaults map[[2]string]string) map[string]bool {
+	tables := make(map[string]bool)
+	for key := range storageDefaults {
+		tables[key[0]] = true
+	}
+	return tables
+}
+
+// readTableSettings reads the table settings of a database, once more on a
+// new connection should the first have been dropped
+func readTableSettings(config *DatabaseConfig, side string, open func(*DatabaseConfig, string) (*sql.DB, error)) (settings, storageDefaults map[[2]string]string, err error) {
+	err = retryOnReconnect(config, "verifying", func() error {
+		db, err := open(config, config.Database)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if settings, storageDefaults, err = tableSettings(db); err != nil {
+			return fmt.Errorf("failed to read %s table settings: %w", side, err)
+		}
+		return nil
+	})
+	return settings, storageDefaults, err
+}
+
+// verifyTableSettings compares the storage parameters, statistics targets
+// and storage modes of the destination's tables with the source, or with the
+// schema file when there is no source. Tables missing on either side are
+// left to the other checks.
+func verifyTableSettings(source, dest *DatabaseConfig, schemaFile string) ([]VerifyDiscrepancy, error) {
+	have, storageDefaults, err := readTableSettings(dest, "destination", openDatabase)
+	if err != nil {
+		return nil, err
+	}
+	var want map[[2]string]string
+	var expectedTables map[string]bool
+	if source != nil {
+		var sourceDefaults map[[2]string]string
+		if want, sourceDefaults, err = readTableSettings(source, "source", openDB); err != nil {
+			return nil, err
+		}
+		expectedTables = settingTables(sourceDefaults)
+	} else if schemaFile != "" {
+		if want, expectedTables, err = declaredSettings(schemaFile); err != nil {
+			return nil, err
+		}
+	}
+	if want == nil {
+		return nil, nil
+	}
+
+	// Only tables on both sides
+	destTables := settingTables(storageDefaults)
+	keys := make(map[[2]string]bool)
+	for _, settings := range []map[[2]string]string{want, have} {
+		for key := range settings {
+			if destTables[key[0]] && expectedTables[key[0]] {
+				keys[key] = true
+			}
+		}
+	}
+
+	var discrepancies []VerifyDiscrepancy
+	for key := range keys {
+		expected, current := want[key], have[key]
+		if expected == current {
+			continue
+		}
+		describe := func(value string) string {
+			if value == "" {
+				return "the default"
+			}
+			return value
+		}
+		discrepancies = append(discrepancies, VerifyDiscrepancy{
+			Table:   key[0],
+			Name:    key[1],
+			Problem: fmt.Sprintf("table setting is %s, expected %s", describe(current), describe(expected)),
+			Fix:     tableSettingStatement(key[0], key[1], expected, storageDefaults[key]),
+		})
+	}
+	sort.Slice(discrepancies, func(i, j int) bool {
+		if discrepancies[i].Table != discrepancies[j].Table {
+			return discrepancies[i].Table < discrepancies[j].Table
+		}
+		return discrepancies[i].Name < discrepancies[j].Name
+	})
+	return discrepancies, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// settingsDump parses testdata/partition_settings.sql after edit
+func settingsDump(t *testing.T, edit func(string) string) []dumpEntry {
+	t.Helper()
+	path := copyTestdata(t, "partition_settings.sql")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(edit(string(data))), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, entries, err := parseDumpEntries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// settingsPattern matches the settings pg_dump writes for a table
+var settingsPattern = regexp.MustCompile(`\nWITH \(.*\)|(?m)^ALTER TABLE ONLY \S+ ALTER COLUMN .* SET (STATISTICS|STORAGE) .*;\n`)
+
+func TestPartitionSettingChanges(t *testing.T) {
+	unchanged := func(dump string) string { return dump }
+	bare := func(dump string) string { return settingsPattern.ReplaceAllString(dump, "") }
+	want := settingsDump(t, unchanged)
+
+	// Settings of the parent stay on it, and each partition gets its own
+	got := changeSQL(diffDumps(want, settingsDump(t, bare), false, 170000, false))
+	wantChanges := []string{
+		"alter ALTER TABLE ONLY public.measurements ALTER COLUMN note SET STORAGE EXTERNAL;\n" +
+			"ALTER TABLE ONLY public.measurements ALTER COLUMN reading SET STATISTICS 500;",
+		"alter ALTER TABLE ONLY public.measurements_2025 SET (autovacuum_enabled='false');\n" +
+			"ALTER TABLE ONLY public.measurements_2025 SET (fillfactor='100');\n" +
+			"ALTER TABLE ONLY public.measurements_2025 ALTER COLUMN note SET STORAGE EXTERNAL;\n" +
+			"ALTER TABLE ONLY public.measurements_2025 ALTER COLUMN reading SET STATISTICS 1000;\n" +
+			"ALTER TABLE ONLY public.measurements_2025 SET (toast.autovacuum_enabled='false');",
+		"alter ALTER TABLE ONLY public.measurements_2026 SET (autovacuum_vacuum_scale_factor='0.02');\n" +
+			"ALTER TABLE ONLY public.measurements_2026 SET (fillfactor='70');\n" +
+			"ALTER TABLE ONLY public.measurements_2026 ALTER COLUMN note SET STORAGE EXTERNAL;\n" +
+			"ALTER TABLE ONLY public.measurements_2026 ALTER COLUMN reading SET STATISTICS 500;\n" +
+			"ALTER TABLE ONLY public.measurements_2026 SET (toast.autovacuum_vacuum_scale_factor='0.05');",
+	}
+	if !slices.Equal(got, wantChanges) {
+		t.Errorf("settings added:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(wantChanges, "\n"))
+	}
+
+	// Settings no longer wanted are reset on the table they are on only
+	less := settingsDump(t, func(dump string) string {
+		dump = strings.Replace(dump, "ALTER TABLE ONLY public.measurements ALTER COLUMN reading SET STATISTICS 500;\n", "", 1)
+		return strings.Replace(dump, "WITH (fillfactor='70', autovacuum_vacuum_scale_factor='0.02', toast.autovacuum_vacuum_scale_factor='0.05');", "WITH (fillfactor='90');", 1)
+	})
+	got = changeSQL(diffDumps(less, want, false, 170000, false))
+	wantChanges = []string{
+		"alter ALTER TABLE ONLY public.measurements ALTER COLUMN reading SET STATISTICS -1;",
+		"alter ALTER TABLE ONLY public.measurements_2026 RESET (autovacuum_vacuum_scale_factor);\n" +
+			"ALTER TABLE ONLY public.measurements_2026 SET (fillfactor='90');\n" +
+			"ALTER TABLE ONLY public.measurements_2026 RESET (toast.autovacuum_vacuum_scale_factor);",
+	}
+	if !slices.Equal(got, wantChanges) {
+		t.Errorf("settings removed:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(wantChanges, "\n"))
+	}
+}
+
+func TestDeclaredPartitionSettings(t *testing.T) {
+	settings, tables, err := declaredSettings(copyTestdata(t, "partition_settings.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"public.measurements", "public.measurements_2025", "public.measurements_2026"} {
+		if !tables[table] {
+			t.Errorf("%s not declared", table)
+		}
+	}
+	for key, value := range map[[2]string]string{
+		{"public.measurements", "reading STATISTICS"}:                        "500",
+		{"public.measurements", "note STORAGE"}:                              "EXTERNAL",
+		{"public.measurements_2025", "fillfactor"}:                           "100",
+		{"public.measurements_2025", "toast.autovacuum_enabled"}:             "false",
+		{"public.measurements_2025", "reading STATISTICS"}:                   "1000",
+		{"public.measurements_2026", "autovacuum_vacuum_scale_factor"}:       "0.02",
+		{"public.measurements_2026", "toast.autovacuum_vacuum_scale_factor"}: "0.05",
+		{"public.measurements_2026", "note STORAGE"}:                         "EXTERNAL",
+	} {
+		if settings[key] != value {
+			t.Errorf("%s %s: %q, want %q", key[0], key[1], settings[key], value)
+		}
+	}
+	if len(settings) != 12 {
+		t.Errorf("%d settings declared, want 12: %v", len(settings), settings)
+	}
+}
+
+func TestVerifyPartitionSettings(t *testing.T) {
+	server := testServer(t)
+	dest := *server
+	dest.Database = "pgsm_partition_settings"
+	drop := func() { execOn(t, server, server.Database, "DROP DATABASE IF EXISTS "+quoteIdentifier(dest.Database)) }
+	drop()
+	t.Cleanup(drop)
+	execOn(t, server, server.Database, "CREATE DATABASE "+quoteIdentifier(dest.Database))
+	captureLog(t)
+
+	schemaFile := copyTestdata(t, "partition_settings.sql")
+	schema, err := os.ReadFile(schemaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execOn(t, &dest, dest.Database, string(schema))
+
+	// What the server holds is what the dump declares
+	db, err := openDatabase(&dest, dest.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	have, _, err := tableSettings(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	declared, _, err := declaredSettings(schemaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range declared {
+		if have[key] != value {
+			t.Errorf("%s %s: %q on the server, %q in the dump", key[0], key[1], have[key], value)
+		}
+	}
+
+	execOn(t, &dest, dest.Database,
+		"ALTER TABLE ONLY public.measurements ALTER COLUMN reading SET STATISTICS 10",
+		"ALTER TABLE public.measurements_2026 SET (fillfactor = 50)",
+		"ALTER TABLE public.measurements_2025 RESET (toast.autovacuum_enabled)")
+	discrepancies, err := verifyTableSettings(nil, &dest, schemaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixes []string
+	for _, d := range discrepancies {
+		fixes = append(fixes, d.Fix)
+	}
+	wantFixes := []string{
+		"ALTER TABLE ONLY public.measurements ALTER COLUMN reading SET STATISTICS 500;",
+		"ALTER TABLE ONLY public.measurements_2025 SET (toast.autovacuum_enabled='false');",
+		"ALTER TABLE ONLY public.measurements_2026 SET (fillfactor='70');",
+	}
+	if !slices.Equal(fixes, wantFixes) {
+		t.Fatalf("fixes %q, want %q", fixes, wantFixes)
+	}
+
+	// The fixes bring the parent and each partition back, and only them
+	execOn(t, &dest, dest.Database, fixes...)
+	if discrepancies, err := verifyTableSettings(nil, &dest, schemaFile); err != nil || len(discrepancies) > 0 {
+		t.Errorf("after the fixes: %+v, %v", discrepancies, err)
+	}
+}
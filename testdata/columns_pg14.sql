@@ -0,0 +1,117 @@
+--
+-- PostgreSQL database dump
+--
+
+-- Dumped from database version 14.17
+-- Dumped by pg_dump version 14.17
+
+SET statement_timeout = 0;
+SET lock_timeout = 0;
+SET idle_in_transaction_session_timeout = 0;
+SET client_encoding = 'UTF8';
+SET standard_conforming_strings = on;
+SELECT pg_catalog.set_config('search_path', '', false);
+SET check_function_bodies = false;
+SET xmloption = content;
+SET client_min_messages = warning;
+SET row_security = off;
+
+--
+-- Name: shop; Type: SCHEMA; Schema: -; Owner: app
+--
+
+CREATE SCHEMA shop;
+
+
+ALTER SCHEMA shop OWNER TO app;
+
+SET default_tablespace = '';
+
+SET default_table_access_method = heap;
+
+--
+-- Name: order_lines; Type: TABLE; Schema: shop; Owner: app
+--
+
+CREATE TABLE shop.order_lines (
+    id bigint NOT NULL,
+    order_id integer NOT NULL,
+    quantity integer NOT NULL,
+    unit_price numeric(10,2) NOT NULL,
+    total numeric GENERATED ALWAYS AS (((quantity)::numeric * unit_price)) STORED,
+    sku text NOT NULL,
+    sku_key text GENERATED ALWAYS AS (lower(TRIM(BOTH FROM sku))) STORED
+);
+
+
+ALTER TABLE shop.order_lines OWNER TO app;
+
+--
+-- Name: order_lines_id_seq; Type: SEQUENCE; Schema: shop; Owner: app
+--
+
+ALTER TABLE shop.order_lines ALTER COLUMN id ADD GENERATED BY DEFAULT AS IDENTITY (
+    SEQUENCE NAME shop.order_lines_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: orders; Type: TABLE; Schema: shop; Owner: app
+--
+
+CREATE TABLE shop.orders (
+    id integer NOT NULL,
+    placed_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE shop.orders OWNER TO app;
+
+--
+-- Name: orders_id_seq; Type: SEQUENCE; Schema: shop; Owner: app
+--
+
+ALTER TABLE shop.orders ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME shop.orders_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: order_lines order_lines_pkey; Type: CONSTRAINT; Schema: shop; Owner: app
+--
+
+ALTER TABLE ONLY shop.order_lines
+    ADD CONSTRAINT order_lines_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: orders orders_pkey; Type: CONSTRAINT; Schema: shop; Owner: app
+--
+
+ALTER TABLE ONLY shop.orders
+    ADD CONSTRAINT orders_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: order_lines order_lines_order_id_fkey; Type: FK CONSTRAINT; Schema: shop; Owner: app
+--
+
+ALTER TABLE ONLY shop.order_lines
+    ADD CONSTRAINT order_lines_order_id_fkey FOREIGN KEY (order_id) REFERENCES shop.orders(id);
+
+
+--
+-- PostgreSQL database dump complete
+--
+
@@ -0,0 +1,74 @@
+--
+-- PostgreSQL database dump
+--
+
+SET statement_timeout = 0;
+SET client_encoding = 'UTF8';
+
+SET default_tablespace = '';
+
+--
+-- Name: measurements; Type: TABLE; Schema: public; Owner: app
+--
+
+CREATE TABLE public.measurements (
+    id bigint NOT NULL,
+    taken date NOT NULL,
+    reading numeric NOT NULL,
+    note text
+)
+PARTITION BY RANGE (taken);
+ALTER TABLE ONLY public.measurements ALTER COLUMN reading SET STATISTICS 500;
+ALTER TABLE ONLY public.measurements ALTER COLUMN note SET STORAGE EXTERNAL;
+
+
+SET default_table_access_method = heap;
+
+--
+-- Name: measurements_2025; Type: TABLE; Schema: public; Owner: app
+--
+
+CREATE TABLE public.measurements_2025 (
+    id bigint NOT NULL,
+    taken date NOT NULL,
+    reading numeric NOT NULL,
+    note text
+)
+WITH (fillfactor='100', autovacuum_enabled='false', toast.autovacuum_enabled='false');
+ALTER TABLE ONLY public.measurements_2025 ALTER COLUMN reading SET STATISTICS 1000;
+ALTER TABLE ONLY public.measurements_2025 ALTER COLUMN note SET STORAGE EXTERNAL;
+
+
+--
+-- Name: measurements_2026; Type: TABLE; Schema: public; Owner: app
+--
+
+CREATE TABLE public.measurements_2026 (
+    id bigint NOT NULL,
+    taken date NOT NULL,
+    reading numeric NOT NULL,
+    note text
+)
+WITH (fillfactor='70', autovacuum_vacuum_scale_factor='0.02', toast.autovacuum_vacuum_scale_factor='0.05');
+ALTER TABLE ONLY public.measurements_2026 ALTER COLUMN reading SET STATISTICS 500;
+ALTER TABLE ONLY public.measurements_2026 ALTER COLUMN note SET STORAGE EXTERNAL;
+
+
+--
+-- Name: measurements_2025; Type: TABLE ATTACH; Schema: public; Owner: app
+--
+
+ALTER TABLE ONLY public.measurements ATTACH PARTITION public.measurements_2025 FOR VALUES FROM ('2025-01-01') TO ('2026-01-01');
+
+
+--
+-- Name: measurements_2026; Type: TABLE ATTACH; Schema: public; Owner: app
+--
+
+ALTER TABLE ONLY public.measurements ATTACH PARTITION public.measurements_2026 FOR VALUES FROM ('2026-01-01') TO ('2027-01-01');
+
+
+--
+-- PostgreSQL database dump complete
+--
+
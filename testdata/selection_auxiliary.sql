@@ -0,0 +1,299 @@
+--
+-- PostgreSQL database dump
+--
+
+-- Dumped from database version 16.8
+-- Dumped by pg_dump version 16.8
+
+SET statement_timeout = 0;
+SET lock_timeout = 0;
+SET idle_in_transaction_session_timeout = 0;
+SET client_encoding = 'UTF8';
+SET standard_conforming_strings = on;
+SELECT pg_catalog.set_config('search_path', '', false);
+SET check_function_bodies = false;
+SET xmloption = content;
+SET client_min_messages = warning;
+SET row_security = off;
+
+--
+-- Name: ledger; Type: SCHEMA; Schema: -; Owner: app
+--
+
+CREATE SCHEMA ledger;
+
+
+ALTER SCHEMA ledger OWNER TO app;
+
+--
+-- Name: other; Type: SCHEMA; Schema: -; Owner: app
+--
+
+CREATE SCHEMA other;
+
+
+ALTER SCHEMA other OWNER TO app;
+
+--
+-- Name: cents; Type: SHELL TYPE; Schema: ledger; Owner: app
+--
+
+CREATE TYPE ledger.cents;
+
+
+--
+-- Name: cents_in(cstring); Type: FUNCTION; Schema: ledger; Owner: app
+--
+
+CREATE FUNCTION ledger.cents_in(cstring) RETURNS ledger.cents
+    LANGUAGE internal IMMUTABLE STRICT
+    AS $$int8in$$;
+
+
+ALTER FUNCTION ledger.cents_in(cstring) OWNER TO app;
+
+--
+-- Name: cents_out(ledger.cents); Type: FUNCTION; Schema: ledger; Owner: app
+--
+
+CREATE FUNCTION ledger.cents_out(ledger.cents) RETURNS cstring
+    LANGUAGE internal IMMUTABLE STRICT
+    AS $$int8out$$;
+
+
+ALTER FUNCTION ledger.cents_out(ledger.cents) OWNER TO app;
+
+--
+-- Name: cents; Type: TYPE; Schema: ledger; Owner: app
+--
+
+CREATE TYPE ledger.cents (
+    INTERNALLENGTH = 8,
+    INPUT = ledger.cents_in,
+    OUTPUT = ledger.cents_out,
+    ALIGNMENT = double,
+    STORAGE = plain,
+    PASSEDBYVALUE
+);
+
+
+ALTER TYPE ledger.cents OWNER TO app;
+
+--
+-- Name: mood; Type: TYPE; Schema: other; Owner: app
+--
+
+CREATE TYPE other.mood AS ENUM (
+    'sad',
+    'happy'
+);
+
+
+ALTER TYPE other.mood OWNER TO app;
+
+--
+-- Name: total(ledger.cents); Type: AGGREGATE; Schema: ledger; Owner: app
+--
+
+CREATE AGGREGATE ledger.total(ledger.cents) (
+    SFUNC = ledger.cents_add,
+    STYPE = ledger.cents
+);
+
+
+ALTER AGGREGATE ledger.total(ledger.cents) OWNER TO app;
+
+--
+-- Name: +; Type: OPERATOR; Schema: ledger; Owner: app
+--
+
+CREATE OPERATOR ledger.+ (
+    FUNCTION = ledger.cents_add,
+    LEFTARG = ledger.cents,
+    RIGHTARG = ledger.cents,
+    COMMUTATOR = OPERATOR(ledger.+)
+);
+
+
+ALTER OPERATOR ledger.+ (ledger.cents, ledger.cents) OWNER TO app;
+
+--
+-- Name: <; Type: OPERATOR; Schema: ledger; Owner: app
+--
+
+CREATE OPERATOR ledger.< (
+    FUNCTION = ledger.cents_lt,
+    LEFTARG = ledger.cents,
+    RIGHTARG = ledger.cents
+);
+
+
+ALTER OPERATOR ledger.< (ledger.cents, ledger.cents) OWNER TO app;
+
+--
+-- Name: cents_ops; Type: OPERATOR FAMILY; Schema: ledger; Owner: app
+--
+
+CREATE OPERATOR FAMILY ledger.cents_ops USING btree;
+
+
+ALTER OPERATOR FAMILY ledger.cents_ops USING btree OWNER TO app;
+
+--
+-- Name: cents_ops; Type: OPERATOR CLASS; Schema: ledger; Owner: app
+--
+
+CREATE OPERATOR CLASS ledger.cents_ops
+    DEFAULT FOR TYPE ledger.cents USING btree FAMILY ledger.cents_ops AS
+    OPERATOR 1 ledger.<(ledger.cents,ledger.cents) ,
+    FUNCTION 1 (ledger.cents, ledger.cents) ledger.cents_cmp(ledger.cents,ledger.cents);
+
+
+ALTER OPERATOR CLASS ledger.cents_ops USING btree OWNER TO app;
+
+--
+-- Name: ###; Type: OPERATOR; Schema: other; Owner: app
+--
+
+CREATE OPERATOR other.### (
+    FUNCTION = other.mood_eq,
+    LEFTARG = other.mood,
+    RIGHTARG = other.mood
+);
+
+
+ALTER OPERATOR other.### (other.mood, other.mood) OWNER TO app;
+
+--
+-- Name: CAST (bigint AS ledger.cents); Type: CAST; Schema: -; Owner: -
+--
+
+CREATE CAST (bigint AS ledger.cents) WITH FUNCTION ledger.cents_from_bigint(bigint) AS IMPLICIT;
+
+
+--
+-- Name: CAST (text AS other.mood); Type: CAST; Schema: -; Owner: -
+--
+
+CREATE CAST (text AS other.mood) WITH INOUT;
+
+
+--
+-- Name: words; Type: TEXT SEARCH CONFIGURATION; Schema: ledger; Owner: app
+--
+
+CREATE TEXT SEARCH CONFIGURATION ledger.words (
+    PARSER = pg_catalog."default" );
+
+ALTER TEXT SEARCH CONFIGURATION ledger.words
+    ADD MAPPING FOR asciiword WITH ledger.plain_words;
+
+
+ALTER TEXT SEARCH CONFIGURATION ledger.words OWNER TO app;
+
+--
+-- Name: plain_words; Type: TEXT SEARCH DICTIONARY; Schema: ledger; Owner: app
+--
+
+CREATE TEXT SEARCH DICTIONARY ledger.plain_words (
+    TEMPLATE = pg_catalog.simple );
+
+
+ALTER TEXT SEARCH DICTIONARY ledger.plain_words OWNER TO app;
+
+--
+-- Name: cents_add(ledger.cents, ledger.cents); Type: FUNCTION; Schema: ledger; Owner: app
+--
+
+CREATE FUNCTION ledger.cents_add(ledger.cents, ledger.cents) RETURNS ledger.cents
+    LANGUAGE internal IMMUTABLE STRICT
+    AS $$int8pl$$;
+
+
+ALTER FUNCTION ledger.cents_add(ledger.cents, ledger.cents) OWNER TO app;
+
+--
+-- Name: cents_cmp(ledger.cents, ledger.cents); Type: FUNCTION; Schema: ledger; Owner: app
+--
+
+CREATE FUNCTION ledger.cents_cmp(ledger.cents, ledger.cents) RETURNS integer
+    LANGUAGE internal IMMUTABLE STRICT
+    AS $$btint8cmp$$;
+
+
+ALTER FUNCTION ledger.cents_cmp(ledger.cents, ledger.cents) OWNER TO app;
+
+--
+-- Name: cents_from_bigint(bigint); Type: FUNCTION; Schema: ledger; Owner: app
+--
+
+CREATE FUNCTION ledger.cents_from_bigint(bigint) RETURNS ledger.cents
+    LANGUAGE internal IMMUTABLE STRICT
+    AS $$int8up$$;
+
+
+ALTER FUNCTION ledger.cents_from_bigint(bigint) OWNER TO app;
+
+--
+-- Name: cents_lt(ledger.cents, ledger.cents); Type: FUNCTION; Schema: ledger; Owner: app
+--
+
+CREATE FUNCTION ledger.cents_lt(ledger.cents, ledger.cents) RETURNS boolean
+    LANGUAGE internal IMMUTABLE STRICT
+    AS $$int8lt$$;
+
+
+ALTER FUNCTION ledger.cents_lt(ledger.cents, ledger.cents) OWNER TO app;
+
+--
+-- Name: mood_eq(other.mood, other.mood); Type: FUNCTION; Schema: other; Owner: app
+--
+
+CREATE FUNCTION other.mood_eq(other.mood, other.mood) RETURNS boolean
+    LANGUAGE sql IMMUTABLE
+    AS $$SELECT $1 = $2$$;
+
+
+ALTER FUNCTION other.mood_eq(other.mood, other.mood) OWNER TO app;
+
+SET default_tablespace = '';
+
+SET default_table_access_method = heap;
+
+--
+-- Name: entries; Type: TABLE; Schema: ledger; Owner: app
+--
+
+CREATE TABLE ledger.entries (
+    id integer NOT NULL,
+    amount ledger.cents NOT NULL,
+    memo text
+);
+
+
+ALTER TABLE ledger.entries OWNER TO app;
+
+--
+-- Name: notes; Type: TABLE; Schema: other; Owner: app
+--
+
+CREATE TABLE other.notes (
+    id integer NOT NULL,
+    mood other.mood
+);
+
+
+ALTER TABLE other.notes OWNER TO app;
+
+--
+-- Name: entries entries_pkey; Type: CONSTRAINT; Schema: ledger; Owner: app
+--
+
+ALTER TABLE ONLY ledger.entries
+    ADD CONSTRAINT entries_pkey PRIMARY KEY (id);
+
+
+--
+-- PostgreSQL database dump complete
+--
+
@@ -0,0 +1,78 @@
+--
+-- PostgreSQL database dump
+--
+
+SET statement_timeout = 0;
+SET client_encoding = 'UTF8';
+
+--
+-- Name: events; Type: TABLE; Schema: public; Owner: app
+--
+
+CREATE TABLE public.events (
+    id bigint NOT NULL,
+    created date NOT NULL
+)
+PARTITION BY RANGE (created);
+
+
+--
+-- Name: events_2025; Type: TABLE; Schema: public; Owner: app
+--
+
+CREATE UNLOGGED TABLE public.events_2025 (
+    id bigint NOT NULL,
+    created date NOT NULL
+);
+
+
+--
+-- Name: events_2026; Type: TABLE; Schema: public; Owner: app
+--
+
+CREATE TABLE public.events_2026 (
+    id bigint NOT NULL,
+    created date NOT NULL
+);
+
+
+--
+-- Name: cache; Type: TABLE; Schema: public; Owner: app
+--
+
+CREATE UNLOGGED TABLE public.cache (
+    key text NOT NULL,
+    value text
+);
+
+
+--
+-- Name: cache_seq; Type: SEQUENCE; Schema: public; Owner: app
+--
+
+CREATE UNLOGGED SEQUENCE public.cache_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: events_2025; Type: TABLE ATTACH; Schema: public; Owner: app
+--
+
+ALTER TABLE ONLY public.events ATTACH PARTITION public.events_2025 FOR VALUES FROM ('2025-01-01') TO ('2026-01-01');
+
+
+--
+-- Name: events_2026; Type: TABLE ATTACH; Schema: public; Owner: app
+--
+
+ALTER TABLE ONLY public.events ATTACH PARTITION public.events_2026 FOR VALUES FROM ('2026-01-01') TO ('2027-01-01');
+
+
+--
+-- PostgreSQL database dump complete
+--
+
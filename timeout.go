@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeoutOptions limits how long a run and its phases may take
+type TimeoutOptions struct {
+	MaxDuration time.Duration            // Whole run, 0 for no limit
+	Phases      map[string]time.Duration // By phase name, e.g. export and apply
+}
+
+// phaseContext returns the context the named phase runs under, bounded by
+// the run's budget and the phase's own limit, and describes the limit that
+// applies first.
+func (r *RunState) phaseContext(parent context.Context, name string, start time.Time) (context.Context, context.CancelFunc, string) {
+	var deadline time.Time
+	var limit string
+	if r.Timeouts.MaxDuration > 0 {
+		deadline = r.StartedAt.Add(r.Timeouts.MaxDuration)
+		limit = fmt.Sprintf("--max-duration %s", r.Timeouts.MaxDuration)
+	}
+	if d := r.Timeouts.Phases[name]; d > 0 {
+		if end := start.Add(d); deadline.IsZero() || end.Before(deadline) {
+			deadline = end
+			limit = fmt.Sprintf("--%s-timeout %s", name, d)
+		}
+	}
+	if deadline.IsZero() {
+		ctx, cancel := context.WithCancel(parent)
+		return ctx, cancel, ""
+	}
+	ctx, cancel := context.WithDeadline(parent, deadline)
+	return ctx, cancel, limit
+}
+
+// context is the context of the phase in progress
+func (r *RunState) context() context.Context {
+	if r == nil || r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// runContext bounds subprocesses and queries by the current run's budget
+func runContext() context.Context {
+	return currentRun.context()
+}
+
+// statementTimeout returns the time left in the current phase in
+// milliseconds, for use as the server-side statement_timeout, or 0
+func statementTimeout() int64 {
+	deadline, ok := runContext().Deadline()
+	if !ok {
+		return 0
+	}
+	ms := time.Until(deadline).Milliseconds()
+	if ms < 1 {
+		ms = 1 // 0 would disable the timeout
+	}
+	return ms
+}
+
+// budgetExceeded records that the named phase ran out of time and returns
+// the error that ends the run, listing where the time went
+func (r *RunState) budgetExceeded(name, limit string, cause error) error {
+	r.TimedOutPhase = name
+
+	spent := make([]string, 0, len(r.Phases))
+	for _, p := range r.Phases {
+		spent = append(spent, fmt.Sprintf("%s %s", p.Name, p.Duration.Round(time.Second)))
+	}
+	if len(spent) > 0 {
+		logger.Error(fmt.Sprintf("Time spent by phase: %s", strings.Join(spent, ", ")))
+	}
+
+	if cause == nil {
+		return fmt.Errorf("time budget (%s) used up before phase %s could start", limit, name)
+	}
+	return fmt.Errorf("phase %s exceeded its time budget (%s): %v", name, limit, cause)
+}
+
+// reportTimedOutApply points to the ways back after the budget ran out with
+// the destination partially migrated
+func reportTimedOutApply(dest *DatabaseConfig, backupFile string, options *MigrationOptions, state *RunState) {
+	if state.TimedOutPhase == "" {
+		return
+	}
+	if err := generateRollbackScript(dest, backupFile, options, state); err != nil {
+		warn(WarnRollbackScriptFailed, fmt.Sprintf("Failed to generate rollback script: %v", err))
+	}
+	if backupFile == "" {
+		logger.Error("The destination is partially migrated and there is no backup; recreate it with 'resume --resume-strategy recreate'")
+		return
+	}
+	logger.Error(fmt.Sprintf("The destination is partially migrated; roll back with 'resume %s --resume-strategy rollback' or the rollback script", options.OutputDir))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tocSuffix is appended to a dump's name for its pg_restore --list listing
+const tocSuffix = ".toc.txt"
+
+// tocMultiWordTypes are the pg_restore --list entry types of more than one
+// word, tried longest first since some begin with others
+var tocMultiWordTypes = []string{
+	"PUBLICATION TABLES IN SCHEMA",
+	"TEXT SEARCH CONFIGURATION",
+	"TEXT SEARCH DICTIONARY",
+	"MATERIALIZED VIEW DATA",
+	"FOREIGN DATA WRAPPER",
+	"TEXT SEARCH TEMPLATE",
+	"TEXT SEARCH PARSER",
+	"PROCEDURAL LANGUAGE",
+	"EXTENDED STATISTICS",
+	"SEQUENCE OWNED BY",
+	"PUBLICATION TABLE",
+	"MATERIALIZED VIEW",
+	"CHECK CONSTRAINT",
+	"OPERATOR FAMILY",
+	"STATISTICS DATA",
+	"OPERATOR CLASS",
+	"FOREIGN SERVER",
+	"EVENT TRIGGER",
+	"FOREIGN TABLE",
+	"ACCESS METHOD",
+	"FK CONSTRAINT",
+	"USER MAPPING",
+	"SEQUENCE SET",
+	"INDEX ATTACH",
+	"TABLE ATTACH",
+	"LARGE OBJECT",
+	"ROW SECURITY",
+	"DEFAULT ACL",
+	"TABLE DATA",
+	"SHELL TYPE",
+}
+
+// TOCEntry is one entry of a dump's table of contents, as pg_restore lists it
+type TOCEntry struct {
+	ID     int    `json:"id"`
+	Type   string `json:"type"`
+	Schema string `json:"schema,omitempty"`
+	Name   string `json:"name"`
+	Owner  string `json:"owner,omitempty"`
+}
+
+// parseTOCLine reads a "id; tableoid oid TYPE schema name owner" line of
+// pg_restore --list. Names may contain spaces: a constraint is listed as
+// "table constraint", so the name is everything between schema and owner.
+func parseTOCLine(line string) (TOCEntry, bool) {
+	id, rest, ok := strings.Cut(line, "; ")
+	if !ok {
+		return TOCEntry{}, false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(id))
+	if err != nil {
+		return TOCEntry{}, false
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 3 {
+		return TOCEntry{}, false
+	}
+	fields = fields[2:] // Catalog table and object OIDs
+	// Entries without an owner, such as comments on extensions, end in a space
+	if strings.HasSuffix(rest, " ") {
+		fields = append(fields, "")
+	}
+
+	entry := TOCEntry{ID: n, Type: fields[0]}
+	joined := strings.Join(fields, " ")
+	for _, typ := range tocMultiWordTypes {
+		if strings.HasPrefix(joined, typ+" ") {
+			entry.Type = typ
+			break
+		}
+	}
+	fields = fields[len(strings.Fields(entry.Type)):]
+	switch len(fields) {
+	case 0:
+		return TOCEntry{}, false
+	case 1:
+		entry.Name = fields[0]
+	case 2:
+		entry.Schema, entry.Name = fields[0], fields[1]
+	default:
+		entry.Schema = fields[0]
+		entry.Name = strings.Join(fields[1:len(fields)-1], " ")
+		entry.Owner = fields[len(fields)-1]
+	}
+	if entry.Schema == "-" {
+		entry.Schema = ""
+	}
+	return entry, true
+}
+
+// parseTOCList reads the entries of pg_restore --list output, skipping its
+// ";" comment lines
+func parseTOCList(listing []byte) []TOCEntry {
+	var entries []TOCEntry
+	scanner := bufio.NewScanner(bytes.NewReader(listing))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if entry, ok := parseTOCLine(line); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// listDumpTOC runs pg_restore --list on a directory dump. A dump whose table
+// of contents can't be read fails here, before anything is restored from it.
+func listDumpTOC(config *DatabaseConfig, dump string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := clientCommand(config, "pg_restore", []string{"--list", dump}, dump)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("pg_restore --list failed: %s", msg)
+		}
+		return nil, fmt.Errorf("pg_restore --list failed: %v", err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// writeDumpTOC saves the table of contents of a directory dump next to it as
+// <dump>.toc.txt and returns its entries for the run manifest
+func writeDumpTOC(config *DatabaseConfig, dump string) (string, []TOCEntry, error) {
+	listing, err := listDumpTOC(config, dump)
+	if err != nil {
+		return "", nil, err
+	}
+	path := strings.TrimSuffix(dump, string(os.PathSeparator)) + tocSuffix
+	if err := os.WriteFile(path, listing, 0644); err != nil {
+		return "", nil, err
+	}
+	entries := parseTOCList(listing)
+	logger.Info(fmt.Sprintf("Saved the table of contents of the dump (%d entries) to: %s", len(entries), path))
+	return path, entries, nil
+}
+
+// checkDumpTOC makes sure pg_restore can read the table of contents of a
+// directory dump. Plain SQL files have none and pass as they are.
+func checkDumpTOC(config *DatabaseConfig, path string) error {
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return err
+	}
+	listing, err := listDumpTOC(config, path)
+	if err != nil {
+		return fmt.Errorf("the dump %s is unreadable: %v", path, err)
+	}
+	logger.Info(fmt.Sprintf("Table of contents of %s lists %d entries", path, len(parseTOCList(listing))))
+	return nil
+}
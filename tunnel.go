@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHOptions holds the settings shared by source and destination tunnels
+type SSHOptions struct {
+	KeyFile               string
+	InsecureIgnoreHostKey bool
+}
+
+// sshTunnel forwards a local port to a database host through a bastion
+type sshTunnel struct {
+	client   *ssh.Client
+	listener net.Listener
+	remote   string
+	wg       sync.WaitGroup
+	once     sync.Once
+}
+
+// parseSSHTarget splits user@host[:port] into its parts
+func parseSSHTarget(spec string) (user, addr string, err error) {
+	at := strings.LastIndex(spec, "@")
+	if at <= 0 || at == len(spec)-1 {
+		return "", "", fmt.Errorf("expected user@host[:port], got %q", spec)
+	}
+	user, host := spec[:at], spec[at+1:]
+
+	if _, _, splitErr := net.SplitHostPort(host); splitErr != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+	return user, host, nil
+}
+
+// startSSHTunnel connects to the bastion in config.SSH and rewrites the
+// config's host and port to a local listener forwarding to the database.
+func startSSHTunnel(config *DatabaseConfig, opts *SSHOptions) (*sshTunnel, error) {
+	if isUnixSocket(config.Host) {
+		return nil, fmt.Errorf("SSH tunnels need a TCP host, not the Unix socket %s", config.Host)
+	}
+
+	user, bastion, err := parseSSHTarget(config.SSH)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := sshAuthMethods(opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := sshHostKeyCallback(opts.InsecureIgnoreHostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientConfig := &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         15 * time.Second,
+	}
+
+	logger.Info(fmt.Sprintf("Opening SSH tunnel via %s@%s...", user, bastion))
+	client, err := ssh.Dial("tcp", bastion, clientConfig)
+	if err != nil {
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			return nil, fmt.Errorf("SSH host key verification for bastion %s failed (add it to known_hosts or use --ssh-insecure-ignore-hostkey): %v", bastion, err)
+		}
+		return nil, fmt.Errorf("SSH connection to bastion %s failed: %v", bastion, err)
+	}
+
+	remote := net.JoinHostPort(config.Host, config.Port)
+
+	// Probe the database through the bastion so an unreachable host gets its own error
+	probe, err := client.Dial("tcp", remote)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("bastion %s cannot reach database %s: %v", bastion, remote, err)
+	}
+	probe.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to open local tunnel port: %v", err)
+	}
+
+	t := &sshTunnel{client: client, listener: listener, remote: remote}
+	go t.serve()
+
+	localPort := listener.Addr().(*net.TCPAddr).Port
+	logger.Info(fmt.Sprintf("SSH tunnel established: 127.0.0.1:%d -> %s (via %s)", localPort, remote, bastion))
+
+	if config.SSLMode == "verify-full" {
+		warn(WarnTunnelVerifyFull, "verify-full checks the certificate against the tunnel address 127.0.0.1 and will likely fail; consider verify-ca")
+	}
+
+	config.TunnelTarget = remote
+	config.Host = "127.0.0.1"
+	config.Port = strconv.Itoa(localPort)
+	return t, nil
+}
+
+func (t *sshTunnel) serve() {
+	for {
+		local, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.forward(local)
+		}()
+	}
+}
+
+func (t *sshTunnel) forward(local net.Conn) {
+	defer local.Close()
+
+	remote, err := t.client.Dial("tcp", t.remote)
+	if err != nil {
+		logger.Error(fmt.Sprintf("SSH tunnel could not reach %s: %v", t.remote, err))
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// Close tears the tunnel down
+func (t *sshTunnel) Close() {
+	t.once.Do(func() {
+		t.listener.Close()
+		t.client.Close()
+		logger.Info(fmt.Sprintf("SSH tunnel to %s closed", t.remote))
+	})
+}
+
+func sshAuthMethods(keyFile string) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		} else {
+			warn(WarnSSHAgentUnavailable, fmt.Sprintf("Could not connect to SSH agent: %v", err))
+		}
+	}
+
+	keyFiles := []string{keyFile}
+	if keyFile == "" {
+		keyFiles = nil
+		if home, err := os.UserHomeDir(); err == nil {
+			for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+				keyFiles = append(keyFiles, filepath.Join(home, ".ssh", name))
+			}
+		}
+	}
+
+	for _, path := range keyFiles {
+		signer, err := loadSSHKey(path)
+		if err != nil {
+			if keyFile != "" {
+				return nil, err
+			}
+			continue
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no SSH authentication available: start an SSH agent or pass --ssh-key")
+	}
+	return methods, nil
+}
+
+func loadSSHKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key %s: %v", path, err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		fmt.Fprintf(os.Stderr, "Enter passphrase for SSH key %s: ", path)
+		passphrase, readErr := readPassword()
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read SSH key passphrase: %v", readErr)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key %s: %v", path, err)
+	}
+	return signer, nil
+}
+
+func sshHostKeyCallback(insecure bool) (ssh.HostKeyCallback, error) {
+	if insecure {
+		warn(WarnSSHHostKeyUnverified, "SSH host key verification disabled (--ssh-insecure-ignore-hostkey)")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("cannot locate known_hosts: %v", err)
+	}
+	callback, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known_hosts: %v", err)
+	}
+	return callback, nil
+}
+
+// startTunnels opens the configured SSH tunnels and registers their teardown
+func startTunnels(opts *SSHOptions, configs ...*DatabaseConfig) error {
+	for _, config := range configs {
+		if config == nil || config.SSH == "" {
+			continue
+		}
+		tunnel, err := startSSHTunnel(config, opts)
+		if err != nil {
+			return err
+		}
+		registerCleanup(tunnel.Close)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Values of --unlogged
+const (
+	UnloggedKeep       = "keep"
+	UnloggedToLogged   = "to-logged"
+	UnloggedToUnlogged = "to-unlogged"
+)
+
+var unloggedModes = []string{UnloggedKeep, UnloggedToLogged, UnloggedToUnlogged}
+
+// Statements of a plain-format dump that --unlogged looks at
+var (
+	persistenceTablePattern    = regexp.MustCompile(`^CREATE (UNLOGGED )?TABLE (\S+)`)
+	persistenceSequencePattern = regexp.MustCompile(`^CREATE (UNLOGGED )?SEQUENCE (\S+)`)
+	partitionOfPattern         = regexp.MustCompile(`\bPARTITION OF (\S+)`)
+	partitionByPattern         = regexp.MustCompile(`(?m)^\)?\s*PARTITION BY `)
+	attachPartitionPattern     = regexp.MustCompile(`^ALTER TABLE (?:ONLY )?(\S+) ATTACH PARTITION (\S+)`)
+	temporaryPattern           = regexp.MustCompile(`^CREATE (?:OR REPLACE )?(?:(?:GLOBAL|LOCAL) )?TEMP(?:ORARY)? (\w+) (\S+)`)
+	tempSchemaPattern          = regexp.MustCompile(`^CREATE (?:OR REPLACE )?(?:UNLOGGED )?(\w+(?: \w+)?) (pg_temp(?:_\d+)?\.[^\s(]+)`)
+)
+
+// UnloggedReport is what --unlogged found and changed in the export
+type UnloggedReport struct {
+	Mode            string   `json:"mode"`
+	Unlogged        []string `json:"unlogged,omitempty"`         // Tables and sequences left unlogged
+	Converted       []string `json:"converted,omitempty"`        // Tables and sequences whose persistence was changed
+	MixedPartitions []string `json:"mixed_partitions,omitempty"` // Partitioned tables with both logged and unlogged partitions
+}
+
+// validateUnloggedMode checks a --unlogged value
+func validateUnloggedMode(mode string) error {
+	if slices.Contains(unloggedModes, mode) {
+		return nil
+	}
+	return fmt.Errorf("--unlogged must be one of: %s", strings.Join(unloggedModes, ", "))
+}
+
+// dumpTable is a table created by a plain-format dump
+type dumpTable struct {
+	name        string
+	unlogged    bool
+	partitioned bool   // PARTITION BY: holds no rows, its partitions do
+	parent      string // Partitioned table it is a partition of
+}
+
+// rewriteUnlogged applies --unlogged to the CREATE TABLE and CREATE SEQUENCE
+// statements of a plain-format dump at path. All partitions of a partitioned
+// table get the same persistence; the partitioned table itself holds no rows
+// and is left as it is, since newer servers refuse unlogged ones. Temporary
+// objects, which pg_dump never writes, fail the rewrite.
+func rewriteUnlogged(path, mode string) (*UnloggedReport, error) {
+	statements, err := splitScriptStatements(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make(map[string]*dumpTable)
+	var order []string
+	var temporary []string
+	for _, s := range statements {
+		if m := temporaryPattern.FindStringSubmatch(s.text); m != nil {
+			temporary = append(temporary, fmt.Sprintf("line %d: temporary %s %s", s.line, strings.ToLower(m[1]), m[2]))
+			continue
+		}
+		if m := tempSchemaPattern.FindStringSubmatch(s.text); m != nil {
+			temporary = append(temporary, fmt.Sprintf("line %d: %s %s", s.line, strings.ToLower(m[1]), m[2]))
+			continue
+		}
+		if m := persistenceTablePattern.FindStringSubmatch(s.text); m != nil {
+			t := &dumpTable{name: m[2], unlogged: m[1] != "", partitioned: partitionByPattern.MatchString(s.text)}
+			if p := partitionOfPattern.FindStringSubmatch(s.text); p != nil {
+				t.parent = p[1]
+			}
+			tables[t.name] = t
+			order = append(order, t.name)
+			continue
+		}
+		if m := attachPartitionPattern.FindStringSubmatch(s.text); m != nil {
+			if t, ok := tables[m[2]]; ok {
+				t.parent = m[1]
+			}
+		}
+	}
+	if len(temporary) > 0 {
+		return nil, fmt.Errorf("the export contains %d temporary object(s), which pg_dump never writes and a migration can't carry:\n   %s",
+			len(temporary), strings.Join(temporary, "\n   "))
+	}
+
+	report := &UnloggedReport{Mode: mode}
+	// Partitions of one partitioned table, to check that those kept agree
+	partitions := make(map[string][]*dumpTable)
+	for _, name := range order {
+		if t := tables[name]; t.parent != "" {
+			partitions[t.parent] = append(partitions[t.parent], t)
+		}
+	}
+	for parent, children := range partitions {
+		unlogged := 0
+		for _, t := range children {
+			if t.unlogged {
+				unlogged++
+			}
+		}
+		if mode == UnloggedKeep && unlogged > 0 && unlogged < len(children) {
+			report.MixedPartitions = append(report.MixedPartitions, fmt.Sprintf("%s (%d of %d partitions unlogged)", parent, unlogged, len(children)))
+		}
+	}
+	sort.Strings(report.MixedPartitions)
+
+	// What each CREATE becomes
+	change := make(map[string]bool)
+	for _, name := range order {
+		t := tables[name]
+		switch {
+		case mode == UnloggedToLogged && t.unlogged:
+			change[name] = true
+		case mode == UnloggedToUnlogged && !t.unlogged && !t.partitioned:
+			change[name] = true
+		case t.unlogged && mode == UnloggedKeep:
+			report.Unlogged = append(report.Unlogged, name)
+		}
+	}
+
+	var b strings.Builder
+	for _, s := range statements {
+		lines := s.lines
+		if m := persistenceTablePattern.FindStringSubmatch(s.text); m != nil && change[m[2]] {
+			lines = rewritePersistence(lines, "TABLE", mode)
+			report.Converted = append(report.Converted, m[2])
+		} else if m := persistenceSequencePattern.FindStringSubmatch(s.text); m != nil {
+			switch {
+			case m[1] != "" && mode == UnloggedToLogged:
+				lines = rewritePersistence(lines, "SEQUENCE", mode)
+				report.Converted = append(report.Converted, m[2])
+			case m[1] != "" && mode == UnloggedKeep:
+				report.Unlogged = append(report.Unlogged, m[2])
+			}
+		}
+		for _, line := range lines {
+			b.WriteString(line + "\n")
+		}
+	}
+	if len(report.Converted) == 0 {
+		return report, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	out, err := os.CreateTemp(filepath.Dir(path), ".unlogged-*.sql")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(out.Name())
+	_, err = out.WriteString(b.String())
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	os.Chmod(out.Name(), info.Mode().Perm())
+	return report, os.Rename(out.Name(), path)
+}
+
+// rewritePersistence changes CREATE [UNLOGGED] <kind> on the first line of a
+// statement that isn't a comment
+func rewritePersistence(lines []string, kind, mode string) []string {
+	rewritten := append([]string(nil), lines...)
+	for i, line := range rewritten {
+		if !strings.HasPrefix(line, "CREATE ") {
+			continue
+		}
+		if mode == UnloggedToLogged {
+			rewritten[i] = strings.Replace(line, "CREATE UNLOGGED "+kind+" ", "CREATE "+kind+" ", 1)
+		} else {
+			rewritten[i] = strings.Replace(line, "CREATE "+kind+" ", "CREATE UNLOGGED "+kind+" ", 1)
+		}
+		break
+	}
+	return rewritten
+}
+
+// applyUnloggedMode runs --unlogged on the export and reports the tables it
+// leaves unlogged or changed
+func applyUnloggedMode(schemaFile string, options *MigrationOptions, state *RunState) error {
+	report, err := rewriteUnlogged(schemaFile, options.Unlogged)
+	if err != nil {
+		return err
+	}
+	if len(report.Unlogged) == 0 && len(report.Converted) == 0 {
+		return nil
+	}
+	state.Unlogged = report
+
+	switch options.Unlogged {
+	case UnloggedToLogged:
+		logger.Info(fmt.Sprintf("Made %d unlogged table(s) and sequence(s) logged (--unlogged to-logged): %s", len(report.Converted), strings.Join(report.Converted, ", ")))
+	case UnloggedToUnlogged:
+		logger.Info(fmt.Sprintf("Made %d table(s) unlogged (--unlogged to-unlogged); they are emptied after a crash and not replicated: %s", len(report.Converted), strings.Join(report.Converted, ", ")))
+	default:
+		warn(WarnUnloggedTables, fmt.Sprintf("%d unlogged table(s) and sequence(s) stay unlogged on the destination, where they are emptied after a crash and not replicated: %s",
+			len(report.Unlogged), strings.Join(report.Unlogged, ", ")))
+		if len(report.MixedPartitions) > 0 {
+			warn(WarnUnloggedTables, fmt.Sprintf("Partitions of the same table differ in persistence: %s; --unlogged to-logged or to-unlogged makes them agree",
+				strings.Join(report.MixedPartitions, ", ")))
+		}
+	}
+	return nil
+}
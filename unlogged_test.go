@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// copyTestdata copies a file of testdata into a temporary directory, for
+// functions that rewrite the file they are given
+func copyTestdata(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRewriteUnloggedPartitions(t *testing.T) {
+	tests := []struct {
+		mode      string
+		unlogged  []string
+		converted []string
+		mixed     []string
+		// CREATE lines expected in the rewritten file
+		creates []string
+	}{
+		{
+			mode:     UnloggedKeep,
+			unlogged: []string{"public.events_2025", "public.cache", "public.cache_seq"},
+			mixed:    []string{"public.events (1 of 2 partitions unlogged)"},
+			creates: []string{
+				"CREATE TABLE public.events (",
+				"CREATE UNLOGGED TABLE public.events_2025 (",
+				"CREATE TABLE public.events_2026 (",
+				"CREATE UNLOGGED TABLE public.cache (",
+				"CREATE UNLOGGED SEQUENCE public.cache_seq",
+			},
+		},
+		{
+			mode:      UnloggedToLogged,
+			converted: []string{"public.events_2025", "public.cache", "public.cache_seq"},
+			creates: []string{
+				"CREATE TABLE public.events (",
+				"CREATE TABLE public.events_2025 (",
+				"CREATE TABLE public.events_2026 (",
+				"CREATE TABLE public.cache (",
+				"CREATE SEQUENCE public.cache_seq",
+			},
+		},
+		{
+			// The partitioned table itself stays logged, its partitions don't
+			mode:      UnloggedToUnlogged,
+			converted: []string{"public.events_2026"},
+			creates: []string{
+				"CREATE TABLE public.events (",
+				"CREATE UNLOGGED TABLE public.events_2025 (",
+				"CREATE UNLOGGED TABLE public.events_2026 (",
+				"CREATE UNLOGGED TABLE public.cache (",
+				"CREATE UNLOGGED SEQUENCE public.cache_seq",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			path := copyTestdata(t, "unlogged_partitions.sql")
+			report, err := rewriteUnlogged(path, test.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(report.Unlogged, test.unlogged) {
+				t.Errorf("unlogged = %q, want %q", report.Unlogged, test.unlogged)
+			}
+			if !slices.Equal(report.Converted, test.converted) {
+				t.Errorf("converted = %q, want %q", report.Converted, test.converted)
+			}
+			if !slices.Equal(report.MixedPartitions, test.mixed) {
+				t.Errorf("mixed partitions = %q, want %q", report.MixedPartitions, test.mixed)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var creates []string
+			for _, line := range strings.Split(string(data), "\n") {
+				if strings.HasPrefix(line, "CREATE ") {
+					creates = append(creates, line)
+				}
+			}
+			if !slices.Equal(creates, test.creates) {
+				t.Errorf("CREATE lines:\n%s\nwant:\n%s", strings.Join(creates, "\n"), strings.Join(test.creates, "\n"))
+			}
+		})
+	}
+}
+
+func TestRewriteUnloggedPartitionOf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.sql")
+	dump := "CREATE TABLE public.m (\n    id integer\n)\nPARTITION BY LIST (id);\n\n" +
+		"CREATE UNLOGGED TABLE public.m_1 PARTITION OF public.m\nFOR VALUES IN (1);\n\n" +
+		"CREATE UNLOGGED TABLE public.m_2 PARTITION OF public.m\nFOR VALUES IN (2);\n"
+	if err := os.WriteFile(path, []byte(dump), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err := rewriteUnlogged(path, UnloggedKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.MixedPartitions) != 0 {
+		t.Errorf("partitions all unlogged reported as mixed: %q", report.MixedPartitions)
+	}
+	if want := []string{"public.m_1", "public.m_2"}; !slices.Equal(report.Unlogged, want) {
+		t.Errorf("unlogged = %q, want %q", report.Unlogged, want)
+	}
+}
+
+func TestRewriteUnloggedRefusesTemporary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.sql")
+	if err := os.WriteFile(path, []byte("CREATE TEMPORARY TABLE scratch (id integer);\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rewriteUnlogged(path, UnloggedKeep); err == nil || !strings.Contains(err.Error(), "temporary table scratch") {
+		t.Fatalf("expected the temporary table to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Exit codes
+const (
+	exitFailure     = 1
+	exitOptionError = 2
+	exitWarnings    = 50 // Run succeeded but --fail-on-warning found warnings
+	exitDestructive = 2  // converge needs --allow-destructive; shares the option error code
+	exitDrift       = 3  // watch --once found schema changes
+)
+
+// maxIdentifierLength is PostgreSQL's default NAMEDATALEN - 1
+const maxIdentifierLength = 63
+
+// optionErrors collects every problem found while validating flags so they
+// can be reported together.
+type optionErrors []string
+
+func (e optionErrors) Error() string {
+	return "invalid options:\n  - " + strings.Join(e, "\n  - ")
+}
+
+// validatePort checks that port is an integer in the TCP port range
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("port must be an integer between 1 and 65535, got %q", port)
+	}
+	return nil
+}
+
+// validateIdentifier checks a user or database name
+func validateIdentifier(kind, name string) error {
+	if name == "" {
+		return fmt.Errorf("%s must not be empty", kind)
+	}
+	if len(name) > maxIdentifierLength {
+		return fmt.Errorf("%s %q is %d bytes long, PostgreSQL truncates identifiers at %d", kind, name, len(name), maxIdentifierLength)
+	}
+	return nil
+}
+
+// validateConnectionFlags checks the connection flags of the selected sides
+// before anything is prompted or connected. An empty --dest-db is allowed since
+// it is prompted for later.
+func validateConnectionFlags(cmd *cobra.Command, source, dest bool) error {
+	var errs optionErrors
+
+	type side struct {
+		prefix string
+		label  string
+	}
+	var sides []side
+	if source {
+		sides = append(sides, side{"source", "source"})
+	}
+	if dest {
+		sides = append(sides, side{"dest", "destination"})
+	}
+
+	driver, _ := cmd.Flags().GetString("driver")
+	if err := validateDriver(driver); err != nil {
+		errs = append(errs, fmt.Sprintf("--driver: %v", err))
+	}
+	if keepalive, _ := cmd.Flags().GetDuration("keepalive-interval"); keepalive < 0 {
+		errs = append(errs, "--keepalive-interval: must not be negative")
+	}
+
+	for _, side := range sides {
+		host, _ := cmd.Flags().GetString(side.prefix + "-host")
+		port, _ := cmd.Flags().GetString(side.prefix + "-port")
+		user, _ := cmd.Flags().GetString(side.prefix + "-user")
+		db, _ := cmd.Flags().GetString(side.prefix + "-db")
+		sslMode, _ := cmd.Flags().GetString(side.prefix + "-ssl")
+
+		if strings.TrimSpace(host) == "" {
+			errs = append(errs, fmt.Sprintf("--%s-host: %s host must not be empty", side.prefix, side.label))
+		}
+		if err := validatePort(port); err != nil {
+			errs = append(errs, fmt.Sprintf("--%s-port: %v", side.prefix, err))
+		}
+		if err := validateIdentifier("user name", user); err != nil {
+			errs = append(errs, fmt.Sprintf("--%s-user: %v", side.prefix, err))
+		}
+		if side.prefix == "source" || db != "" {
+			if err := validateIdentifier("database name", db); err != nil {
+				errs = append(errs, fmt.Sprintf("--%s-db: %v", side.prefix, err))
+			}
+		}
+		if err := validateSSLMode(sslMode); err != nil {
+			errs = append(errs, fmt.Sprintf("--%s-ssl: invalid %s SSL mode %q: %v", side.prefix, side.label, sslMode, err))
+		}
+		channelBinding, _ := cmd.Flags().GetString(side.prefix + "-channel-binding")
+		if err := validateClientSecurity(channelBinding, "", sslMode, driver); err != nil {
+			errs = append(errs, fmt.Sprintf("--%s-channel-binding: %v", side.prefix, err))
+		}
+	}
+	gssEncMode, _ := cmd.Flags().GetString("gssencmode")
+	if err := validateClientSecurity("", gssEncMode, "", driver); err != nil {
+		errs = append(errs, fmt.Sprintf("--gssencmode: %v", err))
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"pg-schema-migrator/internal/catalog"
+)
+
+// Statements of a plain-format dump declaring constraints NOT VALID and
+// triggers disabled, for verifying an apply without a source
+var (
+	notValidPattern        = regexp.MustCompile(`(?s)ADD CONSTRAINT (\S+) .*NOT VALID$`)
+	disabledTriggerPattern = regexp.MustCompile(`DISABLE TRIGGER (\S+)$`)
+)
+
+// triggerModes maps pg_trigger.tgenabled to the ALTER TABLE action setting it
+var triggerModes = map[string]string{
+	"O": "ENABLE TRIGGER",
+	"D": "DISABLE TRIGGER",
+	"R": "ENABLE REPLICA TRIGGER",
+	"A": "ENABLE ALWAYS TRIGGER",
+}
+
+// VerifyDiscrepancy is a constraint, trigger or table setting whose state on
+// the destination differs from the source's after the apply
+type VerifyDiscrepancy struct {
+	Table   string `json:"table"`
+	Name    string `json:"name"`
+	Problem string `json:"problem"`
+	Fix     string `json:"fix"`
+}
+
+// catalogStates returns the NOT VALID constraints of a database and the
+// tgenabled mode of its user triggers, keyed by table and name
+func catalogStates(db *sql.DB) (invalid map[[2]string]bool, modes map[[2]string]string, err error) {
+	c, err := catalog.Read(runContext(), db, catalog.Options{})
+	if err != nil {
+		return nil, nil, err
+	}
+	codes := make(map[string]string, len(catalog.TriggerModes))
+	for code, mode := range catalog.TriggerModes {
+		codes[mode] = code
+	}
+
+	invalid = make(map[[2]string]bool)
+	modes = make(map[[2]string]string)
+	addTriggers := func(table string, triggers []*catalog.Trigger) {
+		for _, t := range triggers {
+			modes[[2]string{table, catalog.QuoteIdent(t.Name)}] = codes[t.Enabled]
+		}
+	}
+	for _, s := range c.Schemas {
+		for _, t := range s.Tables {
+			table := catalog.QualifiedName(s.Name, t.Name)
+			for _, con := range t.Constraints {
+				if !con.Validated {
+					invalid[[2]string{table, catalog.QuoteIdent(con.Name)}] = true
+				}
+			}
+			addTriggers(table, t.Triggers)
+		}
+		for _, v := range s.Views {
+			addTriggers(catalog.QualifiedName(s.Name, v.Name), v.Triggers)
+		}
+	}
+	return invalid, modes, nil
+}
+
+// declaredStates reads the NOT VALID constraints and disabled triggers a
+// schema file creates, by name, for when there is no source to compare with
+func declaredStates(schemaFile string) (constraints, triggers map[string]bool, err error) {
+	data, err := os.ReadFile(schemaFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	constraints = make(map[string]bool)
+	triggers = make(map[string]bool)
+	for _, stmt := range strings.Split(string(data), ";\n") {
+		stmt = strings.TrimSpace(stmt)
+		if m := notValidPattern.FindStringSubmatch(stmt); m != nil {
+			constraints[m[1]] = true
+		}
+		if m := disabledTriggerPattern.FindStringSubmatch(stmt); m != nil {
+			triggers[m[1]] = true
+		}
+	}
+	return constraints, triggers, nil
+}
+
+// readVerifyStates reads the constraint validity and trigger states of a
+// database, once more on a new connection should the first be dropped by a
+// firewall that timed the route out during the long local steps before
+func readVerifyStates(config *DatabaseConfig, side string, open func(*DatabaseConfig, string) (*sql.DB, error)) (invalid map[[2]string]bool, triggers map[[2]string]string, err error) {
+	err = retryOnReconnect(config, "verifying", func() error {
+		db, err := open(config, config.Database)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if invalid, triggers, err = catalogStates(db); err != nil {
+			return fmt.Errorf("failed to read %s constraints and triggers: %w", side, err)
+		}
+		return nil
+	})
+	return invalid, triggers, err
+}
+
+// verifyConstraints compares the validity of constraints and the state of
+// triggers on the destination with the source, or with the schema file when
+// there is no source. A constraint left NOT VALID or a trigger left in
+// another state is a discrepancy, returned with the statement fixing it.
+func verifyConstraints(source, dest *DatabaseConfig, schemaFile string) ([]VerifyDiscrepancy, error) {
+	destInvalid, destTriggers, err := readVerifyStates(dest, "destination", openDatabase)
+	if err != nil {
+		return nil, err
+	}
+
+	// What the destination should look like
+	expectInvalid := func(key [2]string) bool { return false }
+	expectMode := func(key [2]string) (string, bool) { return "O", true }
+	if source != nil {
+		sourceInvalid, sourceTriggers, err := readVerifyStates(source, "source", openDB)
+		if err != nil {
+			return nil, err
+		}
+		expectInvalid = func(key [2]string) bool { return sourceInvalid[key] }
+		expectMode = func(key [2]string) (string, bool) {
+			mode, ok := sourceTriggers[key]
+			return mode, ok
+		}
+	} else if schemaFile != "" {
+		constraints, triggers, err := declaredStates(schemaFile)
+		if err != nil {
+			return nil, err
+		}
+		expectInvalid = func(key [2]string) bool { return constraints[key[1]] }
+		expectMode = func(key [2]string) (string, bool) {
+			if triggers[key[1]] {
+				return "D", true
+			}
+			return "O", true
+		}
+	}
+
+	var discrepancies []VerifyDiscrepancy
+	for key := range destInvalid {
+		if expectInvalid(key) {
+			continue
+		}
+		discrepancies = append(discrepancies, VerifyDiscrepancy{
+			Table:   key[0],
+			Name:    key[1],
+			Problem: "constraint is NOT VALID",
+			Fix:     fmt.Sprintf("ALTER TABLE %s VALIDATE CONSTRAINT %s;", key[0], key[1]),
+		})
+	}
+	for key, mode := range destTriggers {
+		want, ok := expectMode(key)
+		if !ok || want == mode {
+			continue
+		}
+		discrepancies = append(discrepancies, VerifyDiscrepancy{
+			Table:   key[0],
+			Name:    key[1],
+			Problem: fmt.Sprintf("trigger is in state %s (%s), expected %s (%s)", mode, triggerModes[mode], want, triggerModes[want]),
+			Fix:     fmt.Sprintf("ALTER TABLE %s %s %s;", key[0], triggerModes[want], key[1]),
+		})
+	}
+	sort.Slice(discrepancies, func(i, j int) bool {
+		if discrepancies[i].Table != discrepancies[j].Table {
+			return discrepancies[i].Table < discrepancies[j].Table
+		}
+		return discrepancies[i].Name < discrepancies[j].Name
+	})
+	return discrepancies, nil
+}
+
+// missingExportedObjects returns the schemas, tables, views and functions of
+// the schema file that the destination lacks after the apply
+func missingExportedObjects(dest *DatabaseConfig, schemaFile string) ([]VerifyDiscrepancy, error) {
+	expected, err := schemaFileObjects(schemaFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema file: %v", err)
+	}
+	var current []DatabaseObject
+	err = retryOnReconnect(dest, "verifying", func() error {
+		db, err := openDatabase(dest, dest.Database)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if current, err = listDatabaseObjects(db); err != nil {
+			return fmt.Errorf("failed to list destination objects: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	exported := len(expected)
+	for _, obj := range current {
+		delete(expected, obj)
+	}
+
+	var missing []VerifyDiscrepancy
+	for obj := range expected {
+		missing = append(missing, VerifyDiscrepancy{
+			Table:   obj.Schema,
+			Name:    obj.Name,
+			Problem: obj.Type + " in the schema file is missing",
+			Fix:     fmt.Sprintf("-- %s was not created; see %s", obj, schemaFile),
+		})
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i].Table+"."+missing[i].Name < missing[j].Table+"."+missing[j].Name
+	})
+	logger.Info(fmt.Sprintf("%d of %d exported schema(s), table(s), view(s) and function(s) exist on the destination", exported-len(missing), exported))
+	return missing, nil
+}
+
+// verifyDestination runs the verify step: discrepancies fail the run, with
+// the statements fixing them written to the output directory
+func verifyDestination(dest *DatabaseConfig, schemaFile, timestamp string, options *MigrationOptions, state *RunState) error {
+	logger.Info("Verifying constraint validity, trigger states and table settings on the destination...")
+	discrepancies, err := verifyConstraints(state.Source, dest, schemaFile)
+	if err != nil {
+		return err
+	}
+	settings, err := verifyTableSettings(state.Source, dest, schemaFile)
+	if err != nil {
+		return err
+	}
+	discrepancies = append(discrepancies, settings...)
+	// Tables left out with --skip-unreadable were never meant to match
+	if skipped := skippedTables(state); len(skipped) > 0 {
+		discrepancies = slices.DeleteFunc(discrepancies, func(d VerifyDiscrepancy) bool { return skipped[d.Table] })
+	}
+	if options.Format == DumpFormatPlain && options.Comments != CommentsOnly {
+		missing, err := missingExportedObjects(dest, schemaFile)
+		if err != nil {
+			return err
+		}
+		discrepancies = append(discrepancies, missing...)
+	}
+	state.VerifyDiscrepancies = discrepancies
+	if len(discrepancies) == 0 {
+		logger.Success("All constraints are validated, and triggers and table settings match")
+		return nil
+	}
+
+	for _, d := range discrepancies {
+		logger.Error(fmt.Sprintf("   %s on %s: %s", d.Name, d.Table, d.Problem))
+	}
+	path := filepath.Join(options.OutputDir, fmt.Sprintf("verify_fix_%s_%s.sql", dest.Database, timestamp))
+	var b strings.Builder
+	b.WriteString("-- Statements fixing the discrepancies found when verifying the destination\n\n")
+	for _, d := range discrepancies {
+		b.WriteString(d.Fix + "\n")
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("verification found %d discrepancies and the fix file could not be written: %v", len(discrepancies), err)
+	}
+	state.VerifyFixFile = path
+	return fmt.Errorf("verification found %d discrepancies; fix them with %s", len(discrepancies), path)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Warning codes are stable so automation can allowlist specific warnings
+const (
+	WarnBackupSkipped             = "BACKUP_SKIPPED"
+	WarnConnectionsNotTerminated  = "CONNECTIONS_NOT_TERMINATED"
+	WarnRollbackScriptFailed      = "ROLLBACK_SCRIPT_FAILED"
+	WarnMaintenanceWindowRestored = "MAINTENANCE_WINDOW_RESTORED"
+	WarnDestinationObjectsLost    = "DESTINATION_OBJECTS_LOST"
+	WarnSourceActivity            = "SOURCE_ACTIVITY"
+	WarnSourceActivityCheckFailed = "SOURCE_ACTIVITY_CHECK_FAILED"
+	WarnLargeObjectsNotExported   = "LARGE_OBJECTS_NOT_EXPORTED"
+	WarnLargeObjectsExcluded      = "LARGE_OBJECTS_EXCLUDED"
+	WarnLargeObjectsCheckFailed   = "LARGE_OBJECTS_CHECK_FAILED"
+	WarnDatabaseSettingsUnknown   = "DATABASE_SETTINGS_UNKNOWN"
+	WarnOwnerMissing              = "OWNER_MISSING"
+	WarnTablespaceMissing         = "TABLESPACE_MISSING"
+	WarnNonDeferrableForeignKeys  = "NON_DEFERRABLE_FOREIGN_KEYS"
+	WarnForeignKeyCheckFailed     = "FOREIGN_KEY_CHECK_FAILED"
+	WarnSSLModeOverridden         = "SSL_MODE_OVERRIDDEN"
+	WarnSSLOptional               = "SSL_OPTIONAL"
+	WarnTunnelVerifyFull          = "TUNNEL_VERIFY_FULL"
+	WarnSSHAgentUnavailable       = "SSH_AGENT_UNAVAILABLE"
+	WarnSSHHostKeyUnverified      = "SSH_HOST_KEY_UNVERIFIED"
+	WarnKeyringUnavailable        = "KEYRING_UNAVAILABLE"
+	WarnDockerLocalhost           = "DOCKER_LOCALHOST"
+	WarnSchemaPreviewFailed       = "SCHEMA_PREVIEW_FAILED"
+	WarnReportNotWritten          = "REPORT_NOT_WRITTEN"
+	WarnRolesMissing              = "ROLES_MISSING"
+	WarnPlaceholderRolesCreated   = "PLACEHOLDER_ROLES_CREATED"
+	WarnResumeStateNotWritten     = "RESUME_STATE_NOT_WRITTEN"
+	WarnPartialApply              = "PARTIAL_APPLY"
+	WarnDiskSpaceUnknown          = "DISK_SPACE_UNKNOWN"
+	WarnSourceStandby             = "SOURCE_STANDBY"
+	WarnSourceNotStandby          = "SOURCE_NOT_STANDBY"
+	WarnHotStandbyFeedbackOff     = "HOT_STANDBY_FEEDBACK_OFF"
+	WarnReplicaLagUnknown         = "REPLICA_LAG_UNKNOWN"
+	WarnBackupForced              = "BACKUP_FORCED"
+	WarnCodeObjectsRecreated      = "CODE_OBJECTS_RECREATED"
+	WarnEnumManualAction          = "ENUM_MANUAL_ACTION"
+	WarnEnumReordered             = "ENUM_REORDERED"
+	WarnCollationMismatch         = "COLLATION_MISMATCH"
+	WarnCollationCheckFailed      = "COLLATION_CHECK_FAILED"
+	WarnSearchPathDependent       = "SEARCH_PATH_DEPENDENT"
+	WarnSearchPathAuditFailed     = "SEARCH_PATH_AUDIT_FAILED"
+	WarnOwnershipRemnants         = "OWNERSHIP_REMNANTS"
+	WarnBlackoutOverridden        = "BLACKOUT_OVERRIDDEN"
+	WarnApplyErrorsAllowed        = "APPLY_ERRORS_ALLOWED"
+	WarnFileHeaderInvalid         = "FILE_HEADER_INVALID"
+	WarnBootstrapNotEmpty         = "BOOTSTRAP_NOT_EMPTY"
+	WarnExtensionsUnavailable     = "EXTENSIONS_UNAVAILABLE"
+	WarnEphemeralOutput           = "EPHEMERAL_OUTPUT"
+	WarnDiskSpaceLow              = "DISK_SPACE_LOW"
+	WarnReplicationBreakage       = "REPLICATION_BREAKAGE"
+	WarnPublicationIncomplete     = "PUBLICATION_INCOMPLETE"
+	WarnRolesNotMigrated          = "ROLES_NOT_MIGRATED"
+	WarnGrantsNotRestored         = "GRANTS_NOT_RESTORED"
+	WarnAnalyzeFailed             = "ANALYZE_FAILED"
+	WarnEmptySchema               = "EMPTY_SCHEMA"
+	WarnSplitFilesEdited          = "SPLIT_FILES_EDITED"
+	WarnSplitFilesIgnored         = "SPLIT_FILES_IGNORED"
+	WarnMigrationMarkerUnreadable = "MIGRATION_MARKER_UNREADABLE"
+	WarnMigrationMarkerNotWritten = "MIGRATION_MARKER_NOT_WRITTEN"
+	WarnSchemaAlreadyMigrated     = "SCHEMA_ALREADY_MIGRATED"
+	WarnServerVersionDowngrade    = "SERVER_VERSION_DOWNGRADE"
+	WarnSettingsSkipped           = "SETTINGS_SKIPPED"
+	WarnReconnected               = "RECONNECTED"
+	WarnStaleBackup               = "STALE_BACKUP"
+	WarnStaleBackupUnchecked      = "STALE_BACKUP_UNCHECKED"
+	WarnUnloggedTables            = "UNLOGGED_TABLES"
+	WarnDatabaseSwitches          = "DATABASE_SWITCHES"
+	WarnDatabaseCase              = "DATABASE_CASE"
+	WarnUnreadableSkipped         = "UNREADABLE_SKIPPED"
+	WarnRollbackScriptInvalid     = "ROLLBACK_SCRIPT_INVALID"
+	WarnSlowObjects               = "SLOW_OBJECTS"
+	WarnClusterStatements         = "CLUSTER_STATEMENTS"
+	WarnSSLModeAdjusted           = "SSL_MODE_ADJUSTED"
+	WarnUploadFailed              = "UPLOAD_FAILED"
+	WarnPushRetried               = "PUSH_RETRIED"
+)
+
+// Warning is a problem that did not stop the run
+type Warning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// currentRun receives the warnings of the run in progress
+var currentRun *RunState
+
+// warningsMu guards the warnings of phases running concurrently
+var warningsMu sync.Mutex
+
+// warn logs a warning and records it on the current run under code
+func warn(code, msg string) {
+	logger.Warning(msg)
+	if currentRun != nil {
+		warningsMu.Lock()
+		currentRun.Warnings = append(currentRun.Warnings, Warning{Code: code, Message: msg})
+		warningsMu.Unlock()
+	}
+}
+
+// printWarningSummary repeats the run's warnings, counted by code
+func printWarningSummary(state *RunState) {
+	if len(state.Warnings) == 0 {
+		return
+	}
+
+	counts := make(map[string]int)
+	for _, w := range state.Warnings {
+		counts[w.Code]++
+	}
+	codes := make([]string, 0, len(counts))
+	for code := range counts {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	logger.Info(fmt.Sprintf("Run finished with %d warning(s):", len(state.Warnings)))
+	for _, code := range codes {
+		logger.Info(fmt.Sprintf("   %s: %d", code, counts[code]))
+	}
+	for _, w := range state.Warnings {
+		logger.Info(fmt.Sprintf("   [%s] %s", w.Code, w.Message))
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// driftStateVersion is the version of the watch state file
+const driftStateVersion = 1
+
+// watchFirstBackoff is the wait after the first failed check; it doubles
+// with every further failure up to --max-backoff
+const watchFirstBackoff = 30 * time.Second
+
+// DriftChanges lists the objects that differ between two fingerprints
+type DriftChanges struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+}
+
+func (c *DriftChanges) empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Changed) == 0
+}
+
+// DriftState is the watch state file: the fingerprint of the source schema
+// last seen, with one per object so a change can be pinned down
+type DriftState struct {
+	Version     int               `json:"version"`
+	Source      *ManifestDatabase `json:"source"`
+	Fingerprint string            `json:"fingerprint"`
+	Objects     map[string]string `json:"objects"` // pg_dump entry ("TABLE public.users") to the sha256 of its statements
+	CheckedAt   time.Time         `json:"checked_at"`
+	ChangedAt   time.Time         `json:"changed_at"`
+	LastChanges *DriftChanges     `json:"last_changes,omitempty"`
+}
+
+// schemaFingerprint hashes the per-object hashes in key order
+func schemaFingerprint(objects map[string]string) string {
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s\x00%s\n", key, objects[key])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// diffFingerprints compares the objects of two fingerprints
+func diffFingerprints(before, after map[string]string) *DriftChanges {
+	changes := &DriftChanges{}
+	for key, hash := range after {
+		previous, ok := before[key]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, key)
+		case previous != hash:
+			changes.Changed = append(changes.Changed, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			changes.Removed = append(changes.Removed, key)
+		}
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Changed)
+	return changes
+}
+
+// entryObject returns the object of a pg_dump entry as the ignore list sees it
+func entryObject(e dumpEntry) DatabaseObject {
+	if e.Type == "SCHEMA" {
+		return DatabaseObject{Type: "schema", Name: e.Name}
+	}
+	schema := e.Schema
+	if schema == "-" {
+		schema = ""
+	}
+	return DatabaseObject{Type: strings.ToLower(e.Type), Schema: schema, Name: e.Name}
+}
+
+// fingerprintSchema dumps the schema of source and hashes each entry. The
+// dump is normalized the way converge compares it: ownership and the
+// per-dump \restrict key are left out, and so are ignored objects.
+func fingerprintSchema(source *DatabaseConfig, options *MigrationOptions) (map[string]string, error) {
+	file, err := scratchFile("watch-*.sql")
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	defer releaseScratch(file.Name())
+
+	plain := *options
+	plain.Format = DumpFormatPlain
+	args := removeFromSlice(exportSchemaArgs(source, &plain), "--verbose")
+	args = append(args, "-f", file.Name())
+	cmd := clientCommand(source, "pg_dump", args, file.Name())
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("pg_dump of the source failed: %v", err)
+	}
+	return hashDumpEntries(file.Name(), options.Ignore)
+}
+
+// hashDumpEntries hashes each entry of a plain dump, leaving out ignored
+// objects. Entries sharing a name, such as the parts of a split definition,
+// are hashed together.
+func hashDumpEntries(path string, ignore *IgnoreList) (map[string]string, error) {
+	_, entries, err := parseDumpEntries(path)
+	if err != nil {
+		return nil, err
+	}
+
+	bodies := make(map[string]string)
+	for _, e := range entries {
+		if ignore.Ignored(entryObject(e)) {
+			continue
+		}
+		bodies[e.String()] += e.Body + "\n"
+	}
+	objects := make(map[string]string, len(bodies))
+	for key, body := range bodies {
+		sum := sha256.Sum256([]byte(body))
+		objects[key] = hex.EncodeToString(sum[:])
+	}
+	return objects, nil
+}
+
+// readDriftState reads the watch state file, or returns nil when there is none yet
+func readDriftState(path string) (*DriftState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s DriftState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %v", path, err)
+	}
+	if s.Version > driftStateVersion {
+		return nil, fmt.Errorf("state file %s has version %d, this build reads up to %d", path, s.Version, driftStateVersion)
+	}
+	return &s, nil
+}
+
+// writeDriftState replaces the watch state file atomically
+func writeDriftState(path string, s *DriftState) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".pgsm-watch-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// checkSchemaDrift fingerprints the source schema, compares it with the state
+// file and records the result there. It reports whether the schema changed
+// since the last check; the first check only records the baseline.
+func checkSchemaDrift(source *DatabaseConfig, options *MigrationOptions, statePath string) (bool, error) {
+	if err := refreshCredentials(source); err != nil {
+		return false, err
+	}
+	previous, err := readDriftState(statePath)
+	if err != nil {
+		return false, err
+	}
+	objects, err := fingerprintSchema(source, options)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	current := &DriftState{
+		Version:     driftStateVersion,
+		Source:      manifestDatabase(source),
+		Fingerprint: schemaFingerprint(objects),
+		Objects:     objects,
+		CheckedAt:   now,
+		ChangedAt:   now,
+	}
+	short := current.Fingerprint[:12]
+
+	if previous == nil {
+		logger.Info(fmt.Sprintf("Recorded the schema of '%s' (%d object(s), fingerprint %s) as the baseline in %s",
+			source.Database, len(objects), short, statePath))
+		return false, writeDriftState(statePath, current)
+	}
+
+	changes := diffFingerprints(previous.Objects, objects)
+	if changes.empty() {
+		current.ChangedAt, current.LastChanges = previous.ChangedAt, previous.LastChanges
+		logger.Info(fmt.Sprintf("No schema changes in '%s' since %s (fingerprint %s)",
+			source.Database, previous.ChangedAt.Local().Format(time.RFC3339), short))
+		return false, writeDriftState(statePath, current)
+	}
+
+	current.LastChanges = changes
+	logger.Warning(fmt.Sprintf("Schema of '%s' changed since %s: %d added, %d removed, %d changed (fingerprint %s)",
+		source.Database, previous.CheckedAt.Local().Format(time.RFC3339), len(changes.Added), len(changes.Removed), len(changes.Changed), short))
+	for _, key := range changes.Added {
+		logger.Warning("   + " + key)
+	}
+	for _, key := range changes.Removed {
+		logger.Warning("   - " + key)
+	}
+	for _, key := range changes.Changed {
+		logger.Warning("   ~ " + key)
+	}
+	return true, writeDriftState(statePath, current)
+}
+
+func newWatchCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watch",
+		Short: "Watch the source schema and report when it changes",
+		Long: "Dump the source schema every --interval, fingerprint each object and compare with the fingerprint " +
+			"stored in --state-file. Added, removed and changed objects are logged and the state file is updated. " +
+			"SIGHUP reloads .pgsmignore and the --ignore-object patterns and checks at once; failed checks are " +
+			"retried with a growing backoff. --once checks a single time, for cron.",
+		Args: cobra.NoArgs,
+		RunE: runWatch,
+	}
+
+	addSourceFlags(cmd.Flags())
+	cmd.Flags().DurationP("interval", "", time.Hour, "Time between checks")
+	cmd.Flags().StringP("state-file", "", "drift.json", "File the last seen schema fingerprint is kept in")
+	cmd.Flags().BoolP("once", "", false, "Check once and exit: 0 without changes, 3 when the schema changed")
+	cmd.Flags().DurationP("max-backoff", "", 30*time.Minute, "Longest wait between retries of a failed check")
+	return cmd
+}
+
+func runWatch(cmd *cobra.Command, args []string) error {
+	if err := configureCIOutput(cmd); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+
+	logger.Info("Starting PostgreSQL schema watch...")
+	handleSignals()
+
+	interval, _ := cmd.Flags().GetDuration("interval")
+	statePath, _ := cmd.Flags().GetString("state-file")
+	once, _ := cmd.Flags().GetBool("once")
+	maxBackoff, _ := cmd.Flags().GetDuration("max-backoff")
+	ignorePatterns, _ := cmd.Flags().GetStringArray("ignore-object")
+	if interval <= 0 {
+		return exitWith(exitOptionError, errors.New("--interval must be positive"))
+	}
+	if maxBackoff < watchFirstBackoff {
+		return exitWith(exitOptionError, fmt.Errorf("--max-backoff must be at least %s", watchFirstBackoff))
+	}
+	if statePath == "" {
+		return exitWith(exitOptionError, errors.New("--state-file must not be empty"))
+	}
+
+	if err := validateConnectionFlags(cmd, true, false); err != nil {
+		return exitWith(exitOptionError, err)
+	}
+	options, err := parseMigrationOptions(cmd)
+	if err != nil {
+		return exitWith(exitOptionError, fmt.Errorf("Failed to parse options: %v", err))
+	}
+
+	sourceConfig, err := getSourceConfig(cmd)
+	if err != nil {
+		return exitWith(exitFailure, fmt.Errorf("Failed to get source config: %v", err))
+	}
+
+	// A state file recorded for another database would report everything as changed
+	previous, err := readDriftState(statePath)
+	if err != nil {
+		return exitWith(exitOptionError, err)
+	}
+	if previous != nil && previous.Source != nil && !sameDatabase(previous.Source, sourceConfig) {
+		return exitWith(exitOptionError, fmt.Errorf("State file %s tracks '%s' on %s, not '%s' on %s; use another --state-file",
+			statePath, previous.Source.Database, previous.Source.Host, sourceConfig.Database, sourceConfig.Host))
+	}
+
+	if err := startTunnels(&options.SSH, sourceConfig); err != nil {
+		return exitWith(exitFailure, fmt.Errorf("SSH tunnel setup failed: %v", err))
+	}
+
+	if once {
+		changed, err := checkSchemaDrift(sourceConfig, options, statePath)
+		if err != nil {
+			return exitWith(exitFailure, fmt.Errorf("Schema check failed: %v", err))
+		}
+		if changed {
+			return exitWith(exitDrift, nil)
+		}
+		return nil
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	logger.Info(fmt.Sprintf("Checking the schema of '%s' every %s", sourceConfig.Database, interval))
+
+	var backoff time.Duration
+	for {
+		wait := interval
+		if _, err := checkSchemaDrift(sourceConfig, options, statePath); err != nil {
+			backoff = min(max(2*backoff, watchFirstBackoff), maxBackoff)
+			wait = min(backoff, interval)
+			logger.Error(fmt.Sprintf("Schema check failed: %v; retrying in %s", err, wait))
+		} else {
+			backoff = 0
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-hangup:
+			timer.Stop()
+			logger.Info("Received SIGHUP, reloading the ignore patterns and checking now")
+			ignore, err := loadIgnoreList(ignorePatterns)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Keeping the previous ignore patterns: %v", err))
+			} else {
+				options.Ignore = ignore
+			}
+		}
+	}
+}